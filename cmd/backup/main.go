@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/Chase-Garrett/meadowlark/internal/backup"
+	"github.com/Chase-Garrett/meadowlark/internal/config"
+)
+
+// backup takes and restores SQLite snapshots of the meadowlark database
+// usage:
+//
+//	go run cmd/backup/main.go snapshot <file>   copy the database, safe while the server runs
+//	go run cmd/backup/main.go restore <file>    replace the database, stop the server first
+func main() {
+	if len(os.Args) != 3 {
+		usage()
+	}
+	cfg := config.Load()
+	ctx := context.Background()
+
+	switch os.Args[1] {
+	case "snapshot":
+		db, err := sql.Open("sqlite3", cfg.DBPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer db.Close()
+		if err := backup.Snapshot(ctx, db, os.Args[2]); err != nil {
+			log.Fatalf("Snapshot failed: %v", err)
+		}
+		fmt.Printf("Snapshot of %s written to %s\n", cfg.DBPath, os.Args[2])
+	case "restore":
+		if err := backup.Restore(ctx, os.Args[2], cfg.DBPath); err != nil {
+			log.Fatalf("Restore failed: %v", err)
+		}
+		fmt.Printf("Restored %s from %s\n", cfg.DBPath, os.Args[2])
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: backup snapshot|restore <file>")
+	os.Exit(2)
+}
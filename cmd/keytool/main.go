@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/Chase-Garrett/meadowlark/internal/config"
+	"github.com/Chase-Garrett/meadowlark/internal/server"
+)
+
+// keytool re-encrypts data at rest after a key rotation
+// usage: go run cmd/keytool/main.go rotate
+func main() {
+	if len(os.Args) < 2 || os.Args[1] != "rotate" {
+		fmt.Fprintln(os.Stderr, "usage: keytool rotate")
+		os.Exit(2)
+	}
+
+	cfg := config.Load()
+	store, err := server.NewSecrets(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	storage, err := server.OpenUserStorage(cfg, store)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	report, err := storage.RotateKeys()
+	if err != nil {
+		log.Fatalf("Key rotation failed: %v", err)
+	}
+
+	fmt.Printf("Re-encrypted values: %d\n", report.Reencrypted)
+	fmt.Printf("Users without a pepper: %d\n", report.UnpepperedUsers)
+	for id, count := range report.StalePeppers {
+		fmt.Printf("Users on old pepper %q: %d (migrated on next login)\n", id, count)
+	}
+}
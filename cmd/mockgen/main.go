@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// mockgen writes a mock for every interface declared in a Go file. Each mock has a function
+// field per method, named after it with Func appended, and records its calls. Unset fields
+// make methods returning values panic, so unexpected calls show up, and the others no-ops.
+// usage, usually through go:generate in the package holding the interfaces:
+//
+//	go run cmd/mockgen/main.go -source interfaces.go -out mocks/mocks.go
+func main() {
+	source := flag.String("source", "", "file declaring the interfaces")
+	out := flag.String("out", "", "file to write, its directory names the package")
+	flag.Parse()
+	if *source == "" || *out == "" {
+		fmt.Fprintln(os.Stderr, "usage: mockgen -source <file.go> -out <dir/mocks.go>")
+		os.Exit(2)
+	}
+
+	code, err := generate(*source, filepath.Base(filepath.Dir(*out)))
+	if err != nil {
+		log.Fatalf("mockgen: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(*out), 0755); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*out, code, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// generator turns the interfaces of one source file into mocks in another package
+type generator struct {
+	fset    *token.FileSet
+	srcName string            // package name of the source file
+	imports map[string]string // package name to import path, as imported by the source
+	used    map[string]bool   // import paths the mocks refer to
+}
+
+func generate(source, pkg string) ([]byte, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, source, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	srcPath, err := importPath(filepath.Dir(source))
+	if err != nil {
+		return nil, err
+	}
+
+	g := &generator{
+		fset:    fset,
+		srcName: file.Name.Name,
+		imports: map[string]string{file.Name.Name: srcPath},
+		used:    map[string]bool{srcPath: true, "sync": true},
+	}
+	for _, spec := range file.Imports {
+		path, _ := strconv.Unquote(spec.Path.Value)
+		name := filepath.Base(path)
+		if spec.Name != nil {
+			name = spec.Name.Name
+		}
+		g.imports[name] = path
+	}
+
+	var body bytes.Buffer
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			ts := spec.(*ast.TypeSpec)
+			if iface, ok := ts.Type.(*ast.InterfaceType); ok && ts.Name.IsExported() {
+				if err := g.mock(&body, ts.Name.Name, iface); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by cmd/mockgen from %s. DO NOT EDIT.\n\n", filepath.ToSlash(source))
+	fmt.Fprintf(&buf, "// Package %s has mocks of the interfaces in package %s\n", pkg, g.srcName)
+	fmt.Fprintf(&buf, "package %s\n\nimport (\n", pkg)
+	// standard library first, then the module's and third party packages
+	var std, other []string
+	for path := range g.used {
+		if first, _, _ := strings.Cut(path, "/"); strings.Contains(first, ".") {
+			other = append(other, path)
+		} else {
+			std = append(std, path)
+		}
+	}
+	sort.Strings(std)
+	sort.Strings(other)
+	for i, group := range [][]string{std, other} {
+		if i > 0 && len(group) > 0 {
+			buf.WriteString("\n")
+		}
+		for _, path := range group {
+			fmt.Fprintf(&buf, "\t%q\n", path)
+		}
+	}
+	buf.WriteString(")\n\n")
+	buf.WriteString(recorderSource)
+	buf.Write(body.Bytes())
+	return format.Source(buf.Bytes())
+}
+
+// recorderSource is embedded in every mock to keep its calls
+const recorderSource = `// Call is one method call made on a mock
+type Call struct {
+	Method string
+	Args   []interface{}
+}
+
+type recorder struct {
+	mu    sync.Mutex
+	calls []Call
+}
+
+func (r *recorder) record(method string, args ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, Call{Method: method, Args: args})
+}
+
+// Calls returns the calls made so far, oldest first
+func (r *recorder) Calls() []Call {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Call(nil), r.calls...)
+}
+
+`
+
+// mock writes the struct and methods mocking one interface
+func (g *generator) mock(w *bytes.Buffer, name string, iface *ast.InterfaceType) error {
+	type method struct {
+		name            string
+		params, results []*ast.Field
+		variadic        bool
+	}
+	var methods []method
+	for _, field := range iface.Methods.List {
+		fn, ok := field.Type.(*ast.FuncType)
+		if !ok || len(field.Names) == 0 {
+			return fmt.Errorf("%s embeds %s, only methods are supported", name, g.print(field.Type))
+		}
+		m := method{name: field.Names[0].Name, params: fn.Params.List}
+		if fn.Results != nil {
+			m.results = fn.Results.List
+		}
+		if n := len(m.params); n > 0 {
+			_, m.variadic = m.params[n-1].Type.(*ast.Ellipsis)
+		}
+		methods = append(methods, m)
+	}
+
+	fmt.Fprintf(w, "// %s mocks %s.%s. Methods call the field of the same name with Func appended;\n", name, g.srcName, name)
+	fmt.Fprintf(w, "// when it is unset those returning values panic and the others do nothing\ntype %s struct {\n", name)
+	for _, m := range methods {
+		fmt.Fprintf(w, "\t%sFunc func(%s)%s\n", m.name, g.fields(m.params, false), g.results(m.results))
+	}
+	fmt.Fprintf(w, "\n\trecorder\n}\n\nvar _ %s.%s = (*%s)(nil)\n\n", g.srcName, name, name)
+
+	for _, m := range methods {
+		args := g.names(m.params)
+		call := strings.Join(args, ", ")
+		if m.variadic {
+			call += "..."
+		}
+		recorded := append([]string{strconv.Quote(m.name)}, args...)
+
+		fmt.Fprintf(w, "func (m *%s) %s(%s)%s {\n", name, m.name, g.fields(m.params, true), g.results(m.results))
+		fmt.Fprintf(w, "\tm.record(%s)\n", strings.Join(recorded, ", "))
+		if len(m.results) > 0 {
+			fmt.Fprintf(w, "\tif m.%sFunc == nil {\n\t\tpanic(%q)\n\t}\n", m.name, fmt.Sprintf("%s.%s called but %sFunc is unset", name, m.name, m.name))
+			fmt.Fprintf(w, "\treturn m.%sFunc(%s)\n}\n\n", m.name, call)
+		} else {
+			fmt.Fprintf(w, "\tif m.%sFunc != nil {\n\t\tm.%sFunc(%s)\n\t}\n}\n\n", m.name, m.name, call)
+		}
+	}
+	return nil
+}
+
+// names gives every parameter a name, arg0, arg1... for unnamed ones
+func (g *generator) names(params []*ast.Field) []string {
+	var names []string
+	for _, field := range params {
+		if len(field.Names) == 0 {
+			names = append(names, fmt.Sprintf("arg%d", len(names)))
+		}
+		for _, ident := range field.Names {
+			names = append(names, ident.Name)
+		}
+	}
+	return names
+}
+
+// fields prints a parameter list, with names when named is set
+func (g *generator) fields(params []*ast.Field, named bool) string {
+	names := g.names(params)
+	var parts []string
+	i := 0
+	for _, field := range params {
+		count := len(field.Names)
+		if count == 0 {
+			count = 1
+		}
+		typ := g.print(g.qualify(field.Type))
+		for j := 0; j < count; j++ {
+			if named {
+				parts = append(parts, names[i]+" "+typ)
+			} else {
+				parts = append(parts, typ)
+			}
+			i++
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (g *generator) results(results []*ast.Field) string {
+	switch {
+	case len(results) == 0:
+		return ""
+	case len(results) == 1 && len(results[0].Names) <= 1:
+		return " " + g.print(g.qualify(results[0].Type))
+	default:
+		return " (" + g.fields(results, false) + ")"
+	}
+}
+
+// qualify rewrites a type from the source package for use in the mocks package,
+// noting the imports it needs
+func (g *generator) qualify(expr ast.Expr) ast.Expr {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		if isPredeclared(t.Name) {
+			return t
+		}
+		return &ast.SelectorExpr{X: ast.NewIdent(g.srcName), Sel: ast.NewIdent(t.Name)}
+	case *ast.SelectorExpr:
+		if pkg, ok := t.X.(*ast.Ident); ok && g.imports[pkg.Name] != "" {
+			g.used[g.imports[pkg.Name]] = true
+		}
+		return t
+	case *ast.StarExpr:
+		return &ast.StarExpr{X: g.qualify(t.X)}
+	case *ast.ArrayType:
+		return &ast.ArrayType{Len: t.Len, Elt: g.qualify(t.Elt)}
+	case *ast.MapType:
+		return &ast.MapType{Key: g.qualify(t.Key), Value: g.qualify(t.Value)}
+	case *ast.ChanType:
+		return &ast.ChanType{Dir: t.Dir, Value: g.qualify(t.Value)}
+	case *ast.Ellipsis:
+		return &ast.Ellipsis{Elt: g.qualify(t.Elt)}
+	case *ast.FuncType:
+		return &ast.FuncType{Params: g.qualifyList(t.Params), Results: g.qualifyList(t.Results)}
+	default:
+		return expr
+	}
+}
+
+func (g *generator) qualifyList(list *ast.FieldList) *ast.FieldList {
+	if list == nil {
+		return nil
+	}
+	out := &ast.FieldList{}
+	for _, field := range list.List {
+		out.List = append(out.List, &ast.Field{Names: field.Names, Type: g.qualify(field.Type)})
+	}
+	return out
+}
+
+func (g *generator) print(expr ast.Expr) string {
+	var buf bytes.Buffer
+	printer.Fprint(&buf, g.fset, expr)
+	return buf.String()
+}
+
+// isPredeclared reports whether name is a builtin type rather than one of the source package,
+// whose types have to be exported to appear in the interfaces
+func isPredeclared(name string) bool {
+	return !unicode.IsUpper(rune(name[0]))
+}
+
+// importPath works out the import path of dir from the nearest go.mod
+func importPath(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for root := abs; ; root = filepath.Dir(root) {
+		data, err := os.ReadFile(filepath.Join(root, "go.mod"))
+		if err == nil {
+			for _, line := range strings.Split(string(data), "\n") {
+				if module, ok := strings.CutPrefix(strings.TrimSpace(line), "module "); ok {
+					rel, err := filepath.Rel(root, abs)
+					if err != nil {
+						return "", err
+					}
+					return strings.TrimSpace(module) + "/" + filepath.ToSlash(rel), nil
+				}
+			}
+			return "", fmt.Errorf("no module line in %s", filepath.Join(root, "go.mod"))
+		}
+		if root == filepath.Dir(root) {
+			return "", fmt.Errorf("no go.mod above %s", dir)
+		}
+	}
+}
@@ -1,9 +1,21 @@
 package main
 
 import (
+	"flag"
+	"os"
+
 	"github.com/Chase-Garrett/meadowlark/internal/server"
 )
 
 func main() {
+	dev := flag.Bool("dev", false, "developer mode: in-memory database with seeded users and rooms, any origin and verbose logging (same as MEADOWLARK_DEV=true)")
+	flag.Parse()
+	if flag.Arg(0) == "doctor" {
+		os.Exit(server.Doctor(os.Stdout))
+	}
+	// configuration comes from the environment, so the flag is passed on the same way
+	if *dev {
+		os.Setenv("MEADOWLARK_DEV", "true")
+	}
 	server.Start()
 }
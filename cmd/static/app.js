@@ -12,6 +12,27 @@ class MeadowlarkApp {
         this.keys = null; // {publicKey: CryptoKey, privateKey: CryptoKey}
         this.recipientPublicKeys = new Map(); // Map<username, CryptoKey>
         this.publicKeyCache = new Map(); // Map<username, base64 string>
+        this.seenMessageIds = new Set(); // ids already shown, backfilled messages may repeat live ones
+        this.streamReceived = new Map(); // Map<stream id, messages read since credit was last granted>
+    }
+
+    // deviceId identifies this browser across connections, sent in the hello
+    get deviceId() {
+        let id = localStorage.getItem('meadowlark_device_id');
+        if (!id) {
+            id = crypto.randomUUID();
+            localStorage.setItem('meadowlark_device_id', id);
+        }
+        return id;
+    }
+
+    // cursor is the id of the newest message this device has seen
+    get cursor() {
+        return Number(localStorage.getItem('meadowlark_cursor') || 0);
+    }
+
+    set cursor(id) {
+        localStorage.setItem('meadowlark_cursor', String(id));
     }
 
     init() {
@@ -52,15 +73,52 @@ class MeadowlarkApp {
         }
 
         try {
-            const response = await fetch('/api/login', {
+            const response = await fetch('api/login', {
                 method: 'POST',
                 headers: { 'Content-Type': 'application/json' },
                 body: JSON.stringify({ username, password })
             });
 
-            const data = await response.json();
+            let data = await response.json();
+
+            if (data.code === 'password_reset_required') {
+                // a sign-in was reported as not the user's, the password only works to replace it
+                const newPassword = prompt('A sign-in to this account was reported. Choose a new password:');
+                if (!newPassword) {
+                    this.showAlert(alertDiv, data.error);
+                    return;
+                }
+                const body = { username, password, newPassword };
+                if (data.params && data.params.passkey) {
+                    body.recoveryCode = prompt('Enter one of your recovery codes:') || '';
+                }
+                const reset = await fetch('api/login', {
+                    method: 'POST',
+                    headers: { 'Content-Type': 'application/json' },
+                    body: JSON.stringify(body)
+                });
+                data = await reset.json();
+            }
 
-            if (response.ok) {
+            if (response.ok && data.passkey) {
+                // the account requires a passkey after the password, or one of its recovery codes
+                try {
+                    data = await this.confirmWithPasskey(data.passkey);
+                } catch (error) {
+                    const recoveryCode = prompt('No passkey at hand? Enter one of your recovery codes:');
+                    if (!recoveryCode) {
+                        throw error;
+                    }
+                    const recovery = await fetch('api/login', {
+                        method: 'POST',
+                        headers: { 'Content-Type': 'application/json' },
+                        body: JSON.stringify({ username, password, recoveryCode })
+                    });
+                    data = await recovery.json();
+                }
+            }
+
+            if (data.token) {
                 this.token = data.token;
                 this.username = data.username;
                 localStorage.setItem('meadowlark_token', this.token);
@@ -79,6 +137,38 @@ class MeadowlarkApp {
         }
     }
 
+    // confirmWithPasskey answers a passkey challenge from the server and returns the login response
+    async confirmWithPasskey(challenge) {
+        const fromB64 = (s) => Uint8Array.from(atob(s.replace(/-/g, '+').replace(/_/g, '/')), c => c.charCodeAt(0));
+        const toB64 = (buf) => btoa(String.fromCharCode(...new Uint8Array(buf)))
+            .replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+
+        const options = challenge.publicKey;
+        const credential = await navigator.credentials.get({
+            publicKey: {
+                ...options,
+                challenge: fromB64(options.challenge),
+                allowCredentials: (options.allowCredentials || []).map(c => ({ ...c, id: fromB64(c.id) }))
+            }
+        });
+        const response = await fetch('api/login/passkey', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({
+                challengeId: challenge.challengeId,
+                credential: {
+                    id: credential.id,
+                    response: {
+                        clientDataJSON: toB64(credential.response.clientDataJSON),
+                        authenticatorData: toB64(credential.response.authenticatorData),
+                        signature: toB64(credential.response.signature)
+                    }
+                }
+            })
+        });
+        return response.json();
+    }
+
     async initializeEncryption() {
         // Try to load existing keys
         this.keys = await cryptoUtils.loadKeys();
@@ -133,7 +223,7 @@ class MeadowlarkApp {
             await cryptoUtils.storeKeys(keyPair);
 
             // Register with public key
-            const response = await fetch('/api/register', {
+            const response = await fetch('api/register', {
                 method: 'POST',
                 headers: { 'Content-Type': 'application/json' },
                 body: JSON.stringify({ 
@@ -146,7 +236,11 @@ class MeadowlarkApp {
 
             const data = await response.json();
 
-            if (response.ok) {
+            if (response.ok && data.recoveryCodes) {
+                // shown once, the server only keeps their hashes
+                this.showAlert(alertDiv, 'Registration successful! Save these recovery codes somewhere safe, ' +
+                    'each signs you in once if you lose your passkeys: ' + data.recoveryCodes.join(' '), 'success');
+            } else if (response.ok) {
                 this.showAlert(alertDiv, 'Registration successful! Please login.', 'success');
                 setTimeout(() => this.toggleAuthForm(), 1500);
             } else {
@@ -181,6 +275,7 @@ class MeadowlarkApp {
     logout() {
         localStorage.removeItem('meadowlark_token');
         localStorage.removeItem('meadowlark_username');
+        localStorage.removeItem('meadowlark_cursor');
         if (this.socket) {
             this.socket.close();
         }
@@ -188,29 +283,48 @@ class MeadowlarkApp {
     }
 
     connectWebSocket() {
-        const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
-        const wsUrl = `${protocol}//${window.location.host}/ws?token=${encodeURIComponent(this.token)}`;
+        // relative to the page so the app also works under a base path like /chat/
+        const wsUrl = new URL(`ws?token=${encodeURIComponent(this.token)}`, window.location.href);
+        wsUrl.protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
 
         this.socket = new WebSocket(wsUrl);
+        this.socket.binaryType = 'arraybuffer';
 
         this.socket.onopen = () => {
             console.log('WebSocket connected');
+            // the server waits for this before sending anything
+            const hello = {type: 'hello', deviceId: this.deviceId, version: '4'};
+            if (this.cursor > 0) {
+                hello.cursor = String(this.cursor);
+            }
+            this.socket.send(JSON.stringify(hello));
             this.updateConnectionStatus(true);
             this.reconnectAttempts = 0;
         };
 
         this.socket.onmessage = async (event) => {
             try {
-                const message = JSON.parse(event.data);
-                await this.handleIncomingMessage(message);
+                if (event.data instanceof ArrayBuffer) {
+                    await this.handleIncomingMessage(this.parseBinaryFrame(event.data));
+                    return;
+                }
+                // from protocol version 3 a frame may hold a batch of messages
+                const data = JSON.parse(event.data);
+                for (const message of Array.isArray(data) ? data : [data]) {
+                    await this.handleIncomingMessage(message);
+                }
             } catch (error) {
                 console.error('Error parsing WebSocket message:', error);
             }
         };
 
-        this.socket.onclose = () => {
+        this.socket.onclose = (event) => {
             console.log('WebSocket disconnected');
             this.updateConnectionStatus(false);
+            // 4009 already connected, 4010 signed in elsewhere: reconnecting would fight the other session
+            if (event.code === 4009 || event.code === 4010) {
+                return;
+            }
             this.attemptReconnect();
         };
 
@@ -219,10 +333,134 @@ class MeadowlarkApp {
         };
     }
 
+    // parseBinaryFrame reads a binary frame, protocol version 4: the length of a JSON header as
+    // two big-endian bytes, the header and the raw content, which the rest of the app expects
+    // base64 encoded like in text frames
+    parseBinaryFrame(buffer) {
+        const size = new DataView(buffer).getUint16(0);
+        const message = JSON.parse(new TextDecoder().decode(new Uint8Array(buffer, 2, size)));
+        message.content = cryptoUtils.arrayBufferToBase64(buffer.slice(2 + size));
+        return message;
+    }
+
+    handleControlMessage(control) {
+        switch (control.event) {
+            case 'hello': {
+                const data = control.data || {};
+                console.log(`Session ${data.sessionId}, protocol ${data.version}, ${data.pending} messages missed`);
+                if (data.pending > 0 && !data.backfill) {
+                    console.warn('Too many messages were missed to replay, reload to sync them.');
+                }
+                if (this.cursor === 0) {
+                    this.cursor = data.cursor;
+                }
+                break;
+            }
+            case 'backfill_done': {
+                const data = control.data || {};
+                console.log(`Replaying ${data.count} missed messages on ${(data.streams || []).length} streams`);
+                break;
+            }
+            case 'stream_open':
+            case 'stream_end':
+                break;
+            case 'shutdown_warning': {
+                const data = control.data || {};
+                const reason = data.message ? ` ${data.message}` : '';
+                console.warn(`Server entering maintenance, disconnecting in ${data.disconnectSeconds}s.${reason}`);
+                break;
+            }
+            case 'undeliverable': {
+                const data = control.data || {};
+                console.warn(`Message ${data.messageId || ''} to ${data.recipient} was not delivered: ${data.reason}`);
+                break;
+            }
+            case 'signed_in_elsewhere': {
+                const data = control.data || {};
+                console.warn(`Signed in on another device (${data.userAgent || 'unknown client'}), this session was closed.`);
+                break;
+            }
+            case 'new_device': {
+                const data = control.data || {};
+                const where = `${data.userAgent || 'an unknown client'} at ${data.ip}`;
+                if (confirm(`Your account was signed in to from ${where}. Was this you?`)) {
+                    break;
+                }
+                this.reportSignIn(data.id);
+                break;
+            }
+            case 'duplicate': {
+                const data = control.data || {};
+                console.log(`Message ${data.clientId} was already delivered`);
+                break;
+            }
+            case 'error': {
+                const data = control.data || {};
+                console.warn(`Server rejected a message (${data.code}): ${data.error}`);
+                break;
+            }
+            default:
+                console.log('Unhandled control message:', control);
+        }
+    }
+
+    // reportSignIn tells the server a new_device sign-in wasn't the user's, which signs out every
+    // session, this one included, until a new password is chosen at login
+    async reportSignIn(id) {
+        try {
+            const response = await fetch('api/sessions/report', {
+                method: 'POST',
+                headers: {
+                    'Authorization': `Bearer ${this.token}`,
+                    'Content-Type': 'application/json'
+                },
+                body: JSON.stringify({ id })
+            });
+            if (!response.ok) {
+                throw new Error((await response.json()).error);
+            }
+            alert('The sign-in was reported and every session signed out. Log in again to choose a new password.');
+        } catch (error) {
+            console.error('Error reporting sign-in:', error);
+        }
+    }
+
+    // grantCredit lets a stream send more once half its window has been read
+    grantCredit(stream) {
+        const read = (this.streamReceived.get(stream) || 0) + 1;
+        if (read < 32) {
+            this.streamReceived.set(stream, read);
+            return;
+        }
+        this.streamReceived.set(stream, 0);
+        this.socket.send(JSON.stringify({type: 'window', stream: String(stream), credit: String(read)}));
+    }
+
     async handleIncomingMessage(message) {
+        if (message.stream && message.type !== 'control') {
+            this.grantCredit(message.stream);
+        } else if (message.stream && message.control && message.control.event === 'stream_end') {
+            this.streamReceived.delete(message.stream);
+        }
+        if (message.type === 'control') {
+            this.handleControlMessage(message.control || {});
+            return;
+        }
+
         // Backend sends: { Recipient, Sender, Content: []byte }
         // Content is encrypted and base64 encoded in JSON
         
+        // room messages are numbered separately and not replayed
+        if (message.id && !message.room) {
+            if (this.seenMessageIds.has(message.id)) {
+                return;
+            }
+            this.seenMessageIds.add(message.id);
+            if (message.id > this.cursor) {
+                this.cursor = message.id;
+            }
+        }
+
         const sender = message.sender || message.Sender;
         const recipient = message.recipient || message.Recipient;
         
@@ -298,15 +536,23 @@ class MeadowlarkApp {
 
     async loadUsers() {
         try {
-            const response = await fetch('/api/users', {
-                headers: { 'Authorization': `Bearer ${this.token}` }
-            });
-            
-            if (!response.ok) {
-                throw new Error('Failed to load users');
-            }
-            
-            const users = await response.json();
+            const users = [];
+            let cursor = '';
+            do {
+                const params = new URLSearchParams({ limit: '500' });
+                if (cursor) params.set('cursor', cursor);
+                const response = await fetch(`api/users?${params}`, {
+                    headers: { 'Authorization': `Bearer ${this.token}` }
+                });
+
+                if (!response.ok) {
+                    throw new Error('Failed to load users');
+                }
+
+                const page = await response.json();
+                users.push(...page.users);
+                cursor = page.nextCursor;
+            } while (cursor);
             // Filter out current user
             this.users = users.filter(u => u !== this.username);
             this.displayUsers(this.users);
@@ -371,7 +617,7 @@ class MeadowlarkApp {
         }
 
         try {
-            const response = await fetch(`/keys/${username}`);
+            const response = await fetch(`keys/${username}`);
             if (!response.ok) {
                 console.warn(`Could not fetch public key for ${username}`);
                 return null;
@@ -461,7 +707,9 @@ class MeadowlarkApp {
             const message = {
                 recipient: this.currentRecipient,
                 sender: this.username,
-                content: encryptedBase64
+                content: encryptedBase64,
+                // lets the server drop the message if it is ever resubmitted
+                clientId: crypto.randomUUID ? crypto.randomUUID() : undefined
             };
 
             // Also add to local history immediately for better UX (plain text)
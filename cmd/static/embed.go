@@ -0,0 +1,9 @@
+// Package static embeds the web interface so the server binary can run without the source tree
+package static
+
+import "embed"
+
+// Files holds the web interface, served when cmd/static isn't on disk and in desktop mode
+//
+//go:embed *.html *.js *.css
+var Files embed.FS
@@ -9,3 +9,5 @@ require (
 )
 
 require github.com/golang-jwt/jwt/v5 v5.3.0
+
+require golang.org/x/sys v0.35.0 // indirect
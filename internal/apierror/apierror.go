@@ -0,0 +1,246 @@
+package apierror
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// stable error codes, each has a translation under "errors.<code>"
+const (
+	InvalidJSON      = "invalid_json"
+	InvalidRequest   = "invalid_request"
+	MethodNotAllowed = "method_not_allowed"
+	NotFound         = "not_found"
+	PayloadTooLarge  = "payload_too_large"
+	InternalError    = "internal_error"
+	Maintenance      = "maintenance"
+
+	AuthRequired       = "auth_required"
+	InvalidToken       = "invalid_token"
+	TokenExpired       = "token_expired"
+	AdminRequired      = "admin_required"
+	MissingCredentials = "missing_credentials"
+	PasswordTooShort   = "password_too_short"
+	UsernameTaken      = "username_taken"
+	InvalidCredentials = "invalid_credentials"
+	InvalidPublicKey   = "invalid_public_key"
+	UserNotFound       = "user_not_found"
+	InvalidUsername    = "invalid_username"
+	AdminRename        = "admin_rename_forbidden"
+	AdminDeletion      = "admin_deletion_forbidden"
+	InvalidEmail       = "invalid_email"
+	EmailTaken         = "email_taken"
+	InvalidPhone       = "invalid_phone"
+	PhoneTaken         = "phone_taken"
+	VerificationFailed = "verification_failed"
+	VerificationWait   = "verification_wait"
+	SMSFailed          = "sms_failed"
+	EmailFailed        = "email_failed"
+	EmailNotVerified   = "email_not_verified"
+	TooManyIdentifiers = "too_many_identifiers"
+	PublicKeyMissing   = "public_key_missing"
+	UnknownLogHead     = "unknown_log_head"
+
+	AttachmentNotFound        = "attachment_not_found"
+	AttachmentSizeOutOfRange  = "attachment_size_out_of_range"
+	AttachmentNotOwned        = "attachment_not_owned"
+	AttachmentAlreadyUploaded = "attachment_already_uploaded"
+	AttachmentSizeMismatch    = "attachment_size_mismatch"
+	AttachmentIncomplete      = "attachment_incomplete"
+	InvalidAttachmentHash     = "invalid_attachment_hash"
+	AttachmentHashMismatch    = "attachment_hash_mismatch"
+	ThumbnailSizeOutOfRange   = "thumbnail_size_out_of_range"
+	ThumbnailNotAllowed       = "thumbnail_not_allowed"
+	InvalidAudioMetadata      = "invalid_audio_metadata"
+	UploadFailed              = "upload_failed"
+	InvalidUploadOffset       = "invalid_upload_offset"
+	UploadOffsetMismatch      = "upload_offset_mismatch"
+	UploadInProgress          = "upload_in_progress"
+
+	UnknownRegion  = "unknown_region"
+	ExportDisabled = "export_disabled"
+
+	LegalHoldDisabled = "legal_hold_disabled"
+	NotUnderLegalHold = "not_under_legal_hold"
+
+	BackupDestination    = "backup_destination"
+	StorageNotConfigured = "storage_not_configured"
+	BackupFailed         = "backup_failed"
+
+	UnknownProfile    = "unknown_profile"
+	ProfileInProgress = "profile_in_progress"
+
+	UnknownFeatureFlag = "unknown_feature_flag"
+	FeatureDisabled    = "feature_disabled"
+
+	PlanLimitReached = "plan_limit_reached"
+
+	EmojiNotFound        = "emoji_not_found"
+	InvalidPackID        = "invalid_pack_id"
+	InvalidCursor        = "invalid_cursor"
+	InvalidSequenceRange = "invalid_sequence_range"
+	NegativeDuration     = "negative_duration"
+	InvalidSpamAction    = "invalid_spam_action"
+	HeldMessageNotFound  = "held_message_not_found"
+	LocaleNotFound       = "locale_not_found"
+
+	RoomNotFound           = "room_not_found"
+	NotRoomMember          = "not_room_member"
+	RoomForbidden          = "room_forbidden"
+	RoomReadOnly           = "room_read_only"
+	RoomMuted              = "room_muted"
+	RoomSlowMode           = "room_slow_mode"
+	InvalidSlowMode        = "invalid_slow_mode"
+	NotMuted               = "not_muted"
+	InvalidRoomName        = "invalid_room_name"
+	InvalidRoomTopic       = "invalid_room_topic"
+	InvalidRoomDescription = "invalid_room_description"
+	InvalidRoomRules       = "invalid_room_rules"
+	InvalidJoinQuestion    = "invalid_join_question"
+	RulesNotAccepted       = "rules_not_accepted"
+	JoinAnswerRequired     = "join_answer_required"
+	JoinRequestNotFound    = "join_request_not_found"
+	InvalidRoomAvatar      = "invalid_room_avatar"
+	RoomAvatarNotFound     = "room_avatar_not_found"
+	TooManyPins            = "too_many_pins"
+	NotPinned              = "not_pinned"
+	RoomMessageNotFound    = "room_message_not_found"
+	InvalidRoomRole        = "invalid_room_role"
+	LastRoomOwner          = "last_room_owner"
+	RoomMemberExists       = "room_member_exists"
+	CursorExpired          = "cursor_expired"
+	PublicRoomsDisabled    = "public_rooms_disabled"
+	BroadcastNotAllowed    = "broadcast_not_allowed"
+	RoomNotBroadcast       = "room_not_broadcast"
+	InvalidPublicPost      = "invalid_public_post"
+	PublicPostNotFound     = "public_post_not_found"
+	InvalidEvent           = "invalid_event"
+	InvalidEventText       = "invalid_event_text"
+	EventNotFound          = "event_not_found"
+	InvalidRSVP            = "invalid_rsvp"
+	InvalidPoll            = "invalid_poll"
+	PollNotFound           = "poll_not_found"
+	InvalidVote            = "invalid_vote"
+	PollClosed             = "poll_closed"
+	RoomArchivesDisabled   = "room_archives_disabled"
+	InvalidArchiveURL      = "invalid_archive_url"
+	RoomArchiveNotFound    = "room_archive_not_found"
+	RoomExportsDisabled    = "room_exports_disabled"
+	InvalidRoomExport      = "invalid_room_export"
+	RoomExportNotFound     = "room_export_not_found"
+
+	InvalidAttachmentPolicy   = "invalid_attachment_policy"
+	RoomAttachmentsNotAllowed = "room_attachments_not_allowed"
+	AttachmentTypeNotAllowed  = "attachment_type_not_allowed"
+
+	PreviewsDisabled = "previews_disabled"
+	PreviewBlocked   = "preview_blocked"
+	PreviewFailed    = "preview_failed"
+
+	LinksNotAllowed   = "links_not_allowed"
+	BlockedWord       = "blocked_word"
+	InvalidCharacters = "invalid_characters"
+
+	TicketNotFound = "ticket_not_found"
+	TicketClosed   = "ticket_closed"
+
+	UnknownInboundAddress = "unknown_inbound_address"
+	SenderNotAllowed      = "sender_not_allowed"
+
+	InvalidLocationDuration = "invalid_location_duration"
+	TooManyLocationShares   = "too_many_location_shares"
+	LocationShareNotFound   = "location_share_not_found"
+	LocationTooFrequent     = "location_too_frequent"
+
+	ConversationNotFound        = "conversation_not_found"
+	InvalidConversationSettings = "invalid_conversation_settings"
+	MessageNotFound             = "message_not_found"
+	TooManySavedMessages        = "too_many_saved_messages"
+	StaleDraft                  = "stale_draft"
+
+	InvalidPasskey           = "invalid_passkey"
+	PasskeyNotFound          = "passkey_not_found"
+	PasskeyChallengeExpired  = "passkey_challenge_expired"
+	TooManyPasskeys          = "too_many_passkeys"
+	PasskeyAlreadyRegistered = "passkey_already_registered"
+	NoPasskeys               = "no_passkeys"
+	LastPasskey              = "last_passkey"
+
+	InvalidDPoPProof = "invalid_dpop_proof"
+	DPoPRequired     = "dpop_required"
+
+	InvalidScope         = "invalid_scope"
+	InsufficientScope    = "insufficient_scope"
+	InvalidKeyThumbprint = "invalid_key_thumbprint"
+
+	InvalidRecoveryCode = "invalid_recovery_code"
+
+	PasswordResetRequired = "password_reset_required"
+	SessionEventNotFound  = "session_event_not_found"
+
+	// websocket only
+	InvalidFrame       = "invalid_frame"
+	InvalidClientID    = "invalid_client_id"
+	HelloRequired      = "hello_required"
+	UnsupportedVersion = "unsupported_protocol_version"
+	UnknownCommand     = "unknown_command"
+	InvalidCommand     = "invalid_command"
+	UnknownRecipient   = "unknown_recipient"
+	CannotDeliver      = "cannot_deliver"
+	QueueFull          = "queue_full"
+	RateLimited        = "rate_limited"
+	TooManyConnections = "too_many_connections"
+	OriginNotAllowed   = "origin_not_allowed"
+	AlreadyConnected   = "already_connected"
+	SignedInElsewhere  = "signed_in_elsewhere"
+	UsernameChanged    = "username_changed"
+	PasswordChanged    = "password_changed"
+	AccountDeleted     = "account_deleted"
+	Kicked             = "kicked"
+)
+
+// Error is a structured error clients can program against and localize
+type Error struct {
+	Status int                    // HTTP status, not serialized
+	Code   string                 // one of the constants above
+	Params map[string]interface{} // values substituted into the message
+}
+
+// New creates an error with the given HTTP status and code
+func New(status int, code string) *Error {
+	return &Error{Status: status, Code: code}
+}
+
+// Invalid wraps a validation error from a lower layer, its text becomes the detail param
+func Invalid(err error) *Error {
+	return New(http.StatusBadRequest, InvalidRequest).With("detail", err.Error())
+}
+
+// With adds a message parameter
+func (e *Error) With(key string, value interface{}) *Error {
+	if e.Params == nil {
+		e.Params = make(map[string]interface{})
+	}
+	e.Params[key] = value
+	return e
+}
+
+// MessageKey is the translation key for the error
+func (e *Error) MessageKey() string {
+	return "errors." + e.Code
+}
+
+// Error renders the message in the default locale
+func (e *Error) Error() string {
+	return Format(DefaultLocale, e.MessageKey(), e.Params)
+}
+
+// MarshalJSON keeps the English text under "error" so existing clients still work
+func (e *Error) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Error      string                 `json:"error"`
+		Code       string                 `json:"code"`
+		MessageKey string                 `json:"messageKey"`
+		Params     map[string]interface{} `json:"params,omitempty"`
+	}{e.Error(), e.Code, e.MessageKey(), e.Params})
+}
@@ -0,0 +1,90 @@
+package apierror
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+)
+
+// DefaultLocale is used for the "error" text and for keys missing from other locales
+const DefaultLocale = "en"
+
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+// bundles maps locale to translation key to message template
+var bundles = loadBundles()
+
+func loadBundles() map[string]map[string]string {
+	entries, err := localeFiles.ReadDir("locales")
+	if err != nil {
+		log.Fatalf("Failed to read error translations: %v", err)
+	}
+	result := make(map[string]map[string]string)
+	for _, entry := range entries {
+		data, err := localeFiles.ReadFile(path.Join("locales", entry.Name()))
+		if err != nil {
+			log.Fatalf("Failed to read %s: %v", entry.Name(), err)
+		}
+		var messages map[string]string
+		if err := json.Unmarshal(data, &messages); err != nil {
+			log.Fatalf("Invalid translations in %s: %v", entry.Name(), err)
+		}
+		result[strings.TrimSuffix(entry.Name(), ".json")] = messages
+	}
+	return result
+}
+
+// Locales lists the available translation bundles
+func Locales() []string {
+	locales := make([]string, 0, len(bundles))
+	for locale := range bundles {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// Match finds the bundle for a locale tag such as "es-MX", falling back to its base language
+func Match(locale string) (string, bool) {
+	locale = strings.ToLower(strings.ReplaceAll(locale, "_", "-"))
+	if _, ok := bundles[locale]; ok {
+		return locale, true
+	}
+	base, _, _ := strings.Cut(locale, "-")
+	if _, ok := bundles[base]; ok {
+		return base, true
+	}
+	return "", false
+}
+
+// Bundle returns every message for locale, with default locale entries filling any gaps
+func Bundle(locale string) map[string]string {
+	messages := make(map[string]string, len(bundles[DefaultLocale]))
+	for key, msg := range bundles[DefaultLocale] {
+		messages[key] = msg
+	}
+	for key, msg := range bundles[locale] {
+		messages[key] = msg
+	}
+	return messages
+}
+
+// Format renders a message template, replacing {name} with params["name"]
+func Format(locale, key string, params map[string]interface{}) string {
+	msg, ok := bundles[locale][key]
+	if !ok {
+		msg, ok = bundles[DefaultLocale][key]
+	}
+	if !ok {
+		return key
+	}
+	for name, value := range params {
+		msg = strings.ReplaceAll(msg, "{"+name+"}", fmt.Sprint(value))
+	}
+	return msg
+}
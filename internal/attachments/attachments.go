@@ -0,0 +1,686 @@
+package attachments
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/dbutil"
+)
+
+// Attachment describes an uploaded encrypted blob
+type Attachment struct {
+	ID        string    `json:"id"`
+	Owner     string    `json:"owner"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"createdAt"`
+	Region    string    `json:"region,omitempty"` // data residency region holding the blob, empty for the main backend
+	// false until the client finished a presigned upload
+	Complete bool `json:"complete"`
+	// hex SHA-256 of the ciphertext, declared by the client or computed on upload
+	SHA256 string `json:"sha256,omitempty"`
+	// key of the blob in the region's backend, shared by attachments with the same content
+	Blob string `json:"-"`
+	// for a thumbnail, the attachment it previews. Thumbnails are kept and deleted with it
+	ThumbnailOf string `json:"thumbnailOf,omitempty"`
+	// subtype such as KindAudio, empty for a plain file
+	Kind  string `json:"kind,omitempty"`
+	Audio *Audio `json:"audio,omitempty"` // set for KindAudio
+	// id of the room it was reserved for, empty for a direct message. Only the room's
+	// members and the owner can fetch it
+	Room string `json:"room,omitempty"`
+}
+
+// KindAudio marks a voice message or other recording, which carries Audio metadata
+const KindAudio = "audio"
+
+// Audio is what a client needs to draw an audio message before downloading it. It is
+// supplied by the sender and stored unencrypted
+type Audio struct {
+	DurationMS int64  `json:"durationMs"`
+	Waveform   []byte `json:"waveform,omitempty"` // one amplitude per sample, 0 to 255, base64 in JSON
+}
+
+// Storage keeps attachment metadata in SQLite and blobs in a BlobStore,
+// with a separate BlobStore for each data residency region. Blobs are content
+// addressed: attachments whose ciphertext hashes the same share one blob, counted
+// in attachment_blobs and removed once nothing references it
+type Storage struct {
+	db      *sql.DB
+	blobs   BlobStore
+	regions map[string]BlobStore
+}
+
+// NewStorage initializes the attachments table on an open database
+func NewStorage(db *sql.DB, blobs BlobStore, regions map[string]BlobStore) *Storage {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS attachments (
+		"id" TEXT NOT NULL PRIMARY KEY,
+		"owner" TEXT NOT NULL,
+		"size" INTEGER NOT NULL,
+		"complete" INTEGER NOT NULL DEFAULT 0,
+		"created_at" INTEGER NOT NULL);`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Fatalf("Failed to create attachments table: %v", err)
+	}
+	if err := dbutil.AddColumnIfMissing(db, "attachments", "region", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		log.Fatalf("Failed to migrate attachments table: %v", err)
+	}
+	if err := migrateBlobs(db); err != nil {
+		log.Fatalf("Failed to migrate attachment blobs: %v", err)
+	}
+
+	return &Storage{db: db, blobs: blobs, regions: regions}
+}
+
+// migrateBlobs adds the blob reference counts. Blobs uploaded before them stay under
+// their attachment id with an unknown hash, so they are never shared
+func migrateBlobs(db *sql.DB) error {
+	createSQL := `
+	CREATE TABLE IF NOT EXISTS attachment_blobs (
+		"region" TEXT NOT NULL,
+		"key" TEXT NOT NULL,
+		"sha256" TEXT NOT NULL,
+		"size" INTEGER NOT NULL,
+		"refs" INTEGER NOT NULL,
+		"created_at" INTEGER NOT NULL,
+		PRIMARY KEY (region, key));
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_attachment_blobs_sha256
+		ON attachment_blobs(region, sha256) WHERE sha256 != '' AND refs > 0;
+	CREATE INDEX IF NOT EXISTS idx_attachment_blobs_unreferenced ON attachment_blobs(refs) WHERE refs = 0;`
+	if _, err := db.Exec(createSQL); err != nil {
+		return err
+	}
+	if err := dbutil.AddColumnIfMissing(db, "attachments", "sha256", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := dbutil.AddColumnIfMissing(db, "attachments", "thumbnail_of", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	for column, definition := range map[string]string{
+		"kind":              "TEXT NOT NULL DEFAULT ''",
+		"audio_duration_ms": "INTEGER NOT NULL DEFAULT 0",
+		"audio_waveform":    "BLOB",
+		"room":              "TEXT NOT NULL DEFAULT ''",
+	} {
+		if err := dbutil.AddColumnIfMissing(db, "attachments", column, definition); err != nil {
+			return err
+		}
+	}
+	thumbnailSQL := `CREATE UNIQUE INDEX IF NOT EXISTS idx_attachments_thumbnail_of ON attachments(thumbnail_of) WHERE thumbnail_of != '';
+	CREATE INDEX IF NOT EXISTS idx_attachments_room ON attachments(room) WHERE room != ''`
+	if _, err := db.Exec(thumbnailSQL); err != nil {
+		return err
+	}
+	var exists bool
+	if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM pragma_table_info('attachments') WHERE name = 'blob')`).Scan(&exists); err != nil || exists {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	migrateSQL := `
+	ALTER TABLE attachments ADD COLUMN "blob" TEXT NOT NULL DEFAULT '';
+	UPDATE attachments SET blob = id;
+	INSERT INTO attachment_blobs (region, key, sha256, size, refs, created_at)
+		SELECT region, id, '', size, 1, created_at FROM attachments WHERE complete = 1;`
+	if _, err := tx.Exec(migrateSQL); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Blobs returns the backend holding attachment data for a region, the main one for ""
+func (s *Storage) Blobs(region string) (BlobStore, error) {
+	if region == "" {
+		return s.blobs, nil
+	}
+	blobs, ok := s.regions[region]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownRegion, region)
+	}
+	return blobs, nil
+}
+
+// HasRegion reports whether region is configured, "" always is
+func (s *Storage) HasRegion(region string) bool {
+	_, err := s.Blobs(region)
+	return err == nil
+}
+
+// Create records a new attachment whose blob will be kept in region and returns it.
+// When sha256, the hex hash of the ciphertext, matches a blob already stored in region
+// the attachment shares it and comes back complete. Otherwise the blob is uploaded
+// separately and checked against sha256 if one was given. audio, when not nil, makes
+// it a KindAudio attachment. room binds it to a room, "" for a direct message
+func (s *Storage) Create(owner, region, room string, size int64, sha256 string, audio *Audio) (*Attachment, error) {
+	att := &Attachment{Owner: owner, Size: size, Region: region, SHA256: sha256, Audio: audio, Room: room}
+	if audio != nil {
+		att.Kind = KindAudio
+	}
+	return att, s.create(att)
+}
+
+// CreateThumbnail records a small preview of parent, uploaded like any attachment and kept
+// in the same region and bound to the same room. An attachment has at most one thumbnail and thumbnails have none,
+// either fails with ErrThumbnailNotAllowed
+func (s *Storage) CreateThumbnail(parent *Attachment, size int64) (*Attachment, error) {
+	if parent.ThumbnailOf != "" {
+		return nil, ErrThumbnailNotAllowed
+	}
+	att := &Attachment{Owner: parent.Owner, Size: size, Region: parent.Region, ThumbnailOf: parent.ID, Room: parent.Room}
+	err := s.create(att)
+	if err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		return nil, ErrThumbnailNotAllowed
+	}
+	return att, err
+}
+
+// create assigns att an id and inserts it, sharing a stored blob when its hash matches one
+func (s *Storage) create(att *Attachment) error {
+	if !s.HasRegion(att.Region) {
+		return fmt.Errorf("%w: %q", ErrUnknownRegion, att.Region)
+	}
+	id, err := newID()
+	if err != nil {
+		return err
+	}
+	att.ID, att.Blob, att.CreatedAt = id, id, time.Now()
+	audio := att.Audio
+	if audio == nil {
+		audio = &Audio{}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if att.SHA256 != "" {
+		key, err := s.acquire(tx, att.Region, att.SHA256, att.Size)
+		if err != nil {
+			return err
+		}
+		if key != "" {
+			att.Blob = key
+			att.Complete = true
+		}
+	}
+	insertSQL := `INSERT INTO attachments (id, owner, size, complete, created_at, region, sha256, blob, thumbnail_of,
+		kind, audio_duration_ms, audio_waveform, room) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	if _, err := tx.Exec(insertSQL, att.ID, att.Owner, att.Size, att.Complete, att.CreatedAt.Unix(), att.Region, att.SHA256, att.Blob,
+		att.ThumbnailOf, att.Kind, audio.DurationMS, audio.Waveform, att.Room); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Store uploads the blob of an incomplete attachment from r, hashing it on the way, and
+// completes it. It reports whether the content turned out to be stored already, in which
+// case the upload is discarded and the attachment shares the existing blob
+func (s *Storage) Store(ctx context.Context, att *Attachment, r io.Reader) (bool, error) {
+	blobs, err := s.Blobs(att.Region)
+	if err != nil {
+		return false, err
+	}
+	hash := sha256.New()
+	if err := blobs.Put(ctx, att.Blob, io.TeeReader(r, hash), att.Size); err != nil {
+		return false, err
+	}
+	return s.link(ctx, att, blobs, hex.EncodeToString(hash.Sum(nil)))
+}
+
+// Complete finishes an attachment uploaded straight to the backend. The blob is read back
+// to hash it, since the server never saw the upload, then handled as Store does
+func (s *Storage) Complete(ctx context.Context, att *Attachment) (bool, error) {
+	blobs, err := s.Blobs(att.Region)
+	if err != nil {
+		return false, err
+	}
+	blob, err := blobs.Open(ctx, att.Blob)
+	if err != nil {
+		return false, err
+	}
+	hash := sha256.New()
+	n, err := io.Copy(hash, blob)
+	blob.Close()
+	if err != nil {
+		return false, err
+	}
+	if n != att.Size {
+		blobs.Delete(ctx, att.Blob)
+		return false, fmt.Errorf("%w: uploaded %d bytes, expected %d", ErrSizeMismatch, n, att.Size)
+	}
+	return s.link(ctx, att, blobs, hex.EncodeToString(hash.Sum(nil)))
+}
+
+// link points a freshly uploaded attachment at the blob holding its content: an existing
+// one with the same hash, whose reference count goes up and the upload is deleted, or
+// the upload itself, recorded as a new blob
+func (s *Storage) link(ctx context.Context, att *Attachment, blobs BlobStore, sum string) (bool, error) {
+	if att.SHA256 != "" && att.SHA256 != sum {
+		blobs.Delete(ctx, att.Blob)
+		return false, fmt.Errorf("%w: content hashes to %s", ErrHashMismatch, sum)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	key, err := s.acquire(tx, att.Region, sum, att.Size)
+	if err != nil {
+		return false, err
+	}
+	shared := key != ""
+	if !shared {
+		key = att.Blob
+		insertSQL := `INSERT INTO attachment_blobs (region, key, sha256, size, refs, created_at) VALUES (?, ?, ?, ?, 1, ?)`
+		if _, err := tx.Exec(insertSQL, att.Region, key, sum, att.Size, time.Now().Unix()); err != nil {
+			return false, err
+		}
+	}
+	updateSQL := `UPDATE attachments SET complete = 1, sha256 = ?, blob = ? WHERE id = ? AND complete = 0`
+	res, err := tx.Exec(updateSQL, sum, key, att.ID)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// completed concurrently, the blob reference taken above is dropped with the tx
+		return false, ErrAlreadyComplete
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	upload := att.Blob
+	att.Complete, att.SHA256, att.Blob = true, sum, key
+	if shared {
+		if err := blobs.Delete(ctx, upload); err != nil && err != ErrNotFound {
+			log.Printf("Error deleting duplicate upload %s: %v", upload, err)
+		}
+	}
+	return shared, nil
+}
+
+// acquire takes a reference on the blob in region with the given hash and size, returning
+// its key, or "" when there is none. Blobs no longer referenced are never revived, the
+// collector may be deleting them
+func (s *Storage) acquire(tx *sql.Tx, region, sha256 string, size int64) (string, error) {
+	var key string
+	err := tx.QueryRow(`SELECT key FROM attachment_blobs WHERE region = ? AND sha256 = ? AND size = ? AND refs > 0`, region, sha256, size).Scan(&key)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(`UPDATE attachment_blobs SET refs = refs + 1 WHERE region = ? AND key = ?`, region, key)
+	return key, err
+}
+
+// release drops a reference on a blob, reporting whether that was the last one
+func release(tx *sql.Tx, region, key string) (bool, error) {
+	var refs int64
+	err := tx.QueryRow(`UPDATE attachment_blobs SET refs = refs - 1 WHERE region = ? AND key = ? AND refs > 0 RETURNING refs`, region, key).Scan(&refs)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return refs == 0, err
+}
+
+// Get returns the metadata of an attachment
+func (s *Storage) Get(id string) (*Attachment, error) {
+	att := &Attachment{ID: id}
+	var createdAt int64
+	audio := &Audio{}
+	getSQL := `SELECT owner, size, complete, created_at, region, sha256, blob, thumbnail_of, kind, audio_duration_ms, audio_waveform, room
+	FROM attachments WHERE id = ?`
+	err := s.db.QueryRow(getSQL, id).Scan(&att.Owner, &att.Size, &att.Complete, &createdAt, &att.Region, &att.SHA256, &att.Blob,
+		&att.ThumbnailOf, &att.Kind, &audio.DurationMS, &audio.Waveform, &att.Room)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	att.CreatedAt = time.Unix(createdAt, 0)
+	if att.Kind == KindAudio {
+		att.Audio = audio
+	}
+	return att, nil
+}
+
+// Thumbnail returns the id of the thumbnail of id, "" when it has none
+func (s *Storage) Thumbnail(id string) (string, error) {
+	var thumbnail string
+	err := s.db.QueryRow(`SELECT id FROM attachments WHERE thumbnail_of = ?`, id).Scan(&thumbnail)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return thumbnail, err
+}
+
+// OwnedBetween returns owner's uploaded attachments created between from and to inclusive, oldest first
+func (s *Storage) OwnedBetween(owner string, from, to time.Time) ([]Attachment, error) {
+	querySQL := `SELECT id, size, created_at, region, sha256, blob, thumbnail_of FROM attachments
+	WHERE owner = ? AND complete = 1 AND created_at BETWEEN ? AND ? ORDER BY created_at, id`
+	rows, err := s.db.Query(querySQL, owner, from.Unix(), to.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []Attachment{}
+	for rows.Next() {
+		att := Attachment{Owner: owner, Complete: true}
+		var createdAt int64
+		if err := rows.Scan(&att.ID, &att.Size, &createdAt, &att.Region, &att.SHA256, &att.Blob, &att.ThumbnailOf); err != nil {
+			return nil, err
+		}
+		att.CreatedAt = time.Unix(createdAt, 0)
+		list = append(list, att)
+	}
+	return list, rows.Err()
+}
+
+// Delete removes an attachment's metadata and its blob, unless other attachments
+// still share the blob, along with its thumbnail
+func (s *Storage) Delete(ctx context.Context, id string) error {
+	att, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+	thumbnail, err := s.Thumbnail(id)
+	if err != nil {
+		return err
+	}
+	if thumbnail != "" {
+		if err := s.Delete(ctx, thumbnail); err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	blobs, err := s.Blobs(att.Region)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM attachments WHERE id = ?`, id); err != nil {
+		return err
+	}
+	// an unfinished upload has no blob record, whatever was uploaded goes right away
+	unreferenced := !att.Complete
+	if att.Complete {
+		if unreferenced, err = release(tx, att.Region, att.Blob); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if !unreferenced {
+		return nil
+	}
+	if !att.Complete {
+		if err := blobs.Delete(ctx, att.Blob); err != nil && err != ErrNotFound {
+			return err
+		}
+		return nil
+	}
+	return s.collect(ctx, att.Region, att.Blob)
+}
+
+// DeleteOwner removes every attachment of owner with its blob, returning how many went.
+// Stops at the first failure, calling it again resumes
+func (s *Storage) DeleteOwner(ctx context.Context, owner string) (int, error) {
+	rows, err := s.db.Query(`SELECT id FROM attachments WHERE owner = ?`, owner)
+	if err != nil {
+		return 0, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	for i, id := range ids {
+		if err := s.Delete(ctx, id); err != nil && err != ErrNotFound {
+			return i, fmt.Errorf("deleting attachment %s: %w", id, err)
+		}
+	}
+	return len(ids), nil
+}
+
+// Outside counts owner's uploaded attachments kept somewhere other than region
+func (s *Storage) Outside(owner, region string) (int, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM attachments WHERE owner = ? AND complete = 1 AND region != ?`, owner, region).Scan(&n)
+	return n, err
+}
+
+// MoveOwner copies owner's uploaded attachments into region's backend, repoints them and
+// removes the old copies, returning how many moved. Uploads still in progress stay where
+// their upload URL points. Stops at the first failure, calling it again resumes
+func (s *Storage) MoveOwner(ctx context.Context, owner, region string) (int, error) {
+	to, err := s.Blobs(region)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := s.db.Query(`SELECT id, size, region, sha256, blob FROM attachments WHERE owner = ? AND complete = 1 AND region != ?`, owner, region)
+	if err != nil {
+		return 0, err
+	}
+	var pending []Attachment
+	for rows.Next() {
+		att := Attachment{Owner: owner}
+		if err := rows.Scan(&att.ID, &att.Size, &att.Region, &att.SHA256, &att.Blob); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		pending = append(pending, att)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, att := range pending {
+		if err := s.move(ctx, att, region, to); err != nil {
+			return moved, fmt.Errorf("moving attachment %s: %w", att.ID, err)
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+// move copies one blob to another backend before switching the row over, so downloads
+// keep working throughout and a failure leaves at most an unreferenced copy behind.
+// Content already in the target region, moved for another attachment or uploaded there
+// with the same hash, is shared instead of copied
+func (s *Storage) move(ctx context.Context, att Attachment, region string, to BlobStore) error {
+	key, copied, err := s.targetBlob(ctx, att, region, to)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if copied {
+		insertSQL := `INSERT INTO attachment_blobs (region, key, sha256, size, refs, created_at) VALUES (?, ?, ?, ?, 1, ?)
+		ON CONFLICT (region, key) DO UPDATE SET refs = refs + 1`
+		if _, err := tx.Exec(insertSQL, region, key, att.SHA256, att.Size, time.Now().Unix()); err != nil {
+			return err
+		}
+	} else {
+		res, err := tx.Exec(`UPDATE attachment_blobs SET refs = refs + 1 WHERE region = ? AND key = ? AND refs > 0`, region, key)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return fmt.Errorf("blob %s in %q was released during the move", key, region)
+		}
+	}
+	if _, err := tx.Exec(`UPDATE attachments SET region = ?, blob = ? WHERE id = ?`, region, key, att.ID); err != nil {
+		return err
+	}
+	unreferenced, err := release(tx, att.Region, att.Blob)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if unreferenced {
+		return s.collect(ctx, att.Region, att.Blob)
+	}
+	return nil
+}
+
+// targetBlob returns the key of a blob in region holding att's content, reporting whether
+// it had to be copied there. A copy is recorded by the caller
+func (s *Storage) targetBlob(ctx context.Context, att Attachment, region string, to BlobStore) (string, bool, error) {
+	var key string
+	findSQL := `SELECT key FROM attachment_blobs WHERE region = ? AND size = ? AND refs > 0 AND (key = ? OR (sha256 != '' AND sha256 = ?))`
+	err := s.db.QueryRow(findSQL, region, att.Size, att.Blob, att.SHA256).Scan(&key)
+	if err == nil {
+		return key, false, nil
+	}
+	if err != sql.ErrNoRows {
+		return "", false, err
+	}
+
+	from, err := s.Blobs(att.Region)
+	if err != nil {
+		return "", false, err
+	}
+	blob, err := from.Open(ctx, att.Blob)
+	if err != nil {
+		return "", false, err
+	}
+	err = to.Put(ctx, att.Blob, blob, att.Size)
+	blob.Close()
+	if err != nil {
+		return "", false, err
+	}
+	return att.Blob, true, nil
+}
+
+// collect deletes a blob nobody references any more. The record goes first so the blob
+// cannot be shared again while it is deleted, and comes back if the backend fails so
+// CollectGarbage retries it
+func (s *Storage) collect(ctx context.Context, region, key string) error {
+	var sha string
+	var size, createdAt int64
+	deleteSQL := `DELETE FROM attachment_blobs WHERE region = ? AND key = ? AND refs = 0 RETURNING sha256, size, created_at`
+	err := s.db.QueryRow(deleteSQL, region, key).Scan(&sha, &size, &createdAt)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	blobs, err := s.Blobs(region)
+	if err == nil {
+		if err = blobs.Delete(ctx, key); err == ErrNotFound {
+			err = nil
+		}
+	}
+	if err != nil {
+		restoreSQL := `INSERT INTO attachment_blobs (region, key, sha256, size, refs, created_at) VALUES (?, ?, ?, ?, 0, ?)
+		ON CONFLICT (region, key) DO NOTHING`
+		if _, restoreErr := s.db.Exec(restoreSQL, region, key, sha, size, createdAt); restoreErr != nil {
+			log.Printf("Error keeping unreferenced blob %s in %q for a retry: %v", key, region, restoreErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// CollectGarbage deletes every blob left unreferenced, normally already removed along with
+// its last attachment unless the backend failed then. Returns how many were deleted
+func (s *Storage) CollectGarbage(ctx context.Context) (int, error) {
+	rows, err := s.db.Query(`SELECT region, key FROM attachment_blobs WHERE refs = 0`)
+	if err != nil {
+		return 0, err
+	}
+	type blobKey struct{ region, key string }
+	var unreferenced []blobKey
+	for rows.Next() {
+		var b blobKey
+		if err := rows.Scan(&b.region, &b.key); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		unreferenced = append(unreferenced, b)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	for i, b := range unreferenced {
+		if err := s.collect(ctx, b.region, b.key); err != nil {
+			return i, fmt.Errorf("deleting blob %s in %q: %w", b.key, b.region, err)
+		}
+	}
+	return len(unreferenced), nil
+}
+
+// Usage sums up how much attachment data is stored and how much sharing blobs saves
+type Usage struct {
+	Attachments int64 `json:"attachments"` // uploaded attachments
+	Blobs       int64 `json:"blobs"`       // distinct blobs holding them
+	StoredBytes int64 `json:"storedBytes"` // size of those blobs
+	SavedBytes  int64 `json:"savedBytes"`  // bytes not stored again thanks to sharing
+	SharedBlobs int64 `json:"sharedBlobs"` // blobs referenced more than once
+}
+
+// Usage reads the current storage totals from the blob records
+func (s *Storage) Usage() (*Usage, error) {
+	u := &Usage{}
+	usageSQL := `SELECT COALESCE(SUM(refs), 0), COUNT(*), COALESCE(SUM(size), 0),
+		COALESCE(SUM(size * (refs - 1)), 0), COUNT(CASE WHEN refs > 1 THEN 1 END)
+	FROM attachment_blobs WHERE refs > 0`
+	err := s.db.QueryRow(usageSQL).Scan(&u.Attachments, &u.Blobs, &u.StoredBytes, &u.SavedBytes, &u.SharedBlobs)
+	return u, err
+}
+
+// newID returns a random, unguessable attachment id
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
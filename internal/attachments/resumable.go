@@ -0,0 +1,154 @@
+package attachments
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errors returned by Uploads
+var (
+	ErrOffsetMismatch = errors.New("upload offset does not match the bytes received")
+	ErrUploadBusy     = errors.New("another request is writing this upload")
+)
+
+// partialSuffix marks staged upload files in the uploads directory
+const partialSuffix = ".part"
+
+// Uploads stages resumable uploads in a local directory until every byte has arrived and
+// the blob can be stored. The size of a staged file is the offset to resume from, so an
+// upload survives restarts and a chunk cut off halfway keeps what was written
+type Uploads struct {
+	dir string
+
+	mu   sync.Mutex
+	busy map[string]bool
+}
+
+// NewUploads creates dir if needed and stages uploads in it
+func NewUploads(dir string) (*Uploads, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &Uploads{dir: dir, busy: make(map[string]bool)}, nil
+}
+
+func (u *Uploads) path(id string) string {
+	return filepath.Join(u.dir, filepath.Base(id)+partialSuffix)
+}
+
+// Claim reserves the upload for id until the returned release is called, so two requests
+// never write the same file. Fails with ErrUploadBusy when it is taken
+func (u *Uploads) Claim(id string) (func(), error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.busy[id] {
+		return nil, ErrUploadBusy
+	}
+	u.busy[id] = true
+	return func() {
+		u.mu.Lock()
+		delete(u.busy, id)
+		u.mu.Unlock()
+	}, nil
+}
+
+// Offset returns how many bytes of id have been received, 0 before the first chunk
+func (u *Uploads) Offset(id string) (int64, error) {
+	info, err := os.Stat(u.path(id))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Append writes the bytes read from r to the upload for id, which must have offset bytes
+// so far, and returns the new offset. At most size bytes are kept in total, a chunk
+// running past that fails with ErrSizeMismatch after writing what fits. The caller must
+// hold the claim on id
+func (u *Uploads) Append(id string, offset, size int64, r io.Reader) (int64, error) {
+	f, err := os.OpenFile(u.path(id), os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if end != offset {
+		return end, fmt.Errorf("%w: have %d bytes, chunk starts at %d", ErrOffsetMismatch, end, offset)
+	}
+
+	n, copyErr := io.Copy(f, io.LimitReader(r, size-offset))
+	// the offset reported back must survive a crash, or the client would skip bytes
+	if err := f.Sync(); err != nil {
+		return offset, err
+	}
+	offset += n
+	if copyErr != nil {
+		return offset, copyErr
+	}
+	if offset == size {
+		if extra, _ := r.Read(make([]byte, 1)); extra > 0 {
+			return offset, fmt.Errorf("%w: chunk runs past %d bytes", ErrSizeMismatch, size)
+		}
+	}
+	return offset, nil
+}
+
+// Open returns the bytes staged for id
+func (u *Uploads) Open(id string) (*os.File, error) {
+	f, err := os.Open(u.path(id))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+// Remove drops the upload staged for id, if any
+func (u *Uploads) Remove(id string) error {
+	if err := os.Remove(u.path(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Expire removes staged uploads last written before cutoff, returning how many went.
+// Uploads claimed by a request are left alone
+func (u *Uploads) Expire(cutoff time.Time) (int, error) {
+	entries, err := os.ReadDir(u.dir)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), partialSuffix)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		release, err := u.Claim(id)
+		if err != nil {
+			continue
+		}
+		err = u.Remove(id)
+		release()
+		if err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,138 @@
+package attachments
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/s3"
+)
+
+// errors returned by Storage and the blob stores
+var (
+	ErrNotFound        = errors.New("attachment not found")
+	ErrUnknownRegion   = errors.New("unknown data residency region")
+	ErrSizeMismatch    = errors.New("attachment size mismatch")
+	ErrHashMismatch    = errors.New("attachment content does not match its sha256")
+	ErrAlreadyComplete = errors.New("attachment already uploaded")
+
+	ErrThumbnailNotAllowed = errors.New("attachment is a thumbnail or has one already")
+)
+
+// BlobStore stores encrypted attachment blobs
+type BlobStore interface {
+	// Put stores size bytes read from r under key
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Open returns a reader for the blob stored under key
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the blob stored under key
+	Delete(ctx context.Context, key string) error
+	// PresignUpload and PresignDownload return direct URLs to the backend,
+	// or "" when blobs must go through the server
+	PresignUpload(key string, expires time.Duration) (string, error)
+	PresignDownload(key string, expires time.Duration) (string, error)
+}
+
+// FileStore keeps blobs in a local directory
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore creates dir if needed and stores blobs in it
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (s *FileStore) path(key string) string {
+	// keys are generated by the server, Base guards against traversal anyway
+	return filepath.Join(s.dir, filepath.Base(key))
+}
+
+func (s *FileStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	tmp, err := os.CreateTemp(s.dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	written, err := io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if size >= 0 && written != size {
+		return ErrSizeMismatch
+	}
+	return os.Rename(tmp.Name(), s.path(key))
+}
+
+func (s *FileStore) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+func (s *FileStore) Delete(ctx context.Context, key string) error {
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *FileStore) PresignUpload(key string, expires time.Duration) (string, error) {
+	return "", nil
+}
+
+func (s *FileStore) PresignDownload(key string, expires time.Duration) (string, error) {
+	return "", nil
+}
+
+// S3Store keeps blobs in an S3 compatible bucket
+type S3Store struct {
+	client *s3.Client
+	prefix string
+	// uploads larger than this use multipart
+	multipartThreshold int64
+}
+
+// NewS3Store stores blobs under prefix in the client's bucket
+func NewS3Store(client *s3.Client, prefix string, multipartThreshold int64) (*S3Store, error) {
+	if !client.Configured() {
+		return nil, s3.ErrNotConfigured
+	}
+	return &S3Store{client: client, prefix: prefix, multipartThreshold: multipartThreshold}, nil
+}
+
+func (s *S3Store) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	if size < 0 || size > s.multipartThreshold {
+		return s.client.PutObjectMultipart(ctx, s.prefix+key, r, s3.MinPartSize, "application/octet-stream")
+	}
+	return s.client.PutObject(ctx, s.prefix+key, r, size, "application/octet-stream")
+}
+
+func (s *S3Store) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.client.GetObject(ctx, s.prefix+key)
+}
+
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	return s.client.DeleteObject(ctx, s.prefix+key)
+}
+
+func (s *S3Store) PresignUpload(key string, expires time.Duration) (string, error) {
+	return s.client.Presign("PUT", s.prefix+key, expires)
+}
+
+func (s *S3Store) PresignDownload(key string, expires time.Duration) (string, error) {
+	return s.client.Presign("GET", s.prefix+key, expires)
+}
@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"bytes"
 	"database/sql"
 	"encoding/base64"
 	"encoding/hex"
@@ -8,23 +9,76 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/Chase-Garrett/meadowlark/internal/dbutil"
+	"github.com/Chase-Garrett/meadowlark/internal/keyring"
+	"github.com/Chase-Garrett/meadowlark/internal/textpolicy"
 	"github.com/golang-jwt/jwt/v5"
 	_ "github.com/mattn/go-sqlite3"
-	"golang.org/x/crypto/bcrypt"
 )
 
-var jwtSecret = []byte("meadowlark-secret-key-change-in-production") // Change in production!
+// devSigningKey signs tokens when no JWT keys are configured, fine for development only
+var devSigningKey = []byte("meadowlark-secret-key-change-in-production")
+
+// signingKeys holds the keys session tokens are signed and checked with, nil for devSigningKey
+var signingKeys atomic.Pointer[keyring.Keyring]
+
+// SetSigningKeys replaces the JWT keys, e.g. after a rotation. Tokens carry the id of the
+// key that signed them, so those signed with a key still in the keyring stay valid
+func SetSigningKeys(keys *keyring.Keyring) {
+	signingKeys.Store(keys)
+}
+
+// MinPasswordLength is the shortest password accepted at registration
+const MinPasswordLength = 6
+
+// errors returned to API callers
+var (
+	ErrMissingCredentials = errors.New("username and password cannot be empty")
+	ErrPasswordTooShort   = fmt.Errorf("password must be at least %d characters", MinPasswordLength)
+	ErrUsernameTaken      = errors.New("username already exists")
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	ErrInvalidPublicKey   = errors.New("invalid public key format: expected base64 or hex")
+	ErrUserNotFound       = errors.New("user not found")
+	ErrNoPublicKey        = errors.New("user has no public key")
+)
 
 // UserStorage manages user accounts in SQLite
 type UserStorage struct {
-	db *sql.DB
+	db      *sql.DB
+	hasher  PasswordHasher
+	peppers *keyring.Keyring
+	atRest  atomic.Pointer[keyring.Keyring]
+	text    *textpolicy.Policy
+	// when deleted accounts' usernames can be registered again
+	recycling UsernameRecycling
+
+	// serializes key log appends, each extends the head the previous one wrote
+	keyLogMu sync.Mutex
+}
+
+// StorageOptions configures how UserStorage protects secrets
+type StorageOptions struct {
+	Hasher  PasswordHasher     // produces new and migrated password hashes
+	Peppers *keyring.Keyring   // optional server side pepper applied before hashing
+	AtRest  *keyring.Keyring   // optional key for encrypting sensitive columns
+	Text    *textpolicy.Policy // optional, checks new usernames; without it only their length is
+
+	Recycling UsernameRecycling // when deleted accounts' usernames can be registered again
+
+	Driver string // database/sql driver name, sqlite3 when empty
 }
 
 // NewUserStorage connects to SQLite and initalizes the users table
-func NewUserStorage(dbPath string) *UserStorage {
-	db, err := sql.Open("sqlite3", dbPath)
+func NewUserStorage(dbPath string, opts StorageOptions) *UserStorage {
+	driverName := opts.Driver
+	if driverName == "" {
+		driverName = "sqlite3"
+	}
+	db, err := sql.Open(driverName, dbPath)
 	if err != nil {
 		log.Fatalf("Failed to open database: %v", err)
 	}
@@ -41,42 +95,83 @@ func NewUserStorage(dbPath string) *UserStorage {
 		log.Fatalf("Failed to create users table: %v", err)
 	}
 
-	return &UserStorage{db: db}
+	// Columns added after the initial schema
+	for _, col := range []struct{ name, definition string }{
+		{"pepper_id", "TEXT"},
+		{"created_at", "INTEGER"},                        // unix seconds, NULL for accounts created before it was tracked
+		{"region", "TEXT NOT NULL DEFAULT ''"},           // data residency region, empty for the main storage
+		{"token_version", "INTEGER NOT NULL DEFAULT 0"},  // bumped to revoke every token issued before
+		{"password_reset", "INTEGER NOT NULL DEFAULT 0"}, // 1 when the password must be replaced at the next login
+		{"status", "TEXT NOT NULL DEFAULT ''"},           // presence status the user chose, empty for automatic
+	} {
+		if err := dbutil.AddColumnIfMissing(db, "users", col.name, col.definition); err != nil {
+			log.Fatalf("Failed to migrate users table: %v", err)
+		}
+	}
+	createAliasTable(db)
+	migrateIdentifiers(db)
+	createKeyLogTable(db)
+	createTombstoneTable(db)
+	createDeletedUsernameTable(db)
+	createLegalHoldTables(db)
+	createRecoveryTable(db)
+	seedKeyLog(db)
+
+	s := &UserStorage{
+		db:      db,
+		hasher:  opts.Hasher,
+		peppers: opts.Peppers,
+		text:    opts.Text,
+
+		recycling: opts.Recycling,
+	}
+	s.atRest.Store(opts.AtRest)
+	if err := s.sealPlaintext(); err != nil {
+		log.Fatalf("Failed to encrypt sensitive columns: %v", err)
+	}
+	return s
 }
 
 // RegisterNewUser creates a new user, hashes their password and stores them in the db
 // publicKeyBase64 is optional - if empty, public_key will be NULL
 // Accepts base64-encoded public key (SPKI format from Web Crypto API)
-func (s *UserStorage) RegisterNewUser(username, password string, publicKeyBase64 string) error {
+// email is optional, when given it can be used to log in
+func (s *UserStorage) RegisterNewUser(username, password string, publicKeyBase64 string, email string) error {
 	if username == "" || password == "" {
-		return errors.New("username and password cannot be empty")
+		return ErrMissingCredentials
+	}
+
+	if err := s.checkUsername(username); err != nil {
+		return err
 	}
 
-	if len(password) < 6 {
-		return errors.New("password must be at least 6 characters")
+	if len(password) < MinPasswordLength {
+		return ErrPasswordTooShort
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	var emailValue, emailHash interface{}
+	if email != "" {
+		normalized, err := NormalizeEmail(email)
+		if err != nil {
+			return err
+		}
+		sealed, err := s.sealColumn([]byte(normalized))
+		if err != nil {
+			return err
+		}
+		emailValue, emailHash = sealed, IdentifierHash(normalized)
+	}
+
+	hashedPassword, pepperID, err := s.hashPassword(password)
 	if err != nil {
 		return err
 	}
 
-	var publicKeyBytes interface{}
+	var publicKeyBytes []byte
 	if publicKeyBase64 != "" {
-		// Try base64 first (Web Crypto API format)
-		decoded, err := base64.StdEncoding.DecodeString(publicKeyBase64)
-		if err != nil {
-			// Fallback: try hex format for backwards compatibility
-			decoded, hexErr := hex.DecodeString(publicKeyBase64)
-			if hexErr != nil {
-				return fmt.Errorf("invalid public key format: expected base64 or hex, got error: %v", err)
-			}
-			publicKeyBytes = decoded
-		} else {
-			publicKeyBytes = decoded
+		if publicKeyBytes, err = decodePublicKey(publicKeyBase64); err != nil {
+			return err
 		}
-	} else {
-		publicKeyBytes = nil
 	}
 
 	// First check if username already exists
@@ -85,93 +180,363 @@ func (s *UserStorage) RegisterNewUser(username, password string, publicKeyBase64
 	err = s.db.QueryRow(checkSQL, username).Scan(&existingUsername)
 	if err == nil {
 		// Username exists
-		return errors.New("username already exists")
+		return ErrUsernameTaken
 	}
 	if err != sql.ErrNoRows {
 		// Some other database error occurred
 		return fmt.Errorf("database error: %v", err)
 	}
 
+	// recently renamed accounts keep their old name reserved
+	aliased, err := s.aliasActive(username)
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	if aliased {
+		return ErrUsernameTaken
+	}
+	// so do deleted accounts, for as long as the recycling policy says
+	retired, err := s.usernameRetired(s.db, username, time.Now())
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	if retired {
+		return ErrUsernameTaken
+	}
+
 	// Username doesn't exist, proceed with insertion
-	insertSQL := `INSERT INTO users (username, hashed_password, public_key) VALUES (?, ?, ?)`
-	_, err = s.db.Exec(insertSQL, username, hashedPassword, publicKeyBytes)
+	// the key is logged in the same transaction so the log never misses a served key
+	s.keyLogMu.Lock()
+	defer s.keyLogMu.Unlock()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	insertSQL := `INSERT INTO users (username, hashed_password, public_key, pepper_id, created_at, email, email_hash) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	_, err = tx.Exec(insertSQL, username, hashedPassword, publicKeyBytes, pepperID, now.Unix(), emailValue, emailHash)
 	if err != nil {
+		if strings.Contains(err.Error(), "users.email_hash") {
+			return ErrEmailTaken
+		}
 		// Check if it's a UNIQUE constraint violation (primary key)
 		if strings.Contains(err.Error(), "UNIQUE constraint") ||
 			strings.Contains(err.Error(), "PRIMARY KEY") ||
 			strings.Contains(err.Error(), "unique constraint") {
-			return errors.New("username already exists")
+			return ErrUsernameTaken
 		}
 		// Some other database error
 		return fmt.Errorf("failed to register user: %v", err)
 	}
+	if len(publicKeyBytes) > 0 {
+		if err := appendKeyLog(tx, KeyRegistered, username, "", publicKeyBytes, now); err != nil {
+			return fmt.Errorf("failed to log public key: %v", err)
+		}
+	}
 
-	return nil
+	return tx.Commit()
 }
 
-// VerifyUser checks username and password, returns true if valid
+// decodePublicKey accepts base64 (SPKI from the Web Crypto API) or, for older clients, hex
+func decodePublicKey(encoded string) ([]byte, error) {
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err == nil {
+		return decoded, nil
+	}
+	if decoded, err = hex.DecodeString(encoded); err == nil {
+		return decoded, nil
+	}
+	return nil, ErrInvalidPublicKey
+}
+
+// UpdatePublicKey replaces a user's public key and records the rotation in the key log
+func (s *UserStorage) UpdatePublicKey(username, publicKeyBase64 string) error {
+	publicKey, err := decodePublicKey(publicKeyBase64)
+	if err != nil || len(publicKey) == 0 {
+		return ErrInvalidPublicKey
+	}
+
+	s.keyLogMu.Lock()
+	defer s.keyLogMu.Unlock()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current []byte
+	err = tx.QueryRow(`SELECT public_key FROM users WHERE username = ?`, username).Scan(&current)
+	if err == sql.ErrNoRows {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(current, publicKey) {
+		return nil
+	}
+
+	if _, err := tx.Exec(`UPDATE users SET public_key = ? WHERE username = ?`, publicKey, username); err != nil {
+		return err
+	}
+	action := KeyRotated
+	if len(current) == 0 {
+		action = KeyRegistered
+	}
+	if err := appendKeyLog(tx, action, username, "", publicKey, time.Now()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// VerifyUser checks username and password, returns nil if valid
+// hashes made with an outdated algorithm, cost or pepper are upgraded on success
 func (s *UserStorage) VerifyUser(username, password string) error {
-	querySQL := `SELECT hashed_password FROM users WHERE username = ?`
+	querySQL := `SELECT hashed_password, pepper_id FROM users WHERE username = ?`
 	var hashedPassword []byte
+	var pepperID sql.NullString
 
-	err := s.db.QueryRow(querySQL, username).Scan(&hashedPassword)
+	err := s.db.QueryRow(querySQL, username).Scan(&hashedPassword, &pepperID)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return errors.New("invalid username or password")
+			return ErrInvalidCredentials
 		}
 		return err
 	}
 
-	err = bcrypt.CompareHashAndPassword(hashedPassword, []byte(password))
+	peppered, err := s.pepper(pepperID.String, password)
+	if err != nil {
+		return fmt.Errorf("cannot verify password: %v", err)
+	}
+	if !verifyPassword(hashedPassword, peppered) {
+		return ErrInvalidCredentials
+	}
+
+	if s.hasher.NeedsRehash(hashedPassword) || pepperID.String != s.currentPepperID() {
+		s.rehashPassword(username, password)
+	}
+
+	return nil
+}
+
+// rehashPassword migrates a user's stored hash to the configured algorithm and pepper
+// failures are logged and leave the old, still valid, hash in place
+func (s *UserStorage) rehashPassword(username, password string) {
+	newHash, pepperID, err := s.hashPassword(password)
+	if err != nil {
+		log.Printf("Failed to rehash password for %s: %v", username, err)
+		return
+	}
+	updateSQL := `UPDATE users SET hashed_password = ?, pepper_id = ? WHERE username = ?`
+	if _, err := s.db.Exec(updateSQL, newHash, pepperID, username); err != nil {
+		log.Printf("Failed to store rehashed password for %s: %v", username, err)
+		return
+	}
+	log.Printf("Migrated password hash for %s", username)
+}
+
+// ChangePassword replaces a user's password after checking the current one, and revokes every
+// token issued so far by bumping the user's token version. A required reset is done with it
+func (s *UserStorage) ChangePassword(username, current, password string) error {
+	if err := s.VerifyUser(username, current); err != nil {
+		return err
+	}
+	if len(password) < MinPasswordLength {
+		return ErrPasswordTooShort
+	}
+	hashedPassword, pepperID, err := s.hashPassword(password)
+	if err != nil {
+		return err
+	}
+	updateSQL := `UPDATE users SET hashed_password = ?, pepper_id = ?, token_version = token_version + 1, password_reset = 0
+	WHERE username = ?`
+	result, err := s.db.Exec(updateSQL, hashedPassword, pepperID, username)
 	if err != nil {
-		return errors.New("invalid username or password")
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrUserNotFound
 	}
+	return nil
+}
 
+// TokenVersion returns the version a user's tokens must carry, tokens with an older one were
+// issued before the password last changed
+func (s *UserStorage) TokenVersion(username string) (int, error) {
+	var version int
+	err := s.db.QueryRow(`SELECT token_version FROM users WHERE username = ?`, username).Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, ErrUserNotFound
+	}
+	return version, err
+}
+
+// RequirePasswordReset revokes every token of a user whose password is known to someone else,
+// the password then only works to choose a new one, see ChangePassword
+func (s *UserStorage) RequirePasswordReset(username string) error {
+	result, err := s.db.Exec(`UPDATE users SET password_reset = 1, token_version = token_version + 1 WHERE username = ?`, username)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
 	return nil
 }
 
+// PasswordResetRequired reports whether the user must choose a new password at the next login
+func (s *UserStorage) PasswordResetRequired(username string) (bool, error) {
+	var reset bool
+	err := s.db.QueryRow(`SELECT password_reset FROM users WHERE username = ?`, username).Scan(&reset)
+	if err == sql.ErrNoRows {
+		return false, ErrUserNotFound
+	}
+	return reset, err
+}
+
 // UserClaims represents JWT claims
 type UserClaims struct {
-	Username string `json:"username"`
+	Username     string        `json:"username"`
+	Confirmation *Confirmation `json:"cnf,omitempty"`
+	Scope        string        `json:"scope,omitempty"` // space separated, see Scopes
+	Version      int           `json:"ver,omitempty"`   // the user's token version when it was issued
 	jwt.RegisteredClaims
 }
 
-// GenerateToken generates a JWT token for a user
-func GenerateToken(username string) (string, error) {
+// Confirmation binds a token to a client key, only requests with a proof signed by it may use it
+type Confirmation struct {
+	JKT string `json:"jkt"` // thumbprint of the client's public key
+}
+
+// BoundTo returns the thumbprint of the key the token is bound to, empty for bearer tokens
+func (c *UserClaims) BoundTo() string {
+	if c.Confirmation == nil {
+		return ""
+	}
+	return c.Confirmation.JKT
+}
+
+// Tenant returns the workspace the token was issued by, empty for the main one
+func (c *UserClaims) Tenant() string {
+	if len(c.Audience) == 0 {
+		return ""
+	}
+	return c.Audience[0]
+}
+
+// TokenOptions restrict what a token can be used for
+type TokenOptions struct {
+	JKT     string   // thumbprint of the client key the token is bound to, empty for a bearer token
+	Scopes  []string // normalized scopes, see NormalizeScopes
+	Version int      // the user's current token version, see TokenVersion
+	Tenant  string   // workspace issuing the token, the audience it is only accepted by
+}
+
+// IssueToken generates a JWT token for a user bound and scoped as opts says
+func IssueToken(username string, opts TokenOptions) (string, error) {
 	claims := UserClaims{
 		Username: username,
+		Scope:    strings.Join(opts.Scopes, " "),
+		Version:  opts.Version,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			NotBefore: jwt.NewNumericDate(time.Now()),
 		},
 	}
+	if opts.Tenant != "" {
+		claims.Audience = jwt.ClaimStrings{opts.Tenant}
+	}
+	if opts.JKT != "" {
+		claims.Confirmation = &Confirmation{JKT: opts.JKT}
+	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	keys := signingKeys.Load()
+	if keys == nil {
+		return token.SignedString(devSigningKey)
+	}
+	token.Header["kid"] = keys.CurrentID()
+	key, err := keys.Key(keys.CurrentID())
+	if err != nil {
+		return "", err
+	}
+	return token.SignedString(key)
 }
 
 // ValidateToken validates a JWT token and returns the username
 func ValidateToken(tokenString string) (string, error) {
+	claims, err := ParseClaims(tokenString)
+	if err != nil {
+		return "", err
+	}
+	return claims.Username, nil
+}
+
+// ParseClaims validates a JWT token and returns its claims
+func ParseClaims(tokenString string) (*UserClaims, error) {
 	token, err := jwt.ParseWithClaims(tokenString, &UserClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
+		keys := signingKeys.Load()
+		if keys == nil {
+			return devSigningKey, nil
+		}
+		id, _ := token.Header["kid"].(string)
+		return keys.Key(id)
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
 
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if claims, ok := token.Claims.(*UserClaims); ok && token.Valid {
-		return claims.Username, nil
+		return claims, nil
 	}
 
-	return "", errors.New("invalid token")
+	return nil, errors.New("invalid token")
 }
 
-// GetAllUsers returns a list of all registered usernames
-func (s *UserStorage) GetAllUsers() ([]string, error) {
-	querySQL := `SELECT username FROM users ORDER BY username`
-	rows, err := s.db.Query(querySQL)
+// ListUsers returns up to limit usernames starting with prefix, sorted after the given username
+// or before it when desc is set. An empty after starts at the beginning
+func (s *UserStorage) ListUsers(prefix, after string, desc bool, limit int) ([]string, error) {
+	where := `username LIKE ? ESCAPE '\'`
+	args := []interface{}{dbutil.EscapeLike(prefix) + "%"}
+	order := "username"
+	if desc {
+		order = "username DESC"
+		if after != "" {
+			where += ` AND username < ?`
+			args = append(args, after)
+		}
+	} else if after != "" {
+		where += ` AND username > ?`
+		args = append(args, after)
+	}
+	args = append(args, limit)
+
+	rows, err := s.db.Query(`SELECT username FROM users WHERE `+where+` ORDER BY `+order+` LIMIT ?`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []string{}
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		}
+		users = append(users, username)
+	}
+
+	return users, rows.Err()
+}
+
+// ListUsersAfter returns up to limit usernames sorted after the given username
+func (s *UserStorage) ListUsersAfter(after string, limit int) ([]string, error) {
+	querySQL := `SELECT username FROM users WHERE username > ? ORDER BY username LIMIT ?`
+	rows, err := s.db.Query(querySQL, after, limit)
 	if err != nil {
 		return nil, err
 	}
@@ -189,13 +554,74 @@ func (s *UserStorage) GetAllUsers() ([]string, error) {
 	return users, rows.Err()
 }
 
+// UserExists reports whether an account with the given username is registered
+func (s *UserStorage) UserExists(username string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)`, username).Scan(&exists)
+	return exists, err
+}
+
+// CountUsers returns how many accounts are registered
+func (s *UserStorage) CountUsers() (int64, error) {
+	var n int64
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&n)
+	return n, err
+}
+
+// CreatedAt returns when an account was registered, the zero time if it predates tracking
+func (s *UserStorage) CreatedAt(username string) (time.Time, error) {
+	var createdAt sql.NullInt64
+	err := s.db.QueryRow(`SELECT created_at FROM users WHERE username = ?`, username).Scan(&createdAt)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !createdAt.Valid {
+		return time.Time{}, nil
+	}
+	return time.Unix(createdAt.Int64, 0), nil
+}
+
+// UserKey pairs a username with their public key
+type UserKey struct {
+	Username  string
+	PublicKey []byte
+}
+
+// ListPublicKeysAfter returns up to limit users with a public key, sorted after the given username
+func (s *UserStorage) ListPublicKeysAfter(after string, limit int) ([]UserKey, error) {
+	querySQL := `SELECT username, public_key FROM users
+	WHERE username > ? AND public_key IS NOT NULL AND length(public_key) > 0
+	ORDER BY username LIMIT ?`
+	rows, err := s.db.Query(querySQL, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []UserKey
+	for rows.Next() {
+		var key UserKey
+		if err := rows.Scan(&key.Username, &key.PublicKey); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// DB exposes the underlying database so other stores can share the connection pool
+func (s *UserStorage) DB() *sql.DB {
+	return s.db
+}
+
 // GetUserPublicKey retrieves a user's public key (returns error if no key is set)
 func (s *UserStorage) GetUserPublicKey(username string) ([]byte, error) {
 	// First check if user exists
 	var exists bool
 	err := s.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)`, username).Scan(&exists)
 	if err != nil || !exists {
-		return nil, errors.New("user not found")
+		return nil, ErrUserNotFound
 	}
 
 	querySQL := `SELECT public_key FROM users WHERE username = ?`
@@ -204,14 +630,14 @@ func (s *UserStorage) GetUserPublicKey(username string) ([]byte, error) {
 	err = s.db.QueryRow(querySQL, username).Scan(&publicKeyBytes)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, errors.New("user not found")
+			return nil, ErrUserNotFound
 		}
 		// NULL values in SQLite with go-sqlite3 driver will result in empty slice or scan error
-		return nil, errors.New("user has no public key")
+		return nil, ErrNoPublicKey
 	}
 
 	if len(publicKeyBytes) == 0 {
-		return nil, errors.New("user has no public key")
+		return nil, ErrNoPublicKey
 	}
 	return publicKeyBytes, nil
 }
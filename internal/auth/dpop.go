@@ -0,0 +1,146 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ErrInvalidProof wraps every reason a DPoP proof is refused
+var ErrInvalidProof = errors.New("invalid DPoP proof")
+
+func invalidProof(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidProof, fmt.Sprintf(format, args...))
+}
+
+// Proof is a verified DPoP proof: a JWT the client signs with its own key for each request,
+// showing it holds the key a token is bound to
+type Proof struct {
+	JKT      string // thumbprint of the key that signed it, what bound tokens carry
+	ID       string // jti, unique per proof so the server can refuse replays
+	IssuedAt time.Time
+}
+
+type proofClaims struct {
+	ID       string           `json:"jti"`
+	Method   string           `json:"htm"`
+	URL      string           `json:"htu"`
+	IssuedAt *jwt.NumericDate `json:"iat"`
+	Hash     string           `json:"ath,omitempty"` // hash of the access token sent with it
+}
+
+func (c *proofClaims) GetExpirationTime() (*jwt.NumericDate, error) { return nil, nil }
+func (c *proofClaims) GetIssuedAt() (*jwt.NumericDate, error)       { return c.IssuedAt, nil }
+func (c *proofClaims) GetNotBefore() (*jwt.NumericDate, error)      { return nil, nil }
+func (c *proofClaims) GetIssuer() (string, error)                   { return "", nil }
+func (c *proofClaims) GetSubject() (string, error)                  { return "", nil }
+func (c *proofClaims) GetAudience() (jwt.ClaimStrings, error)       { return nil, nil }
+
+// jwkKey reads a public JWK from a proof header and returns it with its RFC 7638 thumbprint.
+// P-256 and Ed25519 keys are accepted
+func jwkKey(header map[string]interface{}) (interface{}, string, error) {
+	jwk, ok := header["jwk"].(map[string]interface{})
+	if !ok {
+		return nil, "", invalidProof("no jwk in header")
+	}
+	field := func(name string) string { s, _ := jwk[name].(string); return s }
+	if _, private := jwk["d"]; private {
+		return nil, "", invalidProof("jwk holds a private key")
+	}
+	x, err := base64.RawURLEncoding.DecodeString(field("x"))
+	if err != nil {
+		return nil, "", invalidProof("bad jwk")
+	}
+
+	var key interface{}
+	var canonical string
+	switch {
+	case field("kty") == "EC" && field("crv") == "P-256":
+		y, err := base64.RawURLEncoding.DecodeString(field("y"))
+		if err != nil || len(x) != 32 || len(y) != 32 {
+			return nil, "", invalidProof("bad jwk")
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, "", invalidProof("bad jwk")
+		}
+		key = pub
+		canonical = fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`, field("x"), field("y"))
+	case field("kty") == "OKP" && field("crv") == "Ed25519":
+		if len(x) != ed25519.PublicKeySize {
+			return nil, "", invalidProof("bad jwk")
+		}
+		key = ed25519.PublicKey(x)
+		canonical = fmt.Sprintf(`{"crv":"Ed25519","kty":"OKP","x":"%s"}`, field("x"))
+	default:
+		return nil, "", invalidProof("unsupported key type")
+	}
+	sum := sha256.Sum256([]byte(canonical))
+	return key, base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// sameResource compares a proof's htu with the URL a request was sent to. Query and fragment
+// are ignored, and so is the scheme: behind a TLS terminating proxy the server can't tell
+// https from http, or wss from ws
+func sameResource(htu, requestURL string) bool {
+	a, errA := url.Parse(htu)
+	b, errB := url.Parse(requestURL)
+	if errA != nil || errB != nil {
+		return false
+	}
+	return strings.EqualFold(a.Host, b.Host) && a.EscapedPath() == b.EscapedPath()
+}
+
+// TokenHash is the ath a proof carries for an access token
+func TokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// VerifyProof checks a DPoP proof for a request with method to requestURL, issued within window
+// of now. A proof sent with an access token must carry its hash, pass "" when there is none
+func VerifyProof(proof, method, requestURL, accessToken string, now time.Time, window time.Duration) (*Proof, error) {
+	var jkt string
+	var claims proofClaims
+	token, err := jwt.ParseWithClaims(proof, &claims, func(t *jwt.Token) (interface{}, error) {
+		if typ, _ := t.Header["typ"].(string); typ != "dpop+jwt" {
+			return nil, invalidProof("typ must be dpop+jwt")
+		}
+		key, thumbprint, err := jwkKey(t.Header)
+		jkt = thumbprint
+		return key, err
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodES256.Alg(), jwt.SigningMethodEdDSA.Alg()}))
+	if err != nil || !token.Valid {
+		if errors.Is(err, ErrInvalidProof) {
+			return nil, err
+		}
+		return nil, invalidProof("bad signature")
+	}
+
+	if claims.ID == "" || claims.IssuedAt == nil {
+		return nil, invalidProof("jti and iat are required")
+	}
+	if age := now.Sub(claims.IssuedAt.Time); age > window || age < -window {
+		return nil, invalidProof("issued too long ago or in the future")
+	}
+	if !strings.EqualFold(claims.Method, method) {
+		return nil, invalidProof("htm does not match the request")
+	}
+	if !sameResource(claims.URL, requestURL) {
+		return nil, invalidProof("htu does not match the request")
+	}
+	if accessToken != "" && claims.Hash != TokenHash(accessToken) {
+		return nil, invalidProof("ath does not match the access token")
+	}
+	return &Proof{JKT: jkt, ID: claims.ID, IssuedAt: claims.IssuedAt.Time}, nil
+}
@@ -0,0 +1,203 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+// legal hold audit actions
+const (
+	HoldPlaced   = "placed"
+	HoldReleased = "released"
+	HoldExported = "exported"
+)
+
+// ErrNotHeld is returned for accounts without a legal hold
+var ErrNotHeld = errors.New("account is not under legal hold")
+
+// ErrHoldReason is returned when a hold action comes without a reason for the audit log
+var ErrHoldReason = errors.New("a reason is required")
+
+// LegalHold keeps an account's stored envelopes past retention policies and account deletion
+type LegalHold struct {
+	Username string    `json:"username"` // the tombstone once the account is deleted
+	Reason   string    `json:"reason"`
+	PlacedBy string    `json:"placedBy"`
+	PlacedAt time.Time `json:"placedAt"`
+}
+
+// HoldAuditEntry is one action on a legal hold. Entries name accounts as they were called at
+// the time and are never changed or removed
+type HoldAuditEntry struct {
+	ID        int64     `json:"id"`
+	Action    string    `json:"action"`
+	Username  string    `json:"username"`
+	Admin     string    `json:"admin"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// createLegalHoldTables creates the holds, which follow renames and deletions through
+// usernameReferences, and their audit log, which doesn't
+func createLegalHoldTables(db *sql.DB) {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS legal_holds (
+		"username" TEXT NOT NULL PRIMARY KEY,
+		"reason" TEXT NOT NULL,
+		"placed_by" TEXT NOT NULL,
+		"placed_at" INTEGER NOT NULL);
+	CREATE TABLE IF NOT EXISTS legal_hold_audit (
+		"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+		"action" TEXT NOT NULL,
+		"username" TEXT NOT NULL,
+		"admin" TEXT NOT NULL,
+		"reason" TEXT NOT NULL,
+		"created_at" INTEGER NOT NULL);`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Fatalf("Failed to create legal hold tables: %v", err)
+	}
+}
+
+// execer is a *sql.DB or a *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// auditHold appends an entry to the legal hold audit log
+func auditHold(q execer, action, username, admin, reason string, now time.Time) error {
+	_, err := q.Exec(`INSERT INTO legal_hold_audit (action, username, admin, reason, created_at) VALUES (?, ?, ?, ?, ?)`,
+		action, username, admin, reason, now.UnixMilli())
+	return err
+}
+
+// PlaceHold puts username, an account or the tombstone of one not yet purged, under legal hold.
+// Placing it again replaces the reason
+func (s *UserStorage) PlaceHold(username, admin, reason string) (*LegalHold, error) {
+	if reason == "" {
+		return nil, ErrHoldReason
+	}
+	now := time.Now()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	existsSQL := `SELECT EXISTS(SELECT 1 FROM users WHERE username = ?) OR EXISTS(SELECT 1 FROM tombstones WHERE id = ?)`
+	if err := tx.QueryRow(existsSQL, username, username).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrUserNotFound
+	}
+	upsertSQL := `INSERT INTO legal_holds (username, reason, placed_by, placed_at) VALUES (?, ?, ?, ?)
+	ON CONFLICT (username) DO UPDATE SET reason = excluded.reason, placed_by = excluded.placed_by, placed_at = excluded.placed_at`
+	if _, err := tx.Exec(upsertSQL, username, reason, admin, now.Unix()); err != nil {
+		return nil, err
+	}
+	if err := auditHold(tx, HoldPlaced, username, admin, reason, now); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &LegalHold{Username: username, Reason: reason, PlacedBy: admin, PlacedAt: time.Unix(now.Unix(), 0)}, nil
+}
+
+// ReleaseHold lifts username's legal hold, retention and a pending purge apply again from the
+// next run
+func (s *UserStorage) ReleaseHold(username, admin, reason string) error {
+	if reason == "" {
+		return ErrHoldReason
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`DELETE FROM legal_holds WHERE username = ?`, username)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotHeld
+	}
+	if err := auditHold(tx, HoldReleased, username, admin, reason, time.Now()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Hold returns username's legal hold, ErrNotHeld if there is none
+func (s *UserStorage) Hold(username string) (*LegalHold, error) {
+	hold := &LegalHold{Username: username}
+	var placedAt int64
+	err := s.db.QueryRow(`SELECT reason, placed_by, placed_at FROM legal_holds WHERE username = ?`, username).
+		Scan(&hold.Reason, &hold.PlacedBy, &placedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotHeld
+	}
+	if err != nil {
+		return nil, err
+	}
+	hold.PlacedAt = time.Unix(placedAt, 0)
+	return hold, nil
+}
+
+// Holds returns every legal hold, oldest first
+func (s *UserStorage) Holds() ([]LegalHold, error) {
+	rows, err := s.db.Query(`SELECT username, reason, placed_by, placed_at FROM legal_holds ORDER BY placed_at, username`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	holds := []LegalHold{}
+	for rows.Next() {
+		var hold LegalHold
+		var placedAt int64
+		if err := rows.Scan(&hold.Username, &hold.Reason, &hold.PlacedBy, &placedAt); err != nil {
+			return nil, err
+		}
+		hold.PlacedAt = time.Unix(placedAt, 0)
+		holds = append(holds, hold)
+	}
+	return holds, rows.Err()
+}
+
+// RecordHoldExport audits an export of username's held envelopes, before it starts so one cut
+// short is on record too
+func (s *UserStorage) RecordHoldExport(username, admin, reason string) error {
+	if reason == "" {
+		return ErrHoldReason
+	}
+	return auditHold(s.db, HoldExported, username, admin, reason, time.Now())
+}
+
+// HoldAudit returns up to limit audit entries older than beforeID (0 for the newest), newest first
+func (s *UserStorage) HoldAudit(beforeID int64, limit int) ([]HoldAuditEntry, error) {
+	querySQL := `SELECT id, action, username, admin, reason, created_at FROM legal_hold_audit
+	WHERE (? = 0 OR id < ?) ORDER BY id DESC LIMIT ?`
+	rows, err := s.db.Query(querySQL, beforeID, beforeID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []HoldAuditEntry{}
+	for rows.Next() {
+		var e HoldAuditEntry
+		var createdAt int64
+		if err := rows.Scan(&e.ID, &e.Action, &e.Username, &e.Admin, &e.Reason, &createdAt); err != nil {
+			return nil, err
+		}
+		e.CreatedAt = time.UnixMilli(createdAt)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,388 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/dbutil"
+)
+
+// errors for email and phone identifiers
+var (
+	ErrInvalidEmail       = errors.New("invalid email address")
+	ErrEmailTaken         = errors.New("email address already in use")
+	ErrInvalidPhone       = errors.New("phone numbers must be in international format, e.g. +15551234567")
+	ErrPhoneTaken         = errors.New("phone number already in use")
+	ErrVerificationFailed = errors.New("verification code is wrong or has expired")
+	ErrVerificationWait   = errors.New("a verification code was sent recently")
+)
+
+// verification code settings, shared by email and phone
+const (
+	verificationCodeTTL      = 10 * time.Minute
+	verificationMaxAttempts  = 5
+	verificationResendPeriod = time.Minute
+)
+
+var (
+	emailPattern = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+	phonePattern = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+)
+
+// NormalizeEmail lowercases and trims an email address
+func NormalizeEmail(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if len(email) > 254 || !emailPattern.MatchString(email) {
+		return "", ErrInvalidEmail
+	}
+	return email, nil
+}
+
+// NormalizePhone strips formatting from a phone number and checks it is E.164
+func NormalizePhone(phone string) (string, error) {
+	phone = strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '(', ')', '.':
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(phone))
+	if !phonePattern.MatchString(phone) {
+		return "", ErrInvalidPhone
+	}
+	return phone, nil
+}
+
+// IdentifierHash is the hex SHA-256 of a normalized email or phone number, as used for contact discovery
+func IdentifierHash(normalized string) string {
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+func migrateIdentifiers(db *sql.DB) {
+	for _, col := range []struct{ name, definition string }{
+		{"email", "TEXT"},      // sealed with the at-rest keys when configured
+		{"email_hash", "TEXT"}, // IdentifierHash(email), for login and uniqueness
+		{"phone", "TEXT"},      // only set once verified, sealed like email
+		{"phone_hash", "TEXT"}, // IdentifierHash(phone), for discovery and uniqueness
+		{"email_verified", "INTEGER NOT NULL DEFAULT 0"},
+	} {
+		if err := dbutil.AddColumnIfMissing(db, "users", col.name, col.definition); err != nil {
+			log.Fatalf("Failed to migrate users table: %v", err)
+		}
+	}
+
+	if err := backfillEmailHashes(db); err != nil {
+		log.Fatalf("Failed to migrate users table: %v", err)
+	}
+
+	// uniqueness is kept on the hashes, sealed values differ even for the same address
+	createTableSQL := `
+	DROP INDEX IF EXISTS users_email;
+	DROP INDEX IF EXISTS users_phone;
+	DROP INDEX IF EXISTS users_phone_hash;
+	CREATE UNIQUE INDEX IF NOT EXISTS users_email_hash ON users (email_hash) WHERE email_hash IS NOT NULL;
+	CREATE UNIQUE INDEX IF NOT EXISTS users_phone_hash_unique ON users (phone_hash) WHERE phone_hash IS NOT NULL;
+	CREATE TABLE IF NOT EXISTS phone_verifications (
+		"username" TEXT NOT NULL PRIMARY KEY,
+		"phone" TEXT NOT NULL,
+		"code_hash" TEXT NOT NULL,
+		"attempts" INTEGER NOT NULL DEFAULT 0,
+		"sent_at" INTEGER NOT NULL,
+		"expires_at" INTEGER NOT NULL);
+	CREATE TABLE IF NOT EXISTS email_verifications (
+		"username" TEXT NOT NULL PRIMARY KEY,
+		"email" TEXT NOT NULL,
+		"code_hash" TEXT NOT NULL,
+		"attempts" INTEGER NOT NULL DEFAULT 0,
+		"sent_at" INTEGER NOT NULL,
+		"expires_at" INTEGER NOT NULL);`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Fatalf("Failed to create identifier tables: %v", err)
+	}
+}
+
+// backfillEmailHashes fills email_hash for addresses stored before it existed, which are
+// still in plaintext since sealed addresses are always written with their hash
+func backfillEmailHashes(db *sql.DB) error {
+	rows, err := db.Query(`SELECT username, email FROM users WHERE email IS NOT NULL AND email_hash IS NULL`)
+	if err != nil {
+		return err
+	}
+	hashes := make(map[string]string)
+	for rows.Next() {
+		var username, email string
+		if err := rows.Scan(&username, &email); err != nil {
+			rows.Close()
+			return err
+		}
+		hashes[username] = IdentifierHash(email)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for username, hash := range hashes {
+		if _, err := db.Exec(`UPDATE users SET email_hash = ? WHERE username = ?`, hash, username); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LookupLogin returns the username for a login identifier, which may be a username or an email address
+func (s *UserStorage) LookupLogin(identifier string) (string, error) {
+	exists, err := s.UserExists(identifier)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return identifier, nil
+	}
+	email, err := NormalizeEmail(identifier)
+	if err != nil {
+		return "", ErrInvalidCredentials
+	}
+
+	var username string
+	err = s.db.QueryRow(`SELECT username FROM users WHERE email_hash = ?`, IdentifierHash(email)).Scan(&username)
+	if err == sql.ErrNoRows {
+		return "", ErrInvalidCredentials
+	}
+	return username, err
+}
+
+// Phone returns a user's verified phone number, or "" if none is set
+func (s *UserStorage) Phone(username string) (string, error) {
+	var sealed []byte
+	err := s.db.QueryRow(`SELECT phone FROM users WHERE username = ?`, username).Scan(&sealed)
+	if err == sql.ErrNoRows {
+		return "", ErrUserNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	phone, err := s.openColumn(sealed)
+	return string(phone), err
+}
+
+// StartPhoneVerification stores a new verification code for phone and returns it for delivery
+func (s *UserStorage) StartPhoneVerification(username, phone string) (string, error) {
+	phone, err := NormalizePhone(phone)
+	if err != nil {
+		return "", err
+	}
+	return s.startVerification(phoneVerifications, username, phone)
+}
+
+// ConfirmPhone checks a verification code and attaches the phone number to the account
+func (s *UserStorage) ConfirmPhone(username, code string) (string, error) {
+	return s.confirmVerification(phoneVerifications, username, code)
+}
+
+// verificationKind is a table of pending codes and the users column a confirmed code fills
+type verificationKind struct {
+	table      string
+	column     string // also the column of the pending table holding the identifier
+	hashColumn string // users column with IdentifierHash of the identifier
+	taken      error
+	set        string // UPDATE run on confirmation with the sealed identifier, its hash and username
+}
+
+var (
+	phoneVerifications = verificationKind{
+		table:      "phone_verifications",
+		column:     "phone",
+		hashColumn: "phone_hash",
+		taken:      ErrPhoneTaken,
+		set:        `UPDATE users SET phone = ?1, phone_hash = ?2 WHERE username = ?3`,
+	}
+	emailVerifications = verificationKind{
+		table:      "email_verifications",
+		column:     "email",
+		hashColumn: "email_hash",
+		taken:      ErrEmailTaken,
+		set:        `UPDATE users SET email = ?1, email_hash = ?2, email_verified = 1 WHERE username = ?3`,
+	}
+)
+
+// startVerification stores a new code for identifier, replacing any pending one, and returns it
+func (s *UserStorage) startVerification(kind verificationKind, username, identifier string) (string, error) {
+	var taken bool
+	querySQL := `SELECT EXISTS(SELECT 1 FROM users WHERE ` + kind.hashColumn + ` = ? AND username != ?)`
+	if err := s.db.QueryRow(querySQL, IdentifierHash(identifier), username).Scan(&taken); err != nil {
+		return "", err
+	}
+	if taken {
+		return "", kind.taken
+	}
+
+	now := time.Now()
+	var sentAt int64
+	err := s.db.QueryRow(`SELECT sent_at FROM `+kind.table+` WHERE username = ?`, username).Scan(&sentAt)
+	if err == nil && now.Sub(time.Unix(sentAt, 0)) < verificationResendPeriod {
+		return "", ErrVerificationWait
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	code := fmt.Sprintf("%06d", n.Int64())
+
+	sealed, err := s.sealColumn([]byte(identifier))
+	if err != nil {
+		return "", err
+	}
+	upsertSQL := `INSERT OR REPLACE INTO ` + kind.table + ` (username, ` + kind.column + `, code_hash, attempts, sent_at, expires_at)
+	VALUES (?, ?, ?, 0, ?, ?)`
+	_, err = s.db.Exec(upsertSQL, username, sealed, IdentifierHash(code), now.Unix(), now.Add(verificationCodeTTL).Unix())
+	if err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// confirmVerification checks a code and stores the identifier it was sent to on the account
+func (s *UserStorage) confirmVerification(kind verificationKind, username, code string) (string, error) {
+	var sealed []byte
+	var codeHash string
+	var attempts int
+	var expiresAt int64
+	querySQL := `SELECT ` + kind.column + `, code_hash, attempts, expires_at FROM ` + kind.table + ` WHERE username = ?`
+	err := s.db.QueryRow(querySQL, username).Scan(&sealed, &codeHash, &attempts, &expiresAt)
+	if err == sql.ErrNoRows {
+		return "", ErrVerificationFailed
+	}
+	if err != nil {
+		return "", err
+	}
+	opened, err := s.openColumn(sealed)
+	if err != nil {
+		return "", err
+	}
+	identifier := string(opened)
+	if attempts >= verificationMaxAttempts || time.Now().Unix() > expiresAt {
+		return "", ErrVerificationFailed
+	}
+
+	if subtle.ConstantTimeCompare([]byte(IdentifierHash(strings.TrimSpace(code))), []byte(codeHash)) != 1 {
+		if _, err := s.db.Exec(`UPDATE `+kind.table+` SET attempts = attempts + 1 WHERE username = ?`, username); err != nil {
+			return "", err
+		}
+		return "", ErrVerificationFailed
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if sealed, err = s.sealColumn(opened); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(kind.set, sealed, IdentifierHash(identifier), username); err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint") {
+			return "", kind.taken
+		}
+		return "", err
+	}
+	if _, err := tx.Exec(`DELETE FROM `+kind.table+` WHERE username = ?`, username); err != nil {
+		return "", err
+	}
+	return identifier, tx.Commit()
+}
+
+// RemovePhone detaches the phone number from an account
+func (s *UserStorage) RemovePhone(username string) error {
+	_, err := s.db.Exec(`UPDATE users SET phone = NULL, phone_hash = NULL WHERE username = ?`, username)
+	return err
+}
+
+// Email returns a user's email address, or "" if none is set, and whether it was verified
+func (s *UserStorage) Email(username string) (string, bool, error) {
+	var sealed []byte
+	var verified bool
+	err := s.db.QueryRow(`SELECT email, email_verified FROM users WHERE username = ?`, username).Scan(&sealed, &verified)
+	if err == sql.ErrNoRows {
+		return "", false, ErrUserNotFound
+	}
+	if err != nil {
+		return "", false, err
+	}
+	email, err := s.openColumn(sealed)
+	return string(email), verified, err
+}
+
+// StartEmailVerification stores a new verification code for email and returns it for delivery.
+// The address only replaces the account's current one once confirmed
+func (s *UserStorage) StartEmailVerification(username, email string) (string, error) {
+	email, err := NormalizeEmail(email)
+	if err != nil {
+		return "", err
+	}
+	return s.startVerification(emailVerifications, username, email)
+}
+
+// ConfirmEmail checks a verification code and sets the verified email address of the account
+func (s *UserStorage) ConfirmEmail(username, code string) (string, error) {
+	return s.confirmVerification(emailVerifications, username, code)
+}
+
+// RemoveEmail detaches the email address from an account, it can no longer be used to log in
+func (s *UserStorage) RemoveEmail(username string) error {
+	_, err := s.db.Exec(`UPDATE users SET email = NULL, email_hash = NULL, email_verified = 0 WHERE username = ?`, username)
+	return err
+}
+
+// DiscoverByHash maps identifier hashes to the usernames of accounts with that verified phone number
+func (s *UserStorage) DiscoverByHash(hashes []string) (map[string]string, error) {
+	matches := make(map[string]string)
+	// stay well below SQLite's bound parameter limit
+	for len(hashes) > 0 {
+		batch := hashes
+		if len(batch) > 500 {
+			batch = batch[:500]
+		}
+		hashes = hashes[len(batch):]
+
+		args := make([]interface{}, len(batch))
+		for i, h := range batch {
+			args[i] = strings.ToLower(h)
+		}
+		querySQL := `SELECT phone_hash, username FROM users WHERE phone_hash IN (?` + strings.Repeat(", ?", len(batch)-1) + `)`
+		rows, err := s.db.Query(querySQL, args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var hash, username string
+			if err := rows.Scan(&hash, &username); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			matches[hash] = username
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return matches, nil
+}
@@ -0,0 +1,253 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"log"
+	"time"
+)
+
+// key log actions
+const (
+	KeyRegistered = "register" // first key of an account, or a key that predates the log
+	KeyRotated    = "rotate"   // the account replaced its key
+	KeyRenamed    = "rename"   // the account, and its current key, moved to a new username
+	KeyDeleted    = "delete"   // the account was deleted, username is its tombstone and the key is retired
+)
+
+// ErrUnknownLogHead is returned for proofs against a log size the server hasn't reached
+var ErrUnknownLogHead = errors.New("key log head not found")
+
+// KeyLogEntry is one record of the append-only key transparency log.
+// Hash chains every entry to the one before it, so rewriting history changes the head
+type KeyLogEntry struct {
+	Seq              int64     `json:"seq"`
+	Action           string    `json:"action"`
+	Username         string    `json:"username"`
+	PreviousUsername string    `json:"previousUsername,omitempty"`
+	PublicKey        []byte    `json:"publicKey"`
+	CreatedAt        time.Time `json:"createdAt"`
+	PrevHash         []byte    `json:"prevHash"`
+	Hash             []byte    `json:"hash"`
+}
+
+// KeyLogHead identifies the log at a given size, clients compare heads with each other
+// to detect a server showing them different logs
+type KeyLogHead struct {
+	Seq  int64  `json:"seq"`
+	Hash []byte `json:"hash"`
+}
+
+// KeyProof shows that Entry is part of the log at Head: hashing Entry.Hash with each
+// leaf hash in Path, in order, gives Head.Hash
+type KeyProof struct {
+	Entry KeyLogEntry `json:"entry"`
+	Path  [][]byte    `json:"path"`
+	Head  KeyLogHead  `json:"head"`
+}
+
+func createKeyLogTable(db *sql.DB) {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS key_log (
+		"seq" INTEGER NOT NULL PRIMARY KEY,
+		"action" TEXT NOT NULL,
+		"username" TEXT NOT NULL,
+		"previous_username" TEXT NOT NULL DEFAULT '',
+		"public_key" BLOB NOT NULL,
+		"created_at" INTEGER NOT NULL,
+		"prev_hash" BLOB NOT NULL,
+		"hash" BLOB NOT NULL);
+	CREATE INDEX IF NOT EXISTS key_log_username ON key_log (username, seq);`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Fatalf("Failed to create key_log table: %v", err)
+	}
+}
+
+// seedKeyLog records keys registered before the log existed, once, when the log is empty
+func seedKeyLog(db *sql.DB) {
+	var empty bool
+	if err := db.QueryRow(`SELECT NOT EXISTS(SELECT 1 FROM key_log)`).Scan(&empty); err != nil {
+		log.Fatalf("Failed to read key_log: %v", err)
+	}
+	if !empty {
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatalf("Failed to seed key_log: %v", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT username, public_key FROM users WHERE length(public_key) > 0 ORDER BY username`)
+	if err != nil {
+		log.Fatalf("Failed to seed key_log: %v", err)
+	}
+	var keys []UserKey
+	for rows.Next() {
+		var key UserKey
+		if err := rows.Scan(&key.Username, &key.PublicKey); err != nil {
+			log.Fatalf("Failed to seed key_log: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+
+	now := time.Now()
+	for _, key := range keys {
+		if err := appendKeyLog(tx, KeyRegistered, key.Username, "", key.PublicKey, now); err != nil {
+			log.Fatalf("Failed to seed key_log: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Fatalf("Failed to seed key_log: %v", err)
+	}
+	if len(keys) > 0 {
+		log.Printf("Added %d existing public keys to the key log", len(keys))
+	}
+}
+
+// appendKeyLog adds an entry after the current head. Callers hold keyLogMu so
+// concurrent transactions can't both extend the same head
+func appendKeyLog(tx *sql.Tx, action, username, previous string, publicKey []byte, now time.Time) error {
+	head, err := keyLogHead(tx)
+	if err != nil {
+		return err
+	}
+	entry := KeyLogEntry{
+		Seq:              head.Seq + 1,
+		Action:           action,
+		Username:         username,
+		PreviousUsername: previous,
+		PublicKey:        publicKey,
+		CreatedAt:        time.Unix(now.Unix(), 0),
+		PrevHash:         head.Hash,
+	}
+	entry.Hash = ChainHash(entry.PrevHash, entry.LeafHash())
+
+	insertSQL := `INSERT INTO key_log (seq, action, username, previous_username, public_key, created_at, prev_hash, hash)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err = tx.Exec(insertSQL, entry.Seq, entry.Action, entry.Username, entry.PreviousUsername,
+		entry.PublicKey, entry.CreatedAt.Unix(), entry.PrevHash, entry.Hash)
+	return err
+}
+
+// LeafHash is SHA-256 over the seq and creation time as big endian uint64s followed by
+// the action, username, previous username and public key, each prefixed with its length
+// as a big endian uint32
+func (e *KeyLogEntry) LeafHash() []byte {
+	var b []byte
+	b = binary.BigEndian.AppendUint64(b, uint64(e.Seq))
+	b = binary.BigEndian.AppendUint64(b, uint64(e.CreatedAt.Unix()))
+	for _, field := range [][]byte{[]byte(e.Action), []byte(e.Username), []byte(e.PreviousUsername), e.PublicKey} {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(field)))
+		b = append(b, field...)
+	}
+	sum := sha256.Sum256(b)
+	return sum[:]
+}
+
+// ChainHash links a leaf to the hash of the entry before it, the first entry follows 32 zero bytes
+func ChainHash(prev, leaf []byte) []byte {
+	sum := sha256.Sum256(append(append([]byte{}, prev...), leaf...))
+	return sum[:]
+}
+
+// querier is the part of *sql.DB and *sql.Tx the key log reads need
+type querier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func keyLogHead(q querier) (KeyLogHead, error) {
+	head := KeyLogHead{Hash: make([]byte, sha256.Size)}
+	err := q.QueryRow(`SELECT seq, hash FROM key_log ORDER BY seq DESC LIMIT 1`).Scan(&head.Seq, &head.Hash)
+	if err == sql.ErrNoRows {
+		return head, nil
+	}
+	return head, err
+}
+
+// KeyLogHead returns the latest seq and hash of the key log
+func (s *UserStorage) KeyLogHead() (KeyLogHead, error) {
+	return keyLogHead(s.db)
+}
+
+const keyLogColumns = `seq, action, username, previous_username, public_key, created_at, prev_hash, hash`
+
+func scanKeyLogEntry(scan func(dest ...interface{}) error) (KeyLogEntry, error) {
+	var entry KeyLogEntry
+	var createdAt int64
+	err := scan(&entry.Seq, &entry.Action, &entry.Username, &entry.PreviousUsername,
+		&entry.PublicKey, &createdAt, &entry.PrevHash, &entry.Hash)
+	entry.CreatedAt = time.Unix(createdAt, 0)
+	return entry, err
+}
+
+// KeyLogAfter returns up to limit entries following seq after, oldest first
+func (s *UserStorage) KeyLogAfter(after int64, limit int) ([]KeyLogEntry, error) {
+	rows, err := s.db.Query(`SELECT `+keyLogColumns+` FROM key_log WHERE seq > ? ORDER BY seq LIMIT ?`, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []KeyLogEntry{}
+	for rows.Next() {
+		entry, err := scanKeyLogEntry(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// KeyProof returns the latest entry for username in the log at seq head, 0 meaning the
+// current head, with the leaf hashes linking it to that head
+func (s *UserStorage) KeyProof(username string, head int64) (*KeyProof, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	current, err := keyLogHead(tx)
+	if err != nil {
+		return nil, err
+	}
+	proof := &KeyProof{Head: current, Path: [][]byte{}}
+	if head != 0 && head != current.Seq {
+		if head < 0 || head > current.Seq {
+			return nil, ErrUnknownLogHead
+		}
+		proof.Head.Seq = head
+		if err := tx.QueryRow(`SELECT hash FROM key_log WHERE seq = ?`, head).Scan(&proof.Head.Hash); err != nil {
+			return nil, err
+		}
+	}
+
+	querySQL := `SELECT ` + keyLogColumns + ` FROM key_log WHERE username = ? AND seq <= ? ORDER BY seq DESC LIMIT 1`
+	proof.Entry, err = scanKeyLogEntry(tx.QueryRow(querySQL, username, proof.Head.Seq).Scan)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoPublicKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(`SELECT `+keyLogColumns+` FROM key_log WHERE seq > ? AND seq <= ? ORDER BY seq`, proof.Entry.Seq, proof.Head.Seq)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		entry, err := scanKeyLogEntry(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		proof.Path = append(proof.Path, entry.LeafHash())
+	}
+	return proof, rows.Err()
+}
@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// supported password hashing algorithms
+const (
+	AlgorithmBcrypt   = "bcrypt"
+	AlgorithmArgon2id = "argon2id"
+)
+
+// PasswordHasher hashes new passwords and decides when stored hashes are outdated
+type PasswordHasher interface {
+	// Hash returns an encoded hash for password
+	Hash(password string) ([]byte, error)
+	// NeedsRehash reports whether hash was produced by a different algorithm or parameters
+	NeedsRehash(hash []byte) bool
+}
+
+// HashingConfig selects and tunes the password hashing algorithm
+type HashingConfig struct {
+	Algorithm     string
+	BcryptCost    int
+	Argon2Memory  uint32 // KiB
+	Argon2Time    uint32
+	Argon2Threads uint8
+}
+
+// NewPasswordHasher builds the hasher described by cfg
+func NewPasswordHasher(cfg HashingConfig) (PasswordHasher, error) {
+	switch cfg.Algorithm {
+	case AlgorithmBcrypt:
+		if cfg.BcryptCost < bcrypt.MinCost || cfg.BcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		return &bcryptHasher{cost: cfg.BcryptCost}, nil
+	case AlgorithmArgon2id, "":
+		if cfg.Argon2Memory == 0 || cfg.Argon2Time == 0 || cfg.Argon2Threads == 0 {
+			return nil, errors.New("argon2id memory, time and threads must be positive")
+		}
+		return &argon2idHasher{
+			memory:  cfg.Argon2Memory,
+			time:    cfg.Argon2Time,
+			threads: cfg.Argon2Threads,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown password hashing algorithm: %s", cfg.Algorithm)
+	}
+}
+
+// verifyPassword checks password against a stored hash of any supported algorithm
+func verifyPassword(hash []byte, password string) bool {
+	if strings.HasPrefix(string(hash), "$argon2id$") {
+		params, salt, key, err := decodeArgon2id(hash)
+		if err != nil {
+			return false
+		}
+		candidate := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(candidate, key) == 1
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+// bcryptHasher hashes passwords with bcrypt at a fixed cost
+type bcryptHasher struct {
+	cost int
+}
+
+func (h *bcryptHasher) Hash(password string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(password), h.cost)
+}
+
+func (h *bcryptHasher) NeedsRehash(hash []byte) bool {
+	cost, err := bcrypt.Cost(hash)
+	return err != nil || cost != h.cost
+}
+
+// argon2idHasher hashes passwords with argon2id and stores them in PHC string format
+type argon2idHasher struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+}
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+func (h *argon2idHasher) Hash(password string) ([]byte, error) {
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.time, h.memory, h.threads, argon2KeyLength)
+
+	encoded := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.memory, h.time, h.threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key))
+	return []byte(encoded), nil
+}
+
+func (h *argon2idHasher) NeedsRehash(hash []byte) bool {
+	params, _, key, err := decodeArgon2id(hash)
+	if err != nil {
+		return true
+	}
+	return params.memory != h.memory || params.time != h.time || params.threads != h.threads ||
+		len(key) != argon2KeyLength
+}
+
+// decodeArgon2id parses a PHC formatted argon2id hash
+func decodeArgon2id(hash []byte) (*argon2idHasher, []byte, []byte, error) {
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, nil, nil, errors.New("invalid argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return nil, nil, nil, err
+	}
+	if version != argon2.Version {
+		return nil, nil, nil, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+
+	params := &argon2idHasher{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+		return nil, nil, nil, err
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return params, salt, key, nil
+}
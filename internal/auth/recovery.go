@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+// RecoveryCodeCount is how many recovery codes an account gets at a time
+const RecoveryCodeCount = 10
+
+// ErrInvalidRecoveryCode is returned for recovery codes that are wrong or already used
+var ErrInvalidRecoveryCode = errors.New("recovery code is wrong or already used")
+
+// recoveryAlphabet leaves out letters and digits that are easily confused (0/O, 1/I)
+const recoveryAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// recovery codes are 16 characters from a 32 letter alphabet, 80 bits, so a plain hash is
+// enough to store them
+const recoveryCodeLength = 16
+
+func createRecoveryTable(db *sql.DB) {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS recovery_codes (
+		"username" TEXT NOT NULL,
+		"code_hash" TEXT NOT NULL,
+		"created_at" INTEGER NOT NULL,
+		PRIMARY KEY (username, code_hash));`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Fatalf("Failed to create recovery code table: %v", err)
+	}
+}
+
+// normalizeRecoveryCode drops the dashes and spaces codes are written with and uppercases them
+func normalizeRecoveryCode(code string) string {
+	return strings.ToUpper(strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, code))
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+func newRecoveryCode() string {
+	b := make([]byte, recoveryCodeLength)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	var code strings.Builder
+	for i, c := range b {
+		if i > 0 && i%4 == 0 {
+			code.WriteByte('-')
+		}
+		// 256 is a multiple of 32, so every letter is equally likely
+		code.WriteByte(recoveryAlphabet[int(c)%len(recoveryAlphabet)])
+	}
+	return code.String()
+}
+
+// GenerateRecoveryCodes replaces username's recovery codes with a new set and returns it. Only
+// hashes are stored, the codes can't be shown again
+func (s *UserStorage) GenerateRecoveryCodes(username string) ([]string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE username = ?`, username); err != nil {
+		return nil, err
+	}
+	codes := make([]string, RecoveryCodeCount)
+	now := time.Now().Unix()
+	for i := range codes {
+		codes[i] = newRecoveryCode()
+		if _, err := tx.Exec(`INSERT INTO recovery_codes (username, code_hash, created_at) VALUES (?, ?, ?)`,
+			username, hashRecoveryCode(codes[i]), now); err != nil {
+			return nil, err
+		}
+	}
+	return codes, tx.Commit()
+}
+
+// UseRecoveryCode consumes one of username's recovery codes and returns how many are left
+func (s *UserStorage) UseRecoveryCode(username, code string) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM recovery_codes WHERE username = ? AND code_hash = ?`, username, hashRecoveryCode(code))
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return 0, ErrInvalidRecoveryCode
+	}
+	var left int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM recovery_codes WHERE username = ?`, username).Scan(&left); err != nil {
+		return 0, err
+	}
+	return left, tx.Commit()
+}
+
+// RecoveryCodesLeft returns how many unused recovery codes username has
+func (s *UserStorage) RecoveryCodesLeft(username string) (int, error) {
+	var left int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM recovery_codes WHERE username = ?`, username).Scan(&left)
+	return left, err
+}
@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// username recycling policies, when a deleted account's username can be registered again
+const (
+	RecyclePermanent = "permanent" // never, nobody can take over the name of someone who left
+	RecycleCooldown  = "cooldown"  // once the cooldown since the deletion has passed
+	RecycleImmediate = "immediate" // as soon as the account is deleted
+)
+
+// UsernameRecycling is the policy for deleted accounts' usernames
+type UsernameRecycling struct {
+	Policy   string        // one of the Recycle* constants, empty means RecycleCooldown
+	Cooldown time.Duration // how long a name is held under RecycleCooldown
+}
+
+// ValidRecyclingPolicy reports whether policy is one of the Recycle* constants
+func ValidRecyclingPolicy(policy string) bool {
+	return policy == RecyclePermanent || policy == RecycleCooldown || policy == RecycleImmediate
+}
+
+// createDeletedUsernameTable records the names of deleted accounts. Unlike tombstones, which
+// go when their data is purged, a row stays for as long as the policy may hold the name
+func createDeletedUsernameTable(db *sql.DB) {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS deleted_usernames (
+		"username" TEXT NOT NULL PRIMARY KEY,
+		"deleted_at" INTEGER NOT NULL);`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Fatalf("Failed to create deleted_usernames table: %v", err)
+	}
+	// accounts deleted before the table existed were held by their tombstone, a tombstone
+	// whose name was taken over again holds its id instead
+	if _, err := db.Exec(`INSERT OR IGNORE INTO deleted_usernames (username, deleted_at)
+		SELECT username, deleted_at FROM tombstones WHERE username != id`); err != nil {
+		log.Fatalf("Failed to record deleted usernames: %v", err)
+	}
+}
+
+// recordDeletedUsername notes that name was deleted at now, a later deletion of an account
+// that took the name over restarts its cooldown
+func recordDeletedUsername(tx *sql.Tx, name string, now time.Time) error {
+	_, err := tx.Exec(`INSERT OR REPLACE INTO deleted_usernames (username, deleted_at) VALUES (?, ?)`, name, now.Unix())
+	return err
+}
+
+// usernameRetired reports whether name belonged to a deleted account and the recycling
+// policy still holds it
+func (s *UserStorage) usernameRetired(q querier, name string, now time.Time) (bool, error) {
+	if s.recycling.Policy == RecycleImmediate {
+		return false, nil
+	}
+	var deletedAt int64
+	err := q.QueryRow(`SELECT deleted_at FROM deleted_usernames WHERE username = ?`, name).Scan(&deletedAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if s.recycling.Policy == RecyclePermanent {
+		return true, nil
+	}
+	return now.Before(time.Unix(deletedAt, 0).Add(s.recycling.Cooldown)), nil
+}
@@ -0,0 +1,25 @@
+package auth
+
+import "database/sql"
+
+// Region returns the data residency region of an account, empty when it isn't tagged
+func (s *UserStorage) Region(username string) (string, error) {
+	var region string
+	err := s.db.QueryRow(`SELECT region FROM users WHERE username = ?`, username).Scan(&region)
+	if err == sql.ErrNoRows {
+		return "", ErrUserNotFound
+	}
+	return region, err
+}
+
+// SetRegion tags an account with a data residency region, empty moves it back to the main storage
+func (s *UserStorage) SetRegion(username, region string) error {
+	result, err := s.db.Exec(`UPDATE users SET region = ? WHERE username = ?`, region, username)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
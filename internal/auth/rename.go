@@ -0,0 +1,238 @@
+package auth
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/textpolicy"
+)
+
+// MaxUsernameLength is the default limit on username length
+const MaxUsernameLength = 32
+
+// ErrInvalidUsername is returned for empty, too long or unchanged usernames
+var ErrInvalidUsername = fmt.Errorf("username must be 1 to %d characters and differ from the current one", MaxUsernameLength)
+
+// usernameReference is a column outside the users table that stores usernames
+type usernameReference struct {
+	Table  string
+	Column string
+	Where  string // optional extra condition limiting which rows hold usernames
+	Remove bool   // rows are deleted with the account instead of pointing at its tombstone
+}
+
+// usernameReferences lists every column that must follow a rename or be tombstoned when
+// the account is deleted. Features storing usernames register their columns here
+var usernameReferences = []usernameReference{
+	{Table: "messages", Column: "sender"},
+	{Table: "messages", Column: "recipient"},
+	{Table: "dead_letters", Column: "sender"},
+	{Table: "dead_letters", Column: "recipient"},
+	{Table: "retention_policies", Column: "subject", Where: `scope = 'user'`, Remove: true},
+	{Table: "spam_flags", Column: "username"},
+	{Table: "spam_held", Column: "sender"},
+	{Table: "spam_held", Column: "recipient"},
+	{Table: "attachments", Column: "owner"},
+	{Table: "phone_verifications", Column: "username", Remove: true},
+	{Table: "email_verifications", Column: "username", Remove: true},
+	{Table: "passkeys", Column: "username", Remove: true},
+	{Table: "passkey_users", Column: "username", Remove: true},
+	{Table: "recovery_codes", Column: "username", Remove: true},
+	{Table: "notification_preferences", Column: "username", Remove: true},
+	{Table: "saved_messages", Column: "username", Remove: true},
+	{Table: "support_tickets", Column: "username"},
+	{Table: "support_messages", Column: "author"},
+	{Table: "inbound_emails", Column: "username", Remove: true},
+	{Table: "conversation_settings", Column: "username", Remove: true},
+	{Table: "conversation_settings", Column: "subject", Where: `scope = 'user'`},
+	{Table: "drafts", Column: "username", Remove: true},
+	{Table: "drafts", Column: "subject", Where: `scope = 'user'`},
+	{Table: "connection_events", Column: "username", Remove: true},
+	{Table: "login_origins", Column: "username", Remove: true},
+	{Table: "room_members", Column: "username", Remove: true},
+	{Table: "room_messages", Column: "sender"},
+	{Table: "room_pins", Column: "pinned_by"},
+	{Table: "room_public_posts", Column: "author"},
+	{Table: "room_events", Column: "creator"},
+	{Table: "room_event_rsvps", Column: "username", Remove: true},
+	{Table: "room_polls", Column: "creator"},
+	{Table: "room_poll_votes", Column: "voter"}, // anonymous polls store hashes, which never match
+	{Table: "room_mutes", Column: "username", Remove: true},
+	{Table: "room_mutes", Column: "muted_by"},
+	{Table: "room_join_requests", Column: "username", Remove: true},
+	{Table: "room_changes", Column: "username", Remove: true},
+	{Table: "room_exports", Column: "created_by"},
+	{Table: "feature_flag_users", Column: "username", Remove: true},
+	{Table: "onboarded_users", Column: "username", Remove: true},
+	{Table: "legal_holds", Column: "username"}, // the hold keeps a deleted account's tombstone from being purged
+}
+
+// checkUsername applies the text policy to a new username. The error is a *textpolicy.Error,
+// or ErrInvalidUsername for an overlong name when no policy is configured
+func (s *UserStorage) checkUsername(username string) error {
+	if IsTombstone(username) {
+		return ErrInvalidUsername
+	}
+	if s.text == nil {
+		if len(username) > MaxUsernameLength {
+			return ErrInvalidUsername
+		}
+		return nil
+	}
+	_, err := s.text.Clean(textpolicy.Username, username)
+	return err
+}
+
+// Alias is a previous username that still resolves to its new owner
+type Alias struct {
+	OldUsername string    `json:"oldUsername"`
+	Username    string    `json:"username"`
+	RenamedAt   time.Time `json:"renamedAt"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+func createAliasTable(db *sql.DB) {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS username_aliases (
+		"old_username" TEXT NOT NULL PRIMARY KEY,
+		"username" TEXT NOT NULL,
+		"renamed_at" INTEGER NOT NULL,
+		"expires_at" INTEGER NOT NULL);
+	CREATE INDEX IF NOT EXISTS username_aliases_username ON username_aliases (username);`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Fatalf("Failed to create username_aliases table: %v", err)
+	}
+}
+
+// RenameUser changes a username everywhere it is stored in a single transaction
+// the old name keeps resolving to the account, and can't be registered, until grace has passed
+func (s *UserStorage) RenameUser(oldName, newName string, grace time.Duration) error {
+	if newName == "" || newName == oldName {
+		return ErrInvalidUsername
+	}
+	if err := s.checkUsername(newName); err != nil {
+		return err
+	}
+
+	s.keyLogMu.Lock()
+	defer s.keyLogMu.Unlock()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	var taken bool
+	checkSQL := `SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)
+		OR EXISTS(SELECT 1 FROM username_aliases WHERE old_username = ? AND username != ? AND expires_at > ?)`
+	if err := tx.QueryRow(checkSQL, newName, newName, oldName, now.Unix()).Scan(&taken); err != nil {
+		return err
+	}
+	if !taken {
+		// a deleted account's name is held against renames like against registration
+		if taken, err = s.usernameRetired(tx, newName, now); err != nil {
+			return err
+		}
+	}
+	if taken {
+		return ErrUsernameTaken
+	}
+
+	res, err := tx.Exec(`UPDATE users SET username = ? WHERE username = ?`, newName, oldName)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+
+	for _, ref := range usernameReferences {
+		updateSQL := fmt.Sprintf(`UPDATE OR REPLACE %q SET %q = ? WHERE %q = ?`, ref.Table, ref.Column, ref.Column)
+		if ref.Where != "" {
+			updateSQL += " AND " + ref.Where
+		}
+		if _, err := tx.Exec(updateSQL, newName, oldName); err != nil {
+			return fmt.Errorf("renaming %s.%s: %v", ref.Table, ref.Column, err)
+		}
+	}
+
+	// taking back an old name drops its alias, earlier aliases follow the account
+	if _, err := tx.Exec(`DELETE FROM username_aliases WHERE old_username = ?`, newName); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE username_aliases SET username = ? WHERE username = ?`, newName, oldName); err != nil {
+		return err
+	}
+	insertSQL := `INSERT OR REPLACE INTO username_aliases (old_username, username, renamed_at, expires_at) VALUES (?, ?, ?, ?)`
+	if _, err := tx.Exec(insertSQL, oldName, newName, now.Unix(), now.Add(grace).Unix()); err != nil {
+		return err
+	}
+
+	// the key log is append only, the key moving to the new name is a new entry
+	var publicKey []byte
+	if err := tx.QueryRow(`SELECT public_key FROM users WHERE username = ?`, newName).Scan(&publicKey); err != nil {
+		return err
+	}
+	if len(publicKey) > 0 {
+		if err := appendKeyLog(tx, KeyRenamed, newName, oldName, publicKey, now); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ResolveUsername returns the current username for name, following unexpired aliases
+func (s *UserStorage) ResolveUsername(name string) (string, error) {
+	exists, err := s.UserExists(name)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return name, nil
+	}
+
+	var current string
+	querySQL := `SELECT username FROM username_aliases WHERE old_username = ? AND expires_at > ?`
+	err = s.db.QueryRow(querySQL, name, time.Now().Unix()).Scan(&current)
+	if err == sql.ErrNoRows {
+		return "", ErrUserNotFound
+	}
+	return current, err
+}
+
+// UsernameHistory returns the previous names of an account, most recent first
+func (s *UserStorage) UsernameHistory(username string) ([]Alias, error) {
+	querySQL := `SELECT old_username, username, renamed_at, expires_at FROM username_aliases
+	WHERE username = ? ORDER BY renamed_at DESC`
+	rows, err := s.db.Query(querySQL, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	aliases := []Alias{}
+	for rows.Next() {
+		var alias Alias
+		var renamedAt, expiresAt int64
+		if err := rows.Scan(&alias.OldUsername, &alias.Username, &renamedAt, &expiresAt); err != nil {
+			return nil, err
+		}
+		alias.RenamedAt = time.Unix(renamedAt, 0)
+		alias.ExpiresAt = time.Unix(expiresAt, 0)
+		aliases = append(aliases, alias)
+	}
+	return aliases, rows.Err()
+}
+
+// aliasActive reports whether name is a previous username still within its grace period
+func (s *UserStorage) aliasActive(name string) (bool, error) {
+	var active bool
+	querySQL := `SELECT EXISTS(SELECT 1 FROM username_aliases WHERE old_username = ? AND expires_at > ?)`
+	err := s.db.QueryRow(querySQL, name, time.Now().Unix()).Scan(&active)
+	return active, err
+}
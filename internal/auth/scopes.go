@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+)
+
+// token scopes, what a token may be used for
+const (
+	ScopeReadOnly = "readonly"  // read the API and receive over the websocket, every token can
+	ScopeChatSend = "chat:send" // send messages and change the rooms, drafts and settings the account owns
+	ScopeAccount  = "account"   // change the password, passkeys, recovery codes, keys and contact details, or delete the account
+	ScopeBots     = "bots"      // issue scoped tokens for integrations
+	ScopeAdmin    = "admin"     // the admin API, for configured admins only
+)
+
+// Scopes lists every scope in the order they are written to tokens
+var Scopes = []string{ScopeReadOnly, ScopeChatSend, ScopeAccount, ScopeBots, ScopeAdmin}
+
+// ErrInvalidScope is returned for scopes that don't exist
+var ErrInvalidScope = errors.New("invalid scope")
+
+// NormalizeScopes checks requested scopes and returns them deduplicated in canonical order.
+// readonly is implied and always included
+func NormalizeScopes(requested []string) ([]string, error) {
+	want := map[string]bool{ScopeReadOnly: true}
+	for _, scope := range requested {
+		known := false
+		for _, s := range Scopes {
+			known = known || s == scope
+		}
+		if !known {
+			return nil, ErrInvalidScope
+		}
+		want[scope] = true
+	}
+	scopes := make([]string, 0, len(want))
+	for _, s := range Scopes {
+		if want[s] {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes, nil
+}
+
+// HasScope reports whether the token may be used for scope. Tokens issued before scopes
+// existed carry none and may be used for anything their account can do
+func (c *UserClaims) HasScope(scope string) bool {
+	if c.Scope == "" {
+		return true
+	}
+	for _, s := range strings.Fields(c.Scope) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// ScopeList returns the token's scopes, every scope for tokens issued before scopes existed
+func (c *UserClaims) ScopeList() []string {
+	if c.Scope == "" {
+		return Scopes
+	}
+	return strings.Fields(c.Scope)
+}
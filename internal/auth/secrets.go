@@ -0,0 +1,217 @@
+package auth
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/Chase-Garrett/meadowlark/internal/keyring"
+)
+
+// EncryptedColumn identifies a column whose values are sealed with the at-rest keyring
+type EncryptedColumn struct {
+	Table     string
+	KeyColumn string // primary key used to address rows
+	Column    string
+}
+
+// encryptedColumns lists every column holding data encrypted at rest
+// features storing secrets (TOTP seeds, push endpoints, ...) register their columns here
+// so key rotation picks them up
+var encryptedColumns = []EncryptedColumn{
+	{Table: "users", KeyColumn: "username", Column: "email"},               // looked up by email_hash
+	{Table: "users", KeyColumn: "username", Column: "phone"},               // looked up by phone_hash
+	{Table: "phone_verifications", KeyColumn: "username", Column: "phone"}, // numbers waiting for their code
+	{Table: "email_verifications", KeyColumn: "username", Column: "email"},
+}
+
+// hashPassword peppers and hashes password, returning the pepper id used (nil if none)
+func (s *UserStorage) hashPassword(password string) ([]byte, interface{}, error) {
+	pepperID := s.currentPepperID()
+	peppered, err := s.pepper(pepperID, password)
+	if err != nil {
+		return nil, nil, err
+	}
+	hash, err := s.hasher.Hash(peppered)
+	if err != nil {
+		return nil, nil, err
+	}
+	if pepperID == "" {
+		return hash, nil, nil
+	}
+	return hash, pepperID, nil
+}
+
+// pepper applies the pepper with the given id to password
+// an empty id means the hash was stored without a pepper
+func (s *UserStorage) pepper(pepperID, password string) (string, error) {
+	if pepperID == "" {
+		return password, nil
+	}
+	if s.peppers == nil {
+		return "", fmt.Errorf("password uses pepper %q but no peppers are configured", pepperID)
+	}
+	mac, err := s.peppers.HMAC(pepperID, []byte(password))
+	if err != nil {
+		return "", fmt.Errorf("pepper %q: %v", pepperID, err)
+	}
+	return base64.StdEncoding.EncodeToString(mac), nil
+}
+
+// currentPepperID returns the pepper applied to new hashes, or "" when peppering is disabled
+func (s *UserStorage) currentPepperID() string {
+	if s.peppers == nil {
+		return ""
+	}
+	return s.peppers.CurrentID()
+}
+
+// SetAtRestKeys replaces the keys of sensitive columns after a rotation. Encryption can't be
+// turned on or off this way, since existing values would become unreadable
+func (s *UserStorage) SetAtRestKeys(keys *keyring.Keyring) error {
+	if (keys == nil) != (s.atRest.Load() == nil) {
+		return errors.New("at-rest encryption can only be turned on or off with a restart")
+	}
+	s.atRest.Store(keys)
+	return nil
+}
+
+// sealColumn encrypts a sensitive value for storage, values pass through when no key is configured
+func (s *UserStorage) sealColumn(value []byte) ([]byte, error) {
+	atRest := s.atRest.Load()
+	if atRest == nil || value == nil {
+		return value, nil
+	}
+	return atRest.Encrypt(value)
+}
+
+// openColumn decrypts a value written by sealColumn. Values stored before encryption was
+// turned on pass through until sealPlaintext gets to them
+func (s *UserStorage) openColumn(value []byte) ([]byte, error) {
+	atRest := s.atRest.Load()
+	if atRest == nil || value == nil || !atRest.IsSealed(value) {
+		return value, nil
+	}
+	return atRest.Decrypt(value)
+}
+
+// sealPlaintext encrypts the values of registered columns stored before at-rest encryption
+// was turned on, run at startup so they don't wait for a key rotation
+func (s *UserStorage) sealPlaintext() error {
+	atRest := s.atRest.Load()
+	if atRest == nil {
+		return nil
+	}
+	for _, col := range encryptedColumns {
+		if _, err := s.rotateColumn(atRest, col, true); err != nil {
+			return fmt.Errorf("sealing %s.%s: %v", col.Table, col.Column, err)
+		}
+	}
+	return nil
+}
+
+// RotationReport summarizes a key rotation run
+type RotationReport struct {
+	Reencrypted     int            // values moved to the current at-rest key
+	StalePeppers    map[string]int // users per old pepper id, migrated on their next login
+	UnpepperedUsers int            // users hashed before a pepper was configured
+}
+
+// RotateKeys re-encrypts every registered encrypted column with the current at-rest key
+// peppers cannot be rotated without the plaintext password, so stale peppers are only reported
+func (s *UserStorage) RotateKeys() (*RotationReport, error) {
+	report := &RotationReport{StalePeppers: make(map[string]int)}
+
+	if atRest := s.atRest.Load(); atRest != nil {
+		for _, col := range encryptedColumns {
+			n, err := s.rotateColumn(atRest, col, false)
+			if err != nil {
+				return report, fmt.Errorf("rotating %s.%s: %v", col.Table, col.Column, err)
+			}
+			report.Reencrypted += n
+		}
+	}
+
+	rows, err := s.db.Query(`SELECT COALESCE(pepper_id, ''), COUNT(*) FROM users GROUP BY pepper_id`)
+	if err != nil {
+		return report, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pepperID string
+		var count int
+		if err := rows.Scan(&pepperID, &count); err != nil {
+			return report, err
+		}
+		switch {
+		case pepperID == s.currentPepperID():
+		case pepperID == "":
+			report.UnpepperedUsers = count
+		default:
+			report.StalePeppers[pepperID] = count
+		}
+	}
+	return report, rows.Err()
+}
+
+// rotateColumn re-encrypts values of one column that aren't under the current key, and seals
+// the ones still in plaintext. With plaintextOnly, sealed values are left under their key
+func (s *UserStorage) rotateColumn(atRest *keyring.Keyring, col EncryptedColumn, plaintextOnly bool) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf(`SELECT %q, %q FROM %q WHERE %q IS NOT NULL`, col.KeyColumn, col.Column, col.Table, col.Column)
+	rows, err := tx.Query(query)
+	if err != nil {
+		return 0, err
+	}
+
+	type pending struct {
+		key   interface{}
+		value []byte
+	}
+	var stale []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.key, &p.value); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if sealed := atRest.IsSealed(p.value); !sealed || (!plaintextOnly && !atRest.IsCurrent(p.value)) {
+			stale = append(stale, p)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	update := fmt.Sprintf(`UPDATE %q SET %q = ? WHERE %q = ?`, col.Table, col.Column, col.KeyColumn)
+	for _, p := range stale {
+		plaintext := p.value
+		if atRest.IsSealed(p.value) {
+			if plaintext, err = atRest.Decrypt(p.value); err != nil {
+				return 0, err
+			}
+		}
+		sealed, err := atRest.Encrypt(plaintext)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec(update, sealed, p.key); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	if len(stale) > 0 {
+		log.Printf("Encrypted %d values in %s.%s", len(stale), col.Table, col.Column)
+	}
+	return len(stale), nil
+}
@@ -0,0 +1,43 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// presence statuses a user can choose, overriding the automatic available or away
+const (
+	StatusAvailable = "available"
+	StatusBusy      = "busy"
+	StatusInvisible = "invisible" // shown as offline
+)
+
+// ErrInvalidStatus is returned for statuses users can't choose
+var ErrInvalidStatus = errors.New("status must be available, busy, invisible or empty for automatic")
+
+// Status returns the presence status an account chose, empty when it's automatic
+func (s *UserStorage) Status(username string) (string, error) {
+	var status string
+	err := s.db.QueryRow(`SELECT status FROM users WHERE username = ?`, username).Scan(&status)
+	if err == sql.ErrNoRows {
+		return "", ErrUserNotFound
+	}
+	return status, err
+}
+
+// SetStatus chooses an account's presence status, empty goes back to automatic
+func (s *UserStorage) SetStatus(username, status string) error {
+	switch status {
+	case "", StatusAvailable, StatusBusy, StatusInvisible:
+	default:
+		return ErrInvalidStatus
+	}
+	result, err := s.db.Exec(`UPDATE users SET status = ? WHERE username = ?`, status, username)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
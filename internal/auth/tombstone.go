@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// TombstonePrefix starts the identifier that replaces a deleted account's username,
+// it can't be registered so tombstones never collide with real accounts
+const TombstonePrefix = "deleted:"
+
+// Tombstone stands in for a deleted account in history, rooms and other records
+// until its data is purged
+type Tombstone struct {
+	ID        string    `json:"id"`
+	DeletedAt time.Time `json:"deletedAt"`
+	PurgeAt   time.Time `json:"purgeAt"`
+}
+
+// IsTombstone reports whether name is a deleted account's tombstone
+func IsTombstone(name string) bool {
+	return strings.HasPrefix(name, TombstonePrefix)
+}
+
+func createTombstoneTable(db *sql.DB) {
+	// username is the name the tombstone replaced, deleted_usernames holds it against
+	// registration for as long as the recycling policy says
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS tombstones (
+		"id" TEXT NOT NULL PRIMARY KEY,
+		"username" TEXT NOT NULL UNIQUE,
+		"deleted_at" INTEGER NOT NULL,
+		"purge_at" INTEGER NOT NULL);`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Fatalf("Failed to create tombstones table: %v", err)
+	}
+}
+
+// DeleteAccount removes an account, pointing every record that names it at a new tombstone
+// so conversations and rooms stay intact. Records listed with Remove are deleted instead.
+// The tombstoned data is kept until grace has passed and PurgeTombstone is called
+func (s *UserStorage) DeleteAccount(username string, grace time.Duration) (*Tombstone, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tomb := &Tombstone{
+		ID:        TombstonePrefix + hex.EncodeToString(random),
+		DeletedAt: now,
+		PurgeAt:   now.Add(grace),
+	}
+
+	s.keyLogMu.Lock()
+	defer s.keyLogMu.Unlock()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var publicKey []byte
+	err = tx.QueryRow(`SELECT public_key FROM users WHERE username = ?`, username).Scan(&publicKey)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM users WHERE username = ?`, username); err != nil {
+		return nil, err
+	}
+
+	for _, ref := range usernameReferences {
+		query := fmt.Sprintf(`UPDATE OR REPLACE %q SET %q = ? WHERE %q = ?`, ref.Table, ref.Column, ref.Column)
+		args := []interface{}{tomb.ID, username}
+		if ref.Remove {
+			query = fmt.Sprintf(`DELETE FROM %q WHERE %q = ?`, ref.Table, ref.Column)
+			args = args[1:]
+		}
+		if ref.Where != "" {
+			query += " AND " + ref.Where
+		}
+		if _, err := tx.Exec(query, args...); err != nil {
+			return nil, fmt.Errorf("tombstoning %s.%s: %v", ref.Table, ref.Column, err)
+		}
+	}
+
+	// previous names are released with the account, the tombstone row holds the current one
+	if _, err := tx.Exec(`DELETE FROM username_aliases WHERE username = ?`, username); err != nil {
+		return nil, err
+	}
+	// a name recycled before the earlier account's data was purged is now this tombstone's
+	if _, err := tx.Exec(`UPDATE tombstones SET username = id WHERE username = ?`, username); err != nil {
+		return nil, err
+	}
+	if err := recordDeletedUsername(tx, username, now); err != nil {
+		return nil, err
+	}
+	insertSQL := `INSERT INTO tombstones (id, username, deleted_at, purge_at) VALUES (?, ?, ?, ?)`
+	if _, err := tx.Exec(insertSQL, tomb.ID, username, now.Unix(), tomb.PurgeAt.Unix()); err != nil {
+		return nil, err
+	}
+
+	// the log shows the key is no longer in use, so clients stop encrypting to it
+	if len(publicKey) > 0 {
+		if err := appendKeyLog(tx, KeyDeleted, tomb.ID, username, publicKey, now); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return tomb, nil
+}
+
+// DueTombstones returns tombstones whose grace period has ended by now, those under legal hold
+// wait until it is released
+func (s *UserStorage) DueTombstones(now time.Time) ([]Tombstone, error) {
+	querySQL := `SELECT id, deleted_at, purge_at FROM tombstones
+	WHERE purge_at <= ? AND id NOT IN (SELECT username FROM legal_holds) ORDER BY purge_at`
+	rows, err := s.db.Query(querySQL, now.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var due []Tombstone
+	for rows.Next() {
+		var tomb Tombstone
+		var deletedAt, purgeAt int64
+		if err := rows.Scan(&tomb.ID, &deletedAt, &purgeAt); err != nil {
+			return nil, err
+		}
+		tomb.DeletedAt = time.Unix(deletedAt, 0)
+		tomb.PurgeAt = time.Unix(purgeAt, 0)
+		due = append(due, tomb)
+	}
+	return due, rows.Err()
+}
+
+// PurgeTombstone deletes every record still naming a tombstone, including messages
+// other people exchanged with the deleted account, and frees its username
+func (s *UserStorage) PurgeTombstone(id string) error {
+	if !IsTombstone(id) {
+		return fmt.Errorf("%q is not a tombstone", id)
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, ref := range usernameReferences {
+		query := fmt.Sprintf(`DELETE FROM %q WHERE %q = ?`, ref.Table, ref.Column)
+		if ref.Where != "" {
+			query += " AND " + ref.Where
+		}
+		if _, err := tx.Exec(query, id); err != nil {
+			return fmt.Errorf("purging %s.%s: %v", ref.Table, ref.Column, err)
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM tombstones WHERE id = ?`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
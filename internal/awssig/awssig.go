@@ -0,0 +1,170 @@
+// Package awssig signs requests with AWS Signature Version 4, for S3 compatible object stores
+// and the AWS JSON APIs alike
+package awssig
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	algorithm  = "AWS4-HMAC-SHA256"
+	dateFormat = "20060102T150405Z"
+	dayFormat  = "20060102"
+)
+
+// UnsignedPayload stands in for the body's hash, so an upload can stream without hashing it first
+const UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+// Signer holds credentials and the region and service they are used for
+type Signer struct {
+	AccessKey string
+	SecretKey string
+	Region    string
+	Service   string // e.g. "s3" or "kms"
+}
+
+// PayloadHash is the hex SHA-256 of body, as Sign wants it
+func PayloadHash(body []byte) string {
+	hash := sha256.Sum256(body)
+	return hex.EncodeToString(hash[:])
+}
+
+// Sign sets the X-Amz-Date and Authorization headers of req. payloadHash is PayloadHash of the
+// body or UnsignedPayload. Host, Content-Type and X-Amz-* headers are signed, so set those first
+func (s *Signer) Sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format(dateFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	signedHeaders, canonicalHeaders := canonicalizeHeaders(req.URL.Host, req.Header)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalPath(req.URL),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := s.scope(now)
+	signature := s.signature(now, stringToSign(amzDate, scope, canonicalRequest))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		algorithm, s.AccessKey, scope, signedHeaders, signature))
+}
+
+// Presign returns a copy of u whose query string allows method without credentials until
+// expires has passed. Only the host is signed and the body isn't
+func (s *Signer) Presign(method string, u *url.URL, expires time.Duration, now time.Time) *url.URL {
+	amzDate := now.UTC().Format(dateFormat)
+	scope := s.scope(now)
+
+	query := u.Query()
+	query.Set("X-Amz-Algorithm", algorithm)
+	query.Set("X-Amz-Credential", s.AccessKey+"/"+scope)
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", fmt.Sprintf("%d", int(expires.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		canonicalPath(u),
+		canonicalQuery(query),
+		"host:" + u.Host + "\n",
+		"host",
+		UnsignedPayload,
+	}, "\n")
+	query.Set("X-Amz-Signature", s.signature(now, stringToSign(amzDate, scope, canonicalRequest)))
+
+	signed := *u
+	signed.RawQuery = canonicalQuery(query)
+	return &signed
+}
+
+func (s *Signer) scope(now time.Time) string {
+	return now.UTC().Format(dayFormat) + "/" + s.Region + "/" + s.Service + "/aws4_request"
+}
+
+func (s *Signer) signature(now time.Time, toSign string) string {
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), now.UTC().Format(dayFormat))
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, s.Service)
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+func stringToSign(amzDate, scope, canonicalRequest string) string {
+	return algorithm + "\n" + amzDate + "\n" + scope + "\n" + PayloadHash([]byte(canonicalRequest))
+}
+
+func canonicalPath(u *url.URL) string {
+	if path := u.EscapedPath(); path != "" {
+		return path
+	}
+	return "/"
+}
+
+func canonicalizeHeaders(host string, header http.Header) (string, string) {
+	names := []string{"host"}
+	values := map[string]string{"host": host}
+	for name, v := range header {
+		lower := strings.ToLower(name)
+		if lower != "content-type" && !strings.HasPrefix(lower, "x-amz-") {
+			continue
+		}
+		names = append(names, lower)
+		values[lower] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name + ":" + values[name] + "\n")
+	}
+	return strings.Join(names, ";"), b.String()
+}
+
+func canonicalQuery(query url.Values) string {
+	var keys []string
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, key := range keys {
+		vals := query[key]
+		sort.Strings(vals)
+		for _, v := range vals {
+			parts = append(parts, URIEncode(key)+"="+URIEncode(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// URIEncode percent-encodes everything except unreserved characters, as SigV4 requires
+func URIEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if ('A' <= ch && ch <= 'Z') || ('a' <= ch && ch <= 'z') || ('0' <= ch && ch <= '9') ||
+			ch == '-' || ch == '_' || ch == '.' || ch == '~' {
+			b.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
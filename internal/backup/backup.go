@@ -0,0 +1,114 @@
+package backup
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// pages copied per backup step, writers can make progress between steps
+const pagesPerStep = 256
+
+// Snapshot copies the live database db to destPath using SQLite's online backup API
+// destPath must not exist yet
+func Snapshot(ctx context.Context, db *sql.DB, destPath string) error {
+	if _, err := os.Stat(destPath); err == nil {
+		return fmt.Errorf("backup target %s already exists", destPath)
+	}
+
+	dest, err := sql.Open("sqlite3", destPath)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	if err := copyDatabase(ctx, dest, db); err != nil {
+		os.Remove(destPath)
+		return err
+	}
+	return nil
+}
+
+// Restore replaces the database at dbPath with the backup at srcPath
+// the server must not be running while restoring
+func Restore(ctx context.Context, srcPath, dbPath string) error {
+	if _, err := os.Stat(srcPath); err != nil {
+		return err
+	}
+
+	src, err := sql.Open("sqlite3", "file:"+srcPath+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	var result string
+	if err := src.QueryRowContext(ctx, `PRAGMA integrity_check`).Scan(&result); err != nil {
+		return fmt.Errorf("cannot read backup: %v", err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("backup failed integrity check: %s", result)
+	}
+
+	dest, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	return copyDatabase(ctx, dest, src)
+}
+
+// copyDatabase runs the SQLite backup API from src into dest
+func copyDatabase(ctx context.Context, dest, src *sql.DB) error {
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	return destConn.Raw(func(destDriver interface{}) error {
+		return srcConn.Raw(func(srcDriver interface{}) error {
+			destSQLite, ok := destDriver.(*sqlite3.SQLiteConn)
+			if !ok {
+				return errors.New("destination is not a sqlite3 connection")
+			}
+			srcSQLite, ok := srcDriver.(*sqlite3.SQLiteConn)
+			if !ok {
+				return errors.New("source is not a sqlite3 connection")
+			}
+
+			b, err := destSQLite.Backup("main", srcSQLite, "main")
+			if err != nil {
+				return err
+			}
+			for {
+				done, err := b.Step(pagesPerStep)
+				if err != nil {
+					b.Finish()
+					return err
+				}
+				if done {
+					break
+				}
+				select {
+				case <-ctx.Done():
+					b.Finish()
+					return ctx.Err()
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+			return b.Finish()
+		})
+	})
+}
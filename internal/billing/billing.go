@@ -0,0 +1,192 @@
+// Package billing reports the usage of a hosted deployment to the operator's billing system.
+// Usage events are written to an outbox table and posted to a webhook in order, so events
+// recorded while the webhook is down are sent once it is back
+package billing
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// event types
+const (
+	EventUserRegistered = "user.registered"
+	EventUserDeleted    = "user.deleted"
+	EventStorageAdded   = "storage.added" // a new blob, Quantity in bytes
+	EventUsageUsers     = "usage.users"   // periodic total of accounts
+	EventUsageStorage   = "usage.storage" // periodic total of stored bytes
+	EventLimitReached   = "limit.reached" // a request refused by the plan, Limit says which
+)
+
+// batchSize is the most events posted in one delivery
+const batchSize = 500
+
+// Event is one usage event
+type Event struct {
+	ID       int64     `json:"id"` // increasing, so the billing system can drop events it has seen
+	Type     string    `json:"type"`
+	Username string    `json:"username,omitempty"`
+	Limit    string    `json:"limit,omitempty"`
+	Quantity int64     `json:"quantity,omitempty"`
+	At       time.Time `json:"at"`
+}
+
+// Delivery is the body of a request to the billing webhook
+type Delivery struct {
+	Workspace string  `json:"workspace,omitempty"` // empty for the main workspace
+	Plan      string  `json:"plan,omitempty"`
+	Events    []Event `json:"events"` // in the order they happened
+}
+
+// Outbox keeps events until the webhook has taken them. The methods of a nil Outbox do
+// nothing, for deployments without a billing webhook
+type Outbox struct {
+	db        *sql.DB
+	workspace string
+	plan      string
+}
+
+// NewOutbox initializes the billing_events table on an open database
+func NewOutbox(db *sql.DB, workspace, plan string) *Outbox {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS billing_events (
+		"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+		"type" TEXT NOT NULL,
+		"username" TEXT NOT NULL DEFAULT '',
+		"limit_name" TEXT NOT NULL DEFAULT '',
+		"quantity" INTEGER NOT NULL DEFAULT 0,
+		"created_at" INTEGER NOT NULL);`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Fatalf("Failed to create billing_events table: %v", err)
+	}
+	return &Outbox{db: db, workspace: workspace, plan: plan}
+}
+
+// Record adds an event to the outbox. Failures are logged, usage reporting never fails the
+// request it is about
+func (o *Outbox) Record(e Event) {
+	if o == nil {
+		return
+	}
+	if e.At.IsZero() {
+		e.At = time.Now()
+	}
+	_, err := o.db.Exec(`INSERT INTO billing_events (type, username, limit_name, quantity, created_at) VALUES (?, ?, ?, ?, ?)`,
+		e.Type, e.Username, e.Limit, e.Quantity, e.At.UnixMilli())
+	if err != nil {
+		log.Printf("Error recording billing event %s: %v", e.Type, err)
+	}
+}
+
+// Pending counts the events not delivered yet
+func (o *Outbox) Pending() (int64, error) {
+	if o == nil {
+		return 0, nil
+	}
+	var n int64
+	err := o.db.QueryRow(`SELECT COUNT(*) FROM billing_events`).Scan(&n)
+	return n, err
+}
+
+// Webhook posts events to the billing system
+type Webhook struct {
+	URL    string
+	Secret string       // signs deliveries, see Sign
+	HTTP   *http.Client // optional, defaults to a client with a 10s timeout
+}
+
+// Flush delivers every pending event, oldest first, in batches. A batch is removed from the
+// outbox once the webhook accepted it, so a failed delivery is retried from there next time.
+// Returns how many events were delivered
+func (o *Outbox) Flush(ctx context.Context, hook *Webhook) (int, error) {
+	if o == nil {
+		return 0, nil
+	}
+	sent := 0
+	for {
+		events, err := o.batch()
+		if err != nil || len(events) == 0 {
+			return sent, err
+		}
+		if err := hook.post(ctx, Delivery{Workspace: o.workspace, Plan: o.plan, Events: events}); err != nil {
+			return sent, err
+		}
+		if _, err := o.db.Exec(`DELETE FROM billing_events WHERE id <= ?`, events[len(events)-1].ID); err != nil {
+			return sent, err
+		}
+		sent += len(events)
+	}
+}
+
+func (o *Outbox) batch() ([]Event, error) {
+	rows, err := o.db.Query(`SELECT id, type, username, limit_name, quantity, created_at FROM billing_events ORDER BY id LIMIT ?`, batchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []Event
+	for rows.Next() {
+		var e Event
+		var at int64
+		if err := rows.Scan(&e.ID, &e.Type, &e.Username, &e.Limit, &e.Quantity, &at); err != nil {
+			return nil, err
+		}
+		e.At = time.UnixMilli(at).UTC()
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func (h *Webhook) post(ctx context.Context, delivery Delivery) error {
+	client := h.HTTP
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	body, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "meadowlark-billing")
+	if h.Secret != "" {
+		req.Header.Set("Meadowlark-Signature", Sign(h.Secret, time.Now(), body))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("billing webhook: %s: %s", resp.Status, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
+
+// Sign returns the Meadowlark-Signature header for body sent at t: the HMAC-SHA256 of
+// "t.body" with the secret, the same scheme as room archive webhooks
+func Sign(secret string, t time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,144 @@
+// Package chaos injects failures for testing how clients and the server recover: delayed,
+// lost and cut off websocket frames and failing database calls
+package chaos
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+)
+
+// ErrInjected is returned by the database calls chosen to fail
+var ErrInjected = errors.New("chaos: injected database error")
+
+// Faults is the failure injection of a test run. Nothing is injected until Arm, so the
+// server can set up its schema first. The methods of a nil Faults inject nothing
+type Faults struct {
+	Latency        time.Duration // frames written are delayed by up to this much
+	DropRate       float64       // fraction of frames lost, in either direction
+	DisconnectRate float64       // fraction of frames written that cut the connection instead
+	DBErrorRate    float64       // fraction of statements, queries and transactions that fail
+
+	armed atomic.Bool
+}
+
+// Arm starts injecting failures
+func (f *Faults) Arm() {
+	f.armed.Store(true)
+}
+
+// roll decides whether a failure happens, f must not be nil
+func (f *Faults) roll(rate float64) bool {
+	return rate > 0 && f.armed.Load() && rand.Float64() < rate
+}
+
+// Delay sleeps up to Latency before a frame is written
+func (f *Faults) Delay() {
+	if f != nil && f.Latency > 0 && f.armed.Load() {
+		time.Sleep(rand.N(f.Latency))
+	}
+}
+
+// Drop reports whether a frame is lost
+func (f *Faults) Drop() bool {
+	return f != nil && f.roll(f.DropRate)
+}
+
+// Disconnect reports whether the connection is cut instead of writing a frame
+func (f *Faults) Disconnect() bool {
+	return f != nil && f.roll(f.DisconnectRate)
+}
+
+// Driver wraps base so that DBErrorRate of its calls fail with ErrInjected, register it
+// with sql.Register
+func (f *Faults) Driver(base driver.Driver) driver.Driver {
+	return &faultyDriver{base: base, faults: f}
+}
+
+// BaseDriver returns the driver registered as name, for Driver
+func BaseDriver(name string) (driver.Driver, error) {
+	// Open only checks that the driver exists, it doesn't connect
+	db, err := sql.Open(name, "")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return db.Driver(), nil
+}
+
+type faultyDriver struct {
+	base   driver.Driver
+	faults *Faults
+}
+
+func (d *faultyDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.base.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyConn{Conn: conn, faults: d.faults}, nil
+}
+
+// faultyConn fails calls before they reach the connection it wraps. Calls in a transaction
+// go through it too, so a transaction can fail halfway
+type faultyConn struct {
+	driver.Conn
+	faults *Faults
+}
+
+func (c *faultyConn) fail() bool {
+	return c.faults.roll(c.faults.DBErrorRate)
+}
+
+func (c *faultyConn) Prepare(query string) (driver.Stmt, error) {
+	if c.fail() {
+		return nil, ErrInjected
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c *faultyConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if c.fail() {
+		return nil, ErrInjected
+	}
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return p.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c *faultyConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	if c.fail() {
+		return nil, ErrInjected
+	}
+	return e.ExecContext(ctx, query, args)
+}
+
+func (c *faultyConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	if c.fail() {
+		return nil, ErrInjected
+	}
+	return q.QueryContext(ctx, query, args)
+}
+
+func (c *faultyConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if c.fail() {
+		return nil, ErrInjected
+	}
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
@@ -2,11 +2,42 @@ package client
 
 import (
 	"log"
+	"os"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/mdns"
 )
 
+// how long to listen for servers announcing themselves on the LAN
+const discoveryTimeout = 2 * time.Second
+
 func Start() {
 	log.Println("Client starting...")
+
+	server := os.Getenv("MEADOWLARK_SERVER")
+	if server == "" {
+		server = discover()
+	}
+	if server == "" {
+		log.Println("No server found, set MEADOWLARK_SERVER to its address")
+		return
+	}
+	log.Printf("Using server %s", server)
 	// TODO: Implement client functionality
 }
 
-
+// discover looks for servers on the LAN and picks the first one found
+func discover() string {
+	services, err := mdns.Browse(discoveryTimeout)
+	if err != nil {
+		log.Printf("LAN discovery failed: %v", err)
+		return ""
+	}
+	for _, service := range services {
+		log.Printf("Found %q at %s", service.Instance, service.URL())
+	}
+	if len(services) == 0 {
+		return ""
+	}
+	return services[0].URL()
+}
@@ -0,0 +1,830 @@
+package config
+
+import (
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds runtime settings for the meadowlark server
+// values are read from MEADOWLARK_* environment variables with sensible defaults
+type Config struct {
+	Addr     string   // address the HTTP server listens on, "host:port" or "unix:/path", ignored under systemd socket activation
+	BasePath string   // URL prefix everything is served under behind a reverse proxy, e.g. "/chat", empty for the root
+	DBPath   string   // path to the SQLite database file
+	Admins   []string // usernames allowed to call /api/admin endpoints
+
+	SocketMode os.FileMode // permissions of a unix socket given in Addr
+
+	// desktop mode: a localhost-only server that opens the browser and exits when the last tab closes
+	Desktop            bool
+	DesktopOpenBrowser bool
+	DesktopIdleTimeout time.Duration // how long to wait for a client to reconnect before exiting
+
+	// developer mode: an in-memory database seeded with users and rooms, any origin and verbose logging
+	Dev     bool
+	Verbose bool // log every HTTP request and websocket frame type
+
+	// mDNS advertisement as _meadowlark._tcp so clients on the LAN can find the server
+	MDNS     bool
+	MDNSName string // instance name shown to clients, defaults to the host name
+
+	// long-term Ed25519 key signing capabilities and public key responses, created on first start
+	IdentityKeyFile string
+
+	// tor onion service, reached through a second listener that only tor should connect to
+	TorListenAddr      string // loopback address for tor to forward onion connections to, random when unset and TorControl is set
+	TorControl         string // control port, "host:port" or "unix:/path", to publish the service with ADD_ONION
+	TorControlPassword string // for HashedControlPassword, the cookie file is used otherwise
+	TorKeyFile         string // onion service private key, created on first publish so the address stays stable
+
+	// SOCKS5 proxy URL for outbound requests (link previews, SMS, object storage), e.g. "socks5h://127.0.0.1:9050"
+	OutboundProxy string
+
+	// websocket origin validation
+	AllowedOrigins []string // browser origins allowed besides the server's own, "https://*.example.com" matches subdomains
+	DevMode        bool     // accept any origin, for local development only
+
+	// reverse proxies whose X-Forwarded-For and X-Real-IP headers are believed, as CIDRs or addresses
+	TrustedProxies []string
+
+	// password hashing
+	PasswordHash  string // "argon2id" or "bcrypt"
+	BcryptCost    int
+	Argon2Memory  int // KiB
+	Argon2Time    int
+	Argon2Threads int
+
+	// server side secrets, each a comma separated list of id:base64key pairs
+	Peppers         string // HMAC keys applied to passwords before hashing
+	PepperID        string // pepper used for new hashes, defaults to the only entry
+	EncryptionKeys  string // AES keys for sensitive columns at rest
+	EncryptionKeyID string // key used for new data, defaults to the first entry
+	JWTKeys         string // HMAC keys signing session tokens, a built-in development key when unset
+	JWTKeyID        string // key used for new tokens, defaults to the first entry
+
+	// where the JWT keys, encryption keys and SMTP credentials come from: "env" reads the
+	// variables above, "file" one file per secret, "vault" and "aws-secrets-manager" fetch
+	// them, "aws-kms" decrypts env values that are KMS ciphertexts
+	SecretsProvider string
+	SecretsDir      string        // for "file"
+	SecretsRefresh  time.Duration // how often secrets are fetched again to pick up rotations, 0 disables
+	VaultAddr       string
+	VaultToken      string
+	VaultMount      string // KV version 2 mount
+	VaultPath       string // secret whose fields hold the values
+	AWSRegion       string
+	AWSAccessKey    string
+	AWSSecretKey    string
+	AWSSessionToken string
+	AWSEndpoint     string // overrides the regional endpoint, e.g. for LocalStack
+	AWSSecretPrefix string // Secrets Manager names are the prefix followed by the secret name
+
+	// websocket permessage-deflate
+	WSCompression             bool
+	WSCompressionLevel        int // flate level, -2 to 9
+	WSCompressionThreshold    int // minimum frame size in bytes to compress
+	WSCompressionEncryptedMin int // minimum frame size to compress when it carries ciphertext
+
+	// websocket heartbeats, 0 disables them. A connection silent for three intervals is closed
+	WSPingInterval time.Duration
+	// how long a new connection has to send its hello, and how many missed messages the
+	// server replays after it; more than that and the client syncs over HTTP instead
+	WSHelloTimeout  time.Duration
+	WSBackfillLimit int
+
+	// bearer token Prometheus scrapes /metrics with, empty disables the endpoint
+	MetricsToken string
+	// address of the admin only profiling and diagnostics listener, empty disables it
+	DebugAddr string
+	// failure injection for testing how clients recover, developer mode only
+	ChaosLatency        time.Duration // websocket frames are delayed by up to this much
+	ChaosDropRate       float64       // fraction of websocket frames lost, either direction
+	ChaosDisconnectRate float64       // fraction of frames written that cut the connection instead
+	ChaosDBErrorRate    float64       // fraction of database calls that fail
+	// gradual rollouts: "name=on,other=25%" over the built in rollouts, admins change them at runtime
+	FeatureFlags        string
+	FeatureFlagsRefresh time.Duration // how often flags changed through another instance are picked up
+
+	// static file serving
+	StaticCacheControl string // ";" separated ext=policy pairs, "*" matches everything else
+	StaticGzip         bool   // gzip text assets on the fly when there is no pre-compressed file
+
+	// HTTP request limits, 0 disables a timeout. Websockets and attachment, export and
+	// backup transfers are exempt from the read and write timeouts
+	MaxBodyBytes      int64         // largest JSON request body
+	ReadHeaderTimeout time.Duration // to receive the request headers
+	ReadTimeout       time.Duration // to receive the whole request
+	WriteTimeout      time.Duration // from the end of the headers to the end of the response
+	IdleTimeout       time.Duration // how long a keep-alive connection waits for the next request
+
+	// simultaneous websocket connections, 0 disables the limit
+	MaxConnectionsPerAccount int
+	MaxConnectionsPerIP      int
+
+	// what happens when an account connects while already connected: "takeover" or "reject"
+	SessionPolicy string
+
+	// how long before its token expires a websocket connection is asked to send a new one
+	TokenRefreshWarning time.Duration
+
+	// passkeys (WebAuthn): the domain they are scoped to, the request's host when empty, the name
+	// authenticators show, and origins allowed besides https pages on that domain (native apps)
+	WebAuthnRPID    string
+	WebAuthnRPName  string
+	WebAuthnOrigins []string
+
+	// DPoP: whether every token must be bound to a client key, and how old a proof may be
+	DPoPRequired    bool
+	DPoPProofWindow time.Duration
+
+	// how long the hub holds a message waiting for an earlier sequence number, 0 disables reordering
+	ReorderWindow time.Duration
+
+	// hub state (undelivered queued messages, last seen times) saved on shutdown and restored on start, empty disables
+	HubSnapshotFile   string
+	HubSnapshotMaxAge time.Duration // queued messages in an older snapshot are dropped, last seen times are always kept
+
+	// how long accepted client message ids are remembered in memory, older ones hit the database index
+	DedupeTTL time.Duration
+	// messages to non-contacts that can't be delivered get a generic cannot_deliver, so the
+	// messaging path doesn't tell which usernames are registered
+	RecipientPrivacy bool
+	// connections that send nothing for this long are shown away to contacts, 0 never
+	AwayTimeout time.Duration
+
+	// live location sharing, relayed in memory and never stored
+	LocationMaxDuration   time.Duration // longest a share can run
+	LocationMinInterval   time.Duration // least time between two updates of one share
+	LocationSharesPerHour int           // shares a user can start per hour, 0 for no limit
+
+	// spam scoring on message metadata
+	SpamEnabled       bool
+	SpamRatePerMinute int
+	SpamFanoutPerHour int
+	SpamNewAccountAge time.Duration
+	SpamFlagScore     float64
+	SpamThrottleScore float64
+	SpamShadowScore   float64
+
+	// message history retention
+	Retention         time.Duration // default global max age, 0 keeps messages forever
+	RetentionInterval time.Duration // how often the janitor prunes
+	JobJitter         float64       // fraction of their interval background job runs are moved by
+	// enterprise: admins can put accounts under legal hold and export their envelopes
+	LegalHold bool
+
+	// deleted accounts are replaced by a tombstone in history and rooms, and their data is
+	// purged for good after this long
+	AccountPurgeGrace time.Duration
+	// when a deleted account's username can be registered again: permanent, cooldown or immediate
+	UsernameRecycling       string
+	UsernameRecycleCooldown time.Duration
+
+	// connection event log
+	ConnectionLogRetention time.Duration // how long connect/disconnect events are kept, 0 keeps them forever
+
+	// device bootstrap sync
+	SyncPageSize      int           // default items per /api/sync page
+	SyncMessageWindow time.Duration // how far back message envelopes are synced
+
+	// attachments
+	AttachmentStorage            string // "file" or "s3"
+	AttachmentDir                string
+	AttachmentS3Prefix           string
+	AttachmentMaxSize            int64
+	AttachmentThumbnailMaxSize   int64         // thumbnails are fetched before the attachment, so kept small
+	AudioMaxDuration             time.Duration // longest audio attachment clients may declare
+	AttachmentMultipartThreshold int64
+	AttachmentURLExpiry          time.Duration // lifetime of presigned URLs
+	AttachmentUploadDir          string        // where resumable uploads are staged until complete
+	AttachmentUploadExpiry       time.Duration // unfinished resumable uploads untouched this long are dropped
+
+	// data residency: accounts tagged with a region keep their attachments in that region's backend
+	Regions       []Region
+	DefaultRegion string // region new accounts are tagged with, empty leaves them on the main backend
+
+	// workspaces: isolated tenants served by the same process, each with its own database, files
+	// and admins, picked by host name or URL prefix
+	Tenant  string // workspace this config is for, empty for the main one
+	Tenants []Tenant
+
+	// accounts
+	UsernameAliasGrace time.Duration // how long a previous username keeps resolving after a rename
+	DiscoveryMaxHashes int           // identifiers accepted per contact discovery request
+
+	// checks on plaintext metadata: usernames and room names, topics and descriptions
+	UsernameMaxLength        int
+	RoomNameMaxLength        int
+	RoomTopicMaxLength       int
+	RoomDescriptionMaxLength int
+	MetadataLinks            string   // "allow", "strip" or "reject" links in room settings, usernames never allow them
+	BlockedWords             []string // words rejected in usernames and rejected or masked in room settings
+	BlockedWordsFile         string   // optional file with more blocked words, one per line
+	BlockedWordsAction       string   // "reject" or "mask"
+
+	// SMS delivery for phone verification
+	SMSProvider      string // "log" or "twilio"
+	TwilioAccountSID string
+	TwilioAuthToken  string
+	TwilioFrom       string
+
+	// email delivery for address verification and digests
+	MailProvider string // "log" or "smtp"
+	SMTPAddr     string // host:port of the relay
+	SMTPUsername string
+	SMTPPassword string
+	MailFrom     string
+
+	// missed message digests
+	DigestInterval time.Duration // how often users due a digest are looked for, 0 disables digests
+	DigestMinGap   time.Duration // least time between two digests to the same user
+
+	// email users with a verified address when they sign in from a new IP address and user agent
+	NewDeviceEmail bool
+
+	// inbound email gateway, off unless a token is set
+	InboundEmailToken   string   // the mail provider's webhook sends it as a bearer token or ?token=
+	InboundEmailRoutes  []string // "alerts@example.com=room:<id>" or "ops@example.com=user:alice"
+	InboundEmailSenders []string // addresses or "@domain" entries allowed to send, empty allows anyone
+	InboundEmailMaxSize int64    // largest webhook request, attachments included
+
+	// statistics
+	StatsFlushInterval time.Duration // how often in-memory counters are folded into the stats tables
+
+	// anonymous telemetry, off unless an endpoint is set
+	TelemetryEndpoint string
+	TelemetryInterval time.Duration
+
+	// link previews
+	PreviewEnabled  bool
+	PreviewTimeout  time.Duration // per fetch, including redirects
+	PreviewMaxBytes int64         // how much of a page is read looking for metadata
+	PreviewCacheTTL time.Duration
+
+	// custom emoji and stickers
+	EmojiMaxSize   int64
+	StickerMaxSize int64
+
+	// rooms
+	RoomAvatarMaxSize int64
+	PublicRooms       bool // public announcement rooms may broadcast unencrypted posts on a public page
+	// room owners may have every message, still encrypted, posted to a webhook
+	RoomArchives        bool
+	RoomArchiveInterval time.Duration // how often rooms with undelivered messages are looked for
+	RoomArchivePrivate  bool          // webhooks may be on private and loopback addresses
+	// room moderators may schedule recurring exports to a webhook or the S3 bucket
+	RoomExports        bool
+	RoomExportInterval time.Duration // how often schedules that are due are looked for
+	RoomExportS3Prefix string        // key prefix for exports written to S3
+	// first login greeting, until admins change it through the API
+	WelcomeMessage string   // text/template, e.g. "Welcome {{.Username}}!"
+	WelcomeRooms   []string // ids of rooms new users are added to
+	// hosted plans: the plan's limits are enforced and usage is posted to the billing webhook
+	Plans                []Plan
+	Plan                 string // plan of the main workspace, empty for no limits
+	BillingWebhook       string // empty records no usage events
+	BillingWebhookSecret string
+	BillingInterval      time.Duration // how often pending usage events are posted
+	BillingUsageInterval time.Duration // how often total users and storage are reported
+
+	// backups
+	BackupDir      string // local directory for snapshots
+	BackupS3Prefix string // key prefix for snapshots uploaded to S3
+
+	// S3 compatible object storage
+	S3Endpoint  string
+	S3Region    string
+	S3Bucket    string
+	S3AccessKey string
+	S3SecretKey string
+
+	// maintenance mode defaults
+	MaintenanceRetryAfter time.Duration // Retry-After sent with 503 responses
+	DrainTimeout          time.Duration // how long connected clients get before being closed
+
+	// startup self-check and doctor
+	TLSCertFile   string // PEM certificate served in front of the server, e.g. by the reverse proxy, checked for expiry
+	ClockCheckURL string // doctor compares the local clock with this server's Date header, empty skips the check
+}
+
+// Load builds a Config from the environment
+func Load() *Config {
+	// desktop mode listens on a random loopback port and keeps its data in the user's data directory
+	desktop := getEnvBool("MEADOWLARK_DESKTOP", false)
+	addr, dataDir := ":8080", "."
+	if desktop {
+		addr, dataDir = "127.0.0.1:0", filepath.Join(userDataDir(), "meadowlark")
+	}
+	// developer mode starts from scratch on every run, the memdb database is shared by all
+	// connections of the process and gone when it exits
+	dev := getEnvBool("MEADOWLARK_DEV", false)
+	// hashed as a uint8, and Argon2 needs at least 8 KiB of memory per thread
+	argon2Threads := getEnvIntRange("MEADOWLARK_ARGON2_THREADS", 4, 1, math.MaxUint8)
+	dbPath, admins, hubSnapshot := filepath.Join(dataDir, "chat.db"), []string(nil), filepath.Join(dataDir, "hub-snapshot.json")
+	if dev {
+		addr, dataDir = "127.0.0.1:8080", filepath.Join(os.TempDir(), "meadowlark-dev")
+		dbPath, admins, hubSnapshot = "file:/meadowlark-dev?vfs=memdb", []string{"alice"}, ""
+	}
+
+	return &Config{
+		Addr:     getEnv("MEADOWLARK_ADDR", addr),
+		BasePath: basePath(getEnv("MEADOWLARK_BASE_PATH", "")),
+		DBPath:   getEnv("MEADOWLARK_DB_PATH", dbPath),
+		Admins:   getEnvList("MEADOWLARK_ADMINS", admins),
+
+		SocketMode: getEnvFileMode("MEADOWLARK_SOCKET_MODE", 0660),
+
+		Desktop:            desktop,
+		DesktopOpenBrowser: getEnvBool("MEADOWLARK_DESKTOP_OPEN_BROWSER", true),
+		DesktopIdleTimeout: getEnvDuration("MEADOWLARK_DESKTOP_IDLE_TIMEOUT", 15*time.Second),
+
+		Dev:     dev,
+		Verbose: getEnvBool("MEADOWLARK_VERBOSE", dev),
+
+		MDNS:     getEnvBool("MEADOWLARK_MDNS", false),
+		MDNSName: getEnv("MEADOWLARK_MDNS_NAME", ""),
+
+		IdentityKeyFile: getEnv("MEADOWLARK_IDENTITY_KEY_FILE", filepath.Join(dataDir, "identity.key")),
+
+		TorListenAddr:      getEnv("MEADOWLARK_TOR_LISTEN_ADDR", ""),
+		TorControl:         getEnv("MEADOWLARK_TOR_CONTROL", ""),
+		TorControlPassword: getEnv("MEADOWLARK_TOR_CONTROL_PASSWORD", ""),
+		TorKeyFile:         getEnv("MEADOWLARK_TOR_KEY_FILE", filepath.Join(dataDir, "onion.key")),
+
+		OutboundProxy: getEnv("MEADOWLARK_OUTBOUND_PROXY", ""),
+
+		AllowedOrigins: getEnvList("MEADOWLARK_ALLOWED_ORIGINS", nil),
+		DevMode:        getEnvBool("MEADOWLARK_DEV_MODE", dev),
+
+		TrustedProxies: getEnvList("MEADOWLARK_TRUSTED_PROXIES", nil),
+
+		PasswordHash:  getEnv("MEADOWLARK_PASSWORD_HASH", "argon2id"),
+		BcryptCost:    getEnvInt("MEADOWLARK_BCRYPT_COST", 10),
+		Argon2Memory:  getEnvIntRange("MEADOWLARK_ARGON2_MEMORY", 64*1024, 8*argon2Threads, math.MaxInt32),
+		Argon2Time:    getEnvIntRange("MEADOWLARK_ARGON2_TIME", 1, 1, math.MaxInt32),
+		Argon2Threads: argon2Threads,
+
+		Peppers:         getEnv("MEADOWLARK_PEPPERS", ""),
+		PepperID:        getEnv("MEADOWLARK_PEPPER_ID", ""),
+		EncryptionKeys:  getEnv("MEADOWLARK_ENCRYPTION_KEYS", ""),
+		EncryptionKeyID: getEnv("MEADOWLARK_ENCRYPTION_KEY_ID", ""),
+		JWTKeys:         getEnv("MEADOWLARK_JWT_KEYS", ""),
+		JWTKeyID:        getEnv("MEADOWLARK_JWT_KEY_ID", ""),
+
+		SecretsProvider: getEnv("MEADOWLARK_SECRETS_PROVIDER", "env"),
+		SecretsDir:      getEnv("MEADOWLARK_SECRETS_DIR", "/run/secrets"),
+		SecretsRefresh:  getEnvDuration("MEADOWLARK_SECRETS_REFRESH", 5*time.Minute),
+		VaultAddr:       getEnv("VAULT_ADDR", ""),
+		VaultToken:      getEnv("VAULT_TOKEN", ""),
+		VaultMount:      getEnv("MEADOWLARK_VAULT_MOUNT", "secret"),
+		VaultPath:       getEnv("MEADOWLARK_VAULT_PATH", "meadowlark"),
+		AWSRegion:       getEnv("AWS_REGION", ""),
+		AWSAccessKey:    getEnv("AWS_ACCESS_KEY_ID", ""),
+		AWSSecretKey:    getEnv("AWS_SECRET_ACCESS_KEY", ""),
+		AWSSessionToken: getEnv("AWS_SESSION_TOKEN", ""),
+		AWSEndpoint:     getEnv("MEADOWLARK_AWS_ENDPOINT", ""),
+		AWSSecretPrefix: getEnv("MEADOWLARK_AWS_SECRET_PREFIX", "meadowlark/"),
+
+		WSCompression:             getEnvBool("MEADOWLARK_WS_COMPRESSION", true),
+		WSCompressionLevel:        getEnvInt("MEADOWLARK_WS_COMPRESSION_LEVEL", 1),
+		WSCompressionThreshold:    getEnvInt("MEADOWLARK_WS_COMPRESSION_THRESHOLD", 256),
+		WSCompressionEncryptedMin: getEnvInt("MEADOWLARK_WS_COMPRESSION_ENCRYPTED_MIN", 4096),
+
+		WSPingInterval:  getEnvDuration("MEADOWLARK_WS_PING_INTERVAL", 30*time.Second),
+		WSHelloTimeout:  getEnvDuration("MEADOWLARK_WS_HELLO_TIMEOUT", 10*time.Second),
+		WSBackfillLimit: getEnvInt("MEADOWLARK_WS_BACKFILL_LIMIT", 500),
+
+		MetricsToken: getEnv("MEADOWLARK_METRICS_TOKEN", ""),
+		DebugAddr:    getEnv("MEADOWLARK_DEBUG_ADDR", ""),
+
+		ChaosLatency:        getEnvDuration("MEADOWLARK_CHAOS_LATENCY", 0),
+		ChaosDropRate:       getEnvFloat("MEADOWLARK_CHAOS_DROP_RATE", 0),
+		ChaosDisconnectRate: getEnvFloat("MEADOWLARK_CHAOS_DISCONNECT_RATE", 0),
+		ChaosDBErrorRate:    getEnvFloat("MEADOWLARK_CHAOS_DB_ERROR_RATE", 0),
+		FeatureFlags:        getEnv("MEADOWLARK_FEATURE_FLAGS", ""),
+		FeatureFlagsRefresh: getEnvDuration("MEADOWLARK_FEATURE_FLAGS_REFRESH", 30*time.Second),
+
+		StaticCacheControl: getEnv("MEADOWLARK_STATIC_CACHE_CONTROL", ".html=no-cache;.js=no-cache;.css=no-cache;*=public, max-age=86400"),
+		StaticGzip:         getEnvBool("MEADOWLARK_STATIC_GZIP", true),
+
+		MaxBodyBytes:      int64(getEnvInt("MEADOWLARK_MAX_BODY_BYTES", 64<<10)),
+		ReadHeaderTimeout: getEnvDuration("MEADOWLARK_READ_HEADER_TIMEOUT", 10*time.Second),
+		ReadTimeout:       getEnvDuration("MEADOWLARK_READ_TIMEOUT", 30*time.Second),
+		WriteTimeout:      getEnvDuration("MEADOWLARK_WRITE_TIMEOUT", 60*time.Second),
+		IdleTimeout:       getEnvDuration("MEADOWLARK_IDLE_TIMEOUT", 2*time.Minute),
+
+		MaxConnectionsPerAccount: getEnvInt("MEADOWLARK_MAX_CONNECTIONS_PER_ACCOUNT", 5),
+		MaxConnectionsPerIP:      getEnvInt("MEADOWLARK_MAX_CONNECTIONS_PER_IP", 20),
+
+		SessionPolicy: getEnv("MEADOWLARK_SESSION_POLICY", "takeover"),
+
+		TokenRefreshWarning: getEnvDuration("MEADOWLARK_TOKEN_REFRESH_WARNING", 5*time.Minute),
+
+		WebAuthnRPID:    getEnv("MEADOWLARK_WEBAUTHN_RP_ID", ""),
+		WebAuthnRPName:  getEnv("MEADOWLARK_WEBAUTHN_RP_NAME", "Meadowlark"),
+		WebAuthnOrigins: getEnvList("MEADOWLARK_WEBAUTHN_ORIGINS", nil),
+
+		DPoPRequired:    getEnvBool("MEADOWLARK_DPOP_REQUIRED", false),
+		DPoPProofWindow: getEnvDuration("MEADOWLARK_DPOP_PROOF_WINDOW", 2*time.Minute),
+
+		ReorderWindow:    getEnvDuration("MEADOWLARK_REORDER_WINDOW", 2*time.Second),
+		DedupeTTL:        getEnvDuration("MEADOWLARK_DEDUPE_TTL", 10*time.Minute),
+		RecipientPrivacy: getEnvBool("MEADOWLARK_RECIPIENT_PRIVACY", false),
+		AwayTimeout:      getEnvDuration("MEADOWLARK_AWAY_TIMEOUT", 5*time.Minute),
+
+		LocationMaxDuration:   getEnvDuration("MEADOWLARK_LOCATION_MAX_DURATION", 8*time.Hour),
+		LocationMinInterval:   getEnvDuration("MEADOWLARK_LOCATION_MIN_INTERVAL", 2*time.Second),
+		LocationSharesPerHour: getEnvInt("MEADOWLARK_LOCATION_SHARES_PER_HOUR", 20),
+
+		HubSnapshotFile:   getEnv("MEADOWLARK_HUB_SNAPSHOT_FILE", hubSnapshot),
+		HubSnapshotMaxAge: getEnvDuration("MEADOWLARK_HUB_SNAPSHOT_MAX_AGE", time.Hour),
+
+		SpamEnabled:       getEnvBool("MEADOWLARK_SPAM_ENABLED", true),
+		SpamRatePerMinute: getEnvInt("MEADOWLARK_SPAM_RATE_PER_MINUTE", 30),
+		SpamFanoutPerHour: getEnvInt("MEADOWLARK_SPAM_FANOUT_PER_HOUR", 20),
+		SpamNewAccountAge: getEnvDuration("MEADOWLARK_SPAM_NEW_ACCOUNT_AGE", 24*time.Hour),
+		SpamFlagScore:     getEnvFloat("MEADOWLARK_SPAM_FLAG_SCORE", 1),
+		SpamThrottleScore: getEnvFloat("MEADOWLARK_SPAM_THROTTLE_SCORE", 2),
+		SpamShadowScore:   getEnvFloat("MEADOWLARK_SPAM_SHADOW_SCORE", 4),
+
+		Retention:         getEnvDuration("MEADOWLARK_RETENTION", 0),
+		RetentionInterval: getEnvDuration("MEADOWLARK_RETENTION_INTERVAL", time.Hour),
+		JobJitter:         getEnvFloat("MEADOWLARK_JOB_JITTER", 0.1),
+		LegalHold:         getEnvBool("MEADOWLARK_LEGAL_HOLD", false),
+
+		AccountPurgeGrace:       getEnvDuration("MEADOWLARK_ACCOUNT_PURGE_GRACE", 30*24*time.Hour),
+		UsernameRecycling:       getEnv("MEADOWLARK_USERNAME_RECYCLING", "cooldown"),
+		UsernameRecycleCooldown: getEnvDuration("MEADOWLARK_USERNAME_RECYCLE_COOLDOWN", 30*24*time.Hour),
+
+		ConnectionLogRetention: getEnvDuration("MEADOWLARK_CONNECTION_LOG_RETENTION", 90*24*time.Hour),
+
+		SyncPageSize:      getEnvInt("MEADOWLARK_SYNC_PAGE_SIZE", 200),
+		SyncMessageWindow: getEnvDuration("MEADOWLARK_SYNC_MESSAGE_WINDOW", 7*24*time.Hour),
+
+		AttachmentStorage:            getEnv("MEADOWLARK_ATTACHMENT_STORAGE", "file"),
+		AttachmentDir:                getEnv("MEADOWLARK_ATTACHMENT_DIR", filepath.Join(dataDir, "attachments")),
+		AttachmentS3Prefix:           getEnv("MEADOWLARK_ATTACHMENT_S3_PREFIX", "attachments/"),
+		AttachmentMaxSize:            int64(getEnvInt("MEADOWLARK_ATTACHMENT_MAX_SIZE", 100<<20)),
+		AttachmentThumbnailMaxSize:   int64(getEnvInt("MEADOWLARK_ATTACHMENT_THUMBNAIL_MAX_SIZE", 64<<10)),
+		AudioMaxDuration:             getEnvDuration("MEADOWLARK_AUDIO_MAX_DURATION", 15*time.Minute),
+		AttachmentMultipartThreshold: int64(getEnvInt("MEADOWLARK_ATTACHMENT_MULTIPART_THRESHOLD", 16<<20)),
+		AttachmentURLExpiry:          getEnvDuration("MEADOWLARK_ATTACHMENT_URL_EXPIRY", 15*time.Minute),
+		AttachmentUploadDir:          getEnv("MEADOWLARK_ATTACHMENT_UPLOAD_DIR", filepath.Join(dataDir, "uploads")),
+		AttachmentUploadExpiry:       getEnvDuration("MEADOWLARK_ATTACHMENT_UPLOAD_EXPIRY", 24*time.Hour),
+
+		Regions:       loadRegions(getEnvList("MEADOWLARK_REGIONS", nil), dataDir),
+		DefaultRegion: getEnv("MEADOWLARK_DEFAULT_REGION", ""),
+
+		Tenants: loadTenants(getEnvList("MEADOWLARK_TENANTS", nil), dataDir),
+
+		UsernameAliasGrace: getEnvDuration("MEADOWLARK_USERNAME_ALIAS_GRACE", 30*24*time.Hour),
+		DiscoveryMaxHashes: getEnvInt("MEADOWLARK_DISCOVERY_MAX_HASHES", 1000),
+
+		UsernameMaxLength:        getEnvInt("MEADOWLARK_USERNAME_MAX_LENGTH", 32),
+		RoomNameMaxLength:        getEnvInt("MEADOWLARK_ROOM_NAME_MAX_LENGTH", 64),
+		RoomTopicMaxLength:       getEnvInt("MEADOWLARK_ROOM_TOPIC_MAX_LENGTH", 512),
+		RoomDescriptionMaxLength: getEnvInt("MEADOWLARK_ROOM_DESCRIPTION_MAX_LENGTH", 4096),
+		MetadataLinks:            getEnv("MEADOWLARK_METADATA_LINKS", "allow"),
+		BlockedWords:             getEnvList("MEADOWLARK_BLOCKED_WORDS", nil),
+		BlockedWordsFile:         getEnv("MEADOWLARK_BLOCKED_WORDS_FILE", ""),
+		BlockedWordsAction:       getEnv("MEADOWLARK_BLOCKED_WORDS_ACTION", "reject"),
+
+		SMSProvider:      getEnv("MEADOWLARK_SMS_PROVIDER", "log"),
+		TwilioAccountSID: getEnv("MEADOWLARK_TWILIO_ACCOUNT_SID", ""),
+		TwilioAuthToken:  getEnv("MEADOWLARK_TWILIO_AUTH_TOKEN", ""),
+		TwilioFrom:       getEnv("MEADOWLARK_TWILIO_FROM", ""),
+
+		MailProvider: getEnv("MEADOWLARK_MAIL_PROVIDER", "log"),
+		SMTPAddr:     getEnv("MEADOWLARK_SMTP_ADDR", ""),
+		SMTPUsername: getEnv("MEADOWLARK_SMTP_USERNAME", ""),
+		SMTPPassword: getEnv("MEADOWLARK_SMTP_PASSWORD", ""),
+		MailFrom:     getEnv("MEADOWLARK_MAIL_FROM", ""),
+
+		DigestInterval: getEnvDuration("MEADOWLARK_DIGEST_INTERVAL", 0),
+		DigestMinGap:   getEnvDuration("MEADOWLARK_DIGEST_MIN_GAP", 12*time.Hour),
+
+		NewDeviceEmail: getEnvBool("MEADOWLARK_NEW_DEVICE_EMAIL", true),
+
+		InboundEmailToken:   getEnv("MEADOWLARK_INBOUND_EMAIL_TOKEN", ""),
+		InboundEmailRoutes:  getEnvList("MEADOWLARK_INBOUND_EMAIL_ROUTES", nil),
+		InboundEmailSenders: getEnvList("MEADOWLARK_INBOUND_EMAIL_SENDERS", nil),
+		InboundEmailMaxSize: int64(getEnvInt("MEADOWLARK_INBOUND_EMAIL_MAX_SIZE", 10<<20)),
+
+		StatsFlushInterval: getEnvDuration("MEADOWLARK_STATS_FLUSH_INTERVAL", time.Minute),
+
+		TelemetryEndpoint: getEnv("MEADOWLARK_TELEMETRY_ENDPOINT", ""),
+		TelemetryInterval: getEnvDuration("MEADOWLARK_TELEMETRY_INTERVAL", 24*time.Hour),
+
+		PreviewEnabled:  getEnvBool("MEADOWLARK_PREVIEW_ENABLED", true),
+		PreviewTimeout:  getEnvDuration("MEADOWLARK_PREVIEW_TIMEOUT", 5*time.Second),
+		PreviewMaxBytes: int64(getEnvInt("MEADOWLARK_PREVIEW_MAX_BYTES", 512<<10)),
+		PreviewCacheTTL: getEnvDuration("MEADOWLARK_PREVIEW_CACHE_TTL", time.Hour),
+
+		EmojiMaxSize:   int64(getEnvInt("MEADOWLARK_EMOJI_MAX_SIZE", 256<<10)),
+		StickerMaxSize: int64(getEnvInt("MEADOWLARK_STICKER_MAX_SIZE", 1<<20)),
+
+		RoomAvatarMaxSize: int64(getEnvInt("MEADOWLARK_ROOM_AVATAR_MAX_SIZE", 512<<10)),
+		PublicRooms:       getEnvBool("MEADOWLARK_PUBLIC_ROOMS", false),
+
+		RoomArchives:        getEnvBool("MEADOWLARK_ROOM_ARCHIVES", false),
+		RoomArchiveInterval: getEnvDuration("MEADOWLARK_ROOM_ARCHIVE_INTERVAL", 10*time.Second),
+		RoomArchivePrivate:  getEnvBool("MEADOWLARK_ROOM_ARCHIVE_PRIVATE", false),
+
+		RoomExports:        getEnvBool("MEADOWLARK_ROOM_EXPORTS", false),
+		RoomExportInterval: getEnvDuration("MEADOWLARK_ROOM_EXPORT_INTERVAL", time.Minute),
+		RoomExportS3Prefix: getEnv("MEADOWLARK_ROOM_EXPORT_S3_PREFIX", "room-exports/"),
+
+		WelcomeMessage: getEnv("MEADOWLARK_WELCOME_MESSAGE", ""),
+		WelcomeRooms:   getEnvList("MEADOWLARK_WELCOME_ROOMS", nil),
+
+		Plans:                loadPlans(getEnvList("MEADOWLARK_PLANS", nil)),
+		Plan:                 getEnv("MEADOWLARK_PLAN", ""),
+		BillingWebhook:       getEnv("MEADOWLARK_BILLING_WEBHOOK", ""),
+		BillingWebhookSecret: getEnv("MEADOWLARK_BILLING_WEBHOOK_SECRET", ""),
+		BillingInterval:      getEnvDuration("MEADOWLARK_BILLING_INTERVAL", time.Minute),
+		BillingUsageInterval: getEnvDuration("MEADOWLARK_BILLING_USAGE_INTERVAL", 24*time.Hour),
+
+		BackupDir:      getEnv("MEADOWLARK_BACKUP_DIR", filepath.Join(dataDir, "backups")),
+		BackupS3Prefix: getEnv("MEADOWLARK_BACKUP_S3_PREFIX", "backups/"),
+
+		S3Endpoint:  getEnv("MEADOWLARK_S3_ENDPOINT", ""),
+		S3Region:    getEnv("MEADOWLARK_S3_REGION", "us-east-1"),
+		S3Bucket:    getEnv("MEADOWLARK_S3_BUCKET", ""),
+		S3AccessKey: getEnv("MEADOWLARK_S3_ACCESS_KEY", ""),
+		S3SecretKey: getEnv("MEADOWLARK_S3_SECRET_KEY", ""),
+
+		MaintenanceRetryAfter: getEnvDuration("MEADOWLARK_MAINTENANCE_RETRY_AFTER", 5*time.Minute),
+		DrainTimeout:          getEnvDuration("MEADOWLARK_DRAIN_TIMEOUT", 30*time.Second),
+
+		TLSCertFile:   getEnv("MEADOWLARK_TLS_CERT_FILE", ""),
+		ClockCheckURL: getEnv("MEADOWLARK_CLOCK_CHECK_URL", ""),
+	}
+}
+
+// IsAdmin reports whether username is listed as an administrator
+func (c *Config) IsAdmin(username string) bool {
+	for _, admin := range c.Admins {
+		if admin == username {
+			return true
+		}
+	}
+	return false
+}
+
+// basePath normalizes a URL prefix to a leading slash and no trailing one, "/" becomes empty
+func basePath(value string) string {
+	value = strings.Trim(strings.TrimSpace(value), "/")
+	if value == "" {
+		return ""
+	}
+	return "/" + value
+}
+
+// Region is a data residency region with its own attachment backend, configured with
+// MEADOWLARK_REGION_{NAME}_* variables. S3 credentials default to the main MEADOWLARK_S3_* ones
+type Region struct {
+	Name              string
+	AttachmentStorage string // "file" or "s3"
+	AttachmentDir     string
+	S3Endpoint        string
+	S3Region          string
+	S3Bucket          string
+	S3Prefix          string
+	S3AccessKey       string
+	S3SecretKey       string
+	AllowExport       bool // whether users in the region may download conversation exports
+}
+
+// loadRegions reads the settings of each named region
+func loadRegions(names []string, dataDir string) []Region {
+	regions := make([]Region, 0, len(names))
+	for _, name := range names {
+		prefix := "MEADOWLARK_REGION_" + strings.ToUpper(name) + "_"
+		regions = append(regions, Region{
+			Name:              name,
+			AttachmentStorage: getEnv(prefix+"ATTACHMENT_STORAGE", "file"),
+			AttachmentDir:     getEnv(prefix+"ATTACHMENT_DIR", filepath.Join(dataDir, "attachments-"+name)),
+			S3Endpoint:        getEnv(prefix+"S3_ENDPOINT", ""),
+			S3Region:          getEnv(prefix+"S3_REGION", "us-east-1"),
+			S3Bucket:          getEnv(prefix+"S3_BUCKET", ""),
+			S3Prefix:          getEnv(prefix+"S3_PREFIX", "attachments/"),
+			S3AccessKey:       getEnv(prefix+"S3_ACCESS_KEY", os.Getenv("MEADOWLARK_S3_ACCESS_KEY")),
+			S3SecretKey:       getEnv(prefix+"S3_SECRET_KEY", os.Getenv("MEADOWLARK_S3_SECRET_KEY")),
+			AllowExport:       getEnvBool(prefix+"ALLOW_EXPORT", true),
+		})
+	}
+	return regions
+}
+
+// Plan is a hosted plan's limits, configured with MEADOWLARK_PLAN_{NAME}_* variables. Zero
+// is no limit
+type Plan struct {
+	Name       string
+	MaxUsers   int64
+	MaxStorage int64         // bytes of attachments
+	Retention  time.Duration // longest message history kept, whatever the retention policies
+}
+
+// loadPlans reads the limits of each named plan
+func loadPlans(names []string) []Plan {
+	plans := make([]Plan, 0, len(names))
+	for _, name := range names {
+		prefix := "MEADOWLARK_PLAN_" + strings.ToUpper(name) + "_"
+		plans = append(plans, Plan{
+			Name:       name,
+			MaxUsers:   int64(getEnvInt(prefix+"MAX_USERS", 0)),
+			MaxStorage: int64(getEnvInt(prefix+"MAX_STORAGE", 0)),
+			Retention:  getEnvDuration(prefix+"RETENTION", 0),
+		})
+	}
+	return plans
+}
+
+// Tenant is a workspace with its own users, rooms and admins, configured with
+// MEADOWLARK_TENANT_{NAME}_* variables. Requests for one of Hosts, or under Prefix, are its
+type Tenant struct {
+	Name    string
+	Hosts   []string // host names, without port
+	Prefix  string   // URL prefix under the main base path, e.g. "/acme"
+	DataDir string   // holds the workspace's database, attachments, uploads and backups
+	Admins  []string
+	Plan    string // empty for the main workspace's plan
+}
+
+// loadTenants reads the settings of each named workspace
+func loadTenants(names []string, dataDir string) []Tenant {
+	tenants := make([]Tenant, 0, len(names))
+	for _, name := range names {
+		prefix := "MEADOWLARK_TENANT_" + strings.ToUpper(name) + "_"
+		tenants = append(tenants, Tenant{
+			Name:    name,
+			Hosts:   getEnvList(prefix+"HOSTS", nil),
+			Prefix:  basePath(getEnv(prefix+"PREFIX", "")),
+			DataDir: getEnv(prefix+"DATA_DIR", filepath.Join(dataDir, "tenants", name)),
+			Admins:  getEnvList(prefix+"ADMINS", nil),
+			Plan:    getEnv(prefix+"PLAN", ""),
+		})
+	}
+	return tenants
+}
+
+// ForTenant returns the configuration of workspace t: the main one with the workspace's own
+// data and admins. Attachment keys in shared buckets get the workspace name as a prefix, so no
+// workspace can reach or collect another's blobs. Process wide features stay with the main one
+func (c *Config) ForTenant(t Tenant) *Config {
+	tc := *c
+	tc.Tenant, tc.Tenants = t.Name, nil
+	tc.BasePath = c.BasePath + t.Prefix
+	tc.Admins = t.Admins
+	if t.Plan != "" {
+		tc.Plan = t.Plan
+	}
+	tc.DBPath = filepath.Join(t.DataDir, "chat.db")
+	if c.Dev {
+		tc.DBPath = "file:/meadowlark-dev-" + t.Name + "?vfs=memdb"
+	}
+	tc.IdentityKeyFile = filepath.Join(t.DataDir, "identity.key")
+	if c.HubSnapshotFile != "" {
+		tc.HubSnapshotFile = filepath.Join(t.DataDir, "hub-snapshot.json")
+	}
+	tc.AttachmentDir = filepath.Join(t.DataDir, "attachments")
+	tc.AttachmentS3Prefix = c.AttachmentS3Prefix + t.Name + "/"
+	tc.AttachmentUploadDir = filepath.Join(t.DataDir, "uploads")
+	tc.Regions = make([]Region, len(c.Regions))
+	for i, r := range c.Regions {
+		r.AttachmentDir = filepath.Join(t.DataDir, "attachments-"+r.Name)
+		r.S3Prefix += t.Name + "/"
+		tc.Regions[i] = r
+	}
+	tc.BackupDir = filepath.Join(t.DataDir, "backups")
+	tc.BackupS3Prefix = c.BackupS3Prefix + t.Name + "/"
+	tc.RoomExportS3Prefix = c.RoomExportS3Prefix + t.Name + "/"
+	tc.InboundEmailRoutes, tc.WelcomeRooms = nil, nil
+	tc.Desktop, tc.MDNS, tc.DebugAddr = false, false, ""
+	tc.TorListenAddr, tc.TorControl = "", ""
+	return &tc
+}
+
+// userDataDir is the per-user application data directory of the OS
+func userDataDir() string {
+	switch runtime.GOOS {
+	case "windows":
+		if dir := os.Getenv("LocalAppData"); dir != "" {
+			return dir
+		}
+	case "darwin":
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, "Library", "Application Support")
+		}
+	default:
+		if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+			return dir
+		}
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, ".local", "share")
+		}
+	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		return dir
+	}
+	return "."
+}
+
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+func getEnvInt(key string, fallback int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return fallback
+	}
+	return n
+}
+
+// getEnvIntRange reads an int that must be within [min, max], refusing to start otherwise
+// rather than letting a narrowing conversion wrap it
+func getEnvIntRange(key string, fallback, min, max int) int {
+	n := getEnvInt(key, fallback)
+	if n < min || n > max {
+		log.Fatalf("%s must be between %d and %d, got %d", key, min, max, n)
+	}
+	return n
+}
+
+func getEnvFloat(key string, fallback float64) float64 {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return fallback
+	}
+	return f
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return fallback
+	}
+	return b
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return fallback
+	}
+	return d
+}
+
+// getEnvFileMode reads octal permissions such as 0660
+func getEnvFileMode(key string, fallback os.FileMode) os.FileMode {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return fallback
+	}
+	return os.FileMode(mode)
+}
+
+// getEnvList splits a comma separated variable, ignoring empty entries
+func getEnvList(key string, fallback []string) []string {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
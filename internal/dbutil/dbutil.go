@@ -0,0 +1,30 @@
+// Package dbutil has the SQLite helpers the storage packages share, for schema upgrades and
+// searches on user input
+package dbutil
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// AddColumnIfMissing adds a column to an existing table, used for schema upgrades
+func AddColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	var exists bool
+	checkSQL := `SELECT EXISTS(SELECT 1 FROM pragma_table_info(?) WHERE name = ?)`
+	if err := db.QueryRow(checkSQL, table, column).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	_, err := db.Exec(fmt.Sprintf(`ALTER TABLE %q ADD COLUMN %q %s`, table, column, definition))
+	return err
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// EscapeLike escapes LIKE wildcards in user input, used with ESCAPE '\'
+func EscapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
@@ -0,0 +1,263 @@
+package emoji
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// pack kinds
+const (
+	KindEmoji   = "emoji"
+	KindSticker = "sticker"
+)
+
+// ErrNotFound is returned for unknown packs or shortcodes
+var ErrNotFound = errors.New("emoji not found")
+
+var shortcodePattern = regexp.MustCompile(`^[a-z0-9_+-]{2,32}$`)
+
+// image types accepted for upload, as reported by http.DetectContentType
+var allowedTypes = map[string]bool{
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+	"image/jpeg": true,
+}
+
+// Pack is a named set of custom emoji or stickers
+type Pack struct {
+	ID    int64  `json:"id"`
+	Name  string `json:"name"`
+	Kind  string `json:"kind"`
+	Room  string `json:"room,omitempty"` // empty for server wide packs
+	Items []Item `json:"items"`
+}
+
+// Item is a single emoji or sticker in a pack
+type Item struct {
+	Shortcode   string `json:"shortcode"`
+	ContentType string `json:"contentType"`
+	ETag        string `json:"etag"`
+	URL         string `json:"url"`
+}
+
+// Manifest lists the packs available to a client
+type Manifest struct {
+	Version string `json:"version"` // changes whenever any listed pack or image changes
+	Packs   []Pack `json:"packs"`
+}
+
+// Image is the stored data for an item
+type Image struct {
+	ContentType string
+	ETag        string
+	Data        []byte
+}
+
+// Storage keeps packs and their images in SQLite
+type Storage struct {
+	db       *sql.DB
+	basePath string // prepended to image URLs, empty when the server is at the root
+}
+
+// NewStorage initializes the emoji tables on an open database
+func NewStorage(db *sql.DB, basePath string) *Storage {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS emoji_packs (
+		"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+		"name" TEXT NOT NULL,
+		"kind" TEXT NOT NULL,
+		"room" TEXT NOT NULL DEFAULT '',
+		"created_at" INTEGER NOT NULL);
+	CREATE TABLE IF NOT EXISTS emoji_items (
+		"pack_id" INTEGER NOT NULL,
+		"shortcode" TEXT NOT NULL,
+		"content_type" TEXT NOT NULL,
+		"etag" TEXT NOT NULL,
+		"data" BLOB NOT NULL,
+		"created_at" INTEGER NOT NULL,
+		PRIMARY KEY ("pack_id", "shortcode"));`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Fatalf("Failed to create emoji tables: %v", err)
+	}
+
+	return &Storage{db: db, basePath: basePath}
+}
+
+// CreatePack adds an empty pack, room scopes it to a single room
+func (s *Storage) CreatePack(name, kind, room string) (Pack, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 64 {
+		return Pack{}, errors.New("pack name must be 1 to 64 characters")
+	}
+	if kind != KindEmoji && kind != KindSticker {
+		return Pack{}, fmt.Errorf("kind must be %q or %q", KindEmoji, KindSticker)
+	}
+
+	insertSQL := `INSERT INTO emoji_packs (name, kind, room, created_at) VALUES (?, ?, ?, ?)`
+	res, err := s.db.Exec(insertSQL, name, kind, room, time.Now().Unix())
+	if err != nil {
+		return Pack{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Pack{}, err
+	}
+	return Pack{ID: id, Name: name, Kind: kind, Room: room, Items: []Item{}}, nil
+}
+
+// DeletePack removes a pack and all of its images
+func (s *Storage) DeletePack(id int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`DELETE FROM emoji_packs WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	if _, err := tx.Exec(`DELETE FROM emoji_items WHERE pack_id = ?`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// PutItem stores or replaces an image in a pack, maxSize limits the image in bytes
+func (s *Storage) PutItem(packID int64, shortcode string, data []byte, maxSize int64) (Item, error) {
+	if !shortcodePattern.MatchString(shortcode) {
+		return Item{}, errors.New("shortcode must be 2 to 32 characters of a-z, 0-9, _, + or -")
+	}
+	if len(data) == 0 || int64(len(data)) > maxSize {
+		return Item{}, fmt.Errorf("image must be between 1 and %d bytes", maxSize)
+	}
+	// trust the bytes, not the client supplied Content-Type
+	contentType := http.DetectContentType(data)
+	if !allowedTypes[contentType] {
+		return Item{}, fmt.Errorf("unsupported image type %q", contentType)
+	}
+
+	if _, err := s.PackKind(packID); err != nil {
+		return Item{}, err
+	}
+
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	upsertSQL := `INSERT INTO emoji_items (pack_id, shortcode, content_type, etag, data, created_at) VALUES (?, ?, ?, ?, ?, ?)
+	ON CONFLICT(pack_id, shortcode) DO UPDATE SET content_type = excluded.content_type, etag = excluded.etag, data = excluded.data`
+	if _, err := s.db.Exec(upsertSQL, packID, shortcode, contentType, etag, data, time.Now().Unix()); err != nil {
+		return Item{}, err
+	}
+	return Item{Shortcode: shortcode, ContentType: contentType, ETag: etag, URL: s.itemURL(packID, shortcode)}, nil
+}
+
+// PackKind returns whether a pack holds emoji or stickers
+func (s *Storage) PackKind(packID int64) (string, error) {
+	var kind string
+	err := s.db.QueryRow(`SELECT kind FROM emoji_packs WHERE id = ?`, packID).Scan(&kind)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	return kind, err
+}
+
+// DeleteItem removes an image from a pack
+func (s *Storage) DeleteItem(packID int64, shortcode string) error {
+	res, err := s.db.Exec(`DELETE FROM emoji_items WHERE pack_id = ? AND shortcode = ?`, packID, shortcode)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Image returns the stored image for a shortcode
+func (s *Storage) Image(packID int64, shortcode string) (*Image, error) {
+	var img Image
+	querySQL := `SELECT content_type, etag, data FROM emoji_items WHERE pack_id = ? AND shortcode = ?`
+	err := s.db.QueryRow(querySQL, packID, shortcode).Scan(&img.ContentType, &img.ETag, &img.Data)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &img, nil
+}
+
+// Manifest lists server wide packs plus those scoped to room, or every pack when allRooms is set
+func (s *Storage) Manifest(room string, allRooms bool) (*Manifest, error) {
+	querySQL := `SELECT id, name, kind, room FROM emoji_packs WHERE room = '' OR room = ? OR ? ORDER BY id`
+	rows, err := s.db.Query(querySQL, room, allRooms)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	manifest := &Manifest{Packs: []Pack{}}
+	index := make(map[int64]int)
+	for rows.Next() {
+		pack := Pack{Items: []Item{}}
+		if err := rows.Scan(&pack.ID, &pack.Name, &pack.Kind, &pack.Room); err != nil {
+			return nil, err
+		}
+		index[pack.ID] = len(manifest.Packs)
+		manifest.Packs = append(manifest.Packs, pack)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	itemRows, err := s.db.Query(`SELECT pack_id, shortcode, content_type, etag FROM emoji_items ORDER BY pack_id, shortcode`)
+	if err != nil {
+		return nil, err
+	}
+	defer itemRows.Close()
+
+	version := sha256.New()
+	for itemRows.Next() {
+		var packID int64
+		var item Item
+		if err := itemRows.Scan(&packID, &item.Shortcode, &item.ContentType, &item.ETag); err != nil {
+			return nil, err
+		}
+		i, ok := index[packID]
+		if !ok {
+			continue
+		}
+		item.URL = s.itemURL(packID, item.Shortcode)
+		manifest.Packs[i].Items = append(manifest.Packs[i].Items, item)
+	}
+	if err := itemRows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, pack := range manifest.Packs {
+		fmt.Fprintf(version, "%d\x00%s\x00%s\x00%s\n", pack.ID, pack.Name, pack.Kind, pack.Room)
+		for _, item := range pack.Items {
+			fmt.Fprintf(version, "%s\x00%s\n", item.Shortcode, item.ETag)
+		}
+	}
+	manifest.Version = hex.EncodeToString(version.Sum(nil)[:16])
+	return manifest, nil
+}
+
+func (s *Storage) itemURL(packID int64, shortcode string) string {
+	return fmt.Sprintf("%s/api/emoji/%d/%s", s.basePath, packID, shortcode)
+}
@@ -0,0 +1,327 @@
+// Package flags decides which users get features that are being rolled out. A flag is on for
+// a share of users, from none to all, set by admins at runtime over the default from the
+// configuration, and can be turned on or off for single users whatever the share
+package flags
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errors returned by Set
+var (
+	ErrUnknownFlag    = errors.New("unknown feature flag")
+	ErrInvalidRollout = errors.New("rollout must be 0 to 100 percent")
+)
+
+// Definition is a flag the server consults, with the share of users it is on for unless
+// configured or set otherwise
+type Definition struct {
+	Name        string
+	Description string
+	Rollout     int
+}
+
+// Flag is the state of a flag, for the admin API
+type Flag struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Rollout     int             `json:"rollout"`        // percent of users the flag is on for
+	Default     int             `json:"defaultRollout"` // the rollout from the configuration
+	UpdatedBy   string          `json:"updatedBy,omitempty"`
+	UpdatedAt   *time.Time      `json:"updatedAt,omitempty"`
+	Users       map[string]bool `json:"users"` // users the flag is turned on or off for, whatever the rollout
+}
+
+// Set holds the flags in memory and keeps changes in SQLite. Changes made through another
+// instance sharing the database are picked up on Reload
+type Set struct {
+	db       *sql.DB
+	defaults []Definition
+
+	mu    sync.RWMutex
+	flags map[string]*Flag
+}
+
+// ParseDefaults reads rollouts configured as "name=on,other=off,third=25%", unknown names
+// are an error
+func ParseDefaults(defs []Definition, spec string) ([]Definition, error) {
+	out := append([]Definition(nil), defs...)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("feature flag %q has no value", entry)
+		}
+		rollout, err := parseRollout(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("feature flag %s: %w", name, err)
+		}
+		found := false
+		for i := range out {
+			if out[i].Name == strings.TrimSpace(name) {
+				out[i].Rollout, found = rollout, true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%w %q", ErrUnknownFlag, name)
+		}
+	}
+	return out, nil
+}
+
+func parseRollout(value string) (int, error) {
+	switch value {
+	case "on", "true":
+		return 100, nil
+	case "off", "false":
+		return 0, nil
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+	if err != nil || n < 0 || n > 100 {
+		return 0, ErrInvalidRollout
+	}
+	return n, nil
+}
+
+// NewSet initializes the flag tables on an open database and loads the flags in defs
+func NewSet(db *sql.DB, defs []Definition) (*Set, error) {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS feature_flags (
+		"name" TEXT NOT NULL PRIMARY KEY,
+		"rollout" INTEGER NOT NULL,
+		"updated_by" TEXT NOT NULL,
+		"updated_at" INTEGER NOT NULL);
+	CREATE TABLE IF NOT EXISTS feature_flag_users (
+		"name" TEXT NOT NULL,
+		"username" TEXT NOT NULL,
+		"enabled" INTEGER NOT NULL,
+		PRIMARY KEY (name, username));`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Fatalf("Failed to create feature flag tables: %v", err)
+	}
+
+	s := &Set{db: db, defaults: defs}
+	return s, s.Reload()
+}
+
+// Reload reads the flags from the database again
+func (s *Set) Reload() error {
+	flags := make(map[string]*Flag, len(s.defaults))
+	for _, def := range s.defaults {
+		flags[def.Name] = &Flag{
+			Name:        def.Name,
+			Description: def.Description,
+			Rollout:     def.Rollout,
+			Default:     def.Rollout,
+			Users:       make(map[string]bool),
+		}
+	}
+
+	rows, err := s.db.Query(`SELECT name, rollout, updated_by, updated_at FROM feature_flags`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, updatedBy string
+		var rollout int
+		var updatedAt int64
+		if err := rows.Scan(&name, &rollout, &updatedBy, &updatedAt); err != nil {
+			return err
+		}
+		// flags the server no longer consults stay in the table, harmlessly
+		if flag, ok := flags[name]; ok {
+			at := time.UnixMilli(updatedAt)
+			flag.Rollout, flag.UpdatedBy, flag.UpdatedAt = rollout, updatedBy, &at
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	userRows, err := s.db.Query(`SELECT name, username, enabled FROM feature_flag_users`)
+	if err != nil {
+		return err
+	}
+	defer userRows.Close()
+	for userRows.Next() {
+		var name, username string
+		var enabled bool
+		if err := userRows.Scan(&name, &username, &enabled); err != nil {
+			return err
+		}
+		if flag, ok := flags[name]; ok {
+			flag.Users[username] = enabled
+		}
+	}
+	if err := userRows.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.flags = flags
+	s.mu.Unlock()
+	return nil
+}
+
+// Enabled reports whether flag is on for username: as turned on or off for them, or else
+// when they fall in the rollout. A user falls in the same share of every rollout of a flag,
+// so raising it only adds users. Unknown flags are off. A nil Set has every flag on
+func (s *Set) Enabled(name, username string) bool {
+	if s == nil {
+		return true
+	}
+	s.mu.RLock()
+	flag, ok := s.flags[name]
+	if !ok {
+		s.mu.RUnlock()
+		return false
+	}
+	enabled, override := flag.Users[username]
+	rollout := flag.Rollout
+	s.mu.RUnlock()
+
+	if override {
+		return enabled
+	}
+	switch rollout {
+	case 0:
+		return false
+	case 100:
+		return true
+	}
+	return bucket(name, username) < rollout
+}
+
+// bucket places username in one of 100 buckets, different for each flag so the same users
+// aren't always first
+func bucket(name, username string) int {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write([]byte(username))
+	return int(h.Sum32() % 100)
+}
+
+// For returns every flag as it is for username
+func (s *Set) For(username string) map[string]bool {
+	s.mu.RLock()
+	names := make([]string, 0, len(s.flags))
+	for name := range s.flags {
+		names = append(names, name)
+	}
+	s.mu.RUnlock()
+
+	out := make(map[string]bool, len(names))
+	for _, name := range names {
+		out[name] = s.Enabled(name, username)
+	}
+	return out
+}
+
+// List returns a copy of every flag, in the order they were defined
+func (s *Set) List() []Flag {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]Flag, 0, len(s.defaults))
+	for _, def := range s.defaults {
+		out = append(out, s.copy(def.Name))
+	}
+	return out
+}
+
+// Get returns a copy of a flag
+func (s *Set) Get(name string) (Flag, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.flags[name]; !ok {
+		return Flag{}, ErrUnknownFlag
+	}
+	return s.copy(name), nil
+}
+
+func (s *Set) copy(name string) Flag {
+	flag := *s.flags[name]
+	flag.Users = make(map[string]bool, len(s.flags[name].Users))
+	for username, enabled := range s.flags[name].Users {
+		flag.Users[username] = enabled
+	}
+	return flag
+}
+
+// SetRollout turns a flag on for rollout percent of users
+func (s *Set) SetRollout(name string, rollout int, admin string) (Flag, error) {
+	if _, err := s.Get(name); err != nil {
+		return Flag{}, err
+	}
+	if rollout < 0 || rollout > 100 {
+		return Flag{}, ErrInvalidRollout
+	}
+	_, err := s.db.Exec(`
+		INSERT INTO feature_flags (name, rollout, updated_by, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET rollout = excluded.rollout, updated_by = excluded.updated_by, updated_at = excluded.updated_at`,
+		name, rollout, admin, time.Now().UnixMilli())
+	return s.changed(name, err)
+}
+
+// ResetRollout returns a flag to its configured rollout, users it was turned on or off for
+// keep their setting
+func (s *Set) ResetRollout(name string) (Flag, error) {
+	if _, err := s.Get(name); err != nil {
+		return Flag{}, err
+	}
+	_, err := s.db.Exec(`DELETE FROM feature_flags WHERE name = ?`, name)
+	return s.changed(name, err)
+}
+
+// SetUser turns a flag on or off for username, whatever the rollout
+func (s *Set) SetUser(name, username string, enabled bool) (Flag, error) {
+	if _, err := s.Get(name); err != nil {
+		return Flag{}, err
+	}
+	_, err := s.db.Exec(`
+		INSERT INTO feature_flag_users (name, username, enabled) VALUES (?, ?, ?)
+		ON CONFLICT (name, username) DO UPDATE SET enabled = excluded.enabled`,
+		name, username, enabled)
+	return s.changed(name, err)
+}
+
+// ClearUser leaves a flag to the rollout for username again
+func (s *Set) ClearUser(name, username string) (Flag, error) {
+	if _, err := s.Get(name); err != nil {
+		return Flag{}, err
+	}
+	_, err := s.db.Exec(`DELETE FROM feature_flag_users WHERE name = ? AND username = ?`, name, username)
+	return s.changed(name, err)
+}
+
+// ForgetUser removes every setting made for username, when their account is purged
+func (s *Set) ForgetUser(username string) error {
+	if _, err := s.db.Exec(`DELETE FROM feature_flag_users WHERE username = ?`, username); err != nil {
+		return err
+	}
+	return s.Reload()
+}
+
+// changed reloads the flags after a write and returns the one written
+func (s *Set) changed(name string, err error) (Flag, error) {
+	if err != nil {
+		return Flag{}, err
+	}
+	if err := s.Reload(); err != nil {
+		return Flag{}, err
+	}
+	return s.Get(name)
+}
@@ -0,0 +1,36 @@
+package history
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+)
+
+// ErrDuplicate is returned by Save when the sender already stored a message with the same client id
+var ErrDuplicate = errors.New("duplicate message")
+
+// migrateClientID adds the client generated message id, unique per sender when present
+func migrateClientID(db *sql.DB) {
+	var exists bool
+	checkSQL := `SELECT EXISTS(SELECT 1 FROM pragma_table_info('messages') WHERE name = 'client_id')`
+	if err := db.QueryRow(checkSQL).Scan(&exists); err != nil {
+		log.Fatalf("Failed to migrate messages table: %v", err)
+	}
+	if !exists {
+		if _, err := db.Exec(`ALTER TABLE messages ADD COLUMN "client_id" TEXT`); err != nil {
+			log.Fatalf("Failed to migrate messages table: %v", err)
+		}
+	}
+
+	indexSQL := `CREATE UNIQUE INDEX IF NOT EXISTS messages_client_id ON messages (sender, client_id) WHERE client_id IS NOT NULL`
+	if _, err := db.Exec(indexSQL); err != nil {
+		log.Fatalf("Failed to create messages index: %v", err)
+	}
+}
+
+// findByClientID looks up the stored copy of a resubmitted message
+func (s *MessageStorage) findByClientID(sender, clientID string) (id, seq, createdAt int64, err error) {
+	querySQL := `SELECT id, seq, created_at FROM messages WHERE sender = ? AND client_id = ?`
+	err = s.db.QueryRow(querySQL, sender, clientID).Scan(&id, &seq, &createdAt)
+	return id, seq, createdAt, err
+}
@@ -0,0 +1,104 @@
+package history
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// reasons a message ends up in the dead-letter table
+const (
+	ReasonQueueFull        = "recipient_queue_full"
+	ReasonUnknownRecipient = "unknown_recipient"
+)
+
+// DeadLetter is a message the hub could not deliver
+type DeadLetter struct {
+	ID        int64     `json:"id"`
+	MessageID int64     `json:"messageId,omitempty"`
+	Sender    string    `json:"sender"`
+	Recipient string    `json:"recipient"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// DeadLetterStats summarizes undeliverable messages for administrators
+type DeadLetterStats struct {
+	Total    int            `json:"total"`
+	Last24h  int            `json:"last24h"`
+	ByReason map[string]int `json:"byReason"`
+	Recent   []DeadLetter   `json:"recent"`
+}
+
+func createDeadLetterTable(db *sql.DB) {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS dead_letters (
+		"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+		"message_id" INTEGER,
+		"sender" TEXT NOT NULL,
+		"recipient" TEXT NOT NULL,
+		"reason" TEXT NOT NULL,
+		"created_at" INTEGER NOT NULL);`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Fatalf("Failed to create dead_letters table: %v", err)
+	}
+}
+
+// RecordDeadLetter stores a message that could not be delivered
+func (s *MessageStorage) RecordDeadLetter(messageID int64, sender, recipient, reason string) error {
+	insertSQL := `INSERT INTO dead_letters (message_id, sender, recipient, reason, created_at) VALUES (?, ?, ?, ?, ?)`
+	var id interface{}
+	if messageID != 0 {
+		id = messageID
+	}
+	_, err := s.db.Exec(insertSQL, id, sender, recipient, reason, time.Now().UnixMilli())
+	return err
+}
+
+// DeadLetterStats returns totals per reason and the most recent entries
+func (s *MessageStorage) DeadLetterStats(recent int) (*DeadLetterStats, error) {
+	stats := &DeadLetterStats{ByReason: make(map[string]int), Recent: []DeadLetter{}}
+
+	rows, err := s.db.Query(`SELECT reason, COUNT(*) FROM dead_letters GROUP BY reason`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var reason string
+		var count int
+		if err := rows.Scan(&reason, &count); err != nil {
+			return nil, err
+		}
+		stats.ByReason[reason] = count
+		stats.Total += count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	dayAgo := time.Now().Add(-24 * time.Hour).UnixMilli()
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM dead_letters WHERE created_at >= ?`, dayAgo).Scan(&stats.Last24h); err != nil {
+		return nil, err
+	}
+
+	recentRows, err := s.db.Query(`
+	SELECT id, COALESCE(message_id, 0), sender, recipient, reason, created_at FROM dead_letters
+	ORDER BY id DESC LIMIT ?`, recent)
+	if err != nil {
+		return nil, err
+	}
+	defer recentRows.Close()
+	for recentRows.Next() {
+		var dl DeadLetter
+		var createdAt int64
+		if err := recentRows.Scan(&dl.ID, &dl.MessageID, &dl.Sender, &dl.Recipient, &dl.Reason, &createdAt); err != nil {
+			return nil, err
+		}
+		dl.CreatedAt = time.UnixMilli(createdAt)
+		stats.Recent = append(stats.Recent, dl)
+	}
+
+	return stats, recentRows.Err()
+}
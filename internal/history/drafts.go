@@ -0,0 +1,109 @@
+package history
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+// MaxDraftSize is the largest draft a user can store for a conversation, in encrypted bytes
+const MaxDraftSize = 32 * 1024
+
+// ErrStaleDraft is returned when a draft change is older than the one stored, which another
+// device wrote later
+var ErrStaleDraft = errors.New("a newer draft is stored")
+
+// Draft is a message a user started in a conversation, encrypted by their client so the server
+// can't read it. A cleared draft is kept with Deleted set, so an older copy still being edited
+// on another device can't bring it back
+type Draft struct {
+	Conversation string    `json:"conversation"` // "user:{username}" or "room:{id}"
+	Content      []byte    `json:"content,omitempty"`
+	UpdatedAt    time.Time `json:"updatedAt"` // when the client last edited it
+	Deleted      bool      `json:"deleted,omitempty"`
+}
+
+func createDraftsTable(db *sql.DB) {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS drafts (
+		"username" TEXT NOT NULL,
+		"scope" TEXT NOT NULL,
+		"subject" TEXT NOT NULL,
+		"content" BLOB,
+		"updated_at" INTEGER NOT NULL,
+		PRIMARY KEY (username, scope, subject));
+	CREATE INDEX IF NOT EXISTS drafts_subject ON drafts (scope, subject);`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Fatalf("Failed to create drafts table: %v", err)
+	}
+}
+
+// Draft returns username's draft for a conversation, nil when there is none
+func (s *MessageStorage) Draft(username, scope, subject string) (*Draft, error) {
+	var content []byte
+	var updatedAt int64
+	querySQL := `SELECT content, updated_at FROM drafts WHERE username = ? AND scope = ? AND subject = ? AND content IS NOT NULL`
+	err := s.db.QueryRow(querySQL, username, scope, subject).Scan(&content, &updatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Draft{Conversation: ConversationID(scope, subject), Content: content, UpdatedAt: time.UnixMilli(updatedAt)}, nil
+}
+
+// Drafts returns username's drafts for every conversation that has one, most recently edited first
+func (s *MessageStorage) Drafts(username string) ([]*Draft, error) {
+	querySQL := `SELECT scope, subject, content, updated_at FROM drafts
+	WHERE username = ? AND content IS NOT NULL ORDER BY updated_at DESC`
+	rows, err := s.db.Query(querySQL, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	drafts := []*Draft{}
+	for rows.Next() {
+		var scope, subject string
+		var content []byte
+		var updatedAt int64
+		if err := rows.Scan(&scope, &subject, &content, &updatedAt); err != nil {
+			return nil, err
+		}
+		drafts = append(drafts, &Draft{Conversation: ConversationID(scope, subject), Content: content, UpdatedAt: time.UnixMilli(updatedAt)})
+	}
+	return drafts, rows.Err()
+}
+
+// SetDraft stores username's draft for a conversation as edited at updatedAt, or clears it when
+// content is nil. The last edit wins: a change older than the stored draft, or than its
+// clearing, returns ErrStaleDraft with the stored draft. Times in the future count as now, so
+// a device with a fast clock can't pin its draft
+func (s *MessageStorage) SetDraft(username, scope, subject string, content []byte, updatedAt time.Time) (*Draft, error) {
+	if now := time.Now(); updatedAt.IsZero() || updatedAt.After(now) {
+		updatedAt = now
+	}
+
+	upsertSQL := `INSERT INTO drafts (username, scope, subject, content, updated_at) VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT (username, scope, subject) DO UPDATE SET content = excluded.content, updated_at = excluded.updated_at
+	WHERE excluded.updated_at >= drafts.updated_at`
+	res, err := s.db.Exec(upsertSQL, username, scope, subject, content, updatedAt.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	draft := &Draft{Conversation: ConversationID(scope, subject), Content: content, UpdatedAt: time.UnixMilli(updatedAt.UnixMilli()), Deleted: content == nil}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return draft, nil
+	}
+
+	var stored []byte
+	var storedAt int64
+	querySQL := `SELECT content, updated_at FROM drafts WHERE username = ? AND scope = ? AND subject = ?`
+	if err := s.db.QueryRow(querySQL, username, scope, subject).Scan(&stored, &storedAt); err != nil {
+		return nil, err
+	}
+	return &Draft{Conversation: draft.Conversation, Content: stored, UpdatedAt: time.UnixMilli(storedAt), Deleted: stored == nil}, ErrStaleDraft
+}
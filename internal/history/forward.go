@@ -0,0 +1,29 @@
+package history
+
+import (
+	"database/sql"
+	"log"
+)
+
+// migrateForward adds what forwards carry to both message tables: the provenance of the
+// forwarded message, NULL for messages that aren't forwards, and the sender's no-forward hint
+func migrateForward(db *sql.DB) {
+	for _, table := range []string{"messages", "room_messages"} {
+		for _, col := range []struct{ name, definition string }{
+			{"provenance", "BLOB"},
+			{"no_forward", "INTEGER NOT NULL DEFAULT 0"},
+		} {
+			var exists bool
+			checkSQL := `SELECT EXISTS(SELECT 1 FROM pragma_table_info(?) WHERE name = ?)`
+			if err := db.QueryRow(checkSQL, table, col.name).Scan(&exists); err != nil {
+				log.Fatalf("Failed to migrate %s table: %v", table, err)
+			}
+			if exists {
+				continue
+			}
+			if _, err := db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN "` + col.name + `" ` + col.definition); err != nil {
+				log.Fatalf("Failed to migrate %s table: %v", table, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package history
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+)
+
+// Envelope is a stored message, the server only ever keeps the encrypted content
+type Envelope struct {
+	ID        int64     `json:"id"`
+	Seq       int64     `json:"seq"`                // per-conversation sequence number
+	ClientID  string    `json:"clientId,omitempty"` // set when the sender supplied one
+	Sender    string    `json:"sender"`
+	Recipient string    `json:"recipient"`
+	Content   []byte    `json:"content"`
+	CreatedAt time.Time `json:"createdAt"`
+	// forwards only, the original's provenance as the forwarding client sent it
+	Provenance []byte `json:"provenance,omitempty"`
+	NoForward  bool   `json:"noForward,omitempty"` // the sender asked for it not to be forwarded
+}
+
+// MessageStorage persists message envelopes in SQLite
+type MessageStorage struct {
+	db *sql.DB
+}
+
+// NewMessageStorage initializes the messages table on an open database
+func NewMessageStorage(db *sql.DB) *MessageStorage {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS messages (
+		"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+		"sender" TEXT NOT NULL,
+		"recipient" TEXT NOT NULL,
+		"content" BLOB,
+		"created_at" INTEGER NOT NULL);
+	CREATE INDEX IF NOT EXISTS messages_sender ON messages (sender, id);
+	CREATE INDEX IF NOT EXISTS messages_recipient ON messages (recipient, id);`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Fatalf("Failed to create messages table: %v", err)
+	}
+	migrateSequence(db)
+	migrateClientID(db)
+	createRoomMessageTable(db)
+	migrateForward(db)
+	createDeadLetterTable(db)
+	createRetentionTable(db)
+	createSettingsTable(db)
+	createSavedTable(db)
+	createDraftsTable(db)
+
+	return &MessageStorage{db: db}
+}
+
+// Save stores a chat message and sets its id, server timestamp and conversation sequence number.
+// If the sender already stored a message with the same client id, nothing is written, msg gets
+// the stored copy's id, sequence number and timestamp and ErrDuplicate is returned
+func (s *MessageStorage) Save(msg *protocol.Message) error {
+	now := time.Now().UnixMilli()
+	var clientID interface{}
+	if msg.ClientID != "" {
+		clientID = msg.ClientID
+	}
+
+	// a single statement, so concurrent senders in one conversation can't draw the same number
+	insertSQL := `
+	INSERT INTO messages (sender, recipient, content, created_at, seq, client_id, provenance, no_forward)
+	SELECT ?, ?, ?, ?, COALESCE(MAX(seq), 0) + 1, ?, ?, ? FROM messages
+	WHERE (sender = ? AND recipient = ?) OR (sender = ? AND recipient = ?)
+	ON CONFLICT (sender, client_id) WHERE client_id IS NOT NULL DO NOTHING
+	RETURNING id, seq`
+	err := s.db.QueryRow(insertSQL, msg.Sender, msg.Recipient, msg.Content, now, clientID, msg.Provenance, msg.NoForward,
+		msg.Sender, msg.Recipient, msg.Recipient, msg.Sender).Scan(&msg.ID, &msg.Seq)
+	if err == sql.ErrNoRows && msg.ClientID != "" {
+		// the conflict clause skipped the insert
+		msg.ID, msg.Seq, msg.Timestamp, err = s.findByClientID(msg.Sender, msg.ClientID)
+		if err != nil {
+			return err
+		}
+		return ErrDuplicate
+	}
+	if err != nil {
+		return err
+	}
+	msg.Timestamp = now
+	return nil
+}
+
+// HasReceivedFrom reports whether from has ever sent username a message
+// used as a metadata-only stand in for "is a contact"
+func (s *MessageStorage) HasReceivedFrom(username, from string) (bool, error) {
+	var exists bool
+	querySQL := `SELECT EXISTS(SELECT 1 FROM messages WHERE sender = ? AND recipient = ?)`
+	err := s.db.QueryRow(querySQL, from, username).Scan(&exists)
+	return exists, err
+}
+
+// Correspondents returns everyone username has exchanged messages with
+func (s *MessageStorage) Correspondents(username string) ([]string, error) {
+	querySQL := `
+	SELECT recipient FROM messages WHERE sender = ?
+	UNION
+	SELECT sender FROM messages WHERE recipient = ?`
+	rows, err := s.db.Query(querySQL, username, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []string
+	for rows.Next() {
+		var user string
+		if err := rows.Scan(&user); err != nil {
+			return nil, err
+		}
+		if user != username {
+			users = append(users, user)
+		}
+	}
+	return users, rows.Err()
+}
+
+// PendingForUser counts the envelopes sent or received by username with an id greater than
+// afterID and returns the id of the newest one username has, 0 if there are none
+func (s *MessageStorage) PendingForUser(username string, afterID int64) (int, int64, error) {
+	querySQL := `
+	SELECT COUNT(CASE WHEN id > ? THEN 1 END), COALESCE(MAX(id), 0) FROM messages
+	WHERE sender = ? OR recipient = ?`
+	var pending int
+	var latest int64
+	err := s.db.QueryRow(querySQL, afterID, username, username).Scan(&pending, &latest)
+	return pending, latest, err
+}
+
+// ListForUser returns envelopes sent or received by username with an id greater than afterID,
+// created at or after since, oldest first
+func (s *MessageStorage) ListForUser(username string, since time.Time, afterID int64, limit int) ([]Envelope, error) {
+	querySQL := `
+	SELECT id, seq, sender, recipient, content, created_at, COALESCE(client_id, ''), provenance, no_forward FROM messages
+	WHERE (sender = ? OR recipient = ?) AND id > ? AND created_at >= ?
+	ORDER BY id
+	LIMIT ?`
+	rows, err := s.db.Query(querySQL, username, username, afterID, since.UnixMilli(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var envelopes []Envelope
+	for rows.Next() {
+		var env Envelope
+		var createdAt int64
+		if err := rows.Scan(&env.ID, &env.Seq, &env.Sender, &env.Recipient, &env.Content, &createdAt, &env.ClientID, &env.Provenance, &env.NoForward); err != nil {
+			return nil, err
+		}
+		env.CreatedAt = time.UnixMilli(createdAt)
+		envelopes = append(envelopes, env)
+	}
+
+	return envelopes, rows.Err()
+}
@@ -0,0 +1,300 @@
+package history
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+// retention policy scopes
+const (
+	ScopeGlobal = "global"
+	ScopeUser   = "user"
+	ScopeRoom   = "room"
+	// ScopePlan is the hosted plan's retention, never stored, it caps every other policy
+	ScopePlan = "plan"
+)
+
+// RetentionPolicy limits how long stored envelopes and attachments are kept
+// a user policy applies to every direct message the user sent or received and their direct
+// attachments, a room policy to the room's messages and attachments,
+// when several policies apply the shortest one wins
+type RetentionPolicy struct {
+	Scope   string        `json:"scope"`
+	Subject string        `json:"subject,omitempty"` // username for user policies, room id for room policies
+	MaxAge  time.Duration `json:"-"`
+}
+
+// retentionTarget is a table retention deletes from and the policy scopes that cover it
+type retentionTarget struct {
+	table string
+	// condition on the policy subject for each scope applying to the table, "" for none
+	scopes map[string]string
+	// leaves out the rows of accounts under legal hold, which outlive every policy
+	notHeld string
+	seconds bool // created_at is in unix seconds rather than milliseconds
+}
+
+var (
+	messageRetention = retentionTarget{
+		table:   "messages",
+		scopes:  map[string]string{ScopeGlobal: "", ScopeUser: "? IN (sender, recipient)", ScopePlan: ""},
+		notHeld: ` AND sender NOT IN (SELECT username FROM legal_holds) AND recipient NOT IN (SELECT username FROM legal_holds)`,
+	}
+	// room messages are not held, they go with their room
+	roomMessageRetention = retentionTarget{
+		table:  "room_messages",
+		scopes: map[string]string{ScopeGlobal: "", ScopeRoom: "room_id = ?", ScopePlan: ""},
+	}
+	// attachment blobs are shared and kept in the attachment backends, so they are only
+	// listed here for the attachment storage to release. Thumbnails go with their attachment
+	attachmentRetention = retentionTarget{
+		table:   "attachments",
+		scopes:  map[string]string{ScopeGlobal: "", ScopeUser: "room = '' AND owner = ?", ScopeRoom: "room = ?", ScopePlan: ""},
+		notHeld: ` AND thumbnail_of = '' AND (room != '' OR owner NOT IN (SELECT username FROM legal_holds))`,
+		seconds: true,
+	}
+)
+
+// condition returns the WHERE clause selecting the rows of the target policy expires at now,
+// false when the policy doesn't cover the target
+func (t retentionTarget) condition(policy RetentionPolicy, now time.Time) (string, []interface{}, bool) {
+	subject, ok := t.scopes[policy.Scope]
+	if !ok {
+		return "", nil, false
+	}
+	cutoff := now.Add(-policy.MaxAge)
+	where := `created_at < ?`
+	args := []interface{}{cutoff.UnixMilli()}
+	if t.seconds {
+		args[0] = cutoff.Unix()
+	}
+	if subject != "" {
+		where += ` AND ` + subject
+		args = append(args, policy.Subject)
+	}
+	return where, args, true
+}
+
+// PruneReport describes what a retention run deleted, or would delete in a dry run
+type PruneReport struct {
+	DryRun       bool `json:"dryRun"`
+	Messages     int  `json:"messages"`
+	RoomMessages int  `json:"roomMessages"`
+	// attachments past retention, released by the attachment storage after the run
+	Attachments int `json:"attachments"`
+	// direct and room messages deleted by each policy
+	ByPolicy map[string]int `json:"byPolicy"`
+	// ids of the attachments past retention, for the attachment storage to release
+	ExpiredAttachments []string `json:"-"`
+}
+
+func createRetentionTable(db *sql.DB) {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS retention_policies (
+		"scope" TEXT NOT NULL,
+		"subject" TEXT NOT NULL DEFAULT '',
+		"max_age_seconds" INTEGER NOT NULL,
+		PRIMARY KEY (scope, subject));`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Fatalf("Failed to create retention_policies table: %v", err)
+	}
+}
+
+// SetRetentionPolicy creates or replaces a policy, a zero max age removes it
+func (s *MessageStorage) SetRetentionPolicy(policy RetentionPolicy) error {
+	switch policy.Scope {
+	case ScopeGlobal:
+		policy.Subject = ""
+	case ScopeUser:
+		if policy.Subject == "" {
+			return errors.New("user policies need a subject")
+		}
+	case ScopeRoom:
+		if policy.Subject == "" {
+			return errors.New("room policies need a subject")
+		}
+	default:
+		return errors.New("scope must be global, user or room")
+	}
+	if policy.MaxAge < 0 {
+		return errors.New("max age cannot be negative")
+	}
+
+	if policy.MaxAge == 0 {
+		_, err := s.db.Exec(`DELETE FROM retention_policies WHERE scope = ? AND subject = ?`, policy.Scope, policy.Subject)
+		return err
+	}
+	upsertSQL := `
+	INSERT INTO retention_policies (scope, subject, max_age_seconds) VALUES (?, ?, ?)
+	ON CONFLICT (scope, subject) DO UPDATE SET max_age_seconds = excluded.max_age_seconds`
+	_, err := s.db.Exec(upsertSQL, policy.Scope, policy.Subject, int64(policy.MaxAge.Seconds()))
+	return err
+}
+
+// RetentionPolicies returns every stored policy
+func (s *MessageStorage) RetentionPolicies() ([]RetentionPolicy, error) {
+	rows, err := s.db.Query(`SELECT scope, subject, max_age_seconds FROM retention_policies ORDER BY scope, subject`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	policies := []RetentionPolicy{}
+	for rows.Next() {
+		var policy RetentionPolicy
+		var seconds int64
+		if err := rows.Scan(&policy.Scope, &policy.Subject, &seconds); err != nil {
+			return nil, err
+		}
+		policy.MaxAge = time.Duration(seconds) * time.Second
+		policies = append(policies, policy)
+	}
+	return policies, rows.Err()
+}
+
+// Prune deletes direct and room messages older than their retention policies allow, but no
+// direct messages of an account under legal hold. Attachments past their policies are only
+// listed in the report, their blobs are released through the attachment storage
+// defaultMaxAge is the configured global policy, used when none is stored (0 keeps forever)
+// planMaxAge is the plan's retention, applied on top of every policy (0 for none)
+func (s *MessageStorage) Prune(defaultMaxAge, planMaxAge time.Duration, dryRun bool) (*PruneReport, error) {
+	policies, err := s.RetentionPolicies()
+	if err != nil {
+		return nil, err
+	}
+	hasGlobal := false
+	for _, policy := range policies {
+		if policy.Scope == ScopeGlobal {
+			hasGlobal = true
+		}
+	}
+	if !hasGlobal && defaultMaxAge > 0 {
+		policies = append(policies, RetentionPolicy{Scope: ScopeGlobal, MaxAge: defaultMaxAge})
+	}
+	if planMaxAge > 0 {
+		policies = append(policies, RetentionPolicy{Scope: ScopePlan, MaxAge: planMaxAge})
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	report := &PruneReport{DryRun: dryRun, ByPolicy: make(map[string]int)}
+	now := time.Now()
+	if report.Messages, err = prune(tx, messageRetention, policies, now, dryRun, report.ByPolicy); err != nil {
+		return nil, err
+	}
+	if report.RoomMessages, err = prune(tx, roomMessageRetention, policies, now, dryRun, report.ByPolicy); err != nil {
+		return nil, err
+	}
+	if report.ExpiredAttachments, err = expiredAttachments(tx, policies, now); err != nil {
+		return nil, err
+	}
+	report.Attachments = len(report.ExpiredAttachments)
+
+	if dryRun {
+		return report, nil
+	}
+	return report, tx.Commit()
+}
+
+// prune deletes the rows of target expired by any of policies, adding the count of each policy
+// to byPolicy, and returns how many went. A dry run counts them instead
+func prune(tx *sql.Tx, target retentionTarget, policies []RetentionPolicy, now time.Time, dryRun bool, byPolicy map[string]int) (int, error) {
+	total := 0
+	for _, policy := range policies {
+		where, args, ok := target.condition(policy, now)
+		if !ok {
+			continue
+		}
+		where += target.notHeld
+
+		var n int64
+		var err error
+		if dryRun {
+			err = tx.QueryRow(`SELECT COUNT(*) FROM `+target.table+` WHERE `+where, args...).Scan(&n)
+		} else {
+			var result sql.Result
+			result, err = tx.Exec(`DELETE FROM `+target.table+` WHERE `+where, args...)
+			if err == nil {
+				n, err = result.RowsAffected()
+			}
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		name := policy.Scope
+		if policy.Subject != "" {
+			name += ":" + policy.Subject
+		}
+		byPolicy[name] += int(n)
+		total += int(n)
+	}
+
+	// in a dry run policies can overlap, count distinct rows instead of summing
+	if dryRun {
+		return countExpired(tx, target, policies, now)
+	}
+	return total, nil
+}
+
+// expiredWhere joins the conditions of every policy covering target, false when none does
+func expiredWhere(target retentionTarget, policies []RetentionPolicy, now time.Time) (string, []interface{}, bool) {
+	where := ""
+	var args []interface{}
+	for _, policy := range policies {
+		condition, conditionArgs, ok := target.condition(policy, now)
+		if !ok {
+			continue
+		}
+		if where != "" {
+			where += " OR "
+		}
+		where += "(" + condition + ")"
+		args = append(args, conditionArgs...)
+	}
+	if where == "" {
+		return "", nil, false
+	}
+	return "(" + where + ")" + target.notHeld, args, true
+}
+
+// countExpired counts rows of target matched by at least one policy
+func countExpired(tx *sql.Tx, target retentionTarget, policies []RetentionPolicy, now time.Time) (int, error) {
+	where, args, ok := expiredWhere(target, policies, now)
+	if !ok {
+		return 0, nil
+	}
+	var count int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM `+target.table+` WHERE `+where, args...).Scan(&count)
+	return count, err
+}
+
+// expiredAttachments lists the attachments matched by at least one policy
+func expiredAttachments(tx *sql.Tx, policies []RetentionPolicy, now time.Time) ([]string, error) {
+	where, args, ok := expiredWhere(attachmentRetention, policies, now)
+	if !ok {
+		return nil, nil
+	}
+	rows, err := tx.Query(`SELECT id FROM attachments WHERE `+where+` ORDER BY created_at`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -0,0 +1,125 @@
+package history
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+)
+
+// RoomEnvelope is a stored room message, encrypted with a key shared among the room's members
+type RoomEnvelope struct {
+	ID        int64     `json:"id"`
+	Room      string    `json:"room"`
+	Seq       int64     `json:"seq"` // per-room sequence number
+	ClientID  string    `json:"clientId,omitempty"`
+	Sender    string    `json:"sender"`
+	Content   []byte    `json:"content"`
+	CreatedAt time.Time `json:"createdAt"`
+	// as in Envelope
+	Provenance []byte `json:"provenance,omitempty"`
+	NoForward  bool   `json:"noForward,omitempty"`
+}
+
+// room messages are kept apart from direct messages so conversation queries
+// never have to tell room ids and usernames apart
+func createRoomMessageTable(db *sql.DB) {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS room_messages (
+		"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+		"room_id" TEXT NOT NULL,
+		"seq" INTEGER NOT NULL,
+		"sender" TEXT NOT NULL,
+		"content" BLOB,
+		"client_id" TEXT,
+		"created_at" INTEGER NOT NULL);
+	CREATE INDEX IF NOT EXISTS room_messages_room ON room_messages (room_id, seq);
+	CREATE UNIQUE INDEX IF NOT EXISTS room_messages_client_id ON room_messages (sender, client_id) WHERE client_id IS NOT NULL;`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Fatalf("Failed to create room_messages table: %v", err)
+	}
+}
+
+// SaveRoom stores a room message like Save, numbering it within the room
+func (s *MessageStorage) SaveRoom(msg *protocol.Message) error {
+	now := time.Now().UnixMilli()
+	var clientID interface{}
+	if msg.ClientID != "" {
+		clientID = msg.ClientID
+	}
+
+	insertSQL := `
+	INSERT INTO room_messages (room_id, seq, sender, content, client_id, created_at, provenance, no_forward)
+	SELECT ?, COALESCE(MAX(seq), 0) + 1, ?, ?, ?, ?, ?, ? FROM room_messages WHERE room_id = ?
+	ON CONFLICT (sender, client_id) WHERE client_id IS NOT NULL DO NOTHING
+	RETURNING id, seq`
+	err := s.db.QueryRow(insertSQL, msg.Room, msg.Sender, msg.Content, clientID, now, msg.Provenance, msg.NoForward, msg.Room).Scan(&msg.ID, &msg.Seq)
+	if err == sql.ErrNoRows && msg.ClientID != "" {
+		querySQL := `SELECT id, seq, created_at FROM room_messages WHERE sender = ? AND client_id = ?`
+		if err := s.db.QueryRow(querySQL, msg.Sender, msg.ClientID).Scan(&msg.ID, &msg.Seq, &msg.Timestamp); err != nil {
+			return err
+		}
+		return ErrDuplicate
+	}
+	if err != nil {
+		return err
+	}
+	msg.Timestamp = now
+	return nil
+}
+
+// FirstRoomSeqSince returns the lowest sequence number of room stored at or after since, in unix
+// millis, or 0 when there is none
+func (s *MessageStorage) FirstRoomSeqSince(room string, since int64) (int64, error) {
+	var seq int64
+	querySQL := `SELECT COALESCE(MIN(seq), 0) FROM room_messages WHERE room_id = ? AND created_at >= ?`
+	err := s.db.QueryRow(querySQL, room, since).Scan(&seq)
+	return seq, err
+}
+
+// RoomMessages returns a room's messages with from <= seq <= to, in sequence order
+func (s *MessageStorage) RoomMessages(room string, from, to int64, limit int) ([]RoomEnvelope, error) {
+	querySQL := `
+	SELECT id, room_id, seq, COALESCE(client_id, ''), sender, content, created_at, provenance, no_forward FROM room_messages
+	WHERE room_id = ? AND seq BETWEEN ? AND ?
+	ORDER BY seq
+	LIMIT ?`
+	rows, err := s.db.Query(querySQL, room, from, to, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	envelopes := []RoomEnvelope{}
+	for rows.Next() {
+		var env RoomEnvelope
+		var createdAt int64
+		if err := rows.Scan(&env.ID, &env.Room, &env.Seq, &env.ClientID, &env.Sender, &env.Content, &createdAt, &env.Provenance, &env.NoForward); err != nil {
+			return nil, err
+		}
+		env.CreatedAt = time.UnixMilli(createdAt)
+		envelopes = append(envelopes, env)
+	}
+	return envelopes, rows.Err()
+}
+
+// RoomMessageExists reports whether a room has a stored message with seq
+func (s *MessageStorage) RoomMessageExists(room string, seq int64) (bool, error) {
+	var exists bool
+	err := s.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM room_messages WHERE room_id = ? AND seq = ?)`, room, seq).Scan(&exists)
+	return exists, err
+}
+
+// DeleteRoom removes every stored message of a room and its members' settings and drafts for it
+func (s *MessageStorage) DeleteRoom(room string) error {
+	if _, err := s.db.Exec(`DELETE FROM room_messages WHERE room_id = ?`, room); err != nil {
+		return err
+	}
+	if _, err := s.db.Exec(`DELETE FROM conversation_settings WHERE scope = ? AND subject = ?`, ConversationRoom, room); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`DELETE FROM drafts WHERE scope = ? AND subject = ?`, ConversationRoom, room)
+	return err
+}
@@ -0,0 +1,195 @@
+package history
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+// MaxSavedMessages is how many messages a user can save
+const MaxSavedMessages = 5000
+
+// ErrMessageNotFound is returned when saving a message that doesn't exist or the user can't read
+var ErrMessageNotFound = errors.New("message not found")
+
+// ErrTooManySaved is returned when a user already saved MaxSavedMessages
+var ErrTooManySaved = errors.New("too many saved messages")
+
+// SavedMessage is a message a user starred, with the stored envelope so any of their devices
+// can show it without having kept a copy
+type SavedMessage struct {
+	ID           int64         `json:"id"`           // the saved entry, for paging
+	Scope        string        `json:"scope"`        // ConversationUser or ConversationRoom
+	MessageID    int64         `json:"messageId"`    // id of the direct or room message
+	Conversation string        `json:"conversation"` // "user:{username}" or "room:{id}"
+	SavedAt      time.Time     `json:"savedAt"`
+	Message      *Envelope     `json:"message,omitempty"`     // direct messages
+	RoomMessage  *RoomEnvelope `json:"roomMessage,omitempty"` // room messages
+}
+
+func createSavedTable(db *sql.DB) {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS saved_messages (
+		"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+		"username" TEXT NOT NULL,
+		"scope" TEXT NOT NULL,
+		"message_id" INTEGER NOT NULL,
+		"saved_at" INTEGER NOT NULL);
+	CREATE UNIQUE INDEX IF NOT EXISTS saved_messages_message ON saved_messages (username, scope, message_id);`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Fatalf("Failed to create saved_messages table: %v", err)
+	}
+}
+
+// readable reports whether username can read a message: direct messages they sent or
+// received, room messages of rooms they are a member of
+func (s *MessageStorage) readable(username, scope string, messageID int64) (bool, error) {
+	var querySQL string
+	switch scope {
+	case ConversationUser:
+		querySQL = `SELECT EXISTS(SELECT 1 FROM messages WHERE id = ?1 AND (sender = ?2 OR recipient = ?2))`
+	case ConversationRoom:
+		querySQL = `SELECT EXISTS(SELECT 1 FROM room_messages m
+		JOIN room_members r ON r.room_id = m.room_id AND r.username = ?2 WHERE m.id = ?1)`
+	default:
+		return false, nil
+	}
+	var ok bool
+	err := s.db.QueryRow(querySQL, messageID, username).Scan(&ok)
+	return ok, err
+}
+
+// SaveMessage stars a message for username, saving one twice keeps the first time.
+// Returns ErrMessageNotFound for messages they can't read
+func (s *MessageStorage) SaveMessage(username, scope string, messageID int64) (*SavedMessage, error) {
+	ok, err := s.readable(username, scope, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrMessageNotFound
+	}
+	var count int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM saved_messages WHERE username = ?`, username).Scan(&count); err != nil {
+		return nil, err
+	}
+	if count >= MaxSavedMessages {
+		return nil, ErrTooManySaved
+	}
+	insertSQL := `INSERT INTO saved_messages (username, scope, message_id, saved_at) VALUES (?, ?, ?, ?)
+	ON CONFLICT (username, scope, message_id) DO NOTHING`
+	if _, err := s.db.Exec(insertSQL, username, scope, messageID, time.Now().UnixMilli()); err != nil {
+		return nil, err
+	}
+	return s.savedMessage(username, scope, messageID)
+}
+
+// UnsaveMessage removes a message from username's saved messages, ErrMessageNotFound if it
+// wasn't saved
+func (s *MessageStorage) UnsaveMessage(username, scope string, messageID int64) error {
+	res, err := s.db.Exec(`DELETE FROM saved_messages WHERE username = ? AND scope = ? AND message_id = ?`, username, scope, messageID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrMessageNotFound
+	}
+	return nil
+}
+
+// savedColumns selects a saved entry with its envelope, from whichever table it is in.
+// Direct messages join on the user taking part, room messages on them still being a member,
+// so entries they can no longer read drop out
+const savedColumns = `
+	SELECT s.id, s.scope, s.message_id, s.saved_at,
+		m.id, m.seq, m.sender, m.recipient, m.content, m.created_at, COALESCE(m.client_id, ''), m.provenance, m.no_forward,
+		rm.id, rm.room_id, rm.seq, COALESCE(rm.client_id, ''), rm.sender, rm.content, rm.created_at, rm.provenance, rm.no_forward
+	FROM saved_messages s
+	LEFT JOIN messages m ON s.scope = 'user' AND m.id = s.message_id AND (m.sender = s.username OR m.recipient = s.username)
+	LEFT JOIN room_messages rm ON s.scope = 'room' AND rm.id = s.message_id
+		AND EXISTS(SELECT 1 FROM room_members r WHERE r.room_id = rm.room_id AND r.username = s.username)`
+
+// scanSaved reads a row of savedColumns for username, false when its message is gone
+func scanSaved(rows interface{ Scan(...interface{}) error }, username string) (*SavedMessage, bool, error) {
+	var saved SavedMessage
+	var savedAt int64
+	var m struct {
+		id, seq, createdAt          sql.NullInt64
+		sender, recipient, clientID sql.NullString
+		content, provenance         []byte
+		noForward                   sql.NullBool
+	}
+	var rm struct {
+		id, seq, createdAt     sql.NullInt64
+		room, clientID, sender sql.NullString
+		content, provenance    []byte
+		noForward              sql.NullBool
+	}
+	err := rows.Scan(&saved.ID, &saved.Scope, &saved.MessageID, &savedAt,
+		&m.id, &m.seq, &m.sender, &m.recipient, &m.content, &m.createdAt, &m.clientID, &m.provenance, &m.noForward,
+		&rm.id, &rm.room, &rm.seq, &rm.clientID, &rm.sender, &rm.content, &rm.createdAt, &rm.provenance, &rm.noForward)
+	if err != nil {
+		return nil, false, err
+	}
+	saved.SavedAt = time.UnixMilli(savedAt)
+	switch {
+	case m.id.Valid:
+		saved.Message = &Envelope{
+			ID: m.id.Int64, Seq: m.seq.Int64, ClientID: m.clientID.String, Sender: m.sender.String, Recipient: m.recipient.String,
+			Content: m.content, CreatedAt: time.UnixMilli(m.createdAt.Int64), Provenance: m.provenance, NoForward: m.noForward.Bool,
+		}
+		with := saved.Message.Recipient
+		if with == username {
+			with = saved.Message.Sender
+		}
+		saved.Conversation = ConversationID(ConversationUser, with)
+	case rm.id.Valid:
+		saved.RoomMessage = &RoomEnvelope{
+			ID: rm.id.Int64, Room: rm.room.String, Seq: rm.seq.Int64, ClientID: rm.clientID.String, Sender: rm.sender.String,
+			Content: rm.content, CreatedAt: time.UnixMilli(rm.createdAt.Int64), Provenance: rm.provenance, NoForward: rm.noForward.Bool,
+		}
+		saved.Conversation = ConversationID(ConversationRoom, saved.RoomMessage.Room)
+	default:
+		return nil, false, nil
+	}
+	return &saved, true, nil
+}
+
+// savedMessage returns one of username's saved messages, ErrMessageNotFound if it isn't saved
+// or they can't read it anymore
+func (s *MessageStorage) savedMessage(username, scope string, messageID int64) (*SavedMessage, error) {
+	row := s.db.QueryRow(savedColumns+` WHERE s.username = ? AND s.scope = ? AND s.message_id = ?`, username, scope, messageID)
+	saved, ok, err := scanSaved(row, username)
+	if err == sql.ErrNoRows || (err == nil && !ok) {
+		return nil, ErrMessageNotFound
+	}
+	return saved, err
+}
+
+// SavedMessages returns username's saved messages with an entry id below before, or from the
+// newest when before is 0, most recently saved first. Messages that were deleted since, or
+// that they can no longer read, are left out
+func (s *MessageStorage) SavedMessages(username string, before int64, limit int) ([]SavedMessage, error) {
+	if before == 0 {
+		before = 1<<63 - 1
+	}
+	rows, err := s.db.Query(savedColumns+`
+	WHERE s.username = ? AND s.id < ? AND (m.id IS NOT NULL OR rm.id IS NOT NULL)
+	ORDER BY s.id DESC LIMIT ?`, username, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	saved := []SavedMessage{}
+	for rows.Next() {
+		entry, _, err := scanSaved(rows, username)
+		if err != nil {
+			return nil, err
+		}
+		saved = append(saved, *entry)
+	}
+	return saved, rows.Err()
+}
@@ -0,0 +1,69 @@
+package history
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// migrateSequence adds per-conversation sequence numbers, numbering existing messages by id
+func migrateSequence(db *sql.DB) {
+	var exists bool
+	checkSQL := `SELECT EXISTS(SELECT 1 FROM pragma_table_info('messages') WHERE name = 'seq')`
+	if err := db.QueryRow(checkSQL).Scan(&exists); err != nil {
+		log.Fatalf("Failed to migrate messages table: %v", err)
+	}
+	if !exists {
+		migrateSQL := `
+		ALTER TABLE messages ADD COLUMN "seq" INTEGER NOT NULL DEFAULT 0;
+		UPDATE messages SET seq = numbered.seq FROM (
+			SELECT id, ROW_NUMBER() OVER (PARTITION BY MIN(sender, recipient), MAX(sender, recipient) ORDER BY id) AS seq
+			FROM messages) AS numbered
+		WHERE messages.id = numbered.id;`
+		if _, err := db.Exec(migrateSQL); err != nil {
+			log.Fatalf("Failed to migrate messages table: %v", err)
+		}
+	}
+
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS messages_conversation ON messages (sender, recipient, seq)`); err != nil {
+		log.Fatalf("Failed to create messages index: %v", err)
+	}
+}
+
+// Conversation returns envelopes exchanged between a and b with from <= seq <= to, in sequence order,
+// so a client can fill gaps it detected in delivered sequence numbers
+func (s *MessageStorage) Conversation(a, b string, from, to int64, limit int) ([]Envelope, error) {
+	querySQL := `
+	SELECT id, seq, sender, recipient, content, created_at, COALESCE(client_id, ''), provenance, no_forward FROM messages
+	WHERE ((sender = ? AND recipient = ?) OR (sender = ? AND recipient = ?)) AND seq BETWEEN ? AND ?
+	ORDER BY seq
+	LIMIT ?`
+	rows, err := s.db.Query(querySQL, a, b, b, a, from, to, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	envelopes := []Envelope{}
+	for rows.Next() {
+		var env Envelope
+		var createdAt int64
+		if err := rows.Scan(&env.ID, &env.Seq, &env.Sender, &env.Recipient, &env.Content, &createdAt, &env.ClientID, &env.Provenance, &env.NoForward); err != nil {
+			return nil, err
+		}
+		env.CreatedAt = time.UnixMilli(createdAt)
+		envelopes = append(envelopes, env)
+	}
+	return envelopes, rows.Err()
+}
+
+// FirstSeqSince returns the lowest sequence number of the conversation between a and b stored at
+// or after since, in unix millis, or 0 when there is none
+func (s *MessageStorage) FirstSeqSince(a, b string, since int64) (int64, error) {
+	querySQL := `
+	SELECT COALESCE(MIN(seq), 0) FROM messages
+	WHERE ((sender = ? AND recipient = ?) OR (sender = ? AND recipient = ?)) AND created_at >= ?`
+	var seq int64
+	err := s.db.QueryRow(querySQL, a, b, b, a, since).Scan(&seq)
+	return seq, err
+}
@@ -0,0 +1,178 @@
+package history
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+)
+
+// conversation scopes
+const (
+	ConversationUser = "user"
+	ConversationRoom = "room"
+)
+
+// limits on a user's settings for one conversation
+const (
+	MaxConversationSettings = 32
+	MaxSettingKeyLength     = 64
+	MaxSettingValueSize     = 1024
+)
+
+// ErrInvalidSettings is returned for a malformed key, an oversized value or too many keys
+var ErrInvalidSettings = errors.New("invalid conversation settings")
+
+// ConversationSettings are one user's key-value settings for a conversation, such as a color,
+// a nickname or a pinned flag. Values are any JSON, the server doesn't interpret them
+type ConversationSettings struct {
+	Conversation string                     `json:"conversation"` // "user:{username}" or "room:{id}"
+	Settings     map[string]json.RawMessage `json:"settings"`
+	UpdatedAt    *time.Time                 `json:"updatedAt,omitempty"`
+}
+
+func createSettingsTable(db *sql.DB) {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS conversation_settings (
+		"username" TEXT NOT NULL,
+		"scope" TEXT NOT NULL,
+		"subject" TEXT NOT NULL,
+		"key" TEXT NOT NULL,
+		"value" TEXT NOT NULL,
+		"updated_at" INTEGER NOT NULL,
+		PRIMARY KEY (username, scope, subject, key));
+	CREATE INDEX IF NOT EXISTS conversation_settings_subject ON conversation_settings (scope, subject);`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Fatalf("Failed to create conversation_settings table: %v", err)
+	}
+}
+
+// ConversationID names a conversation in settings, subject is a username or room id
+func ConversationID(scope, subject string) string {
+	return scope + ":" + subject
+}
+
+func validSettingKey(key string) bool {
+	if key == "" || len(key) > MaxSettingKeyLength {
+		return false
+	}
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// ConversationSettings returns username's settings for a conversation, empty when none are set
+func (s *MessageStorage) ConversationSettings(username, scope, subject string) (*ConversationSettings, error) {
+	querySQL := `SELECT key, value, updated_at FROM conversation_settings
+	WHERE username = ? AND scope = ? AND subject = ? ORDER BY key`
+	rows, err := s.db.Query(querySQL, username, scope, subject)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	settings := &ConversationSettings{Conversation: ConversationID(scope, subject), Settings: map[string]json.RawMessage{}}
+	for rows.Next() {
+		var key, value string
+		var updatedAt int64
+		if err := rows.Scan(&key, &value, &updatedAt); err != nil {
+			return nil, err
+		}
+		settings.Settings[key] = json.RawMessage(value)
+		if t := time.UnixMilli(updatedAt); settings.UpdatedAt == nil || t.After(*settings.UpdatedAt) {
+			settings.UpdatedAt = &t
+		}
+	}
+	return settings, rows.Err()
+}
+
+// AllConversationSettings returns username's settings for every conversation that has any
+func (s *MessageStorage) AllConversationSettings(username string) ([]*ConversationSettings, error) {
+	querySQL := `SELECT scope, subject, key, value, updated_at FROM conversation_settings
+	WHERE username = ? ORDER BY scope, subject, key`
+	rows, err := s.db.Query(querySQL, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	all := []*ConversationSettings{}
+	var current *ConversationSettings
+	for rows.Next() {
+		var scope, subject, key, value string
+		var updatedAt int64
+		if err := rows.Scan(&scope, &subject, &key, &value, &updatedAt); err != nil {
+			return nil, err
+		}
+		if id := ConversationID(scope, subject); current == nil || current.Conversation != id {
+			current = &ConversationSettings{Conversation: id, Settings: map[string]json.RawMessage{}}
+			all = append(all, current)
+		}
+		current.Settings[key] = json.RawMessage(value)
+		if t := time.UnixMilli(updatedAt); current.UpdatedAt == nil || t.After(*current.UpdatedAt) {
+			current.UpdatedAt = &t
+		}
+	}
+	return all, rows.Err()
+}
+
+// UpdateConversationSettings merges changes into username's settings for a conversation, a null
+// value removes its key, and returns the settings as they now are
+func (s *MessageStorage) UpdateConversationSettings(username, scope, subject string, changes map[string]json.RawMessage) (*ConversationSettings, error) {
+	for key, value := range changes {
+		if !validSettingKey(key) || len(value) > MaxSettingValueSize {
+			return nil, ErrInvalidSettings
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UnixMilli()
+	for key, value := range changes {
+		if len(value) == 0 || bytes.Equal(value, []byte("null")) {
+			deleteSQL := `DELETE FROM conversation_settings WHERE username = ? AND scope = ? AND subject = ? AND key = ?`
+			if _, err := tx.Exec(deleteSQL, username, scope, subject, key); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, value); err != nil {
+			return nil, ErrInvalidSettings
+		}
+		upsertSQL := `INSERT INTO conversation_settings (username, scope, subject, key, value, updated_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (username, scope, subject, key) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at`
+		if _, err := tx.Exec(upsertSQL, username, scope, subject, key, compact.String(), now); err != nil {
+			return nil, err
+		}
+	}
+
+	var count int
+	countSQL := `SELECT COUNT(*) FROM conversation_settings WHERE username = ? AND scope = ? AND subject = ?`
+	if err := tx.QueryRow(countSQL, username, scope, subject).Scan(&count); err != nil {
+		return nil, err
+	}
+	if count > MaxConversationSettings {
+		return nil, ErrInvalidSettings
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return s.ConversationSettings(username, scope, subject)
+}
+
+// ClearConversationSettings removes all of username's settings for a conversation
+func (s *MessageStorage) ClearConversationSettings(username, scope, subject string) error {
+	_, err := s.db.Exec(`DELETE FROM conversation_settings WHERE username = ? AND scope = ? AND subject = ?`, username, scope, subject)
+	return err
+}
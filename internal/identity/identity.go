@@ -0,0 +1,119 @@
+// Package identity holds the server's long-term Ed25519 key, used to sign responses
+// clients need to trust even when a reverse proxy in between is compromised
+package identity
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// signaturePrefix separates response signatures from anything else the key might sign
+const signaturePrefix = "meadowlark-response-v1\n"
+
+// Identity is the server's signing key pair
+type Identity struct {
+	private   ed25519.PrivateKey
+	public    ed25519.PublicKey
+	createdAt time.Time
+}
+
+// LoadOrCreate reads the PKCS #8 PEM key at path, generating and saving a new one if the file doesn't exist
+func LoadOrCreate(path string) (*Identity, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return create(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s: not a PEM private key", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{private: private, public: private.Public().(ed25519.PublicKey), createdAt: info.ModTime()}, nil
+}
+
+func create(path string) (*Identity, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	// O_EXCL so two servers sharing a data directory can't overwrite each other's key
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return &Identity{private: private, public: public, createdAt: time.Now()}, nil
+}
+
+// PublicKey returns the raw 32 byte public key
+func (id *Identity) PublicKey() ed25519.PublicKey {
+	return id.public
+}
+
+// Fingerprint is the hex SHA-256 of the public key, short enough to compare by eye
+func (id *Identity) Fingerprint() string {
+	sum := sha256.Sum256(id.public)
+	return hex.EncodeToString(sum[:])
+}
+
+// CreatedAt is when the key was generated, approximated by its file's modification time
+func (id *Identity) CreatedAt() time.Time {
+	return id.createdAt
+}
+
+// SignResponse signs body as served at signedAt
+func (id *Identity) SignResponse(body []byte, signedAt time.Time) []byte {
+	return ed25519.Sign(id.private, responseMessage(body, signedAt.Unix()))
+}
+
+// VerifyResponse checks a signature made by SignResponse against a pinned public key
+func VerifyResponse(public ed25519.PublicKey, body []byte, signedAt int64, signature []byte) bool {
+	return len(public) == ed25519.PublicKeySize && ed25519.Verify(public, responseMessage(body, signedAt), signature)
+}
+
+// responseMessage is the prefix, the unix time in decimal and a newline, then the body
+func responseMessage(body []byte, signedAt int64) []byte {
+	msg := make([]byte, 0, len(signaturePrefix)+21+len(body))
+	msg = append(msg, signaturePrefix...)
+	msg = strconv.AppendInt(msg, signedAt, 10)
+	msg = append(msg, '\n')
+	return append(msg, body...)
+}
@@ -0,0 +1,195 @@
+// Package inbound bridges email into chat: mail a provider receives for a configured address
+// is stored for the user or room the address maps to. Bridged email is plaintext, the server
+// can read it like the mail provider could
+package inbound
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/mail"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// MaxTextLength is how much of an email's text is kept, in characters, longer text is cut
+const MaxTextLength = 16000
+
+// MaxSubjectLength is how much of a subject is kept, in characters
+const MaxSubjectLength = 256
+
+// Route is where mail for one address goes, either a user or a room
+type Route struct {
+	Username string
+	Room     string
+}
+
+// Routes maps lower case email addresses to their destinations
+type Routes map[string]Route
+
+// ParseRoutes reads "alerts@example.com=room:<id>" and "ops@example.com=user:alice" entries
+func ParseRoutes(entries []string) (Routes, error) {
+	routes := make(Routes, len(entries))
+	for _, entry := range entries {
+		address, target, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return nil, fmt.Errorf("route %q: expected address=user:name or address=room:id", entry)
+		}
+		parsed, err := mail.ParseAddress(strings.TrimSpace(address))
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %v", entry, err)
+		}
+		kind, name, _ := strings.Cut(strings.TrimSpace(target), ":")
+		var route Route
+		switch {
+		case kind == "user" && name != "":
+			route.Username = name
+		case kind == "room" && name != "":
+			route.Room = name
+		default:
+			return nil, fmt.Errorf("route %q: expected address=user:name or address=room:id", entry)
+		}
+		routes[strings.ToLower(parsed.Address)] = route
+	}
+	return routes, nil
+}
+
+// Match returns the first address in a To header value that has a route
+func (r Routes) Match(to string) (string, Route, bool) {
+	addresses, err := mail.ParseAddressList(to)
+	if err != nil {
+		// providers sometimes pass the bare envelope recipient
+		addresses = []*mail.Address{{Address: strings.TrimSpace(to)}}
+	}
+	for _, a := range addresses {
+		address := strings.ToLower(a.Address)
+		if route, ok := r[address]; ok {
+			return address, route, true
+		}
+	}
+	return "", Route{}, false
+}
+
+// SenderAllowed reports whether from is in allowed, entries are addresses or "@domain" for a
+// whole domain. An empty list allows every sender
+func SenderAllowed(from string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	parsed, err := mail.ParseAddress(from)
+	if err != nil {
+		return false
+	}
+	address := strings.ToLower(parsed.Address)
+	for _, entry := range allowed {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == address || (strings.HasPrefix(entry, "@") && strings.HasSuffix(address, entry)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Email is a bridged email as users see it
+type Email struct {
+	ID         int64     `json:"id"`
+	Address    string    `json:"address"` // the routed address it was sent to
+	Room       string    `json:"room,omitempty"`
+	From       string    `json:"from"`
+	Subject    string    `json:"subject"`
+	Text       string    `json:"text"`
+	Truncated  bool      `json:"truncated,omitempty"` // the text was cut to MaxTextLength
+	ReceivedAt time.Time `json:"receivedAt"`
+}
+
+// Storage keeps bridged emails in SQLite until they are read through the API
+type Storage struct {
+	db *sql.DB
+}
+
+// NewStorage initializes the inbound email table on an open database
+func NewStorage(db *sql.DB) *Storage {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS inbound_emails (
+		"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+		"username" TEXT NOT NULL DEFAULT '',
+		"room_id" TEXT NOT NULL DEFAULT '',
+		"address" TEXT NOT NULL,
+		"sender" TEXT NOT NULL,
+		"subject" TEXT NOT NULL,
+		"body" TEXT NOT NULL,
+		"truncated" INTEGER NOT NULL DEFAULT 0,
+		"received_at" INTEGER NOT NULL);
+	CREATE INDEX IF NOT EXISTS inbound_emails_username ON inbound_emails (username, id);
+	CREATE INDEX IF NOT EXISTS inbound_emails_room ON inbound_emails (room_id, id);`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Fatalf("Failed to create inbound_emails table: %v", err)
+	}
+	return &Storage{db: db}
+}
+
+// truncate cuts s to max characters, reporting whether anything was cut
+func truncate(s string, max int) (string, bool) {
+	if utf8.RuneCountInString(s) <= max {
+		return s, false
+	}
+	return string([]rune(s)[:max]), true
+}
+
+// Save stores an email for route, cutting overlong text and subjects, and fills in its id and time
+func (s *Storage) Save(route Route, email *Email) error {
+	email.Subject, _ = truncate(strings.TrimSpace(email.Subject), MaxSubjectLength)
+	email.Text, email.Truncated = truncate(strings.ToValidUTF8(email.Text, "�"), MaxTextLength)
+	email.Room = route.Room
+	email.ReceivedAt = time.Unix(time.Now().Unix(), 0)
+
+	insertSQL := `INSERT INTO inbound_emails (username, room_id, address, sender, subject, body, truncated, received_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	result, err := s.db.Exec(insertSQL, route.Username, route.Room, email.Address, email.From, email.Subject, email.Text,
+		email.Truncated, email.ReceivedAt.Unix())
+	if err != nil {
+		return err
+	}
+	email.ID, err = result.LastInsertId()
+	return err
+}
+
+// ForUser lists emails bridged to username, newest first, below id before when it isn't 0
+func (s *Storage) ForUser(username string, before int64, limit int) ([]Email, error) {
+	return s.list(`username = ?`, username, before, limit)
+}
+
+// ForRoom lists emails bridged to a room, newest first, below id before when it isn't 0
+func (s *Storage) ForRoom(roomID string, before int64, limit int) ([]Email, error) {
+	return s.list(`room_id = ?`, roomID, before, limit)
+}
+
+func (s *Storage) list(where, arg string, before int64, limit int) ([]Email, error) {
+	querySQL := `SELECT id, address, room_id, sender, subject, body, truncated, received_at FROM inbound_emails
+	WHERE ` + where + ` AND (? = 0 OR id < ?) ORDER BY id DESC LIMIT ?`
+	rows, err := s.db.Query(querySQL, arg, before, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	emails := []Email{}
+	for rows.Next() {
+		var e Email
+		var receivedAt int64
+		if err := rows.Scan(&e.ID, &e.Address, &e.Room, &e.From, &e.Subject, &e.Text, &e.Truncated, &receivedAt); err != nil {
+			return nil, err
+		}
+		e.ReceivedAt = time.Unix(receivedAt, 0)
+		emails = append(emails, e)
+	}
+	return emails, rows.Err()
+}
+
+// DeleteRoom removes the emails bridged to a deleted room
+func (s *Storage) DeleteRoom(roomID string) error {
+	_, err := s.db.Exec(`DELETE FROM inbound_emails WHERE room_id = ?`, roomID)
+	return err
+}
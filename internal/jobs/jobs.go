@@ -0,0 +1,203 @@
+// Package jobs runs periodic background work such as pruning, purges and digest emails. Each
+// job runs on its own interval with jitter, and a job changing shared data takes a lease in
+// the database first, so instances sharing a database don't each do the same run
+package jobs
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	mrand "math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Job is a task run every Interval
+type Job struct {
+	Name     string
+	Interval time.Duration // zero or less disables the job
+	// Local jobs run on every instance, for work on the instance's own state such as
+	// counters held in memory. Other jobs run on the instance holding their lease
+	Local bool
+	Run   func(now time.Time) error
+}
+
+// Stats describes how a job has fared since startup
+type Stats struct {
+	Name        string
+	Interval    time.Duration
+	Runs        int64
+	Failures    int64
+	Skipped     int64 // runs left to the instance holding the lease
+	Running     bool
+	Duration    time.Duration // total time spent running
+	LastRun     time.Time
+	LastSuccess time.Time
+	LastError   string
+}
+
+// Scheduler runs jobs added before Start, each in a goroutine of its own
+type Scheduler struct {
+	db     *sql.DB
+	holder string  // this instance in the job_leases table
+	jitter float64 // fraction of the interval runs are moved by, either way
+
+	mu      sync.Mutex
+	jobs    []Job
+	stats   map[string]*Stats
+	started bool
+}
+
+// NewScheduler initializes the job_leases table on an open database. Runs are moved by up to
+// jitter times the interval, so instances started together don't hit the database together
+func NewScheduler(db *sql.DB, jitter float64) *Scheduler {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS job_leases (
+		"name" TEXT NOT NULL PRIMARY KEY,
+		"holder" TEXT NOT NULL,
+		"expires_at" INTEGER NOT NULL);`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Fatalf("Failed to create job_leases table: %v", err)
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &Scheduler{
+		db:     db,
+		holder: hex.EncodeToString(id),
+		jitter: min(max(jitter, 0), 1),
+		stats:  make(map[string]*Stats),
+	}
+}
+
+// Add registers a job, jobs added after Start never run
+func (s *Scheduler) Add(job Job) {
+	if job.Interval <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.stats[job.Name]; ok {
+		panic(fmt.Sprintf("jobs: %s added twice", job.Name))
+	}
+	s.jobs = append(s.jobs, job)
+	s.stats[job.Name] = &Stats{Name: job.Name, Interval: job.Interval}
+}
+
+// Start runs every job added so far, the first run of each one interval from now
+func (s *Scheduler) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return
+	}
+	s.started = true
+	for _, job := range s.jobs {
+		go s.loop(job)
+	}
+}
+
+// Stats returns a copy of every job's stats, by name
+func (s *Scheduler) Stats() []Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all := make([]Stats, 0, len(s.stats))
+	for _, st := range s.stats {
+		all = append(all, *st)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Name < all[j].Name })
+	return all
+}
+
+func (s *Scheduler) loop(job Job) {
+	timer := time.NewTimer(s.delay(job.Interval))
+	defer timer.Stop()
+	for now := range timer.C {
+		s.run(job, now)
+		timer.Reset(s.delay(job.Interval))
+	}
+}
+
+// delay is the time until a job's next run, its interval moved by the jitter
+func (s *Scheduler) delay(interval time.Duration) time.Duration {
+	spread := time.Duration(float64(interval) * s.jitter)
+	if spread <= 0 {
+		return interval
+	}
+	return interval - spread + mrand.N(2*spread)
+}
+
+// run runs job once unless another instance holds its lease
+func (s *Scheduler) run(job Job, now time.Time) {
+	if !job.Local {
+		ok, err := s.lease(job, now)
+		if err != nil {
+			s.finish(job.Name, now, 0, fmt.Errorf("taking the lease: %w", err))
+			return
+		}
+		if !ok {
+			s.mu.Lock()
+			s.stats[job.Name].Skipped++
+			s.mu.Unlock()
+			return
+		}
+	}
+
+	s.mu.Lock()
+	s.stats[job.Name].Running = true
+	s.mu.Unlock()
+	err := job.Run(now)
+	finished := time.Now()
+	s.finish(job.Name, now, finished.Sub(now), err)
+
+	if !job.Local {
+		// the lease runs a full interval from the end of the run, so a slow run doesn't
+		// leave another instance free to start over right after it
+		if err := s.renew(job, finished); err != nil {
+			log.Printf("Error renewing the lease of job %s: %v", job.Name, err)
+		}
+	}
+}
+
+// lease takes or keeps the job's lease for an interval, false if another instance holds it
+func (s *Scheduler) lease(job Job, now time.Time) (bool, error) {
+	result, err := s.db.Exec(`
+		INSERT INTO job_leases (name, holder, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET holder = excluded.holder, expires_at = excluded.expires_at
+		WHERE job_leases.expires_at <= ? OR job_leases.holder = excluded.holder`,
+		job.Name, s.holder, now.Add(job.Interval).Unix(), now.Unix())
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+func (s *Scheduler) renew(job Job, now time.Time) error {
+	_, err := s.db.Exec(`UPDATE job_leases SET expires_at = ? WHERE name = ? AND holder = ?`,
+		now.Add(job.Interval).Unix(), job.Name, s.holder)
+	return err
+}
+
+// finish records the outcome of a run that started at start
+func (s *Scheduler) finish(name string, start time.Time, took time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.stats[name]
+	st.Running = false
+	st.Runs++
+	st.Duration += took
+	st.LastRun = start
+	if err != nil {
+		st.Failures++
+		st.LastError = err.Error()
+		log.Printf("Job %s failed: %v", name, err)
+		return
+	}
+	st.LastError = ""
+	st.LastSuccess = start.Add(took)
+}
@@ -0,0 +1,171 @@
+package keyring
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrUnknownKey is returned when data references a key id the keyring doesn't hold
+var ErrUnknownKey = errors.New("unknown key id")
+
+// Keyring holds versioned secret keys, one of which is current
+// old keys are kept so existing data can still be read until it is rotated
+type Keyring struct {
+	current string
+	keys    map[string][]byte
+}
+
+// New creates a keyring from id -> key pairs, current must be one of the ids
+func New(current string, keys map[string][]byte) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("keyring needs at least one key")
+	}
+	for id := range keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("invalid key id %q", id)
+		}
+	}
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("current key %q not in keyring", current)
+	}
+	return &Keyring{current: current, keys: keys}, nil
+}
+
+// Parse builds a keyring from a "id:base64key,id:base64key" list
+// an empty list returns a nil keyring, meaning the feature is disabled
+func Parse(current, list string) (*Keyring, error) {
+	if strings.TrimSpace(list) == "" {
+		return nil, nil
+	}
+	keys := make(map[string][]byte)
+	for _, entry := range strings.Split(list, ",") {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid key entry %q, expected id:base64key", entry)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 for key %q: %v", id, err)
+		}
+		keys[id] = key
+	}
+	if current == "" && len(keys) == 1 {
+		for id := range keys {
+			current = id
+		}
+	}
+	return New(current, keys)
+}
+
+// CurrentID returns the id of the key used for new data
+func (k *Keyring) CurrentID() string {
+	return k.current
+}
+
+// Key returns the key with the given id
+func (k *Keyring) Key(id string) ([]byte, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+// CheckAES verifies every key is a valid AES-128, AES-192 or AES-256 key
+func (k *Keyring) CheckAES() error {
+	for id, key := range k.keys {
+		if _, err := aes.NewCipher(key); err != nil {
+			return fmt.Errorf("key %q: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// HMAC computes HMAC-SHA256 of data with the key with the given id
+func (k *Keyring) HMAC(id string, data []byte) ([]byte, error) {
+	key, err := k.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil), nil
+}
+
+// Encrypt seals plaintext with AES-GCM under the current key
+// the output is "keyid:" followed by the nonce and ciphertext
+func (k *Keyring) Encrypt(plaintext []byte) ([]byte, error) {
+	gcm, err := k.aead(k.current)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := append([]byte(k.current+":"), nonce...)
+	return gcm.Seal(out, nonce, plaintext, []byte(k.current)), nil
+}
+
+// Decrypt opens data produced by Encrypt with any key in the keyring
+func (k *Keyring) Decrypt(data []byte) ([]byte, error) {
+	id, sealed, err := splitKeyID(data)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := k.aead(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, []byte(id))
+}
+
+// IsCurrent reports whether data was encrypted with the current key
+func (k *Keyring) IsCurrent(data []byte) bool {
+	id, _, err := splitKeyID(data)
+	return err == nil && id == k.current
+}
+
+// IsSealed reports whether data carries the id of one of the keyring's keys, as the output of
+// Encrypt does, telling it apart from a value stored before encryption was turned on
+func (k *Keyring) IsSealed(data []byte) bool {
+	id, _, err := splitKeyID(data)
+	if err != nil {
+		return false
+	}
+	_, ok := k.keys[id]
+	return ok
+}
+
+func (k *Keyring) aead(id string) (cipher.AEAD, error) {
+	key, err := k.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("key %q: %v", id, err)
+	}
+	return cipher.NewGCM(block)
+}
+
+func splitKeyID(data []byte) (string, []byte, error) {
+	i := bytes.IndexByte(data, ':')
+	if i <= 0 {
+		return "", nil, errors.New("missing key id")
+	}
+	return string(data[:i]), data[i+1:], nil
+}
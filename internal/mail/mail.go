@@ -0,0 +1,115 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"sync"
+	"time"
+)
+
+// Sender delivers plain text emails
+type Sender interface {
+	Send(ctx context.Context, to, subject, body string) error
+}
+
+// LogSender writes emails to the server log instead of sending them, for development
+type LogSender struct{}
+
+// Send logs the email
+func (LogSender) Send(ctx context.Context, to, subject, body string) error {
+	log.Printf("Email to %s: %s\n%s", to, subject, body)
+	return nil
+}
+
+// SMTPSender sends emails through an SMTP relay, upgrading to TLS when the relay offers STARTTLS
+type SMTPSender struct {
+	Addr     string // host:port of the relay
+	Username string // optional, PLAIN authentication is only attempted over TLS or to localhost
+	Password string
+	From     string
+
+	mu sync.Mutex // guards Username and Password once sending has started
+}
+
+// SetCredentials replaces the relay login, e.g. after the password was rotated
+func (s *SMTPSender) SetCredentials(username, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Username, s.Password = username, password
+}
+
+// Send delivers one email, ctx bounds the whole SMTP conversation
+func (s *SMTPSender) Send(ctx context.Context, to, subject, body string) error {
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return err
+	}
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	username, password := s.Username, s.Password
+	s.mu.Unlock()
+	if username != "" {
+		if err := c.Auth(smtp.PlainAuth("", username, password, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(s.From); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(message(s.From, to, subject, body)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// message formats a UTF-8 plain text email, callers pass addresses already validated
+// so they can't smuggle in extra headers
+func message(from, to, subject, body string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qp := quotedprintable.NewWriter(&b)
+	qp.Write([]byte(body))
+	qp.Close()
+	return b.Bytes()
+}
@@ -0,0 +1,129 @@
+package mdns
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Browse asks the local network for meadowlark servers and collects answers for timeout.
+// The query is sent from an ephemeral port, so responders reply directly and no
+// multicast membership is needed
+func Browse(timeout time.Duration) ([]Service, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	query := (&message{
+		id:        1,
+		questions: []question{{name: serviceName, qtype: typePTR, qclass: classIN}},
+	}).pack()
+	if _, err := conn.WriteToUDP(query, groupAddr); err != nil {
+		return nil, err
+	}
+	// ask once more halfway through in case the first packet was lost
+	retry := time.AfterFunc(timeout/2, func() { conn.WriteToUDP(query, groupAddr) })
+	defer retry.Stop()
+
+	found := newBrowseResults()
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 9000)
+	for {
+		conn.SetReadDeadline(deadline)
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				break
+			}
+			return nil, err
+		}
+		resp, err := parse(buf[:n])
+		if err != nil || !resp.response {
+			continue
+		}
+		found.add(resp.answers)
+	}
+	return found.services(), nil
+}
+
+// browseResults gathers records from all responses, they may arrive in separate packets
+type browseResults struct {
+	instances []string            // PTR targets in the order first seen
+	srv       map[string]record   // by instance name
+	txt       map[string][]string // by instance name
+	addrs     map[string][]net.IP // by host name
+}
+
+func newBrowseResults() *browseResults {
+	return &browseResults{
+		srv:   make(map[string]record),
+		txt:   make(map[string][]string),
+		addrs: make(map[string][]net.IP),
+	}
+}
+
+func (b *browseResults) add(records []record) {
+	for _, rr := range records {
+		name := strings.ToLower(rr.name)
+		switch rr.rtype {
+		case typePTR:
+			if name == strings.ToLower(serviceName) && !containsFold(b.instances, rr.target) {
+				b.instances = append(b.instances, rr.target)
+			}
+		case typeSRV:
+			b.srv[name] = rr
+		case typeTXT:
+			b.txt[name] = rr.text
+		case typeA:
+			if !containsIP(b.addrs[name], rr.ip) {
+				b.addrs[name] = append(b.addrs[name], rr.ip.To4())
+			}
+		}
+	}
+}
+
+// services assembles the instances for which an SRV record was received
+func (b *browseResults) services() []Service {
+	var services []Service
+	for _, instance := range b.instances {
+		srv, ok := b.srv[strings.ToLower(instance)]
+		if !ok {
+			continue
+		}
+		service := Service{
+			Instance: strings.TrimSuffix(instance, "."+serviceName),
+			Host:     strings.TrimSuffix(srv.target, "."+domain),
+			Port:     int(srv.port),
+			Addrs:    b.addrs[strings.ToLower(srv.target)],
+			Text:     make(map[string]string),
+		}
+		for _, kv := range b.txt[strings.ToLower(instance)] {
+			k, v, _ := strings.Cut(kv, "=")
+			service.Text[k] = v
+		}
+		services = append(services, service)
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Instance < services[j].Instance })
+	return services
+}
+
+func containsIP(list []net.IP, ip net.IP) bool {
+	for _, item := range list {
+		if item.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
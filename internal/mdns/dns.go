@@ -0,0 +1,243 @@
+package mdns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+// record types and classes used for service discovery
+const (
+	typeA   = 1
+	typePTR = 12
+	typeTXT = 16
+	typeSRV = 33
+	typeANY = 255
+
+	classIN = 1
+	// the top bit of the class asks for a unicast reply in questions and
+	// replaces cached records in answers
+	classTopBit = 0x8000
+)
+
+var errMalformed = errors.New("malformed DNS message")
+
+type question struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+// record is a resource record, only the fields for its type are set
+type record struct {
+	name   string
+	rtype  uint16
+	class  uint16
+	ttl    uint32
+	target string   // PTR and SRV
+	port   uint16   // SRV
+	ip     net.IP   // A
+	text   []string // TXT
+}
+
+type message struct {
+	id          uint16
+	response    bool
+	questions   []question
+	answers     []record
+	additionals []record // only used when packing, parsing puts every record in answers
+}
+
+// pack encodes a message without name compression
+func (m *message) pack() []byte {
+	b := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(b[0:], m.id)
+	if m.response {
+		binary.BigEndian.PutUint16(b[2:], 0x8400) // response, authoritative
+	}
+	binary.BigEndian.PutUint16(b[4:], uint16(len(m.questions)))
+	binary.BigEndian.PutUint16(b[6:], uint16(len(m.answers)))
+	binary.BigEndian.PutUint16(b[10:], uint16(len(m.additionals)))
+
+	for _, q := range m.questions {
+		b = appendName(b, q.name)
+		b = binary.BigEndian.AppendUint16(b, q.qtype)
+		b = binary.BigEndian.AppendUint16(b, q.qclass)
+	}
+	for _, rr := range m.records() {
+		b = appendName(b, rr.name)
+		b = binary.BigEndian.AppendUint16(b, rr.rtype)
+		b = binary.BigEndian.AppendUint16(b, rr.class)
+		b = binary.BigEndian.AppendUint32(b, rr.ttl)
+		data := rr.packData()
+		b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+		b = append(b, data...)
+	}
+	return b
+}
+
+// records lists answers followed by additionals
+func (m *message) records() []record {
+	all := make([]record, 0, len(m.answers)+len(m.additionals))
+	return append(append(all, m.answers...), m.additionals...)
+}
+
+func (rr *record) packData() []byte {
+	switch rr.rtype {
+	case typeA:
+		return rr.ip.To4()
+	case typePTR:
+		return appendName(nil, rr.target)
+	case typeSRV:
+		b := make([]byte, 6) // priority and weight stay 0
+		binary.BigEndian.PutUint16(b[4:], rr.port)
+		return appendName(b, rr.target)
+	case typeTXT:
+		if len(rr.text) == 0 {
+			return []byte{0} // a TXT record holds at least one, possibly empty, string
+		}
+		var b []byte
+		for _, s := range rr.text {
+			if len(s) > 255 {
+				s = s[:255]
+			}
+			b = append(b, byte(len(s)))
+			b = append(b, s...)
+		}
+		return b
+	}
+	return nil
+}
+
+// appendName encodes a dotted name, labels must not contain dots themselves
+func appendName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		if len(label) > 63 {
+			label = label[:63]
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// readName decodes a possibly compressed name starting at off, returning it with a
+// trailing dot and the offset just after it in the original position
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errMalformed
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case n&0xC0 == 0xC0:
+			if off+1 >= len(msg) || jumps > 16 {
+				return "", 0, errMalformed
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+			jumps++
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errMalformed
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
+
+// parse decodes a message, answer, authority and additional records all end up in answers
+func parse(msg []byte) (*message, error) {
+	if len(msg) < 12 {
+		return nil, errMalformed
+	}
+	m := &message{
+		id:       binary.BigEndian.Uint16(msg[0:]),
+		response: msg[2]&0x80 != 0,
+	}
+	qdCount := int(binary.BigEndian.Uint16(msg[4:]))
+	rrCount := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+
+	off := 12
+	for i := 0; i < qdCount; i++ {
+		name, next, err := readName(msg, off)
+		if err != nil || next+4 > len(msg) {
+			return nil, errMalformed
+		}
+		m.questions = append(m.questions, question{
+			name:   name,
+			qtype:  binary.BigEndian.Uint16(msg[next:]),
+			qclass: binary.BigEndian.Uint16(msg[next+2:]),
+		})
+		off = next + 4
+	}
+	for i := 0; i < rrCount; i++ {
+		name, next, err := readName(msg, off)
+		if err != nil || next+10 > len(msg) {
+			return nil, errMalformed
+		}
+		rr := record{
+			name:  name,
+			rtype: binary.BigEndian.Uint16(msg[next:]),
+			class: binary.BigEndian.Uint16(msg[next+2:]),
+			ttl:   binary.BigEndian.Uint32(msg[next+4:]),
+		}
+		length := int(binary.BigEndian.Uint16(msg[next+8:]))
+		start := next + 10
+		if start+length > len(msg) {
+			return nil, errMalformed
+		}
+		if err := rr.parseData(msg, start, length); err != nil {
+			return nil, err
+		}
+		m.answers = append(m.answers, rr)
+		off = start + length
+	}
+	return m, nil
+}
+
+func (rr *record) parseData(msg []byte, start, length int) error {
+	data := msg[start : start+length]
+	var err error
+	switch rr.rtype {
+	case typeA:
+		if length != 4 {
+			return errMalformed
+		}
+		rr.ip = net.IPv4(data[0], data[1], data[2], data[3])
+	case typePTR:
+		rr.target, _, err = readName(msg, start)
+	case typeSRV:
+		if length < 7 {
+			return errMalformed
+		}
+		rr.port = binary.BigEndian.Uint16(data[4:])
+		rr.target, _, err = readName(msg, start+6)
+	case typeTXT:
+		for i := 0; i < len(data); {
+			n := int(data[i])
+			if i+1+n > len(data) {
+				return errMalformed
+			}
+			if n > 0 {
+				rr.text = append(rr.text, string(data[i+1:i+1+n]))
+			}
+			i += 1 + n
+		}
+	}
+	return err
+}
@@ -0,0 +1,238 @@
+// Package mdns advertises and discovers meadowlark servers on the local network with
+// multicast DNS (RFC 6762) and DNS service discovery (RFC 6763).
+// Only what discovery needs is implemented: IPv4 and PTR, SRV, TXT and A records
+package mdns
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServiceType is the DNS-SD service meadowlark servers register as
+const ServiceType = "_meadowlark._tcp"
+
+const (
+	domain = "local."
+	// how long peers may cache our records
+	recordTTL = 120
+	// replies to one-shot queries from ephemeral ports must not be cached longer (RFC 6762 6.7)
+	legacyTTL = 10
+)
+
+// the mDNS multicast group
+var groupAddr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// service enumeration, lets generic browsers list the types on the network
+const servicesName = "_services._dns-sd._udp." + domain
+
+var serviceName = ServiceType + "." + domain
+
+// Service describes an advertised server
+type Service struct {
+	Instance string            // human readable name, shown when choosing a server
+	Host     string            // host name, without .local
+	Port     int               // HTTP port
+	Addrs    []net.IP          // IPv4 addresses
+	Text     map[string]string // extra key=value metadata
+}
+
+// URL is the HTTP address of the service at its first address
+func (s Service) URL() string {
+	if len(s.Addrs) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("http://%s", net.JoinHostPort(s.Addrs[0].String(), fmt.Sprint(s.Port)))
+}
+
+// sanitizeLabel makes s usable as a single DNS label
+func sanitizeLabel(s string) string {
+	s = strings.TrimSpace(strings.ReplaceAll(s, ".", "-"))
+	if len(s) > 63 {
+		s = s[:63]
+	}
+	return s
+}
+
+// Responder answers mDNS queries for one service until closed
+type Responder struct {
+	conn    *net.UDPConn
+	service Service
+
+	instanceName string
+	hostName     string
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// Advertise announces service on the local network and answers queries for it
+func Advertise(service Service) (*Responder, error) {
+	service.Instance = sanitizeLabel(service.Instance)
+	service.Host = sanitizeLabel(service.Host)
+	if service.Instance == "" || service.Host == "" || service.Port <= 0 || len(service.Addrs) == 0 {
+		return nil, errors.New("mdns: service needs an instance name, host, port and address")
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, groupAddr)
+	if err != nil {
+		return nil, err
+	}
+	r := &Responder{
+		conn:         conn,
+		service:      service,
+		instanceName: service.Instance + "." + serviceName,
+		hostName:     service.Host + "." + domain,
+		done:         make(chan struct{}),
+	}
+	go r.serve()
+	go r.announce()
+	return r, nil
+}
+
+// Close withdraws the advertisement and stops answering queries
+func (r *Responder) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		close(r.done)
+		// a zero TTL tells peers to forget the records right away
+		r.send(r.response(nil, 0), groupAddr)
+		err = r.conn.Close()
+	})
+	return err
+}
+
+// announce sends unsolicited responses so peers that are already browsing see the service (RFC 6762 8.3)
+func (r *Responder) announce() {
+	for i := 0; i < 2; i++ {
+		r.send(r.response(nil, recordTTL), groupAddr)
+		select {
+		case <-r.done:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (r *Responder) serve() {
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-r.done:
+			default:
+				log.Printf("mDNS: read error: %v", err)
+			}
+			return
+		}
+		query, err := parse(buf[:n])
+		if err != nil || query.response {
+			continue
+		}
+
+		// queries from a port other than 5353 come from simple resolvers that expect a
+		// direct reply echoing the id and question
+		if src.Port != groupAddr.Port {
+			resp := r.response(query.questions, legacyTTL)
+			if len(resp.answers) > 0 {
+				resp.id = query.id
+				resp.questions = query.questions
+				r.send(resp, src)
+			}
+			continue
+		}
+		if resp := r.response(query.questions, recordTTL); len(resp.answers) > 0 {
+			r.send(resp, groupAddr)
+		}
+	}
+}
+
+// response answers questions, or announces every record when questions is nil
+func (r *Responder) response(questions []question, ttl uint32) *message {
+	ptr := record{name: serviceName, rtype: typePTR, class: classIN, ttl: ttl, target: r.instanceName}
+	srv := record{name: r.instanceName, rtype: typeSRV, class: classIN, ttl: ttl, target: r.hostName, port: uint16(r.service.Port)}
+	txt := record{name: r.instanceName, rtype: typeTXT, class: classIN, ttl: ttl}
+	for k, v := range r.service.Text {
+		txt.text = append(txt.text, k+"="+v)
+	}
+	var addrs []record
+	for _, ip := range r.service.Addrs {
+		addrs = append(addrs, record{name: r.hostName, rtype: typeA, class: classIN, ttl: ttl, ip: ip})
+	}
+	// records only we own replace whatever peers have cached, legacy replies must not set the bit
+	if ttl != legacyTTL {
+		srv.class |= classTopBit
+		txt.class |= classTopBit
+		for i := range addrs {
+			addrs[i].class |= classTopBit
+		}
+	}
+
+	resp := &message{response: true}
+	if questions == nil {
+		resp.answers = append([]record{ptr, srv, txt}, addrs...)
+		return resp
+	}
+	for _, q := range questions {
+		qtype := q.qtype
+		switch strings.ToLower(q.name) {
+		case strings.ToLower(serviceName):
+			if qtype == typePTR || qtype == typeANY {
+				resp.answers = append(resp.answers, ptr)
+				resp.additionals = append(append(resp.additionals, srv, txt), addrs...)
+			}
+		case strings.ToLower(r.instanceName):
+			if qtype == typeSRV || qtype == typeANY {
+				resp.answers = append(resp.answers, srv)
+				resp.additionals = append(resp.additionals, addrs...)
+			}
+			if qtype == typeTXT || qtype == typeANY {
+				resp.answers = append(resp.answers, txt)
+			}
+		case strings.ToLower(r.hostName):
+			if qtype == typeA || qtype == typeANY {
+				resp.answers = append(resp.answers, addrs...)
+			}
+		case servicesName:
+			if qtype == typePTR || qtype == typeANY {
+				resp.answers = append(resp.answers, record{name: servicesName, rtype: typePTR, class: classIN, ttl: ttl, target: serviceName})
+			}
+		}
+	}
+	return resp
+}
+
+func (r *Responder) send(m *message, to *net.UDPAddr) {
+	if _, err := r.conn.WriteToUDP(m.pack(), to); err != nil {
+		log.Printf("mDNS: send error: %v", err)
+	}
+}
+
+// LocalAddrs lists the IPv4 addresses of interfaces that are up and can multicast, loopback excluded
+func LocalAddrs() ([]net.IP, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 || iface.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+				ips = append(ips, ipNet.IP.To4())
+			}
+		}
+	}
+	return ips, nil
+}
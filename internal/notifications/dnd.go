@@ -0,0 +1,154 @@
+package notifications
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+	// schedules name IANA time zones, which must resolve on hosts without a zoneinfo database
+	_ "time/tzdata"
+)
+
+// MaxQuietWindows is how many do-not-disturb windows a schedule can have
+const MaxQuietWindows = 14
+
+// ErrInvalidDoNotDisturb is wrapped by the errors for schedules that can't be used
+var ErrInvalidDoNotDisturb = errors.New("invalid do-not-disturb schedule")
+
+// QuietWindow is a daily stretch of do-not-disturb in the schedule's time zone. One that ends
+// before it starts runs past midnight, into the next day; one that ends when it starts lasts
+// the whole day
+type QuietWindow struct {
+	Days  []time.Weekday `json:"days"`  // the days it starts on, 0 is Sunday; empty for every day
+	Start string         `json:"start"` // "22:00"
+	End   string         `json:"end"`   // "07:00"
+}
+
+// DoNotDisturb is when a user doesn't want to be notified. Messages are still delivered,
+// only notifications about them are held back
+type DoNotDisturb struct {
+	Timezone string        `json:"timezone"` // IANA name the windows are in, empty for UTC
+	Windows  []QuietWindow `json:"windows"`
+	// do-not-disturb until then whatever the windows say, e.g. for a meeting
+	Until *time.Time `json:"until,omitempty"`
+}
+
+// clock parses "HH:MM" into minutes since midnight
+func clock(s string) (int, bool) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, false
+	}
+	return t.Hour()*60 + t.Minute(), true
+}
+
+// Validate reports what is wrong with a schedule, wrapping ErrInvalidDoNotDisturb
+func (d DoNotDisturb) Validate() error {
+	if _, err := time.LoadLocation(d.Timezone); err != nil {
+		return fmt.Errorf("%w: unknown time zone %q", ErrInvalidDoNotDisturb, d.Timezone)
+	}
+	if len(d.Windows) > MaxQuietWindows {
+		return fmt.Errorf("%w: at most %d windows", ErrInvalidDoNotDisturb, MaxQuietWindows)
+	}
+	for _, w := range d.Windows {
+		_, okStart := clock(w.Start)
+		_, okEnd := clock(w.End)
+		if !okStart || !okEnd {
+			return fmt.Errorf("%w: start and end must be times like 22:00", ErrInvalidDoNotDisturb)
+		}
+		for _, day := range w.Days {
+			if day < time.Sunday || day > time.Saturday {
+				return fmt.Errorf("%w: days must be 0 (Sunday) to 6 (Saturday)", ErrInvalidDoNotDisturb)
+			}
+		}
+	}
+	return nil
+}
+
+// Active reports whether do-not-disturb is on at now
+func (d DoNotDisturb) Active(now time.Time) bool {
+	if d.Until != nil && now.Before(*d.Until) {
+		return true
+	}
+	loc, err := time.LoadLocation(d.Timezone)
+	if err != nil {
+		return false
+	}
+	local := now.In(loc)
+	minute := local.Hour()*60 + local.Minute()
+	today, yesterday := local.Weekday(), local.AddDate(0, 0, -1).Weekday()
+	for _, w := range d.Windows {
+		start, _ := clock(w.Start)
+		end, _ := clock(w.End)
+		switch {
+		case start == end:
+			if w.on(today) {
+				return true
+			}
+		case start < end:
+			if w.on(today) && minute >= start && minute < end {
+				return true
+			}
+		default:
+			// the part after midnight belongs to the day before
+			if (w.on(today) && minute >= start) || (w.on(yesterday) && minute < end) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// on reports whether the window starts on day
+func (w QuietWindow) on(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// DoNotDisturb returns a user's do-not-disturb schedule, empty if they never set one
+func (s *Storage) DoNotDisturb(username string) (DoNotDisturb, error) {
+	var raw string
+	err := s.db.QueryRow(`SELECT dnd FROM notification_preferences WHERE username = ?`, username).Scan(&raw)
+	if err == sql.ErrNoRows || (err == nil && raw == "") {
+		return DoNotDisturb{Windows: []QuietWindow{}}, nil
+	}
+	if err != nil {
+		return DoNotDisturb{}, err
+	}
+	var dnd DoNotDisturb
+	if err := json.Unmarshal([]byte(raw), &dnd); err != nil {
+		return DoNotDisturb{}, err
+	}
+	return dnd, nil
+}
+
+// SetDoNotDisturb replaces a user's do-not-disturb schedule, leaving their other preferences
+func (s *Storage) SetDoNotDisturb(username string, dnd DoNotDisturb) error {
+	if err := dnd.Validate(); err != nil {
+		return err
+	}
+	if dnd.Windows == nil {
+		dnd.Windows = []QuietWindow{}
+	}
+	for i := range dnd.Windows {
+		if dnd.Windows[i].Days == nil {
+			dnd.Windows[i].Days = []time.Weekday{}
+		}
+	}
+	raw, err := json.Marshal(dnd)
+	if err != nil {
+		return err
+	}
+	upsertSQL := `INSERT INTO notification_preferences (username, dnd) VALUES (?, ?)
+	ON CONFLICT (username) DO UPDATE SET dnd = excluded.dnd`
+	_, err = s.db.Exec(upsertSQL, username, string(raw))
+	return err
+}
@@ -0,0 +1,204 @@
+package notifications
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/dbutil"
+)
+
+// MaxDigestHours is the longest a user can ask to be offline before a digest is sent
+const MaxDigestHours = 7 * 24
+
+// MaxDigestSenders is how many direct message senders a digest names, for users who opted in
+const MaxDigestSenders = 3
+
+// ErrInvalidDigestHours is returned for digest delays outside 0 to MaxDigestHours
+var ErrInvalidDigestHours = fmt.Errorf("digestHours must be between 0 (off) and %d", MaxDigestHours)
+
+// ErrEmailNotVerified is returned when enabling digests for an account without a verified email address
+var ErrEmailNotVerified = errors.New("a verified email address is required")
+
+// Preferences are a user's notification settings
+type Preferences struct {
+	DigestHours int  `json:"digestHours"` // email a digest after this many hours offline, 0 disables digests
+	NameSenders bool `json:"nameSenders"` // name who direct messages are from in digests, contacts then show up in email
+}
+
+// Digest is a missed message summary due to be emailed
+type Digest struct {
+	Username      string
+	OfflineSince  time.Time
+	Conversations int      // direct conversations and rooms with new messages since OfflineSince
+	Senders       []string // latest direct message senders, up to MaxDigestSenders, when the user asked for names
+	MoreSenders   bool     // more people than Senders sent direct messages
+}
+
+// Storage keeps notification preferences in SQLite
+type Storage struct {
+	db *sql.DB
+}
+
+// NewStorage initializes the notification_preferences table on an open database
+func NewStorage(db *sql.DB) *Storage {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS notification_preferences (
+		"username" TEXT NOT NULL PRIMARY KEY,
+		"digest_hours" INTEGER NOT NULL DEFAULT 0,
+		"digest_sent_at" INTEGER NOT NULL DEFAULT 0);`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Fatalf("Failed to create notification_preferences table: %v", err)
+	}
+	if err := dbutil.AddColumnIfMissing(db, "notification_preferences", "name_senders", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		log.Fatalf("Failed to add name_senders column: %v", err)
+	}
+	if err := dbutil.AddColumnIfMissing(db, "notification_preferences", "dnd", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		log.Fatalf("Failed to add dnd column: %v", err)
+	}
+
+	return &Storage{db: db}
+}
+
+// Get returns a user's preferences, the defaults if they never changed them
+func (s *Storage) Get(username string) (Preferences, error) {
+	var prefs Preferences
+	querySQL := `SELECT digest_hours, name_senders FROM notification_preferences WHERE username = ?`
+	err := s.db.QueryRow(querySQL, username).Scan(&prefs.DigestHours, &prefs.NameSenders)
+	if err == sql.ErrNoRows {
+		return Preferences{}, nil
+	}
+	return prefs, err
+}
+
+// Set replaces a user's preferences. Digests can only be enabled with a verified email address
+func (s *Storage) Set(username string, prefs Preferences) error {
+	if prefs.DigestHours < 0 || prefs.DigestHours > MaxDigestHours {
+		return ErrInvalidDigestHours
+	}
+	if prefs.DigestHours > 0 {
+		var verified bool
+		err := s.db.QueryRow(`SELECT email_verified FROM users WHERE username = ? AND email IS NOT NULL`, username).Scan(&verified)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if !verified {
+			return ErrEmailNotVerified
+		}
+	}
+
+	upsertSQL := `INSERT INTO notification_preferences (username, digest_hours, name_senders) VALUES (?, ?, ?)
+	ON CONFLICT (username) DO UPDATE SET digest_hours = excluded.digest_hours, name_senders = excluded.name_senders`
+	_, err := s.db.Exec(upsertSQL, username, prefs.DigestHours, prefs.NameSenders)
+	return err
+}
+
+// DueDigests finds users who opted in, have a verified email address, have been offline for at
+// least their digest delay, haven't had a digest for this offline period or within minGap, and
+// missed messages. minGap keeps someone who drops off often from getting a digest each time.
+// Someone is offline when their latest connection event is a disconnect, so a user whose
+// connection was cut by a crash counts as online until they connect again
+func (s *Storage) DueDigests(now time.Time, minGap time.Duration) ([]Digest, error) {
+	querySQL := `
+	SELECT p.username, p.digest_hours, p.name_senders, p.digest_sent_at, e.event, e.created_at
+	FROM notification_preferences p
+	JOIN users u ON u.username = p.username
+	JOIN connection_events e ON e.id = (
+		SELECT id FROM connection_events
+		WHERE username = p.username AND event IN ('connect', 'disconnect')
+		ORDER BY id DESC LIMIT 1)
+	WHERE p.digest_hours > 0 AND u.email IS NOT NULL AND u.email_verified = 1`
+	rows, err := s.db.Query(querySQL)
+	if err != nil {
+		return nil, err
+	}
+	type candidate struct {
+		Digest
+		nameSenders bool
+	}
+	var candidates []candidate
+	for rows.Next() {
+		var d candidate
+		var hours int
+		var sentAt, eventAt int64
+		var event string
+		if err := rows.Scan(&d.Username, &hours, &d.nameSenders, &sentAt, &event, &eventAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if event != "disconnect" || sentAt >= eventAt || now.Sub(time.UnixMilli(eventAt)) < time.Duration(hours)*time.Hour {
+			continue
+		}
+		if sentAt > 0 && now.Sub(time.UnixMilli(sentAt)) < minGap {
+			continue
+		}
+		d.OfflineSince = time.UnixMilli(eventAt)
+		candidates = append(candidates, d)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// counted separately so the candidate rows aren't held open during the counts
+	due := []Digest{}
+	for _, d := range candidates {
+		countSQL := `
+		SELECT (SELECT COUNT(DISTINCT sender) FROM messages WHERE recipient = ?1 AND created_at > ?2) +
+			(SELECT COUNT(DISTINCT m.room_id) FROM room_messages m
+			JOIN room_members r ON r.room_id = m.room_id AND r.username = ?1
+			WHERE m.created_at > ?2 AND m.sender != ?1)`
+		if err := s.db.QueryRow(countSQL, d.Username, d.OfflineSince.UnixMilli()).Scan(&d.Conversations); err != nil {
+			return nil, err
+		}
+		if d.Conversations == 0 {
+			continue
+		}
+		if d.nameSenders {
+			senders, err := s.latestSenders(d.Username, d.OfflineSince)
+			if err != nil {
+				return nil, err
+			}
+			if len(senders) > MaxDigestSenders {
+				senders, d.MoreSenders = senders[:MaxDigestSenders], true
+			}
+			d.Senders = senders
+		}
+		due = append(due, d.Digest)
+	}
+	return due, nil
+}
+
+// latestSenders lists up to MaxDigestSenders+1 people who sent username direct messages since,
+// most recent first, the extra one tells whether there are more
+func (s *Storage) latestSenders(username string, since time.Time) ([]string, error) {
+	querySQL := `SELECT sender FROM messages WHERE recipient = ? AND created_at > ?
+	GROUP BY sender ORDER BY MAX(created_at) DESC LIMIT ?`
+	rows, err := s.db.Query(querySQL, username, since.UnixMilli(), MaxDigestSenders+1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	senders := []string{}
+	for rows.Next() {
+		var sender string
+		if err := rows.Scan(&sender); err != nil {
+			return nil, err
+		}
+		senders = append(senders, sender)
+	}
+	return senders, rows.Err()
+}
+
+// MarkDigestSent records that the digest for the current offline period went out. Anything else
+// that tells a user about missed messages, such as push notifications, should mark it too so the
+// same offline period isn't announced twice
+func (s *Storage) MarkDigestSent(username string, at time.Time) error {
+	_, err := s.db.Exec(`UPDATE notification_preferences SET digest_sent_at = ? WHERE username = ?`, at.UnixMilli(), username)
+	return err
+}
@@ -0,0 +1,222 @@
+// Package onboarding greets new users. On an account's first login the server renders a
+// welcome message from a template admins set, keeps it for the account and adds the account
+// to the rooms admins chose
+package onboarding
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+)
+
+// MaxMessageLength is the longest welcome template and rendered message, in characters
+const MaxMessageLength = 4000
+
+// MaxRooms is how many rooms new users may be added to
+const MaxRooms = 20
+
+// errors returned by Storage
+var (
+	ErrInvalidTemplate = errors.New("invalid welcome template")
+	ErrMessageTooLong  = fmt.Errorf("welcome messages must be at most %d characters", MaxMessageLength)
+	ErrTooManyRooms    = fmt.Errorf("new users can be added to at most %d rooms", MaxRooms)
+)
+
+// Settings is what new users get on their first login
+type Settings struct {
+	Enabled   bool       `json:"enabled"`
+	Message   string     `json:"message"` // a text/template over Data, empty sends none
+	Rooms     []string   `json:"rooms"`   // ids of the rooms new users are added to
+	UpdatedBy string     `json:"updatedBy,omitempty"`
+	UpdatedAt *time.Time `json:"updatedAt,omitempty"`
+}
+
+// Data is what a welcome template can refer to, e.g. "Hi {{.Username}}"
+type Data struct {
+	Username  string
+	Workspace string   // empty for the main workspace
+	Rooms     []string // names of the rooms the user was added to
+}
+
+// Welcome is the message a user got on their first login
+type Welcome struct {
+	Body      string    `json:"body"`
+	Rooms     []string  `json:"rooms"` // ids of the rooms the user was added to
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Storage keeps the onboarding settings and who has been onboarded in SQLite
+type Storage struct {
+	db       *sql.DB
+	defaults Settings
+}
+
+// NewStorage initializes the onboarding tables on an open database. defaults apply until an
+// admin changes the settings. Accounts registered before the tables existed count as
+// onboarded, so they aren't greeted on their next login
+func NewStorage(db *sql.DB, defaults Settings) *Storage {
+	var exists bool
+	if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'onboarded_users')`).Scan(&exists); err != nil {
+		log.Fatalf("Failed to look for the onboarding tables: %v", err)
+	}
+
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS onboarding_settings (
+		"id" INTEGER NOT NULL PRIMARY KEY CHECK (id = 1),
+		"enabled" INTEGER NOT NULL,
+		"message" TEXT NOT NULL,
+		"rooms" TEXT NOT NULL,
+		"updated_by" TEXT NOT NULL,
+		"updated_at" INTEGER NOT NULL);
+	CREATE TABLE IF NOT EXISTS onboarded_users (
+		"username" TEXT NOT NULL PRIMARY KEY,
+		"body" TEXT NOT NULL DEFAULT '',
+		"rooms" TEXT NOT NULL DEFAULT '[]',
+		"created_at" INTEGER NOT NULL);`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Fatalf("Failed to create onboarding tables: %v", err)
+	}
+	if !exists {
+		if _, err := db.Exec(`INSERT OR IGNORE INTO onboarded_users (username, created_at) SELECT username, ? FROM users`, time.Now().UnixMilli()); err != nil {
+			log.Fatalf("Failed to mark existing accounts as onboarded: %v", err)
+		}
+	}
+	if defaults.Rooms == nil {
+		defaults.Rooms = []string{}
+	}
+	return &Storage{db: db, defaults: defaults}
+}
+
+// Check reports what is wrong with settings: a template that doesn't parse or render, or too
+// many rooms
+func Check(settings Settings) error {
+	if utf8.RuneCountInString(settings.Message) > MaxMessageLength {
+		return ErrMessageTooLong
+	}
+	if len(settings.Rooms) > MaxRooms {
+		return ErrTooManyRooms
+	}
+	_, err := Render(settings.Message, Data{Username: "alice", Workspace: "example", Rooms: []string{"General"}})
+	return err
+}
+
+// Render fills in a welcome template
+func Render(message string, data Data) (string, error) {
+	tmpl, err := template.New("welcome").Option("missingkey=error").Parse(message)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidTemplate, err)
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidTemplate, err)
+	}
+	if utf8.RuneCountInString(b.String()) > MaxMessageLength {
+		return "", ErrMessageTooLong
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// Settings returns the settings admins made, or the defaults
+func (s *Storage) Settings() (Settings, error) {
+	var settings Settings
+	var rooms string
+	var updatedAt int64
+	err := s.db.QueryRow(`SELECT enabled, message, rooms, updated_by, updated_at FROM onboarding_settings WHERE id = 1`).
+		Scan(&settings.Enabled, &settings.Message, &rooms, &settings.UpdatedBy, &updatedAt)
+	if err == sql.ErrNoRows {
+		return s.defaults, nil
+	}
+	if err != nil {
+		return Settings{}, err
+	}
+	if err := json.Unmarshal([]byte(rooms), &settings.Rooms); err != nil {
+		return Settings{}, err
+	}
+	at := time.UnixMilli(updatedAt)
+	settings.UpdatedAt = &at
+	return settings, nil
+}
+
+// SetSettings replaces the settings, checked with Check
+func (s *Storage) SetSettings(settings Settings, admin string) (Settings, error) {
+	if settings.Rooms == nil {
+		settings.Rooms = []string{}
+	}
+	if err := Check(settings); err != nil {
+		return Settings{}, err
+	}
+	rooms, err := json.Marshal(settings.Rooms)
+	if err != nil {
+		return Settings{}, err
+	}
+	_, err = s.db.Exec(`
+		INSERT INTO onboarding_settings (id, enabled, message, rooms, updated_by, updated_at) VALUES (1, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET enabled = excluded.enabled, message = excluded.message, rooms = excluded.rooms,
+			updated_by = excluded.updated_by, updated_at = excluded.updated_at`,
+		settings.Enabled, settings.Message, string(rooms), admin, time.Now().UnixMilli())
+	if err != nil {
+		return Settings{}, err
+	}
+	return s.Settings()
+}
+
+// ResetSettings goes back to the defaults
+func (s *Storage) ResetSettings() (Settings, error) {
+	if _, err := s.db.Exec(`DELETE FROM onboarding_settings`); err != nil {
+		return Settings{}, err
+	}
+	return s.defaults, nil
+}
+
+// Claim marks username as onboarded, true the first time only, so a welcome is sent once
+// however many logins race
+func (s *Storage) Claim(username string) (bool, error) {
+	result, err := s.db.Exec(`INSERT OR IGNORE INTO onboarded_users (username, created_at) VALUES (?, ?)`,
+		username, time.Now().UnixMilli())
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// Save keeps the welcome a user got
+func (s *Storage) Save(username string, welcome *Welcome) error {
+	rooms, err := json.Marshal(welcome.Rooms)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`UPDATE onboarded_users SET body = ?, rooms = ?, created_at = ? WHERE username = ?`,
+		welcome.Body, string(rooms), welcome.CreatedAt.UnixMilli(), username)
+	return err
+}
+
+// Welcome returns the welcome username got, nil if they got none
+func (s *Storage) Welcome(username string) (*Welcome, error) {
+	var w Welcome
+	var rooms string
+	var createdAt int64
+	err := s.db.QueryRow(`SELECT body, rooms, created_at FROM onboarded_users WHERE username = ?`, username).
+		Scan(&w.Body, &rooms, &createdAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(rooms), &w.Rooms); err != nil {
+		return nil, err
+	}
+	if w.Body == "" && len(w.Rooms) == 0 {
+		return nil, nil
+	}
+	w.CreatedAt = time.UnixMilli(createdAt)
+	return &w, nil
+}
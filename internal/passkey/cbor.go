@@ -0,0 +1,130 @@
+package passkey
+
+import (
+	"errors"
+	"math"
+)
+
+// maxCBORDepth bounds nesting, authenticator data never goes deeper than a few levels
+const maxCBORDepth = 16
+
+var errCBOR = errors.New("malformed CBOR")
+
+// decodeCBOR reads one CBOR data item from data and returns it with the bytes after it. It covers
+// what authenticators send: integers (int64), byte strings ([]byte), text (string), arrays
+// ([]interface{}), maps (map[interface{}]interface{}) and simple values. Indefinite lengths,
+// which authenticators don't use, are rejected. Tags are dropped in favor of their content
+func decodeCBOR(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > maxCBORDepth || len(data) == 0 {
+		return nil, nil, errCBOR
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(data) < size {
+			return nil, nil, errCBOR
+		}
+		for _, b := range data[:size] {
+			arg = arg<<8 | uint64(b)
+		}
+		data = data[size:]
+	default:
+		return nil, nil, errCBOR
+	}
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, nil, errCBOR
+		}
+		return int64(arg), data, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, errCBOR
+		}
+		return -1 - int64(arg), data, nil
+	case 2, 3:
+		if arg > uint64(len(data)) {
+			return nil, nil, errCBOR
+		}
+		if major == 3 {
+			return string(data[:arg]), data[arg:], nil
+		}
+		return append([]byte(nil), data[:arg]...), data[arg:], nil
+	case 4:
+		// each item takes at least a byte, so a longer count can't be honest
+		if arg > uint64(len(data)) {
+			return nil, nil, errCBOR
+		}
+		items := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			var item interface{}
+			var err error
+			if item, data, err = decodeCBOR(data, depth+1); err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, data, nil
+	case 5:
+		if arg > uint64(len(data))/2 {
+			return nil, nil, errCBOR
+		}
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			var key, value interface{}
+			var err error
+			if key, data, err = decodeCBOR(data, depth+1); err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errCBOR
+			}
+			if value, data, err = decodeCBOR(data, depth+1); err != nil {
+				return nil, nil, err
+			}
+			m[key] = value
+		}
+		return m, data, nil
+	case 6:
+		return decodeCBOR(data, depth+1)
+	default:
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22, 23:
+			return nil, data, nil
+		case 25:
+			// half precision floats aren't needed for anything read here
+			return nil, data, nil
+		case 26:
+			return float64(math.Float32frombits(uint32(arg))), data, nil
+		case 27:
+			return math.Float64frombits(arg), data, nil
+		}
+		return nil, nil, errCBOR
+	}
+}
+
+// cborMap decodes data as a single CBOR map, returning the bytes after it
+func cborMap(data []byte) (map[interface{}]interface{}, []byte, error) {
+	item, rest, err := decodeCBOR(data, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	m, ok := item.(map[interface{}]interface{})
+	if !ok {
+		return nil, nil, errCBOR
+	}
+	return m, rest, nil
+}
@@ -0,0 +1,299 @@
+// Package passkey stores users' WebAuthn credentials and runs the registration and login
+// ceremonies for them. Passkeys sign in without a password, or confirm a password login for
+// users who require them as a second factor
+package passkey
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// ChallengeTimeout is how long a ceremony's challenge can be answered
+const ChallengeTimeout = 5 * time.Minute
+
+// MaxPasskeys is how many passkeys one user can register
+const MaxPasskeys = 20
+
+// MaxNameLength is the longest label a passkey can have, in characters
+const MaxNameLength = 64
+
+// ceremony kinds
+const (
+	Register     = "register"
+	Login        = "login"         // passwordless, anyone's passkey may answer
+	SecondFactor = "second_factor" // after a password, only the user's passkeys may answer
+)
+
+var (
+	ErrNotFound          = errors.New("passkey not found")
+	ErrChallengeExpired  = errors.New("passkey challenge expired or already used")
+	ErrTooManyPasskeys   = errors.New("too many passkeys")
+	ErrAlreadyRegistered = errors.New("passkey already registered")
+	ErrNoPasskeys        = errors.New("register a passkey before requiring one")
+	ErrRequired          = errors.New("passkeys are required for this account, keep at least one")
+)
+
+// Credential is a registered passkey
+type Credential struct {
+	ID         Base64URL  `json:"id"`
+	Username   string     `json:"-"`
+	Name       string     `json:"name"`
+	PublicKey  []byte     `json:"-"` // COSE key
+	SignCount  uint32     `json:"-"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+// Challenge is a ceremony waiting for the authenticator's answer
+type Challenge struct {
+	Kind      string
+	Username  string // empty for passwordless logins
+	RPID      string // the domain the ceremony runs for
+	Challenge []byte
+	ExpiresAt time.Time
+}
+
+// Storage keeps passkeys in SQLite and open challenges in memory, so a ceremony has to finish
+// on the server that started it
+type Storage struct {
+	db *sql.DB
+
+	mu         sync.Mutex
+	challenges map[string]*Challenge
+}
+
+// NewStorage initializes the passkey tables on an open database
+func NewStorage(db *sql.DB) *Storage {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS passkeys (
+		"id" TEXT NOT NULL PRIMARY KEY,
+		"username" TEXT NOT NULL,
+		"name" TEXT NOT NULL,
+		"public_key" BLOB NOT NULL,
+		"sign_count" INTEGER NOT NULL DEFAULT 0,
+		"created_at" INTEGER NOT NULL,
+		"last_used_at" INTEGER NOT NULL DEFAULT 0);
+	CREATE INDEX IF NOT EXISTS passkeys_username ON passkeys (username);
+	CREATE TABLE IF NOT EXISTS passkey_users (
+		"username" TEXT NOT NULL PRIMARY KEY,
+		"handle" BLOB NOT NULL,
+		"required" INTEGER NOT NULL DEFAULT 0);`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Fatalf("Failed to create passkey tables: %v", err)
+	}
+	return &Storage{db: db, challenges: make(map[string]*Challenge)}
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// Begin opens a ceremony for the relying party rpID and returns its id with the challenge to
+// send the authenticator
+func (s *Storage) Begin(kind, username, rpID string) (string, *Challenge) {
+	id := base64.RawURLEncoding.EncodeToString(randomBytes(16))
+	c := &Challenge{
+		Kind:      kind,
+		Username:  username,
+		RPID:      rpID,
+		Challenge: randomBytes(32),
+		ExpiresAt: time.Now().Add(ChallengeTimeout),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for key, old := range s.challenges {
+		if now.After(old.ExpiresAt) {
+			delete(s.challenges, key)
+		}
+	}
+	s.challenges[id] = c
+	return id, c
+}
+
+// Take ends a ceremony, returning its challenge. Each challenge can be answered once
+func (s *Storage) Take(id string) (*Challenge, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.challenges[id]
+	if !ok {
+		return nil, ErrChallengeExpired
+	}
+	delete(s.challenges, id)
+	if time.Now().After(c.ExpiresAt) {
+		return nil, ErrChallengeExpired
+	}
+	return c, nil
+}
+
+// UserHandle returns the random id authenticators store for username, creating it on first use.
+// It stays the same across renames, unlike the name
+func (s *Storage) UserHandle(username string) ([]byte, error) {
+	_, err := s.db.Exec(`INSERT INTO passkey_users (username, handle) VALUES (?, ?) ON CONFLICT (username) DO NOTHING`,
+		username, randomBytes(16))
+	if err != nil {
+		return nil, err
+	}
+	var handle []byte
+	err = s.db.QueryRow(`SELECT handle FROM passkey_users WHERE username = ?`, username).Scan(&handle)
+	return handle, err
+}
+
+// Add stores a newly registered passkey
+func (s *Storage) Add(cred *Credential) error {
+	cred.Name = strings.TrimSpace(cred.Name)
+	if cred.Name == "" {
+		cred.Name = "Passkey"
+	}
+	if utf8.RuneCountInString(cred.Name) > MaxNameLength {
+		cred.Name = string([]rune(cred.Name)[:MaxNameLength])
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var count int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM passkeys WHERE username = ?`, cred.Username).Scan(&count); err != nil {
+		return err
+	}
+	if count >= MaxPasskeys {
+		return ErrTooManyPasskeys
+	}
+	var exists bool
+	id := base64.RawURLEncoding.EncodeToString(cred.ID)
+	if err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM passkeys WHERE id = ?)`, id).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return ErrAlreadyRegistered
+	}
+	cred.CreatedAt = time.Unix(time.Now().Unix(), 0)
+	insertSQL := `INSERT INTO passkeys (id, username, name, public_key, sign_count, created_at) VALUES (?, ?, ?, ?, ?, ?)`
+	if _, err := tx.Exec(insertSQL, id, cred.Username, cred.Name, cred.PublicKey, cred.SignCount, cred.CreatedAt.Unix()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const credentialColumns = `id, username, name, public_key, sign_count, created_at, last_used_at`
+
+func scanCredential(scan func(...interface{}) error) (*Credential, error) {
+	var c Credential
+	var id string
+	var createdAt, lastUsedAt int64
+	if err := scan(&id, &c.Username, &c.Name, &c.PublicKey, &c.SignCount, &createdAt, &lastUsedAt); err != nil {
+		return nil, err
+	}
+	c.ID, _ = base64.RawURLEncoding.DecodeString(id)
+	c.CreatedAt = time.Unix(createdAt, 0)
+	if lastUsedAt != 0 {
+		t := time.Unix(lastUsedAt, 0)
+		c.LastUsedAt = &t
+	}
+	return &c, nil
+}
+
+// Get returns the passkey with credential id
+func (s *Storage) Get(id []byte) (*Credential, error) {
+	row := s.db.QueryRow(`SELECT `+credentialColumns+` FROM passkeys WHERE id = ?`, base64.RawURLEncoding.EncodeToString(id))
+	c, err := scanCredential(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return c, err
+}
+
+// List returns username's passkeys, oldest first
+func (s *Storage) List(username string) ([]*Credential, error) {
+	rows, err := s.db.Query(`SELECT `+credentialColumns+` FROM passkeys WHERE username = ? ORDER BY created_at, id`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	creds := []*Credential{}
+	for rows.Next() {
+		c, err := scanCredential(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		creds = append(creds, c)
+	}
+	return creds, rows.Err()
+}
+
+// Used records a successful login with a passkey and its authenticator's new counter
+func (s *Storage) Used(id []byte, signCount uint32) error {
+	_, err := s.db.Exec(`UPDATE passkeys SET sign_count = ?, last_used_at = ? WHERE id = ?`,
+		signCount, time.Now().Unix(), base64.RawURLEncoding.EncodeToString(id))
+	return err
+}
+
+// Delete removes one of username's passkeys. The last one can't go while passkeys are required
+func (s *Storage) Delete(username string, id []byte) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM passkeys WHERE username = ? AND id = ?`, username, base64.RawURLEncoding.EncodeToString(id))
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	var required, left bool
+	checkSQL := `SELECT EXISTS(SELECT 1 FROM passkey_users WHERE username = ? AND required = 1),
+	EXISTS(SELECT 1 FROM passkeys WHERE username = ?)`
+	if err := tx.QueryRow(checkSQL, username, username).Scan(&required, &left); err != nil {
+		return err
+	}
+	if required && !left {
+		return ErrRequired
+	}
+	return tx.Commit()
+}
+
+// Required reports whether username's password logins must be confirmed with a passkey
+func (s *Storage) Required(username string) (bool, error) {
+	var required bool
+	err := s.db.QueryRow(`SELECT required FROM passkey_users WHERE username = ?`, username).Scan(&required)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return required, err
+}
+
+// SetRequired turns the second factor requirement on or off, turning it on takes a passkey
+func (s *Storage) SetRequired(username string, required bool) error {
+	if required {
+		var exists bool
+		if err := s.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM passkeys WHERE username = ?)`, username).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return ErrNoPasskeys
+		}
+	}
+	// a registered passkey means the row exists
+	_, err := s.db.Exec(`UPDATE passkey_users SET required = ? WHERE username = ?`, required, username)
+	return err
+}
@@ -0,0 +1,286 @@
+package passkey
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+)
+
+// COSE algorithms accepted for passkeys, in order of preference
+const (
+	AlgES256 = -7
+	AlgEdDSA = -8
+	AlgRS256 = -257
+)
+
+// Algorithms lists the COSE algorithms offered when registering a passkey
+var Algorithms = []int{AlgES256, AlgEdDSA, AlgRS256}
+
+// authenticator data flags
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40
+)
+
+// ErrInvalidResponse wraps every reason an authenticator response is refused
+var ErrInvalidResponse = errors.New("invalid passkey response")
+
+func invalid(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidResponse, fmt.Sprintf(format, args...))
+}
+
+// Base64URL is binary data in WebAuthn's JSON encoding, unpadded base64url. Standard and
+// padded base64 are accepted when reading
+type Base64URL []byte
+
+func (b Base64URL) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *Base64URL) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	s = strings.TrimRight(strings.NewReplacer("+", "-", "/", "_").Replace(s), "=")
+	decoded, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
+
+// RelyingParty is the server as WebAuthn sees it. Passkeys are scoped to ID, a domain
+type RelyingParty struct {
+	ID      string
+	Name    string
+	Origins []string // origins allowed besides https pages on ID and its subdomains
+}
+
+// checkOrigin reports whether a ceremony may come from origin: a listed origin, an https page on
+// the relying party's domain or below it, or http on localhost for development
+func (rp RelyingParty) checkOrigin(origin string) bool {
+	for _, allowed := range rp.Origins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	if host != rp.ID && !strings.HasSuffix(host, "."+rp.ID) {
+		return false
+	}
+	return u.Scheme == "https" || (u.Scheme == "http" && rp.ID == "localhost")
+}
+
+// clientData is the part of clientDataJSON that is checked
+type clientData struct {
+	Type      string    `json:"type"`
+	Challenge Base64URL `json:"challenge"`
+	Origin    string    `json:"origin"`
+}
+
+func (rp RelyingParty) checkClientData(raw []byte, ceremony string, challenge []byte) error {
+	var cd clientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return invalid("unreadable client data")
+	}
+	if cd.Type != ceremony {
+		return invalid("client data type is %q, expected %q", cd.Type, ceremony)
+	}
+	if subtle.ConstantTimeCompare(cd.Challenge, challenge) != 1 {
+		return invalid("challenge mismatch")
+	}
+	if !rp.checkOrigin(cd.Origin) {
+		return invalid("origin %q is not allowed", cd.Origin)
+	}
+	return nil
+}
+
+// authData is parsed authenticator data
+type authData struct {
+	rpIDHash     []byte
+	flags        byte
+	signCount    uint32
+	credentialID []byte // only in registrations
+	publicKey    []byte // COSE key, only in registrations
+}
+
+func parseAuthData(data []byte) (*authData, error) {
+	if len(data) < 37 {
+		return nil, invalid("authenticator data too short")
+	}
+	ad := &authData{rpIDHash: data[:32], flags: data[32], signCount: binary.BigEndian.Uint32(data[33:37])}
+	if ad.flags&flagAttested == 0 {
+		return ad, nil
+	}
+	rest := data[37:]
+	// 16 byte AAGUID, then a two byte length and the credential id
+	if len(rest) < 18 {
+		return nil, invalid("attested credential data too short")
+	}
+	n := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if n == 0 || n > 1023 || len(rest) < n {
+		return nil, invalid("bad credential id length")
+	}
+	ad.credentialID = rest[:n]
+	_, after, err := cborMap(rest[n:])
+	if err != nil {
+		return nil, invalid("unreadable credential public key")
+	}
+	ad.publicKey = rest[n : len(rest)-len(after)]
+	return ad, nil
+}
+
+func (rp RelyingParty) checkAuthData(ad *authData, requireUV bool) error {
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(ad.rpIDHash, rpIDHash[:]) {
+		return invalid("passkey is for another site")
+	}
+	if ad.flags&flagUserPresent == 0 {
+		return invalid("user not present")
+	}
+	if requireUV && ad.flags&flagUserVerified == 0 {
+		return invalid("user not verified")
+	}
+	return nil
+}
+
+// AttestationResponse is the response of navigator.credentials.create()
+type AttestationResponse struct {
+	ClientDataJSON    Base64URL `json:"clientDataJSON"`
+	AttestationObject Base64URL `json:"attestationObject"`
+}
+
+// VerifyRegistration checks a new passkey's response to challenge and returns its credential id
+// and COSE public key. Attestation statements are not checked, registrations ask for none
+func (rp RelyingParty) VerifyRegistration(challenge []byte, resp AttestationResponse) (id, publicKey []byte, err error) {
+	if err := rp.checkClientData(resp.ClientDataJSON, "webauthn.create", challenge); err != nil {
+		return nil, nil, err
+	}
+	obj, _, err := cborMap(resp.AttestationObject)
+	if err != nil {
+		return nil, nil, invalid("unreadable attestation object")
+	}
+	raw, ok := obj["authData"].([]byte)
+	if !ok {
+		return nil, nil, invalid("attestation object has no authenticator data")
+	}
+	ad, err := parseAuthData(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := rp.checkAuthData(ad, false); err != nil {
+		return nil, nil, err
+	}
+	if ad.credentialID == nil {
+		return nil, nil, invalid("no credential in authenticator data")
+	}
+	// make sure the key is one we can verify with later
+	if _, err := verifier(ad.publicKey); err != nil {
+		return nil, nil, err
+	}
+	return ad.credentialID, ad.publicKey, nil
+}
+
+// AssertionResponse is the response of navigator.credentials.get()
+type AssertionResponse struct {
+	ClientDataJSON    Base64URL `json:"clientDataJSON"`
+	AuthenticatorData Base64URL `json:"authenticatorData"`
+	Signature         Base64URL `json:"signature"`
+	UserHandle        Base64URL `json:"userHandle,omitempty"`
+}
+
+// VerifyAssertion checks a passkey's signature over challenge and returns the authenticator's
+// new signature counter. requireUV demands the user was verified (PIN or biometrics), not only
+// present, which a passkey standing in for a password needs
+func (rp RelyingParty) VerifyAssertion(challenge []byte, cred *Credential, resp AssertionResponse, requireUV bool) (uint32, error) {
+	if err := rp.checkClientData(resp.ClientDataJSON, "webauthn.get", challenge); err != nil {
+		return 0, err
+	}
+	ad, err := parseAuthData(resp.AuthenticatorData)
+	if err != nil {
+		return 0, err
+	}
+	if err := rp.checkAuthData(ad, requireUV); err != nil {
+		return 0, err
+	}
+	verify, err := verifier(cred.PublicKey)
+	if err != nil {
+		return 0, err
+	}
+	clientDataHash := sha256.Sum256(resp.ClientDataJSON)
+	signed := append(append([]byte(nil), resp.AuthenticatorData...), clientDataHash[:]...)
+	if !verify(signed, resp.Signature) {
+		return 0, invalid("bad signature")
+	}
+	// counters only move forward, one that doesn't suggests a cloned authenticator. Passkeys
+	// synced between devices report 0 throughout
+	if (ad.signCount != 0 || cred.SignCount != 0) && ad.signCount <= cred.SignCount {
+		return 0, invalid("signature counter went backwards")
+	}
+	return ad.signCount, nil
+}
+
+// verifier parses a COSE public key into a function checking signatures made with it
+func verifier(coseKey []byte) (func(data, sig []byte) bool, error) {
+	key, _, err := cborMap(coseKey)
+	if err != nil {
+		return nil, invalid("unreadable public key")
+	}
+	alg, _ := key[int64(3)].(int64)
+	switch alg {
+	case AlgES256:
+		x, _ := key[int64(-2)].([]byte)
+		y, _ := key[int64(-3)].([]byte)
+		if crv, _ := key[int64(-1)].(int64); crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, invalid("bad P-256 key")
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, invalid("bad P-256 key")
+		}
+		return func(data, sig []byte) bool {
+			digest := sha256.Sum256(data)
+			return ecdsa.VerifyASN1(pub, digest[:], sig)
+		}, nil
+	case AlgEdDSA:
+		x, _ := key[int64(-2)].([]byte)
+		if crv, _ := key[int64(-1)].(int64); crv != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, invalid("bad Ed25519 key")
+		}
+		pub := ed25519.PublicKey(x)
+		return func(data, sig []byte) bool { return ed25519.Verify(pub, data, sig) }, nil
+	case AlgRS256:
+		n, _ := key[int64(-1)].([]byte)
+		e, _ := key[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, invalid("bad RSA key")
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		return func(data, sig []byte) bool {
+			digest := sha256.Sum256(data)
+			return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) == nil
+		}, nil
+	}
+	return nil, invalid("unsupported algorithm %d", alg)
+}
@@ -0,0 +1,300 @@
+package preview
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
+)
+
+// Preview is the sanitized Open Graph metadata of a page
+type Preview struct {
+	URL         string `json:"url"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Image       string `json:"image,omitempty"`
+	SiteName    string `json:"siteName,omitempty"`
+}
+
+// ErrBlockedAddress is returned for URLs resolving to private or local addresses
+var ErrBlockedAddress = errors.New("destination address not allowed")
+
+// field length limits after sanitizing
+const (
+	maxTitle       = 200
+	maxDescription = 500
+	maxURL         = 2048
+)
+
+// Fetcher fetches link previews on behalf of clients
+type Fetcher struct {
+	client   *http.Client
+	maxBytes int64
+	ttl      time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	preview *Preview
+	err     error
+	expires time.Time
+}
+
+// maxCacheEntries bounds memory used by cached previews
+const maxCacheEntries = 1000
+
+// NewFetcher creates a fetcher that reads at most maxBytes of each page and caches results for ttl.
+// With a proxy every page is fetched through it and the proxy resolves host names, so
+// the address check only sees literal IPs and blocking private destinations is up to the proxy
+// (tor exits refuse them by default)
+func NewFetcher(timeout time.Duration, maxBytes int64, ttl time.Duration, proxy *url.URL) *Fetcher {
+	transport := PublicTransport(proxy, timeout)
+	transport.ResponseHeaderTimeout = timeout
+	transport.IdleConnTimeout = 30 * time.Second
+	return &Fetcher{
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   timeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= 3 {
+					return errors.New("too many redirects")
+				}
+				return checkURL(req.URL)
+			},
+		},
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		cache:    make(map[string]cacheEntry),
+	}
+}
+
+// PublicTransport returns a transport that only connects to public addresses, giving up on
+// dials and TLS handshakes after timeout. Addresses are checked after DNS resolution so
+// rebinding tricks can't reach internal hosts, connections to others fail with
+// ErrBlockedAddress. With a proxy the proxy is the only thing dialed and it resolves host
+// names, so keeping requests off private destinations is up to it and the caller's URL checks
+func PublicTransport(proxy *url.URL, timeout time.Duration) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !IsPublic(ip) {
+				return ErrBlockedAddress
+			}
+			return nil
+		},
+	}
+	if proxy != nil {
+		dialer.Control = nil
+	}
+	return &http.Transport{
+		DialContext:         dialer.DialContext,
+		Proxy:               http.ProxyURL(proxy),
+		TLSHandshakeTimeout: timeout,
+		MaxIdleConns:        10,
+	}
+}
+
+// Fetch returns the preview for rawURL, from cache when possible
+func (f *Fetcher) Fetch(ctx context.Context, rawURL string) (*Preview, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || len(rawURL) > maxURL {
+		return nil, errors.New("invalid url")
+	}
+	if err := checkURL(u); err != nil {
+		return nil, err
+	}
+	u.Fragment = ""
+	key := u.String()
+
+	f.mu.Lock()
+	entry, ok := f.cache[key]
+	f.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.preview, entry.err
+	}
+
+	preview, err := f.fetch(ctx, u)
+	// failures are cached too so a bad link can't be used to hammer a site
+	f.store(key, cacheEntry{preview: preview, err: err, expires: time.Now().Add(f.ttl)})
+	return preview, err
+}
+
+func (f *Fetcher) store(key string, entry cacheEntry) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.cache) >= maxCacheEntries {
+		now := time.Now()
+		for k, e := range f.cache {
+			if now.After(e.expires) {
+				delete(f.cache, k)
+			}
+		}
+		// still full, evict an arbitrary entry
+		for k := range f.cache {
+			if len(f.cache) < maxCacheEntries {
+				break
+			}
+			delete(f.cache, k)
+		}
+	}
+	f.cache[key] = entry
+}
+
+func (f *Fetcher) fetch(ctx context.Context, u *url.URL) (*Preview, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "MeadowlarkPreview/1.0")
+	req.Header.Set("Accept", "text/html")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		// don't echo resolved addresses back to the client
+		if errors.Is(err, ErrBlockedAddress) {
+			return nil, ErrBlockedAddress
+		}
+		return nil, errors.New("fetch failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch failed: %s", resp.Status)
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil, fmt.Errorf("unsupported content type %q", mediaType)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, f.maxBytes))
+	if err != nil {
+		return nil, err
+	}
+	return parse(resp.Request.URL, string(body)), nil
+}
+
+// checkURL only allows plain http(s) URLs on default-ish ports
+func checkURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("only http and https urls are allowed")
+	}
+	if u.User != nil {
+		return errors.New("urls with credentials are not allowed")
+	}
+	if u.Hostname() == "" {
+		return errors.New("url has no host")
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !IsPublic(ip) {
+		return ErrBlockedAddress
+	}
+	if host := strings.ToLower(strings.TrimSuffix(u.Hostname(), ".")); host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return ErrBlockedAddress
+	}
+	if port := u.Port(); port != "" && port != "80" && port != "443" && port != "8080" && port != "8443" {
+		return errors.New("port not allowed")
+	}
+	return nil
+}
+
+// IsPublic reports whether ip is a globally routable unicast address
+func IsPublic(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	// carrier-grade NAT range 100.64.0.0/10
+	if ip4 := ip.To4(); ip4 != nil && ip4[0] == 100 && ip4[1]&0xc0 == 64 {
+		return false
+	}
+	return true
+}
+
+var (
+	metaTag   = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+	attribute = regexp.MustCompile(`(?is)([a-z:-]+)\s*=\s*("([^"]*)"|'([^']*)')`)
+	titleTag  = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	markup    = regexp.MustCompile(`<[^>]*>`)
+)
+
+// parse extracts Open Graph metadata, falling back to standard tags
+func parse(base *url.URL, page string) *Preview {
+	meta := make(map[string]string)
+	for _, tag := range metaTag.FindAllString(page, -1) {
+		attrs := make(map[string]string)
+		for _, m := range attribute.FindAllStringSubmatch(tag, -1) {
+			value := m[3]
+			if value == "" {
+				value = m[4]
+			}
+			attrs[strings.ToLower(m[1])] = value
+		}
+		name := attrs["property"]
+		if name == "" {
+			name = attrs["name"]
+		}
+		name = strings.ToLower(name)
+		if _, seen := meta[name]; name != "" && !seen {
+			meta[name] = attrs["content"]
+		}
+	}
+
+	preview := &Preview{URL: base.String()}
+	preview.Title = clean(first(meta["og:title"], meta["twitter:title"]), maxTitle)
+	if preview.Title == "" {
+		if m := titleTag.FindStringSubmatch(page); m != nil {
+			preview.Title = clean(m[1], maxTitle)
+		}
+	}
+	preview.Description = clean(first(meta["og:description"], meta["twitter:description"], meta["description"]), maxDescription)
+	preview.SiteName = clean(meta["og:site_name"], maxTitle)
+
+	if image := first(meta["og:image"], meta["twitter:image"]); image != "" {
+		if u, err := base.Parse(html.UnescapeString(image)); err == nil && checkURL(u) == nil && len(u.String()) <= maxURL {
+			preview.Image = u.String()
+		}
+	}
+	return preview
+}
+
+func first(values ...string) string {
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// clean unescapes entities, strips markup and control characters and truncates to max runes
+func clean(s string, max int) string {
+	s = html.UnescapeString(s)
+	s = markup.ReplaceAllString(s, "")
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, s)
+	s = strings.Join(strings.Fields(s), " ")
+	if runes := []rune(s); len(runes) > max {
+		s = string(runes[:max-1]) + "…"
+	}
+	return s
+}
@@ -0,0 +1,70 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"unicode/utf8"
+)
+
+// binaryLengthSize is the size of the big-endian length of the header opening a binary frame
+const binaryLengthSize = 2
+
+// DecodeBinaryFrame parses and validates a binary chat, forward or location frame from a client: the
+// header length, the header, a JSON object held to the rules of DecodeFrame but without
+// content, and the content up to the end of the frame. The frame's Content shares data's
+// memory. Errors are always *FrameError
+func DecodeBinaryFrame(data []byte) (*Frame, error) {
+	if len(data) > MaxFrameSize {
+		return nil, &FrameError{Reason: fmt.Sprintf("larger than %d bytes", MaxFrameSize)}
+	}
+	if len(data) < binaryLengthSize {
+		return nil, &FrameError{Reason: "shorter than its header"}
+	}
+	end := binaryLengthSize + int(binary.BigEndian.Uint16(data))
+	if len(data) < end {
+		return nil, &FrameError{Reason: "shorter than its header"}
+	}
+	header := data[binaryLengthSize:end]
+	if !utf8.Valid(header) {
+		return nil, &FrameError{Reason: "header not valid UTF-8"}
+	}
+	fields, err := readFrameObject(header)
+	if err != nil {
+		return nil, err
+	}
+	defer fields.release()
+	if fields["content"] != nil {
+		return nil, &FrameError{Field: "content", Reason: "follows the header in binary frames"}
+	}
+	if t := fields.get("type"); t != "" && t != TypeChat && t != TypeForward && t != TypeLocation {
+		return nil, &FrameError{Field: "type", Reason: "only chat, forward and location frames can be binary"}
+	}
+	content := data[end:]
+	if len(content) == 0 {
+		return nil, &FrameError{Field: "content", Reason: "required"}
+	}
+	return decodeFields(fields, content)
+}
+
+// AppendBinaryHeader writes the start of a binary frame carrying message to buf: the header
+// length and message as JSON without its content, which the frame ends with
+func AppendBinaryHeader(buf *bytes.Buffer, message *Message) error {
+	header := *message
+	header.Content = nil
+	start := buf.Len()
+	buf.Write(make([]byte, binaryLengthSize))
+	if err := json.NewEncoder(buf).Encode(&header); err != nil {
+		return err
+	}
+	// Encode ends with a newline, which the header can do without
+	buf.Truncate(buf.Len() - 1)
+	size := buf.Len() - start - binaryLengthSize
+	if size > math.MaxUint16 {
+		return fmt.Errorf("message header of %d bytes is too large for a binary frame", size)
+	}
+	binary.BigEndian.PutUint16(buf.Bytes()[start:], uint16(size))
+	return nil
+}
@@ -0,0 +1,36 @@
+package protocol
+
+import "encoding/json"
+
+// websocket close codes used by the server. Application codes are 4000 plus the
+// last two digits of the matching HTTP status, in the 4000-4999 private use range
+const (
+	CloseProtocolViolation  = 4000 // the client kept sending frames the server can't parse
+	CloseAuthExpired        = 4001 // the token expired or no longer names the account, log in again
+	CloseKicked             = 4003 // disconnected by an admin
+	CloseAlreadyConnected   = 4009 // another session is active and the policy rejects new ones
+	CloseSignedInElsewhere  = 4010 // replaced by a newer session of the same account
+	CloseRateLimited        = 4029 // too many connections or messages, back off before reconnecting
+	CloseTooManyConnections = CloseRateLimited
+	CloseServerShutdown     = 1012 // "service restart": maintenance or shutdown, reconnect later
+)
+
+// maxCloseReason is the most a close frame can carry after its two byte code
+const maxCloseReason = 123
+
+// CloseReason is the JSON sent as the reason text of close frames, so clients can tell
+// whether to reconnect, log in again or show the error
+type CloseReason struct {
+	Code       string `json:"code"`                 // API error code, also a translation key under errors.
+	Retry      bool   `json:"retry"`                // reconnecting unchanged is expected to work
+	RetryAfter int    `json:"retryAfter,omitempty"` // seconds to wait before reconnecting
+}
+
+// String encodes the reason, falling back to the bare code if the JSON doesn't fit a close frame
+func (r CloseReason) String() string {
+	data, err := json.Marshal(r)
+	if err != nil || len(data) > maxCloseReason {
+		return r.Code
+	}
+	return string(data)
+}
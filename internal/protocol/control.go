@@ -0,0 +1,111 @@
+package protocol
+
+// ServerSender is the sender name used for messages generated by the server itself
+const ServerSender = "server"
+
+// control events sent from the server to clients
+const (
+	EventShutdownWarning      = "shutdown_warning"
+	EventUndeliverable        = "undeliverable"
+	EventRateLimited          = "rate_limited"
+	EventError                = "error" // data is a structured API error
+	EventUserRenamed          = "user_renamed"
+	EventUserDeleted          = "user_deleted" // a contact's account was deleted, data.tombstone replaces their name
+	EventKeyChanged           = "key_changed"  // a contact rotated their public key
+	EventSignedInElsewhere    = "signed_in_elsewhere"
+	EventReauthenticate       = "reauthenticate"  // the connection's token expires soon, send a new one
+	EventReauthenticated      = "reauthenticated" // a new token was accepted
+	EventDuplicate            = "duplicate"       // a resubmitted clientId was already accepted
+	EventRoomUpdated          = "room_updated"
+	EventRoomPins             = "room_pins"
+	EventRoomPublicPost       = "room_public_post"  // data.action is one of the PublicPost* constants
+	EventRoomEvent            = "room_event"        // data.action is one of the RoomEvent* constants
+	EventRoomRSVP             = "room_rsvp"         // a member answered an event, an empty status withdraws the answer
+	EventRoomPoll             = "room_poll"         // data.action is one of the Poll* constants
+	EventRoomPollTally        = "room_poll_tally"   // a poll's votes changed
+	EventRoomMember           = "room_member"       // data.action is one of the Member* constants
+	EventRoomJoinRequest      = "room_join_request" // data.action is one of the Join* constants
+	EventRoomExport           = "room_export"       // a scheduled room export failed, or succeeded again after failing
+	EventCommandResult        = "command_result"    // outcome of a slash command
+	EventSupportMessage       = "support_message"   // a support ticket message, to its user or to online admins
+	EventSupportClosed        = "support_closed"
+	EventInboundEmail         = "inbound_email"         // an email bridged to the user or one of their rooms
+	EventLocationShare        = "location_share"        // data.action is one of the LocationShare* constants
+	EventConversationSettings = "conversation_settings" // the user changed a conversation's settings on one of their devices
+	EventRecoveryCodeUsed     = "recovery_code_used"    // someone logged in with one of the user's recovery codes
+	EventNewDevice            = "new_device"            // someone signed in from an IP address and user agent not seen before
+	EventHello                = "hello"                 // answers the client's hello, data is a ServerHello
+	EventBackfillDone         = "backfill_done"         // the messages announced in the hello were all sent, or with streams, queued
+	EventStreamOpen           = "stream_open"           // first message of a stream, says what it carries
+	EventStreamEnd            = "stream_end"            // last message of a stream
+	EventPresence             = "presence"              // a contact went online, away, busy, dnd or offline, data is their presence
+	EventDoNotDisturb         = "do_not_disturb"        // the user changed their do-not-disturb schedule on one of their devices
+	EventSavedMessage         = "saved_message"         // the user saved or unsaved a message on one of their devices, data.action is one of the Saved* constants
+	EventDraft                = "draft"                 // the user changed or cleared a conversation's draft on one of their devices, data is the draft
+)
+
+// actions reported in room_member events
+const (
+	MemberAdded   = "added"
+	MemberRemoved = "removed"
+	MemberMuted   = "muted"
+	MemberUnmuted = "unmuted"
+	MemberDeleted = "deleted" // the member's account was deleted
+)
+
+// actions reported in saved_message events
+const (
+	SavedAdded   = "saved"
+	SavedRemoved = "removed"
+)
+
+// actions reported in room_join_request events, to the room's moderators and the requester
+const (
+	JoinRequested = "requested"
+	JoinApproved  = "approved"
+	JoinRejected  = "rejected"
+	JoinWithdrawn = "withdrawn"
+)
+
+// actions reported in room_public_post events
+const (
+	PublicPostAdded   = "posted"
+	PublicPostDeleted = "deleted"
+)
+
+// actions reported in room_event events
+const (
+	RoomEventCreated   = "created"
+	RoomEventUpdated   = "updated"
+	RoomEventCancelled = "cancelled"
+)
+
+// actions reported in room_poll events
+const (
+	PollCreated = "created"
+	PollClosed  = "closed"
+	PollDeleted = "deleted"
+)
+
+// actions reported in location_share events, to both sides of the share
+const (
+	LocationShareStarted = "started"
+	LocationShareStopped = "stopped"
+	LocationShareExpired = "expired"
+)
+
+// Control is a server generated, unencrypted payload for protocol level events
+type Control struct {
+	Event string      `json:"event"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+// NewControlMessage builds a control message from the server to recipient
+func NewControlMessage(recipient, event string, data interface{}) *Message {
+	return &Message{
+		Type:      TypeControl,
+		Recipient: recipient,
+		Sender:    ServerSender,
+		Control:   &Control{Event: event, Data: data},
+	}
+}
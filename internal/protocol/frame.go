@@ -0,0 +1,391 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// MaxFrameSize is the largest websocket frame a client may send. Attachments are
+// uploaded over HTTP, so this only has to fit an encrypted text message
+const MaxFrameSize = 256 << 10
+
+// MaxProvenanceSize is the largest provenance a forward may carry, decoded: the original's
+// sender, timestamp and signature with room to spare
+const MaxProvenanceSize = 2048
+
+// longest accepted values of the string fields of a frame, in bytes
+const (
+	maxNameLength    = 256 // recipient, room and sender
+	maxCommandLength = 4096
+	maxTokenLength   = 8192
+	maxNumberLength  = 19 // decimal digits of the largest int64
+)
+
+// strictBase64 decodes content, kept rather than made by Strict for every frame
+var strictBase64 = base64.StdEncoding.Strict()
+
+// clientIDPattern accepts UUIDs in their canonical text form
+var clientIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// Frame is a client to server websocket frame that passed DecodeFrame
+type Frame struct {
+	Type      string // TypeChat, TypeForward, TypeCommand, TypeReauth, TypeLocation, TypeHello or TypeWindow, an empty type is read as TypeChat
+	Recipient string // chat messages have a recipient or a room
+	Room      string // also the room a command applies to
+	Content   []byte // encrypted chat content or location, sent as base64
+	ClientID  string // optional UUID, resubmissions with the same id are dropped
+	Command   string // the command line, e.g. "/kick bob"
+	Token     string // a fresh JWT, for reauthenticate frames
+	DeviceID  string // hello frames: the client's own id for the device, kept across connections
+	Version   int    // hello frames: the newest protocol version the client speaks
+	Cursor    int64  // hello frames: id of the newest message the device has, 0 if it has none
+	Stream    int    // window frames: the stream granted credit
+	Credit    int    // window frames: how many more messages the stream may send
+
+	Provenance []byte // forward frames: the original's signed provenance, sent as base64
+	NoForward  bool   // chat and forward frames: "true" asks recipients not to forward the message
+}
+
+// FrameError says why a frame was rejected. Field is the offending JSON key, empty
+// when the frame as a whole is malformed
+type FrameError struct {
+	Field  string
+	Reason string
+}
+
+func (e *FrameError) Error() string {
+	if e.Field == "" {
+		return "invalid frame: " + e.Reason
+	}
+	return fmt.Sprintf("invalid frame: %s: %s", e.Field, e.Reason)
+}
+
+// frameFields lists the keys a frame may carry with their length limits. "sender" is
+// accepted for older clients and ignored, the server always sets it
+var frameFields = map[string]int{
+	"type":      len(TypeReauth),
+	"recipient": maxNameLength,
+	"room":      maxNameLength,
+	"sender":    maxNameLength,
+	"content":   base64.StdEncoding.EncodedLen(MaxFrameSize),
+	"clientId":  36,
+	"command":   maxCommandLength,
+	"token":     maxTokenLength,
+	"deviceId":  64,
+	"version":   maxNumberLength,
+	"cursor":    maxNumberLength,
+	"stream":    maxNumberLength,
+	"credit":    maxNumberLength,
+
+	"provenance": base64.StdEncoding.EncodedLen(MaxProvenanceSize),
+	"noForward":  len("false"),
+}
+
+// frameFieldNames maps the keys of frameFields to themselves, so a key read from a frame
+// doesn't need a string of its own
+var frameFieldNames = func() map[string]string {
+	names := make(map[string]string, len(frameFields))
+	for name := range frameFields {
+		names[name] = name
+	}
+	return names
+}()
+
+// fields each frame type may set besides type, sender and clientId
+var frameTypeFields = map[string]map[string]bool{
+	TypeChat:     {"recipient": true, "room": true, "content": true, "noForward": true},
+	TypeForward:  {"recipient": true, "room": true, "content": true, "provenance": true, "noForward": true},
+	TypeCommand:  {"command": true, "room": true},
+	TypeReauth:   {"token": true},
+	TypeLocation: {"recipient": true, "content": true},
+	TypeHello:    {"deviceId": true, "version": true, "cursor": true},
+	TypeWindow:   {"stream": true, "credit": true},
+}
+
+// DecodeFrame parses and validates a frame from a client. The frame must be one JSON
+// object of string or null values with no unknown or repeated keys and nothing after it,
+// and carry exactly the fields its type needs. Errors are always *FrameError
+func DecodeFrame(data []byte) (*Frame, error) {
+	if len(data) > MaxFrameSize {
+		return nil, &FrameError{Reason: fmt.Sprintf("larger than %d bytes", MaxFrameSize)}
+	}
+	if !utf8.Valid(data) {
+		return nil, &FrameError{Reason: "not valid UTF-8"}
+	}
+	fields, err := readFrameObject(data)
+	if err != nil {
+		return nil, err
+	}
+	defer fields.release()
+	return decodeFields(fields, nil)
+}
+
+// decodeFields builds and validates a frame from the fields of its JSON object. The content
+// of binary frames comes raw in content, text frames carry it base64 encoded in the fields
+func decodeFields(fields frameObject, content []byte) (*Frame, error) {
+	frame := &Frame{
+		Type:      fields.get("type"),
+		Recipient: fields.get("recipient"),
+		Room:      fields.get("room"),
+		ClientID:  fields.get("clientId"),
+		Command:   fields.get("command"),
+		Token:     fields.get("token"),
+	}
+	if frame.Type == "" {
+		frame.Type = TypeChat
+	}
+	allowed, ok := frameTypeFields[frame.Type]
+	if !ok {
+		return nil, &FrameError{Field: "type", Reason: fmt.Sprintf("unknown type %q", frame.Type)}
+	}
+	for key, value := range fields {
+		if value != nil && key != "type" && key != "sender" && key != "clientId" && !allowed[key] {
+			return nil, &FrameError{Field: key, Reason: "not allowed in " + frame.Type + " frames"}
+		}
+	}
+	if frame.ClientID != "" && !clientIDPattern.MatchString(frame.ClientID) {
+		return nil, &FrameError{Field: "clientId", Reason: "must be a UUID"}
+	}
+
+	switch noForward := fields.get("noForward"); noForward {
+	case "", "false":
+	case "true":
+		frame.NoForward = true
+	default:
+		return nil, &FrameError{Field: "noForward", Reason: `must be "true" or "false"`}
+	}
+
+	switch frame.Type {
+	case TypeChat, TypeForward, TypeLocation:
+		if frame.Type == TypeForward {
+			encoded := fields["provenance"]
+			if len(encoded) == 0 {
+				return nil, &FrameError{Field: "provenance", Reason: "required"}
+			}
+			decoded := make([]byte, strictBase64.DecodedLen(len(encoded)))
+			n, err := strictBase64.Decode(decoded, encoded)
+			if err != nil {
+				return nil, &FrameError{Field: "provenance", Reason: "not valid base64"}
+			}
+			frame.Provenance = decoded[:n]
+		}
+		if frame.Type == TypeLocation && frame.Recipient == "" {
+			return nil, &FrameError{Field: "recipient", Reason: "required"}
+		}
+		if (frame.Recipient == "") == (frame.Room == "") {
+			return nil, &FrameError{Field: "recipient", Reason: "exactly one of recipient and room is required"}
+		}
+		if content != nil {
+			frame.Content = content
+			break
+		}
+		encoded := fields["content"]
+		if len(encoded) == 0 {
+			return nil, &FrameError{Field: "content", Reason: "required"}
+		}
+		decoded := make([]byte, strictBase64.DecodedLen(len(encoded)))
+		n, err := strictBase64.Decode(decoded, encoded)
+		if err != nil {
+			return nil, &FrameError{Field: "content", Reason: "not valid base64"}
+		}
+		frame.Content = decoded[:n]
+	case TypeCommand:
+		if frame.Command == "" {
+			return nil, &FrameError{Field: "command", Reason: "required"}
+		}
+	case TypeReauth:
+		if frame.Token == "" {
+			return nil, &FrameError{Field: "token", Reason: "required"}
+		}
+	case TypeHello:
+		frame.DeviceID = fields.get("deviceId")
+		if !deviceIDPattern.MatchString(frame.DeviceID) {
+			return nil, &FrameError{Field: "deviceId", Reason: "required, letters, digits and . _ : - only"}
+		}
+		version, err := strconv.Atoi(fields.get("version"))
+		if err != nil || version < 1 {
+			return nil, &FrameError{Field: "version", Reason: "must be a positive number"}
+		}
+		frame.Version = version
+		if cursor := fields.get("cursor"); cursor != "" {
+			if frame.Cursor, err = strconv.ParseInt(cursor, 10, 64); err != nil || frame.Cursor < 0 {
+				return nil, &FrameError{Field: "cursor", Reason: "must be a message id"}
+			}
+		}
+	case TypeWindow:
+		stream, err := strconv.Atoi(fields.get("stream"))
+		if err != nil || stream < 1 {
+			return nil, &FrameError{Field: "stream", Reason: "must be a stream id"}
+		}
+		credit, err := strconv.Atoi(fields.get("credit"))
+		if err != nil || credit < 1 {
+			return nil, &FrameError{Field: "credit", Reason: "must be a positive number"}
+		}
+		frame.Stream, frame.Credit = stream, credit
+	}
+	return frame, nil
+}
+
+// malformed rejects frames that aren't a JSON object, read only like every FrameError
+var malformed = &FrameError{Reason: "not a JSON object"}
+
+// frameObject holds the values of a frame's top level JSON object by key, nil for null.
+// Values without escapes share the frame's memory
+type frameObject map[string][]byte
+
+// objectPool holds the objects of frames being decoded, which don't outlive DecodeFrame
+var objectPool = sync.Pool{New: func() interface{} { return make(frameObject, len(frameFields)) }}
+
+// get returns the value of key as a string, empty if it is null or missing
+func (o frameObject) get(key string) string {
+	return string(o[key])
+}
+
+// release empties o and returns it to the pool
+func (o frameObject) release() {
+	clear(o)
+	objectPool.Put(o)
+}
+
+// readFrameObject reads the top level JSON object of a frame. Frames only hold strings, so
+// they are scanned here rather than through a json.Decoder, which copies the frame and every
+// value it reads. The caller releases the object
+func readFrameObject(data []byte) (frameObject, error) {
+	r := frameReader{data: data}
+	if !r.consume('{') {
+		return nil, malformed
+	}
+	fields := objectPool.Get().(frameObject)
+	fail := func(err error) (frameObject, error) {
+		fields.release()
+		return nil, err
+	}
+	for first := true; !r.consume('}'); first = false {
+		if !first && !r.consume(',') {
+			return fail(malformed)
+		}
+		name, ok := r.string()
+		if !ok {
+			return fail(malformed)
+		}
+		key, known := frameFieldNames[string(name)]
+		if !known {
+			return fail(&FrameError{Field: string(name), Reason: "unknown field"})
+		}
+		if _, seen := fields[key]; seen {
+			return fail(&FrameError{Field: key, Reason: "repeated"})
+		}
+		if !r.consume(':') {
+			return fail(malformed)
+		}
+
+		var value []byte
+		switch c := r.peek(); {
+		case c == '"':
+			if value, ok = r.string(); !ok {
+				return fail(malformed)
+			}
+			if limit := frameFields[key]; len(value) > limit {
+				return fail(&FrameError{Field: key, Reason: fmt.Sprintf("longer than %d bytes", limit)})
+			}
+		case c == 'n':
+			if !r.literal("null") {
+				return fail(malformed)
+			}
+		case strings.IndexByte(`{[tf-0123456789`, c) >= 0:
+			// the rest of the value is left unread, the frame is rejected either way
+			return fail(&FrameError{Field: key, Reason: "must be a string"})
+		default:
+			return fail(malformed)
+		}
+		fields[key] = value
+	}
+	if r.skipSpace(); r.pos != len(data) {
+		return fail(&FrameError{Reason: "unexpected data after the object"})
+	}
+	return fields, nil
+}
+
+// frameReader scans the JSON of a frame
+type frameReader struct {
+	data []byte
+	pos  int
+}
+
+// skipSpace moves past JSON whitespace
+func (r *frameReader) skipSpace() {
+	for r.pos < len(r.data) {
+		switch r.data[r.pos] {
+		case ' ', '\t', '\n', '\r':
+			r.pos++
+		default:
+			return
+		}
+	}
+}
+
+// peek returns the next byte after whitespace, 0 at the end
+func (r *frameReader) peek() byte {
+	r.skipSpace()
+	if r.pos == len(r.data) {
+		return 0
+	}
+	return r.data[r.pos]
+}
+
+// consume moves past the next byte after whitespace if it is c
+func (r *frameReader) consume(c byte) bool {
+	if r.peek() != c {
+		return false
+	}
+	r.pos++
+	return true
+}
+
+// literal moves past word if it comes next
+func (r *frameReader) literal(word string) bool {
+	r.skipSpace()
+	if !bytes.HasPrefix(r.data[r.pos:], []byte(word)) {
+		return false
+	}
+	r.pos += len(word)
+	return true
+}
+
+// string reads a JSON string and returns its value. A value without escapes, such as
+// base64, is a slice of the frame; others are unescaped by encoding/json into new memory
+func (r *frameReader) string() ([]byte, bool) {
+	if r.peek() != '"' {
+		return nil, false
+	}
+	start := r.pos
+	escaped := false
+	for i := start + 1; i < len(r.data); i++ {
+		switch c := r.data[i]; {
+		case c == '"':
+			r.pos = i + 1
+			if !escaped {
+				return r.data[start+1 : i], true
+			}
+			var value string
+			if err := json.Unmarshal(r.data[start:r.pos], &value); err != nil {
+				return nil, false
+			}
+			return []byte(value), true
+		case c == '\\':
+			escaped = true
+			// the escaped character can't end the string, json.Unmarshal checks the rest
+			i++
+		case c < 0x20:
+			return nil, false
+		}
+	}
+	return nil, false
+}
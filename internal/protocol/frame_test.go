@@ -0,0 +1,192 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const testClientID = "123e4567-e89b-12d3-a456-426614174000"
+
+// validFrames are well formed frames of every type, also the fuzzer's seeds
+var validFrames = []string{
+	`{"recipient":"bob","content":"aGVsbG8="}`,
+	`{"type":"chat","room":"r1","content":"aGVsbG8=","clientId":"` + testClientID + `"}`,
+	`{"type":"chat","recipient":"bob","sender":"alice","content":"aGVsbG8=","noForward":"true"}`,
+	`{"type":"forward","recipient":"bob","content":"aGVsbG8=","provenance":"c2lnbmVk"}`,
+	`{"type":"command","room":"r1","command":"/kick bob"}`,
+	`{"type":"reauthenticate","token":"a.b.c"}`,
+	`{"type":"location","recipient":"bob","content":"bG9jYXRpb24="}`,
+	`{"type":"hello","deviceId":"phone-1","version":"2","cursor":"41"}`,
+	`{"type":"window","stream":"3","credit":"100"}`,
+	` { "recipient" : "bob" , "room" : null , "content" : "aGVsbG8=" } `,
+}
+
+func TestDecodeFrameValid(t *testing.T) {
+	tests := []struct {
+		frame string
+		want  Frame
+	}{
+		{validFrames[0], Frame{Type: TypeChat, Recipient: "bob", Content: []byte("hello")}},
+		{validFrames[1], Frame{Type: TypeChat, Room: "r1", Content: []byte("hello"), ClientID: testClientID}},
+		{validFrames[2], Frame{Type: TypeChat, Recipient: "bob", Content: []byte("hello"), NoForward: true}},
+		{validFrames[3], Frame{Type: TypeForward, Recipient: "bob", Content: []byte("hello"), Provenance: []byte("signed")}},
+		{validFrames[4], Frame{Type: TypeCommand, Room: "r1", Command: "/kick bob"}},
+		{validFrames[5], Frame{Type: TypeReauth, Token: "a.b.c"}},
+		{validFrames[6], Frame{Type: TypeLocation, Recipient: "bob", Content: []byte("location")}},
+		{validFrames[7], Frame{Type: TypeHello, DeviceID: "phone-1", Version: 2, Cursor: 41}},
+		{validFrames[8], Frame{Type: TypeWindow, Stream: 3, Credit: 100}},
+		{validFrames[9], Frame{Type: TypeChat, Recipient: "bob", Content: []byte("hello")}},
+	}
+	for _, tt := range tests {
+		frame, err := DecodeFrame([]byte(tt.frame))
+		if err != nil {
+			t.Errorf("DecodeFrame(%s): %v", tt.frame, err)
+			continue
+		}
+		if !equalFrames(frame, &tt.want) {
+			t.Errorf("DecodeFrame(%s) = %+v, want %+v", tt.frame, *frame, tt.want)
+		}
+	}
+}
+
+func equalFrames(a, b *Frame) bool {
+	return a.Type == b.Type && a.Recipient == b.Recipient && a.Room == b.Room && bytes.Equal(a.Content, b.Content) &&
+		a.ClientID == b.ClientID && a.Command == b.Command && a.Token == b.Token && a.DeviceID == b.DeviceID &&
+		a.Version == b.Version && a.Cursor == b.Cursor && a.Stream == b.Stream && a.Credit == b.Credit &&
+		bytes.Equal(a.Provenance, b.Provenance) && a.NoForward == b.NoForward
+}
+
+func TestDecodeFrameErrors(t *testing.T) {
+	oversized := `{"recipient":"bob","content":"` + strings.Repeat("A", MaxFrameSize) + `"}`
+	tests := []struct {
+		name   string
+		frame  string
+		field  string
+		reason string // a substring of the reason
+	}{
+		{"repeated key", `{"recipient":"bob","recipient":"carol","content":"aGk="}`, "recipient", "repeated"},
+		{"repeated null key", `{"room":null,"room":"r1","content":"aGk="}`, "room", "repeated"},
+		{"unknown key", `{"recipient":"bob","content":"aGk=","colour":"red"}`, "colour", "unknown field"},
+		{"key in the wrong case", `{"Recipient":"bob","content":"aGk="}`, "Recipient", "unknown field"},
+		{"field not allowed for chat", `{"recipient":"bob","content":"aGk=","token":"t"}`, "token", "not allowed in chat frames"},
+		{"field not allowed for command", `{"type":"command","command":"/x","content":"aGk="}`, "content", "not allowed in command frames"},
+		{"field not allowed for hello", `{"type":"hello","deviceId":"d","version":"1","room":"r1"}`, "room", "not allowed in hello frames"},
+		{"provenance outside forwards", `{"recipient":"bob","content":"aGk=","provenance":"aGk="}`, "provenance", "not allowed in chat frames"},
+		{"bad base64 content", `{"recipient":"bob","content":"not base64!"}`, "content", "not valid base64"},
+		{"unpadded base64 content", `{"recipient":"bob","content":"aGk"}`, "content", "not valid base64"},
+		{"non-canonical base64 content", `{"recipient":"bob","content":"aGl="}`, "content", "not valid base64"},
+		{"bad base64 provenance", `{"type":"forward","recipient":"bob","content":"aGk=","provenance":"%%%"}`, "provenance", "not valid base64"},
+		{"non-UTF-8 value", "{\"recipient\":\"b\xffb\",\"content\":\"aGk=\"}", "", "not valid UTF-8"},
+		{"non-UTF-8 key", "{\"\xc3\x28\":\"x\"}", "", "not valid UTF-8"},
+		{"oversized frame", oversized, "", "larger than"},
+		{"oversized value", `{"recipient":"` + strings.Repeat("b", maxNameLength+1) + `","content":"aGk="}`, "recipient", "longer than"},
+		{"trailing object", `{"recipient":"bob","content":"aGk="}{}`, "", "unexpected data after the object"},
+		{"trailing garbage", `{"recipient":"bob","content":"aGk="} x`, "", "unexpected data after the object"},
+		{"not an object", `["recipient","bob"]`, "", "not a JSON object"},
+		{"empty", ``, "", "not a JSON object"},
+		{"unterminated", `{"recipient":"bob"`, "", "not a JSON object"},
+		{"missing colon", `{"recipient" "bob"}`, "", "not a JSON object"},
+		{"control character", "{\"recipient\":\"b\tb\",\"content\":\"aGk=\"}", "", "not a JSON object"},
+		{"bad escape", `{"recipient":"b\qb","content":"aGk="}`, "", "not a JSON object"},
+		{"number value", `{"type":"window","stream":3,"credit":"1"}`, "stream", "must be a string"},
+		{"boolean value", `{"recipient":"bob","content":"aGk=","noForward":true}`, "noForward", "must be a string"},
+		{"object value", `{"recipient":{"name":"bob"}}`, "recipient", "must be a string"},
+		{"unknown type", `{"type":"shout","recipient":"bob"}`, "type", "unknown type"},
+		{"bad client id", `{"recipient":"bob","content":"aGk=","clientId":"abc"}`, "clientId", "must be a UUID"},
+		{"bad noForward", `{"recipient":"bob","content":"aGk=","noForward":"yes"}`, "noForward", `must be "true" or "false"`},
+		{"recipient and room", `{"recipient":"bob","room":"r1","content":"aGk="}`, "recipient", "exactly one"},
+		{"no recipient or room", `{"content":"aGk="}`, "recipient", "exactly one"},
+		{"missing content", `{"recipient":"bob"}`, "content", "required"},
+		{"location in a room", `{"type":"location","room":"r1","content":"aGk="}`, "room", "not allowed in location frames"},
+		{"forward without provenance", `{"type":"forward","recipient":"bob","content":"aGk="}`, "provenance", "required"},
+		{"missing command", `{"type":"command","room":"r1"}`, "command", "required"},
+		{"missing token", `{"type":"reauthenticate"}`, "token", "required"},
+		{"bad device id", `{"type":"hello","deviceId":"a b","version":"1"}`, "deviceId", "required"},
+		{"bad version", `{"type":"hello","deviceId":"d","version":"0"}`, "version", "positive"},
+		{"negative cursor", `{"type":"hello","deviceId":"d","version":"1","cursor":"-1"}`, "cursor", "message id"},
+		{"bad stream", `{"type":"window","stream":"x","credit":"1"}`, "stream", "stream id"},
+		{"bad credit", `{"type":"window","stream":"1","credit":"0"}`, "credit", "positive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame, err := DecodeFrame([]byte(tt.frame))
+			if err == nil {
+				t.Fatalf("accepted as %+v", *frame)
+			}
+			var frameErr *FrameError
+			if !errors.As(err, &frameErr) {
+				t.Fatalf("error %T %v is not a *FrameError", err, err)
+			}
+			if frameErr.Field != tt.field || !strings.Contains(frameErr.Reason, tt.reason) {
+				t.Fatalf("got field %q reason %q, want field %q reason containing %q", frameErr.Field, frameErr.Reason, tt.field, tt.reason)
+			}
+		})
+	}
+}
+
+// FuzzDecodeFrame checks that any input is either rejected with a *FrameError or is a JSON
+// object of strings whose values the decoded frame agrees with
+func FuzzDecodeFrame(f *testing.F) {
+	for _, frame := range validFrames {
+		f.Add([]byte(frame))
+	}
+	f.Add([]byte(`{"recipient":"bob","recipient":"carol","content":"aGk="}`))
+	f.Add([]byte(`{"type":"window","stream":3}`))
+	f.Add([]byte(`{"recipient":"bob","content":"aGk="} {}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		frame, err := DecodeFrame(data)
+		if err != nil {
+			var frameErr *FrameError
+			if !errors.As(err, &frameErr) {
+				t.Fatalf("error %T %v is not a *FrameError", err, err)
+			}
+			return
+		}
+
+		var fields map[string]*string
+		if err := json.Unmarshal(data, &fields); err != nil {
+			t.Fatalf("accepted a frame encoding/json rejects: %v", err)
+		}
+		value := func(key string) string {
+			if v := fields[key]; v != nil {
+				return *v
+			}
+			return ""
+		}
+		if _, ok := frameTypeFields[frame.Type]; !ok {
+			t.Fatalf("accepted unknown type %q", frame.Type)
+		}
+		if value("type") != "" && value("type") != frame.Type {
+			t.Fatalf("type %q decoded as %q", value("type"), frame.Type)
+		}
+		if frame.Recipient != value("recipient") || frame.Room != value("room") || frame.Command != value("command") ||
+			frame.Token != value("token") || frame.ClientID != value("clientId") {
+			t.Fatalf("frame %+v doesn't match its fields %v", *frame, fields)
+		}
+		if encoded := value("content"); encoded != "" && base64.StdEncoding.EncodeToString(frame.Content) != encoded {
+			t.Fatalf("content %q decoded as %q", encoded, frame.Content)
+		}
+	})
+}
+
+func BenchmarkDecodeFrame(b *testing.B) {
+	for _, size := range []int{200, 16 << 10} {
+		content := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0xa5}, size))
+		frame := []byte(`{"type":"chat","recipient":"bob","content":"` + content + `","clientId":"` + testClientID + `"}`)
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(frame)))
+			for i := 0; i < b.N; i++ {
+				if _, err := DecodeFrame(frame); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
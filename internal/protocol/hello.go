@@ -0,0 +1,45 @@
+package protocol
+
+import "regexp"
+
+// versions of the websocket protocol the server speaks. A client sends the newest version it
+// knows in its hello and the server answers with the version both use
+const (
+	MinProtocolVersion = 1
+	ProtocolVersion    = 4
+
+	// StreamsVersion is the first version with streams: replays and other transfers are
+	// multiplexed with their own flow control, clients grant credit with window frames
+	StreamsVersion = 2
+
+	// BatchVersion is the first version with batches: when messages queue up, the server may
+	// write several in one frame as a JSON array instead of a frame each
+	BatchVersion = 3
+
+	// BinaryVersion is the first version with binary frames: chat and location frames, and
+	// messages the server writes, may carry their content raw after a JSON header instead of
+	// base64 in a JSON object, sparing a third of the size and the encoding on both ends
+	BinaryVersion = 4
+)
+
+// deviceIDPattern accepts the ids clients generate for themselves, such as a UUID
+var deviceIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+// ServerHello is the data of the hello control message, the first message on every connection
+type ServerHello struct {
+	SessionID    string   `json:"sessionId"`    // identifies this connection in logs and the admin API
+	Version      int      `json:"version"`      // the protocol version used from here on
+	Capabilities []string `json:"capabilities"` // features enabled for this connection
+	Pending      int      `json:"pending"`      // messages stored after the client's cursor
+	Cursor       int64    `json:"cursor"`       // id of the newest stored message of the account
+	Backfill     bool     `json:"backfill"`     // the pending messages follow, ending with backfill_done
+}
+
+// NegotiateVersion returns the protocol version to use with a client that speaks up to
+// version, false if the client is too old
+func NegotiateVersion(version int) (int, bool) {
+	if version < MinProtocolVersion {
+		return 0, false
+	}
+	return min(version, ProtocolVersion), true
+}
@@ -1,9 +1,59 @@
 package protocol
 
+import "sync"
+
+// message types carried in the Type field
+// an empty type is treated as an encrypted chat message for older clients
+const (
+	TypeChat     = "chat"
+	TypeControl  = "control"
+	TypeCommand  = "command"        // client to server only, a slash command for the server to run
+	TypeReauth   = "reauthenticate" // client to server only, replaces the connection's token before it expires
+	TypeLocation = "location"       // a live location update, relayed to an online recipient and never stored
+	TypeHello    = "hello"          // client to server only, the first frame of every connection
+	TypeWindow   = "window"         // client to server only, lets a stream send more messages
+	TypeForward  = "forward"        // a chat message passed on from another conversation, with the original's provenance
+)
+
 // message structure for all E2EE websocket messages
 // server can see sender and recipient but the message content itself is encrypted
 type Message struct {
-	Recipient string `json:"recipient"` // not encrypted
-	Sender    string `json:"sender"`    // not encrypted
-	Content   []byte `json:"content"`   // encrypted
+	ID        int64    `json:"id,omitempty"`        // assigned by the server when stored
+	Seq       int64    `json:"seq,omitempty"`       // per-conversation sequence number, assigned when stored
+	Timestamp int64    `json:"timestamp,omitempty"` // server receive time, unix millis
+	ClientID  string   `json:"clientId,omitempty"`  // sender generated id, used to drop resubmissions
+	Type      string   `json:"type,omitempty"`      // not encrypted
+	Recipient string   `json:"recipient"`           // not encrypted
+	Room      string   `json:"room,omitempty"`      // set for room messages, which are fanned out to every member
+	Sender    string   `json:"sender"`              // not encrypted
+	Content   []byte   `json:"content,omitempty"`   // encrypted
+	Control   *Control `json:"control,omitempty"`   // server generated, not encrypted
+	Stream    int      `json:"stream,omitempty"`    // the stream carrying the message, unset for live messages
+	// forwards: who sent the original and when, signed by their client; opaque to the server
+	Provenance []byte `json:"provenance,omitempty"`
+	NoForward  bool   `json:"noForward,omitempty"` // the sender asks recipients not to forward it, honored by clients
+
+	pooled bool // from CopyMessage, see Release
+}
+
+// messagePool holds the copies made by CopyMessage, a room message is copied for every member
+var messagePool = sync.Pool{New: func() interface{} { return new(Message) }}
+
+// CopyMessage returns a copy of message from a pool, for a message with a single owner such
+// as a room message queued for one member. The owner calls Release once done with it
+func CopyMessage(message *Message) *Message {
+	copied := messagePool.Get().(*Message)
+	*copied = *message
+	copied.pooled = true
+	return copied
+}
+
+// Release returns a message made by CopyMessage to the pool; nothing may use it afterwards.
+// Other messages are left alone, so writers can release everything they write
+func (m *Message) Release() {
+	if !m.pooled {
+		return
+	}
+	*m = Message{}
+	messagePool.Put(m)
 }
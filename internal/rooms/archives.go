@@ -0,0 +1,169 @@
+package rooms
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+)
+
+// ErrNoArchive is returned for rooms without an archive webhook
+var ErrNoArchive = errors.New("room has no archive webhook")
+
+// Archive is a webhook that receives every message posted to a room, still encrypted,
+// so members can keep an archive of their own. The server never sees the plaintext
+type Archive struct {
+	Room      string    `json:"room"`
+	URL       string    `json:"url"`
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+	// signs deliveries, only returned when the webhook is set
+	Secret string `json:"secret,omitempty"`
+	// the last room sequence number the webhook accepted
+	Delivered int64 `json:"delivered"`
+	// failed attempts in a row, the next waits until NextAttempt
+	Failures    int        `json:"failures"`
+	NextAttempt *time.Time `json:"nextAttempt,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+}
+
+func createArchiveTable(db *sql.DB) {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS room_archives (
+		"room_id" TEXT NOT NULL PRIMARY KEY,
+		"url" TEXT NOT NULL,
+		"secret" TEXT NOT NULL,
+		"created_by" TEXT NOT NULL,
+		"created_at" INTEGER NOT NULL,
+		"delivered" INTEGER NOT NULL DEFAULT 0,
+		"failures" INTEGER NOT NULL DEFAULT 0,
+		"next_attempt" INTEGER NOT NULL DEFAULT 0,
+		"last_error" TEXT NOT NULL DEFAULT '');`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Fatalf("Failed to create room_archives table: %v", err)
+	}
+}
+
+// newArchiveSecret returns a random key for signing deliveries
+func newArchiveSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// SetArchive points a room's archive webhook at url with a new secret, returned once here.
+// A new webhook starts after the room's latest message, or before its first with backfill;
+// replacing one keeps its place, so rotating the secret or moving the archive loses nothing
+func (s *Storage) SetArchive(roomID, url, by string, backfill bool) (*Archive, error) {
+	secret, err := newArchiveSecret()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var delivered int64
+	if !backfill {
+		latestSQL := `SELECT COALESCE(MAX(seq), 0) FROM room_messages WHERE room_id = ?`
+		if err := s.db.QueryRow(latestSQL, roomID).Scan(&delivered); err != nil {
+			return nil, err
+		}
+	}
+	upsertSQL := `INSERT INTO room_archives (room_id, url, secret, created_by, created_at, delivered) VALUES (?, ?, ?, ?, ?, ?)
+	ON CONFLICT (room_id) DO UPDATE SET url = excluded.url, secret = excluded.secret, created_by = excluded.created_by,
+		created_at = excluded.created_at, failures = 0, next_attempt = 0, last_error = ''`
+	if _, err := s.db.Exec(upsertSQL, roomID, url, secret, by, now.Unix(), delivered); err != nil {
+		return nil, err
+	}
+	s.invalidate(roomID)
+	archive, err := s.Archive(roomID)
+	if err != nil {
+		return nil, err
+	}
+	archive.Secret = secret
+	return archive, nil
+}
+
+const archiveColumns = `room_id, url, secret, created_by, created_at, delivered, failures, next_attempt, last_error`
+
+// scanArchive reads a row of archiveColumns, the secret included
+func scanArchive(row interface{ Scan(...interface{}) error }) (*Archive, error) {
+	var a Archive
+	var createdAt, nextAttempt int64
+	if err := row.Scan(&a.Room, &a.URL, &a.Secret, &a.CreatedBy, &createdAt, &a.Delivered, &a.Failures, &nextAttempt, &a.LastError); err != nil {
+		return nil, err
+	}
+	a.CreatedAt = time.Unix(createdAt, 0)
+	if nextAttempt > 0 {
+		t := time.Unix(nextAttempt, 0)
+		a.NextAttempt = &t
+	}
+	return &a, nil
+}
+
+// Archive returns a room's archive webhook without its secret, ErrNoArchive if it has none
+func (s *Storage) Archive(roomID string) (*Archive, error) {
+	archive, err := scanArchive(s.db.QueryRow(`SELECT `+archiveColumns+` FROM room_archives WHERE room_id = ?`, roomID))
+	if err == sql.ErrNoRows {
+		return nil, ErrNoArchive
+	}
+	if err != nil {
+		return nil, err
+	}
+	archive.Secret = ""
+	return archive, nil
+}
+
+// RemoveArchive stops a room's deliveries
+func (s *Storage) RemoveArchive(roomID string) error {
+	res, err := s.db.Exec(`DELETE FROM room_archives WHERE room_id = ?`, roomID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNoArchive
+	}
+	s.invalidate(roomID)
+	return nil
+}
+
+// DueArchives returns the webhooks of rooms with messages after the last delivered one
+// that aren't waiting to retry, secrets included
+func (s *Storage) DueArchives(now time.Time) ([]Archive, error) {
+	querySQL := `SELECT ` + archiveColumns + ` FROM room_archives a
+	WHERE next_attempt <= ? AND EXISTS(SELECT 1 FROM room_messages m WHERE m.room_id = a.room_id AND m.seq > a.delivered)`
+	rows, err := s.db.Query(querySQL, now.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var archives []Archive
+	for rows.Next() {
+		archive, err := scanArchive(rows)
+		if err != nil {
+			return nil, err
+		}
+		archives = append(archives, *archive)
+	}
+	return archives, rows.Err()
+}
+
+// ArchiveDelivered records that the webhook accepted the messages up to seq. Deliveries
+// made with an older secret or URL still count, they went to the room's archive either way
+func (s *Storage) ArchiveDelivered(roomID string, seq int64) error {
+	updateSQL := `UPDATE room_archives SET delivered = MAX(delivered, ?), failures = 0, next_attempt = 0, last_error = ''
+	WHERE room_id = ?`
+	_, err := s.db.Exec(updateSQL, seq, roomID)
+	return err
+}
+
+// ArchiveFailed records a failed delivery, the next is tried at next
+func (s *Storage) ArchiveFailed(roomID, reason string, next time.Time) error {
+	updateSQL := `UPDATE room_archives SET failures = failures + 1, next_attempt = ?, last_error = ? WHERE room_id = ?`
+	_, err := s.db.Exec(updateSQL, next.Unix(), reason, roomID)
+	return err
+}
@@ -0,0 +1,130 @@
+package rooms
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+// changeRetention is how long room list changes are kept for delta sync,
+// clients with an older cursor fetch the whole list again
+const changeRetention = 30 * 24 * time.Hour
+
+// ErrCursorExpired means changes since the cursor are no longer kept
+var ErrCursorExpired = errors.New("room list cursor expired")
+
+// Changes is what changed in a user's room list after a cursor
+type Changes struct {
+	Rooms   []Room   `json:"rooms"`   // joined or changed since the cursor
+	Removed []string `json:"removed"` // ids of rooms the user left, was removed from or that were deleted
+	Cursor  int64    `json:"cursor"`
+}
+
+func createChangesTable(db *sql.DB) {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS room_changes (
+		"seq" INTEGER PRIMARY KEY AUTOINCREMENT,
+		"room_id" TEXT NOT NULL,
+		"username" TEXT NOT NULL DEFAULT '', -- empty when the change applies to every member
+		"created_at" INTEGER NOT NULL);
+	CREATE INDEX IF NOT EXISTS room_changes_room ON room_changes (room_id, seq);`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Fatalf("Failed to create room_changes table: %v", err)
+	}
+
+	// the newest change is always kept so the oldest remaining seq shows how far pruning went
+	pruneSQL := `DELETE FROM room_changes WHERE created_at < ? AND seq < (SELECT MAX(seq) FROM room_changes)`
+	if _, err := db.Exec(pruneSQL, time.Now().Add(-changeRetention).Unix()); err != nil {
+		log.Printf("Error pruning room changes: %v", err)
+	}
+}
+
+// execer is the part of *sql.DB and *sql.Tx recording a change needs
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// recordChange notes that a room's entry changed in username's room list,
+// or in every member's list when username is empty
+func recordChange(e execer, roomID, username string) error {
+	_, err := e.Exec(`INSERT INTO room_changes (room_id, username, created_at) VALUES (?, ?, ?)`, roomID, username, time.Now().Unix())
+	return err
+}
+
+// recordMembersChange notes a change for each current member, used before memberships are deleted
+func recordMembersChange(tx *sql.Tx, roomID string) error {
+	_, err := tx.Exec(`INSERT INTO room_changes (room_id, username, created_at)
+	SELECT room_id, username, ? FROM room_members WHERE room_id = ?`, time.Now().Unix(), roomID)
+	return err
+}
+
+// relevantChanges selects changes to username's room list, binding the username twice
+const relevantChanges = `FROM room_changes WHERE (username = ?
+	OR (username = '' AND room_id IN (SELECT room_id FROM room_members WHERE username = ?)))`
+
+// Cursor returns the position of username's room list, to be passed to ChangesSince later
+func (s *Storage) Cursor(username string) (int64, error) {
+	var latest, oldest int64
+	if err := s.db.QueryRow(`SELECT COALESCE(MAX(seq), 0) `+relevantChanges, username, username).Scan(&latest); err != nil {
+		return 0, err
+	}
+	if err := s.db.QueryRow(`SELECT COALESCE(MIN(seq), 1) FROM room_changes`).Scan(&oldest); err != nil {
+		return 0, err
+	}
+	// everything before the oldest kept change is already reflected in the list
+	return max(latest, oldest-1), nil
+}
+
+// ChangesSince returns the rooms in username's list that changed after cursor
+// and those that left it. ErrCursorExpired means the list must be fetched again
+func (s *Storage) ChangesSince(username string, cursor int64) (*Changes, error) {
+	var oldest, newest int64
+	if err := s.db.QueryRow(`SELECT COALESCE(MIN(seq), 1), COALESCE(MAX(seq), 0) FROM room_changes`).Scan(&oldest, &newest); err != nil {
+		return nil, err
+	}
+	if cursor < oldest-1 || cursor > newest {
+		return nil, ErrCursorExpired
+	}
+
+	rows, err := s.db.Query(`SELECT room_id, MAX(seq) `+relevantChanges+` AND seq > ? GROUP BY room_id ORDER BY MAX(seq)`,
+		username, username, cursor)
+	if err != nil {
+		return nil, err
+	}
+	changes := &Changes{Rooms: []Room{}, Removed: []string{}, Cursor: cursor}
+	var ids []string
+	for rows.Next() {
+		var id string
+		var seq int64
+		if err := rows.Scan(&id, &seq); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+		changes.Cursor = max(changes.Cursor, seq)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil || len(ids) == 0 {
+		return changes, err
+	}
+
+	current, err := s.ForUser(username)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]Room, len(current))
+	for _, room := range current {
+		byID[room.ID] = room
+	}
+	for _, id := range ids {
+		if room, ok := byID[id]; ok {
+			changes.Rooms = append(changes.Rooms, room)
+		} else {
+			changes.Removed = append(changes.Removed, id)
+		}
+	}
+	return changes, nil
+}
@@ -0,0 +1,72 @@
+package rooms
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/dbutil"
+)
+
+// DirectoryEntry is a public room as listed in the directory
+type DirectoryEntry struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	Topic        string    `json:"topic"`
+	AvatarURL    string    `json:"avatarUrl,omitempty"`
+	Announcement bool      `json:"announcement"`
+	MemberCount  int       `json:"memberCount"`
+	Joined       bool      `json:"joined"`  // the caller is already a member
+	CanJoin      bool      `json:"canJoin"` // the caller may join right now
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// DirectoryCursor is where the previous directory page stopped, rooms are ordered by name then id
+type DirectoryCursor struct {
+	Name string `json:"n"`
+	ID   string `json:"i"`
+}
+
+// Directory lists public rooms whose name or topic contains search, after cursor (nil for the first page)
+func (s *Storage) Directory(username, search string, after *DirectoryCursor, limit int) ([]DirectoryEntry, error) {
+	where := `r.public = 1`
+	args := []interface{}{username}
+	if search = strings.TrimSpace(search); search != "" {
+		where += ` AND (r.name LIKE ? ESCAPE '\' OR r.topic LIKE ? ESCAPE '\')`
+		pattern := "%" + dbutil.EscapeLike(search) + "%"
+		args = append(args, pattern, pattern)
+	}
+	if after != nil {
+		where += ` AND (r.name > ? OR (r.name = ? AND r.id > ?))`
+		args = append(args, after.Name, after.Name, after.ID)
+	}
+	args = append(args, limit)
+
+	querySQL := `
+	SELECT r.id, r.name, r.topic, r.announcement, r.created_at, COALESCE(a.etag, ''),
+		(SELECT COUNT(*) FROM room_members m WHERE m.room_id = r.id),
+		EXISTS(SELECT 1 FROM room_members m WHERE m.room_id = r.id AND m.username = ?)
+	FROM rooms r LEFT JOIN room_avatars a ON a.room_id = r.id
+	WHERE ` + where + `
+	ORDER BY r.name, r.id
+	LIMIT ?`
+	rows, err := s.db.Query(querySQL, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []DirectoryEntry{}
+	for rows.Next() {
+		var e DirectoryEntry
+		var createdAt int64
+		var etag string
+		if err := rows.Scan(&e.ID, &e.Name, &e.Topic, &e.Announcement, &createdAt, &etag, &e.MemberCount, &e.Joined); err != nil {
+			return nil, err
+		}
+		e.AvatarURL = s.avatarURL(e.ID, etag)
+		e.CreatedAt = time.Unix(createdAt, 0)
+		e.CanJoin = !e.Joined
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,325 @@
+package rooms
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/textpolicy"
+)
+
+// MaxEventDuration is the longest an event can last, from start to end
+const MaxEventDuration = 31 * 24 * time.Hour
+
+// MaxEventContentSize is the largest encrypted event details accepted, in bytes
+const MaxEventContentSize = 64 << 10
+
+// RSVP answers
+const (
+	RSVPYes   = "yes"
+	RSVPNo    = "no"
+	RSVPMaybe = "maybe"
+)
+
+var (
+	ErrEventNotFound    = errors.New("event not found")
+	ErrEventEmpty       = errors.New("an event needs a start time or encrypted content")
+	ErrInvalidEventTime = fmt.Errorf("an event's end must come after its start and within %d days", MaxEventDuration/(24*time.Hour))
+	ErrEventTooLarge    = fmt.Errorf("encrypted event content can be at most %d bytes", MaxEventContentSize)
+	ErrInvalidRSVP      = errors.New("rsvp must be yes, no or maybe")
+)
+
+// Event is a meetup organized in a room. Content holds the details encrypted for members;
+// the title, location and times are only set when the creator chose to share them with the
+// server, which needs a start time to put the event in the room's calendar export
+type Event struct {
+	ID        int64      `json:"id"`
+	Room      string     `json:"room"`
+	Creator   string     `json:"creator"`
+	Title     string     `json:"title,omitempty"`
+	Location  string     `json:"location,omitempty"`
+	Start     *time.Time `json:"start,omitempty"`
+	End       *time.Time `json:"end,omitempty"`
+	Content   []byte     `json:"content,omitempty"` // encrypted
+	CreatedAt time.Time  `json:"createdAt"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+	RSVPs     []RSVP     `json:"rsvps"`
+}
+
+// RSVP is a member's answer to an event
+type RSVP struct {
+	Username  string    `json:"username"`
+	Status    string    `json:"status"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func createEventTables(db *sql.DB) {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS room_events (
+		"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+		"room_id" TEXT NOT NULL,
+		"creator" TEXT NOT NULL,
+		"title" TEXT NOT NULL DEFAULT '',
+		"location" TEXT NOT NULL DEFAULT '',
+		"starts_at" INTEGER NOT NULL DEFAULT 0,
+		"ends_at" INTEGER NOT NULL DEFAULT 0,
+		"content" BLOB,
+		"created_at" INTEGER NOT NULL,
+		"updated_at" INTEGER NOT NULL);
+	CREATE INDEX IF NOT EXISTS room_events_room ON room_events (room_id, id);
+	CREATE TABLE IF NOT EXISTS room_event_rsvps (
+		"room_id" TEXT NOT NULL,
+		"event_id" INTEGER NOT NULL,
+		"username" TEXT NOT NULL,
+		"status" TEXT NOT NULL,
+		"updated_at" INTEGER NOT NULL,
+		PRIMARY KEY ("event_id", "username"));
+	CREATE INDEX IF NOT EXISTS room_event_rsvps_room ON room_event_rsvps (room_id, username);`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Fatalf("Failed to create room event tables: %v", err)
+	}
+}
+
+// checkEvent cleans the plaintext fields of e through the text policy and checks its times.
+// The error may be a *textpolicy.Error
+func (s *Storage) checkEvent(e *Event) error {
+	if e.Start == nil && len(e.Content) == 0 {
+		return ErrEventEmpty
+	}
+	if len(e.Content) > MaxEventContentSize {
+		return ErrEventTooLarge
+	}
+	if e.End != nil && (e.Start == nil || !e.End.After(*e.Start) || e.End.Sub(*e.Start) > MaxEventDuration) {
+		return ErrInvalidEventTime
+	}
+	var err error
+	if e.Title, err = s.text.Clean(textpolicy.EventTitle, e.Title); err != nil {
+		return err
+	}
+	if e.Location, err = s.text.Clean(textpolicy.EventLocation, e.Location); err != nil {
+		return err
+	}
+	return nil
+}
+
+// unixOrZero stores an optional time as unix seconds, 0 when it isn't set
+func unixOrZero(t *time.Time) int64 {
+	if t == nil {
+		return 0
+	}
+	return t.Unix()
+}
+
+// AddEvent stores a new event in a room, filling in its id and times
+func (s *Storage) AddEvent(e *Event) error {
+	if err := s.checkEvent(e); err != nil {
+		return err
+	}
+	if _, err := s.Get(e.Room); err != nil {
+		return err
+	}
+	now := time.Unix(time.Now().Unix(), 0)
+	insertSQL := `INSERT INTO room_events (room_id, creator, title, location, starts_at, ends_at, content, created_at, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	result, err := s.db.Exec(insertSQL, e.Room, e.Creator, e.Title, e.Location, unixOrZero(e.Start), unixOrZero(e.End),
+		e.Content, now.Unix(), now.Unix())
+	if err != nil {
+		return err
+	}
+	if e.ID, err = result.LastInsertId(); err != nil {
+		return err
+	}
+	e.CreatedAt, e.UpdatedAt, e.RSVPs = now, now, []RSVP{}
+	return nil
+}
+
+// UpdateEvent replaces the title, location, times and content of an event, keeping its RSVPs
+func (s *Storage) UpdateEvent(e *Event) error {
+	if err := s.checkEvent(e); err != nil {
+		return err
+	}
+	updateSQL := `UPDATE room_events SET title = ?, location = ?, starts_at = ?, ends_at = ?, content = ?, updated_at = ?
+	WHERE room_id = ? AND id = ?`
+	result, err := s.db.Exec(updateSQL, e.Title, e.Location, unixOrZero(e.Start), unixOrZero(e.End), e.Content,
+		time.Now().Unix(), e.Room, e.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrEventNotFound
+	}
+	updated, err := s.Event(e.Room, e.ID)
+	if err != nil {
+		return err
+	}
+	*e = *updated
+	return nil
+}
+
+// DeleteEvent removes an event and its RSVPs
+func (s *Storage) DeleteEvent(roomID string, id int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM room_events WHERE room_id = ? AND id = ?`, roomID, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrEventNotFound
+	}
+	if _, err := tx.Exec(`DELETE FROM room_event_rsvps WHERE event_id = ?`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const eventColumns = `id, room_id, creator, title, location, starts_at, ends_at, content, created_at, updated_at`
+
+func scanEvent(scan func(...interface{}) error) (*Event, error) {
+	var e Event
+	var startsAt, endsAt, createdAt, updatedAt int64
+	if err := scan(&e.ID, &e.Room, &e.Creator, &e.Title, &e.Location, &startsAt, &endsAt, &e.Content,
+		&createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	if startsAt != 0 {
+		start := time.Unix(startsAt, 0)
+		e.Start = &start
+	}
+	if endsAt != 0 {
+		end := time.Unix(endsAt, 0)
+		e.End = &end
+	}
+	e.CreatedAt, e.UpdatedAt = time.Unix(createdAt, 0), time.Unix(updatedAt, 0)
+	e.RSVPs = []RSVP{}
+	return &e, nil
+}
+
+// Event returns one of a room's events with its RSVPs
+func (s *Storage) Event(roomID string, id int64) (*Event, error) {
+	row := s.db.QueryRow(`SELECT `+eventColumns+` FROM room_events WHERE room_id = ? AND id = ?`, roomID, id)
+	e, err := scanEvent(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, ErrEventNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := s.loadRSVPs(roomID, []*Event{e}); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Events lists a room's events with their RSVPs, newest first, below id before when it isn't 0
+func (s *Storage) Events(roomID string, before int64, limit int) ([]*Event, error) {
+	querySQL := `SELECT ` + eventColumns + ` FROM room_events
+	WHERE room_id = ? AND (? = 0 OR id < ?) ORDER BY id DESC LIMIT ?`
+	rows, err := s.db.Query(querySQL, roomID, before, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	events := []*Event{}
+	for rows.Next() {
+		e, err := scanEvent(rows.Scan)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.loadRSVPs(roomID, events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// ScheduledEvents lists a room's events that have a start time, soonest first, for calendar export
+func (s *Storage) ScheduledEvents(roomID string, limit int) ([]*Event, error) {
+	querySQL := `SELECT ` + eventColumns + ` FROM room_events
+	WHERE room_id = ? AND starts_at != 0 ORDER BY starts_at, id LIMIT ?`
+	rows, err := s.db.Query(querySQL, roomID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*Event{}
+	for rows.Next() {
+		e, err := scanEvent(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// loadRSVPs fills in the RSVPs of events, all from roomID
+func (s *Storage) loadRSVPs(roomID string, events []*Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	byID := make(map[int64]*Event, len(events))
+	low, high := events[0].ID, events[0].ID
+	for _, e := range events {
+		byID[e.ID] = e
+		low, high = min(low, e.ID), max(high, e.ID)
+	}
+	// one query for the id range is cheaper than one per event, answers to other events are skipped
+	rows, err := s.db.Query(`SELECT event_id, username, status, updated_at FROM room_event_rsvps
+	WHERE room_id = ? AND event_id BETWEEN ? AND ? ORDER BY updated_at, username`, roomID, low, high)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, updatedAt int64
+		var rsvp RSVP
+		if err := rows.Scan(&id, &rsvp.Username, &rsvp.Status, &updatedAt); err != nil {
+			return err
+		}
+		if e, ok := byID[id]; ok {
+			rsvp.UpdatedAt = time.Unix(updatedAt, 0)
+			e.RSVPs = append(e.RSVPs, rsvp)
+		}
+	}
+	return rows.Err()
+}
+
+// SetRSVP records a member's answer to an event, replacing an earlier one. An empty status
+// withdraws the answer
+func (s *Storage) SetRSVP(roomID string, id int64, username, status string) error {
+	switch status {
+	case RSVPYes, RSVPNo, RSVPMaybe, "":
+	default:
+		return ErrInvalidRSVP
+	}
+	var exists bool
+	if err := s.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM room_events WHERE room_id = ? AND id = ?)`, roomID, id).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrEventNotFound
+	}
+	if status == "" {
+		_, err := s.db.Exec(`DELETE FROM room_event_rsvps WHERE event_id = ? AND username = ?`, id, username)
+		return err
+	}
+	upsertSQL := `INSERT INTO room_event_rsvps (room_id, event_id, username, status, updated_at) VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT (event_id, username) DO UPDATE SET status = excluded.status, updated_at = excluded.updated_at`
+	_, err := s.db.Exec(upsertSQL, roomID, id, username, status, time.Now().Unix())
+	return err
+}
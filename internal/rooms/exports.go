@@ -0,0 +1,216 @@
+package rooms
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+// ErrNoExport is returned for rooms without an export schedule
+var ErrNoExport = errors.New("room has no export schedule")
+
+// export destinations
+const (
+	ExportWebhook = "webhook" // posted to a URL the moderators run
+	ExportS3      = "s3"      // written to the server's S3 bucket
+)
+
+// export frequencies
+const (
+	ExportDaily   = "daily"
+	ExportWeekly  = "weekly"
+	ExportMonthly = "monthly"
+)
+
+// export outcomes
+const (
+	ExportOK     = "ok"
+	ExportFailed = "failed"
+)
+
+// NextExport returns when an export made at t is followed by the next, false for an unknown
+// frequency
+func NextExport(every string, t time.Time) (time.Time, bool) {
+	switch every {
+	case ExportDaily:
+		return t.AddDate(0, 0, 1), true
+	case ExportWeekly:
+		return t.AddDate(0, 0, 7), true
+	case ExportMonthly:
+		return t.AddDate(0, 1, 0), true
+	}
+	return time.Time{}, false
+}
+
+// Export is a recurring export of a room's messages, still encrypted, set up by its
+// moderators. Each run exports the messages posted since the one before
+type Export struct {
+	Room        string    `json:"room"`
+	Destination string    `json:"destination"`
+	URL         string    `json:"url,omitempty"` // webhooks only
+	Every       string    `json:"every"`
+	CreatedBy   string    `json:"createdBy"`
+	CreatedAt   time.Time `json:"createdAt"`
+	// signs webhook deliveries, only returned when the schedule is set
+	Secret string `json:"secret,omitempty"`
+	// the last room sequence number exported
+	Exported int64     `json:"exported"`
+	NextRun  time.Time `json:"nextRun"`
+	// the outcome of the last run, with where it was written and how many messages it had
+	LastRun      *time.Time `json:"lastRun,omitempty"`
+	LastStatus   string     `json:"lastStatus,omitempty"`
+	LastLocation string     `json:"lastLocation,omitempty"`
+	LastMessages int        `json:"lastMessages"`
+	// failed runs in a row, the next is tried at NextRun
+	Failures  int    `json:"failures"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+func createExportTable(db *sql.DB) {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS room_exports (
+		"room_id" TEXT NOT NULL PRIMARY KEY,
+		"destination" TEXT NOT NULL,
+		"url" TEXT NOT NULL DEFAULT '',
+		"secret" TEXT NOT NULL DEFAULT '',
+		"every" TEXT NOT NULL,
+		"created_by" TEXT NOT NULL,
+		"created_at" INTEGER NOT NULL,
+		"exported" INTEGER NOT NULL DEFAULT 0,
+		"next_run" INTEGER NOT NULL,
+		"last_run" INTEGER NOT NULL DEFAULT 0,
+		"last_status" TEXT NOT NULL DEFAULT '',
+		"last_location" TEXT NOT NULL DEFAULT '',
+		"last_messages" INTEGER NOT NULL DEFAULT 0,
+		"failures" INTEGER NOT NULL DEFAULT 0,
+		"last_error" TEXT NOT NULL DEFAULT '');`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Fatalf("Failed to create room_exports table: %v", err)
+	}
+}
+
+// SetExport schedules a room's exports. Webhooks get a new secret, returned once here.
+// A new schedule starts after the room's latest message with the first run one period away,
+// or before its first message with the first run straight away with backfill; replacing one
+// keeps its place, so changing the destination or frequency loses nothing
+func (s *Storage) SetExport(roomID, destination, url, every, by string, backfill bool) (*Export, error) {
+	var secret string
+	if destination == ExportWebhook {
+		var err error
+		if secret, err = newArchiveSecret(); err != nil {
+			return nil, err
+		}
+	}
+	now := time.Now()
+	next, ok := NextExport(every, now)
+	if !ok {
+		return nil, errors.New("unknown export frequency " + every)
+	}
+	var exported int64
+	if backfill {
+		next = now
+	} else {
+		latestSQL := `SELECT COALESCE(MAX(seq), 0) FROM room_messages WHERE room_id = ?`
+		if err := s.db.QueryRow(latestSQL, roomID).Scan(&exported); err != nil {
+			return nil, err
+		}
+	}
+	upsertSQL := `INSERT INTO room_exports (room_id, destination, url, secret, every, created_by, created_at, exported, next_run)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (room_id) DO UPDATE SET destination = excluded.destination, url = excluded.url, secret = excluded.secret,
+		every = excluded.every, created_by = excluded.created_by, created_at = excluded.created_at,
+		next_run = MIN(next_run, excluded.next_run), failures = 0, last_error = ''`
+	if _, err := s.db.Exec(upsertSQL, roomID, destination, url, secret, every, by, now.Unix(), exported, next.Unix()); err != nil {
+		return nil, err
+	}
+	export, err := s.Export(roomID)
+	if err != nil {
+		return nil, err
+	}
+	export.Secret = secret
+	return export, nil
+}
+
+const exportColumns = `room_id, destination, url, secret, every, created_by, created_at, exported, next_run,
+	last_run, last_status, last_location, last_messages, failures, last_error`
+
+// scanExport reads a row of exportColumns, the secret included
+func scanExport(row interface{ Scan(...interface{}) error }) (*Export, error) {
+	var e Export
+	var createdAt, nextRun, lastRun int64
+	err := row.Scan(&e.Room, &e.Destination, &e.URL, &e.Secret, &e.Every, &e.CreatedBy, &createdAt, &e.Exported, &nextRun,
+		&lastRun, &e.LastStatus, &e.LastLocation, &e.LastMessages, &e.Failures, &e.LastError)
+	if err != nil {
+		return nil, err
+	}
+	e.CreatedAt = time.Unix(createdAt, 0)
+	e.NextRun = time.Unix(nextRun, 0)
+	if lastRun > 0 {
+		t := time.Unix(lastRun, 0)
+		e.LastRun = &t
+	}
+	return &e, nil
+}
+
+// Export returns a room's export schedule without its secret, ErrNoExport if it has none
+func (s *Storage) Export(roomID string) (*Export, error) {
+	export, err := scanExport(s.db.QueryRow(`SELECT `+exportColumns+` FROM room_exports WHERE room_id = ?`, roomID))
+	if err == sql.ErrNoRows {
+		return nil, ErrNoExport
+	}
+	if err != nil {
+		return nil, err
+	}
+	export.Secret = ""
+	return export, nil
+}
+
+// RemoveExport stops a room's exports
+func (s *Storage) RemoveExport(roomID string) error {
+	res, err := s.db.Exec(`DELETE FROM room_exports WHERE room_id = ?`, roomID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNoExport
+	}
+	return nil
+}
+
+// DueExports returns the schedules whose next run has come, secrets included
+func (s *Storage) DueExports(now time.Time) ([]Export, error) {
+	rows, err := s.db.Query(`SELECT `+exportColumns+` FROM room_exports WHERE next_run <= ?`, now.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var exports []Export
+	for rows.Next() {
+		export, err := scanExport(rows)
+		if err != nil {
+			return nil, err
+		}
+		exports = append(exports, *export)
+	}
+	return exports, rows.Err()
+}
+
+// ExportDone records a run that exported the messages up to seq to location, the next
+// run is at next
+func (s *Storage) ExportDone(roomID string, seq int64, location string, messages int, next time.Time) error {
+	updateSQL := `UPDATE room_exports SET exported = MAX(exported, ?), next_run = ?, last_run = ?, last_status = ?,
+		last_location = ?, last_messages = ?, failures = 0, last_error = '' WHERE room_id = ?`
+	_, err := s.db.Exec(updateSQL, seq, next.Unix(), time.Now().Unix(), ExportOK, location, messages, roomID)
+	return err
+}
+
+// ExportFailed records a failed run, the next is tried at next
+func (s *Storage) ExportFailed(roomID, reason string, next time.Time) error {
+	updateSQL := `UPDATE room_exports SET failures = failures + 1, next_run = ?, last_run = ?, last_status = ?,
+		last_error = ? WHERE room_id = ?`
+	_, err := s.db.Exec(updateSQL, next.Unix(), time.Now().Unix(), ExportFailed, reason, roomID)
+	return err
+}
@@ -0,0 +1,157 @@
+package rooms
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+// MaxJoinAnswerLength limits the answer to a room's join question, in bytes
+const MaxJoinAnswerLength = 1024
+
+var (
+	ErrRulesNotAccepted    = errors.New("the room rules must be accepted to join")
+	ErrJoinAnswerRequired  = errors.New("the join question must be answered")
+	ErrJoinRequestNotFound = errors.New("no pending join request")
+)
+
+// Gate is what a public room asks of people joining it
+type Gate struct {
+	Rules    string `json:"rules,omitempty"`    // must be accepted
+	Question string `json:"question,omitempty"` // answered and reviewed by a moderator
+}
+
+// JoinRequest is someone waiting for a moderator to review their answer
+type JoinRequest struct {
+	Username  string    `json:"username"`
+	Answer    string    `json:"answer"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func createJoinRequestTable(db *sql.DB) {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS room_join_requests (
+		"room_id" TEXT NOT NULL,
+		"username" TEXT NOT NULL,
+		"answer" TEXT NOT NULL,
+		"created_at" INTEGER NOT NULL,
+		PRIMARY KEY ("room_id", "username"));
+	CREATE INDEX IF NOT EXISTS room_join_requests_username ON room_join_requests (username);`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Fatalf("Failed to create room_join_requests table: %v", err)
+	}
+}
+
+// Gate returns the rules and question of a public room, private rooms report ErrNotFound
+func (s *Storage) Gate(roomID string) (*Gate, error) {
+	room, err := s.Get(roomID)
+	if err != nil {
+		return nil, err
+	}
+	if !room.Public {
+		return nil, ErrNotFound
+	}
+	return &Gate{Rules: room.Rules, Question: room.JoinQuestion}, nil
+}
+
+// Join adds username to a public room as a member, private rooms report ErrNotFound.
+// Rooms with rules need acceptRules, and rooms with a join question get a pending request
+// holding answer instead, reported by pending, for a moderator to approve
+func (s *Storage) Join(roomID, username string, acceptRules bool, answer string) (pending bool, err error) {
+	room, err := s.Get(roomID)
+	if err != nil {
+		return false, err
+	}
+	if !room.Public {
+		return false, ErrNotFound
+	}
+	if room.Rules != "" && !acceptRules {
+		return false, ErrRulesNotAccepted
+	}
+	if room.JoinQuestion == "" {
+		return false, s.AddMember(roomID, username, RoleMember)
+	}
+
+	answer = strings.TrimSpace(answer)
+	if answer == "" || len(answer) > MaxJoinAnswerLength {
+		return false, ErrJoinAnswerRequired
+	}
+	if _, err := s.Role(roomID, username); err == nil {
+		return false, ErrMemberExists
+	} else if err != ErrNotMember {
+		return false, err
+	}
+	// asking again replaces the earlier answer
+	upsertSQL := `INSERT INTO room_join_requests (room_id, username, answer, created_at) VALUES (?, ?, ?, ?)
+	ON CONFLICT(room_id, username) DO UPDATE SET answer = excluded.answer, created_at = excluded.created_at`
+	if _, err := s.db.Exec(upsertSQL, roomID, username, answer, time.Now().Unix()); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// JoinRequests lists a room's pending join requests, oldest first
+func (s *Storage) JoinRequests(roomID string) ([]JoinRequest, error) {
+	rows, err := s.db.Query(`SELECT username, answer, created_at FROM room_join_requests WHERE room_id = ? ORDER BY created_at, username`, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	requests := []JoinRequest{}
+	for rows.Next() {
+		var req JoinRequest
+		var createdAt int64
+		if err := rows.Scan(&req.Username, &req.Answer, &createdAt); err != nil {
+			return nil, err
+		}
+		req.CreatedAt = time.Unix(createdAt, 0)
+		requests = append(requests, req)
+	}
+	return requests, rows.Err()
+}
+
+// ApproveJoin makes the author of a pending join request a member
+func (s *Storage) ApproveJoin(roomID, username string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM room_join_requests WHERE room_id = ? AND username = ?`, roomID, username)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrJoinRequestNotFound
+	}
+	// someone added by a moderator in the meantime keeps the role they were given
+	if _, err := tx.Exec(`INSERT OR IGNORE INTO room_members (room_id, username, role, joined_at) VALUES (?, ?, ?, ?)`,
+		roomID, username, RoleMember, time.Now().Unix()); err != nil {
+		return err
+	}
+	if err := recordChange(tx, roomID, username); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.invalidate(roomID)
+	return nil
+}
+
+// DeleteJoinRequest drops a pending join request, rejected by a moderator or withdrawn
+func (s *Storage) DeleteJoinRequest(roomID, username string) error {
+	result, err := s.db.Exec(`DELETE FROM room_join_requests WHERE room_id = ? AND username = ?`, roomID, username)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrJoinRequestNotFound
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package rooms
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// MaxPins is how many messages a room can have pinned at once
+const MaxPins = 50
+
+var (
+	ErrNoAvatar      = errors.New("room has no avatar")
+	ErrInvalidAvatar = errors.New("avatar must be a PNG, GIF, WebP or JPEG image")
+	ErrTooManyPins   = fmt.Errorf("a room can have at most %d pinned messages", MaxPins)
+	ErrNotPinned     = errors.New("message is not pinned")
+)
+
+// avatar types accepted for upload, as reported by http.DetectContentType
+var avatarTypes = map[string]bool{
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+	"image/jpeg": true,
+}
+
+// Avatar is a room's stored avatar image
+type Avatar struct {
+	ContentType string
+	ETag        string
+	Data        []byte
+}
+
+// Pin references a pinned room message by its sequence number
+type Pin struct {
+	Seq      int64     `json:"seq"`
+	PinnedBy string    `json:"pinnedBy"`
+	PinnedAt time.Time `json:"pinnedAt"`
+}
+
+func createMetadataTables(db *sql.DB) {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS room_avatars (
+		"room_id" TEXT NOT NULL PRIMARY KEY,
+		"content_type" TEXT NOT NULL,
+		"etag" TEXT NOT NULL,
+		"data" BLOB NOT NULL);
+	CREATE TABLE IF NOT EXISTS room_pins (
+		"room_id" TEXT NOT NULL,
+		"seq" INTEGER NOT NULL,
+		"pinned_by" TEXT NOT NULL,
+		"pinned_at" INTEGER NOT NULL,
+		PRIMARY KEY ("room_id", "seq"));`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Fatalf("Failed to create room metadata tables: %v", err)
+	}
+}
+
+// avatarURL is where clients load a room avatar, the etag makes replaced images a new URL
+func (s *Storage) avatarURL(roomID, etag string) string {
+	if etag == "" {
+		return ""
+	}
+	return s.basePath + "/api/rooms/" + roomID + "/avatar?v=" + etag[1:9]
+}
+
+// SetAvatar stores data as the room's avatar and returns its URL
+func (s *Storage) SetAvatar(roomID string, data []byte) (string, error) {
+	// trust the bytes, not the client supplied Content-Type
+	contentType := http.DetectContentType(data)
+	if len(data) == 0 || !avatarTypes[contentType] {
+		return "", ErrInvalidAvatar
+	}
+	if _, err := s.Get(roomID); err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	upsertSQL := `INSERT INTO room_avatars (room_id, content_type, etag, data) VALUES (?, ?, ?, ?)
+	ON CONFLICT(room_id) DO UPDATE SET content_type = excluded.content_type, etag = excluded.etag, data = excluded.data`
+	if _, err := s.db.Exec(upsertSQL, roomID, contentType, etag, data); err != nil {
+		return "", err
+	}
+	s.invalidate(roomID)
+	return s.avatarURL(roomID, etag), recordChange(s.db, roomID, "")
+}
+
+// Avatar returns a room's avatar image
+func (s *Storage) Avatar(roomID string) (*Avatar, error) {
+	var a Avatar
+	err := s.db.QueryRow(`SELECT content_type, etag, data FROM room_avatars WHERE room_id = ?`, roomID).
+		Scan(&a.ContentType, &a.ETag, &a.Data)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoAvatar
+	}
+	return &a, err
+}
+
+// DeleteAvatar removes a room's avatar
+func (s *Storage) DeleteAvatar(roomID string) error {
+	result, err := s.db.Exec(`DELETE FROM room_avatars WHERE room_id = ?`, roomID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNoAvatar
+	}
+	s.invalidate(roomID)
+	return recordChange(s.db, roomID, "")
+}
+
+// Pins lists a room's pinned messages, most recently pinned first
+func (s *Storage) Pins(roomID string) ([]Pin, error) {
+	rows, err := s.db.Query(`SELECT seq, pinned_by, pinned_at FROM room_pins WHERE room_id = ? ORDER BY pinned_at DESC, seq DESC`, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pins := []Pin{}
+	for rows.Next() {
+		var p Pin
+		var pinnedAt int64
+		if err := rows.Scan(&p.Seq, &p.PinnedBy, &pinnedAt); err != nil {
+			return nil, err
+		}
+		p.PinnedAt = time.Unix(pinnedAt, 0)
+		pins = append(pins, p)
+	}
+	return pins, rows.Err()
+}
+
+// Pin pins the room message with seq, pinning it again only refreshes who pinned it
+func (s *Storage) Pin(roomID string, seq int64, username string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var count int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM room_pins WHERE room_id = ? AND seq != ?`, roomID, seq).Scan(&count); err != nil {
+		return err
+	}
+	if count >= MaxPins {
+		return ErrTooManyPins
+	}
+	upsertSQL := `INSERT INTO room_pins (room_id, seq, pinned_by, pinned_at) VALUES (?, ?, ?, ?)
+	ON CONFLICT(room_id, seq) DO UPDATE SET pinned_by = excluded.pinned_by, pinned_at = excluded.pinned_at`
+	if _, err := tx.Exec(upsertSQL, roomID, seq, username, time.Now().Unix()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Unpin removes a pin
+func (s *Storage) Unpin(roomID string, seq int64) error {
+	result, err := s.db.Exec(`DELETE FROM room_pins WHERE room_id = ? AND seq = ?`, roomID, seq)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotPinned
+	}
+	return nil
+}
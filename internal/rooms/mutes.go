@@ -0,0 +1,85 @@
+package rooms
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+func createMuteTable(db *sql.DB) {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS room_mutes (
+		"room_id" TEXT NOT NULL,
+		"username" TEXT NOT NULL,
+		"muted_by" TEXT NOT NULL,
+		"until" INTEGER NOT NULL, -- unix seconds, 0 until unmuted
+		PRIMARY KEY ("room_id", "username"));`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Fatalf("Failed to create room_mutes table: %v", err)
+	}
+}
+
+// Muted reports whether username is muted in the room and until when, a zero time means until unmuted
+func (s *Snapshot) Muted(username string, now time.Time) (time.Time, bool) {
+	until, ok := s.Mutes[username]
+	if !ok || (!until.IsZero() && !until.After(now)) {
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+// Mute stops a member from posting until the given time, or until unmuted when until is zero
+func (s *Storage) Mute(roomID, username, by string, until time.Time) error {
+	if _, err := s.Role(roomID, username); err != nil {
+		return err
+	}
+	var untilUnix int64
+	if !until.IsZero() {
+		untilUnix = until.Unix()
+	}
+	upsertSQL := `INSERT INTO room_mutes (room_id, username, muted_by, until) VALUES (?, ?, ?, ?)
+	ON CONFLICT(room_id, username) DO UPDATE SET muted_by = excluded.muted_by, until = excluded.until`
+	if _, err := s.db.Exec(upsertSQL, roomID, username, by, untilUnix); err != nil {
+		return err
+	}
+	s.invalidate(roomID)
+	return nil
+}
+
+// Unmute lets a member post again, ErrNotMuted if they weren't muted
+func (s *Storage) Unmute(roomID, username string) error {
+	result, err := s.db.Exec(`DELETE FROM room_mutes WHERE room_id = ? AND username = ?`, roomID, username)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotMuted
+	}
+	s.invalidate(roomID)
+	return nil
+}
+
+// mutes loads a room's unexpired mutes for its snapshot
+func (s *Storage) mutes(roomID string) (map[string]time.Time, error) {
+	rows, err := s.db.Query(`SELECT username, until FROM room_mutes WHERE room_id = ? AND (until = 0 OR until > ?)`,
+		roomID, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mutes := make(map[string]time.Time)
+	for rows.Next() {
+		var username string
+		var until int64
+		if err := rows.Scan(&username, &until); err != nil {
+			return nil, err
+		}
+		mutes[username] = time.Time{}
+		if until != 0 {
+			mutes[username] = time.Unix(until, 0)
+		}
+	}
+	return mutes, rows.Err()
+}
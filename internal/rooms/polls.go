@@ -0,0 +1,357 @@
+package rooms
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// limits on the number of choices a poll offers
+const (
+	MinPollOptions = 2
+	MaxPollOptions = 20
+)
+
+// MaxPollDuration is the furthest in the future a poll's deadline can be
+const MaxPollDuration = 90 * 24 * time.Hour
+
+// MaxPollContentSize is the largest encrypted question and choices accepted, in bytes
+const MaxPollContentSize = 16 << 10
+
+var (
+	ErrPollNotFound = errors.New("poll not found")
+	ErrInvalidPoll  = fmt.Errorf("a poll needs encrypted content of at most %d bytes, %d to %d options and a deadline within %d days",
+		MaxPollContentSize, MinPollOptions, MaxPollOptions, MaxPollDuration/(24*time.Hour))
+	ErrInvalidVote = errors.New("vote for one of the poll's options")
+	ErrPollClosed  = errors.New("poll is closed")
+)
+
+// Poll is a question put to a room. The question and the choices are in Content, encrypted for
+// members; the server only knows how many choices there are and counts votes by their index
+type Poll struct {
+	ID        int64      `json:"id"`
+	Room      string     `json:"room"`
+	Creator   string     `json:"creator"`
+	Content   []byte     `json:"content"` // encrypted
+	Options   int        `json:"options"`
+	Anonymous bool       `json:"anonymous"`          // votes are counted without recording who cast them
+	ClosesAt  *time.Time `json:"closesAt,omitempty"` // deadline, none when the poll stays open until closed
+	ClosedAt  *time.Time `json:"closedAt,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+	Tally     []int      `json:"tally"`           // votes per option
+	Votes     []Vote     `json:"votes,omitempty"` // who voted for what, left out for anonymous polls
+	MyVote    *int       `json:"myVote,omitempty"`
+}
+
+// Vote is one member's choice in a poll that isn't anonymous
+type Vote struct {
+	Username string `json:"username"`
+	Option   int    `json:"option"`
+}
+
+// Closed reports whether the poll no longer takes votes at now
+func (p *Poll) Closed(now time.Time) bool {
+	return p.ClosedAt != nil || (p.ClosesAt != nil && !now.Before(*p.ClosesAt))
+}
+
+func createPollTables(db *sql.DB) {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS room_polls (
+		"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+		"room_id" TEXT NOT NULL,
+		"creator" TEXT NOT NULL,
+		"content" BLOB NOT NULL,
+		"options" INTEGER NOT NULL,
+		"anonymous" INTEGER NOT NULL DEFAULT 0,
+		"salt" BLOB,
+		"closes_at" INTEGER NOT NULL DEFAULT 0,
+		"closed_at" INTEGER NOT NULL DEFAULT 0,
+		"created_at" INTEGER NOT NULL);
+	CREATE INDEX IF NOT EXISTS room_polls_room ON room_polls (room_id, id);
+	CREATE INDEX IF NOT EXISTS room_polls_deadline ON room_polls (closes_at) WHERE closes_at != 0 AND closed_at = 0;
+	CREATE TABLE IF NOT EXISTS room_poll_votes (
+		"room_id" TEXT NOT NULL,
+		"poll_id" INTEGER NOT NULL,
+		"voter" TEXT NOT NULL,
+		"option" INTEGER NOT NULL,
+		"voted_at" INTEGER NOT NULL,
+		PRIMARY KEY ("poll_id", "voter"));`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Fatalf("Failed to create room poll tables: %v", err)
+	}
+}
+
+// voterKey is what a vote is stored under: the username, or for anonymous polls a hash of it
+// salted per poll, which still allows one vote per member and changing it but keeps the
+// votes table from listing who voted. A renamed member hashes differently, so can vote again
+func voterKey(salt []byte, username string) string {
+	if salt == nil {
+		return username
+	}
+	sum := sha256.Sum256(append(append([]byte{}, salt...), username...))
+	return hex.EncodeToString(sum[:16])
+}
+
+// AddPoll stores a new poll in a room, filling in its id, time and empty tally
+func (s *Storage) AddPoll(p *Poll) error {
+	now := time.Unix(time.Now().Unix(), 0)
+	if len(p.Content) == 0 || len(p.Content) > MaxPollContentSize || p.Options < MinPollOptions || p.Options > MaxPollOptions {
+		return ErrInvalidPoll
+	}
+	if p.ClosesAt != nil && (!p.ClosesAt.After(now) || p.ClosesAt.Sub(now) > MaxPollDuration) {
+		return ErrInvalidPoll
+	}
+	if _, err := s.Get(p.Room); err != nil {
+		return err
+	}
+	var salt []byte
+	if p.Anonymous {
+		salt = make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return err
+		}
+	}
+
+	insertSQL := `INSERT INTO room_polls (room_id, creator, content, options, anonymous, salt, closes_at, created_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	result, err := s.db.Exec(insertSQL, p.Room, p.Creator, p.Content, p.Options, p.Anonymous, salt, unixOrZero(p.ClosesAt), now.Unix())
+	if err != nil {
+		return err
+	}
+	if p.ID, err = result.LastInsertId(); err != nil {
+		return err
+	}
+	p.CreatedAt, p.Tally = now, make([]int, p.Options)
+	return nil
+}
+
+const pollColumns = `id, room_id, creator, content, options, anonymous, salt, closes_at, closed_at, created_at`
+
+func scanPoll(scan func(...interface{}) error) (*Poll, []byte, error) {
+	var p Poll
+	var salt []byte
+	var closesAt, closedAt, createdAt int64
+	if err := scan(&p.ID, &p.Room, &p.Creator, &p.Content, &p.Options, &p.Anonymous, &salt, &closesAt, &closedAt, &createdAt); err != nil {
+		return nil, nil, err
+	}
+	if closesAt != 0 {
+		t := time.Unix(closesAt, 0)
+		p.ClosesAt = &t
+	}
+	if closedAt != 0 {
+		t := time.Unix(closedAt, 0)
+		p.ClosedAt = &t
+	}
+	p.CreatedAt = time.Unix(createdAt, 0)
+	p.Tally = make([]int, p.Options)
+	return &p, salt, nil
+}
+
+// Poll returns one of a room's polls with its tally, and viewer's own vote when viewer isn't empty
+func (s *Storage) Poll(roomID string, id int64, viewer string) (*Poll, error) {
+	row := s.db.QueryRow(`SELECT `+pollColumns+` FROM room_polls WHERE room_id = ? AND id = ?`, roomID, id)
+	p, salt, err := scanPoll(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, ErrPollNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := s.loadVotes([]*Poll{p}, map[int64][]byte{p.ID: salt}, viewer); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Polls lists a room's polls with their tallies, newest first, below id before when it isn't 0
+func (s *Storage) Polls(roomID string, before int64, limit int, viewer string) ([]*Poll, error) {
+	querySQL := `SELECT ` + pollColumns + ` FROM room_polls
+	WHERE room_id = ? AND (? = 0 OR id < ?) ORDER BY id DESC LIMIT ?`
+	rows, err := s.db.Query(querySQL, roomID, before, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	polls := []*Poll{}
+	salts := map[int64][]byte{}
+	for rows.Next() {
+		p, salt, err := scanPoll(rows.Scan)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		polls = append(polls, p)
+		salts[p.ID] = salt
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.loadVotes(polls, salts, viewer); err != nil {
+		return nil, err
+	}
+	return polls, nil
+}
+
+// loadVotes counts the votes of polls, lists the voters of those that aren't anonymous and
+// finds viewer's own vote
+func (s *Storage) loadVotes(polls []*Poll, salts map[int64][]byte, viewer string) error {
+	for _, p := range polls {
+		rows, err := s.db.Query(`SELECT voter, option FROM room_poll_votes WHERE poll_id = ? ORDER BY voted_at, voter`, p.ID)
+		if err != nil {
+			return err
+		}
+		mine := voterKey(salts[p.ID], viewer)
+		for rows.Next() {
+			var voter string
+			var option int
+			if err := rows.Scan(&voter, &option); err != nil {
+				rows.Close()
+				return err
+			}
+			if option < 0 || option >= p.Options {
+				continue
+			}
+			p.Tally[option]++
+			if !p.Anonymous {
+				p.Votes = append(p.Votes, Vote{Username: voter, Option: option})
+			}
+			if viewer != "" && voter == mine {
+				p.MyVote = &option
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Vote records username's choice in a poll, replacing their earlier one, or withdraws it when
+// option is negative. It returns the poll with the new tally, seen by username
+func (s *Storage) Vote(roomID string, id int64, username string, option int) (*Poll, error) {
+	row := s.db.QueryRow(`SELECT `+pollColumns+` FROM room_polls WHERE room_id = ? AND id = ?`, roomID, id)
+	p, salt, err := scanPoll(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, ErrPollNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if p.Closed(now) {
+		return nil, ErrPollClosed
+	}
+	if option >= p.Options {
+		return nil, ErrInvalidVote
+	}
+
+	voter := voterKey(salt, username)
+	if option < 0 {
+		_, err = s.db.Exec(`DELETE FROM room_poll_votes WHERE poll_id = ? AND voter = ?`, id, voter)
+	} else {
+		upsertSQL := `INSERT INTO room_poll_votes (room_id, poll_id, voter, option, voted_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (poll_id, voter) DO UPDATE SET option = excluded.option, voted_at = excluded.voted_at`
+		_, err = s.db.Exec(upsertSQL, roomID, id, voter, option, now.Unix())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := s.loadVotes([]*Poll{p}, map[int64][]byte{p.ID: salt}, username); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// ClosePoll stops a poll taking votes ahead of its deadline
+func (s *Storage) ClosePoll(roomID string, id int64) error {
+	result, err := s.db.Exec(`UPDATE room_polls SET closed_at = ? WHERE room_id = ? AND id = ? AND closed_at = 0`,
+		time.Now().Unix(), roomID, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		var exists bool
+		if err := s.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM room_polls WHERE room_id = ? AND id = ?)`, roomID, id).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return ErrPollNotFound
+		}
+		return ErrPollClosed
+	}
+	return nil
+}
+
+// CloseDuePolls closes the polls whose deadline has passed by now and returns them with their
+// final tallies
+func (s *Storage) CloseDuePolls(now time.Time) ([]*Poll, error) {
+	rows, err := s.db.Query(`SELECT `+pollColumns+` FROM room_polls
+	WHERE closes_at != 0 AND closes_at <= ? AND closed_at = 0`, now.Unix())
+	if err != nil {
+		return nil, err
+	}
+	var due []*Poll
+	salts := map[int64][]byte{}
+	for rows.Next() {
+		p, salt, err := scanPoll(rows.Scan)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		due = append(due, p)
+		salts[p.ID] = salt
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	closed := []*Poll{}
+	for _, p := range due {
+		// the deadline is when it closed, however late this run is
+		result, err := s.db.Exec(`UPDATE room_polls SET closed_at = closes_at WHERE id = ? AND closed_at = 0`, p.ID)
+		if err != nil {
+			return nil, err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			continue
+		}
+		p.ClosedAt = p.ClosesAt
+		closed = append(closed, p)
+	}
+	if err := s.loadVotes(closed, salts, ""); err != nil {
+		return nil, err
+	}
+	return closed, nil
+}
+
+// DeletePoll removes a poll and its votes
+func (s *Storage) DeletePoll(roomID string, id int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM room_polls WHERE room_id = ? AND id = ?`, roomID, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrPollNotFound
+	}
+	if _, err := tx.Exec(`DELETE FROM room_poll_votes WHERE poll_id = ?`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
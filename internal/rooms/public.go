@@ -0,0 +1,153 @@
+package rooms
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/textpolicy"
+)
+
+var (
+	ErrBroadcastNotAllowed = errors.New("only public announcement rooms can broadcast")
+	ErrNotBroadcast        = errors.New("room does not broadcast")
+	ErrPublicPostNotFound  = errors.New("public post not found")
+)
+
+// PublicPost is an announcement posted unencrypted so it can be shown outside the app, on
+// the room's public page. Regular room messages stay end to end encrypted
+type PublicPost struct {
+	ID        int64     `json:"id"`
+	Author    string    `json:"author"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func createPublicPostTable(db *sql.DB) {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS room_public_posts (
+		"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+		"room_id" TEXT NOT NULL,
+		"author" TEXT NOT NULL,
+		"text" TEXT NOT NULL,
+		"created_at" INTEGER NOT NULL);
+	CREATE INDEX IF NOT EXISTS room_public_posts_room ON room_public_posts (room_id, id);`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Fatalf("Failed to create room_public_posts table: %v", err)
+	}
+}
+
+// Broadcasting returns a room that publishes its public posts, other rooms report ErrNotFound
+// so the public page doesn't reveal that they exist
+func (s *Storage) Broadcasting(roomID string) (*Room, error) {
+	room, err := s.Get(roomID)
+	if err != nil {
+		return nil, err
+	}
+	if !room.Broadcast {
+		return nil, ErrNotFound
+	}
+	return room, nil
+}
+
+// AddPublicPost stores text as a public post in a broadcasting room. The text goes through the
+// text policy like other plaintext, the error may be a *textpolicy.Error
+func (s *Storage) AddPublicPost(roomID, author, text string) (*PublicPost, error) {
+	room, err := s.Get(roomID)
+	if err != nil {
+		return nil, err
+	}
+	if !room.Broadcast {
+		return nil, ErrNotBroadcast
+	}
+	if text, err = s.text.Clean(textpolicy.PublicPost, text); err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`INSERT INTO room_public_posts (room_id, author, text, created_at) VALUES (?, ?, ?, ?)`,
+		roomID, author, text, now)
+	if err != nil {
+		return nil, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`UPDATE rooms SET public_updated_at = ? WHERE id = ?`, now, roomID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &PublicPost{ID: id, Author: author, Text: text, CreatedAt: time.Unix(now, 0)}, nil
+}
+
+// PublicPosts lists a room's public posts newest first, starting below id before when it isn't 0
+func (s *Storage) PublicPosts(roomID string, before int64, limit int) ([]PublicPost, error) {
+	querySQL := `SELECT id, author, text, created_at FROM room_public_posts
+	WHERE room_id = ? AND (? = 0 OR id < ?) ORDER BY id DESC LIMIT ?`
+	rows, err := s.db.Query(querySQL, roomID, before, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	posts := []PublicPost{}
+	for rows.Next() {
+		var p PublicPost
+		var createdAt int64
+		if err := rows.Scan(&p.ID, &p.Author, &p.Text, &createdAt); err != nil {
+			return nil, err
+		}
+		p.CreatedAt = time.Unix(createdAt, 0)
+		posts = append(posts, p)
+	}
+	return posts, rows.Err()
+}
+
+// DeletePublicPost removes a public post from a room
+func (s *Storage) DeletePublicPost(roomID string, id int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM room_public_posts WHERE room_id = ? AND id = ?`, roomID, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrPublicPostNotFound
+	}
+	if _, err := tx.Exec(`UPDATE rooms SET public_updated_at = ? WHERE id = ?`, time.Now().Unix(), roomID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// PublicUpdated returns when anything shown on a room's public page last changed: a post was
+// added or removed, or the room's settings or avatar changed
+func (s *Storage) PublicUpdated(roomID string) (time.Time, error) {
+	querySQL := `SELECT MAX(r.created_at, r.public_updated_at,
+		COALESCE((SELECT MAX(created_at) FROM room_changes WHERE room_id = r.id AND username = ''), 0))
+	FROM rooms r WHERE r.id = ?`
+	var updated int64
+	err := s.db.QueryRow(querySQL, roomID).Scan(&updated)
+	if err == sql.ErrNoRows {
+		return time.Time{}, ErrNotFound
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(updated, 0), nil
+}
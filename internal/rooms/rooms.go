@@ -0,0 +1,674 @@
+package rooms
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/dbutil"
+	"github.com/Chase-Garrett/meadowlark/internal/textpolicy"
+)
+
+// member roles, in increasing order of privilege
+const (
+	RoleMember    = "member"
+	RoleModerator = "moderator"
+	RoleOwner     = "owner"
+)
+
+// default limits on room settings, the configured ones are enforced by the text policy
+const (
+	MaxNameLength        = 64
+	MaxTopicLength       = 512
+	MaxDescriptionLength = 4096
+)
+
+// MaxSlowMode is the longest slow mode interval a room can have
+const MaxSlowMode = 6 * 60 * 60
+
+var (
+	ErrNotFound     = errors.New("room not found")
+	ErrNotMember    = errors.New("not a member of this room")
+	ErrInvalidRole  = errors.New("role must be member, moderator or owner")
+	ErrLastOwner    = errors.New("a room must keep at least one owner")
+	ErrMemberExists = errors.New("already a member of this room")
+	ErrNotMuted     = errors.New("member is not muted")
+
+	ErrInvalidSlowMode = fmt.Errorf("slow mode must be between 0 and %d seconds", MaxSlowMode)
+)
+
+// Room is a group conversation. Messages are encrypted by clients with a key shared
+// among members, the server only fans the ciphertext out
+type Room struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	Topic        string `json:"topic"`
+	Description  string `json:"description"`
+	AvatarURL    string `json:"avatarUrl,omitempty"` // set by SetAvatar, not by clients
+	Announcement bool   `json:"announcement"`        // only owners and moderators may post
+	Public       bool   `json:"public"`              // listed in the directory, anyone may join
+	// public announcement rooms only: public posts are shown on a page anyone can read
+	Broadcast bool `json:"broadcast"`
+	// seconds a member must wait between messages, 0 when off. Moderators and owners are exempt
+	SlowMode int `json:"slowMode"`
+	// join gates for public rooms: rules to accept, and a question a moderator reviews the answer to
+	Rules        string `json:"rules,omitempty"`
+	JoinQuestion string `json:"joinQuestion,omitempty"`
+	// who may send attachments, one of the Attachments* constants, and the categories allowed,
+	// empty for all
+	Attachments     string   `json:"attachments"`
+	AttachmentTypes []string `json:"attachmentTypes"`
+	// messages are copied to an archive webhook, set by SetArchive so members can tell
+	Archived  bool      `json:"archived"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Member is a user's membership in a room
+type Member struct {
+	Username string    `json:"username"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joinedAt"`
+}
+
+// Snapshot is a cached view of a room used on the message path
+type Snapshot struct {
+	Room    Room
+	Members map[string]string    // username -> role
+	Mutes   map[string]time.Time // username -> muted until, zero until unmuted
+}
+
+// CanPost reports whether username may send messages to the room
+func (s *Snapshot) CanPost(username string) bool {
+	role, ok := s.Members[username]
+	if !ok {
+		return false
+	}
+	if _, muted := s.Muted(username, time.Now()); muted {
+		return false
+	}
+	return !s.Room.Announcement || rank(role) >= rank(RoleModerator)
+}
+
+// SlowMode returns how long username must wait between messages in the room, 0 when
+// slow mode is off or they moderate it
+func (s *Snapshot) SlowMode(username string) time.Duration {
+	if s.Room.SlowMode <= 0 || rank(s.Members[username]) >= rank(RoleModerator) {
+		return 0
+	}
+	return time.Duration(s.Room.SlowMode) * time.Second
+}
+
+// Capabilities is what a member may do in a room, so clients can hide what would be refused
+type Capabilities struct {
+	Post            bool     `json:"post"`
+	Attach          bool     `json:"attach"`
+	AttachmentTypes []string `json:"attachmentTypes"` // categories they may attach, empty for all
+	SlowMode        int      `json:"slowMode"`        // seconds they must wait between messages
+}
+
+// Capabilities returns what username may do in the room
+func (s *Snapshot) Capabilities(username string) Capabilities {
+	return Capabilities{
+		Post:            s.CanPost(username),
+		Attach:          s.CanAttachAny(username),
+		AttachmentTypes: s.Room.AttachmentTypes,
+		SlowMode:        int(s.SlowMode(username) / time.Second),
+	}
+}
+
+// rank orders roles so permissions can be compared
+func rank(role string) int {
+	switch role {
+	case RoleOwner:
+		return 3
+	case RoleModerator:
+		return 2
+	case RoleMember:
+		return 1
+	}
+	return 0
+}
+
+// AtLeast reports whether role grants at least the privileges of min
+func AtLeast(role, min string) bool {
+	return rank(role) >= rank(min)
+}
+
+// ValidRole reports whether role is one of the known roles
+func ValidRole(role string) bool {
+	return rank(role) > 0
+}
+
+// Storage keeps rooms and memberships in SQLite, with an in-memory snapshot cache
+// so the hub can check permissions without a query per message
+type Storage struct {
+	db   *sql.DB
+	text *textpolicy.Policy // checks names, topics and descriptions
+	// prepended to avatar URLs, empty when the server is at the root
+	basePath string
+
+	mu         sync.Mutex
+	cache      map[string]*Snapshot
+	generation int64 // bumped on every change so a slow load can't cache stale data
+}
+
+// roomTables hold a room's data besides its members, keyed by room_id, and go with the room
+var roomTables = []string{"room_avatars", "room_pins", "room_mutes", "room_join_requests", "room_public_posts",
+	"room_events", "room_event_rsvps", "room_polls", "room_poll_votes", "room_archives", "room_exports"}
+
+// NewStorage initializes the room tables on an open database
+func NewStorage(db *sql.DB, text *textpolicy.Policy, basePath string) *Storage {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS rooms (
+		"id" TEXT NOT NULL PRIMARY KEY,
+		"name" TEXT NOT NULL,
+		"announcement" INTEGER NOT NULL DEFAULT 0,
+		"created_at" INTEGER NOT NULL);
+	CREATE TABLE IF NOT EXISTS room_members (
+		"room_id" TEXT NOT NULL,
+		"username" TEXT NOT NULL,
+		"role" TEXT NOT NULL,
+		"joined_at" INTEGER NOT NULL,
+		PRIMARY KEY ("room_id", "username"));
+	CREATE INDEX IF NOT EXISTS room_members_username ON room_members (username);`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Fatalf("Failed to create room tables: %v", err)
+	}
+
+	// Columns added after the initial schema
+	for _, col := range []struct{ name, definition string }{
+		{"topic", "TEXT NOT NULL DEFAULT ''"},
+		{"public", "INTEGER NOT NULL DEFAULT 0"},
+		{"description", "TEXT NOT NULL DEFAULT ''"},
+		{"slow_mode", "INTEGER NOT NULL DEFAULT 0"},
+		{"rules", "TEXT NOT NULL DEFAULT ''"},
+		{"join_question", "TEXT NOT NULL DEFAULT ''"},
+		{"broadcast", "INTEGER NOT NULL DEFAULT 0"},
+		{"public_updated_at", "INTEGER NOT NULL DEFAULT 0"},
+		{"attachments", "TEXT NOT NULL DEFAULT 'everyone'"},
+		{"attachment_types", "TEXT NOT NULL DEFAULT ''"},
+	} {
+		if err := dbutil.AddColumnIfMissing(db, "rooms", col.name, col.definition); err != nil {
+			log.Fatalf("Failed to migrate rooms table: %v", err)
+		}
+	}
+	createMetadataTables(db)
+	createMuteTable(db)
+	createChangesTable(db)
+	createJoinRequestTable(db)
+	createPublicPostTable(db)
+	createEventTables(db)
+	createPollTables(db)
+	createArchiveTable(db)
+	createExportTable(db)
+
+	return &Storage{db: db, text: text, basePath: basePath, cache: make(map[string]*Snapshot)}
+}
+
+// newID returns a random, unguessable room id
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// validate cleans user supplied settings with the text policy, the error is a *textpolicy.Error
+// ErrInvalidSlowMode, ErrBroadcastNotAllowed or ErrInvalidAttachmentPolicy
+func (r *Room) validate(text *textpolicy.Policy) error {
+	if r.SlowMode < 0 || r.SlowMode > MaxSlowMode {
+		return ErrInvalidSlowMode
+	}
+	if r.Broadcast && !(r.Public && r.Announcement) {
+		return ErrBroadcastNotAllowed
+	}
+	if err := r.validateAttachments(); err != nil {
+		return err
+	}
+	var err error
+	if r.Name, err = text.Clean(textpolicy.RoomName, r.Name); err != nil {
+		return err
+	}
+	if r.Topic, err = text.Clean(textpolicy.RoomTopic, r.Topic); err != nil {
+		return err
+	}
+	if r.Description, err = text.Clean(textpolicy.RoomDescription, r.Description); err != nil {
+		return err
+	}
+	if r.Rules, err = text.Clean(textpolicy.RoomRules, r.Rules); err != nil {
+		return err
+	}
+	r.JoinQuestion, err = text.Clean(textpolicy.RoomJoinQuestion, r.JoinQuestion)
+	return err
+}
+
+// Create makes a room from settings with owner as its only member
+func (s *Storage) Create(owner string, settings Room) (*Room, error) {
+	room := settings
+	if err := room.validate(s.text); err != nil {
+		return nil, err
+	}
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	insertSQL := `INSERT INTO rooms (id, name, topic, description, announcement, public, broadcast, slow_mode, rules, join_question,
+	attachments, attachment_types, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	if _, err := tx.Exec(insertSQL, id, room.Name, room.Topic, room.Description, room.Announcement, room.Public, room.Broadcast,
+		room.SlowMode, room.Rules, room.JoinQuestion, room.Attachments, strings.Join(room.AttachmentTypes, ","), now.Unix()); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`INSERT INTO room_members (room_id, username, role, joined_at) VALUES (?, ?, ?, ?)`,
+		id, owner, RoleOwner, now.Unix()); err != nil {
+		return nil, err
+	}
+	if err := recordChange(tx, id, owner); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	room.ID = id
+	room.AvatarURL = ""
+	room.Archived = false
+	room.CreatedAt = time.Unix(now.Unix(), 0)
+	return &room, nil
+}
+
+// Get returns a room's settings
+func (s *Storage) Get(id string) (*Room, error) {
+	room, err := s.scanRoom(s.db.QueryRow(`SELECT `+roomColumns+` FROM rooms r
+	LEFT JOIN room_avatars a ON a.room_id = r.id WHERE r.id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return room, nil
+}
+
+// roomColumns are read by scanRoom, from rooms r LEFT JOIN room_avatars a
+const roomColumns = `r.id, r.name, r.topic, r.description, r.announcement, r.public, r.broadcast, r.slow_mode, r.rules, r.join_question,
+	r.attachments, r.attachment_types, r.created_at, COALESCE(a.etag, ''),
+	EXISTS(SELECT 1 FROM room_archives x WHERE x.room_id = r.id)`
+
+// scanRoom reads a row selected with roomColumns
+func (s *Storage) scanRoom(row interface{ Scan(...interface{}) error }) (*Room, error) {
+	var room Room
+	var createdAt int64
+	var etag, attachmentTypes string
+	err := row.Scan(&room.ID, &room.Name, &room.Topic, &room.Description, &room.Announcement, &room.Public, &room.Broadcast, &room.SlowMode, &room.Rules, &room.JoinQuestion,
+		&room.Attachments, &attachmentTypes, &createdAt, &etag, &room.Archived)
+	if err != nil {
+		return nil, err
+	}
+	room.AttachmentTypes = []string{}
+	if attachmentTypes != "" {
+		room.AttachmentTypes = strings.Split(attachmentTypes, ",")
+	}
+	room.CreatedAt = time.Unix(createdAt, 0)
+	room.AvatarURL = s.avatarURL(room.ID, etag)
+	return &room, nil
+}
+
+// Update saves a room's settings
+func (s *Storage) Update(room *Room) error {
+	if err := room.validate(s.text); err != nil {
+		return err
+	}
+	updateSQL := `UPDATE rooms SET name = ?, topic = ?, description = ?, announcement = ?, public = ?, broadcast = ?,
+	slow_mode = ?, rules = ?, join_question = ?, attachments = ?, attachment_types = ? WHERE id = ?`
+	result, err := s.db.Exec(updateSQL, room.Name, room.Topic, room.Description, room.Announcement, room.Public, room.Broadcast,
+		room.SlowMode, room.Rules, room.JoinQuestion, room.Attachments, strings.Join(room.AttachmentTypes, ","), room.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	s.invalidate(room.ID)
+	return recordChange(s.db, room.ID, "")
+}
+
+// Delete removes a room with its memberships and metadata, stored messages are removed by history
+func (s *Storage) Delete(id string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM rooms WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	if err := recordMembersChange(tx, id); err != nil {
+		return err
+	}
+	for _, table := range append([]string{"room_members"}, roomTables...) {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE room_id = ?`, id); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.invalidate(id)
+	return nil
+}
+
+// Role returns username's role in the room, ErrNotMember if they don't belong to it
+func (s *Storage) Role(roomID, username string) (string, error) {
+	snap, err := s.Snapshot(roomID)
+	if err != nil {
+		return "", err
+	}
+	role, ok := snap.Members[username]
+	if !ok {
+		return "", ErrNotMember
+	}
+	return role, nil
+}
+
+// AddMember adds username to the room with role
+func (s *Storage) AddMember(roomID, username, role string) error {
+	if !ValidRole(role) {
+		return ErrInvalidRole
+	}
+	if _, err := s.Get(roomID); err != nil {
+		return err
+	}
+	result, err := s.db.Exec(`INSERT OR IGNORE INTO room_members (room_id, username, role, joined_at) VALUES (?, ?, ?, ?)`,
+		roomID, username, role, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrMemberExists
+	}
+	s.invalidate(roomID)
+	return recordChange(s.db, roomID, username)
+}
+
+// SetRole changes a member's role, refusing to demote the last owner
+func (s *Storage) SetRole(roomID, username, role string) error {
+	if !ValidRole(role) {
+		return ErrInvalidRole
+	}
+	return s.changeMember(roomID, username, func(tx *sql.Tx) error {
+		_, err := tx.Exec(`UPDATE room_members SET role = ? WHERE room_id = ? AND username = ?`, role, roomID, username)
+		return err
+	})
+}
+
+// RemoveMember takes username out of the room, refusing to remove the last owner
+func (s *Storage) RemoveMember(roomID, username string) error {
+	return s.changeMember(roomID, username, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM room_members WHERE room_id = ? AND username = ?`, roomID, username); err != nil {
+			return err
+		}
+		// answers from someone no longer in the room would mislead who is coming
+		if _, err := tx.Exec(`DELETE FROM room_event_rsvps WHERE room_id = ? AND username = ?`, roomID, username); err != nil {
+			return err
+		}
+		return recordChange(tx, roomID, username)
+	})
+}
+
+// RemoveUser takes a deleted account out of every room it belongs to, returning the rooms
+// that still exist. A room it was the last owner of passes to its longest standing moderator,
+// or member when there is none, and a room left empty is deleted
+func (s *Storage) RemoveUser(username string) ([]string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT room_id FROM room_members WHERE username = ?`, username)
+	if err != nil {
+		return nil, err
+	}
+	var joined []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		joined = append(joined, id)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var remaining []string
+	for _, id := range joined {
+		if _, err := tx.Exec(`DELETE FROM room_members WHERE room_id = ? AND username = ?`, id, username); err != nil {
+			return nil, err
+		}
+		var owners, members int
+		if err := tx.QueryRow(`SELECT COUNT(*), COUNT(CASE role WHEN ? THEN 1 END) FROM room_members WHERE room_id = ?`,
+			RoleOwner, id).Scan(&members, &owners); err != nil {
+			return nil, err
+		}
+		if members == 0 {
+			for _, table := range append([]string{"rooms"}, roomTables...) {
+				column := "room_id"
+				if table == "rooms" {
+					column = "id"
+				}
+				if _, err := tx.Exec(`DELETE FROM `+table+` WHERE `+column+` = ?`, id); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		if owners == 0 {
+			promoteSQL := `UPDATE room_members SET role = ? WHERE room_id = ? AND username = (
+				SELECT username FROM room_members WHERE room_id = ?
+				ORDER BY CASE role WHEN 'moderator' THEN 0 ELSE 1 END, joined_at, username LIMIT 1)`
+			if _, err := tx.Exec(promoteSQL, RoleOwner, id, id); err != nil {
+				return nil, err
+			}
+		}
+		if err := recordChange(tx, id, ""); err != nil {
+			return nil, err
+		}
+		remaining = append(remaining, id)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	for _, id := range joined {
+		s.invalidate(id)
+	}
+	return remaining, nil
+}
+
+// changeMember applies change to an existing member and checks an owner remains
+func (s *Storage) changeMember(roomID, username string, change func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM room_members WHERE room_id = ? AND username = ?)`, roomID, username).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotMember
+	}
+	if err := change(tx); err != nil {
+		return err
+	}
+
+	var owners int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM room_members WHERE room_id = ? AND role = ?`, roomID, RoleOwner).Scan(&owners); err != nil {
+		return err
+	}
+	if owners == 0 {
+		return ErrLastOwner
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.invalidate(roomID)
+	return nil
+}
+
+// Members lists a room's members, owners first
+func (s *Storage) Members(roomID string) ([]Member, error) {
+	rows, err := s.db.Query(`SELECT username, role, joined_at FROM room_members WHERE room_id = ?
+	ORDER BY CASE role WHEN 'owner' THEN 0 WHEN 'moderator' THEN 1 ELSE 2 END, username`, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []Member{}
+	for rows.Next() {
+		var m Member
+		var joinedAt int64
+		if err := rows.Scan(&m.Username, &m.Role, &joinedAt); err != nil {
+			return nil, err
+		}
+		m.JoinedAt = time.Unix(joinedAt, 0)
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+// ForUser lists the rooms username belongs to
+func (s *Storage) ForUser(username string) ([]Room, error) {
+	rows, err := s.db.Query(`SELECT `+roomColumns+` FROM rooms r
+	JOIN room_members m ON m.room_id = r.id LEFT JOIN room_avatars a ON a.room_id = r.id
+	WHERE m.username = ? ORDER BY r.name, r.id`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rooms := []Room{}
+	for rows.Next() {
+		room, err := s.scanRoom(rows)
+		if err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, *room)
+	}
+	return rooms, rows.Err()
+}
+
+// ForUserPage lists up to limit of username's rooms whose name contains search, ordered by
+// name then id and starting after cursor (nil for the first page), in reverse when desc is set
+func (s *Storage) ForUserPage(username, search string, after *DirectoryCursor, desc bool, limit int) ([]Room, error) {
+	where := `m.username = ?`
+	args := []interface{}{username}
+	if search = strings.TrimSpace(search); search != "" {
+		where += ` AND r.name LIKE ? ESCAPE '\'`
+		args = append(args, "%"+dbutil.EscapeLike(search)+"%")
+	}
+	order, cmp := "r.name, r.id", ">"
+	if desc {
+		order, cmp = "r.name DESC, r.id DESC", "<"
+	}
+	if after != nil {
+		where += ` AND (r.name ` + cmp + ` ? OR (r.name = ? AND r.id ` + cmp + ` ?))`
+		args = append(args, after.Name, after.Name, after.ID)
+	}
+	args = append(args, limit)
+
+	rows, err := s.db.Query(`SELECT `+roomColumns+` FROM rooms r
+	JOIN room_members m ON m.room_id = r.id LEFT JOIN room_avatars a ON a.room_id = r.id
+	WHERE `+where+` ORDER BY `+order+` LIMIT ?`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rooms := []Room{}
+	for rows.Next() {
+		room, err := s.scanRoom(rows)
+		if err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, *room)
+	}
+	return rooms, rows.Err()
+}
+
+// Snapshot returns the cached settings and members of a room, loading them on first use
+func (s *Storage) Snapshot(roomID string) (*Snapshot, error) {
+	s.mu.Lock()
+	snap, ok := s.cache[roomID]
+	generation := s.generation
+	s.mu.Unlock()
+	if ok {
+		return snap, nil
+	}
+
+	room, err := s.Get(roomID)
+	if err != nil {
+		return nil, err
+	}
+	members, err := s.Members(roomID)
+	if err != nil {
+		return nil, err
+	}
+	mutes, err := s.mutes(roomID)
+	if err != nil {
+		return nil, err
+	}
+	snap = &Snapshot{Room: *room, Members: make(map[string]string, len(members)), Mutes: mutes}
+	for _, m := range members {
+		snap.Members[m.Username] = m.Role
+	}
+
+	s.mu.Lock()
+	if s.generation == generation {
+		s.cache[roomID] = snap
+	}
+	s.mu.Unlock()
+	return snap, nil
+}
+
+// invalidate drops a cached snapshot after a change
+func (s *Storage) invalidate(roomID string) {
+	s.mu.Lock()
+	delete(s.cache, roomID)
+	s.generation++
+	s.mu.Unlock()
+}
+
+// Reset drops every cached snapshot, used after usernames change
+func (s *Storage) Reset() {
+	s.mu.Lock()
+	s.cache = make(map[string]*Snapshot)
+	s.generation++
+	s.mu.Unlock()
+}
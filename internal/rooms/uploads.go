@@ -0,0 +1,132 @@
+package rooms
+
+import (
+	"errors"
+	"mime"
+	"strings"
+)
+
+// who may send attachments to a room
+const (
+	AttachmentsEveryone   = "everyone"
+	AttachmentsModerators = "moderators" // owners and moderators
+	AttachmentsNone       = "none"
+)
+
+// attachment categories a room can limit uploads to, from the MIME type the client declares.
+// Attachments are encrypted, so the server can't check the declared type against the content
+const (
+	CategoryImage    = "image"
+	CategoryVideo    = "video"
+	CategoryAudio    = "audio"
+	CategoryDocument = "document" // text, PDF, office documents
+	CategoryOther    = "other"    // anything else, including no declared type
+)
+
+var (
+	ErrInvalidAttachmentPolicy  = errors.New("attachments must be everyone, moderators or none, and types image, video, audio, document or other")
+	ErrAttachmentsNotAllowed    = errors.New("attachments are not allowed in this room")
+	ErrAttachmentTypeNotAllowed = errors.New("this type of attachment is not allowed in this room")
+)
+
+// documentTypes are the application/* types counted as documents
+var documentTypes = map[string]bool{
+	"application/pdf":                                 true,
+	"application/rtf":                                 true,
+	"application/msword":                              true,
+	"application/vnd.ms-excel":                        true,
+	"application/vnd.ms-powerpoint":                   true,
+	"application/vnd.oasis.opendocument.text":         true,
+	"application/vnd.oasis.opendocument.spreadsheet":  true,
+	"application/vnd.oasis.opendocument.presentation": true,
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   true,
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         true,
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": true,
+}
+
+// AttachmentCategory returns the category of a declared MIME type, CategoryOther when it
+// is empty or malformed
+func AttachmentCategory(mimeType string) string {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return CategoryOther
+	}
+	major, _, _ := strings.Cut(mediaType, "/")
+	switch {
+	case major == "image":
+		return CategoryImage
+	case major == "video":
+		return CategoryVideo
+	case major == "audio":
+		return CategoryAudio
+	case major == "text" || documentTypes[mediaType]:
+		return CategoryDocument
+	}
+	return CategoryOther
+}
+
+func validCategory(category string) bool {
+	switch category {
+	case CategoryImage, CategoryVideo, CategoryAudio, CategoryDocument, CategoryOther:
+		return true
+	}
+	return false
+}
+
+// validateAttachments checks a room's attachment settings, filling in the defaults
+func (r *Room) validateAttachments() error {
+	switch r.Attachments {
+	case "":
+		r.Attachments = AttachmentsEveryone
+	case AttachmentsEveryone, AttachmentsModerators, AttachmentsNone:
+	default:
+		return ErrInvalidAttachmentPolicy
+	}
+	seen := make(map[string]bool, len(r.AttachmentTypes))
+	types := []string{}
+	for _, category := range r.AttachmentTypes {
+		if !validCategory(category) {
+			return ErrInvalidAttachmentPolicy
+		}
+		if !seen[category] {
+			seen[category] = true
+			types = append(types, category)
+		}
+	}
+	r.AttachmentTypes = types
+	return nil
+}
+
+// CanAttachAny reports whether username may send attachments to the room at all
+func (s *Snapshot) CanAttachAny(username string) bool {
+	if !s.CanPost(username) {
+		return false
+	}
+	switch s.Room.Attachments {
+	case AttachmentsNone:
+		return false
+	case AttachmentsModerators:
+		return rank(s.Members[username]) >= rank(RoleModerator)
+	}
+	return true
+}
+
+// CanAttach checks that username may send an attachment of the given category to the room,
+// returning ErrNotMember, ErrAttachmentsNotAllowed or ErrAttachmentTypeNotAllowed
+func (s *Snapshot) CanAttach(username, category string) error {
+	if _, ok := s.Members[username]; !ok {
+		return ErrNotMember
+	}
+	if !s.CanAttachAny(username) {
+		return ErrAttachmentsNotAllowed
+	}
+	if len(s.Room.AttachmentTypes) == 0 {
+		return nil
+	}
+	for _, allowed := range s.Room.AttachmentTypes {
+		if allowed == category {
+			return nil
+		}
+	}
+	return ErrAttachmentTypeNotAllowed
+}
@@ -0,0 +1,146 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// MinPartSize is the smallest part S3 accepts, except for the last one
+const MinPartSize = 5 << 20
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+// PutObjectMultipart uploads body to key in parts of partSize bytes
+// the upload is aborted if any part fails so no orphaned parts are left behind.
+// A body that fits in one part, empty included, goes up with a single PutObject instead,
+// S3 rejects completing an upload without parts
+func (c *Client) PutObjectMultipart(ctx context.Context, key string, body io.Reader, partSize int64, contentType string) error {
+	if partSize < MinPartSize {
+		partSize = MinPartSize
+	}
+
+	buf := make([]byte, partSize)
+	n, err := io.ReadFull(body, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return c.PutObject(ctx, key, bytes.NewReader(buf[:n]), int64(n), contentType)
+	}
+	if err != nil {
+		return err
+	}
+
+	uploadID, err := c.createMultipartUpload(ctx, key, contentType)
+	if err != nil {
+		return err
+	}
+
+	parts, err := c.uploadParts(ctx, key, uploadID, buf, body)
+	if err == nil {
+		err = c.completeMultipartUpload(ctx, key, uploadID, parts)
+	}
+	if err != nil {
+		c.abortMultipartUpload(context.Background(), key, uploadID)
+		return err
+	}
+	return nil
+}
+
+func (c *Client) createMultipartUpload(ctx context.Context, key, contentType string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.objectURL(key)+"?uploads=", nil)
+	if err != nil {
+		return "", err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	c.sign(req, time.Now())
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return "", responseError(resp)
+	}
+
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("s3: decoding multipart upload: %v", err)
+	}
+	return result.UploadID, nil
+}
+
+// uploadParts uploads buf, which holds the first part, then the rest of body in parts of
+// len(buf) bytes
+func (c *Client) uploadParts(ctx context.Context, key, uploadID string, buf []byte, body io.Reader) ([]completedPart, error) {
+	var parts []completedPart
+	n := len(buf)
+	for number := 1; ; number++ {
+		partURL := fmt.Sprintf("%s?partNumber=%d&uploadId=%s", c.objectURL(key), number, url.QueryEscape(uploadID))
+		resp, err := c.do(ctx, http.MethodPut, partURL, bytes.NewReader(buf[:n]), int64(n))
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		parts = append(parts, completedPart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+
+		if n < len(buf) {
+			break
+		}
+		n, err = io.ReadFull(body, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+	}
+	return parts, nil
+}
+
+func (c *Client) completeMultipartUpload(ctx context.Context, key, uploadID string, parts []completedPart) error {
+	body, err := xml.Marshal(completeMultipartUpload{Parts: parts})
+	if err != nil {
+		return err
+	}
+	completeURL := c.objectURL(key) + "?uploadId=" + url.QueryEscape(uploadID)
+	resp, err := c.do(ctx, http.MethodPost, completeURL, bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// S3 can report a failed completion with a 200 status and an error body
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if strings.Contains(string(data), "<Error>") {
+		return fmt.Errorf("s3: completing multipart upload: %s", strings.TrimSpace(string(data)))
+	}
+	return nil
+}
+
+func (c *Client) abortMultipartUpload(ctx context.Context, key, uploadID string) {
+	abortURL := c.objectURL(key) + "?uploadId=" + url.QueryEscape(uploadID)
+	if resp, err := c.do(ctx, http.MethodDelete, abortURL, nil, 0); err == nil {
+		resp.Body.Close()
+	}
+}
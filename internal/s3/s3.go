@@ -0,0 +1,143 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/awssig"
+)
+
+// ErrNotConfigured is returned when S3 settings are missing
+var ErrNotConfigured = errors.New("s3 storage is not configured")
+
+// Client talks to an S3 compatible object store (AWS S3, MinIO, ...) using path style URLs
+type Client struct {
+	Endpoint  string // e.g. https://s3.us-east-1.amazonaws.com or http://localhost:9000
+	Region    string
+	AccessKey string
+	SecretKey string
+	Bucket    string
+
+	HTTP *http.Client
+}
+
+// Configured reports whether enough settings are present to use the client
+func (c *Client) Configured() bool {
+	return c != nil && c.Endpoint != "" && c.Bucket != "" && c.AccessKey != "" && c.SecretKey != ""
+}
+
+// PutObject uploads size bytes from body to key
+func (c *Client) PutObject(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.objectURL(key), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	c.sign(req, time.Now())
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return responseError(resp)
+	}
+	return nil
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTP != nil {
+		return c.HTTP
+	}
+	return http.DefaultClient
+}
+
+// objectURL builds the path style URL for key
+func (c *Client) objectURL(key string) string {
+	return strings.TrimRight(c.Endpoint, "/") + "/" + c.Bucket + "/" + escapePath(key)
+}
+
+// responseError turns an S3 error response into a Go error
+func responseError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("s3: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
+
+// sign adds AWS Signature Version 4 headers to req
+func (c *Client) sign(req *http.Request, now time.Time) {
+	req.Header.Set("X-Amz-Content-Sha256", awssig.UnsignedPayload)
+	c.signer().Sign(req, awssig.UnsignedPayload, now)
+}
+
+func (c *Client) signer() *awssig.Signer {
+	return &awssig.Signer{AccessKey: c.AccessKey, SecretKey: c.SecretKey, Region: c.Region, Service: "s3"}
+}
+
+// escapePath encodes an object key, keeping slashes as separators
+func escapePath(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = awssig.URIEncode(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// GetObject downloads key, the caller must close the returned body
+func (c *Client) GetObject(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, http.MethodGet, c.objectURL(key), nil, -1)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// DeleteObject removes key, deleting a missing key is not an error
+func (c *Client) DeleteObject(ctx context.Context, key string) error {
+	resp, err := c.do(ctx, http.MethodDelete, c.objectURL(key), nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Presign returns a URL that allows method on key without credentials until it expires
+func (c *Client) Presign(method, key string, expires time.Duration) (string, error) {
+	u, err := url.Parse(c.objectURL(key))
+	if err != nil {
+		return "", err
+	}
+	return c.signer().Presign(method, u, expires, time.Now()).String(), nil
+}
+
+// do sends a signed request and returns the response if it succeeded
+func (c *Client) do(ctx context.Context, method, rawURL string, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, body)
+	if err != nil {
+		return nil, err
+	}
+	if size >= 0 {
+		req.ContentLength = size
+	}
+	c.sign(req, time.Now())
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		return nil, responseError(resp)
+	}
+	return resp, nil
+}
@@ -0,0 +1,109 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/awssig"
+)
+
+// AWS holds credentials for the Secrets Manager and KMS JSON APIs
+type AWS struct {
+	Region       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string // for temporary credentials
+	Endpoint     string // overrides https://{service}.{region}.amazonaws.com, e.g. for LocalStack
+
+	HTTP *http.Client
+}
+
+// SecretsManager reads each secret from AWS Secrets Manager as the secret Prefix+name
+type SecretsManager struct {
+	*AWS
+	Prefix string // e.g. "meadowlark/"
+}
+
+// Get returns the SecretString of the secret for name
+func (m *SecretsManager) Get(ctx context.Context, name string) (string, error) {
+	var out struct {
+		SecretString string
+	}
+	in := map[string]string{"SecretId": m.Prefix + name}
+	if err := m.call(ctx, "secretsmanager", "secretsmanager.GetSecretValue", in, &out); err != nil {
+		if strings.Contains(err.Error(), "ResourceNotFoundException") {
+			return "", ErrNotFound
+		}
+		return "", err
+	}
+	return out.SecretString, nil
+}
+
+// KMS decrypts secrets that Source holds as base64 ciphertexts from "aws kms encrypt",
+// so values in the environment or on disk are useless without access to the key
+type KMS struct {
+	*AWS
+	Source Provider
+}
+
+// Get fetches the ciphertext for name and decrypts it
+func (k *KMS) Get(ctx context.Context, name string) (string, error) {
+	encoded, err := k.Source.Get(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	blob, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", fmt.Errorf("%s is not a base64 KMS ciphertext: %v", name, err)
+	}
+
+	var out struct {
+		Plaintext []byte // base64 in JSON
+	}
+	in := map[string][]byte{"CiphertextBlob": blob}
+	if err := k.call(ctx, "kms", "TrentService.Decrypt", in, &out); err != nil {
+		return "", err
+	}
+	return string(out.Plaintext), nil
+}
+
+// call posts a JSON 1.1 request to an AWS service, signed with Signature Version 4
+func (a *AWS) call(ctx context.Context, service, target string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	endpoint := a.Endpoint
+	if endpoint == "" {
+		endpoint = "https://" + service + "." + a.Region + ".amazonaws.com"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(endpoint, "/")+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", target)
+	if a.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", a.SessionToken)
+	}
+	signer := &awssig.Signer{AccessKey: a.AccessKey, SecretKey: a.SecretKey, Region: a.Region, Service: service}
+	signer.Sign(req, awssig.PayloadHash(body), time.Now())
+
+	resp, err := httpClient(a.HTTP).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%s: %s: %s", service, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,108 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// Cache keeps fetched secrets in memory so a remote provider is only asked once per name,
+// and refetches them periodically to pick up rotations
+type Cache struct {
+	provider Provider
+
+	mu     sync.Mutex
+	values map[string]string // missing secrets are cached as ""
+	hooks  map[string][]func(string)
+}
+
+// NewCache wraps provider
+func NewCache(provider Provider) *Cache {
+	return &Cache{
+		provider: provider,
+		values:   make(map[string]string),
+		hooks:    make(map[string][]func(string)),
+	}
+}
+
+// Get returns the cached value of name, fetching it the first time. A secret the provider
+// doesn't hold is returned as "" without an error
+func (c *Cache) Get(ctx context.Context, name string) (string, error) {
+	c.mu.Lock()
+	value, ok := c.values[name]
+	c.mu.Unlock()
+	if ok {
+		return value, nil
+	}
+
+	value, err := c.fetch(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	c.values[name] = value
+	c.mu.Unlock()
+	return value, nil
+}
+
+// OnRotate registers a hook called with the new value whenever a refresh finds name changed
+func (c *Cache) OnRotate(name string, hook func(value string)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hooks[name] = append(c.hooks[name], hook)
+}
+
+// Refresh fetches every cached secret again and runs the hooks of those that changed.
+// A secret that fails to fetch keeps its old value
+func (c *Cache) Refresh(ctx context.Context) {
+	c.mu.Lock()
+	names := make([]string, 0, len(c.values))
+	for name := range c.values {
+		names = append(names, name)
+	}
+	c.mu.Unlock()
+
+	for _, name := range names {
+		value, err := c.fetch(ctx, name)
+		if err != nil {
+			log.Printf("Error refreshing secret %s: %v", name, err)
+			continue
+		}
+		c.mu.Lock()
+		changed := c.values[name] != value
+		c.values[name] = value
+		hooks := c.hooks[name]
+		c.mu.Unlock()
+		if !changed {
+			continue
+		}
+		log.Printf("Secret %s rotated", name)
+		for _, hook := range hooks {
+			hook(value)
+		}
+	}
+}
+
+// Run refreshes the cache every interval until ctx is done
+func (c *Cache) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.Refresh(ctx)
+		}
+	}
+}
+
+func (c *Cache) fetch(ctx context.Context, name string) (string, error) {
+	value, err := c.provider.Get(ctx, name)
+	if errors.Is(err, ErrNotFound) {
+		return "", nil
+	}
+	return value, err
+}
@@ -0,0 +1,53 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// names of the secrets the server asks its provider for
+const (
+	JWTKeys        = "jwt-keys"        // "id:base64key" list signing session tokens
+	EncryptionKeys = "encryption-keys" // "id:base64key" list encrypting sensitive columns at rest
+	SMTPUsername   = "smtp-username"
+	SMTPPassword   = "smtp-password"
+)
+
+// ErrNotFound means the provider holds no value for a secret, which leaves the feature
+// using it disabled or on its default
+var ErrNotFound = errors.New("secret not found")
+
+// Provider fetches secrets by name from wherever they are kept
+type Provider interface {
+	Get(ctx context.Context, name string) (string, error)
+}
+
+// Static serves secrets given up front, such as those read from MEADOWLARK_* variables
+type Static map[string]string
+
+// Get returns the value for name
+func (s Static) Get(ctx context.Context, name string) (string, error) {
+	value, ok := s[name]
+	if !ok || value == "" {
+		return "", ErrNotFound
+	}
+	return value, nil
+}
+
+// Dir reads each secret from a file named after it, as mounted by Docker and Kubernetes secrets
+type Dir string
+
+// Get returns the contents of the file for name without a trailing newline
+func (d Dir) Get(ctx context.Context, name string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(string(d), name))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
@@ -0,0 +1,65 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Vault reads secrets from one HashiCorp Vault KV version 2 secret, each name being
+// a field of it, e.g. "vault kv put secret/meadowlark jwt-keys=k1:..."
+type Vault struct {
+	Addr  string // e.g. https://vault.example.com:8200
+	Token string
+	Mount string // KV engine mount, usually "secret"
+	Path  string // secret path under the mount
+
+	HTTP *http.Client
+}
+
+// Get returns the field called name of the secret
+func (v *Vault) Get(ctx context.Context, name string) (string, error) {
+	url := strings.TrimRight(v.Addr, "/") + "/v1/" + strings.Trim(v.Mount, "/") + "/data/" + strings.Trim(v.Path, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", v.Token)
+
+	resp, err := httpClient(v.HTTP).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", ErrNotFound
+	}
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return "", fmt.Errorf("vault: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var secret struct {
+		Data struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", fmt.Errorf("vault: %v", err)
+	}
+	value, ok := secret.Data.Data[name].(string)
+	if !ok {
+		return "", ErrNotFound
+	}
+	return value, nil
+}
+
+func httpClient(c *http.Client) *http.Client {
+	if c != nil {
+		return c
+	}
+	return http.DefaultClient
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/auth"
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+	"github.com/Chase-Garrett/meadowlark/internal/textpolicy"
+)
+
+// UsernameChangeRequest defines JSON for POST /api/account/username
+type UsernameChangeRequest struct {
+	Username string `json:"username"`
+}
+
+// HandleUsername lists previous usernames or renames the account
+func (s *Server) HandleUsername(w http.ResponseWriter, r *http.Request, username string) {
+	switch r.Method {
+	case http.MethodGet:
+		aliases, err := s.userStorage.UsernameHistory(username)
+		if err != nil {
+			respondInternalError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"username": username,
+			"previous": aliases,
+		})
+	case http.MethodPost:
+		s.changeUsername(w, r, username)
+	default:
+		respondMethodNotAllowed(w)
+	}
+}
+
+// changeUsername renames the account, returns a token for the new name and tells contacts
+func (s *Server) changeUsername(w http.ResponseWriter, r *http.Request, username string) {
+	var req UsernameChangeRequest
+	if err := s.readJSON(w, r, &req); err != nil {
+		respondError(w, err)
+		return
+	}
+	// admins are configured by name, a rename would drop their privileges
+	// and eventually free the configured name for anyone to register
+	if s.config.IsAdmin(username) {
+		respondError(w, apierror.New(http.StatusForbidden, apierror.AdminRename))
+		return
+	}
+
+	err := s.userStorage.RenameUser(username, req.Username, s.config.UsernameAliasGrace)
+	if apiErr := textPolicyError(err); apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+	switch err {
+	case nil:
+	case auth.ErrInvalidUsername:
+		respondError(w, apierror.New(http.StatusBadRequest, apierror.InvalidUsername).With("max", s.text.MaxLength(textpolicy.Username)))
+		return
+	case auth.ErrUsernameTaken:
+		respondError(w, apierror.New(http.StatusConflict, apierror.UsernameTaken))
+		return
+	case auth.ErrUserNotFound:
+		respondError(w, apierror.New(http.StatusNotFound, apierror.UserNotFound))
+		return
+	default:
+		respondInternalError(w, err)
+		return
+	}
+	log.Printf("User %s renamed to %s", username, req.Username)
+	// cached room memberships still list the old name
+	s.rooms.Reset()
+	// and cached flag settings
+	if err := s.flags.Reload(); err != nil {
+		log.Printf("Error reloading feature flags after renaming %s: %v", username, err)
+	}
+
+	// the new token is bound to the same key and has the same scopes as the one the request
+	// came with
+	var opts auth.TokenOptions
+	if claims := requestClaims(r); claims != nil {
+		opts = auth.TokenOptions{JKT: claims.BoundTo(), Scopes: strings.Fields(claims.Scope)}
+	}
+	token, err := s.issueToken(req.Username, opts)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+
+	renamed := map[string]interface{}{
+		"oldUsername": username,
+		"username":    req.Username,
+	}
+	contacts, err := s.messages.Correspondents(req.Username)
+	if err != nil {
+		log.Printf("Error listing contacts of %s: %v", req.Username, err)
+	}
+	for _, contact := range contacts {
+		s.hub.Forward(protocol.NewControlMessage(contact, protocol.EventUserRenamed, renamed))
+	}
+	// the open connection still carries the old name, the client reconnects with the new token
+	s.hub.Disconnect(username, protocol.CloseAuthExpired, protocol.CloseReason{Code: apierror.UsernameChanged})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LoginResponse{
+		Token:    token,
+		Username: req.Username,
+	})
+}
@@ -0,0 +1,267 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/history"
+	"github.com/Chase-Garrett/meadowlark/internal/preview"
+	"github.com/Chase-Garrett/meadowlark/internal/rooms"
+)
+
+// archive webhook delivery limits
+const (
+	archiveTimeout    = 10 * time.Second // per delivery, the webhook should store and answer
+	archiveBatch      = 100              // messages per delivery
+	archiveMaxBatches = 10               // deliveries per room per run, so a backfill doesn't hog a run
+	archiveMaxURL     = 2048
+	archiveRetryMin   = 30 * time.Second // doubled after each failure in a row
+	archiveRetryMax   = time.Hour
+)
+
+// ArchiveRequest defines JSON for PUT /api/rooms/{id}/archive
+type ArchiveRequest struct {
+	URL string `json:"url"`
+	// a new webhook gets the room's earlier messages too, instead of starting with the next one
+	Backfill bool `json:"backfill"`
+}
+
+// ArchiveDelivery is the body of a request to an archive webhook
+type ArchiveDelivery struct {
+	Room      string                 `json:"room"`
+	Envelopes []history.RoomEnvelope `json:"envelopes"` // in sequence order
+}
+
+// archiveRoutes keeps track of the rooms being delivered, so a slow webhook isn't sent the
+// same messages again by the next run
+type archiveRoutes struct {
+	mu       sync.Mutex
+	inFlight map[string]bool
+}
+
+// claim marks room as being delivered, false if it already is
+func (a *archiveRoutes) claim(room string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.inFlight[room] {
+		return false
+	}
+	a.inFlight[room] = true
+	return true
+}
+
+func (a *archiveRoutes) release(room string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.inFlight, room)
+}
+
+// archiveClient returns the client webhooks are called with, giving up after timeout. Unless
+// private destinations are allowed it connects through preview.PublicTransport like link
+// previews, and redirects aren't followed so they can't lead anywhere else
+func archiveClient(proxy *url.URL, allowPrivate bool, timeout time.Duration) *http.Client {
+	noRedirects := func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse }
+	if allowPrivate {
+		client := outboundClient(proxy, timeout)
+		client.CheckRedirect = noRedirects
+		return client
+	}
+	transport := preview.PublicTransport(proxy, timeout)
+	transport.IdleConnTimeout = time.Minute
+	return &http.Client{Transport: transport, Timeout: timeout, CheckRedirect: noRedirects}
+}
+
+// checkArchiveURL describes what is wrong with a webhook URL, empty when it may be used
+func checkArchiveURL(raw string, allowPrivate bool) string {
+	u, err := url.Parse(raw)
+	switch {
+	case err != nil || len(raw) > archiveMaxURL:
+		return "not a URL"
+	case u.Scheme != "http" && u.Scheme != "https":
+		return "only http and https URLs are allowed"
+	case u.User != nil:
+		return "URLs with credentials are not allowed"
+	case u.Hostname() == "":
+		return "the URL has no host"
+	}
+	if allowPrivate {
+		return ""
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if ip := net.ParseIP(host); (ip != nil && !preview.IsPublic(ip)) || host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return "private and local addresses are not allowed"
+	}
+	return ""
+}
+
+// signArchiveDelivery returns the Meadowlark-Signature header for body sent at t: the
+// HMAC-SHA256 of "t.body" with the webhook's secret, t included so replays can be turned away
+func signArchiveDelivery(secret string, t time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// archiveRetryDelay is how long to wait after failures deliveries in a row have failed
+func archiveRetryDelay(failures int) time.Duration {
+	return min(archiveRetryMin<<min(failures-1, 16), archiveRetryMax)
+}
+
+// deliverRoomArchives starts delivering new room messages to the archive webhooks due
+func (s *Server) deliverRoomArchives(now time.Time, routes *archiveRoutes) error {
+	due, err := s.rooms.DueArchives(now)
+	if err != nil {
+		return fmt.Errorf("finding room archives to deliver: %w", err)
+	}
+	for _, archive := range due {
+		if !routes.claim(archive.Room) {
+			continue
+		}
+		go func(archive rooms.Archive) {
+			defer routes.release(archive.Room)
+			s.deliverArchive(archive)
+		}(archive)
+	}
+	return nil
+}
+
+// deliverArchive posts a room's messages after the last delivered one to its webhook, in
+// batches. A batch is delivered until the webhook answers 2xx, so messages may arrive more
+// than once but never out of order; webhooks drop repeats by room and seq
+func (s *Server) deliverArchive(archive rooms.Archive) {
+	for range archiveMaxBatches {
+		envelopes, err := s.messages.RoomMessages(archive.Room, archive.Delivered+1, math.MaxInt64, archiveBatch)
+		if err != nil {
+			log.Printf("Error loading messages to archive for room %s: %v", archive.Room, err)
+			return
+		}
+		if len(envelopes) == 0 {
+			return
+		}
+		last := envelopes[len(envelopes)-1].Seq
+		if err := s.postArchive(archive, envelopes); err != nil {
+			archive.Failures++
+			next := time.Now().Add(archiveRetryDelay(archive.Failures))
+			if err := s.rooms.ArchiveFailed(archive.Room, err.Error(), next); err != nil {
+				log.Printf("Error recording failed archive delivery for room %s: %v", archive.Room, err)
+			}
+			return
+		}
+		if err := s.rooms.ArchiveDelivered(archive.Room, last); err != nil {
+			log.Printf("Error recording archive delivery for room %s: %v", archive.Room, err)
+			return
+		}
+		archive.Delivered = last
+		if len(envelopes) < archiveBatch {
+			return
+		}
+	}
+}
+
+// postArchive sends one batch, the error is shown to the room's owners
+func (s *Server) postArchive(archive rooms.Archive, envelopes []history.RoomEnvelope) error {
+	body, err := json.Marshal(ArchiveDelivery{Room: archive.Room, Envelopes: envelopes})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, archive.URL, bytes.NewReader(body))
+	if err != nil {
+		return errors.New("invalid webhook URL")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "MeadowlarkArchive/1.0")
+	req.Header.Set("Meadowlark-Delivery", fmt.Sprintf("%s:%d-%d", archive.Room, envelopes[0].Seq, envelopes[len(envelopes)-1].Seq))
+	req.Header.Set("Meadowlark-Signature", signArchiveDelivery(archive.Secret, time.Now(), body))
+
+	resp, err := s.archives.Do(req)
+	if err != nil {
+		return webhookError(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// webhookError describes a failed webhook request for the room's moderators, without the
+// addresses the URL resolved to
+func webhookError(err error) error {
+	if errors.Is(err, preview.ErrBlockedAddress) {
+		return preview.ErrBlockedAddress
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	return fmt.Errorf("request failed: %v", err)
+}
+
+// handleRoomArchive shows (GET), sets (PUT) or removes (DELETE) a room's archive webhook
+// (owners). Members are told through room_updated, the room's archived flag changes
+func (s *Server) handleRoomArchive(w http.ResponseWriter, r *http.Request, roomID, username string) {
+	if !s.config.RoomArchives {
+		respondError(w, apierror.New(http.StatusForbidden, apierror.RoomArchivesDisabled))
+		return
+	}
+	if _, ok := s.roomRole(w, roomID, username, rooms.RoleOwner); !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		archive, err := s.rooms.Archive(roomID)
+		if err != nil {
+			respondRoomError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(archive)
+	case http.MethodPut:
+		var req ArchiveRequest
+		if err := s.readJSON(w, r, &req); err != nil {
+			respondError(w, err)
+			return
+		}
+		if detail := checkArchiveURL(req.URL, s.config.RoomArchivePrivate); detail != "" {
+			respondError(w, apierror.New(http.StatusBadRequest, apierror.InvalidArchiveURL).With("detail", detail))
+			return
+		}
+		archive, err := s.rooms.SetArchive(roomID, req.URL, username, req.Backfill)
+		if err != nil {
+			respondRoomError(w, err)
+			return
+		}
+		log.Printf("%s set the archive webhook of room %s", username, roomID)
+		s.hub.NotifyRoomUpdated(roomID, username)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(archive)
+	case http.MethodDelete:
+		if err := s.rooms.RemoveArchive(roomID); err != nil {
+			respondRoomError(w, err)
+			return
+		}
+		log.Printf("%s removed the archive webhook of room %s", username, roomID)
+		s.hub.NotifyRoomUpdated(roomID, username)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		respondMethodNotAllowed(w)
+	}
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/preview"
+)
+
+// TestArchiveClientBlocksPrivate checks a webhook on a loopback address is only reached when
+// private destinations are allowed, and that redirects aren't followed
+func TestArchiveClientBlocksPrivate(t *testing.T) {
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://example.com/", http.StatusFound)
+	}))
+	defer webhook.Close()
+
+	_, err := archiveClient(nil, false, time.Second).Post(webhook.URL, "application/json", nil)
+	if !errors.Is(err, preview.ErrBlockedAddress) {
+		t.Fatalf("posting to %s gave %v, want %v", webhook.URL, err, preview.ErrBlockedAddress)
+	}
+
+	resp, err := archiveClient(nil, true, time.Second).Post(webhook.URL, "application/json", nil)
+	if err != nil {
+		t.Fatalf("with private destinations allowed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("status %d, want the redirect itself", resp.StatusCode)
+	}
+}
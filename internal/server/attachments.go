@@ -0,0 +1,431 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/attachments"
+	"github.com/Chase-Garrett/meadowlark/internal/billing"
+	"github.com/Chase-Garrett/meadowlark/internal/rooms"
+	"github.com/Chase-Garrett/meadowlark/internal/stats"
+)
+
+// blobCollectionTimeout bounds one garbage collection run over the blob backends
+const blobCollectionTimeout = 10 * time.Minute
+
+// maxWaveformSamples caps the waveform of an audio attachment, enough for a message bubble
+const maxWaveformSamples = 256
+
+// sha256Pattern matches a lowercase hex SHA-256 digest
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// AttachmentRequest defines JSON for POST /api/attachments
+type AttachmentRequest struct {
+	Size int64 `json:"size"` // size of the encrypted blob in bytes
+	// optional hex SHA-256 of the encrypted blob, lets a blob stored before be reused
+	// without uploading it again
+	SHA256 string `json:"sha256,omitempty"`
+	// id of one of the caller's attachments this is the encrypted thumbnail of
+	ThumbnailOf string `json:"thumbnailOf,omitempty"`
+	// makes this an audio attachment, shown to recipients before they download it
+	Audio *attachments.Audio `json:"audio,omitempty"`
+	// id of the room it will be sent to, whose attachment settings it must meet.
+	// Only the room's members can fetch it then
+	Room string `json:"room,omitempty"`
+	// MIME type of the plaintext as declared by the client, for the room's allowed categories
+	MimeType string `json:"mimeType,omitempty"`
+}
+
+// AttachmentInfo is the metadata of an attachment anyone can read before downloading it
+type AttachmentInfo struct {
+	ID          string             `json:"id"`
+	Size        int64              `json:"size"`
+	Complete    bool               `json:"complete"`
+	Kind        string             `json:"kind,omitempty"`
+	Audio       *attachments.Audio `json:"audio,omitempty"`
+	Thumbnail   string             `json:"thumbnail,omitempty"` // id of its thumbnail
+	ThumbnailOf string             `json:"thumbnailOf,omitempty"`
+}
+
+// AttachmentResponse tells the client where to upload the blob
+type AttachmentResponse struct {
+	ID        string `json:"id"`
+	UploadURL string `json:"uploadUrl,omitempty"`
+	// true when UploadURL points straight at object storage,
+	// the client must then call /api/attachments/{id}/complete
+	Direct bool `json:"direct"`
+	// true when the blob was stored already, the attachment is complete and there is
+	// nothing to upload
+	Deduplicated bool `json:"deduplicated,omitempty"`
+}
+
+// HandleCreateAttachment reserves an attachment id and returns an upload URL
+func (s *Server) HandleCreateAttachment(w http.ResponseWriter, r *http.Request, username string) {
+	var req AttachmentRequest
+	if err := s.readJSON(w, r, &req); err != nil {
+		respondError(w, err)
+		return
+	}
+	if req.ThumbnailOf != "" {
+		s.createThumbnail(w, username, req)
+		return
+	}
+	if req.Size <= 0 || req.Size > s.config.AttachmentMaxSize {
+		respondError(w, apierror.New(http.StatusRequestEntityTooLarge, apierror.AttachmentSizeOutOfRange).With("max", s.config.AttachmentMaxSize))
+		return
+	}
+	if apiErr := s.checkStorageLimit(username, req.Size); apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+	if req.Room != "" && !s.checkRoomAttachment(w, username, req) {
+		return
+	}
+	req.SHA256 = strings.ToLower(req.SHA256)
+	if req.SHA256 != "" && !sha256Pattern.MatchString(req.SHA256) {
+		respondError(w, apierror.New(http.StatusBadRequest, apierror.InvalidAttachmentHash))
+		return
+	}
+	if req.Audio != nil {
+		if req.Audio.DurationMS <= 0 || req.Audio.DurationMS > s.config.AudioMaxDuration.Milliseconds() {
+			respondError(w, apierror.New(http.StatusBadRequest, apierror.InvalidAudioMetadata).
+				With("field", "durationMs").With("max", s.config.AudioMaxDuration.Milliseconds()))
+			return
+		}
+		if len(req.Audio.Waveform) > maxWaveformSamples {
+			respondError(w, apierror.New(http.StatusBadRequest, apierror.InvalidAudioMetadata).
+				With("field", "waveform").With("max", maxWaveformSamples))
+			return
+		}
+	}
+
+	// blobs are kept in the uploader's data residency region
+	region, err := s.userStorage.Region(username)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	blobs, err := s.attachments.Blobs(region)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	att, err := s.attachments.Create(username, region, req.Room, req.Size, req.SHA256, req.Audio)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	if att.Complete {
+		s.stats.AddTotal(stats.TotalAttachmentBytes, att.Size)
+		s.stats.AddTotal(stats.TotalDeduplicatedUploads, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(AttachmentResponse{ID: att.ID, Deduplicated: true})
+		return
+	}
+
+	s.respondUploadURL(w, blobs, att)
+}
+
+// checkRoomAttachment checks an attachment meant for a room against who may send attachments
+// there and which categories it allows, answering the request when it is refused. Messages
+// are encrypted, so this is where the server sees an attachment together with its room
+func (s *Server) checkRoomAttachment(w http.ResponseWriter, username string, req AttachmentRequest) bool {
+	snap, err := s.rooms.Snapshot(req.Room)
+	if err != nil {
+		respondRoomError(w, err)
+		return false
+	}
+	if apiErr := roomPostError(snap, username); apiErr != nil {
+		respondError(w, apiErr)
+		return false
+	}
+	category := rooms.AttachmentCategory(req.MimeType)
+	if req.Audio != nil {
+		category = rooms.CategoryAudio
+	}
+	switch err := snap.CanAttach(username, category); err {
+	case nil:
+		return true
+	case rooms.ErrAttachmentTypeNotAllowed:
+		respondError(w, apierror.New(http.StatusForbidden, apierror.AttachmentTypeNotAllowed).
+			With("type", category).With("allowed", snap.Room.AttachmentTypes))
+	default:
+		respondRoomError(w, err)
+	}
+	return false
+}
+
+// createThumbnail reserves the thumbnail of one of the caller's attachments, under the
+// tighter thumbnail size limit
+func (s *Server) createThumbnail(w http.ResponseWriter, username string, req AttachmentRequest) {
+	if req.Size <= 0 || req.Size > s.config.AttachmentThumbnailMaxSize {
+		respondError(w, apierror.New(http.StatusRequestEntityTooLarge, apierror.ThumbnailSizeOutOfRange).With("max", s.config.AttachmentThumbnailMaxSize))
+		return
+	}
+	if apiErr := s.checkStorageLimit(username, req.Size); apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+	parent, err := s.attachments.Get(req.ThumbnailOf)
+	if err == attachments.ErrNotFound {
+		respondError(w, apierror.New(http.StatusNotFound, apierror.AttachmentNotFound))
+		return
+	}
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	if parent.Owner != username {
+		respondError(w, apierror.New(http.StatusForbidden, apierror.AttachmentNotOwned))
+		return
+	}
+	blobs, err := s.attachments.Blobs(parent.Region)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	att, err := s.attachments.CreateThumbnail(parent, req.Size)
+	if err == attachments.ErrThumbnailNotAllowed {
+		respondError(w, apierror.New(http.StatusConflict, apierror.ThumbnailNotAllowed))
+		return
+	}
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	s.respondUploadURL(w, blobs, att)
+}
+
+// respondUploadURL answers a reservation with where to upload the blob
+func (s *Server) respondUploadURL(w http.ResponseWriter, blobs attachments.BlobStore, att *attachments.Attachment) {
+	resp := AttachmentResponse{ID: att.ID, UploadURL: s.config.BasePath + "/api/attachments/" + att.ID}
+	presigned, err := blobs.PresignUpload(att.Blob, s.config.AttachmentURLExpiry)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	if presigned != "" {
+		resp.UploadURL = presigned
+		resp.Direct = true
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// HandleAttachment serves uploads, resumable uploads, completion and downloads for
+// /api/attachments/{id}
+func (s *Server) HandleAttachment(w http.ResponseWriter, r *http.Request, username string) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/attachments/")
+	id, action, _ := strings.Cut(path, "/")
+
+	att, err := s.attachments.Get(id)
+	if err == attachments.ErrNotFound {
+		respondError(w, apierror.New(http.StatusNotFound, apierror.AttachmentNotFound))
+		return
+	}
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	if !s.checkAttachmentRoom(w, username, att) {
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPut && action == "":
+		s.uploadAttachment(w, r, username, att)
+	case r.Method == http.MethodPatch && action == "":
+		s.resumeUpload(w, r, username, att)
+	case r.Method == http.MethodHead && action == "":
+		s.uploadStatus(w, username, att)
+	case r.Method == http.MethodPost && action == "complete":
+		if att.Owner != username {
+			respondError(w, apierror.New(http.StatusForbidden, apierror.AttachmentNotOwned))
+			return
+		}
+		if att.Complete {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		liftDeadlines(w)
+		shared, err := s.attachments.Complete(r.Context(), att)
+		s.uploaded(w, att, shared, err)
+	case r.Method == http.MethodGet && action == "":
+		s.downloadAttachment(w, r, att)
+	case r.Method == http.MethodGet && action == "info":
+		s.attachmentInfo(w, att)
+	default:
+		respondMethodNotAllowed(w)
+	}
+}
+
+// checkAttachmentRoom keeps an attachment reserved for a room to the room's members and its
+// owner, answering the request when the caller is neither. Other attachments are open to
+// anyone with the id
+func (s *Server) checkAttachmentRoom(w http.ResponseWriter, username string, att *attachments.Attachment) bool {
+	if att.Room == "" || att.Owner == username {
+		return true
+	}
+	_, err := s.rooms.Role(att.Room, username)
+	switch err {
+	case nil:
+		return true
+	case rooms.ErrNotMember, rooms.ErrNotFound:
+		// not found rather than forbidden, so the id doesn't tell outsiders which room it is in
+		respondError(w, apierror.New(http.StatusNotFound, apierror.AttachmentNotFound))
+	default:
+		respondInternalError(w, err)
+	}
+	return false
+}
+
+// attachmentInfo returns what clients show before downloading an attachment. Like the
+// download, it is open to anyone with the id, or the room's members for a room's attachment
+func (s *Server) attachmentInfo(w http.ResponseWriter, att *attachments.Attachment) {
+	thumbnail, err := s.attachments.Thumbnail(att.ID)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AttachmentInfo{
+		ID:          att.ID,
+		Size:        att.Size,
+		Complete:    att.Complete,
+		Kind:        att.Kind,
+		Audio:       att.Audio,
+		Thumbnail:   thumbnail,
+		ThumbnailOf: att.ThumbnailOf,
+	})
+}
+
+// uploadAttachment stores a blob sent through the server
+func (s *Server) uploadAttachment(w http.ResponseWriter, r *http.Request, username string, att *attachments.Attachment) {
+	if att.Owner != username {
+		respondError(w, apierror.New(http.StatusForbidden, apierror.AttachmentNotOwned))
+		return
+	}
+	if att.Complete {
+		respondError(w, apierror.New(http.StatusConflict, apierror.AttachmentAlreadyUploaded))
+		return
+	}
+	if r.ContentLength >= 0 && r.ContentLength != att.Size {
+		respondError(w, apierror.New(http.StatusBadRequest, apierror.AttachmentSizeMismatch))
+		return
+	}
+
+	liftDeadlines(w)
+	body := http.MaxBytesReader(w, r.Body, att.Size)
+	shared, err := s.attachments.Store(r.Context(), att, body)
+	s.uploaded(w, att, shared, err)
+}
+
+// uploaded answers a finished upload or completion, counting the bytes it added and
+// whether its content turned out to be stored already
+func (s *Server) uploaded(w http.ResponseWriter, att *attachments.Attachment, shared bool, err error) {
+	switch {
+	case errors.Is(err, attachments.ErrHashMismatch):
+		respondError(w, apierror.New(http.StatusBadRequest, apierror.AttachmentHashMismatch))
+	case errors.Is(err, attachments.ErrSizeMismatch):
+		respondError(w, apierror.New(http.StatusBadRequest, apierror.AttachmentSizeMismatch))
+	case errors.Is(err, attachments.ErrAlreadyComplete):
+		respondError(w, apierror.New(http.StatusConflict, apierror.AttachmentAlreadyUploaded))
+	case errors.Is(err, attachments.ErrNotFound):
+		respondError(w, apierror.New(http.StatusConflict, apierror.AttachmentIncomplete))
+	case err != nil:
+		respondError(w, apierror.New(http.StatusBadRequest, apierror.UploadFailed).With("detail", err.Error()))
+	default:
+		s.stats.AddTotal(stats.TotalAttachmentBytes, att.Size)
+		if shared {
+			s.stats.AddTotal(stats.TotalDeduplicatedUploads, 1)
+		} else {
+			s.billing.Record(billing.Event{Type: billing.EventStorageAdded, Username: att.Owner, Quantity: att.Size})
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// downloadAttachment redirects to object storage or streams the blob, honouring Range
+// requests when the backend can seek
+func (s *Server) downloadAttachment(w http.ResponseWriter, r *http.Request, att *attachments.Attachment) {
+	if !att.Complete {
+		respondError(w, apierror.New(http.StatusConflict, apierror.AttachmentIncomplete))
+		return
+	}
+
+	blobs, err := s.attachments.Blobs(att.Region)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	presigned, err := blobs.PresignDownload(att.Blob, s.config.AttachmentURLExpiry)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	if presigned != "" {
+		http.Redirect(w, r, presigned, http.StatusFound)
+		return
+	}
+
+	blob, err := blobs.Open(r.Context(), att.Blob)
+	if err == attachments.ErrNotFound {
+		respondError(w, apierror.New(http.StatusNotFound, apierror.AttachmentNotFound))
+		return
+	}
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	defer blob.Close()
+
+	liftDeadlines(w)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if seeker, ok := blob.(io.ReadSeeker); ok {
+		if att.SHA256 != "" {
+			// lets an interrupted download resume with If-Range
+			w.Header().Set("ETag", `"`+att.SHA256+`"`)
+		}
+		http.ServeContent(w, r, "", att.CreatedAt, seeker)
+		return
+	}
+	if _, err := io.Copy(w, blob); err != nil {
+		log.Printf("Error streaming attachment %s: %v", att.ID, err)
+	}
+}
+
+// collectBlobs deletes blobs no attachment references any more. Deleting the last
+// attachment normally removes its blob right away, this catches the ones whose backend
+// delete failed. Resumable uploads abandoned for longer than the upload expiry go too
+func (s *Server) collectBlobs(now time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), blobCollectionTimeout)
+	removed, collectErr := s.attachments.CollectGarbage(ctx)
+	cancel()
+	if collectErr != nil {
+		collectErr = fmt.Errorf("collecting unreferenced attachment blobs: %w", collectErr)
+	}
+	if removed > 0 {
+		log.Printf("Deleted %d unreferenced attachment blobs", removed)
+	}
+
+	expired, err := s.uploads.Expire(now.Add(-s.config.AttachmentUploadExpiry))
+	if err != nil {
+		return errors.Join(collectErr, fmt.Errorf("removing abandoned uploads: %w", err))
+	}
+	if expired > 0 {
+		log.Printf("Removed %d abandoned resumable uploads", expired)
+	}
+	return collectErr
+}
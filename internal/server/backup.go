@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/backup"
+)
+
+// BackupRequest defines JSON for POST /api/admin/backup
+type BackupRequest struct {
+	Destination string `json:"destination"` // "file" (default) or "s3"
+}
+
+// BackupResponse describes a finished backup
+type BackupResponse struct {
+	Destination string `json:"destination"`
+	Location    string `json:"location"`
+	Size        int64  `json:"size"`
+	DurationMS  int64  `json:"durationMs"`
+}
+
+// HandleBackup snapshots the live database to the backup directory or S3 (admin only)
+func (s *Server) HandleBackup(w http.ResponseWriter, r *http.Request) {
+	var req BackupRequest
+	if err := s.readJSON(w, r, &req); err != nil {
+		respondError(w, err)
+		return
+	}
+	if req.Destination == "" {
+		req.Destination = "file"
+	}
+	if req.Destination != "file" && req.Destination != "s3" {
+		respondError(w, apierror.New(http.StatusBadRequest, apierror.BackupDestination))
+		return
+	}
+	if req.Destination == "s3" && !s.objectStore.Configured() {
+		respondError(w, apierror.New(http.StatusBadRequest, apierror.StorageNotConfigured))
+		return
+	}
+
+	if err := os.MkdirAll(s.config.BackupDir, 0o700); err != nil {
+		respondInternalError(w, err)
+		return
+	}
+
+	// a large database takes longer to copy than the write timeout allows
+	liftDeadlines(w)
+	start := time.Now()
+	name := "chat-" + start.UTC().Format("20060102T150405Z") + ".db"
+	path := filepath.Join(s.config.BackupDir, name)
+	if err := backup.Snapshot(r.Context(), s.userStorage.DB(), path); err != nil {
+		respondError(w, apierror.New(http.StatusInternalServerError, apierror.BackupFailed).With("detail", err.Error()))
+		return
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	resp := BackupResponse{Destination: req.Destination, Location: path, Size: info.Size()}
+
+	if req.Destination == "s3" {
+		key := s.config.BackupS3Prefix + name
+		if err := s.uploadBackup(r.Context(), path, key, info.Size()); err != nil {
+			respondError(w, apierror.New(http.StatusBadGateway, apierror.UploadFailed).With("detail", err.Error()))
+			return
+		}
+		os.Remove(path)
+		resp.Location = "s3://" + s.objectStore.Bucket + "/" + key
+	}
+
+	resp.DurationMS = time.Since(start).Milliseconds()
+	log.Printf("Backup written to %s (%d bytes)", resp.Location, resp.Size)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) uploadBackup(ctx context.Context, path, key string, size int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s.objectStore.PutObject(ctx, key, f, size, "application/vnd.sqlite3")
+}
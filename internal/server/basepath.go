@@ -0,0 +1,31 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// withBasePath serves next under prefix, so behind a reverse proxy that forwards /chat/...
+// unchanged the handlers still see /api/..., /ws and the static files at the root.
+// Requests outside the prefix are not found, the bare prefix redirects to the trailing
+// slash so relative links in the web client resolve under it
+func withBasePath(prefix string, next http.Handler) http.Handler {
+	if prefix == "" {
+		return next
+	}
+	strip := http.StripPrefix(prefix, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == prefix:
+			target := prefix + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+		case strings.HasPrefix(r.URL.Path, prefix+"/"):
+			strip.ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+)
+
+// limits of a batch frame. A single message larger than maxBatchBytes is still written,
+// on its own
+const (
+	maxBatchMessages = 64
+	maxBatchBytes    = 64 << 10
+)
+
+// textFrame builds a text frame of one message or a batch in a pooled buffer. writePump
+// keeps one for the connection, so writing a message doesn't allocate its JSON or a frame
+type textFrame struct {
+	buf      *bytes.Buffer
+	enc      *json.Encoder // writes to buf through Write
+	messages []*protocol.Message
+}
+
+func newTextFrame() *textFrame {
+	f := &textFrame{}
+	f.enc = json.NewEncoder(f)
+	return f
+}
+
+func (f *textFrame) Write(p []byte) (int, error) {
+	return f.buf.Write(p)
+}
+
+// start begins a frame with message, false if it can't be encoded
+func (f *textFrame) start(message *protocol.Message) bool {
+	f.buf = getFrameBuffer()
+	// the opening bracket is left out again unless the frame becomes a batch
+	f.buf.WriteByte('[')
+	if !f.add(message) {
+		f.reset()
+		return false
+	}
+	return true
+}
+
+// add appends message to the frame, false if it can't be encoded. The frame is left as it
+// was when the message doesn't fit in a batch; the caller checks size and removes it again
+func (f *textFrame) add(message *protocol.Message) bool {
+	mark := f.buf.Len()
+	if len(f.messages) > 0 {
+		f.buf.WriteByte(',')
+	}
+	if err := f.enc.Encode(message); err != nil {
+		log.Printf("Error marshaling message: %v", err)
+		f.buf.Truncate(mark)
+		message.Release()
+		return false
+	}
+	// Encode ends with a newline, which the frame can do without
+	f.buf.Truncate(f.buf.Len() - 1)
+	f.messages = append(f.messages, message)
+	return true
+}
+
+// undo removes the last message added, back to the size mark the frame had before it
+func (f *textFrame) undo(mark int) {
+	f.buf.Truncate(mark)
+	f.messages = f.messages[:len(f.messages)-1]
+}
+
+// size is the length of the frame as a batch, brackets included
+func (f *textFrame) size() int {
+	return f.buf.Len() + 1
+}
+
+// bytes returns the finished frame, valid until reset: a JSON array of several messages,
+// or a lone one as is
+func (f *textFrame) bytes() []byte {
+	if len(f.messages) == 1 {
+		return f.buf.Bytes()[1:]
+	}
+	f.buf.WriteByte(']')
+	return f.buf.Bytes()
+}
+
+// reset releases the written messages and returns the buffer to the pool
+func (f *textFrame) reset() {
+	for i, message := range f.messages {
+		message.Release()
+		f.messages[i] = nil
+	}
+	f.messages = f.messages[:0]
+	putFrameBuffer(f.buf)
+	f.buf = nil
+}
+
+// fillBatch adds the messages already queued behind the first one to frame while it stays
+// within the batch limits, without waiting for more. A message that doesn't fit, or goes in a
+// binary frame, is returned as carry, to start the next frame
+func (c *Client) fillBatch(frame *textFrame) (carry *protocol.Message) {
+	for len(frame.messages) < maxBatchMessages {
+		message, ok := c.send.take()
+		if !ok {
+			return nil
+		}
+		if c.sendsBinary(message) {
+			return message
+		}
+		mark := frame.buf.Len()
+		if !frame.add(message) {
+			continue
+		}
+		if frame.size() > maxBatchBytes {
+			frame.undo(mark)
+			return message
+		}
+	}
+	return nil
+}
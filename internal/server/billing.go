@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/billing"
+	"github.com/Chase-Garrett/meadowlark/internal/config"
+)
+
+// billingTimeout bounds one run posting usage events
+const billingTimeout = time.Minute
+
+// plan limits, named in plan_limit_reached errors and limit.reached events
+const (
+	limitUsers   = "users"
+	limitStorage = "storage"
+)
+
+// findPlan returns the plan cfg puts the workspace on, one without limits when it names none
+func findPlan(cfg *config.Config) (config.Plan, error) {
+	if cfg.Plan == "" {
+		return config.Plan{}, nil
+	}
+	for _, plan := range cfg.Plans {
+		if plan.Name == cfg.Plan {
+			return plan, nil
+		}
+	}
+	return config.Plan{}, fmt.Errorf("plan %q is not listed in MEADOWLARK_PLANS", cfg.Plan)
+}
+
+// newBilling returns the outbox usage events are recorded in and the webhook they are posted
+// to, both nil unless the operator set a webhook
+func newBilling(cfg *config.Config, plan config.Plan, users UserStore, proxy *url.URL) (*billing.Outbox, *billing.Webhook, error) {
+	if cfg.BillingWebhook == "" {
+		return nil, nil, nil
+	}
+	endpoint, err := url.Parse(cfg.BillingWebhook)
+	if err != nil || (endpoint.Scheme != "https" && endpoint.Scheme != "http") || endpoint.Host == "" {
+		return nil, nil, fmt.Errorf("%q is not an http:// or https:// URL", cfg.BillingWebhook)
+	}
+	hook := &billing.Webhook{
+		URL:    cfg.BillingWebhook,
+		Secret: cfg.BillingWebhookSecret,
+		HTTP:   outboundClient(proxy, 30*time.Second),
+	}
+	return billing.NewOutbox(users.DB(), cfg.Tenant, plan.Name), hook, nil
+}
+
+// limitReached answers a request the plan doesn't allow with 402 plan_limit_reached and
+// reports it to billing, so the customer can be offered an upgrade
+func (s *Server) limitReached(username, limit string, max int64) *apierror.Error {
+	s.billing.Record(billing.Event{Type: billing.EventLimitReached, Username: username, Limit: limit})
+	return apierror.New(http.StatusPaymentRequired, apierror.PlanLimitReached).With("limit", limit).With("max", max)
+}
+
+// checkUserLimit refuses a new account once the plan's accounts are all taken
+func (s *Server) checkUserLimit(username string) *apierror.Error {
+	if s.plan.MaxUsers <= 0 {
+		return nil
+	}
+	n, err := s.userStorage.CountUsers()
+	if err != nil {
+		log.Printf("Error counting users for the plan limit: %v", err)
+		return apierror.New(http.StatusInternalServerError, apierror.InternalError)
+	}
+	if n >= s.plan.MaxUsers {
+		return s.limitReached(username, limitUsers, s.plan.MaxUsers)
+	}
+	return nil
+}
+
+// checkStorageLimit refuses an upload of size bytes that would take attachments past the
+// plan's storage
+func (s *Server) checkStorageLimit(username string, size int64) *apierror.Error {
+	if s.plan.MaxStorage <= 0 {
+		return nil
+	}
+	usage, err := s.attachments.Usage()
+	if err != nil {
+		log.Printf("Error reading attachment usage for the plan limit: %v", err)
+		return apierror.New(http.StatusInternalServerError, apierror.InternalError)
+	}
+	if usage.StoredBytes+size > s.plan.MaxStorage {
+		return s.limitReached(username, limitStorage, s.plan.MaxStorage)
+	}
+	return nil
+}
+
+// flushBilling posts the usage events recorded since the last run
+func (s *Server) flushBilling(time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), billingTimeout)
+	defer cancel()
+	_, err := s.billing.Flush(ctx, s.billingHook)
+	return err
+}
+
+// reportUsage records the workspace's total accounts and stored bytes
+func (s *Server) reportUsage(now time.Time) error {
+	users, err := s.userStorage.CountUsers()
+	if err != nil {
+		return err
+	}
+	usage, err := s.attachments.Usage()
+	if err != nil {
+		return err
+	}
+	s.billing.Record(billing.Event{Type: billing.EventUsageUsers, Quantity: users, At: now})
+	s.billing.Record(billing.Event{Type: billing.EventUsageStorage, Quantity: usage.StoredBytes, At: now})
+	return nil
+}
+
+// HandleAdminPlan shows the workspace's plan, how much of it is used and how many usage
+// events wait for the billing webhook (admin only)
+func (s *Server) HandleAdminPlan(w http.ResponseWriter, r *http.Request) {
+	users, err := s.userStorage.CountUsers()
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	usage, err := s.attachments.Usage()
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	pending, err := s.billing.Pending()
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	resp := map[string]interface{}{
+		"plan": s.plan.Name,
+		"limits": map[string]interface{}{
+			"users":            s.plan.MaxUsers,
+			"storageBytes":     s.plan.MaxStorage,
+			"retentionSeconds": int64(s.plan.Retention.Seconds()),
+		},
+		"usage": map[string]interface{}{
+			"users":        users,
+			"storageBytes": usage.StoredBytes,
+		},
+		"billing": map[string]interface{}{
+			"enabled":       s.billing != nil,
+			"pendingEvents": pending,
+		},
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"log"
+
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// binaryContentMin is the smallest content written in a binary frame, smaller messages
+// gain little from it and can still be batched
+const binaryContentMin = 1 << 10
+
+// sendsBinary reports whether message goes to the client in a binary frame
+func (c *Client) sendsBinary(message *protocol.Message) bool {
+	return c.version >= protocol.BinaryVersion && len(message.Content) >= binaryContentMin
+}
+
+// writeBinary writes message as a binary frame, its header from a pooled buffer and its
+// content straight from the message, which the hub shares among a room's members, without
+// encoding it. Returns false when the connection failed
+func (c *Client) writeBinary(message *protocol.Message) bool {
+	if skip, disconnect := c.injectFault(); skip {
+		return !disconnect
+	}
+	buf := getFrameBuffer()
+	defer putFrameBuffer(buf)
+	if err := protocol.AppendBinaryHeader(buf, message); err != nil {
+		log.Printf("Error marshaling message: %v", err)
+		return true
+	}
+	size := buf.Len() + len(message.Content)
+	// no-op unless compression was negotiated for this connection
+	c.conn.EnableWriteCompression(c.compression.shouldCompress([]*protocol.Message{message}, size))
+	w, err := c.conn.NextWriter(websocket.BinaryMessage)
+	if err == nil {
+		w.Write(buf.Bytes())
+		w.Write(message.Content)
+		err = w.Close()
+	}
+	if err != nil {
+		log.Printf("Error writing message: %v", err)
+		return false
+	}
+	c.metrics.sent(1, size)
+	return true
+}
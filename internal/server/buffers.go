@@ -0,0 +1,29 @@
+package server
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+)
+
+// maxPooledBuffer keeps buffers grown past any frame a client may send out of the pool
+const maxPooledBuffer = 2 * protocol.MaxFrameSize
+
+// framePool holds the buffers frames are read into, text frames are encoded in and binary
+// frame headers written to, so a busy connection doesn't allocate a buffer per frame
+var framePool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// getFrameBuffer returns an empty buffer from the pool
+func getFrameBuffer() *bytes.Buffer {
+	buf := framePool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// putFrameBuffer returns buf to the pool, nothing may use it or its bytes afterwards
+func putFrameBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBuffer {
+		framePool.Put(buf)
+	}
+}
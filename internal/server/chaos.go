@@ -0,0 +1,57 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+
+	"github.com/Chase-Garrett/meadowlark/internal/chaos"
+	"github.com/Chase-Garrett/meadowlark/internal/config"
+)
+
+// chaosDriver is SQLite with injected errors, registered when MEADOWLARK_CHAOS_DB_ERROR_RATE is set
+const chaosDriver = "sqlite3-chaos"
+
+// the process's failure injection. A database driver can only be registered once, so the
+// faults are loaded once too, from the first config
+var (
+	faultsOnce sync.Once
+	faults     *chaos.Faults
+	faultsErr  error
+)
+
+// loadFaults returns the failure injection set in cfg, nil when there is none. It is only
+// allowed in developer mode, so a production server can't be started with it by mistake
+func loadFaults(cfg *config.Config) (*chaos.Faults, error) {
+	faultsOnce.Do(func() {
+		f := &chaos.Faults{
+			Latency:        cfg.ChaosLatency,
+			DropRate:       cfg.ChaosDropRate,
+			DisconnectRate: cfg.ChaosDisconnectRate,
+			DBErrorRate:    cfg.ChaosDBErrorRate,
+		}
+		if f.Latency <= 0 && f.DropRate <= 0 && f.DisconnectRate <= 0 && f.DBErrorRate <= 0 {
+			return
+		}
+		if !cfg.Dev {
+			faultsErr = fmt.Errorf("the MEADOWLARK_CHAOS_ settings require MEADOWLARK_DEV")
+			return
+		}
+		for _, rate := range []float64{f.DropRate, f.DisconnectRate, f.DBErrorRate} {
+			if rate < 0 || rate > 1 {
+				faultsErr = fmt.Errorf("chaos rates must be between 0 and 1, got %v", rate)
+				return
+			}
+		}
+		if f.DBErrorRate > 0 {
+			base, err := chaos.BaseDriver("sqlite3")
+			if err != nil {
+				faultsErr = err
+				return
+			}
+			sql.Register(chaosDriver, f.Driver(base))
+		}
+		faults = f
+	})
+	return faults, faultsErr
+}
@@ -0,0 +1,293 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/auth"
+	"github.com/Chase-Garrett/meadowlark/internal/chaos"
+	"github.com/Chase-Garrett/meadowlark/internal/config"
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// chaosEnv turns on every kind of fault, often enough that a client needs several tries
+// to get its messages through. Faults are loaded once per process, so only one test in
+// the package can start a chaos server
+var chaosEnv = map[string]string{
+	"MEADOWLARK_CHAOS_LATENCY":         "2ms",
+	"MEADOWLARK_CHAOS_DROP_RATE":       "0.1",
+	"MEADOWLARK_CHAOS_DISCONNECT_RATE": "0.03",
+	"MEADOWLARK_CHAOS_DB_ERROR_RATE":   "0.03",
+}
+
+// chaosServer starts a developer mode server with chaosEnv's faults, not yet armed, and
+// returns the URL of its websocket endpoint
+func chaosServer(t *testing.T) (*Server, string) {
+	dir := t.TempDir()
+	t.Setenv("MEADOWLARK_DEV", "true")
+	// in memory, writes that finish after the test can't race the temporary directory's removal
+	t.Setenv("MEADOWLARK_DB_PATH", "file:/"+t.Name()+"?vfs=memdb")
+	t.Setenv("MEADOWLARK_IDENTITY_KEY_FILE", filepath.Join(dir, "identity.key"))
+	// every resubmission counts towards the sending rate
+	t.Setenv("MEADOWLARK_SPAM_ENABLED", "false")
+	for key, value := range chaosEnv {
+		t.Setenv(key, value)
+	}
+	cfg := config.Load()
+	s := NewServer(cfg)
+	if s.faults == nil {
+		t.Fatal("chaos mode is off")
+	}
+	s.seedDevFixtures()
+
+	mux := http.NewServeMux()
+	registerRoutes(mux, s, cfg)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return s, "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+}
+
+// chaosPeer is a protocol version 1 client that reconnects whenever its connection fails
+type chaosPeer struct {
+	url      string
+	token    string
+	deviceID string
+	conn     *websocket.Conn
+}
+
+func newChaosPeer(t *testing.T, s *Server, url, username string) *chaosPeer {
+	scopes, apiErr := s.tokenScopes(username, nil, nil)
+	if apiErr != nil {
+		t.Fatal(apiErr)
+	}
+	token, err := s.issueToken(username, auth.TokenOptions{Scopes: scopes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &chaosPeer{url: url, token: token, deviceID: username + "-test"}
+}
+
+// dial connects and sends the hello with cursor, retrying until a connection gets through
+func (p *chaosPeer) dial(cursor int64, deadline time.Time) error {
+	for time.Now().Before(deadline) {
+		conn, _, err := websocket.DefaultDialer.Dial(p.url+"?token="+p.token, nil)
+		if err == nil {
+			hello := map[string]string{"type": protocol.TypeHello, "deviceId": p.deviceID, "version": "1"}
+			if cursor > 0 {
+				hello["cursor"] = strconv.FormatInt(cursor, 10)
+			}
+			if err = conn.WriteJSON(hello); err == nil {
+				p.conn = conn
+				return nil
+			}
+			conn.Close()
+		}
+		// the handshake's database calls fail now and then too
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fmt.Errorf("%s didn't finish before the deadline", p.deviceID)
+}
+
+// read returns the next message, an error once the connection failed or nothing arrived
+// within wait
+func (p *chaosPeer) read(wait time.Duration) (*protocol.Message, error) {
+	p.conn.SetReadDeadline(time.Now().Add(wait))
+	_, data, err := p.conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	var message protocol.Message
+	if err := json.Unmarshal(data, &message); err != nil {
+		return nil, fmt.Errorf("undecodable frame %s: %v", data, err)
+	}
+	return &message, nil
+}
+
+// sendUntilAcknowledged sends a message with each client id to recipient, then resends
+// those not acknowledged yet, reconnecting as often as it takes. A resubmission of a stored
+// message is answered with a duplicate event, which is the acknowledgement; the returned
+// map has the message id it gave for each client id
+func (p *chaosPeer) sendUntilAcknowledged(recipient string, clientIDs []string, deadline time.Time) (map[string]int64, error) {
+	acked := make(map[string]int64)
+	for len(acked) < len(clientIDs) {
+		if err := p.dial(0, deadline); err != nil {
+			return acked, err
+		}
+		for _, clientID := range clientIDs {
+			if _, ok := acked[clientID]; ok {
+				continue
+			}
+			frame := map[string]string{
+				"recipient": recipient,
+				"clientId":  clientID,
+				"content":   base64.StdEncoding.EncodeToString([]byte(clientID)),
+			}
+			if err := p.conn.WriteJSON(frame); err != nil {
+				break
+			}
+		}
+		for {
+			message, err := p.read(200 * time.Millisecond)
+			if err != nil {
+				break
+			}
+			if message.Control == nil || message.Control.Event != protocol.EventDuplicate {
+				continue
+			}
+			data, _ := message.Control.Data.(map[string]interface{})
+			clientID, _ := data["clientId"].(string)
+			id, _ := data["messageId"].(float64)
+			if id == 0 {
+				return acked, fmt.Errorf("duplicate event without a message id: %v", data)
+			}
+			acked[clientID] = int64(id)
+		}
+		p.conn.Close()
+	}
+	return acked, nil
+}
+
+// receiveInOrder collects the stored messages from sender by conversation sequence number
+// until it has every one up to last. It reconnects with the id of the last message received
+// without a gap as its cursor whenever the connection fails or the next one takes too long,
+// so the server replays whatever was lost
+func (p *chaosPeer) receiveInOrder(sender string, cursor, next, last int64, deadline time.Time) (map[int64]*protocol.Message, error) {
+	bySeq := make(map[int64]*protocol.Message)
+	for next <= last {
+		if err := p.dial(cursor, deadline); err != nil {
+			return bySeq, err
+		}
+		// presence and other events keep coming, only progress counts
+		progress := time.Now()
+		for next <= last {
+			message, err := p.read(time.Until(progress.Add(300 * time.Millisecond)))
+			if err != nil {
+				break
+			}
+			// a message that failed to store is still relayed live, without an id or sequence
+			// number; its sender retries it
+			if message.Type != protocol.TypeChat || message.Sender != sender || message.Seq == 0 {
+				continue
+			}
+			// messages stored while a replay runs may arrive twice, but never with another's seq
+			if seen, ok := bySeq[message.Seq]; ok && seen.ID != message.ID {
+				return bySeq, fmt.Errorf("seq %d given to messages %d and %d", message.Seq, seen.ID, message.ID)
+			}
+			bySeq[message.Seq] = message
+			for bySeq[next] != nil {
+				cursor = bySeq[next].ID
+				next++
+				progress = time.Now()
+			}
+		}
+		p.conn.Close()
+	}
+	return bySeq, nil
+}
+
+// retryInjected runs query until it fails with something other than an injected error
+func retryInjected(query func() error) error {
+	for {
+		if err := query(); !errors.Is(err, chaos.ErrInjected) {
+			return err
+		}
+	}
+}
+
+// TestDeliveryUnderChaos has alice send messages to bob while frames are delayed, dropped and
+// cut off and database calls fail, with bob connected throughout and reconnecting whenever
+// a message goes missing. Every message alice was told was accepted must be stored once, and
+// bob must receive all of them with gap-free sequence numbers
+func TestDeliveryUnderChaos(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs for several seconds")
+	}
+	const count = 100
+	s, url := chaosServer(t)
+
+	// bob writes first, so alice's messages to him aren't treated as a stranger's, and the
+	// conversation has a message bob's cursor can start from
+	seed := &protocol.Message{Type: protocol.TypeChat, Sender: "bob", Recipient: "alice", Content: []byte("hi")}
+	if err := s.messages.Save(seed); err != nil {
+		t.Fatal(err)
+	}
+	alice := newChaosPeer(t, s, url, "alice")
+	bob := newChaosPeer(t, s, url, "bob")
+	clientIDs := make([]string, count)
+	for i := range clientIDs {
+		clientIDs[i] = fmt.Sprintf("00000000-0000-4000-8000-%012d", i)
+	}
+	s.faults.Arm()
+	deadline := time.Now().Add(time.Minute)
+
+	type sendResult struct {
+		acked map[string]int64
+		err   error
+	}
+	sent := make(chan sendResult, 1)
+	go func() {
+		acked, err := alice.sendUntilAcknowledged("bob", clientIDs, deadline)
+		sent <- sendResult{acked, err}
+	}()
+	received, err := bob.receiveInOrder("alice", seed.ID, seed.Seq+1, seed.Seq+count, deadline)
+	if err != nil {
+		t.Fatalf("bob received %d of %d messages: %v", len(received), count, err)
+	}
+	result := <-sent
+	if result.err != nil {
+		t.Fatalf("alice had %d of %d messages acknowledged: %v", len(result.acked), count, result.err)
+	}
+
+	type stored struct{ id, seq int64 }
+	byClientID := make(map[string]stored)
+	err = retryInjected(func() error {
+		rows, err := s.userStorage.DB().Query(`SELECT client_id, id, seq FROM messages WHERE sender = 'alice' AND recipient = 'bob'`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		clear(byClientID)
+		for rows.Next() {
+			var clientID string
+			var row stored
+			if err := rows.Scan(&clientID, &row.id, &row.seq); err != nil {
+				return err
+			}
+			if _, ok := byClientID[clientID]; ok {
+				return fmt.Errorf("client id %s stored twice", clientID)
+			}
+			byClientID[clientID] = row
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(byClientID) != count {
+		t.Fatalf("%d messages stored, want %d", len(byClientID), count)
+	}
+
+	for _, clientID := range clientIDs {
+		row, ok := byClientID[clientID]
+		if !ok {
+			t.Fatalf("message %s was acknowledged but not stored", clientID)
+		}
+		if acked := result.acked[clientID]; acked != row.id {
+			t.Errorf("message %s acknowledged as id %d, stored as %d", clientID, acked, row.id)
+		}
+		message := received[row.seq]
+		if message == nil || message.ID != row.id || message.ClientID != clientID || string(message.Content) != clientID {
+			t.Errorf("bob got %+v as seq %d, want message %d with client id %s", message, row.seq, row.id, clientID)
+		}
+	}
+}
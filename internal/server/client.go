@@ -1,103 +1,503 @@
 package server
 
 import (
-	"encoding/base64"
-	"encoding/json"
+	"bytes"
+	"fmt"
 	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
 
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/auth"
+	"github.com/Chase-Garrett/meadowlark/internal/chaos"
+	"github.com/Chase-Garrett/meadowlark/internal/flags"
+	"github.com/Chase-Garrett/meadowlark/internal/history"
+	"github.com/Chase-Garrett/meadowlark/internal/notifications"
 	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+	"github.com/Chase-Garrett/meadowlark/internal/rooms"
+	"github.com/Chase-Garrett/meadowlark/internal/sessions"
+	"github.com/Chase-Garrett/meadowlark/internal/spam"
+	"github.com/Chase-Garrett/meadowlark/internal/stats"
 
 	"github.com/gorilla/websocket"
 )
 
 // middleware between websocket connection and hub
 type Client struct {
-	hub      *Hub
-	conn     *websocket.Conn
-	send     chan *protocol.Message
-	username string
-}
+	hub         MessageRouter
+	conn        *websocket.Conn
+	send        *sendQueues
+	username    string
+	compression compressionPolicy
+	messages    *history.MessageStorage
+	users       UserStore
+	release     func() // frees the connection limit slot
+	spam        *spam.Filter
+	createdAt   time.Time       // account registration time, for spam scoring
+	contacts    map[string]bool // recipients known to have messaged this user
+	stats       *stats.Collector
+	sessions    *sessions.Log
+	ip          string
+	userAgent   string
+	dedupe      *dedupeCache
+	rooms       *rooms.Storage
+	locations   *locationShares
+	verbose     bool // log the type of every frame
+	sessionID   string
+	deviceID    string // sent by the client in its hello
+	version     int    // protocol version agreed in the hello
+
+	// traffic and heartbeat round trip times, for the admin API and /metrics
+	conns        *connRegistry
+	metrics      *connMetrics
+	pingInterval time.Duration
+	faults       *chaos.Faults // nil outside chaos mode
+	flags        *flags.Set
+
+	// expiry of the token the connection was opened or last renewed with
+	token         tokenLifetime
+	reauthWarning time.Duration // how long before expiry the client is asked for a new token
+	keyBinding    string        // thumbprint of the key the token is bound to, renewals must match
+	tenant        string        // workspace the connection is in, renewals must be issued by it
+	canSend       bool          // the token has the chat:send scope
+
+	// unknown recipients are checked like strangers and answered like the hub's generic notices
+	recipientPrivacy bool
 
-// IncomingMessage represents a message received from the client
-type IncomingMessage struct {
-	Recipient string      `json:"recipient"`
-	Sender    string      `json:"sender"`
-	Content   interface{} `json:"content"` // Can be string or base64 string
+	// the presence status and do-not-disturb schedule the user chose, only touched by the hub
+	// once registered; when the connection last sent something, in unix nanoseconds, and how
+	// long until it counts as idle
+	status      string
+	dnd         notifications.DoNotDisturb
+	lastActive  atomic.Int64
+	idleTimeout time.Duration
+
+	// only touched by readPump
+	invalidFrames int // malformed frames so far
+	throttled     int // messages sent in a row while rate limited
 }
 
+// misbehaving connections are closed once they pass these counts
+const (
+	maxInvalidFrames   = 20
+	maxThrottledInARow = 10
+)
+
+// seconds a client closed for sending too fast should wait before reconnecting
+const rateLimitRetryAfter = 60
+
 func (c *Client) readPump() {
+	disconnect := sessions.Event{Username: c.username, Kind: sessions.EventDisconnect, IP: c.ip, UserAgent: c.userAgent}
+	done := make(chan struct{})
 	defer func() {
-		c.hub.unregister <- c
+		close(done)
+		c.stopExpiry()
+		c.hub.Unregister(c)
 		c.conn.Close()
+		c.release()
+		c.conns.remove(c)
+		c.sessions.Record(disconnect)
 	}()
+	if c.pingInterval > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(3 * c.pingInterval))
+		c.conn.SetPongHandler(func(payload string) error {
+			c.metrics.pong(payload)
+			return c.conn.SetReadDeadline(time.Now().Add(3 * c.pingInterval))
+		})
+		go c.ping(c.pingInterval, done)
+	}
 	for {
-		_, messageBytes, err := c.conn.ReadMessage()
+		frame, size, frameErr, err := c.readFrame()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("error: %v", err)
 			}
+			if closeErr, ok := err.(*websocket.CloseError); ok {
+				disconnect.CloseCode = closeErr.Code
+				disconnect.CloseReason = closeErr.Text
+			} else {
+				disconnect.CloseReason = err.Error()
+			}
 			break
 		}
+		if c.faults.Drop() {
+			continue
+		}
+		c.metrics.received(size)
+		if c.pingInterval > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(3 * c.pingInterval))
+		}
 
-		var incoming IncomingMessage
-		if err := json.Unmarshal(messageBytes, &incoming); err != nil {
-			log.Printf("Error unmarshaling message: %v", err)
+		if frameErr != nil {
+			if c.rejectFrame(&disconnect, frameError(frameErr)) {
+				return
+			}
 			continue
 		}
+		if c.verbose {
+			log.Printf("Frame from %s: type %q, %d bytes", c.username, frame.Type, size)
+		}
+		// flow control and token renewals are sent by the client on its own, not by its user
+		if frame.Type != protocol.TypeWindow && frame.Type != protocol.TypeReauth && c.touch(time.Now()) {
+			c.hub.Active(c.username)
+		}
 
-		// Convert content to []byte
-		// Frontend sends encrypted content as base64 string, we decode it to []byte
-		var contentBytes []byte
-		if contentStr, ok := incoming.Content.(string); ok {
-			// Content is base64-encoded encrypted bytes
-			// Decode base64 to get the actual encrypted byte array
-			decoded, err := base64.StdEncoding.DecodeString(contentStr)
-			if err != nil {
-				log.Printf("Error decoding base64 content: %v", err)
-				continue
+		if frame.Type == protocol.TypeCommand {
+			c.runCommand(frame)
+			continue
+		}
+		if frame.Type == protocol.TypeReauth {
+			c.reauthenticate(frame.Token)
+			continue
+		}
+		if frame.Type == protocol.TypeWindow {
+			// credit for a stream that already finished is of no use, and harmless
+			c.send.grant(frame.Stream, frame.Credit)
+			continue
+		}
+		if frame.Type == protocol.TypeHello {
+			// the handshake happened before readPump started
+			if c.rejectFrame(&disconnect, apierror.New(http.StatusBadRequest, apierror.InvalidFrame).With("field", "type").With("reason", "hello was already sent")) {
+				return
 			}
-			contentBytes = decoded
-		} else {
-			// Fallback: try to unmarshal as protocol.Message for base64 []byte support
-			var msg protocol.Message
-			if json.Unmarshal(messageBytes, &msg) == nil {
-				contentBytes = msg.Content
-			} else {
-				log.Printf("Could not parse content, expected string, got: %T", incoming.Content)
+			continue
+		}
+		// readonly tokens receive but can't send messages, locations or commands
+		if !c.canSend {
+			c.sendError(apierror.New(http.StatusForbidden, apierror.InsufficientScope).With("scope", auth.ScopeChatSend))
+			continue
+		}
+		if frame.Type == protocol.TypeLocation {
+			c.relayLocation(frame)
+			continue
+		}
+
+		if frame.ClientID != "" {
+			if sub, ok := c.dedupe.lookup(c.username, frame.ClientID); ok {
+				c.sendDuplicate(frame.ClientID, sub)
 				continue
 			}
 		}
 
 		msg := &protocol.Message{
-			Recipient: incoming.Recipient,
+			Type:      frame.Type, // chat or forward, relayed as they came
+			Recipient: frame.Recipient,
 			Sender:    c.username, // ensure correctly identified sender
-			Content:   contentBytes,
+			Content:   frame.Content,
+			ClientID:  frame.ClientID,
+
+			Provenance: frame.Provenance,
+			NoForward:  frame.NoForward,
+		}
+
+		if frame.Room != "" {
+			msg.Room = frame.Room
+			c.postToRoom(msg)
+			continue
+		}
+
+		// previous usernames still reach the account during the alias grace period
+		recipient, err := c.users.ResolveUsername(msg.Recipient)
+		unknown := err == auth.ErrUserNotFound
+		if unknown && !c.recipientPrivacy {
+			c.hub.Reject(msg, history.ReasonUnknownRecipient)
+			continue
+		}
+		if err != nil && !unknown {
+			log.Printf("Error looking up recipient: %v", err)
+			c.sendError(apierror.New(http.StatusInternalServerError, apierror.InternalError))
+			continue
+		}
+		if !unknown {
+			msg.Recipient = recipient
+		}
+
+		// with recipient privacy, guessing usernames counts like messaging strangers, so
+		// probing for accounts runs into the same rate and fan-out limits
+		verdict := c.spam.Check(c.username, msg.Recipient, c.isContact(msg.Recipient), c.createdAt)
+		if verdict.Action != spam.ActionAllow && c.spam.ShouldRecordFlag(c.username) {
+			log.Printf("Flagged %s for review (score %.2f, %s): %v", c.username, verdict.Score, verdict.Action, verdict.Reasons)
+			if err := c.spam.Store().RecordFlag(c.username, verdict); err != nil {
+				log.Printf("Error recording spam flag: %v", err)
+			}
+		}
+		if verdict.Action != spam.ActionThrottle {
+			c.throttled = 0
+		}
+		switch verdict.Action {
+		case spam.ActionThrottle:
+			// a client that keeps sending regardless is disconnected
+			if c.throttled++; c.throttled > maxThrottledInARow {
+				c.closeConn(&disconnect, protocol.CloseRateLimited,
+					protocol.CloseReason{Code: apierror.RateLimited, Retry: true, RetryAfter: rateLimitRetryAfter})
+				return
+			}
+			c.hub.Forward(protocol.NewControlMessage(c.username, protocol.EventRateLimited, map[string]interface{}{
+				"recipient":         msg.Recipient,
+				"retryAfterSeconds": 60,
+				"error":             apierror.New(http.StatusTooManyRequests, apierror.RateLimited).With("retryAfterSeconds", 60),
+			}))
+			continue
+		case spam.ActionShadow:
+			// the sender isn't told, the message waits for an admin
+			if unknown {
+				continue
+			}
+			if err := c.spam.Store().Hold(msg.Sender, msg.Recipient, msg.Content, verdict.Score); err != nil {
+				log.Printf("Error holding message: %v", err)
+			} else if msg.ClientID != "" {
+				c.dedupe.remember(c.username, msg.ClientID, submission{})
+			}
+			continue
+		}
+
+		if unknown {
+			c.hub.Reject(msg, history.ReasonUnknownRecipient)
+			continue
+		}
+
+		// keep the encrypted envelope so other devices can sync it later
+		err = c.messages.Save(msg)
+		if err == history.ErrDuplicate {
+			// stored before the dedupe cache entry expired or on another server start
+			sub := submission{id: msg.ID, seq: msg.Seq, timestamp: msg.Timestamp}
+			c.dedupe.remember(c.username, msg.ClientID, sub)
+			c.sendDuplicate(msg.ClientID, sub)
+			continue
+		}
+		if err != nil {
+			log.Printf("Error storing message: %v", err)
+		} else if msg.ClientID != "" {
+			c.dedupe.remember(c.username, msg.ClientID, submission{id: msg.ID, seq: msg.Seq, timestamp: msg.Timestamp})
 		}
+		c.stats.MessageSent()
+		c.stats.UserActive(c.username)
+
+		c.hub.Forward(msg)
+	}
+}
+
+// postToRoom stores a room message and hands it to the hub for fan-out.
+// Rooms only contain members added by their moderators, so spam scoring is skipped
+func (c *Client) postToRoom(msg *protocol.Message) {
+	snap, err := c.rooms.Snapshot(msg.Room)
+	if err == rooms.ErrNotFound {
+		c.sendError(apierror.New(http.StatusNotFound, apierror.RoomNotFound).With("room", msg.Room))
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading room %s: %v", msg.Room, err)
+		return
+	}
+	// checked before storing so rejected posts leave nothing behind, the hub checks again
+	if apiErr := roomPostError(snap, c.username); apiErr != nil {
+		c.sendError(apiErr)
+		return
+	}
+	if wait := c.hub.ClaimRoomPost(snap, c.username); wait > 0 {
+		retryAfter := int64((wait + time.Second - 1) / time.Second)
+		c.sendError(apierror.New(http.StatusTooManyRequests, apierror.RoomSlowMode).
+			With("room", snap.Room.ID).With("retryAfter", retryAfter))
+		return
+	}
 
-		c.hub.forward <- msg
+	err = c.messages.SaveRoom(msg)
+	if err == history.ErrDuplicate {
+		sub := submission{id: msg.ID, seq: msg.Seq, timestamp: msg.Timestamp}
+		c.dedupe.remember(c.username, msg.ClientID, sub)
+		c.sendDuplicate(msg.ClientID, sub)
+		return
+	}
+	if err != nil {
+		log.Printf("Error storing room message: %v", err)
+		return
 	}
+	if msg.ClientID != "" {
+		c.dedupe.remember(c.username, msg.ClientID, submission{id: msg.ID, seq: msg.Seq, timestamp: msg.Timestamp})
+	}
+	c.stats.MessageSent()
+	c.stats.UserActive(c.username)
+
+	c.hub.Forward(msg)
+}
+
+// rejectFrame reports a malformed frame to the client and closes the connection once there
+// have been too many, it returns true when the connection was closed
+func (c *Client) rejectFrame(disconnect *sessions.Event, apiErr *apierror.Error) bool {
+	c.sendError(apiErr)
+	if c.invalidFrames++; c.invalidFrames <= maxInvalidFrames {
+		return false
+	}
+	c.closeConn(disconnect, protocol.CloseProtocolViolation, protocol.CloseReason{Code: apiErr.Code})
+	return true
+}
+
+// closeConn sends a close frame from readPump, which then returns and records disconnect.
+// WriteControl may be called concurrently with writePump
+func (c *Client) closeConn(disconnect *sessions.Event, code int, reason protocol.CloseReason) {
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason.String()), time.Now().Add(time.Second))
+	disconnect.CloseCode = code
+	disconnect.CloseReason = reason.Code
+}
+
+// frameError is the error sent back for a frame DecodeFrame rejected
+func frameError(err *protocol.FrameError) *apierror.Error {
+	if err.Field == "clientId" {
+		return apierror.New(http.StatusBadRequest, apierror.InvalidClientID)
+	}
+	apiErr := apierror.New(http.StatusBadRequest, apierror.InvalidFrame).With("reason", err.Reason)
+	if err.Field != "" {
+		apiErr.With("field", err.Field)
+	}
+	return apiErr
+}
+
+// sendError tells this client a frame was rejected
+func (c *Client) sendError(apiErr *apierror.Error) {
+	c.hub.Forward(protocol.NewControlMessage(c.username, protocol.EventError, apiErr))
+}
+
+// sendDuplicate tells this client a resubmitted message was already accepted
+func (c *Client) sendDuplicate(clientID string, sub submission) {
+	data := map[string]interface{}{"clientId": clientID}
+	if sub.id != 0 {
+		data["messageId"] = sub.id
+		data["seq"] = sub.seq
+		data["timestamp"] = sub.timestamp
+	}
+	c.hub.Forward(protocol.NewControlMessage(c.username, protocol.EventDuplicate, data))
+}
+
+// isContact reports whether recipient has messaged this client's user before
+func (c *Client) isContact(recipient string) bool {
+	if c.contacts[recipient] {
+		return true
+	}
+	known, err := c.messages.HasReceivedFrom(c.username, recipient)
+	if err != nil {
+		log.Printf("Error checking contact: %v", err)
+		return false
+	}
+	if known {
+		c.contacts[recipient] = true
+	}
+	return known
+}
+
+// touch records activity on the connection, reporting whether it had been idle long enough
+// to be shown away
+func (c *Client) touch(now time.Time) bool {
+	last := c.lastActive.Swap(now.UnixNano())
+	return c.idleTimeout > 0 && now.Sub(time.Unix(0, last)) >= c.idleTimeout
+}
+
+// activeAt returns when the connection last sent something
+func (c *Client) activeAt() time.Time {
+	return time.Unix(0, c.lastActive.Load())
+}
+
+// readFrame reads the next frame into a pooled buffer and decodes it. err is a read error,
+// which ends the connection; a frame that doesn't decode is returned as frameErr, with the
+// size read either way
+func (c *Client) readFrame() (frame *protocol.Frame, size int, frameErr *protocol.FrameError, err error) {
+	messageType, reader, err := c.conn.NextReader()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	buf := getFrameBuffer()
+	defer putFrameBuffer(buf)
+	if _, err := buf.ReadFrom(reader); err != nil {
+		return nil, 0, nil, err
+	}
+
+	data := buf.Bytes()
+	var decodeErr error
+	switch {
+	case messageType == websocket.TextMessage:
+		frame, decodeErr = protocol.DecodeFrame(data)
+	case c.version < protocol.BinaryVersion:
+		decodeErr = &protocol.FrameError{Reason: fmt.Sprintf("binary frames need protocol version %d", protocol.BinaryVersion)}
+	default:
+		frame, decodeErr = protocol.DecodeBinaryFrame(data)
+		if decodeErr == nil {
+			// the content outlives the buffer, which goes back to the pool
+			frame.Content = bytes.Clone(frame.Content)
+		}
+	}
+	if decodeErr != nil {
+		return nil, len(data), decodeErr.(*protocol.FrameError), nil
+	}
+	return frame, len(data), nil, nil
+}
+
+// injectFault delays a frame about to be written in chaos mode, and decides whether it is
+// lost or the connection cut without a close frame instead
+func (c *Client) injectFault() (skip, disconnect bool) {
+	if c.faults.Disconnect() {
+		log.Printf("Chaos mode: cutting the connection of %s", c.username)
+		return true, true
+	}
+	c.faults.Delay()
+	return c.faults.Drop(), false
 }
 
 func (c *Client) writePump() {
 	defer func() {
 		c.conn.Close()
 	}()
+	// the hello is always written alone, it tells the client whether batches follow
+	batching := false
+	var carry *protocol.Message
+	text := newTextFrame()
 	for {
-		select {
-		case message, ok := <-c.send:
-			if !ok {
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+		message := carry
+		carry = nil
+		if message == nil {
+			var ok bool
+			if message, ok = c.send.next(); !ok {
+				var closeMessage []byte
+				if c.send.closeCode != 0 {
+					closeMessage = websocket.FormatCloseMessage(c.send.closeCode, c.send.closeReason)
+				}
+				c.conn.WriteMessage(websocket.CloseMessage, closeMessage)
 				return
 			}
-			messageBytes, err := json.Marshal(message)
-			if err != nil {
-				log.Printf("Error marshaling message: %v", err)
-				continue
+		}
+		if c.sendsBinary(message) {
+			ok := c.writeBinary(message)
+			message.Release()
+			if !ok {
+				return
 			}
-			if err := c.conn.WriteMessage(websocket.TextMessage, messageBytes); err != nil {
-				log.Printf("Error writing message: %v", err)
+			batching = c.version >= protocol.BatchVersion
+			continue
+		}
+		if !text.start(message) {
+			continue
+		}
+		if batching {
+			carry = c.fillBatch(text)
+		}
+		if skip, disconnect := c.injectFault(); skip {
+			text.reset()
+			if disconnect {
 				return
 			}
+			continue
+		}
+		frame := text.bytes()
+		count, size := len(text.messages), len(frame)
+		// no-op unless compression was negotiated for this connection
+		c.conn.EnableWriteCompression(c.compression.shouldCompress(text.messages, len(frame)))
+		err := c.conn.WriteMessage(websocket.TextMessage, frame)
+		// the written messages and frame buffer go back to their pools
+		text.reset()
+		if err != nil {
+			log.Printf("Error writing message: %v", err)
+			return
 		}
+		c.metrics.sent(count, size)
+		batching = c.version >= protocol.BatchVersion
 	}
 }
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// pumpedClient returns a Client speaking version whose writePump writes to a websocket peer
+// that discards everything, and a function that closes it once sent messages were written
+func pumpedClient(b *testing.B, version int) (*Client, func(sent int64)) {
+	upgraded := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		upgraded <- conn
+	}))
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	go func() {
+		for {
+			_, r, err := peer.NextReader()
+			if err != nil {
+				return
+			}
+			io.Copy(io.Discard, r)
+		}
+	}()
+
+	c := &Client{conn: <-upgraded, send: newSendQueues(), metrics: &connMetrics{}, username: "bob", version: version}
+	done := make(chan struct{})
+	go func() {
+		c.writePump()
+		close(done)
+	}()
+	return c, func(sent int64) {
+		for c.metrics.messagesOut.Load() < sent {
+			time.Sleep(time.Millisecond)
+		}
+		// the benchmark goroutine stands in for the hub here
+		c.send.close()
+		<-done
+		peer.Close()
+		srv.Close()
+	}
+}
+
+// BenchmarkWritePump writes room messages copied for one member, as the hub queues them,
+// 16 per op
+func BenchmarkWritePump(b *testing.B) {
+	const perOp = 16
+	tests := []struct {
+		name    string
+		version int
+		size    int
+	}{
+		{"single", protocol.StreamsVersion, 200},
+		{"batched", protocol.BatchVersion, 200},
+		{"binary", protocol.BinaryVersion, 16 << 10},
+	}
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			c, stop := pumpedClient(b, tt.version)
+			template := &protocol.Message{Type: protocol.TypeChat, Room: "r1", Sender: "alice", Recipient: "bob",
+				Content: bytes.Repeat([]byte{0xa5}, tt.size), Timestamp: time.Now().UnixMilli()}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < perOp; j++ {
+					message := protocol.CopyMessage(template)
+					message.Seq = int64(i*perOp + j + 1)
+					c.send.pushWait(laneContent, message)
+				}
+			}
+			stop(int64(b.N * perOp))
+		})
+	}
+}
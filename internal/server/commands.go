@@ -0,0 +1,252 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/auth"
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+	"github.com/Chase-Garrett/meadowlark/internal/rooms"
+)
+
+// commandContext is what a slash command runs against
+type commandContext struct {
+	client *Client
+	room   *rooms.Snapshot
+	role   string // the issuer's role in the room
+	usage  string
+	args   []string // arguments split on whitespace
+	rest   string   // everything after the command name, for free text
+}
+
+// roomCommand is a slash command that acts on the room it was sent to
+type roomCommand struct {
+	usage   string
+	minRole string
+	run     func(ctx *commandContext) (interface{}, *apierror.Error)
+}
+
+// roomCommands are the commands clients can send as {"type": "command", "room": ..., "command": "/kick bob"}
+var roomCommands = map[string]roomCommand{
+	"topic":  {usage: "/topic <text>", minRole: rooms.RoleModerator, run: runTopicCommand},
+	"invite": {usage: "/invite <username>", minRole: rooms.RoleModerator, run: runInviteCommand},
+	"kick":   {usage: "/kick <username>", minRole: rooms.RoleModerator, run: runKickCommand},
+	"mute":   {usage: "/mute <username> [duration]", minRole: rooms.RoleModerator, run: runMuteCommand},
+	"unmute": {usage: "/unmute <username>", minRole: rooms.RoleModerator, run: runUnmuteCommand},
+}
+
+// parseCommand splits "/name args..." into its lowercased name, arguments and raw argument text
+func parseCommand(line string) (name string, args []string, rest string, ok bool) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "/") {
+		return "", nil, "", false
+	}
+	name = line[1:]
+	if i := strings.IndexFunc(name, unicode.IsSpace); i >= 0 {
+		name, rest = name[:i], strings.TrimSpace(name[i:])
+	}
+	name = strings.ToLower(name)
+	return name, strings.Fields(rest), rest, name != ""
+}
+
+// runCommand executes a slash command and sends the outcome back as a command_result control message
+func (c *Client) runCommand(incoming *protocol.Frame) {
+	name, args, rest, ok := parseCommand(incoming.Command)
+	result := map[string]interface{}{"command": name}
+	if incoming.ClientID != "" {
+		result["clientId"] = incoming.ClientID
+	}
+	if incoming.Room != "" {
+		result["room"] = incoming.Room
+	}
+
+	var data interface{}
+	var apiErr *apierror.Error
+	switch {
+	case !ok:
+		apiErr = apierror.New(http.StatusBadRequest, apierror.InvalidCommand).With("usage", "/<command> [arguments]")
+	case name == "help":
+		data = commandHelp()
+	default:
+		data, apiErr = c.runRoomCommand(incoming.Room, name, args, rest)
+	}
+
+	result["ok"] = apiErr == nil
+	if apiErr != nil {
+		result["error"] = apiErr
+	} else if data != nil {
+		result["result"] = data
+	}
+	c.hub.Forward(protocol.NewControlMessage(c.username, protocol.EventCommandResult, result))
+}
+
+// runRoomCommand looks up a room command and checks the issuer may run it
+func (c *Client) runRoomCommand(roomID, name string, args []string, rest string) (interface{}, *apierror.Error) {
+	cmd, ok := roomCommands[name]
+	if !ok {
+		return nil, apierror.New(http.StatusNotFound, apierror.UnknownCommand).With("command", name)
+	}
+
+	// like the HTTP API, rooms the issuer isn't in look the same as missing ones
+	snap, err := c.rooms.Snapshot(roomID)
+	if err == rooms.ErrNotFound {
+		return nil, apierror.New(http.StatusNotFound, apierror.RoomNotFound).With("room", roomID)
+	}
+	if err != nil {
+		return nil, commandInternalError(err)
+	}
+	role, ok := snap.Members[c.username]
+	if !ok {
+		return nil, apierror.New(http.StatusNotFound, apierror.RoomNotFound).With("room", roomID)
+	}
+	if !rooms.AtLeast(role, cmd.minRole) {
+		return nil, apierror.New(http.StatusForbidden, apierror.RoomForbidden).With("role", cmd.minRole)
+	}
+
+	return cmd.run(&commandContext{client: c, room: snap, role: role, usage: cmd.usage, args: args, rest: rest})
+}
+
+// commandHelp lists the available commands
+func commandHelp() []map[string]string {
+	names := make([]string, 0, len(roomCommands))
+	for name := range roomCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	help := make([]map[string]string, 0, len(names))
+	for _, name := range names {
+		help = append(help, map[string]string{"command": name, "usage": roomCommands[name].usage, "role": roomCommands[name].minRole})
+	}
+	return help
+}
+
+// commandInternalError logs an unexpected error and hides it from the client
+func commandInternalError(err error) *apierror.Error {
+	log.Printf("Error running command: %v", err)
+	return apierror.New(http.StatusInternalServerError, apierror.InternalError)
+}
+
+// commandRoomError maps room storage errors like the HTTP API does
+func commandRoomError(err error) *apierror.Error {
+	if apiErr := roomError(err); apiErr != nil {
+		return apiErr
+	}
+	return commandInternalError(err)
+}
+
+// usageError reports a command called with the wrong arguments
+func (ctx *commandContext) usageError() *apierror.Error {
+	return apierror.New(http.StatusBadRequest, apierror.InvalidCommand).With("usage", ctx.usage)
+}
+
+// target resolves the member a moderation command acts on and checks the issuer outranks them
+func (ctx *commandContext) target(username string) (string, *apierror.Error) {
+	member, err := ctx.client.users.ResolveUsername(username)
+	if err == auth.ErrUserNotFound {
+		return "", apierror.New(http.StatusNotFound, apierror.NotRoomMember)
+	}
+	if err != nil {
+		return "", commandInternalError(err)
+	}
+	role, ok := ctx.room.Members[member]
+	if !ok {
+		return "", apierror.New(http.StatusNotFound, apierror.NotRoomMember)
+	}
+	if member != ctx.client.username && !canRemoveMember(ctx.role, role) {
+		return "", apierror.New(http.StatusForbidden, apierror.RoomForbidden).With("role", rooms.RoleOwner)
+	}
+	return member, nil
+}
+
+func runTopicCommand(ctx *commandContext) (interface{}, *apierror.Error) {
+	room := ctx.room.Room
+	room.Topic = ctx.rest
+	if err := ctx.client.rooms.Update(&room); err != nil {
+		return nil, commandRoomError(err)
+	}
+	ctx.client.hub.NotifyRoomUpdated(room.ID, ctx.client.username)
+	return map[string]interface{}{"room": room}, nil
+}
+
+func runInviteCommand(ctx *commandContext) (interface{}, *apierror.Error) {
+	if len(ctx.args) != 1 {
+		return nil, ctx.usageError()
+	}
+	member, err := ctx.client.users.ResolveUsername(ctx.args[0])
+	if err == auth.ErrUserNotFound {
+		return nil, apierror.New(http.StatusNotFound, apierror.UserNotFound)
+	}
+	if err != nil {
+		return nil, commandInternalError(err)
+	}
+	if err := ctx.client.rooms.AddMember(ctx.room.Room.ID, member, rooms.RoleMember); err != nil {
+		return nil, commandRoomError(err)
+	}
+	ctx.client.hub.NotifyRoomMember(ctx.room.Room.ID, member, protocol.MemberAdded, ctx.client.username,
+		map[string]interface{}{"role": rooms.RoleMember})
+	return map[string]interface{}{"username": member, "role": rooms.RoleMember}, nil
+}
+
+func runKickCommand(ctx *commandContext) (interface{}, *apierror.Error) {
+	if len(ctx.args) != 1 {
+		return nil, ctx.usageError()
+	}
+	member, apiErr := ctx.target(ctx.args[0])
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	if err := ctx.client.rooms.RemoveMember(ctx.room.Room.ID, member); err != nil {
+		return nil, commandRoomError(err)
+	}
+	ctx.client.hub.NotifyRoomMember(ctx.room.Room.ID, member, protocol.MemberRemoved, ctx.client.username, nil)
+	return map[string]interface{}{"username": member}, nil
+}
+
+func runMuteCommand(ctx *commandContext) (interface{}, *apierror.Error) {
+	if len(ctx.args) < 1 || len(ctx.args) > 2 {
+		return nil, ctx.usageError()
+	}
+	var until time.Time
+	if len(ctx.args) == 2 {
+		d, err := time.ParseDuration(ctx.args[1])
+		if err != nil || d <= 0 {
+			return nil, ctx.usageError()
+		}
+		until = time.Now().Add(d)
+	}
+	member, apiErr := ctx.target(ctx.args[0])
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	if err := ctx.client.rooms.Mute(ctx.room.Room.ID, member, ctx.client.username, until); err != nil {
+		return nil, commandRoomError(err)
+	}
+
+	data := map[string]interface{}{"username": member}
+	if !until.IsZero() {
+		data["until"] = until.Unix()
+	}
+	ctx.client.hub.NotifyRoomMember(ctx.room.Room.ID, member, protocol.MemberMuted, ctx.client.username, data)
+	return data, nil
+}
+
+func runUnmuteCommand(ctx *commandContext) (interface{}, *apierror.Error) {
+	if len(ctx.args) != 1 {
+		return nil, ctx.usageError()
+	}
+	member, apiErr := ctx.target(ctx.args[0])
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	if err := ctx.client.rooms.Unmute(ctx.room.Room.ID, member); err != nil {
+		return nil, commandRoomError(err)
+	}
+	ctx.client.hub.NotifyRoomMember(ctx.room.Room.ID, member, protocol.MemberUnmuted, ctx.client.username, nil)
+	return map[string]interface{}{"username": member}, nil
+}
@@ -0,0 +1,29 @@
+package server
+
+import "github.com/Chase-Garrett/meadowlark/internal/protocol"
+
+// compressionPolicy decides per frame whether permessage-deflate is worth using
+type compressionPolicy struct {
+	enabled bool
+	// frames smaller than this are always sent uncompressed
+	threshold int
+	// frames carrying encrypted content compress poorly, so they need to be at
+	// least this large before compression is attempted
+	encryptedCutoff int
+}
+
+// shouldCompress reports whether a frame of frameSize bytes holding messages should be compressed
+func (p compressionPolicy) shouldCompress(messages []*protocol.Message, frameSize int) bool {
+	if !p.enabled || frameSize < p.threshold {
+		return false
+	}
+	if frameSize >= p.encryptedCutoff {
+		return true
+	}
+	for _, message := range messages {
+		if len(message.Content) > 0 {
+			return false
+		}
+	}
+	return true
+}
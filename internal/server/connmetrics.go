@@ -0,0 +1,333 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const maxConnectionsPage = 500
+
+// connMetrics counts one websocket connection's traffic, updated by its pumps and read by
+// the admin API and the metrics endpoint
+type connMetrics struct {
+	id          int64
+	connectedAt time.Time
+
+	messagesIn   atomic.Int64
+	messagesOut  atomic.Int64
+	framesOut    atomic.Int64 // fewer than messagesOut when messages were batched
+	bytesIn      atomic.Int64
+	bytesOut     atomic.Int64
+	lastActivity atomic.Int64 // unix nanos of the last frame or pong from the client
+	rtt          atomic.Int64 // nanos, from the latest answered ping, 0 before the first
+}
+
+// received records a frame from the client
+func (m *connMetrics) received(n int) {
+	m.messagesIn.Add(1)
+	m.bytesIn.Add(int64(n))
+	m.lastActivity.Store(time.Now().UnixNano())
+}
+
+// sent records a frame of messages to the client
+func (m *connMetrics) sent(messages, n int) {
+	m.messagesOut.Add(int64(messages))
+	m.framesOut.Add(1)
+	m.bytesOut.Add(int64(n))
+}
+
+// pong records the answer to a ping whose payload was its send time
+func (m *connMetrics) pong(payload string) {
+	now := time.Now()
+	m.lastActivity.Store(now.UnixNano())
+	if sentAt, err := strconv.ParseInt(payload, 10, 64); err == nil && sentAt <= now.UnixNano() {
+		m.rtt.Store(now.UnixNano() - sentAt)
+	}
+}
+
+// ConnectionInfo is one open websocket connection as GET /api/admin/connections shows it
+type ConnectionInfo struct {
+	ID           int64     `json:"id"`
+	SessionID    string    `json:"sessionId"`
+	DeviceID     string    `json:"deviceId"`
+	Username     string    `json:"username"`
+	IP           string    `json:"ip"`
+	UserAgent    string    `json:"userAgent"`
+	ConnectedAt  time.Time `json:"connectedAt"`
+	LastActivity time.Time `json:"lastActivity"`
+	MessagesIn   int64     `json:"messagesIn"`
+	MessagesOut  int64     `json:"messagesOut"`
+	BytesIn      int64     `json:"bytesIn"`
+	BytesOut     int64     `json:"bytesOut"`
+	RTTMillis    *float64  `json:"rttMs,omitempty"` // unset until a ping is answered
+}
+
+// connRegistry tracks the metrics of open connections and the totals of closed ones
+type connRegistry struct {
+	mu     sync.Mutex
+	nextID int64
+	open   map[*Client]*connMetrics
+
+	// traffic of connections that have closed, so totals only ever grow
+	closedMessagesIn, closedMessagesOut int64
+	closedFramesOut                     int64
+	closedBytesIn, closedBytesOut       int64
+}
+
+func newConnRegistry() *connRegistry {
+	return &connRegistry{open: make(map[*Client]*connMetrics)}
+}
+
+// add starts tracking client and returns its metrics
+func (r *connRegistry) add(client *Client) *connMetrics {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	m := &connMetrics{id: r.nextID, connectedAt: time.Now()}
+	m.lastActivity.Store(m.connectedAt.UnixNano())
+	r.open[client] = m
+	return m
+}
+
+// remove stops tracking client, folding its traffic into the totals
+func (r *connRegistry) remove(client *Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m, ok := r.open[client]
+	if !ok {
+		return
+	}
+	delete(r.open, client)
+	r.closedMessagesIn += m.messagesIn.Load()
+	r.closedMessagesOut += m.messagesOut.Load()
+	r.closedFramesOut += m.framesOut.Load()
+	r.closedBytesIn += m.bytesIn.Load()
+	r.closedBytesOut += m.bytesOut.Load()
+}
+
+// list returns open connections whose username starts with prefix, ordered by id
+func (r *connRegistry) list(prefix string) []ConnectionInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	conns := []ConnectionInfo{}
+	for client, m := range r.open {
+		if !strings.HasPrefix(client.username, prefix) {
+			continue
+		}
+		info := ConnectionInfo{
+			ID:           m.id,
+			SessionID:    client.sessionID,
+			DeviceID:     client.deviceID,
+			Username:     client.username,
+			IP:           client.ip,
+			UserAgent:    client.userAgent,
+			ConnectedAt:  m.connectedAt,
+			LastActivity: time.Unix(0, m.lastActivity.Load()),
+			MessagesIn:   m.messagesIn.Load(),
+			MessagesOut:  m.messagesOut.Load(),
+			BytesIn:      m.bytesIn.Load(),
+			BytesOut:     m.bytesOut.Load(),
+		}
+		if rtt := m.rtt.Load(); rtt > 0 {
+			ms := float64(rtt) / float64(time.Millisecond)
+			info.RTTMillis = &ms
+		}
+		conns = append(conns, info)
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ID < conns[j].ID })
+	return conns
+}
+
+// ping sends heartbeats carrying their send time until done is closed. Control frames pass
+// through websocket proxies and keep their idle timeouts from closing quiet connections
+func (c *Client) ping(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			payload := []byte(strconv.FormatInt(now.UnixNano(), 10))
+			if err := c.conn.WriteControl(websocket.PingMessage, payload, now.Add(10*time.Second)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// HandleAdminConnections pages through open websocket connections with their traffic,
+// activity and round trip time, optionally only usernames starting with ?q= (admin only)
+func (s *Server) HandleAdminConnections(w http.ResponseWriter, r *http.Request) {
+	p, apiErr := readPage(r, maxConnectionsPage, true)
+	if apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+	var after int64
+	if _, apiErr := p.after(&after); apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+
+	all := s.conns.list(p.Query)
+	if p.Desc {
+		sort.Slice(all, func(i, j int) bool { return all[i].ID > all[j].ID })
+	}
+	conns := []ConnectionInfo{}
+	for _, info := range all {
+		if len(conns) == p.Limit {
+			break
+		}
+		if after == 0 || (!p.Desc && info.ID > after) || (p.Desc && info.ID < after) {
+			conns = append(conns, info)
+		}
+	}
+	p.respond(w, r, map[string]interface{}{"connections": conns}, len(conns), func() interface{} {
+		return conns[len(conns)-1].ID
+	})
+}
+
+// connection buckets for the metrics endpoint, per connection values are never labels
+var (
+	rttBuckets  = []time.Duration{50 * time.Millisecond, 200 * time.Millisecond, time.Second, 5 * time.Second}
+	idleBuckets = []time.Duration{time.Minute, 10 * time.Minute, time.Hour}
+	rateBuckets = []float64{1, 10, 60} // messages from the client per minute
+)
+
+// HandleMetrics writes connection metrics in the Prometheus text format. Open connections
+// are counted per bucket of round trip time, idle time and message rate, so the number of
+// series doesn't grow with the number of users
+func (s *Server) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	s.conns.mu.Lock()
+	messagesIn, messagesOut := s.conns.closedMessagesIn, s.conns.closedMessagesOut
+	framesOut := s.conns.closedFramesOut
+	bytesIn, bytesOut := s.conns.closedBytesIn, s.conns.closedBytesOut
+	open := make([]*connMetrics, 0, len(s.conns.open))
+	for _, m := range s.conns.open {
+		open = append(open, m)
+	}
+	s.conns.mu.Unlock()
+
+	now := time.Now()
+	rtt := make([]int, len(rttBuckets)+2) // the last two count slower and unmeasured connections
+	idle := make([]int, len(idleBuckets)+1)
+	rate := make([]int, len(rateBuckets)+1)
+	for _, m := range open {
+		in := m.messagesIn.Load()
+		messagesIn += in
+		messagesOut += m.messagesOut.Load()
+		framesOut += m.framesOut.Load()
+		bytesIn += m.bytesIn.Load()
+		bytesOut += m.bytesOut.Load()
+
+		if d := time.Duration(m.rtt.Load()); d == 0 {
+			rtt[len(rtt)-1]++
+		} else {
+			rtt[durationBucket(d, rttBuckets)]++
+		}
+		idle[durationBucket(now.Sub(time.Unix(0, m.lastActivity.Load())), idleBuckets)]++
+		minutes := now.Sub(m.connectedAt).Minutes()
+		if minutes < 1 {
+			minutes = 1
+		}
+		rate[floatBucket(float64(in)/minutes, rateBuckets)]++
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetric(w, "meadowlark_ws_connections", "gauge", "Open websocket connections.")
+	fmt.Fprintf(w, "meadowlark_ws_connections %d\n", len(open))
+	writeMetric(w, "meadowlark_ws_messages_total", "counter", "Websocket messages since startup, by direction.")
+	fmt.Fprintf(w, "meadowlark_ws_messages_total{direction=\"in\"} %d\n", messagesIn)
+	fmt.Fprintf(w, "meadowlark_ws_messages_total{direction=\"out\"} %d\n", messagesOut)
+	writeMetric(w, "meadowlark_ws_frames_out_total", "counter", "Websocket frames written since startup, a batch of messages counts once.")
+	fmt.Fprintf(w, "meadowlark_ws_frames_out_total %d\n", framesOut)
+	writeMetric(w, "meadowlark_ws_bytes_total", "counter", "Websocket payload bytes since startup, before compression, by direction.")
+	fmt.Fprintf(w, "meadowlark_ws_bytes_total{direction=\"in\"} %d\n", bytesIn)
+	fmt.Fprintf(w, "meadowlark_ws_bytes_total{direction=\"out\"} %d\n", bytesOut)
+
+	writeMetric(w, "meadowlark_ws_connections_by_rtt", "gauge", "Open websocket connections by round trip time of their latest ping.")
+	for i, label := range durationLabels(rttBuckets) {
+		fmt.Fprintf(w, "meadowlark_ws_connections_by_rtt{rtt=%q} %d\n", label, rtt[i])
+	}
+	fmt.Fprintf(w, "meadowlark_ws_connections_by_rtt{rtt=\"unknown\"} %d\n", rtt[len(rtt)-1])
+	writeMetric(w, "meadowlark_ws_connections_by_idle", "gauge", "Open websocket connections by time since the client last sent anything.")
+	for i, label := range durationLabels(idleBuckets) {
+		fmt.Fprintf(w, "meadowlark_ws_connections_by_idle{idle=%q} %d\n", label, idle[i])
+	}
+	writeMetric(w, "meadowlark_ws_connections_by_rate", "gauge", "Open websocket connections by messages received per minute since connecting.")
+	for i, label := range rateLabels(rateBuckets) {
+		fmt.Fprintf(w, "meadowlark_ws_connections_by_rate{rate=%q} %d\n", label, rate[i])
+	}
+	s.writeHubMetrics(w, r)
+	s.writeJobMetrics(w)
+}
+
+func writeMetric(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// durationBucket is the index of the first bound d is below, len(bounds) when above them all
+func durationBucket(d time.Duration, bounds []time.Duration) int {
+	for i, bound := range bounds {
+		if d < bound {
+			return i
+		}
+	}
+	return len(bounds)
+}
+
+func floatBucket(v float64, bounds []float64) int {
+	for i, bound := range bounds {
+		if v < bound {
+			return i
+		}
+	}
+	return len(bounds)
+}
+
+// durationLabels names the ranges between bounds, e.g. "<1m", "1m-10m" and ">=1h"
+func durationLabels(bounds []time.Duration) []string {
+	labels := make([]string, 0, len(bounds)+1)
+	for i, bound := range bounds {
+		if i == 0 {
+			labels = append(labels, "<"+shortDuration(bound))
+		} else {
+			labels = append(labels, shortDuration(bounds[i-1])+"-"+shortDuration(bound))
+		}
+	}
+	return append(labels, ">="+shortDuration(bounds[len(bounds)-1]))
+}
+
+func rateLabels(bounds []float64) []string {
+	labels := make([]string, 0, len(bounds)+1)
+	for i, bound := range bounds {
+		if i == 0 {
+			labels = append(labels, fmt.Sprintf("<%g", bound))
+		} else {
+			labels = append(labels, fmt.Sprintf("%g-%g", bounds[i-1], bound))
+		}
+	}
+	return append(labels, fmt.Sprintf(">=%g", bounds[len(bounds)-1]))
+}
+
+// shortDuration formats d without zero units, "1m" rather than "1m0s"
+func shortDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/auth"
+	"github.com/Chase-Garrett/meadowlark/internal/history"
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+	"github.com/Chase-Garrett/meadowlark/internal/rooms"
+)
+
+// ConversationSettingsRequest defines JSON for PATCH /api/conversations/{id}/settings
+type ConversationSettingsRequest struct {
+	Settings map[string]json.RawMessage `json:"settings"` // null removes a key
+}
+
+// resolveConversation reads a "user:{username}" or "room:{id}" conversation id the caller
+// takes part in, returning its scope and subject. ok is false when there is no such conversation
+func (s *Server) resolveConversation(id, username string) (scope, subject string, ok bool, err error) {
+	scope, subject, _ = strings.Cut(id, ":")
+	switch scope {
+	case history.ConversationUser:
+		resolved, err := s.userStorage.ResolveUsername(subject)
+		if err == auth.ErrUserNotFound {
+			return "", "", false, nil
+		}
+		return scope, resolved, err == nil, err
+	case history.ConversationRoom:
+		// rooms the caller doesn't belong to are reported as missing, like elsewhere
+		_, err := s.rooms.Role(subject, username)
+		if err == rooms.ErrNotFound || err == rooms.ErrNotMember {
+			return "", "", false, nil
+		}
+		return scope, subject, err == nil, err
+	}
+	return "", "", false, nil
+}
+
+// HandleConversationSettings serves the caller's per-conversation settings: all of them at
+// /api/conversations/settings, and one conversation's at /api/conversations/{id}/settings,
+// where PATCH merges changes and DELETE clears them. Changes are sent to the caller's
+// connections so their other devices follow
+func (s *Server) HandleConversationSettings(w http.ResponseWriter, r *http.Request, username string) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/conversations/")
+	if rest == "settings" {
+		if r.Method != http.MethodGet {
+			respondMethodNotAllowed(w)
+			return
+		}
+		all, err := s.messages.AllConversationSettings(username)
+		if err != nil {
+			respondInternalError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"conversations": all})
+		return
+	}
+
+	id, ok := strings.CutSuffix(rest, "/settings")
+	if !ok || id == "" {
+		respondError(w, apierror.New(http.StatusNotFound, apierror.NotFound))
+		return
+	}
+	scope, subject, ok, err := s.resolveConversation(id, username)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	if !ok {
+		respondError(w, apierror.New(http.StatusNotFound, apierror.ConversationNotFound))
+		return
+	}
+
+	var settings *history.ConversationSettings
+	switch r.Method {
+	case http.MethodGet:
+		if settings, err = s.messages.ConversationSettings(username, scope, subject); err != nil {
+			respondInternalError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(settings)
+		return
+	case http.MethodPatch:
+		var req ConversationSettingsRequest
+		if err := s.readJSON(w, r, &req); err != nil {
+			respondError(w, err)
+			return
+		}
+		settings, err = s.messages.UpdateConversationSettings(username, scope, subject, req.Settings)
+		if err == history.ErrInvalidSettings {
+			respondError(w, apierror.New(http.StatusBadRequest, apierror.InvalidConversationSettings).
+				With("max", history.MaxConversationSettings).
+				With("keyLength", history.MaxSettingKeyLength).
+				With("valueSize", history.MaxSettingValueSize))
+			return
+		}
+	case http.MethodDelete:
+		if err = s.messages.ClearConversationSettings(username, scope, subject); err == nil {
+			settings, err = s.messages.ConversationSettings(username, scope, subject)
+		}
+	default:
+		respondMethodNotAllowed(w)
+		return
+	}
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+
+	s.hub.Forward(protocol.NewControlMessage(username, protocol.EventConversationSettings, settings))
+	if r.Method == http.MethodDelete {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/telemetry"
+)
+
+// limits of the CPU profile and execution trace durations, in seconds
+const (
+	defaultProfileSeconds = 30
+	defaultTraceSeconds   = 5
+	maxProfileSeconds     = 300
+)
+
+// RuntimeStats is the process as the Go runtime sees it, for GET /debug/runtime
+type RuntimeStats struct {
+	Version       string     `json:"version"`
+	GoVersion     string     `json:"goVersion"`
+	StartedAt     time.Time  `json:"startedAt"`
+	Goroutines    int        `json:"goroutines"`
+	GOMAXPROCS    int        `json:"gomaxprocs"`
+	CPUs          int        `json:"cpus"`
+	HeapAlloc     uint64     `json:"heapAlloc"` // bytes of live and not yet collected objects
+	HeapInuse     uint64     `json:"heapInuse"`
+	HeapObjects   uint64     `json:"heapObjects"`
+	Sys           uint64     `json:"sys"` // bytes obtained from the OS
+	TotalAlloc    uint64     `json:"totalAlloc"`
+	Mallocs       uint64     `json:"mallocs"`
+	NumGC         uint32     `json:"numGC"`
+	LastGC        *time.Time `json:"lastGC,omitempty"`
+	GCPauseTotal  int64      `json:"gcPauseTotalNs"`
+	GCCPUFraction float64    `json:"gcCPUFraction"`
+}
+
+// processStart is reported as RuntimeStats.StartedAt
+var processStart = time.Now()
+
+// serveDebug starts the diagnostics listener on addr: profiles, goroutine dumps and runtime and
+// hub stats, for admins only. It has a mux of its own, so none of it is reachable through the
+// main listener, and net/http/pprof isn't imported because it registers on the default mux
+func (s *Server) serveDebug(addr string) {
+	var listener net.Listener
+	var err error
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		listener, err = listenUnix(path, s.config.SocketMode)
+	} else {
+		listener, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		log.Fatalf("Debug listener: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	s.registerDebugRoutes(mux)
+	srv := newHTTPServer(s.config, mux)
+	srv.ConnContext = tagLocalSocket
+	go func() {
+		if err := srv.Serve(listener); err != http.ErrServerClosed {
+			log.Fatal("Debug listener: ", err)
+		}
+	}()
+	log.Printf("Serving diagnostics for admins on %s", listener.Addr())
+}
+
+// registerDebugRoutes serves the diagnostics on mux, listed in routeScopes like the API
+func (s *Server) registerDebugRoutes(mux routeMux) {
+	mux.HandleFunc("/debug/pprof/", s.adminOnly(s.HandleDebugProfile))
+	mux.HandleFunc("/debug/runtime", s.adminOnly(s.HandleDebugRuntime))
+	mux.HandleFunc("/debug/hub", s.adminOnly(s.HandleAdminHub))
+}
+
+// adminOnly wraps a GET handler of the debug listener, which takes the same admin tokens as
+// /api/admin
+func (s *Server) adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondMethodNotAllowed(w)
+			return
+		}
+		admin, ok := s.requireAdmin(w, r)
+		if !ok {
+			return
+		}
+		log.Printf("%s requested %s from the debug listener", admin, r.URL.Path)
+		next(w, r)
+	}
+}
+
+// HandleDebugProfile serves /debug/pprof/: the list of profiles, a CPU profile or execution
+// trace over ?seconds=, or a runtime profile such as heap or goroutine, in the formats
+// go tool pprof and go tool trace read
+func (s *Server) HandleDebugProfile(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/debug/pprof/")
+	switch name {
+	case "":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		profiles := pprof.Profiles()
+		sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name() < profiles[j].Name() })
+		for _, p := range profiles {
+			fmt.Fprintf(w, "%s %d\n", p.Name(), p.Count())
+		}
+		fmt.Fprintln(w, "profile")
+		fmt.Fprintln(w, "trace")
+	case "profile":
+		s.recordProfile(w, r, name, defaultProfileSeconds, pprof.StartCPUProfile, pprof.StopCPUProfile)
+	case "trace":
+		s.recordProfile(w, r, name, defaultTraceSeconds, trace.Start, trace.Stop)
+	default:
+		profile := pprof.Lookup(name)
+		if profile == nil {
+			respondError(w, apierror.New(http.StatusNotFound, apierror.UnknownProfile).With("name", name))
+			return
+		}
+		debug, _ := strconv.Atoi(r.URL.Query().Get("debug"))
+		if name == "heap" && r.URL.Query().Get("gc") != "" {
+			runtime.GC()
+		}
+		if debug > 0 {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		}
+		profile.WriteTo(w, debug)
+	}
+}
+
+// recordProfile runs a CPU profile or trace for ?seconds= and writes it. The runtime only
+// records one of each at a time, a second request answers 409 profile_in_progress
+func (s *Server) recordProfile(w http.ResponseWriter, r *http.Request, name string, defaultSeconds int, start func(w io.Writer) error, stop func()) {
+	seconds := defaultSeconds
+	if v := r.URL.Query().Get("seconds"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxProfileSeconds {
+			respondError(w, apierror.New(http.StatusBadRequest, apierror.InvalidRequest).With("detail", fmt.Sprintf("seconds must be 1 to %d", maxProfileSeconds)))
+			return
+		}
+		seconds = n
+	}
+	// a profile takes longer than the server's write timeout allows
+	liftDeadlines(w)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	if err := start(w); err != nil {
+		w.Header().Del("Content-Disposition")
+		respondError(w, apierror.New(http.StatusConflict, apierror.ProfileInProgress))
+		return
+	}
+	select {
+	case <-time.After(time.Duration(seconds) * time.Second):
+	case <-r.Context().Done():
+	}
+	stop()
+}
+
+// HandleDebugRuntime reports goroutine and memory figures without the pause of a profile
+func (s *Server) HandleDebugRuntime(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats := RuntimeStats{
+		Version:       telemetry.Version(),
+		GoVersion:     runtime.Version(),
+		StartedAt:     processStart,
+		Goroutines:    runtime.NumGoroutine(),
+		GOMAXPROCS:    runtime.GOMAXPROCS(0),
+		CPUs:          runtime.NumCPU(),
+		HeapAlloc:     mem.HeapAlloc,
+		HeapInuse:     mem.HeapInuse,
+		HeapObjects:   mem.HeapObjects,
+		Sys:           mem.Sys,
+		TotalAlloc:    mem.TotalAlloc,
+		Mallocs:       mem.Mallocs,
+		NumGC:         mem.NumGC,
+		GCPauseTotal:  int64(mem.PauseTotalNs),
+		GCCPUFraction: mem.GCCPUFraction,
+	}
+	if mem.LastGC > 0 {
+		lastGC := time.Unix(0, int64(mem.LastGC))
+		stats.LastGC = &lastGC
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
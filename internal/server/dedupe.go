@@ -0,0 +1,64 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// submission is what a client is told when it resubmits a message
+type submission struct {
+	id        int64 // 0 when the message was held instead of stored
+	seq       int64
+	timestamp int64
+	expires   time.Time
+}
+
+// dedupeCache remembers recently accepted client message ids so retries after a reconnect
+// are answered without touching the database. The unique index on messages catches
+// anything that has already expired from here
+type dedupeCache struct {
+	mu        sync.Mutex
+	ttl       time.Duration // 0 disables the cache
+	entries   map[string]submission
+	lastSweep time.Time
+}
+
+func newDedupeCache(ttl time.Duration) *dedupeCache {
+	return &dedupeCache{ttl: ttl, entries: make(map[string]submission)}
+}
+
+func dedupeKey(sender, clientID string) string {
+	return sender + "\x00" + clientID
+}
+
+// lookup returns the earlier submission of clientID by sender, if it is still remembered
+func (d *dedupeCache) lookup(sender, clientID string) (submission, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	sub, ok := d.entries[dedupeKey(sender, clientID)]
+	if !ok || time.Now().After(sub.expires) {
+		return submission{}, false
+	}
+	return sub, true
+}
+
+// remember records an accepted submission
+func (d *dedupeCache) remember(sender, clientID string, sub submission) {
+	if d.ttl <= 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(d.lastSweep) > d.ttl {
+		for key, entry := range d.entries {
+			if now.After(entry.expires) {
+				delete(d.entries, key)
+			}
+		}
+		d.lastSweep = now
+	}
+	sub.expires = now.Add(d.ttl)
+	d.entries[dedupeKey(sender, clientID)] = sub
+}
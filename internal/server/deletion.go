@@ -0,0 +1,143 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/auth"
+	"github.com/Chase-Garrett/meadowlark/internal/billing"
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+)
+
+// purgeTimeout bounds removing one tombstone's attachments from storage
+const purgeTimeout = 5 * time.Minute
+
+// AccountDeletionRequest defines JSON for DELETE /api/account
+type AccountDeletionRequest struct {
+	Password string `json:"password"` // asked again so a stolen token can't delete the account
+}
+
+// HandleDeleteAccount deletes the caller's account
+func (s *Server) HandleDeleteAccount(w http.ResponseWriter, r *http.Request, username string) {
+	var req AccountDeletionRequest
+	if err := s.readJSON(w, r, &req); err != nil {
+		respondError(w, err)
+		return
+	}
+	err := s.userStorage.VerifyUser(username, req.Password)
+	if err == auth.ErrInvalidCredentials {
+		respondError(w, apierror.New(http.StatusUnauthorized, apierror.InvalidCredentials))
+		return
+	}
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	s.respondDeleted(w, username, username)
+}
+
+// HandleAdminDeleteUser serves DELETE /api/admin/users/{username} (admin only)
+func (s *Server) HandleAdminDeleteUser(w http.ResponseWriter, r *http.Request, admin string) {
+	username := strings.TrimPrefix(r.URL.Path, "/api/admin/users/")
+	if username == "" || strings.Contains(username, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		respondMethodNotAllowed(w)
+		return
+	}
+	s.respondDeleted(w, username, admin)
+}
+
+// respondDeleted deletes username's account on behalf of by and returns its tombstone
+func (s *Server) respondDeleted(w http.ResponseWriter, username, by string) {
+	// admins are configured by name, a new account under it would inherit their privileges
+	if s.config.IsAdmin(username) {
+		respondError(w, apierror.New(http.StatusForbidden, apierror.AdminDeletion))
+		return
+	}
+	tomb, err := s.deleteAccount(username)
+	if err == auth.ErrUserNotFound {
+		respondError(w, apierror.New(http.StatusNotFound, apierror.UserNotFound))
+		return
+	}
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	log.Printf("Account %s deleted by %s as %s, purging after %s", username, by, tomb.ID, tomb.PurgeAt.Format(time.RFC3339))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tomb)
+}
+
+// deleteAccount takes username out of its rooms, replaces it with a tombstone everywhere
+// else and tells the people who knew the account
+func (s *Server) deleteAccount(username string) (*auth.Tombstone, error) {
+	contacts, err := s.messages.Correspondents(username)
+	if err != nil {
+		return nil, err
+	}
+	if exists, err := s.userStorage.UserExists(username); err != nil || !exists {
+		if err == nil {
+			err = auth.ErrUserNotFound
+		}
+		return nil, err
+	}
+	joined, err := s.rooms.RemoveUser(username)
+	if err != nil {
+		return nil, err
+	}
+	tomb, err := s.userStorage.DeleteAccount(username, s.config.AccountPurgeGrace)
+	if err != nil {
+		return nil, err
+	}
+	// cached room memberships and history still list the old name
+	s.rooms.Reset()
+	if err := s.flags.ForgetUser(username); err != nil {
+		log.Printf("Error removing feature flag settings of %s: %v", username, err)
+	}
+	s.billing.Record(billing.Event{Type: billing.EventUserDeleted, Username: username})
+
+	s.hub.Disconnect(username, protocol.CloseAuthExpired, protocol.CloseReason{Code: apierror.AccountDeleted})
+	deleted := map[string]interface{}{"username": username, "tombstone": tomb.ID}
+	for _, contact := range contacts {
+		s.hub.Forward(protocol.NewControlMessage(contact, protocol.EventUserDeleted, deleted))
+	}
+	for _, roomID := range joined {
+		s.hub.NotifyRoomMember(roomID, username, protocol.MemberDeleted, username, map[string]interface{}{"tombstone": tomb.ID})
+	}
+	return tomb, nil
+}
+
+// purgeTombstones fully removes deleted accounts' data once their grace period ends: the
+// attachments, messages and other records left under each due tombstone. A failure leaves the
+// tombstone in place to be retried on the next run
+func (s *Server) purgeTombstones(now time.Time) error {
+	due, err := s.userStorage.DueTombstones(now)
+	if err != nil {
+		return fmt.Errorf("finding tombstones to purge: %w", err)
+	}
+	for _, tomb := range due {
+		ctx, cancel := context.WithTimeout(context.Background(), purgeTimeout)
+		removed, err := s.attachments.DeleteOwner(ctx, tomb.ID)
+		cancel()
+		if err != nil {
+			log.Printf("Error purging attachments of %s: %v", tomb.ID, err)
+			continue
+		}
+		if err := s.userStorage.PurgeTombstone(tomb.ID); err != nil {
+			log.Printf("Error purging %s: %v", tomb.ID, err)
+			continue
+		}
+		log.Printf("Purged %s, deleted %s, with %d attachments", tomb.ID, tomb.DeletedAt.Format(time.RFC3339), removed)
+	}
+	return nil
+}
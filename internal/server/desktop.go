@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/config"
+)
+
+// prepareDesktop checks desktop mode stays on the loopback interface and creates its data directory
+func prepareDesktop(cfg *config.Config) {
+	host, _, err := net.SplitHostPort(cfg.Addr)
+	if err != nil {
+		log.Fatalf("Invalid address %q: %v", cfg.Addr, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		log.Fatalf("Desktop mode only listens on loopback addresses, got %q", cfg.Addr)
+	}
+	if err := os.MkdirAll(filepath.Dir(cfg.DBPath), 0700); err != nil {
+		log.Fatalf("Failed to create data directory: %v", err)
+	}
+}
+
+// runDesktop serves on a loopback port, opens the web interface in the default browser
+// and shuts down once the last client has been gone for the idle timeout
+func (s *Server) runDesktop() {
+	listener, err := net.Listen("tcp", s.config.Addr)
+	if err != nil {
+		log.Fatal("Listen: ", err)
+	}
+	url := "http://" + listener.Addr().String() + s.config.BasePath + "/"
+
+	srv := newHTTPServer(s.config, withBasePath(s.config.BasePath, http.DefaultServeMux))
+	go func() {
+		if err := srv.Serve(listener); err != http.ErrServerClosed {
+			log.Fatal("Serve: ", err)
+		}
+	}()
+
+	log.Printf("Desktop mode: meadowlark is running at %s, data is kept in %s", url, filepath.Dir(s.config.DBPath))
+	if s.config.DesktopOpenBrowser {
+		if err := openBrowser(url); err != nil {
+			log.Printf("Could not open a browser (%v), open %s yourself", err, url)
+		}
+	}
+
+	s.waitForLastClient()
+	log.Println("Last client disconnected, shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down HTTP server: %v", err)
+	}
+	s.close()
+}
+
+// waitForLastClient returns once clients have connected and then all been gone for the idle timeout,
+// which is long enough for a page reload to reconnect. Before the first connection it waits indefinitely
+// so there is time to register or log in
+func (s *Server) waitForLastClient() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var seen bool
+	var idleSince time.Time
+	for now := range ticker.C {
+		if connections, _, _ := s.connLimits.counts(); connections > 0 {
+			seen, idleSince = true, time.Time{}
+			continue
+		}
+		if !seen {
+			continue
+		}
+		if idleSince.IsZero() {
+			idleSince = now
+		}
+		if now.Sub(idleSince) >= s.config.DesktopIdleTimeout {
+			return
+		}
+	}
+}
+
+// openBrowser opens url with the desktop's default browser
+func openBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	case "darwin":
+		cmd = exec.Command("open", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go cmd.Wait()
+	return nil
+}
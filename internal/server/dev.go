@@ -0,0 +1,144 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/config"
+	"github.com/Chase-Garrett/meadowlark/internal/rooms"
+)
+
+// devPassword is the password of every seeded account
+const devPassword = "password"
+
+// devUsers are registered on every developer mode start, the first one is the default admin
+var devUsers = []string{"alice", "bob", "carol", "dave"}
+
+// devRooms are created by their owner, with members given as username and role
+var devRooms = []struct {
+	owner   string
+	room    rooms.Room
+	members map[string]string
+}{
+	{
+		owner:   "alice",
+		room:    rooms.Room{Name: "General", Topic: "Anything goes", Public: true},
+		members: map[string]string{"bob": rooms.RoleModerator, "carol": rooms.RoleMember, "dave": rooms.RoleMember},
+	},
+	{
+		owner:   "bob",
+		room:    rooms.Room{Name: "Random", Topic: "Off topic"},
+		members: map[string]string{"alice": rooms.RoleMember, "carol": rooms.RoleMember},
+	},
+	{
+		owner:   "alice",
+		room:    rooms.Room{Name: "Announcements", Announcement: true, Public: true},
+		members: map[string]string{"bob": rooms.RoleMember, "carol": rooms.RoleMember, "dave": rooms.RoleMember},
+	},
+}
+
+// prepareDev turns on detailed log lines, warns when developer mode is reachable from other
+// machines and creates the directory for the identity key and attachments
+func prepareDev(cfg *config.Config) {
+	log.SetFlags(log.LstdFlags | log.Lmicroseconds | log.Lshortfile)
+	if host, _, err := net.SplitHostPort(cfg.Addr); err == nil {
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			log.Printf("Warning: developer mode is listening on %q, the seeded accounts have known passwords", cfg.Addr)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(cfg.IdentityKeyFile), 0700); err != nil {
+		log.Fatalf("Failed to create developer data directory: %v", err)
+	}
+}
+
+// seedDevFixtures registers the developer mode accounts and rooms, unless a database kept
+// between runs has them already. The in-memory database lives as long as one of its
+// connections, so one is held open until the process exits
+func (s *Server) seedDevFixtures() {
+	if _, err := s.userStorage.DB().Conn(context.Background()); err != nil {
+		log.Fatalf("Failed to hold the developer database open: %v", err)
+	}
+	if seeded, err := s.userStorage.UserExists(devUsers[0]); err != nil || seeded {
+		if err != nil {
+			log.Fatalf("Failed to check for developer fixtures: %v", err)
+		}
+		log.Printf("Developer mode: fixtures already present in %s", s.config.DBPath)
+		return
+	}
+	for _, username := range devUsers {
+		if err := s.userStorage.RegisterNewUser(username, devPassword, "", ""); err != nil {
+			log.Fatalf("Failed to seed user %s: %v", username, err)
+		}
+	}
+	for _, seed := range devRooms {
+		room, err := s.rooms.Create(seed.owner, seed.room)
+		if err != nil {
+			log.Fatalf("Failed to seed room %s: %v", seed.room.Name, err)
+		}
+		for username, role := range seed.members {
+			if err := s.rooms.AddMember(room.ID, username, role); err != nil {
+				log.Fatalf("Failed to seed room %s: %v", seed.room.Name, err)
+			}
+		}
+	}
+	log.Printf("Developer mode: seeded users %v (password %q) and %d rooms, admins %v",
+		devUsers, devPassword, len(devRooms), s.config.Admins)
+}
+
+// loggedResponse records the status a handler sent
+type loggedResponse struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (l *loggedResponse) WriteHeader(status int) {
+	if l.status == 0 {
+		l.status = status
+	}
+	l.ResponseWriter.WriteHeader(status)
+}
+
+func (l *loggedResponse) Write(p []byte) (int, error) {
+	if l.status == 0 {
+		l.status = http.StatusOK
+	}
+	n, err := l.ResponseWriter.Write(p)
+	l.size += n
+	return n, err
+}
+
+// Hijack lets websocket upgrades through, the request is logged as 101
+func (l *loggedResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	l.status = http.StatusSwitchingProtocols
+	return http.NewResponseController(l.ResponseWriter).Hijack()
+}
+
+func (l *loggedResponse) Flush() {
+	http.NewResponseController(l.ResponseWriter).Flush()
+}
+
+// Unwrap gives http.ResponseController access to the connection deadlines
+func (l *loggedResponse) Unwrap() http.ResponseWriter {
+	return l.ResponseWriter
+}
+
+// logRequests logs the method, path, status, size and duration of every request. The query
+// is left out since websocket connections carry their token in it
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		lw := &loggedResponse{ResponseWriter: w}
+		next.ServeHTTP(lw, r)
+		if lw.status == 0 {
+			lw.status = http.StatusOK
+		}
+		log.Printf("%s %s %d %dB %s", r.Method, r.URL.Path, lw.status, lw.size, time.Since(start).Round(time.Microsecond))
+	})
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Chase-Garrett/meadowlark/internal/config"
+	"github.com/Chase-Garrett/meadowlark/internal/mdns"
+)
+
+// advertise announces the server on the LAN with mDNS, returning nil when it can't
+func advertise(cfg *config.Config) *mdns.Responder {
+	service, err := mdnsService(cfg)
+	if err != nil {
+		log.Printf("mDNS advertisement disabled: %v", err)
+		return nil
+	}
+	responder, err := mdns.Advertise(service)
+	if err != nil {
+		log.Printf("mDNS advertisement disabled: %v", err)
+		return nil
+	}
+	log.Printf("Advertising %q as %s on %v port %d", service.Instance, mdns.ServiceType, service.Addrs, service.Port)
+	return responder
+}
+
+// mdnsService describes this server for mDNS from the listen address and host name
+func mdnsService(cfg *config.Config) (mdns.Service, error) {
+	host, portText, err := net.SplitHostPort(cfg.Addr)
+	if err != nil {
+		return mdns.Service{}, err
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil || port == 0 {
+		return mdns.Service{}, fmt.Errorf("no fixed port in %q", cfg.Addr)
+	}
+
+	var addrs []net.IP
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+		if ip.IsLoopback() || ip.To4() == nil {
+			return mdns.Service{}, fmt.Errorf("%s is not reachable over IPv4 from the LAN", host)
+		}
+		addrs = []net.IP{ip.To4()}
+	} else if addrs, err = mdns.LocalAddrs(); err != nil {
+		return mdns.Service{}, err
+	}
+	if len(addrs) == 0 {
+		return mdns.Service{}, fmt.Errorf("no LAN addresses found")
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return mdns.Service{}, err
+	}
+	// the first label, "laptop.example.com" becomes "laptop.local"
+	hostname, _, _ = strings.Cut(hostname, ".")
+	name := cfg.MDNSName
+	if name == "" {
+		name = "Meadowlark on " + hostname
+	}
+
+	return mdns.Service{
+		Instance: name,
+		Host:     hostname,
+		Port:     port,
+		Addrs:    addrs,
+		Text:     map[string]string{"path": cfg.BasePath + "/", "ws": cfg.BasePath + "/ws"},
+	}, nil
+}
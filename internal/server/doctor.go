@@ -0,0 +1,377 @@
+package server
+
+import (
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/auth"
+	"github.com/Chase-Garrett/meadowlark/internal/config"
+	"github.com/Chase-Garrett/meadowlark/internal/inbound"
+	"github.com/Chase-Garrett/meadowlark/internal/keyring"
+	"github.com/Chase-Garrett/meadowlark/internal/secrets"
+)
+
+// schemaVersion is recorded in the database's user_version once every table is migrated.
+// Bump it whenever a migration is added, so older builds refuse a database they can't read
+const schemaVersion = 1
+
+// check outcomes
+const (
+	checkOK   = "ok"
+	checkWarn = "warn"
+	checkFail = "fail"
+	checkSkip = "skip"
+)
+
+// certExpiryWarning is how close to expiry a TLS certificate starts being reported
+const certExpiryWarning = 14 * 24 * time.Hour
+
+// checkResult is the outcome of one diagnostic, with what to do about it when it isn't ok
+type checkResult struct {
+	Name   string
+	Status string
+	Detail string
+	Fix    string
+}
+
+// diagnostic is one self-check, online ones contact other hosts and only run under doctor
+type diagnostic struct {
+	name   string
+	online bool
+	run    func(cfg *config.Config) checkResult
+}
+
+var diagnostics = []diagnostic{
+	{"config", false, checkConfig},
+	{"database", false, checkDatabase},
+	{"permissions", false, checkPermissions},
+	{"static files", false, checkStaticFiles},
+	{"tls certificate", false, checkTLSCertificate},
+	{"secrets", true, checkSecrets},
+	{"clock", true, checkClock},
+}
+
+// runDiagnostics runs the offline checks, and the online ones too when online is set
+func runDiagnostics(cfg *config.Config, online bool) []checkResult {
+	var results []checkResult
+	for _, d := range diagnostics {
+		if d.online && !online {
+			continue
+		}
+		result := d.run(cfg)
+		result.Name = d.name
+		results = append(results, result)
+	}
+	return results
+}
+
+// Doctor runs every check against the configuration in the environment and prints the
+// results to w, returning the process exit status: 1 when any check failed
+func Doctor(w io.Writer) int {
+	cfg := config.Load()
+	status := 0
+	for _, result := range runDiagnostics(cfg, true) {
+		fmt.Fprintf(w, "%-4s  %-16s %s\n", result.Status, result.Name, result.Detail)
+		if result.Fix != "" {
+			fmt.Fprintf(w, "      %-16s fix: %s\n", "", result.Fix)
+		}
+		if result.Status == checkFail {
+			status = 1
+		}
+	}
+	return status
+}
+
+// selfCheck runs the offline checks before the server starts, logging warnings and
+// exiting on failures so a broken setup is reported before the first request hits it
+func selfCheck(cfg *config.Config) {
+	var failed []string
+	for _, result := range runDiagnostics(cfg, false) {
+		switch result.Status {
+		case checkWarn:
+			log.Printf("Warning: self-check %s: %s (%s)", result.Name, result.Detail, result.Fix)
+		case checkFail:
+			log.Printf("Self-check %s failed: %s (%s)", result.Name, result.Detail, result.Fix)
+			failed = append(failed, result.Name)
+		}
+	}
+	if len(failed) > 0 {
+		log.Fatalf("Self-check failed for %s, run the server with the doctor argument for the full report", strings.Join(failed, ", "))
+	}
+}
+
+// stampSchemaVersion records that the database holds every table and column of this build
+func stampSchemaVersion(db *sql.DB) error {
+	_, err := db.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, schemaVersion))
+	return err
+}
+
+// checkConfig looks for settings the server would reject, or accept and regret
+func checkConfig(cfg *config.Config) checkResult {
+	var problems []string
+	if cfg.SessionPolicy != SessionPolicyTakeover && cfg.SessionPolicy != SessionPolicyReject {
+		problems = append(problems, fmt.Sprintf("MEADOWLARK_SESSION_POLICY %q is not takeover or reject", cfg.SessionPolicy))
+	}
+	if !auth.ValidRecyclingPolicy(cfg.UsernameRecycling) {
+		problems = append(problems, fmt.Sprintf("MEADOWLARK_USERNAME_RECYCLING %q is not permanent, cooldown or immediate", cfg.UsernameRecycling))
+	}
+	if path, ok := strings.CutPrefix(cfg.Addr, "unix:"); ok {
+		if path == "" {
+			problems = append(problems, "MEADOWLARK_ADDR has no unix socket path")
+		}
+	} else if _, _, err := net.SplitHostPort(cfg.Addr); err != nil {
+		problems = append(problems, fmt.Sprintf("MEADOWLARK_ADDR: %v", err))
+	}
+	if _, err := auth.NewPasswordHasher(auth.HashingConfig{
+		Algorithm:     cfg.PasswordHash,
+		BcryptCost:    cfg.BcryptCost,
+		Argon2Memory:  uint32(cfg.Argon2Memory),
+		Argon2Time:    uint32(cfg.Argon2Time),
+		Argon2Threads: uint8(cfg.Argon2Threads),
+	}); err != nil {
+		problems = append(problems, fmt.Sprintf("password hashing: %v", err))
+	}
+	if _, err := keyring.Parse(cfg.PepperID, cfg.Peppers); err != nil {
+		problems = append(problems, fmt.Sprintf("MEADOWLARK_PEPPERS: %v", err))
+	}
+	if _, err := newOriginPolicy(cfg.AllowedOrigins, cfg.DevMode); err != nil {
+		problems = append(problems, fmt.Sprintf("MEADOWLARK_ALLOWED_ORIGINS: %v", err))
+	}
+	if _, err := newProxyPolicy(cfg.TrustedProxies); err != nil {
+		problems = append(problems, fmt.Sprintf("MEADOWLARK_TRUSTED_PROXIES: %v", err))
+	}
+	if _, err := parseCacheControl(cfg.StaticCacheControl); err != nil {
+		problems = append(problems, fmt.Sprintf("MEADOWLARK_STATIC_CACHE_CONTROL: %v", err))
+	}
+	if _, err := parseOutboundProxy(cfg.OutboundProxy); err != nil {
+		problems = append(problems, fmt.Sprintf("MEADOWLARK_OUTBOUND_PROXY: %v", err))
+	}
+	if _, err := newTelemetryReporter(cfg, nil); err != nil {
+		problems = append(problems, fmt.Sprintf("MEADOWLARK_TELEMETRY_ENDPOINT: %v", err))
+	}
+	if _, err := inbound.ParseRoutes(cfg.InboundEmailRoutes); err != nil {
+		problems = append(problems, fmt.Sprintf("MEADOWLARK_INBOUND_EMAIL_ROUTES: %v", err))
+	}
+	if len(problems) > 0 {
+		return checkResult{Status: checkFail, Detail: strings.Join(problems, "; "), Fix: "correct the listed variables, see Server Settings in the README"}
+	}
+
+	if len(cfg.Admins) == 0 {
+		return checkResult{Status: checkWarn, Detail: "no admins are configured, the /api/admin endpoints can't be used", Fix: "list usernames in MEADOWLARK_ADMINS"}
+	}
+	return checkResult{Status: checkOK}
+}
+
+// inMemoryDB reports whether the database path names an in-memory database, as in developer mode
+func inMemoryDB(path string) bool {
+	return path == ":memory:" || strings.Contains(path, "mode=memory") || strings.Contains(path, "vfs=memdb")
+}
+
+// checkDatabase opens the database read-only to check its integrity and schema version
+func checkDatabase(cfg *config.Config) checkResult {
+	if inMemoryDB(cfg.DBPath) {
+		return checkResult{Status: checkSkip, Detail: "in-memory database"}
+	}
+	if _, err := os.Stat(cfg.DBPath); errors.Is(err, os.ErrNotExist) {
+		return checkResult{Status: checkOK, Detail: cfg.DBPath + " doesn't exist yet and will be created"}
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+cfg.DBPath+"?mode=ro")
+	if err != nil {
+		return checkResult{Status: checkFail, Detail: err.Error(), Fix: "check MEADOWLARK_DB_PATH"}
+	}
+	defer db.Close()
+
+	var integrity string
+	if err := db.QueryRow(`PRAGMA quick_check`).Scan(&integrity); err != nil {
+		return checkResult{Status: checkFail, Detail: fmt.Sprintf("%s can't be read: %v", cfg.DBPath, err), Fix: "check MEADOWLARK_DB_PATH points at a meadowlark database"}
+	}
+	if integrity != "ok" {
+		return checkResult{Status: checkFail, Detail: fmt.Sprintf("%s is damaged: %s", cfg.DBPath, integrity), Fix: "restore the latest backup, see Backup and Restore in the README"}
+	}
+
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return checkResult{Status: checkFail, Detail: err.Error(), Fix: "check MEADOWLARK_DB_PATH"}
+	}
+	switch {
+	case version > schemaVersion:
+		return checkResult{Status: checkFail,
+			Detail: fmt.Sprintf("schema version %d was written by a newer meadowlark, this build knows %d", version, schemaVersion),
+			Fix:    "upgrade meadowlark, or restore a backup taken before the upgrade"}
+	case version < schemaVersion:
+		return checkResult{Status: checkOK, Detail: fmt.Sprintf("schema version %d, migrated to %d on the next start", version, schemaVersion)}
+	}
+	return checkResult{Status: checkOK, Detail: fmt.Sprintf("schema version %d", version)}
+}
+
+// checkPermissions makes sure the database and identity key can be written by the server
+// and read by nobody else. SQLite also needs to create journal files next to the database
+func checkPermissions(cfg *config.Config) checkResult {
+	var warnings, fixes []string
+	if !inMemoryDB(cfg.DBPath) {
+		dir := filepath.Dir(cfg.DBPath)
+		f, err := os.CreateTemp(dir, ".meadowlark-doctor-*")
+		if errors.Is(err, os.ErrNotExist) {
+			return checkResult{Status: checkFail, Detail: dir + " doesn't exist", Fix: "mkdir -p " + dir}
+		}
+		if err != nil {
+			return checkResult{Status: checkFail, Detail: fmt.Sprintf("can't create files in %s: %v", dir, err), Fix: "make the directory writable by the user meadowlark runs as"}
+		}
+		f.Close()
+		os.Remove(f.Name())
+		for _, path := range []string{cfg.DBPath, cfg.DBPath + "-wal", cfg.DBPath + "-shm"} {
+			info, err := os.Stat(path)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return checkResult{Status: checkFail, Detail: err.Error(), Fix: "check MEADOWLARK_DB_PATH"}
+			}
+			f, err := os.OpenFile(path, os.O_RDWR, 0)
+			if err != nil {
+				return checkResult{Status: checkFail, Detail: fmt.Sprintf("%s isn't writable: %v", path, err), Fix: fmt.Sprintf("chown the file to the user meadowlark runs as and chmod 600 %s", path)}
+			}
+			f.Close()
+			if info.Mode().Perm()&0o077 != 0 {
+				warnings = append(warnings, fmt.Sprintf("%s is accessible to other users (%v)", path, info.Mode().Perm()))
+				fixes = append(fixes, "chmod 600 "+path)
+			}
+		}
+	}
+	if info, err := os.Stat(cfg.IdentityKeyFile); err == nil && info.Mode().Perm()&0o077 != 0 {
+		warnings = append(warnings, fmt.Sprintf("the identity key %s is accessible to other users (%v)", cfg.IdentityKeyFile, info.Mode().Perm()))
+		fixes = append(fixes, "chmod 600 "+cfg.IdentityKeyFile)
+	}
+	if len(warnings) > 0 {
+		return checkResult{Status: checkWarn, Detail: strings.Join(warnings, "; "), Fix: strings.Join(fixes, " && ")}
+	}
+	return checkResult{Status: checkOK}
+}
+
+// checkStaticFiles makes sure the web client on disk, when it is served from there, is complete
+func checkStaticFiles(cfg *config.Config) checkResult {
+	dir := filepath.Join("cmd", "static")
+	info, err := os.Stat(dir)
+	if cfg.Desktop || err != nil || !info.IsDir() {
+		return checkResult{Status: checkOK, Detail: "serving the copy embedded in the binary"}
+	}
+	for _, name := range []string{"index.html", "app.js", "crypto.js", "styles.css"} {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			return checkResult{Status: checkFail, Detail: fmt.Sprintf("the web client on disk is incomplete: %v", err),
+				Fix: fmt.Sprintf("restore %s, or move %s away to serve the embedded copy", filepath.Join(dir, name), dir)}
+		}
+		f.Close()
+	}
+	if info.Mode().Perm()&0o002 != 0 {
+		return checkResult{Status: checkWarn, Detail: dir + " is writable by every user, who could change the web client",
+			Fix: "chmod o-w " + dir}
+	}
+	return checkResult{Status: checkOK, Detail: "serving " + dir}
+}
+
+// checkTLSCertificate reports a certificate in MEADOWLARK_TLS_CERT_FILE that isn't valid yet,
+// has expired or is about to
+func checkTLSCertificate(cfg *config.Config) checkResult {
+	if cfg.TLSCertFile == "" {
+		return checkResult{Status: checkSkip, Detail: "MEADOWLARK_TLS_CERT_FILE is not set"}
+	}
+	data, err := os.ReadFile(cfg.TLSCertFile)
+	if err != nil {
+		return checkResult{Status: checkFail, Detail: err.Error(), Fix: "check MEADOWLARK_TLS_CERT_FILE"}
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return checkResult{Status: checkFail, Detail: cfg.TLSCertFile + " holds no PEM certificate", Fix: "point MEADOWLARK_TLS_CERT_FILE at the certificate, not the key"}
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return checkResult{Status: checkFail, Detail: err.Error(), Fix: "check MEADOWLARK_TLS_CERT_FILE"}
+	}
+
+	now := time.Now()
+	names := strings.Join(cert.DNSNames, ", ")
+	switch {
+	case now.Before(cert.NotBefore):
+		return checkResult{Status: checkFail, Detail: fmt.Sprintf("the certificate for %s isn't valid until %s", names, cert.NotBefore.Format(time.RFC3339)),
+			Fix: "check the system clock, or wait for the certificate to become valid"}
+	case now.After(cert.NotAfter):
+		return checkResult{Status: checkFail, Detail: fmt.Sprintf("the certificate for %s expired on %s", names, cert.NotAfter.Format(time.RFC3339)),
+			Fix: "renew the certificate"}
+	case cert.NotAfter.Sub(now) < certExpiryWarning:
+		return checkResult{Status: checkWarn, Detail: fmt.Sprintf("the certificate for %s expires on %s", names, cert.NotAfter.Format(time.RFC3339)),
+			Fix: "renew the certificate, and check automatic renewal is running"}
+	}
+	return checkResult{Status: checkOK, Detail: fmt.Sprintf("%s, valid until %s", names, cert.NotAfter.Format(time.RFC3339))}
+}
+
+// checkSecrets fetches the JWT and encryption keys from the configured provider
+func checkSecrets(cfg *config.Config) checkResult {
+	store, err := NewSecrets(cfg)
+	if err != nil {
+		return checkResult{Status: checkFail, Detail: err.Error(), Fix: "check MEADOWLARK_SECRETS_PROVIDER and its settings"}
+	}
+	jwtKeys, err := loadKeyring(store, secrets.JWTKeys, cfg.JWTKeyID)
+	if err != nil {
+		return checkResult{Status: checkFail, Detail: fmt.Sprintf("JWT keys: %v", err), Fix: "check the JWT keys the secrets provider returns"}
+	}
+	atRest, err := loadKeyring(store, secrets.EncryptionKeys, cfg.EncryptionKeyID)
+	if err == nil && atRest != nil {
+		err = atRest.CheckAES()
+	}
+	if err != nil {
+		return checkResult{Status: checkFail, Detail: fmt.Sprintf("encryption keys: %v", err), Fix: "check the encryption keys the secrets provider returns"}
+	}
+	if jwtKeys == nil && !cfg.Dev {
+		return checkResult{Status: checkWarn, Detail: "no JWT keys, session tokens are signed with the built-in development key", Fix: "configure JWT keys, e.g. MEADOWLARK_JWT_KEYS=id:base64key"}
+	}
+	return checkResult{Status: checkOK, Detail: "fetched from " + cfg.SecretsProvider}
+}
+
+// checkClock compares the local clock with the Date header of MEADOWLARK_CLOCK_CHECK_URL.
+// Token expiry and signed responses depend on it
+func checkClock(cfg *config.Config) checkResult {
+	if cfg.ClockCheckURL == "" {
+		return checkResult{Status: checkSkip, Detail: "MEADOWLARK_CLOCK_CHECK_URL is not set"}
+	}
+	proxy, err := parseOutboundProxy(cfg.OutboundProxy)
+	if err != nil {
+		return checkResult{Status: checkSkip, Detail: "the outbound proxy is invalid"}
+	}
+	start := time.Now()
+	resp, err := outboundClient(proxy, 10*time.Second).Head(cfg.ClockCheckURL)
+	if err != nil {
+		return checkResult{Status: checkWarn, Detail: err.Error(), Fix: "check MEADOWLARK_CLOCK_CHECK_URL is reachable"}
+	}
+	resp.Body.Close()
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return checkResult{Status: checkWarn, Detail: cfg.ClockCheckURL + " sent no Date header", Fix: "use another MEADOWLARK_CLOCK_CHECK_URL"}
+	}
+
+	// Date has second precision, compare against the middle of the request
+	elapsed := time.Since(start)
+	skew := start.Add(elapsed / 2).Sub(date).Round(time.Second)
+	if skew < 0 {
+		skew = -skew
+	}
+	switch {
+	case skew > 5*time.Minute:
+		return checkResult{Status: checkFail, Detail: fmt.Sprintf("the clock is off by %v", skew), Fix: "enable time synchronisation, e.g. systemd-timesyncd or chrony"}
+	case skew > 30*time.Second:
+		return checkResult{Status: checkWarn, Detail: fmt.Sprintf("the clock is off by %v", skew), Fix: "enable time synchronisation, e.g. systemd-timesyncd or chrony"}
+	}
+	return checkResult{Status: checkOK, Detail: fmt.Sprintf("off by %v from %s", skew, cfg.ClockCheckURL)}
+}
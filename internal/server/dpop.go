@@ -0,0 +1,126 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/auth"
+)
+
+// proofReplay remembers the ids of recently accepted DPoP proofs, so a proof captured on the
+// wire can't be sent again while it is still fresh
+type proofReplay struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+func newProofReplay(window time.Duration) *proofReplay {
+	// a proof is fresh for window either side of the server's clock
+	return &proofReplay{ttl: 2 * window, seen: make(map[string]time.Time)}
+}
+
+// first records a proof and reports whether it hadn't been seen before
+func (p *proofReplay) first(proof *auth.Proof) bool {
+	key := proof.JKT + "\x00" + proof.ID
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(p.lastSweep) > p.ttl {
+		for k, expires := range p.seen {
+			if now.After(expires) {
+				delete(p.seen, k)
+			}
+		}
+		p.lastSweep = now
+	}
+	if expires, ok := p.seen[key]; ok && now.Before(expires) {
+		return false
+	}
+	p.seen[key] = now.Add(p.ttl)
+	return true
+}
+
+// requestToken returns the access token of an Authorization header using the Bearer or DPoP
+// scheme, empty when there is none
+func requestToken(r *http.Request) string {
+	parts := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(parts) != 2 || (parts[0] != "Bearer" && parts[0] != "DPoP") {
+		return ""
+	}
+	return parts[1]
+}
+
+// requestURL is the URL the client sent r to, as a proof's htu names it. The base path
+// stripped from r.URL is still in the request URI
+func (s *Server) requestURL(r *http.Request) string {
+	path := r.RequestURI
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	return s.proxies.scheme(r) + "://" + r.Host + path
+}
+
+// checkProof verifies a DPoP proof for r, sent with accessToken or "" when it asks for one
+func (s *Server) checkProof(r *http.Request, proof, accessToken string) (*auth.Proof, *apierror.Error) {
+	invalid := apierror.New(http.StatusUnauthorized, apierror.InvalidDPoPProof)
+	if proof == "" {
+		return nil, invalid
+	}
+	p, err := auth.VerifyProof(proof, r.Method, s.requestURL(r), accessToken, time.Now(), s.config.DPoPProofWindow)
+	if errors.Is(err, auth.ErrInvalidProof) {
+		return nil, invalid.With("detail", strings.TrimPrefix(err.Error(), auth.ErrInvalidProof.Error()+": "))
+	}
+	if err != nil {
+		log.Printf("Error verifying DPoP proof: %v", err)
+		return nil, invalid
+	}
+	if !s.proofs.first(p) {
+		return nil, invalid.With("detail", "proof already used")
+	}
+	return p, nil
+}
+
+// checkBinding makes sure a token bound to a key came with a proof signed by it, and, when the
+// server requires binding, that the token is bound at all
+func (s *Server) checkBinding(r *http.Request, claims *auth.UserClaims, token, proof string) *apierror.Error {
+	jkt := claims.BoundTo()
+	if jkt == "" {
+		if s.config.DPoPRequired {
+			return apierror.New(http.StatusUnauthorized, apierror.DPoPRequired)
+		}
+		return nil
+	}
+	p, apiErr := s.checkProof(r, proof, token)
+	if apiErr != nil {
+		return apiErr
+	}
+	if p.JKT != jkt {
+		return apierror.New(http.StatusUnauthorized, apierror.InvalidDPoPProof).With("detail", "proof signed by another key")
+	}
+	return nil
+}
+
+// loginBinding returns the thumbprint of the key a login's DPoP header proves, so the token it
+// receives is bound to it. Logins without the header get bearer tokens unless binding is required
+func (s *Server) loginBinding(r *http.Request) (string, *apierror.Error) {
+	proof := r.Header.Get("DPoP")
+	if proof == "" {
+		if s.config.DPoPRequired {
+			return "", apierror.New(http.StatusUnauthorized, apierror.DPoPRequired)
+		}
+		return "", nil
+	}
+	p, apiErr := s.checkProof(r, proof, "")
+	if apiErr != nil {
+		return "", apiErr
+	}
+	return p.JKT, nil
+}
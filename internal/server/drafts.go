@@ -0,0 +1,114 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/history"
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+)
+
+// DraftRequest defines JSON for PUT /api/drafts/{id}
+type DraftRequest struct {
+	Content   []byte     `json:"content"`             // encrypted by the client
+	UpdatedAt *time.Time `json:"updatedAt,omitempty"` // when it was last edited, defaults to now
+}
+
+// HandleDrafts serves the caller's unsent drafts: all of them at /api/drafts, and one
+// conversation's at /api/drafts/{id}, where PUT stores it and DELETE clears it, for instance
+// once it was sent. The last edit wins, an older one answers 409 stale_draft. Changes are sent
+// to the caller's connections so a draft started on one device can be finished on another
+func (s *Server) HandleDrafts(w http.ResponseWriter, r *http.Request, username string) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/drafts")
+	if rest == "" || rest == "/" {
+		if r.Method != http.MethodGet {
+			respondMethodNotAllowed(w)
+			return
+		}
+		drafts, err := s.messages.Drafts(username)
+		if err != nil {
+			respondInternalError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"drafts": drafts})
+		return
+	}
+
+	scope, subject, ok, err := s.resolveConversation(strings.TrimPrefix(rest, "/"), username)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	if !ok {
+		respondError(w, apierror.New(http.StatusNotFound, apierror.ConversationNotFound))
+		return
+	}
+
+	var draft *history.Draft
+	switch r.Method {
+	case http.MethodGet:
+		if draft, err = s.messages.Draft(username, scope, subject); err != nil {
+			respondInternalError(w, err)
+			return
+		}
+		if draft == nil {
+			respondError(w, apierror.New(http.StatusNotFound, apierror.NotFound))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(draft)
+		return
+	case http.MethodPut:
+		var req DraftRequest
+		if err := s.readJSON(w, r, &req); err != nil {
+			respondError(w, err)
+			return
+		}
+		if req.Content == nil {
+			respondError(w, apierror.Invalid(errors.New("content is required, DELETE clears a draft")))
+			return
+		}
+		if len(req.Content) > history.MaxDraftSize {
+			respondError(w, apierror.New(http.StatusRequestEntityTooLarge, apierror.PayloadTooLarge).With("max", history.MaxDraftSize))
+			return
+		}
+		var updatedAt time.Time
+		if req.UpdatedAt != nil {
+			updatedAt = *req.UpdatedAt
+		}
+		draft, err = s.messages.SetDraft(username, scope, subject, req.Content, updatedAt)
+	case http.MethodDelete:
+		var updatedAt time.Time
+		if raw := r.URL.Query().Get("updatedAt"); raw != "" {
+			if updatedAt, err = time.Parse(time.RFC3339Nano, raw); err != nil {
+				respondError(w, apierror.Invalid(err))
+				return
+			}
+		}
+		draft, err = s.messages.SetDraft(username, scope, subject, nil, updatedAt)
+	default:
+		respondMethodNotAllowed(w)
+		return
+	}
+	if errors.Is(err, history.ErrStaleDraft) {
+		respondError(w, apierror.New(http.StatusConflict, apierror.StaleDraft).With("updatedAt", draft.UpdatedAt))
+		return
+	}
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+
+	s.hub.Forward(protocol.NewControlMessage(username, protocol.EventDraft, draft))
+	if r.Method == http.MethodDelete {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(draft)
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/emoji"
+)
+
+// EmojiPackRequest defines JSON for POST /api/admin/emoji
+type EmojiPackRequest struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`           // "emoji" or "sticker"
+	Room string `json:"room,omitempty"` // optional, limits the pack to one room
+}
+
+// HandleEmojiManifest returns the packs a client should offer, honouring If-None-Match
+func (s *Server) HandleEmojiManifest(w http.ResponseWriter, r *http.Request) {
+	manifest, err := s.emoji.Manifest(r.URL.Query().Get("room"), false)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+
+	etag := `"` + manifest.Version + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(manifest)
+}
+
+// HandleEmojiImage serves /api/emoji/{pack}/{shortcode}
+// images are public so they can be used directly in img tags
+func (s *Server) HandleEmojiImage(w http.ResponseWriter, r *http.Request) {
+	packID, shortcode, ok := parseEmojiPath(strings.TrimPrefix(r.URL.Path, "/api/emoji/"))
+	if !ok || shortcode == "" {
+		respondError(w, apierror.New(http.StatusNotFound, apierror.EmojiNotFound))
+		return
+	}
+
+	img, err := s.emoji.Image(packID, shortcode)
+	if err == emoji.ErrNotFound {
+		respondError(w, apierror.New(http.StatusNotFound, apierror.EmojiNotFound))
+		return
+	}
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+
+	w.Header().Set("ETag", img.ETag)
+	// shortcodes can be replaced, so caches revalidate after an hour
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	if r.Header.Get("If-None-Match") == img.ETag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", img.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(img.Data)))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(img.Data)
+}
+
+// HandleEmojiPacks lists every pack or creates a new one (admin only)
+func (s *Server) HandleEmojiPacks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		manifest, err := s.emoji.Manifest("", true)
+		if err != nil {
+			respondInternalError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(manifest)
+	case http.MethodPost:
+		var req EmojiPackRequest
+		if err := s.readJSON(w, r, &req); err != nil {
+			respondError(w, err)
+			return
+		}
+		pack, err := s.emoji.CreatePack(req.Name, req.Kind, req.Room)
+		if err != nil {
+			respondError(w, apierror.Invalid(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(pack)
+	default:
+		respondMethodNotAllowed(w)
+	}
+}
+
+// HandleEmojiPack manages /api/admin/emoji/{pack} and /api/admin/emoji/{pack}/{shortcode} (admin only)
+func (s *Server) HandleEmojiPack(w http.ResponseWriter, r *http.Request) {
+	packID, shortcode, ok := parseEmojiPath(strings.TrimPrefix(r.URL.Path, "/api/admin/emoji/"))
+	if !ok {
+		respondError(w, apierror.New(http.StatusBadRequest, apierror.InvalidPackID))
+		return
+	}
+
+	var err error
+	switch {
+	case r.Method == http.MethodDelete && shortcode == "":
+		err = s.emoji.DeletePack(packID)
+	case r.Method == http.MethodDelete:
+		err = s.emoji.DeleteItem(packID, shortcode)
+	case r.Method == http.MethodPut && shortcode != "":
+		s.uploadEmoji(w, r, packID, shortcode)
+		return
+	default:
+		respondMethodNotAllowed(w)
+		return
+	}
+
+	if err == emoji.ErrNotFound {
+		respondError(w, apierror.New(http.StatusNotFound, apierror.EmojiNotFound))
+		return
+	}
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// uploadEmoji stores the raw image in the request body under shortcode
+func (s *Server) uploadEmoji(w http.ResponseWriter, r *http.Request, packID int64, shortcode string) {
+	// read up to the larger limit, the pack kind picks the real one below
+	maxSize := s.config.EmojiMaxSize
+	if s.config.StickerMaxSize > maxSize {
+		maxSize = s.config.StickerMaxSize
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSize))
+	if err != nil {
+		respondError(w, apierror.New(http.StatusRequestEntityTooLarge, apierror.PayloadTooLarge).With("max", maxSize))
+		return
+	}
+
+	kind, err := s.emoji.PackKind(packID)
+	if err == emoji.ErrNotFound {
+		respondError(w, apierror.New(http.StatusNotFound, apierror.EmojiNotFound))
+		return
+	}
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	limit := s.config.EmojiMaxSize
+	if kind == emoji.KindSticker {
+		limit = s.config.StickerMaxSize
+	}
+
+	item, err := s.emoji.PutItem(packID, shortcode, data, limit)
+	if err == emoji.ErrNotFound {
+		respondError(w, apierror.New(http.StatusNotFound, apierror.EmojiNotFound))
+		return
+	}
+	if err != nil {
+		respondError(w, apierror.Invalid(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(item)
+}
+
+// parseEmojiPath splits "{pack}" or "{pack}/{shortcode}"
+func parseEmojiPath(path string) (int64, string, bool) {
+	idPart, shortcode, _ := strings.Cut(path, "/")
+	packID, err := strconv.ParseInt(idPart, 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+	return packID, shortcode, true
+}
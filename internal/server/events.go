@@ -0,0 +1,280 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+	"github.com/Chase-Garrett/meadowlark/internal/rooms"
+)
+
+const maxRoomEventsPage = 100
+
+// how many scheduled events a room's calendar export holds
+const maxCalendarEvents = 500
+
+// RoomEventRequest defines JSON for creating or replacing a room event. Content is encrypted
+// for the room's members; the other fields are optional plaintext the server can read
+type RoomEventRequest struct {
+	Title    string     `json:"title"`
+	Location string     `json:"location"`
+	Start    *time.Time `json:"start"`
+	End      *time.Time `json:"end"`
+	Content  []byte     `json:"content"`
+}
+
+// RSVPRequest defines JSON for PUT /api/rooms/{id}/events/{event}/rsvp
+type RSVPRequest struct {
+	Status string `json:"status"` // yes, no or maybe
+}
+
+// handleRoomEvents lists and creates a room's events (/events), and with idPart shows, replaces or
+// cancels one (/events/{event}) or answers it (/events/{event}/rsvp)
+func (s *Server) handleRoomEvents(w http.ResponseWriter, r *http.Request, roomID, username, idPart string) {
+	role, ok := s.roomRole(w, roomID, username, rooms.RoleMember)
+	if !ok {
+		return
+	}
+	if idPart == "" {
+		switch r.Method {
+		case http.MethodGet:
+			s.listRoomEvents(w, r, roomID)
+		case http.MethodPost:
+			s.createRoomEvent(w, r, roomID, username)
+		default:
+			respondMethodNotAllowed(w)
+		}
+		return
+	}
+
+	idPart, rsvp := strings.CutSuffix(idPart, "/rsvp")
+	id, err := strconv.ParseInt(idPart, 10, 64)
+	if err != nil {
+		respondError(w, apierror.New(http.StatusNotFound, apierror.EventNotFound))
+		return
+	}
+	if rsvp {
+		s.handleRSVP(w, r, roomID, username, id)
+		return
+	}
+
+	event, err := s.rooms.Event(roomID, id)
+	if err != nil {
+		respondRoomError(w, err)
+		return
+	}
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(event)
+		return
+	}
+	if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		respondMethodNotAllowed(w)
+		return
+	}
+	// the creator changes their own events, moderators anyone's
+	if event.Creator != username && !rooms.AtLeast(role, rooms.RoleModerator) {
+		respondError(w, apierror.New(http.StatusForbidden, apierror.RoomForbidden).With("role", rooms.RoleModerator))
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		if err := s.rooms.DeleteEvent(roomID, id); err != nil {
+			respondRoomError(w, err)
+			return
+		}
+		s.hub.NotifyRoom(roomID, protocol.EventRoomEvent, map[string]interface{}{
+			"room": roomID, "action": protocol.RoomEventCancelled, "id": id, "by": username,
+		})
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var req RoomEventRequest
+	if err := s.readJSON(w, r, &req); err != nil {
+		respondError(w, err)
+		return
+	}
+	event.Title, event.Location, event.Start, event.End, event.Content = req.Title, req.Location, req.Start, req.End, req.Content
+	if err := s.rooms.UpdateEvent(event); err != nil {
+		respondRoomError(w, err)
+		return
+	}
+	s.hub.NotifyRoom(roomID, protocol.EventRoomEvent, map[string]interface{}{
+		"room": roomID, "action": protocol.RoomEventUpdated, "event": event, "by": username,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(event)
+}
+
+// listRoomEvents pages through a room's events, newest first
+func (s *Server) listRoomEvents(w http.ResponseWriter, r *http.Request, roomID string) {
+	p, apiErr := readPage(r, maxRoomEventsPage, false)
+	if apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+	var before int64
+	if _, apiErr := p.after(&before); apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+	events, err := s.rooms.Events(roomID, before, p.Limit)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	p.respond(w, r, map[string]interface{}{"events": events}, len(events), func() interface{} {
+		return events[len(events)-1].ID
+	})
+}
+
+// createRoomEvent adds an event, which takes the same right as posting a message to the room
+func (s *Server) createRoomEvent(w http.ResponseWriter, r *http.Request, roomID, username string) {
+	snap, err := s.rooms.Snapshot(roomID)
+	if err != nil {
+		respondRoomError(w, err)
+		return
+	}
+	if apiErr := roomPostError(snap, username); apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+	var req RoomEventRequest
+	if err := s.readJSON(w, r, &req); err != nil {
+		respondError(w, err)
+		return
+	}
+	event := &rooms.Event{
+		Room:     roomID,
+		Creator:  username,
+		Title:    req.Title,
+		Location: req.Location,
+		Start:    req.Start,
+		End:      req.End,
+		Content:  req.Content,
+	}
+	if err := s.rooms.AddEvent(event); err != nil {
+		respondRoomError(w, err)
+		return
+	}
+	s.hub.NotifyRoom(roomID, protocol.EventRoomEvent, map[string]interface{}{
+		"room": roomID, "action": protocol.RoomEventCreated, "event": event, "by": username,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(event)
+}
+
+// handleRSVP answers (PUT) or withdraws the answer to (DELETE) an event
+func (s *Server) handleRSVP(w http.ResponseWriter, r *http.Request, roomID, username string, id int64) {
+	var status string
+	switch r.Method {
+	case http.MethodPut:
+		var req RSVPRequest
+		if err := s.readJSON(w, r, &req); err != nil {
+			respondError(w, err)
+			return
+		}
+		if req.Status == "" {
+			respondError(w, apierror.New(http.StatusBadRequest, apierror.InvalidRSVP))
+			return
+		}
+		status = req.Status
+	case http.MethodDelete:
+	default:
+		respondMethodNotAllowed(w)
+		return
+	}
+	if err := s.rooms.SetRSVP(roomID, id, username, status); err != nil {
+		respondRoomError(w, err)
+		return
+	}
+	s.hub.NotifyRoom(roomID, protocol.EventRoomRSVP, map[string]interface{}{
+		"room": roomID, "event": id, "username": username, "status": status,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// icsEscape escapes a TEXT value as RFC 5545 section 3.3.11 requires
+func icsEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`, "\r", `\n`).Replace(s)
+}
+
+// icsLine writes a content line, folded at 75 octets without splitting a UTF-8 sequence
+func icsLine(b *strings.Builder, name, value string) {
+	line := name + ":" + value
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		b.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+		// continuation lines start with a space, which counts toward their 75 octets
+		limit = 74
+	}
+	b.WriteString(line + "\r\n")
+}
+
+// handleRoomCalendar serves /api/rooms/{id}/events.ics, the room's events that have a
+// plaintext start time as an iCalendar file. Details only in encrypted content are left out
+func (s *Server) handleRoomCalendar(w http.ResponseWriter, r *http.Request, roomID, username string) {
+	if r.Method != http.MethodGet {
+		respondMethodNotAllowed(w)
+		return
+	}
+	if _, ok := s.roomRole(w, roomID, username, rooms.RoleMember); !ok {
+		return
+	}
+	room, err := s.rooms.Get(roomID)
+	if err != nil {
+		respondRoomError(w, err)
+		return
+	}
+	events, err := s.rooms.ScheduledEvents(roomID, maxCalendarEvents)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+
+	const stamp = "20060102T150405Z"
+	var b strings.Builder
+	icsLine(&b, "BEGIN", "VCALENDAR")
+	icsLine(&b, "VERSION", "2.0")
+	icsLine(&b, "PRODID", "-//Meadowlark//Room events//EN")
+	icsLine(&b, "CALSCALE", "GREGORIAN")
+	icsLine(&b, "X-WR-CALNAME", icsEscape(room.Name))
+	for _, e := range events {
+		title := e.Title
+		if title == "" {
+			title = room.Name
+		}
+		icsLine(&b, "BEGIN", "VEVENT")
+		// stable across exports so calendar apps update events instead of duplicating them
+		icsLine(&b, "UID", "room-event-"+strconv.FormatInt(e.ID, 10)+"@"+r.Host)
+		icsLine(&b, "DTSTAMP", e.UpdatedAt.UTC().Format(stamp))
+		icsLine(&b, "CREATED", e.CreatedAt.UTC().Format(stamp))
+		icsLine(&b, "LAST-MODIFIED", e.UpdatedAt.UTC().Format(stamp))
+		icsLine(&b, "DTSTART", e.Start.UTC().Format(stamp))
+		if e.End != nil {
+			icsLine(&b, "DTEND", e.End.UTC().Format(stamp))
+		}
+		icsLine(&b, "SUMMARY", icsEscape(title))
+		if e.Location != "" {
+			icsLine(&b, "LOCATION", icsEscape(e.Location))
+		}
+		icsLine(&b, "END", "VEVENT")
+	}
+	icsLine(&b, "END", "VCALENDAR")
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="events.ics"`)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/auth"
+	"github.com/Chase-Garrett/meadowlark/internal/history"
+	"github.com/Chase-Garrett/meadowlark/internal/rooms"
+)
+
+// exportVersion is bumped whenever the meaning of an existing line type changes
+const exportVersion = 1
+
+// ExportHeader is the first line of a conversation export
+type ExportHeader struct {
+	Type         string             `json:"type"` // "header"
+	Format       string             `json:"format"`
+	Version      int                `json:"version"`
+	ExportedBy   string             `json:"exportedBy"`
+	ExportedAt   time.Time          `json:"exportedAt"`
+	Conversation ExportConversation `json:"conversation"`
+}
+
+// ExportConversation identifies the exported conversation
+type ExportConversation struct {
+	Kind    string         `json:"kind"`           // "direct" or "room"
+	With    string         `json:"with,omitempty"` // direct conversations
+	Room    *rooms.Room    `json:"room,omitempty"`
+	Members []rooms.Member `json:"members,omitempty"`
+}
+
+// exportMessage is a direct message line, the envelope fields are inlined
+type exportMessage struct {
+	Type string `json:"type"` // "message"
+	history.Envelope
+}
+
+// exportRoomMessage is a room message line
+type exportRoomMessage struct {
+	Type string `json:"type"` // "message"
+	history.RoomEnvelope
+}
+
+// ExportAttachment is an attachment the exporting user uploaded while the conversation ran.
+// Which message uses it is only known to clients, inside the encrypted content
+type ExportAttachment struct {
+	Type      string    `json:"type"` // "attachment"
+	ID        string    `json:"id"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"createdAt"`
+	URL       string    `json:"url"`
+	// set on thumbnails, the id of the attachment they preview
+	ThumbnailOf string `json:"thumbnailOf,omitempty"`
+}
+
+// ExportEnd is the last line, a stream without it was cut short
+type ExportEnd struct {
+	Type        string `json:"type"` // "end"
+	Messages    int    `json:"messages"`
+	Attachments int    `json:"attachments"`
+}
+
+// HandleExport streams every stored envelope of one conversation as JSON Lines:
+// GET /api/export?with={username} for a direct conversation, ?room={id} for a room.
+// Content stays encrypted, the export is for clients to archive and decrypt themselves
+func (s *Server) HandleExport(w http.ResponseWriter, r *http.Request, username string) {
+	region, err := s.userStorage.Region(username)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	if rc := s.regionConfig(region); rc != nil && !rc.AllowExport {
+		respondError(w, apierror.New(http.StatusForbidden, apierror.ExportDisabled))
+		return
+	}
+
+	query := r.URL.Query()
+	header := ExportHeader{
+		Type:       "header",
+		Format:     "meadowlark-export",
+		Version:    exportVersion,
+		ExportedBy: username,
+		ExportedAt: time.Now(),
+	}
+	var filename string
+
+	switch {
+	case query.Get("room") != "":
+		roomID := query.Get("room")
+		if _, ok := s.roomRole(w, roomID, username, rooms.RoleMember); !ok {
+			return
+		}
+		room, err := s.rooms.Get(roomID)
+		if err != nil {
+			respondInternalError(w, err)
+			return
+		}
+		members, err := s.rooms.Members(roomID)
+		if err != nil {
+			respondInternalError(w, err)
+			return
+		}
+		header.Conversation = ExportConversation{Kind: "room", Room: room, Members: members}
+		filename = "meadowlark-room-" + roomID + ".jsonl"
+	case query.Get("with") != "":
+		with, err := s.userStorage.ResolveUsername(query.Get("with"))
+		if err == auth.ErrUserNotFound {
+			respondError(w, apierror.New(http.StatusNotFound, apierror.UserNotFound))
+			return
+		}
+		if err != nil {
+			respondInternalError(w, err)
+			return
+		}
+		header.Conversation = ExportConversation{Kind: "direct", With: with}
+		filename = "meadowlark-" + with + ".jsonl"
+	default:
+		respondError(w, apierror.New(http.StatusBadRequest, apierror.InvalidRequest).With("detail", "pass with or room"))
+		return
+	}
+
+	liftDeadlines(w)
+	w.Header().Set("Content-Type", "application/jsonl")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("Cache-Control", "no-store")
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	if err := enc.Encode(header); err != nil {
+		return
+	}
+
+	end := ExportEnd{Type: "end"}
+	var first, last time.Time
+	// page by sequence number so memory stays bounded however long the conversation is
+	for from := int64(1); ; {
+		var n int
+		var err error
+		if header.Conversation.Kind == "room" {
+			var page []history.RoomEnvelope
+			page, err = s.messages.RoomMessages(header.Conversation.Room.ID, from, 1<<62, maxMissingMessages)
+			for _, env := range page {
+				if err = enc.Encode(exportRoomMessage{Type: "message", RoomEnvelope: env}); err != nil {
+					break
+				}
+				first, last = spanOf(first, last, env.CreatedAt)
+				from = env.Seq + 1
+			}
+			n = len(page)
+		} else {
+			var page []history.Envelope
+			page, err = s.messages.Conversation(username, header.Conversation.With, from, 1<<62, maxMissingMessages)
+			for _, env := range page {
+				if err = enc.Encode(exportMessage{Type: "message", Envelope: env}); err != nil {
+					break
+				}
+				first, last = spanOf(first, last, env.CreatedAt)
+				from = env.Seq + 1
+			}
+			n = len(page)
+		}
+		if err != nil {
+			// headers are gone, leaving out the end line tells the client the export is incomplete
+			log.Printf("Error exporting conversation for %s: %v", username, err)
+			return
+		}
+		end.Messages += n
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if n < maxMissingMessages {
+			break
+		}
+	}
+
+	if end.Messages > 0 {
+		// attachment times are stored in seconds, widen the span so none at its edges are missed
+		owned, err := s.attachments.OwnedBetween(username, first.Truncate(time.Second), last.Add(time.Second))
+		if err != nil {
+			log.Printf("Error exporting attachments for %s: %v", username, err)
+			return
+		}
+		for _, att := range owned {
+			line := ExportAttachment{
+				Type:        "attachment",
+				ID:          att.ID,
+				Size:        att.Size,
+				CreatedAt:   att.CreatedAt,
+				URL:         s.config.BasePath + "/api/attachments/" + att.ID,
+				ThumbnailOf: att.ThumbnailOf,
+			}
+			if err := enc.Encode(line); err != nil {
+				return
+			}
+		}
+		end.Attachments = len(owned)
+	}
+	enc.Encode(end)
+}
+
+// spanOf widens the first and last times seen to include t
+func spanOf(first, last, t time.Time) (time.Time, time.Time) {
+	if first.IsZero() || t.Before(first) {
+		first = t
+	}
+	if t.After(last) {
+		last = t
+	}
+	return first, last
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+)
+
+// how many of the latest public posts a room feed carries
+const feedEntries = 50
+
+// entry titles are the first line of a post, cut to this many characters
+const feedTitleLength = 80
+
+// atomFeed and the types below are the parts of RFC 4287 a room feed uses
+type atomFeed struct {
+	XMLName  xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID       string      `xml:"id"`
+	Title    string      `xml:"title"`
+	Subtitle string      `xml:"subtitle,omitempty"`
+	Updated  string      `xml:"updated"`
+	Icon     string      `xml:"icon,omitempty"`
+	Links    []atomLink  `xml:"link"`
+	Entries  []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Author    atomAuthor  `xml:"author"`
+	Published string      `xml:"published"`
+	Updated   string      `xml:"updated"`
+	Link      atomLink    `xml:"link"`
+	Content   atomContent `xml:"content"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+// feedTitle is the first line of text, shortened to feedTitleLength characters
+func feedTitle(text string) string {
+	title, _, _ := strings.Cut(text, "\n")
+	title = strings.TrimSpace(title)
+	if utf8.RuneCountInString(title) > feedTitleLength {
+		title = strings.TrimSpace(string([]rune(title)[:feedTitleLength-1])) + "…"
+	}
+	return title
+}
+
+// HandleRoomFeed serves /feeds/rooms/{id}.xml, an Atom feed of a broadcasting room's latest
+// public posts. Ids are URNs so they stay the same when the server moves to another address
+func (s *Server) HandleRoomFeed(w http.ResponseWriter, r *http.Request) {
+	roomID, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/feeds/rooms/"), ".xml")
+	if !s.config.PublicRooms || !ok || roomID == "" || strings.Contains(roomID, "/") {
+		respondError(w, apierror.New(http.StatusNotFound, apierror.NotFound))
+		return
+	}
+	room, err := s.rooms.Broadcasting(roomID)
+	if err != nil {
+		respondRoomError(w, err)
+		return
+	}
+	posts, err := s.rooms.PublicPosts(roomID, 0, feedEntries)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	updated, err := s.rooms.PublicUpdated(roomID)
+	if err != nil {
+		respondRoomError(w, err)
+		return
+	}
+
+	// links are absolute, feed readers fetch them from elsewhere
+	origin := s.proxies.scheme(r) + "://" + r.Host
+	pageURL := origin + s.config.BasePath + "/public/rooms/" + room.ID
+
+	feed := atomFeed{
+		ID:       "urn:meadowlark:room:" + room.ID,
+		Title:    room.Name,
+		Subtitle: room.Topic,
+		Updated:  updated.UTC().Format(time.RFC3339),
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: origin + s.config.BasePath + "/feeds/rooms/" + room.ID + ".xml"},
+			{Rel: "alternate", Type: "text/html", Href: pageURL},
+		},
+		Entries: make([]atomEntry, 0, len(posts)),
+	}
+	if room.AvatarURL != "" {
+		feed.Icon = origin + room.AvatarURL
+	}
+	for _, post := range posts {
+		created := post.CreatedAt.UTC().Format(time.RFC3339)
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:        "urn:meadowlark:room:" + room.ID + ":post:" + strconv.FormatInt(post.ID, 10),
+			Title:     feedTitle(post.Text),
+			Author:    atomAuthor{Name: post.Author},
+			Published: created,
+			Updated:   created,
+			Link:      atomLink{Rel: "alternate", Type: "text/html", Href: pageURL},
+			Content:   atomContent{Type: "text", Text: post.Text},
+		})
+	}
+
+	data, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	data = append([]byte(xml.Header), append(data, '\n')...)
+	respondPublic(w, r, "application/atom+xml; charset=utf-8", updated, data)
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/auth"
+	"github.com/Chase-Garrett/meadowlark/internal/flags"
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+)
+
+// feature flags the server consults
+const (
+	flagBatchFrames       = "batchFrames"
+	flagBinaryFrames      = "binaryFrames"
+	flagLiveLocation      = "liveLocation"
+	flagMessageReordering = "messageReordering"
+)
+
+// featureFlags are the features that can be rolled out gradually, and their rollout unless
+// MEADOWLARK_FEATURE_FLAGS says otherwise. A new risky feature starts at 0
+var featureFlags = []flags.Definition{
+	{Name: flagBatchFrames, Description: "Protocol version 3, several messages in one websocket frame", Rollout: 100},
+	{Name: flagBinaryFrames, Description: "Protocol version 4, message content raw in binary websocket frames", Rollout: 100},
+	{Name: flagLiveLocation, Description: "Sharing live location with another user", Rollout: 100},
+	{Name: flagMessageReordering, Description: "Holding chat messages that arrive out of order until the gap fills", Rollout: 100},
+}
+
+// FlagRequest defines JSON for PUT /api/admin/flags/{name}
+type FlagRequest struct {
+	Rollout *int `json:"rollout"` // percent of users, 0 to 100
+}
+
+// FlagUserRequest defines JSON for PUT /api/admin/flags/{name}/users/{username}
+type FlagUserRequest struct {
+	Enabled *bool `json:"enabled"`
+}
+
+// loadFeatureFlags reads the configured rollouts and the flags admins have set
+func loadFeatureFlags(spec string, db *sql.DB) *flags.Set {
+	defs, err := flags.ParseDefaults(featureFlags, spec)
+	if err != nil {
+		log.Fatalf("Invalid MEADOWLARK_FEATURE_FLAGS: %v", err)
+	}
+	set, err := flags.NewSet(db, defs)
+	if err != nil {
+		log.Fatalf("Failed to load feature flags: %v", err)
+	}
+	return set
+}
+
+// flaggedVersion lowers a negotiated protocol version to the newest one the user's flags allow
+func (s *Server) flaggedVersion(version int, username string) int {
+	if version >= protocol.BinaryVersion && !s.flags.Enabled(flagBinaryFrames, username) {
+		version = protocol.BatchVersion
+	}
+	if version >= protocol.BatchVersion && !s.flags.Enabled(flagBatchFrames, username) {
+		version = protocol.StreamsVersion
+	}
+	return version
+}
+
+// requireFlag answers 403 feature_disabled unless flag is on for username
+func (s *Server) requireFlag(w http.ResponseWriter, flag, username string) bool {
+	if s.flags.Enabled(flag, username) {
+		return true
+	}
+	respondError(w, apierror.New(http.StatusForbidden, apierror.FeatureDisabled).With("feature", flag))
+	return false
+}
+
+// HandleFlags lists the feature flags as they are for the caller
+func (s *Server) HandleFlags(w http.ResponseWriter, r *http.Request, username string) {
+	if r.Method != http.MethodGet {
+		respondMethodNotAllowed(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"flags": s.flags.For(username)})
+}
+
+// HandleAdminFlags lists every feature flag with its rollout and the users it is turned on or
+// off for (admin only)
+func (s *Server) HandleAdminFlags(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondMethodNotAllowed(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"flags": s.flags.List()})
+}
+
+// HandleAdminFlag changes a flag at /api/admin/flags/{name}: its rollout (PUT), back to the
+// configured one (DELETE), or for one user at /api/admin/flags/{name}/users/{username} (admin only)
+func (s *Server) HandleAdminFlag(w http.ResponseWriter, r *http.Request, admin string) {
+	name, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/admin/flags/"), "/")
+	if _, err := s.flags.Get(name); err != nil {
+		respondFlagError(w, name, err)
+		return
+	}
+
+	var flag flags.Flag
+	var err error
+	switch user, isUser := strings.CutPrefix(rest, "users/"); {
+	case rest == "" && r.Method == http.MethodGet:
+		flag, err = s.flags.Get(name)
+	case rest == "" && r.Method == http.MethodPut:
+		var req FlagRequest
+		if apiErr := s.readJSON(w, r, &req); apiErr != nil {
+			respondError(w, apiErr)
+			return
+		}
+		if req.Rollout == nil {
+			respondError(w, apierror.New(http.StatusBadRequest, apierror.InvalidRequest).With("detail", "rollout is required"))
+			return
+		}
+		flag, err = s.flags.SetRollout(name, *req.Rollout, admin)
+		if err == nil {
+			log.Printf("%s set the rollout of feature flag %s to %d%%", admin, name, flag.Rollout)
+		}
+	case rest == "" && r.Method == http.MethodDelete:
+		flag, err = s.flags.ResetRollout(name)
+		if err == nil {
+			log.Printf("%s reset feature flag %s to its configured rollout of %d%%", admin, name, flag.Rollout)
+		}
+	case isUser && user != "" && !strings.Contains(user, "/") && r.Method == http.MethodPut:
+		var req FlagUserRequest
+		if apiErr := s.readJSON(w, r, &req); apiErr != nil {
+			respondError(w, apiErr)
+			return
+		}
+		if req.Enabled == nil {
+			respondError(w, apierror.New(http.StatusBadRequest, apierror.InvalidRequest).With("detail", "enabled is required"))
+			return
+		}
+		username, resolveErr := s.userStorage.ResolveUsername(user)
+		if resolveErr == auth.ErrUserNotFound {
+			respondError(w, apierror.New(http.StatusNotFound, apierror.UserNotFound))
+			return
+		}
+		if resolveErr != nil {
+			respondInternalError(w, resolveErr)
+			return
+		}
+		flag, err = s.flags.SetUser(name, username, *req.Enabled)
+		if err == nil {
+			log.Printf("%s turned feature flag %s %s for %s", admin, name, onOff(*req.Enabled), username)
+		}
+	case isUser && user != "" && !strings.Contains(user, "/") && r.Method == http.MethodDelete:
+		flag, err = s.flags.ClearUser(name, user)
+		if err == nil {
+			log.Printf("%s left feature flag %s to the rollout for %s", admin, name, user)
+		}
+	case rest == "" || isUser:
+		respondMethodNotAllowed(w)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		respondFlagError(w, name, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(flag)
+}
+
+func onOff(enabled bool) string {
+	if enabled {
+		return "on"
+	}
+	return "off"
+}
+
+func respondFlagError(w http.ResponseWriter, name string, err error) {
+	switch {
+	case errors.Is(err, flags.ErrUnknownFlag):
+		respondError(w, apierror.New(http.StatusNotFound, apierror.UnknownFeatureFlag).With("name", name))
+	case errors.Is(err, flags.ErrInvalidRollout):
+		respondError(w, apierror.Invalid(err))
+	default:
+		respondInternalError(w, err)
+	}
+}
@@ -0,0 +1,186 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/auth"
+	"github.com/Chase-Garrett/meadowlark/internal/config"
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+	"github.com/Chase-Garrett/meadowlark/internal/server"
+	"github.com/Chase-Garrett/meadowlark/internal/server/mocks"
+)
+
+// mockServer builds a server around users and a router that records what it is asked to deliver
+func mockServer(t *testing.T, users *mocks.UserStore) (*server.Server, *mocks.MessageRouter) {
+	router := &mocks.MessageRouter{}
+	s, err := server.NewServerWith(&config.Config{MaxBodyBytes: 1 << 20}, users, router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, router
+}
+
+// knownUser answers the lookups every sign-in makes for an account named username with password
+func knownUser(username, password string) *mocks.UserStore {
+	return &mocks.UserStore{
+		LookupLoginFunc: func(identifier string) (string, error) {
+			if identifier != username {
+				return "", auth.ErrInvalidCredentials
+			}
+			return username, nil
+		},
+		VerifyUserFunc: func(_, given string) error {
+			if given != password {
+				return auth.ErrInvalidCredentials
+			}
+			return nil
+		},
+		PasswordResetRequiredFunc: func(string) (bool, error) { return false, nil },
+		TokenVersionFunc:          func(string) (int, error) { return 3, nil },
+	}
+}
+
+func post(handler http.HandlerFunc, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+	return w
+}
+
+func errorCode(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatalf("undecodable error response: %v", err)
+	}
+	return body.Code
+}
+
+func TestLoginIssuesCurrentToken(t *testing.T) {
+	users := knownUser("bob", "hunter22")
+	s, _ := mockServer(t, users)
+
+	w := post(s.HandleLogin, `{"username":"bob","password":"hunter22"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var resp server.LoginResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	claims, err := auth.ParseClaims(resp.Token)
+	if err != nil {
+		t.Fatalf("token doesn't validate: %v", err)
+	}
+	if claims.Username != "bob" || claims.Version != 3 {
+		t.Fatalf("token for %s at version %d, want bob at 3", claims.Username, claims.Version)
+	}
+	if !claims.HasScope(auth.ScopeAccount) {
+		t.Fatalf("login token has scopes %q, want every scope bob can hold", claims.Scope)
+	}
+	if calls := users.Calls(); calls[1].Method != "VerifyUser" || calls[1].Args[1] != "hunter22" {
+		t.Fatalf("password checked with %+v", calls[1])
+	}
+}
+
+func TestLoginRejectsWrongPassword(t *testing.T) {
+	users := knownUser("bob", "hunter22")
+	s, _ := mockServer(t, users)
+
+	w := post(s.HandleLogin, `{"username":"bob","password":"hunter2"}`)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if code := errorCode(t, w); code != apierror.InvalidCredentials {
+		t.Fatalf("error %s, want %s", code, apierror.InvalidCredentials)
+	}
+	for _, call := range users.Calls() {
+		if call.Method == "TokenVersion" {
+			t.Fatal("a token was issued for a wrong password")
+		}
+	}
+}
+
+func TestLoginWantsPasswordReset(t *testing.T) {
+	users := knownUser("bob", "hunter22")
+	users.PasswordResetRequiredFunc = func(string) (bool, error) { return true, nil }
+	s, _ := mockServer(t, users)
+
+	w := post(s.HandleLogin, `{"username":"bob","password":"hunter22"}`)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if code := errorCode(t, w); code != apierror.PasswordResetRequired {
+		t.Fatalf("error %s, want %s", code, apierror.PasswordResetRequired)
+	}
+}
+
+// TestChangePasswordDisconnects checks open connections, authenticated with tokens the change
+// revokes, are closed
+func TestChangePasswordDisconnects(t *testing.T) {
+	users := knownUser("bob", "hunter22")
+	var changed []string
+	users.ChangePasswordFunc = func(username, current, password string) error {
+		if current != "hunter22" {
+			return auth.ErrInvalidCredentials
+		}
+		changed = append(changed, username+":"+password)
+		return nil
+	}
+	s, router := mockServer(t, users)
+	change := func(w http.ResponseWriter, r *http.Request) { s.HandleChangePassword(w, r, "bob") }
+
+	w := post(change, `{"currentPassword":"hunter2","newPassword":"correct horse"}`)
+	if w.Code != http.StatusUnauthorized || len(router.Calls()) != 0 {
+		t.Fatalf("wrong current password: status %d, router calls %+v", w.Code, router.Calls())
+	}
+
+	w = post(change, `{"currentPassword":"hunter22","newPassword":"correct horse"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if len(changed) != 1 || changed[0] != "bob:correct horse" {
+		t.Fatalf("password changes %v", changed)
+	}
+	calls := router.Calls()
+	if len(calls) != 1 || calls[0].Method != "Disconnect" {
+		t.Fatalf("router calls %+v, want one Disconnect", calls)
+	}
+	if calls[0].Args[0] != "bob" || calls[0].Args[1] != protocol.CloseAuthExpired {
+		t.Fatalf("disconnected %v with code %v", calls[0].Args[0], calls[0].Args[1])
+	}
+}
+
+func TestGetUsersPages(t *testing.T) {
+	users := &mocks.UserStore{
+		ListUsersFunc: func(prefix, after string, desc bool, limit int) ([]string, error) {
+			return []string{"bob", "bobby"}, nil
+		},
+	}
+	s, _ := mockServer(t, users)
+
+	w := httptest.NewRecorder()
+	s.HandleGetUsers(w, httptest.NewRequest(http.MethodGet, "/api/users?q=bo&limit=2", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	calls := users.Calls()
+	if len(calls) != 1 || calls[0].Args[0] != "bo" || calls[0].Args[3] != 2 {
+		t.Fatalf("store calls %+v, want ListUsers for prefix bo, 2 at most", calls)
+	}
+	var resp struct {
+		Users []string `json:"users"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(resp.Users, ",") != "bob,bobby" {
+		t.Fatalf("users %v", resp.Users)
+	}
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/history"
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// readHello waits up to timeout for the client's hello, which must be the first frame of
+// every connection, and returns it with the protocol version both sides use
+func readHello(conn *websocket.Conn, timeout time.Duration) (*protocol.Frame, int, *apierror.Error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		// nothing in time, or the client went away, either way there is no hello
+		return nil, 0, apierror.New(http.StatusBadRequest, apierror.HelloRequired)
+	}
+	frame, err := protocol.DecodeFrame(data)
+	if err != nil {
+		return nil, 0, frameError(err.(*protocol.FrameError))
+	}
+	if frame.Type != protocol.TypeHello {
+		return nil, 0, apierror.New(http.StatusBadRequest, apierror.HelloRequired)
+	}
+	version, ok := protocol.NegotiateVersion(frame.Version)
+	if !ok {
+		return nil, 0, apierror.New(http.StatusBadRequest, apierror.UnsupportedVersion).
+			With("min", protocol.MinProtocolVersion).With("max", protocol.ProtocolVersion)
+	}
+	return frame, version, nil
+}
+
+// newSessionID returns a random id for a connection
+func newSessionID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// connectionCapabilities lists the features a connection may use: those enabled on the server,
+// backfill when the server replays missed messages, streams from protocol version 2, batch
+// from version 3, binary from version 4 and send unless the token is read only
+func (s *Server) connectionCapabilities(client *Client) []string {
+	var capabilities []string
+	for feature, enabled := range s.features() {
+		if enabled {
+			capabilities = append(capabilities, feature)
+		}
+	}
+	if s.config.WSBackfillLimit > 0 {
+		capabilities = append(capabilities, "backfill")
+	}
+	if client.version >= protocol.StreamsVersion {
+		capabilities = append(capabilities, "streams")
+	}
+	if client.version >= protocol.BatchVersion {
+		capabilities = append(capabilities, "batch")
+	}
+	if client.version >= protocol.BinaryVersion {
+		capabilities = append(capabilities, "binary")
+	}
+	if client.canSend {
+		capabilities = append(capabilities, "send")
+	}
+	sort.Strings(capabilities)
+	return capabilities
+}
+
+// greet queues the server hello for a client that connected with cursor, before anything the
+// hub sends it, and reports whether the messages after cursor should be replayed. A device
+// without a cursor bootstraps with /api/sync instead, as does one too far behind
+func (s *Server) greet(client *Client, version int, cursor int64) bool {
+	hello := protocol.ServerHello{
+		SessionID:    client.sessionID,
+		Version:      version,
+		Capabilities: s.connectionCapabilities(client),
+		Cursor:       cursor,
+	}
+	pending, latest, err := s.messages.PendingForUser(client.username, cursor)
+	if err != nil {
+		log.Printf("Error counting messages pending for %s: %v", client.username, err)
+	} else {
+		hello.Pending, hello.Cursor = pending, latest
+	}
+	hello.Backfill = cursor > 0 && hello.Pending > 0 && hello.Pending <= s.config.WSBackfillLimit
+	client.send.push(protocol.NewControlMessage(client.username, protocol.EventHello, hello))
+	return hello.Backfill
+}
+
+// backfill replays the stored messages after cursor, then sends backfill_done. The client is
+// registered first, so a message stored meanwhile may arrive twice but never goes missing;
+// clients drop repeats by id
+func (c *Client) backfill(cursor int64, limit int) {
+	envelopes, err := c.messages.ListForUser(c.username, time.Time{}, cursor, limit)
+	if err != nil {
+		log.Printf("Error loading messages to backfill for %s: %v", c.username, err)
+		return
+	}
+	if c.version >= protocol.StreamsVersion {
+		c.backfillStreams(envelopes, cursor)
+		return
+	}
+	for _, env := range envelopes {
+		if !c.send.pushWait(laneBulk, envelopeMessage(env)) {
+			return
+		}
+		cursor = env.ID
+	}
+	c.send.pushWait(laneBulk, protocol.NewControlMessage(c.username, protocol.EventBackfillDone, map[string]interface{}{
+		"count":  len(envelopes),
+		"cursor": cursor,
+	}))
+}
+
+// backfillStreams replays each conversation on its own stream, so a long one doesn't hold up
+// the others, and announces the streams with backfill_done once they are all queued
+func (c *Client) backfillStreams(envelopes []history.Envelope, cursor int64) {
+	var partners []string
+	conversations := make(map[string][]history.Envelope)
+	for _, env := range envelopes {
+		partner := env.Recipient
+		if partner == c.username {
+			partner = env.Sender
+		}
+		if _, ok := conversations[partner]; !ok {
+			partners = append(partners, partner)
+		}
+		conversations[partner] = append(conversations[partner], env)
+		cursor = max(cursor, env.ID)
+	}
+
+	streams := make([]int, 0, len(partners))
+	for _, partner := range partners {
+		conversation := conversations[partner]
+		stream := c.send.openStream()
+		c.send.pushStream(stream, protocol.NewControlMessage(c.username, protocol.EventStreamOpen, map[string]interface{}{
+			"kind":  "backfill",
+			"with":  partner,
+			"count": len(conversation),
+		}))
+		for _, env := range conversation {
+			c.send.pushStream(stream, envelopeMessage(env))
+		}
+		c.send.endStream(stream, protocol.NewControlMessage(c.username, protocol.EventStreamEnd, map[string]interface{}{
+			"count":  len(conversation),
+			"cursor": conversation[len(conversation)-1].ID,
+		}))
+		streams = append(streams, stream)
+	}
+	c.send.pushWait(laneControl, protocol.NewControlMessage(c.username, protocol.EventBackfillDone, map[string]interface{}{
+		"count":   len(envelopes),
+		"cursor":  cursor,
+		"streams": streams,
+	}))
+}
+
+// envelopeMessage turns a stored envelope back into the message that was delivered live
+func envelopeMessage(env history.Envelope) *protocol.Message {
+	msg := &protocol.Message{
+		ID:        env.ID,
+		Seq:       env.Seq,
+		Timestamp: env.CreatedAt.UnixMilli(),
+		ClientID:  env.ClientID,
+		Type:      protocol.TypeChat,
+		Recipient: env.Recipient,
+		Sender:    env.Sender,
+		Content:   env.Content,
+
+		Provenance: env.Provenance,
+		NoForward:  env.NoForward,
+	}
+	// only forwards are stored with a provenance
+	if env.Provenance != nil {
+		msg.Type = protocol.TypeForward
+	}
+	return msg
+}
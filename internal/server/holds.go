@@ -0,0 +1,221 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/auth"
+)
+
+// maxHoldAudit caps a page of the legal hold audit log
+const maxHoldAudit = 500
+
+// HoldRequest defines JSON for POST /api/admin/holds, DELETE /api/admin/holds/{username}
+// and POST /api/admin/holds/{username}/export
+type HoldRequest struct {
+	Username string `json:"username,omitempty"` // placing a hold only, the others name it in the path
+	Reason   string `json:"reason"`             // required, goes to the audit log
+}
+
+// HoldExportHeader is the first line of a legal hold export
+type HoldExportHeader struct {
+	Type       string          `json:"type"` // "header"
+	Format     string          `json:"format"`
+	Version    int             `json:"version"`
+	ExportedBy string          `json:"exportedBy"`
+	ExportedAt time.Time       `json:"exportedAt"`
+	Reason     string          `json:"reason"`
+	Hold       *auth.LegalHold `json:"hold"`
+}
+
+// HoldExportEnd is the last line, an export without it was cut short
+type HoldExportEnd struct {
+	Type     string `json:"type"` // "end"
+	Messages int    `json:"messages"`
+}
+
+// legalHoldEnabled answers legal_hold_disabled unless the server has legal holds turned on
+func (s *Server) legalHoldEnabled(w http.ResponseWriter) bool {
+	if !s.config.LegalHold {
+		respondError(w, apierror.New(http.StatusForbidden, apierror.LegalHoldDisabled))
+		return false
+	}
+	return true
+}
+
+// respondHoldError answers errors from the legal hold storage
+func respondHoldError(w http.ResponseWriter, err error) {
+	switch err {
+	case auth.ErrUserNotFound:
+		respondError(w, apierror.New(http.StatusNotFound, apierror.UserNotFound))
+	case auth.ErrNotHeld:
+		respondError(w, apierror.New(http.StatusNotFound, apierror.NotUnderLegalHold))
+	case auth.ErrHoldReason:
+		respondError(w, apierror.Invalid(err))
+	default:
+		respondInternalError(w, err)
+	}
+}
+
+// HandleHolds lists the legal holds (GET) or places one (POST), admin only
+func (s *Server) HandleHolds(w http.ResponseWriter, r *http.Request, admin string) {
+	if !s.legalHoldEnabled(w) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		holds, err := s.userStorage.Holds()
+		if err != nil {
+			respondInternalError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"holds": holds})
+	case http.MethodPost:
+		var req HoldRequest
+		if err := s.readJSON(w, r, &req); err != nil {
+			respondError(w, err)
+			return
+		}
+		username := req.Username
+		if !auth.IsTombstone(username) {
+			resolved, err := s.userStorage.ResolveUsername(username)
+			if err != nil {
+				respondHoldError(w, err)
+				return
+			}
+			username = resolved
+		}
+		hold, err := s.userStorage.PlaceHold(username, admin, strings.TrimSpace(req.Reason))
+		if err != nil {
+			respondHoldError(w, err)
+			return
+		}
+		log.Printf("Admin %s placed a legal hold on %s", admin, username)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(hold)
+	default:
+		respondMethodNotAllowed(w)
+	}
+}
+
+// HandleHold serves /api/admin/holds/{username}: DELETE releases the hold, POST .../export
+// streams the account's envelopes. GET /api/admin/holds/audit pages through the audit log
+func (s *Server) HandleHold(w http.ResponseWriter, r *http.Request, admin string) {
+	if !s.legalHoldEnabled(w) {
+		return
+	}
+	rest := strings.TrimPrefix(r.URL.Path, "/api/admin/holds/")
+	username, action, _ := strings.Cut(rest, "/")
+	switch {
+	case r.Method == http.MethodGet && rest == "audit":
+		s.handleHoldAudit(w, r)
+	case username == "" || strings.Contains(action, "/") || (action != "" && action != "export"):
+		http.NotFound(w, r)
+	case action == "" && r.Method == http.MethodDelete:
+		var req HoldRequest
+		if err := s.readJSON(w, r, &req); err != nil {
+			respondError(w, err)
+			return
+		}
+		if err := s.userStorage.ReleaseHold(username, admin, strings.TrimSpace(req.Reason)); err != nil {
+			respondHoldError(w, err)
+			return
+		}
+		log.Printf("Admin %s released the legal hold on %s", admin, username)
+		w.WriteHeader(http.StatusNoContent)
+	case action == "export" && r.Method == http.MethodPost:
+		s.handleHoldExport(w, r, admin, username)
+	default:
+		respondMethodNotAllowed(w)
+	}
+}
+
+// handleHoldAudit lists legal hold actions, newest first
+func (s *Server) handleHoldAudit(w http.ResponseWriter, r *http.Request) {
+	limit := pageLimit(r, 50, maxHoldAudit)
+	before, _ := strconv.ParseInt(r.URL.Query().Get("before"), 10, 64)
+	entries, err := s.userStorage.HoldAudit(before, limit)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	resp := map[string]interface{}{"entries": entries}
+	if len(entries) == limit {
+		resp["nextBefore"] = entries[len(entries)-1].ID
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleHoldExport streams every stored envelope a held account sent or received as JSON
+// Lines, oldest first. Content stays encrypted; the export is audited before it starts
+func (s *Server) handleHoldExport(w http.ResponseWriter, r *http.Request, admin, username string) {
+	var req HoldRequest
+	if err := s.readJSON(w, r, &req); err != nil {
+		respondError(w, err)
+		return
+	}
+	reason := strings.TrimSpace(req.Reason)
+	hold, err := s.userStorage.Hold(username)
+	if err != nil {
+		respondHoldError(w, err)
+		return
+	}
+	if err := s.userStorage.RecordHoldExport(username, admin, reason); err != nil {
+		respondHoldError(w, err)
+		return
+	}
+	log.Printf("Admin %s exported the envelopes of %s under legal hold", admin, username)
+
+	liftDeadlines(w)
+	w.Header().Set("Content-Type", "application/jsonl")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "meadowlark-hold-"+username+".jsonl"))
+	w.Header().Set("Cache-Control", "no-store")
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	header := HoldExportHeader{
+		Type:       "header",
+		Format:     "meadowlark-legal-hold",
+		Version:    exportVersion,
+		ExportedBy: admin,
+		ExportedAt: time.Now(),
+		Reason:     reason,
+		Hold:       hold,
+	}
+	if err := enc.Encode(header); err != nil {
+		return
+	}
+
+	end := HoldExportEnd{Type: "end"}
+	// page by id so memory stays bounded however many envelopes the account has
+	for after := int64(0); ; {
+		page, err := s.messages.ListForUser(username, time.Time{}, after, maxMissingMessages)
+		if err != nil {
+			// headers are gone, leaving out the end line tells the reader the export is incomplete
+			log.Printf("Error exporting envelopes of %s under legal hold: %v", username, err)
+			return
+		}
+		for _, env := range page {
+			if err := enc.Encode(exportMessage{Type: "message", Envelope: env}); err != nil {
+				return
+			}
+			after = env.ID
+		}
+		end.Messages += len(page)
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if len(page) < maxMissingMessages {
+			break
+		}
+	}
+	enc.Encode(end)
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/config"
+)
+
+// newHTTPServer applies the timeouts from cfg to a server for handler
+func newHTTPServer(cfg *config.Config, handler http.Handler) *http.Server {
+	if cfg.Verbose {
+		handler = logRequests(handler)
+	}
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+}
+
+// readJSON decodes a request body of at most MaxBodyBytes into v
+func (s *Server) readJSON(w http.ResponseWriter, r *http.Request, v interface{}) *apierror.Error {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, s.config.MaxBodyBytes)).Decode(v)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &tooLarge):
+		return apierror.New(http.StatusRequestEntityTooLarge, apierror.PayloadTooLarge).With("max", tooLarge.Limit)
+	default:
+		return apierror.New(http.StatusBadRequest, apierror.InvalidJSON)
+	}
+}
+
+// liftDeadlines exempts a transfer whose length depends on the client's bandwidth, such as
+// an attachment upload, from the server's read and write timeouts
+func liftDeadlines(w http.ResponseWriter) {
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+}
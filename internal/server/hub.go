@@ -1,6 +1,19 @@
 package server
 
-import "github.com/Chase-Garrett/meadowlark/internal/protocol"
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/auth"
+	"github.com/Chase-Garrett/meadowlark/internal/flags"
+	"github.com/Chase-Garrett/meadowlark/internal/history"
+	"github.com/Chase-Garrett/meadowlark/internal/notifications"
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+	"github.com/Chase-Garrett/meadowlark/internal/rooms"
+)
 
 // hub maintains the active clients and forwards messages
 type Hub struct {
@@ -8,37 +21,421 @@ type Hub struct {
 	register   chan *Client
 	unregister chan *Client
 	forward    chan *protocol.Message
+	broadcast  chan *protocol.Message
+	drain      chan bool
+	disconnect chan disconnectRequest
+	rejected   chan rejectedMessage
+	snapshot   chan chan *HubSnapshot
+	presence   chan presenceQuery
+	stats      chan chan *HubStats
+	active     chan string
+	statuses   chan statusChange
+	quiet      chan dndChange
+
+	messages *history.MessageStorage
+	rooms    *rooms.Storage
+
+	// what happens when a user connects while already connected
+	sessionPolicy string
+	// senders that aren't contacts of the recipient get a generic reason for undelivered messages
+	recipientPrivacy bool
+
+	// holds chat messages that arrive ahead of an earlier sequence number
+	ordering *reorderBuffer
+	// feature flags, nil has them all on
+	flags *flags.Set
+	// last posts of members of rooms in slow mode
+	cooldowns *roomCooldowns
+
+	// while draining, new clients are turned away
+	draining bool
+
+	// messages restored from a snapshot, delivered when their recipient connects
+	held map[string][]*protocol.Message
+	// when each user was last connected, kept across restarts by the snapshot
+	lastSeen map[string]time.Time
+
+	// connections silent this long are shown away, 0 never
+	idleTimeout time.Duration
+	// the status contacts were last told about, for users shown as anything but offline
+	shown map[string]string
+}
+
+// disconnectRequest closes one user's connection, or every connection when username is empty
+type disconnectRequest struct {
+	username string
+	code     int // websocket close code, one of the protocol.Close* constants
+	reason   protocol.CloseReason
+}
+
+// rejectedMessage is a message that will never reach its recipient
+type rejectedMessage struct {
+	message *protocol.Message
+	reason  string
+}
+
+// session policies for a second connection of the same account
+const (
+	SessionPolicyTakeover = "takeover" // close the existing connection
+	SessionPolicyReject   = "reject"   // turn the new connection away
+)
+
+// reorders reports whether message's conversation has the message reordering flag. It is
+// decided per conversation, so both directions agree: a room by its id, a direct conversation
+// when the flag is on for both sides
+func (h *Hub) reorders(message *protocol.Message) bool {
+	if message.Room != "" {
+		return h.flags.Enabled(flagMessageReordering, message.Room)
+	}
+	return h.flags.Enabled(flagMessageReordering, message.Sender) && h.flags.Enabled(flagMessageReordering, message.Recipient)
+}
+
+func NewHub(messages *history.MessageStorage, roomStorage *rooms.Storage, sessionPolicy string, reorderWindow time.Duration) *Hub {
+	h := &Hub{
+		messages:      messages,
+		rooms:         roomStorage,
+		sessionPolicy: sessionPolicy,
+		ordering:      newReorderBuffer(reorderWindow),
+		cooldowns:     newRoomCooldowns(),
+		clients:       make(map[string]*Client),
+		register:      make(chan *Client),
+		unregister:    make(chan *Client),
+		forward:       make(chan *protocol.Message),
+		broadcast:     make(chan *protocol.Message),
+		drain:         make(chan bool),
+		disconnect:    make(chan disconnectRequest),
+		rejected:      make(chan rejectedMessage),
+		snapshot:      make(chan chan *HubSnapshot),
+		presence:      make(chan presenceQuery),
+		stats:         make(chan chan *HubStats),
+		active:        make(chan string),
+		statuses:      make(chan statusChange),
+		quiet:         make(chan dndChange),
+		held:          make(map[string][]*protocol.Message),
+		lastSeen:      make(map[string]time.Time),
+		shown:         make(map[string]string),
+	}
+	h.ordering.start = h.firstUnreleased
+	return h
 }
 
-func NewHub() *Hub {
-	return &Hub{
-		clients:    make(map[string]*Client),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		forward:    make(chan *protocol.Message),
+// firstUnreleased is where the reorder buffer starts a conversation message is the first of
+// it to arrive: the earliest one stored within the reorder window before it, since this process
+// started. It looks at the database, but only once per conversation until it goes idle
+func (h *Hub) firstUnreleased(message *protocol.Message) int64 {
+	since := max(message.Timestamp-h.ordering.window.Milliseconds(), h.ordering.started.UnixMilli())
+	var seq int64
+	var err error
+	if message.Room != "" {
+		seq, err = h.messages.FirstRoomSeqSince(message.Room, since)
+	} else {
+		seq, err = h.messages.FirstSeqSince(message.Sender, message.Recipient, since)
 	}
+	if err != nil {
+		log.Printf("Error finding the first message to reorder: %v", err)
+		return message.Seq
+	}
+	if seq == 0 {
+		return message.Seq
+	}
+	return seq
+}
+
+// Register hands a newly connected client to the hub
+func (h *Hub) Register(client *Client) {
+	h.register <- client
+}
+
+// Unregister removes a client whose connection has ended
+func (h *Hub) Unregister(client *Client) {
+	h.unregister <- client
+}
+
+// Forward routes a message to its recipient or room, queueing it while they are offline
+func (h *Hub) Forward(message *protocol.Message) {
+	h.forward <- message
+}
+
+// Broadcast sends a message to every connected client
+func (h *Hub) Broadcast(message *protocol.Message) {
+	h.broadcast <- message
+}
+
+// Reject records a message that will never reach its recipient and tells the sender
+func (h *Hub) Reject(message *protocol.Message, reason string) {
+	h.rejected <- rejectedMessage{message: message, reason: reason}
+}
+
+// Disconnect closes username's connection, or every connection when username is empty,
+// with code, one of the protocol.Close* constants
+func (h *Hub) Disconnect(username string, code int, reason protocol.CloseReason) {
+	h.disconnect <- disconnectRequest{username: username, code: code, reason: reason}
+}
+
+// SetDraining turns new connections away while draining is true
+func (h *Hub) SetDraining(draining bool) {
+	h.drain <- draining
+}
+
+// Presence reports whether usernames are connected and when they were last seen.
+// It gives up once ctx is done, so a stuck hub can be told apart
+func (h *Hub) Presence(ctx context.Context, usernames []string) ([]Presence, error) {
+	query := presenceQuery{usernames: usernames, reply: make(chan []Presence, 1)}
+	select {
+	case h.presence <- query:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return <-query.reply, nil
+}
+
+// Active tells the hub a connection sent something after being idle
+func (h *Hub) Active(username string) {
+	h.active <- username
+}
+
+// SetStatus applies the presence status username chose to their connection
+func (h *Hub) SetStatus(username, status string) {
+	h.statuses <- statusChange{username: username, status: status}
+}
+
+// SetDoNotDisturb applies username's new do-not-disturb schedule to their connection
+func (h *Hub) SetDoNotDisturb(username string, dnd notifications.DoNotDisturb) {
+	h.quiet <- dndChange{username: username, dnd: dnd}
+}
+
+// Snapshot closes every connection and returns the state to carry across a restart.
+// The hub turns clients away afterwards
+func (h *Hub) Snapshot() *HubSnapshot {
+	reply := make(chan *HubSnapshot)
+	h.snapshot <- reply
+	return <-reply
 }
 
 func (h *Hub) Run() {
+	var reorderTick <-chan time.Time
+	if h.ordering.window > 0 {
+		// held messages wait between window and one and a half windows
+		ticker := time.NewTicker(max(h.ordering.window/2, time.Millisecond))
+		defer ticker.Stop()
+		reorderTick = ticker.C
+	}
+	// users are shown away within a quarter of the idle timeout, and do-not-disturb windows
+	// are followed to within half a minute
+	presenceInterval := 30 * time.Second
+	if h.idleTimeout > 0 {
+		presenceInterval = min(max(h.idleTimeout/4, time.Second), presenceInterval)
+	}
+	presenceTick := time.NewTicker(presenceInterval)
+	defer presenceTick.Stop()
+
 	for {
 		select {
 		case client := <-h.register:
+			if h.draining {
+				// closing send makes writePump close the connection
+				client.send.closeWith(protocol.CloseServerShutdown, protocol.CloseReason{Code: apierror.Maintenance, Retry: true})
+				continue
+			}
+			if existing, ok := h.clients[client.username]; ok && !h.replace(existing, client) {
+				continue
+			}
 			h.clients[client.username] = client
+			if client.status != auth.StatusInvisible {
+				h.lastSeen[client.username] = time.Now()
+			}
+			h.announce(client.username, time.Now())
+			for _, message := range h.held[client.username] {
+				h.deliver(client, message)
+			}
+			delete(h.held, client.username)
 		case client := <-h.unregister:
-			if _, ok := h.clients[client.username]; ok {
-				delete(h.clients, client.username)
-				close(client.send)
+			// a replaced client must not remove the session that took over
+			if h.clients[client.username] == client {
+				h.remove(client)
 			}
+			client.send.close()
 		case message := <-h.forward:
-			// find recipient client and send the message
-			if recipient, ok := h.clients[message.Recipient]; ok {
-				select {
-				case recipient.send <- message:
-				default:
-					close(recipient.send)
-					delete(h.clients, recipient.username)
+			if !h.reorders(message) {
+				h.route(message)
+				continue
+			}
+			for _, ready := range h.ordering.admit(message, time.Now()) {
+				h.route(ready)
+			}
+		case now := <-reorderTick:
+			for _, ready := range h.ordering.expire(now) {
+				h.route(ready)
+			}
+		case now := <-presenceTick.C:
+			for username := range h.clients {
+				h.announce(username, now)
+			}
+		case username := <-h.active:
+			h.announce(username, time.Now())
+		case change := <-h.statuses:
+			h.changeStatus(change)
+		case change := <-h.quiet:
+			if client, ok := h.clients[change.username]; ok {
+				client.dnd = change.dnd
+			}
+			h.announce(change.username, time.Now())
+		case rejected := <-h.rejected:
+			h.deadLetter(rejected.message, rejected.reason)
+		case message := <-h.broadcast:
+			// send a copy to every client, addressed to them
+			for _, client := range h.clients {
+				copied := *message
+				copied.Recipient = client.username
+				h.deliver(client, &copied)
+			}
+		case reply := <-h.snapshot:
+			reply <- h.takeSnapshot()
+		case query := <-h.presence:
+			query.reply <- h.presenceOf(query.usernames)
+		case reply := <-h.stats:
+			reply <- h.takeStats()
+		case draining := <-h.drain:
+			h.draining = draining
+		case req := <-h.disconnect:
+			for username, client := range h.clients {
+				if req.username == "" || req.username == username {
+					client.send.closeWith(req.code, req.reason)
+					h.remove(client)
 				}
 			}
 		}
 	}
 }
+
+// replace applies the session policy when client connects while existing is active,
+// it reports whether client should take the existing client's place
+func (h *Hub) replace(existing, client *Client) bool {
+	if h.sessionPolicy == SessionPolicyReject {
+		apiErr := apierror.New(http.StatusConflict, apierror.AlreadyConnected)
+		client.send.push(protocol.NewControlMessage(client.username, protocol.EventError, apiErr))
+		client.send.closeWith(protocol.CloseAlreadyConnected, protocol.CloseReason{Code: apiErr.Code})
+		return false
+	}
+
+	apiErr := apierror.New(http.StatusConflict, apierror.SignedInElsewhere)
+	existing.send.push(protocol.NewControlMessage(existing.username, protocol.EventSignedInElsewhere, map[string]interface{}{
+		"ip":        client.ip,
+		"userAgent": client.userAgent,
+		"error":     apiErr,
+	}))
+	existing.send.closeWith(protocol.CloseSignedInElsewhere, protocol.CloseReason{Code: apiErr.Code})
+	return true
+}
+
+// route sends a message to its recipient if they are connected
+func (h *Hub) route(message *protocol.Message) {
+	if message.Room != "" {
+		h.fanOut(message)
+		return
+	}
+	if recipient, ok := h.clients[message.Recipient]; ok {
+		if !h.deliver(recipient, message) {
+			h.deadLetter(message, history.ReasonQueueFull)
+		}
+	}
+}
+
+// fanOut sends a room message to every connected member but the sender.
+// Posting rights are checked again here, the sender's role may have changed since readPump
+// stored the message; snapshots are cached so this normally doesn't touch the database
+func (h *Hub) fanOut(message *protocol.Message) {
+	snap, err := h.rooms.Snapshot(message.Room)
+	if err != nil {
+		log.Printf("Error loading room %s: %v", message.Room, err)
+		return
+	}
+	if apiErr := roomPostError(snap, message.Sender); apiErr != nil {
+		if sender, ok := h.clients[message.Sender]; ok {
+			h.deliver(sender, protocol.NewControlMessage(sender.username, protocol.EventError, apiErr))
+		}
+		return
+	}
+	for member := range snap.Members {
+		if member == message.Sender {
+			continue
+		}
+		if client, ok := h.clients[member]; ok {
+			// the member's writePump releases its copy once written
+			copied := protocol.CopyMessage(message)
+			copied.Recipient = member
+			if !h.deliver(client, copied) {
+				copied.Release()
+			}
+		}
+	}
+}
+
+// deliver queues a message for a client, dropping the client if its buffer is full
+func (h *Hub) deliver(client *Client, message *protocol.Message) bool {
+	if !client.send.push(message) {
+		client.send.close()
+		h.remove(client)
+		return false
+	}
+	return true
+}
+
+// deadLetter records a dropped chat message and tells the sender it was not delivered
+func (h *Hub) deadLetter(message *protocol.Message, reason string) {
+	// control messages and location updates were never stored, there's nothing to retry
+	if message.Type == protocol.TypeControl || message.Type == protocol.TypeLocation {
+		return
+	}
+
+	go func(id int64, sender, recipient string) {
+		if err := h.messages.RecordDeadLetter(id, sender, recipient, reason); err != nil {
+			log.Printf("Error recording dead letter: %v", err)
+		}
+	}(message.ID, message.Sender, message.Recipient)
+
+	sender, ok := h.clients[message.Sender]
+	if !ok {
+		return
+	}
+	if !h.recipientPrivacy {
+		h.deliver(sender, undeliverableNotice(message, reason, false))
+		return
+	}
+	// whether the sender may learn why takes a database lookup, made off the hub goroutine
+	go func() {
+		known, err := h.messages.HasReceivedFrom(message.Sender, message.Recipient)
+		if err != nil {
+			log.Printf("Error checking contact: %v", err)
+		}
+		h.forward <- undeliverableNotice(message, reason, !known)
+	}()
+}
+
+// reasonCannotDeliver stands in for the dead letter reason in generic notices
+const reasonCannotDeliver = "cannot_deliver"
+
+// undeliverableNotice tells the sender why message won't be delivered. A generic notice
+// gives the same cannot_deliver for every reason, so senders that aren't contacts of the
+// recipient can't tell an unregistered username from a registered one
+func undeliverableNotice(message *protocol.Message, reason string, generic bool) *protocol.Message {
+	apiErr := apierror.New(http.StatusServiceUnavailable, apierror.QueueFull)
+	switch {
+	case generic:
+		reason = reasonCannotDeliver
+		apiErr = apierror.New(http.StatusBadRequest, apierror.CannotDeliver)
+	case reason == history.ReasonUnknownRecipient:
+		apiErr = apierror.New(http.StatusNotFound, apierror.UnknownRecipient)
+	}
+	data := map[string]interface{}{
+		"messageId": message.ID,
+		"recipient": message.Recipient,
+		"reason":    reason,
+		"error":     apiErr.With("recipient", message.Recipient),
+	}
+	// unknown recipients are turned away before the message is stored, so it has no id yet
+	if message.ClientID != "" {
+		data["clientId"] = message.ClientID
+	}
+	return protocol.NewControlMessage(message.Sender, protocol.EventUndeliverable, data)
+}
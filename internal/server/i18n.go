@@ -0,0 +1,54 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+)
+
+// TranslationBundle is the response for GET /api/i18n/{locale}
+type TranslationBundle struct {
+	Locale   string            `json:"locale"`
+	Messages map[string]string `json:"messages"`
+}
+
+// HandleLocales lists the locales translations are available for
+func (s *Server) HandleLocales(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"default": apierror.DefaultLocale,
+		"locales": apierror.Locales(),
+	})
+}
+
+// HandleTranslations serves the message bundle for a locale such as "es" or "es-MX"
+// missing keys are filled from the default locale so clients always get a complete set
+func (s *Server) HandleTranslations(w http.ResponseWriter, r *http.Request) {
+	requested := strings.TrimPrefix(r.URL.Path, "/api/i18n/")
+	locale, ok := apierror.Match(requested)
+	if !ok {
+		respondError(w, apierror.New(http.StatusNotFound, apierror.LocaleNotFound).With("locale", requested))
+		return
+	}
+
+	data, err := json.Marshal(TranslationBundle{Locale: locale, Messages: apierror.Bundle(locale)})
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/auth"
+)
+
+var identifierHashPattern = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+
+// PhoneRequest defines JSON for POST /api/account/phone
+type PhoneRequest struct {
+	Phone string `json:"phone"` // international format, e.g. +15551234567
+}
+
+// PhoneVerifyRequest defines JSON for POST /api/account/phone/verify
+type PhoneVerifyRequest struct {
+	Code string `json:"code"`
+}
+
+// DiscoverRequest defines JSON for POST /api/contacts/discover
+type DiscoverRequest struct {
+	Hashes []string `json:"hashes"` // hex SHA-256 of normalized phone numbers
+}
+
+// DiscoverMatch is an address book entry found on the server
+type DiscoverMatch struct {
+	Hash     string `json:"hash"`
+	Username string `json:"username"`
+}
+
+// HandlePhone shows, starts verification of, or removes the account phone number
+func (s *Server) HandlePhone(w http.ResponseWriter, r *http.Request, username string) {
+	switch r.Method {
+	case http.MethodGet:
+		phone, err := s.userStorage.Phone(username)
+		if err != nil {
+			respondInternalError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"phone": phone})
+	case http.MethodPost:
+		var req PhoneRequest
+		if err := s.readJSON(w, r, &req); err != nil {
+			respondError(w, err)
+			return
+		}
+		code, err := s.userStorage.StartPhoneVerification(username, req.Phone)
+		if err != nil {
+			respondIdentifierError(w, err)
+			return
+		}
+		phone, _ := auth.NormalizePhone(req.Phone)
+		if err := s.sms.Send(r.Context(), phone, "Your Meadowlark verification code is "+code); err != nil {
+			log.Printf("Error sending verification SMS to %s: %v", username, err)
+			respondError(w, apierror.New(http.StatusBadGateway, apierror.SMSFailed))
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodDelete:
+		if err := s.userStorage.RemovePhone(username); err != nil {
+			respondInternalError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		respondMethodNotAllowed(w)
+	}
+}
+
+// HandlePhoneVerify confirms the code sent by HandlePhone
+func (s *Server) HandlePhoneVerify(w http.ResponseWriter, r *http.Request, username string) {
+	var req PhoneVerifyRequest
+	if err := s.readJSON(w, r, &req); err != nil {
+		respondError(w, err)
+		return
+	}
+	phone, err := s.userStorage.ConfirmPhone(username, req.Code)
+	if err != nil {
+		respondIdentifierError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"phone": phone})
+}
+
+// HandleDiscover reports which hashed address book entries belong to accounts on this server
+// only verified phone numbers are matched, raw numbers never leave the client
+func (s *Server) HandleDiscover(w http.ResponseWriter, r *http.Request, username string) {
+	var req DiscoverRequest
+	if err := s.readJSON(w, r, &req); err != nil {
+		respondError(w, err)
+		return
+	}
+	if len(req.Hashes) > s.config.DiscoveryMaxHashes {
+		respondError(w, apierror.New(http.StatusRequestEntityTooLarge, apierror.TooManyIdentifiers).With("max", s.config.DiscoveryMaxHashes))
+		return
+	}
+	for _, hash := range req.Hashes {
+		if !identifierHashPattern.MatchString(hash) {
+			respondError(w, apierror.New(http.StatusBadRequest, apierror.InvalidRequest).With("detail", "hashes must be hex encoded SHA-256"))
+			return
+		}
+	}
+
+	found, err := s.userStorage.DiscoverByHash(req.Hashes)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	matches := []DiscoverMatch{}
+	for hash, match := range found {
+		if match != username {
+			matches = append(matches, DiscoverMatch{Hash: hash, Username: match})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"matches": matches})
+}
+
+// respondIdentifierError maps auth identifier errors to API errors
+func respondIdentifierError(w http.ResponseWriter, err error) {
+	switch err {
+	case auth.ErrInvalidEmail:
+		respondError(w, apierror.New(http.StatusBadRequest, apierror.InvalidEmail))
+	case auth.ErrEmailTaken:
+		respondError(w, apierror.New(http.StatusConflict, apierror.EmailTaken))
+	case auth.ErrInvalidPhone:
+		respondError(w, apierror.New(http.StatusBadRequest, apierror.InvalidPhone))
+	case auth.ErrPhoneTaken:
+		respondError(w, apierror.New(http.StatusConflict, apierror.PhoneTaken))
+	case auth.ErrVerificationFailed:
+		respondError(w, apierror.New(http.StatusBadRequest, apierror.VerificationFailed))
+	case auth.ErrVerificationWait:
+		respondError(w, apierror.New(http.StatusTooManyRequests, apierror.VerificationWait))
+	default:
+		respondInternalError(w, err)
+	}
+}
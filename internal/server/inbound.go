@@ -0,0 +1,185 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/inbound"
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+	"github.com/Chase-Garrett/meadowlark/internal/rooms"
+)
+
+const maxEmailsPage = 200
+
+// inboundAuthorized checks the webhook secret, sent as a bearer token or, for providers that
+// can't set headers, in ?token=
+func (s *Server) inboundAuthorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.config.InboundEmailToken)) == 1
+}
+
+// firstField returns the first non-empty value among keys, providers name the same field differently
+func firstField(get func(string) string, keys ...string) string {
+	for _, key := range keys {
+		if v := get(key); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// readInboundEmail reads a provider webhook: a form as Mailgun and SendGrid post, or a JSON
+// object with to, from, subject and text as Postmark and most others can be set up to send.
+// Only the plain text part is kept, attachments and HTML are dropped
+func (s *Server) readInboundEmail(w http.ResponseWriter, r *http.Request) (to string, email *inbound.Email, apiErr *apierror.Error) {
+	r.Body = http.MaxBytesReader(w, r.Body, s.config.InboundEmailMaxSize)
+	tooLarge := apierror.New(http.StatusRequestEntityTooLarge, apierror.PayloadTooLarge).With("max", s.config.InboundEmailMaxSize)
+
+	var get func(string) string
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		var fields map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				return "", nil, tooLarge
+			}
+			return "", nil, apierror.New(http.StatusBadRequest, apierror.InvalidJSON)
+		}
+		get = func(key string) string {
+			v, _ := fields[key].(string)
+			return v
+		}
+	case "multipart/form-data", "application/x-www-form-urlencoded":
+		// attachments past the first MiB are spooled to temporary files and removed below
+		err := r.ParseMultipartForm(1 << 20)
+		if err == http.ErrNotMultipart {
+			err = r.ParseForm()
+		}
+		if r.MultipartForm != nil {
+			defer r.MultipartForm.RemoveAll()
+		}
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				return "", nil, tooLarge
+			}
+			return "", nil, apierror.New(http.StatusBadRequest, apierror.InvalidRequest).With("detail", "the form could not be read")
+		}
+		get = r.PostForm.Get
+	default:
+		return "", nil, apierror.New(http.StatusUnsupportedMediaType, apierror.InvalidRequest).With("detail", "send JSON or a form")
+	}
+
+	to = firstField(get, "recipient", "to", "To")
+	email = &inbound.Email{
+		From:    firstField(get, "from", "From", "sender"),
+		Subject: firstField(get, "subject", "Subject"),
+		Text:    firstField(get, "body-plain", "text", "TextBody", "stripped-text"),
+	}
+	if to == "" || email.From == "" {
+		return "", nil, apierror.New(http.StatusBadRequest, apierror.InvalidRequest).With("detail", "to and from are required")
+	}
+	return to, email, nil
+}
+
+// HandleInboundEmail is the mail provider webhook at POST /api/hooks/email. Mail to an address
+// in MEADOWLARK_INBOUND_EMAIL_ROUTES is stored for its user or room and pushed to them as an
+// inbound_email control message
+func (s *Server) HandleInboundEmail(w http.ResponseWriter, r *http.Request) {
+	to, email, apiErr := s.readInboundEmail(w, r)
+	if apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+	address, route, ok := s.inboundRoutes.Match(to)
+	if !ok {
+		respondError(w, apierror.New(http.StatusNotFound, apierror.UnknownInboundAddress))
+		return
+	}
+	if !inbound.SenderAllowed(email.From, s.config.InboundEmailSenders) {
+		log.Printf("Inbound email to %s from %q refused, the sender isn't allowed", address, email.From)
+		respondError(w, apierror.New(http.StatusForbidden, apierror.SenderNotAllowed))
+		return
+	}
+	email.Address = address
+
+	// routes are configuration, so the user or room may have gone since
+	if route.Room != "" {
+		if _, err := s.rooms.Get(route.Room); err != nil {
+			if err == rooms.ErrNotFound {
+				log.Printf("Inbound email route %s points at room %s, which doesn't exist", address, route.Room)
+				respondError(w, apierror.New(http.StatusNotFound, apierror.UnknownInboundAddress))
+				return
+			}
+			respondInternalError(w, err)
+			return
+		}
+	} else {
+		exists, err := s.userStorage.UserExists(route.Username)
+		if err != nil {
+			respondInternalError(w, err)
+			return
+		}
+		if !exists {
+			log.Printf("Inbound email route %s points at user %s, who doesn't exist", address, route.Username)
+			respondError(w, apierror.New(http.StatusNotFound, apierror.UnknownInboundAddress))
+			return
+		}
+	}
+
+	if err := s.inbound.Save(route, email); err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	if route.Room != "" {
+		s.hub.NotifyRoom(route.Room, protocol.EventInboundEmail, email)
+	} else {
+		s.hub.Forward(protocol.NewControlMessage(route.Username, protocol.EventInboundEmail, email))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{"id": email.ID})
+}
+
+// HandleEmails pages through emails bridged to the caller, or with ?room= to a room they are
+// a member of, newest first
+func (s *Server) HandleEmails(w http.ResponseWriter, r *http.Request, username string) {
+	p, apiErr := readPage(r, maxEmailsPage, false)
+	if apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+	var before int64
+	if _, apiErr := p.after(&before); apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+
+	var emails []inbound.Email
+	var err error
+	if roomID := r.URL.Query().Get("room"); roomID != "" {
+		if _, ok := s.roomRole(w, roomID, username, rooms.RoleMember); !ok {
+			return
+		}
+		emails, err = s.inbound.ForRoom(roomID, before, p.Limit)
+	} else {
+		emails, err = s.inbound.ForUser(username, before, p.Limit)
+	}
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	p.respond(w, r, map[string]interface{}{"emails": emails}, len(emails), func() interface{} {
+		return emails[len(emails)-1].ID
+	})
+}
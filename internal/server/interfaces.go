@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/auth"
+	"github.com/Chase-Garrett/meadowlark/internal/notifications"
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+	"github.com/Chase-Garrett/meadowlark/internal/rooms"
+)
+
+//go:generate go run ../../cmd/mockgen -source interfaces.go -out mocks/mocks.go
+
+// UserStore is the account storage handlers and clients use, implemented by
+// auth.UserStorage. Handler tests can substitute the mock in the mocks package
+type UserStore interface {
+	// accounts
+	RegisterNewUser(username, password string, publicKeyBase64 string, email string) error
+	VerifyUser(username, password string) error
+	LookupLogin(identifier string) (string, error)
+	UserExists(username string) (bool, error)
+	CountUsers() (int64, error)
+	CreatedAt(username string) (time.Time, error)
+	ListUsers(prefix, after string, desc bool, limit int) ([]string, error)
+	ListUsersAfter(after string, limit int) ([]string, error)
+	RenameUser(oldName, newName string, grace time.Duration) error
+	ResolveUsername(name string) (string, error)
+	UsernameHistory(username string) ([]auth.Alias, error)
+	Region(username string) (string, error)
+	SetRegion(username, region string) error
+	ChangePassword(username, current, password string) error
+	TokenVersion(username string) (int, error)
+	RequirePasswordReset(username string) error
+	PasswordResetRequired(username string) (bool, error)
+
+	// deletion
+	DeleteAccount(username string, grace time.Duration) (*auth.Tombstone, error)
+	DueTombstones(now time.Time) ([]auth.Tombstone, error)
+	PurgeTombstone(id string) error
+
+	// public keys and the key transparency log
+	GetUserPublicKey(username string) ([]byte, error)
+	UpdatePublicKey(username, publicKeyBase64 string) error
+	ListPublicKeysAfter(after string, limit int) ([]auth.UserKey, error)
+	KeyLogHead() (auth.KeyLogHead, error)
+	KeyLogAfter(after int64, limit int) ([]auth.KeyLogEntry, error)
+	KeyProof(username string, head int64) (*auth.KeyProof, error)
+
+	// phone numbers and email addresses
+	Phone(username string) (string, error)
+	StartPhoneVerification(username, phone string) (string, error)
+	ConfirmPhone(username, code string) (string, error)
+	RemovePhone(username string) error
+	DiscoverByHash(hashes []string) (map[string]string, error)
+	Email(username string) (string, bool, error)
+	StartEmailVerification(username, email string) (string, error)
+	ConfirmEmail(username, code string) (string, error)
+	RemoveEmail(username string) error
+
+	// one-time recovery codes standing in for a passkey
+	GenerateRecoveryCodes(username string) ([]string, error)
+	UseRecoveryCode(username, code string) (int, error)
+	RecoveryCodesLeft(username string) (int, error)
+
+	// legal holds and their audit log
+	PlaceHold(username, admin, reason string) (*auth.LegalHold, error)
+	ReleaseHold(username, admin, reason string) error
+	Hold(username string) (*auth.LegalHold, error)
+	Holds() ([]auth.LegalHold, error)
+	RecordHoldExport(username, admin, reason string) error
+	HoldAudit(beforeID int64, limit int) ([]auth.HoldAuditEntry, error)
+
+	// presence status the user chose
+	Status(username string) (string, error)
+	SetStatus(username, status string) error
+
+	// DB is shared with the other storage, nil when there is no database
+	DB() *sql.DB
+}
+
+// MessageRouter delivers messages and events to connected clients, implemented by Hub
+type MessageRouter interface {
+	Register(client *Client)
+	Unregister(client *Client)
+	Forward(message *protocol.Message)
+	Broadcast(message *protocol.Message)
+	Reject(message *protocol.Message, reason string)
+	Disconnect(username string, code int, reason protocol.CloseReason)
+	SetDraining(draining bool)
+	Presence(ctx context.Context, usernames []string) ([]Presence, error)
+	Stats(ctx context.Context) (*HubStats, error)
+	Snapshot() *HubSnapshot
+
+	// presence: a connection sent something after being idle, or its user chose a status
+	Active(username string)
+	SetStatus(username, status string)
+	SetDoNotDisturb(username string, dnd notifications.DoNotDisturb)
+
+	// ClaimRoomPost applies a room's slow mode, returning how long username must wait
+	// or 0 when the post is allowed and recorded
+	ClaimRoomPost(snap *rooms.Snapshot, username string) time.Duration
+
+	// room events, sent to every member
+	NotifyRoom(roomID, event string, data interface{})
+	NotifyRoomUpdated(roomID, by string)
+	NotifyRoomMember(roomID, username, action, by string, extra map[string]interface{})
+	NotifyRoomModerators(roomID, event string, data interface{})
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// QueueDepth counts the messages waiting on a client's send lanes
+type QueueDepth struct {
+	Control int `json:"control"`
+	Content int `json:"content"`
+	Bulk    int `json:"bulk"`
+}
+
+func (d QueueDepth) total() int {
+	return d.Control + d.Content + d.Bulk
+}
+
+// ClientStats is one connected client as the hub sees it
+type ClientStats struct {
+	Username string     `json:"username"`
+	Queued   QueueDepth `json:"queued"`
+}
+
+// HubStats is a consistent view of the hub, taken on the hub goroutine
+type HubStats struct {
+	Connected  int           `json:"connected"`
+	Draining   bool          `json:"draining"`
+	Held       int           `json:"held"`       // messages restored from a snapshot waiting for their recipient
+	Reordering int           `json:"reordering"` // chat messages waiting for an earlier sequence number
+	Queued     QueueDepth    `json:"queued"`     // summed over every client
+	Clients    []ClientStats `json:"clients"`
+}
+
+// Usernames lists the connected users in alphabetical order
+func (s *HubStats) Usernames() []string {
+	usernames := make([]string, len(s.Clients))
+	for i, c := range s.Clients {
+		usernames[i] = c.Username
+	}
+	return usernames
+}
+
+// maximum number of clients GET /api/admin/hub lists
+const maxHubClientsPage = 500
+
+// Stats reports the connected clients and their queue depths. The hub goroutine answers,
+// so the result never races with it; it gives up once ctx is done like Presence
+func (h *Hub) Stats(ctx context.Context) (*HubStats, error) {
+	reply := make(chan *HubStats, 1)
+	select {
+	case h.stats <- reply:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return <-reply, nil
+}
+
+// takeStats collects the hub's state, called from the hub goroutine
+func (h *Hub) takeStats() *HubStats {
+	stats := &HubStats{
+		Connected: len(h.clients),
+		Draining:  h.draining,
+		Clients:   make([]ClientStats, 0, len(h.clients)),
+	}
+	for _, held := range h.held {
+		stats.Held += len(held)
+	}
+	stats.Reordering = h.ordering.held()
+	for username, client := range h.clients {
+		// lanes are channels, their length can be read while writePump drains them
+		depth := QueueDepth{
+			Control: len(client.send.lanes[laneControl]),
+			Content: len(client.send.lanes[laneContent]),
+			Bulk:    len(client.send.lanes[laneBulk]),
+		}
+		stats.Queued.Control += depth.Control
+		stats.Queued.Content += depth.Content
+		stats.Queued.Bulk += depth.Bulk
+		stats.Clients = append(stats.Clients, ClientStats{Username: username, Queued: depth})
+	}
+	sort.Slice(stats.Clients, func(i, j int) bool { return stats.Clients[i].Username < stats.Clients[j].Username })
+	return stats
+}
+
+// HandleAdminHub shows the hub's state: connected clients, held and reordered messages and
+// send queue depths, with the ?limit= clients with the most queued messages first (admin only)
+func (s *Server) HandleAdminHub(w http.ResponseWriter, r *http.Request) {
+	stats, err := s.hub.Stats(r.Context())
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	sort.SliceStable(stats.Clients, func(i, j int) bool {
+		return stats.Clients[i].Queued.total() > stats.Clients[j].Queued.total()
+	})
+	if limit := pageLimit(r, min(defaultPageSize, maxHubClientsPage), maxHubClientsPage); len(stats.Clients) > limit {
+		stats.Clients = stats.Clients[:limit]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// hubMetricsTimeout bounds how long the metrics endpoint waits for the hub
+const hubMetricsTimeout = time.Second
+
+// writeHubMetrics adds the hub's gauges to the metrics endpoint, nothing if the hub doesn't answer
+func (s *Server) writeHubMetrics(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), hubMetricsTimeout)
+	defer cancel()
+	stats, err := s.hub.Stats(ctx)
+	if err != nil {
+		return
+	}
+	writeMetric(w, "meadowlark_hub_clients", "gauge", "Clients registered with the hub.")
+	fmt.Fprintf(w, "meadowlark_hub_clients %d\n", stats.Connected)
+	writeMetric(w, "meadowlark_hub_queued_messages", "gauge", "Messages waiting in client send queues, by lane.")
+	fmt.Fprintf(w, "meadowlark_hub_queued_messages{lane=\"control\"} %d\n", stats.Queued.Control)
+	fmt.Fprintf(w, "meadowlark_hub_queued_messages{lane=\"content\"} %d\n", stats.Queued.Content)
+	fmt.Fprintf(w, "meadowlark_hub_queued_messages{lane=\"bulk\"} %d\n", stats.Queued.Bulk)
+	writeMetric(w, "meadowlark_hub_held_messages", "gauge", "Messages restored from a snapshot waiting for their recipient to connect.")
+	fmt.Fprintf(w, "meadowlark_hub_held_messages %d\n", stats.Held)
+	writeMetric(w, "meadowlark_hub_reordering_messages", "gauge", "Chat messages held until an earlier sequence number arrives.")
+	fmt.Fprintf(w, "meadowlark_hub_reordering_messages %d\n", stats.Reordering)
+	draining := 0
+	if stats.Draining {
+		draining = 1
+	}
+	writeMetric(w, "meadowlark_hub_draining", "gauge", "1 while new connections are turned away.")
+	fmt.Fprintf(w, "meadowlark_hub_draining %d\n", draining)
+}
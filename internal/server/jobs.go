@@ -0,0 +1,102 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/jobs"
+)
+
+// scheduleJobs adds the server's background work to its scheduler. Everything changing the
+// shared database runs on one instance at a time; stats are counted in each instance's memory,
+// so every instance flushes its own
+func (s *Server) scheduleJobs() {
+	cfg := s.config
+	s.jobs.Add(jobs.Job{Name: "retention", Interval: cfg.RetentionInterval, Run: func(time.Time) error {
+		report, err := s.messages.Prune(cfg.Retention, s.plan.Retention, false)
+		if err != nil {
+			return err
+		}
+		released, err := s.releaseAttachments(report.ExpiredAttachments)
+		if report.Messages > 0 || report.RoomMessages > 0 || released > 0 {
+			log.Printf("Retention pruned %d messages, %d room messages and %d attachments", report.Messages, report.RoomMessages, released)
+		}
+		return err
+	}})
+	if cfg.ConnectionLogRetention > 0 {
+		s.jobs.Add(jobs.Job{Name: "connection_events", Interval: cfg.RetentionInterval, Run: func(time.Time) error {
+			n, err := s.sessions.Prune(cfg.ConnectionLogRetention)
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				log.Printf("Pruned %d connection events", n)
+			}
+			return nil
+		}})
+	}
+	s.jobs.Add(jobs.Job{Name: "stats_flush", Interval: cfg.StatsFlushInterval, Local: true, Run: func(time.Time) error {
+		return s.stats.Flush()
+	}})
+	s.jobs.Add(jobs.Job{Name: "feature_flags", Interval: cfg.FeatureFlagsRefresh, Local: true, Run: func(time.Time) error {
+		return s.flags.Reload()
+	}})
+	s.jobs.Add(jobs.Job{Name: "tombstone_purge", Interval: cfg.RetentionInterval, Run: s.purgeTombstones})
+	s.jobs.Add(jobs.Job{Name: "blob_collection", Interval: cfg.RetentionInterval, Run: s.collectBlobs})
+	s.jobs.Add(jobs.Job{Name: "digests", Interval: cfg.DigestInterval, Run: s.sendDigests})
+	s.jobs.Add(jobs.Job{Name: "poll_deadlines", Interval: pollCloseInterval, Run: s.closeDuePolls})
+	if s.billing != nil {
+		s.jobs.Add(jobs.Job{Name: "billing_events", Interval: cfg.BillingInterval, Run: s.flushBilling})
+		s.jobs.Add(jobs.Job{Name: "billing_usage", Interval: cfg.BillingUsageInterval, Run: s.reportUsage})
+	}
+	if cfg.RoomArchives {
+		routes := &archiveRoutes{inFlight: make(map[string]bool)}
+		s.jobs.Add(jobs.Job{Name: "room_archives", Interval: cfg.RoomArchiveInterval, Run: func(now time.Time) error {
+			return s.deliverRoomArchives(now, routes)
+		}})
+	}
+	if cfg.RoomExports {
+		routes := &archiveRoutes{inFlight: make(map[string]bool)}
+		s.jobs.Add(jobs.Job{Name: "room_exports", Interval: cfg.RoomExportInterval, Run: func(now time.Time) error {
+			return s.runRoomExports(now, routes)
+		}})
+	}
+}
+
+// writeJobMetrics adds each background job's runs, failures and timings to the metrics endpoint
+func (s *Server) writeJobMetrics(w io.Writer) {
+	all := s.jobs.Stats()
+	writeMetric(w, "meadowlark_job_runs_total", "counter", "Background job runs since startup, by job and result.")
+	for _, job := range all {
+		fmt.Fprintf(w, "meadowlark_job_runs_total{job=%q,result=\"success\"} %d\n", job.Name, job.Runs-job.Failures)
+		fmt.Fprintf(w, "meadowlark_job_runs_total{job=%q,result=\"failure\"} %d\n", job.Name, job.Failures)
+	}
+	writeMetric(w, "meadowlark_job_skipped_total", "counter", "Background job runs left to another instance holding the job's lease.")
+	for _, job := range all {
+		fmt.Fprintf(w, "meadowlark_job_skipped_total{job=%q} %d\n", job.Name, job.Skipped)
+	}
+	writeMetric(w, "meadowlark_job_duration_seconds_total", "counter", "Time spent running background jobs since startup.")
+	for _, job := range all {
+		fmt.Fprintf(w, "meadowlark_job_duration_seconds_total{job=%q} %g\n", job.Name, job.Duration.Seconds())
+	}
+	writeMetric(w, "meadowlark_job_interval_seconds", "gauge", "How often each background job runs, before jitter.")
+	for _, job := range all {
+		fmt.Fprintf(w, "meadowlark_job_interval_seconds{job=%q} %g\n", job.Name, job.Interval.Seconds())
+	}
+	writeMetric(w, "meadowlark_job_running", "gauge", "1 while a background job is running on this instance.")
+	for _, job := range all {
+		running := 0
+		if job.Running {
+			running = 1
+		}
+		fmt.Fprintf(w, "meadowlark_job_running{job=%q} %d\n", job.Name, running)
+	}
+	writeMetric(w, "meadowlark_job_last_success_timestamp_seconds", "gauge", "Unix time the latest successful run of a background job finished on this instance.")
+	for _, job := range all {
+		if !job.LastSuccess.IsZero() {
+			fmt.Fprintf(w, "meadowlark_job_last_success_timestamp_seconds{job=%q} %d\n", job.Name, job.LastSuccess.Unix())
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/auth"
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+)
+
+const maxKeyLogPage = 500
+
+// PublicKeyRequest defines JSON for PUT /api/account/key
+type PublicKeyRequest struct {
+	PublicKey string `json:"publicKey"`
+}
+
+// HandleKeyLog pages through the key transparency log so anyone can audit it.
+// The log only holds public keys, which /keys/ serves without authentication anyway
+func (s *Server) HandleKeyLog(w http.ResponseWriter, r *http.Request) {
+	limit := pageLimit(r, 100, maxKeyLogPage)
+	after, _ := strconv.ParseInt(r.URL.Query().Get("after"), 10, 64)
+
+	// read the head first, so it never lags behind the entries returned
+	head, err := s.userStorage.KeyLogHead()
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	entries, err := s.userStorage.KeyLogAfter(after, limit)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	resp := map[string]interface{}{"entries": entries, "head": head}
+	if len(entries) == limit {
+		resp["nextAfter"] = entries[len(entries)-1].Seq
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// HandleKeyLogHead serves the current size and hash of the key log
+func (s *Server) HandleKeyLogHead(w http.ResponseWriter, r *http.Request) {
+	head, err := s.userStorage.KeyLogHead()
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(head)
+}
+
+// HandleKeyProof serves the latest key log entry for a user with the hashes linking it to a log head
+func (s *Server) HandleKeyProof(w http.ResponseWriter, r *http.Request) {
+	head, err := strconv.ParseInt(r.URL.Query().Get("head"), 10, 64)
+	if r.URL.Query().Get("head") == "" {
+		head, err = 0, nil
+	}
+	if err != nil || head < 0 {
+		respondError(w, apierror.New(http.StatusBadRequest, apierror.InvalidRequest))
+		return
+	}
+
+	username, err := s.userStorage.ResolveUsername(strings.TrimPrefix(r.URL.Path, "/api/keylog/proof/"))
+	var proof *auth.KeyProof
+	if err == nil {
+		proof, err = s.userStorage.KeyProof(username, head)
+	}
+	switch err {
+	case nil:
+	case auth.ErrUserNotFound:
+		respondError(w, apierror.New(http.StatusNotFound, apierror.UserNotFound))
+		return
+	case auth.ErrNoPublicKey:
+		respondError(w, apierror.New(http.StatusNotFound, apierror.PublicKeyMissing))
+		return
+	case auth.ErrUnknownLogHead:
+		respondError(w, apierror.New(http.StatusNotFound, apierror.UnknownLogHead).With("head", head))
+		return
+	default:
+		respondInternalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(proof)
+}
+
+// HandleAccountKey replaces the caller's public key, logging the rotation and telling contacts
+func (s *Server) HandleAccountKey(w http.ResponseWriter, r *http.Request, username string) {
+	if r.Method != http.MethodPut {
+		respondMethodNotAllowed(w)
+		return
+	}
+	var req PublicKeyRequest
+	if err := s.readJSON(w, r, &req); err != nil {
+		respondError(w, err)
+		return
+	}
+
+	switch err := s.userStorage.UpdatePublicKey(username, req.PublicKey); err {
+	case nil:
+	case auth.ErrInvalidPublicKey:
+		respondError(w, apierror.New(http.StatusBadRequest, apierror.InvalidPublicKey))
+		return
+	case auth.ErrUserNotFound:
+		respondError(w, apierror.New(http.StatusNotFound, apierror.UserNotFound))
+		return
+	default:
+		respondInternalError(w, err)
+		return
+	}
+	head, err := s.userStorage.KeyLogHead()
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	log.Printf("User %s changed their public key", username)
+
+	changed := map[string]interface{}{"username": username, "head": head}
+	contacts, err := s.messages.Correspondents(username)
+	if err != nil {
+		log.Printf("Error listing contacts of %s: %v", username, err)
+	}
+	for _, contact := range contacts {
+		s.hub.Forward(protocol.NewControlMessage(contact, protocol.EventKeyChanged, changed))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(changed)
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+)
+
+// seconds a client turned away by a connection limit should wait before reconnecting
+const connectionRetryAfter = 60
+
+// connectionLimiter caps simultaneous websocket connections per account and per source IP
+type connectionLimiter struct {
+	mu         sync.Mutex
+	perAccount int // 0 means unlimited
+	perIP      int // 0 means unlimited
+	accounts   map[string]int
+	ips        map[string]int
+}
+
+func newConnectionLimiter(perAccount, perIP int) *connectionLimiter {
+	return &connectionLimiter{
+		perAccount: perAccount,
+		perIP:      perIP,
+		accounts:   make(map[string]int),
+		ips:        make(map[string]int),
+	}
+}
+
+// acquire reserves a connection slot, returning a release func or a reason for rejection
+func (l *connectionLimiter) acquire(username, ip string) (func(), string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.perAccount > 0 && l.accounts[username] >= l.perAccount {
+		return nil, "too many connections for this account"
+	}
+	if l.perIP > 0 && ip != onionClientIP && l.ips[ip] >= l.perIP {
+		return nil, "too many connections from this address"
+	}
+	l.accounts[username]++
+	l.ips[ip]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { l.release(username, ip) })
+	}, ""
+}
+
+// counts returns the number of open connections, distinct accounts and distinct addresses
+func (l *connectionLimiter) counts() (connections, accounts, addresses int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, n := range l.accounts {
+		connections += n
+	}
+	return connections, len(l.accounts), len(l.ips)
+}
+
+func (l *connectionLimiter) release(username, ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.accounts[username]--; l.accounts[username] <= 0 {
+		delete(l.accounts, username)
+	}
+	if l.ips[ip]--; l.ips[ip] <= 0 {
+		delete(l.ips, ip)
+	}
+}
+
+// clientIP returns the address a request came from, looking past trusted proxies
+func (s *Server) clientIP(r *http.Request) string {
+	if isOnion(r) {
+		return onionClientIP
+	}
+	return s.proxies.clientIP(r)
+}
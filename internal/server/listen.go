@@ -0,0 +1,175 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/config"
+)
+
+// listenFDsStart is the first file descriptor systemd passes with socket activation
+const listenFDsStart = 3
+
+type localSocketContextKey struct{}
+
+// isLocalSocket reports whether r arrived on a unix socket, from a process on this host
+func isLocalSocket(r *http.Request) bool {
+	local, _ := r.Context().Value(localSocketContextKey{}).(bool)
+	return local
+}
+
+// tagLocalSocket is the http.Server ConnContext marking connections accepted on a unix socket
+func tagLocalSocket(ctx context.Context, conn net.Conn) context.Context {
+	if conn.LocalAddr().Network() == "unix" {
+		return context.WithValue(ctx, localSocketContextKey{}, true)
+	}
+	return ctx
+}
+
+// listen opens the sockets the HTTP server accepts connections on: those handed over by
+// systemd socket activation when there are any, otherwise cfg.Addr
+func listen(cfg *config.Config) ([]net.Listener, error) {
+	activated, err := systemdListeners()
+	if err != nil || len(activated) > 0 {
+		return activated, err
+	}
+	if path, ok := strings.CutPrefix(cfg.Addr, "unix:"); ok {
+		listener, err := listenUnix(path, cfg.SocketMode)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{listener}, nil
+	}
+	listener, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	return []net.Listener{listener}, nil
+}
+
+// listenUnix listens on a unix socket at path, replacing one left behind by an unclean exit
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		// a socket nobody answers on is stale, one that answers belongs to a running server
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// systemdListeners takes the sockets passed through LISTEN_FDS, none when the process
+// wasn't socket activated. The variables are cleared so child processes don't inherit them
+func systemdListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]net.Listener, 0, count)
+	for i := 0; i < count; i++ {
+		fd := listenFDsStart + i
+		syscall.CloseOnExec(fd)
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		file := os.NewFile(uintptr(fd), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("socket %s from systemd: %v", name, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// sdNotify sends a state such as "READY=1" to the service manager, a no-op when not
+// started by systemd with Type=notify
+func sdNotify(state string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return
+	}
+	// a leading @ names a socket in the abstract namespace
+	if strings.HasPrefix(addr, "@") {
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		log.Printf("Error notifying systemd: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Printf("Error notifying systemd: %v", err)
+	}
+}
+
+// runWatchdog pings systemd at half the WatchdogSec interval for as long as the hub
+// answers, so a stuck hub gets the service restarted
+func (s *Server) runWatchdog() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid, err := strconv.Atoi(os.Getenv("WATCHDOG_PID")); err == nil && pid != os.Getpid() {
+		return
+	}
+	interval := time.Duration(usec) * time.Microsecond / 2
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := s.pingHub(interval); err != nil {
+			log.Printf("Skipping watchdog ping: %v", err)
+			continue
+		}
+		sdNotify("WATCHDOG=1")
+	}
+}
+
+// pingHub checks that the hub goroutine is still handling requests
+func (s *Server) pingHub(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if _, err := s.hub.Presence(ctx, nil); err != nil {
+		return errors.New("hub is not responding")
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/auth"
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+)
+
+// LocationShareRequest defines JSON for POST /api/location/shares
+type LocationShareRequest struct {
+	Recipient string `json:"recipient"`
+	Minutes   int    `json:"minutes"` // how long the share runs
+}
+
+// LocationShare is a live location share as its two sides see it
+type LocationShare struct {
+	Sender    string    `json:"sender"`
+	Recipient string    `json:"recipient"`
+	StartedAt time.Time `json:"startedAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type locationKey struct {
+	sender, recipient string
+}
+
+type locationShare struct {
+	LocationShare
+	lastUpdate time.Time
+	timer      *time.Timer
+}
+
+// locationShares tracks live location shares in memory. The server never sees a location, it
+// only decides how long updates are relayed: past its expiry or once stopped, a share's frames
+// are refused. Shares don't survive a restart
+type locationShares struct {
+	hub         MessageRouter
+	maxDuration time.Duration
+	minInterval time.Duration
+	perHour     int
+
+	mu      sync.Mutex
+	shares  map[locationKey]*locationShare
+	started map[string][]time.Time // when each user started shares in the last hour
+}
+
+func newLocationShares(hub MessageRouter, maxDuration, minInterval time.Duration, perHour int) *locationShares {
+	return &locationShares{
+		hub:         hub,
+		maxDuration: maxDuration,
+		minInterval: minInterval,
+		perHour:     perHour,
+		shares:      make(map[locationKey]*locationShare),
+		started:     make(map[string][]time.Time),
+	}
+}
+
+// start begins or extends sender's share with recipient for d and tells both of them
+func (l *locationShares) start(sender, recipient string, d time.Duration) (LocationShare, *apierror.Error) {
+	now := time.Now()
+	l.mu.Lock()
+	recent := l.started[sender][:0]
+	for _, t := range l.started[sender] {
+		if now.Sub(t) < time.Hour {
+			recent = append(recent, t)
+		}
+	}
+	l.started[sender] = recent
+	if l.perHour > 0 && len(recent) >= l.perHour {
+		l.mu.Unlock()
+		retryAfter := int64((time.Hour - now.Sub(recent[0]) + time.Second - 1) / time.Second)
+		return LocationShare{}, apierror.New(http.StatusTooManyRequests, apierror.TooManyLocationShares).
+			With("max", l.perHour).With("retryAfter", retryAfter)
+	}
+	l.started[sender] = append(recent, now)
+
+	key := locationKey{sender, recipient}
+	if old, ok := l.shares[key]; ok {
+		old.timer.Stop()
+	}
+	share := &locationShare{LocationShare: LocationShare{
+		Sender:    sender,
+		Recipient: recipient,
+		StartedAt: now,
+		ExpiresAt: now.Add(d),
+	}}
+	share.timer = time.AfterFunc(d, func() { l.end(key, share, protocol.LocationShareExpired, "") })
+	l.shares[key] = share
+	l.mu.Unlock()
+
+	l.notify(share.LocationShare, protocol.LocationShareStarted, sender)
+	return share.LocationShare, nil
+}
+
+// stop ends sender's share with recipient early, by is whoever ended it
+func (l *locationShares) stop(sender, recipient, by string) bool {
+	l.mu.Lock()
+	share, ok := l.shares[locationKey{sender, recipient}]
+	l.mu.Unlock()
+	if !ok {
+		return false
+	}
+	return l.end(locationKey{sender, recipient}, share, protocol.LocationShareStopped, by)
+}
+
+// end removes share if it is still the current one for key and tells both sides
+func (l *locationShares) end(key locationKey, share *locationShare, action, by string) bool {
+	l.mu.Lock()
+	if l.shares[key] != share {
+		l.mu.Unlock()
+		return false
+	}
+	delete(l.shares, key)
+	share.timer.Stop()
+	l.mu.Unlock()
+
+	l.notify(share.LocationShare, action, by)
+	return true
+}
+
+func (l *locationShares) notify(share LocationShare, action, by string) {
+	data := map[string]interface{}{"action": action, "share": share}
+	if by != "" {
+		data["by"] = by
+	}
+	l.hub.Forward(protocol.NewControlMessage(share.Sender, protocol.EventLocationShare, data))
+	l.hub.Forward(protocol.NewControlMessage(share.Recipient, protocol.EventLocationShare, data))
+}
+
+// claim checks sender may relay an update to recipient now and records it, returning an
+// error when there is no live share or the last update was too recent
+func (l *locationShares) claim(sender, recipient string, now time.Time) *apierror.Error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	share, ok := l.shares[locationKey{sender, recipient}]
+	if !ok || !now.Before(share.ExpiresAt) {
+		return apierror.New(http.StatusNotFound, apierror.LocationShareNotFound).With("user", recipient)
+	}
+	if wait := l.minInterval - now.Sub(share.lastUpdate); wait > 0 {
+		return apierror.New(http.StatusTooManyRequests, apierror.LocationTooFrequent).
+			With("recipient", recipient).With("retryAfterMs", wait.Milliseconds())
+	}
+	share.lastUpdate = now
+	return nil
+}
+
+// list returns the shares username sends or receives, soonest to expire first
+func (l *locationShares) list(username string) []LocationShare {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	shares := []LocationShare{}
+	for key, share := range l.shares {
+		if key.sender == username || key.recipient == username {
+			shares = append(shares, share.LocationShare)
+		}
+	}
+	sort.Slice(shares, func(i, j int) bool { return shares[i].ExpiresAt.Before(shares[j].ExpiresAt) })
+	return shares
+}
+
+// relayLocation passes a live location update to its recipient while the sender's share with
+// them lasts. Updates are dropped when the recipient is offline, a location is only worth
+// anything live
+func (c *Client) relayLocation(frame *protocol.Frame) {
+	if !c.flags.Enabled(flagLiveLocation, c.username) {
+		c.sendError(apierror.New(http.StatusForbidden, apierror.FeatureDisabled).With("feature", flagLiveLocation))
+		return
+	}
+	recipient, err := c.users.ResolveUsername(frame.Recipient)
+	if err != nil {
+		recipient = frame.Recipient
+	}
+	if apiErr := c.locations.claim(c.username, recipient, time.Now()); apiErr != nil {
+		c.sendError(apiErr)
+		return
+	}
+	c.hub.Forward(&protocol.Message{
+		Type:      protocol.TypeLocation,
+		Timestamp: time.Now().UnixMilli(),
+		Recipient: recipient,
+		Sender:    c.username,
+		Content:   frame.Content,
+	})
+}
+
+// HandleLocationShares lists (GET) and starts (POST) the caller's live location shares at
+// /api/location/shares, and stops one at /api/location/shares/{username}: the caller's share
+// with them, or with ?incoming=true theirs with the caller
+func (s *Server) HandleLocationShares(w http.ResponseWriter, r *http.Request, username string) {
+	other := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/location/shares"), "/")
+	switch {
+	case other == "" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"shares": s.locations.list(username)})
+	case other == "" && r.Method == http.MethodPost:
+		if !s.requireFlag(w, flagLiveLocation, username) {
+			return
+		}
+		var req LocationShareRequest
+		if err := s.readJSON(w, r, &req); err != nil {
+			respondError(w, err)
+			return
+		}
+		d := time.Duration(req.Minutes) * time.Minute
+		if d <= 0 || d > s.config.LocationMaxDuration {
+			respondError(w, apierror.New(http.StatusBadRequest, apierror.InvalidLocationDuration).
+				With("max", int(s.config.LocationMaxDuration/time.Minute)))
+			return
+		}
+		recipient, err := s.userStorage.ResolveUsername(req.Recipient)
+		if err == auth.ErrUserNotFound || recipient == username {
+			respondError(w, apierror.New(http.StatusNotFound, apierror.UnknownRecipient).With("recipient", req.Recipient))
+			return
+		}
+		if err != nil {
+			respondInternalError(w, err)
+			return
+		}
+		share, apiErr := s.locations.start(username, recipient, d)
+		if apiErr != nil {
+			respondError(w, apiErr)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(share)
+	case other != "" && r.Method == http.MethodDelete:
+		sender, recipient := username, other
+		if r.URL.Query().Get("incoming") == "true" {
+			sender, recipient = other, username
+		}
+		if !s.locations.stop(sender, recipient, username) {
+			respondError(w, apierror.New(http.StatusNotFound, apierror.LocationShareNotFound).With("user", other))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		respondMethodNotAllowed(w)
+	}
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+)
+
+// maintenanceState tracks whether the server is refusing new sessions
+type maintenanceState struct {
+	mu         sync.RWMutex
+	enabled    bool
+	message    string
+	since      time.Time
+	retryAfter time.Duration
+	drainTimer *time.Timer
+}
+
+// MaintenanceRequest defines JSON for POST /api/admin/maintenance
+type MaintenanceRequest struct {
+	Enabled             bool   `json:"enabled"`
+	Message             string `json:"message"`
+	RetryAfterSeconds   int    `json:"retryAfterSeconds"`   // optional, defaults to config
+	DrainTimeoutSeconds int    `json:"drainTimeoutSeconds"` // optional, defaults to config
+}
+
+// MaintenanceStatus defines the JSON response for the maintenance endpoint
+type MaintenanceStatus struct {
+	Enabled           bool      `json:"enabled"`
+	Message           string    `json:"message,omitempty"`
+	Since             time.Time `json:"since,omitempty"`
+	RetryAfterSeconds int       `json:"retryAfterSeconds,omitempty"`
+}
+
+// status returns a copy of the current maintenance state
+func (m *maintenanceState) status() MaintenanceStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if !m.enabled {
+		return MaintenanceStatus{}
+	}
+	return MaintenanceStatus{
+		Enabled:           true,
+		Message:           m.message,
+		Since:             m.since,
+		RetryAfterSeconds: int(m.retryAfter.Seconds()),
+	}
+}
+
+// rejectDuringMaintenance writes a 503 with Retry-After and returns true while in maintenance mode
+func (s *Server) rejectDuringMaintenance(w http.ResponseWriter) bool {
+	status := s.maintenance.status()
+	if !status.Enabled {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(status.RetryAfterSeconds))
+	apiErr := apierror.New(http.StatusServiceUnavailable, apierror.Maintenance).With("retryAfterSeconds", status.RetryAfterSeconds)
+	if status.Message != "" {
+		apiErr.With("message", status.Message)
+	}
+	respondError(w, apiErr)
+	return true
+}
+
+// HandleMaintenance reports or changes maintenance mode (admin only)
+func (s *Server) HandleMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.maintenance.status())
+	case http.MethodPost:
+		var req MaintenanceRequest
+		if err := s.readJSON(w, r, &req); err != nil {
+			respondError(w, err)
+			return
+		}
+		if req.RetryAfterSeconds < 0 || req.DrainTimeoutSeconds < 0 {
+			respondError(w, apierror.New(http.StatusBadRequest, apierror.NegativeDuration))
+			return
+		}
+
+		if req.Enabled {
+			retryAfter := s.config.MaintenanceRetryAfter
+			if req.RetryAfterSeconds > 0 {
+				retryAfter = time.Duration(req.RetryAfterSeconds) * time.Second
+			}
+			drainTimeout := s.config.DrainTimeout
+			if req.DrainTimeoutSeconds > 0 {
+				drainTimeout = time.Duration(req.DrainTimeoutSeconds) * time.Second
+			}
+			s.enterMaintenance(req.Message, retryAfter, drainTimeout)
+		} else {
+			s.exitMaintenance()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.maintenance.status())
+	default:
+		respondMethodNotAllowed(w)
+	}
+}
+
+// enterMaintenance stops new sessions, warns connected clients and closes them after drainTimeout
+func (s *Server) enterMaintenance(message string, retryAfter, drainTimeout time.Duration) {
+	m := s.maintenance
+	m.mu.Lock()
+	if !m.enabled {
+		m.since = time.Now()
+	}
+	m.enabled = true
+	m.message = message
+	m.retryAfter = retryAfter
+	if m.drainTimer != nil {
+		m.drainTimer.Stop()
+	}
+	m.drainTimer = time.AfterFunc(drainTimeout, func() {
+		log.Println("Maintenance drain timeout reached, disconnecting clients")
+		s.hub.Disconnect("", protocol.CloseServerShutdown, protocol.CloseReason{Code: apierror.Maintenance, Retry: true, RetryAfter: int(retryAfter.Seconds())})
+	})
+	m.mu.Unlock()
+
+	s.hub.SetDraining(true)
+	s.hub.Broadcast(protocol.NewControlMessage("", protocol.EventShutdownWarning, map[string]interface{}{
+		"message":           message,
+		"disconnectSeconds": int(drainTimeout.Seconds()),
+		"retryAfterSeconds": int(retryAfter.Seconds()),
+	}))
+	log.Printf("Maintenance mode enabled, draining connections for %s", drainTimeout)
+}
+
+// exitMaintenance resumes normal operation
+func (s *Server) exitMaintenance() {
+	m := s.maintenance
+	m.mu.Lock()
+	m.enabled = false
+	m.message = ""
+	if m.drainTimer != nil {
+		m.drainTimer.Stop()
+		m.drainTimer = nil
+	}
+	m.mu.Unlock()
+
+	s.hub.SetDraining(false)
+	log.Println("Maintenance mode disabled")
+}
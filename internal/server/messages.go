@@ -0,0 +1,49 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/auth"
+)
+
+const maxMissingMessages = 500
+
+// HandleMissingMessages returns the envelopes of one conversation within a sequence range,
+// for clients that saw a gap in the sequence numbers of delivered messages
+func (s *Server) HandleMissingMessages(w http.ResponseWriter, r *http.Request, username string) {
+	query := r.URL.Query()
+	from, fromErr := strconv.ParseInt(query.Get("from"), 10, 64)
+	to, toErr := strconv.ParseInt(query.Get("to"), 10, 64)
+	if fromErr != nil || toErr != nil || from < 1 || to < from {
+		respondError(w, apierror.New(http.StatusBadRequest, apierror.InvalidSequenceRange))
+		return
+	}
+
+	with, err := s.userStorage.ResolveUsername(query.Get("with"))
+	if err == auth.ErrUserNotFound {
+		respondError(w, apierror.New(http.StatusNotFound, apierror.UserNotFound))
+		return
+	}
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+
+	limit := pageLimit(r, maxMissingMessages, maxMissingMessages)
+	envelopes, err := s.messages.Conversation(username, with, from, to, limit)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+
+	resp := map[string]interface{}{"messages": envelopes}
+	if len(envelopes) == limit {
+		// more remain, ask again from here
+		resp["nextFrom"] = envelopes[len(envelopes)-1].Seq + 1
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,630 @@
+// Code generated by cmd/mockgen from interfaces.go. DO NOT EDIT.
+
+// Package mocks has mocks of the interfaces in package server
+package mocks
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/auth"
+	"github.com/Chase-Garrett/meadowlark/internal/notifications"
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+	"github.com/Chase-Garrett/meadowlark/internal/rooms"
+	"github.com/Chase-Garrett/meadowlark/internal/server"
+)
+
+// Call is one method call made on a mock
+type Call struct {
+	Method string
+	Args   []interface{}
+}
+
+type recorder struct {
+	mu    sync.Mutex
+	calls []Call
+}
+
+func (r *recorder) record(method string, args ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, Call{Method: method, Args: args})
+}
+
+// Calls returns the calls made so far, oldest first
+func (r *recorder) Calls() []Call {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Call(nil), r.calls...)
+}
+
+// UserStore mocks server.UserStore. Methods call the field of the same name with Func appended;
+// when it is unset those returning values panic and the others do nothing
+type UserStore struct {
+	RegisterNewUserFunc        func(string, string, string, string) error
+	VerifyUserFunc             func(string, string) error
+	LookupLoginFunc            func(string) (string, error)
+	UserExistsFunc             func(string) (bool, error)
+	CountUsersFunc             func() (int64, error)
+	CreatedAtFunc              func(string) (time.Time, error)
+	ListUsersFunc              func(string, string, bool, int) ([]string, error)
+	ListUsersAfterFunc         func(string, int) ([]string, error)
+	RenameUserFunc             func(string, string, time.Duration) error
+	ResolveUsernameFunc        func(string) (string, error)
+	UsernameHistoryFunc        func(string) ([]auth.Alias, error)
+	RegionFunc                 func(string) (string, error)
+	SetRegionFunc              func(string, string) error
+	ChangePasswordFunc         func(string, string, string) error
+	TokenVersionFunc           func(string) (int, error)
+	RequirePasswordResetFunc   func(string) error
+	PasswordResetRequiredFunc  func(string) (bool, error)
+	DeleteAccountFunc          func(string, time.Duration) (*auth.Tombstone, error)
+	DueTombstonesFunc          func(time.Time) ([]auth.Tombstone, error)
+	PurgeTombstoneFunc         func(string) error
+	GetUserPublicKeyFunc       func(string) ([]byte, error)
+	UpdatePublicKeyFunc        func(string, string) error
+	ListPublicKeysAfterFunc    func(string, int) ([]auth.UserKey, error)
+	KeyLogHeadFunc             func() (auth.KeyLogHead, error)
+	KeyLogAfterFunc            func(int64, int) ([]auth.KeyLogEntry, error)
+	KeyProofFunc               func(string, int64) (*auth.KeyProof, error)
+	PhoneFunc                  func(string) (string, error)
+	StartPhoneVerificationFunc func(string, string) (string, error)
+	ConfirmPhoneFunc           func(string, string) (string, error)
+	RemovePhoneFunc            func(string) error
+	DiscoverByHashFunc         func([]string) (map[string]string, error)
+	EmailFunc                  func(string) (string, bool, error)
+	StartEmailVerificationFunc func(string, string) (string, error)
+	ConfirmEmailFunc           func(string, string) (string, error)
+	RemoveEmailFunc            func(string) error
+	GenerateRecoveryCodesFunc  func(string) ([]string, error)
+	UseRecoveryCodeFunc        func(string, string) (int, error)
+	RecoveryCodesLeftFunc      func(string) (int, error)
+	PlaceHoldFunc              func(string, string, string) (*auth.LegalHold, error)
+	ReleaseHoldFunc            func(string, string, string) error
+	HoldFunc                   func(string) (*auth.LegalHold, error)
+	HoldsFunc                  func() ([]auth.LegalHold, error)
+	RecordHoldExportFunc       func(string, string, string) error
+	HoldAuditFunc              func(int64, int) ([]auth.HoldAuditEntry, error)
+	StatusFunc                 func(string) (string, error)
+	SetStatusFunc              func(string, string) error
+	DBFunc                     func() *sql.DB
+
+	recorder
+}
+
+var _ server.UserStore = (*UserStore)(nil)
+
+func (m *UserStore) RegisterNewUser(username string, password string, publicKeyBase64 string, email string) error {
+	m.record("RegisterNewUser", username, password, publicKeyBase64, email)
+	if m.RegisterNewUserFunc == nil {
+		panic("UserStore.RegisterNewUser called but RegisterNewUserFunc is unset")
+	}
+	return m.RegisterNewUserFunc(username, password, publicKeyBase64, email)
+}
+
+func (m *UserStore) VerifyUser(username string, password string) error {
+	m.record("VerifyUser", username, password)
+	if m.VerifyUserFunc == nil {
+		panic("UserStore.VerifyUser called but VerifyUserFunc is unset")
+	}
+	return m.VerifyUserFunc(username, password)
+}
+
+func (m *UserStore) LookupLogin(identifier string) (string, error) {
+	m.record("LookupLogin", identifier)
+	if m.LookupLoginFunc == nil {
+		panic("UserStore.LookupLogin called but LookupLoginFunc is unset")
+	}
+	return m.LookupLoginFunc(identifier)
+}
+
+func (m *UserStore) UserExists(username string) (bool, error) {
+	m.record("UserExists", username)
+	if m.UserExistsFunc == nil {
+		panic("UserStore.UserExists called but UserExistsFunc is unset")
+	}
+	return m.UserExistsFunc(username)
+}
+
+func (m *UserStore) CountUsers() (int64, error) {
+	m.record("CountUsers")
+	if m.CountUsersFunc == nil {
+		panic("UserStore.CountUsers called but CountUsersFunc is unset")
+	}
+	return m.CountUsersFunc()
+}
+
+func (m *UserStore) CreatedAt(username string) (time.Time, error) {
+	m.record("CreatedAt", username)
+	if m.CreatedAtFunc == nil {
+		panic("UserStore.CreatedAt called but CreatedAtFunc is unset")
+	}
+	return m.CreatedAtFunc(username)
+}
+
+func (m *UserStore) ListUsers(prefix string, after string, desc bool, limit int) ([]string, error) {
+	m.record("ListUsers", prefix, after, desc, limit)
+	if m.ListUsersFunc == nil {
+		panic("UserStore.ListUsers called but ListUsersFunc is unset")
+	}
+	return m.ListUsersFunc(prefix, after, desc, limit)
+}
+
+func (m *UserStore) ListUsersAfter(after string, limit int) ([]string, error) {
+	m.record("ListUsersAfter", after, limit)
+	if m.ListUsersAfterFunc == nil {
+		panic("UserStore.ListUsersAfter called but ListUsersAfterFunc is unset")
+	}
+	return m.ListUsersAfterFunc(after, limit)
+}
+
+func (m *UserStore) RenameUser(oldName string, newName string, grace time.Duration) error {
+	m.record("RenameUser", oldName, newName, grace)
+	if m.RenameUserFunc == nil {
+		panic("UserStore.RenameUser called but RenameUserFunc is unset")
+	}
+	return m.RenameUserFunc(oldName, newName, grace)
+}
+
+func (m *UserStore) ResolveUsername(name string) (string, error) {
+	m.record("ResolveUsername", name)
+	if m.ResolveUsernameFunc == nil {
+		panic("UserStore.ResolveUsername called but ResolveUsernameFunc is unset")
+	}
+	return m.ResolveUsernameFunc(name)
+}
+
+func (m *UserStore) UsernameHistory(username string) ([]auth.Alias, error) {
+	m.record("UsernameHistory", username)
+	if m.UsernameHistoryFunc == nil {
+		panic("UserStore.UsernameHistory called but UsernameHistoryFunc is unset")
+	}
+	return m.UsernameHistoryFunc(username)
+}
+
+func (m *UserStore) Region(username string) (string, error) {
+	m.record("Region", username)
+	if m.RegionFunc == nil {
+		panic("UserStore.Region called but RegionFunc is unset")
+	}
+	return m.RegionFunc(username)
+}
+
+func (m *UserStore) SetRegion(username string, region string) error {
+	m.record("SetRegion", username, region)
+	if m.SetRegionFunc == nil {
+		panic("UserStore.SetRegion called but SetRegionFunc is unset")
+	}
+	return m.SetRegionFunc(username, region)
+}
+
+func (m *UserStore) ChangePassword(username string, current string, password string) error {
+	m.record("ChangePassword", username, current, password)
+	if m.ChangePasswordFunc == nil {
+		panic("UserStore.ChangePassword called but ChangePasswordFunc is unset")
+	}
+	return m.ChangePasswordFunc(username, current, password)
+}
+
+func (m *UserStore) TokenVersion(username string) (int, error) {
+	m.record("TokenVersion", username)
+	if m.TokenVersionFunc == nil {
+		panic("UserStore.TokenVersion called but TokenVersionFunc is unset")
+	}
+	return m.TokenVersionFunc(username)
+}
+
+func (m *UserStore) RequirePasswordReset(username string) error {
+	m.record("RequirePasswordReset", username)
+	if m.RequirePasswordResetFunc == nil {
+		panic("UserStore.RequirePasswordReset called but RequirePasswordResetFunc is unset")
+	}
+	return m.RequirePasswordResetFunc(username)
+}
+
+func (m *UserStore) PasswordResetRequired(username string) (bool, error) {
+	m.record("PasswordResetRequired", username)
+	if m.PasswordResetRequiredFunc == nil {
+		panic("UserStore.PasswordResetRequired called but PasswordResetRequiredFunc is unset")
+	}
+	return m.PasswordResetRequiredFunc(username)
+}
+
+func (m *UserStore) DeleteAccount(username string, grace time.Duration) (*auth.Tombstone, error) {
+	m.record("DeleteAccount", username, grace)
+	if m.DeleteAccountFunc == nil {
+		panic("UserStore.DeleteAccount called but DeleteAccountFunc is unset")
+	}
+	return m.DeleteAccountFunc(username, grace)
+}
+
+func (m *UserStore) DueTombstones(now time.Time) ([]auth.Tombstone, error) {
+	m.record("DueTombstones", now)
+	if m.DueTombstonesFunc == nil {
+		panic("UserStore.DueTombstones called but DueTombstonesFunc is unset")
+	}
+	return m.DueTombstonesFunc(now)
+}
+
+func (m *UserStore) PurgeTombstone(id string) error {
+	m.record("PurgeTombstone", id)
+	if m.PurgeTombstoneFunc == nil {
+		panic("UserStore.PurgeTombstone called but PurgeTombstoneFunc is unset")
+	}
+	return m.PurgeTombstoneFunc(id)
+}
+
+func (m *UserStore) GetUserPublicKey(username string) ([]byte, error) {
+	m.record("GetUserPublicKey", username)
+	if m.GetUserPublicKeyFunc == nil {
+		panic("UserStore.GetUserPublicKey called but GetUserPublicKeyFunc is unset")
+	}
+	return m.GetUserPublicKeyFunc(username)
+}
+
+func (m *UserStore) UpdatePublicKey(username string, publicKeyBase64 string) error {
+	m.record("UpdatePublicKey", username, publicKeyBase64)
+	if m.UpdatePublicKeyFunc == nil {
+		panic("UserStore.UpdatePublicKey called but UpdatePublicKeyFunc is unset")
+	}
+	return m.UpdatePublicKeyFunc(username, publicKeyBase64)
+}
+
+func (m *UserStore) ListPublicKeysAfter(after string, limit int) ([]auth.UserKey, error) {
+	m.record("ListPublicKeysAfter", after, limit)
+	if m.ListPublicKeysAfterFunc == nil {
+		panic("UserStore.ListPublicKeysAfter called but ListPublicKeysAfterFunc is unset")
+	}
+	return m.ListPublicKeysAfterFunc(after, limit)
+}
+
+func (m *UserStore) KeyLogHead() (auth.KeyLogHead, error) {
+	m.record("KeyLogHead")
+	if m.KeyLogHeadFunc == nil {
+		panic("UserStore.KeyLogHead called but KeyLogHeadFunc is unset")
+	}
+	return m.KeyLogHeadFunc()
+}
+
+func (m *UserStore) KeyLogAfter(after int64, limit int) ([]auth.KeyLogEntry, error) {
+	m.record("KeyLogAfter", after, limit)
+	if m.KeyLogAfterFunc == nil {
+		panic("UserStore.KeyLogAfter called but KeyLogAfterFunc is unset")
+	}
+	return m.KeyLogAfterFunc(after, limit)
+}
+
+func (m *UserStore) KeyProof(username string, head int64) (*auth.KeyProof, error) {
+	m.record("KeyProof", username, head)
+	if m.KeyProofFunc == nil {
+		panic("UserStore.KeyProof called but KeyProofFunc is unset")
+	}
+	return m.KeyProofFunc(username, head)
+}
+
+func (m *UserStore) Phone(username string) (string, error) {
+	m.record("Phone", username)
+	if m.PhoneFunc == nil {
+		panic("UserStore.Phone called but PhoneFunc is unset")
+	}
+	return m.PhoneFunc(username)
+}
+
+func (m *UserStore) StartPhoneVerification(username string, phone string) (string, error) {
+	m.record("StartPhoneVerification", username, phone)
+	if m.StartPhoneVerificationFunc == nil {
+		panic("UserStore.StartPhoneVerification called but StartPhoneVerificationFunc is unset")
+	}
+	return m.StartPhoneVerificationFunc(username, phone)
+}
+
+func (m *UserStore) ConfirmPhone(username string, code string) (string, error) {
+	m.record("ConfirmPhone", username, code)
+	if m.ConfirmPhoneFunc == nil {
+		panic("UserStore.ConfirmPhone called but ConfirmPhoneFunc is unset")
+	}
+	return m.ConfirmPhoneFunc(username, code)
+}
+
+func (m *UserStore) RemovePhone(username string) error {
+	m.record("RemovePhone", username)
+	if m.RemovePhoneFunc == nil {
+		panic("UserStore.RemovePhone called but RemovePhoneFunc is unset")
+	}
+	return m.RemovePhoneFunc(username)
+}
+
+func (m *UserStore) DiscoverByHash(hashes []string) (map[string]string, error) {
+	m.record("DiscoverByHash", hashes)
+	if m.DiscoverByHashFunc == nil {
+		panic("UserStore.DiscoverByHash called but DiscoverByHashFunc is unset")
+	}
+	return m.DiscoverByHashFunc(hashes)
+}
+
+func (m *UserStore) Email(username string) (string, bool, error) {
+	m.record("Email", username)
+	if m.EmailFunc == nil {
+		panic("UserStore.Email called but EmailFunc is unset")
+	}
+	return m.EmailFunc(username)
+}
+
+func (m *UserStore) StartEmailVerification(username string, email string) (string, error) {
+	m.record("StartEmailVerification", username, email)
+	if m.StartEmailVerificationFunc == nil {
+		panic("UserStore.StartEmailVerification called but StartEmailVerificationFunc is unset")
+	}
+	return m.StartEmailVerificationFunc(username, email)
+}
+
+func (m *UserStore) ConfirmEmail(username string, code string) (string, error) {
+	m.record("ConfirmEmail", username, code)
+	if m.ConfirmEmailFunc == nil {
+		panic("UserStore.ConfirmEmail called but ConfirmEmailFunc is unset")
+	}
+	return m.ConfirmEmailFunc(username, code)
+}
+
+func (m *UserStore) RemoveEmail(username string) error {
+	m.record("RemoveEmail", username)
+	if m.RemoveEmailFunc == nil {
+		panic("UserStore.RemoveEmail called but RemoveEmailFunc is unset")
+	}
+	return m.RemoveEmailFunc(username)
+}
+
+func (m *UserStore) GenerateRecoveryCodes(username string) ([]string, error) {
+	m.record("GenerateRecoveryCodes", username)
+	if m.GenerateRecoveryCodesFunc == nil {
+		panic("UserStore.GenerateRecoveryCodes called but GenerateRecoveryCodesFunc is unset")
+	}
+	return m.GenerateRecoveryCodesFunc(username)
+}
+
+func (m *UserStore) UseRecoveryCode(username string, code string) (int, error) {
+	m.record("UseRecoveryCode", username, code)
+	if m.UseRecoveryCodeFunc == nil {
+		panic("UserStore.UseRecoveryCode called but UseRecoveryCodeFunc is unset")
+	}
+	return m.UseRecoveryCodeFunc(username, code)
+}
+
+func (m *UserStore) RecoveryCodesLeft(username string) (int, error) {
+	m.record("RecoveryCodesLeft", username)
+	if m.RecoveryCodesLeftFunc == nil {
+		panic("UserStore.RecoveryCodesLeft called but RecoveryCodesLeftFunc is unset")
+	}
+	return m.RecoveryCodesLeftFunc(username)
+}
+
+func (m *UserStore) PlaceHold(username string, admin string, reason string) (*auth.LegalHold, error) {
+	m.record("PlaceHold", username, admin, reason)
+	if m.PlaceHoldFunc == nil {
+		panic("UserStore.PlaceHold called but PlaceHoldFunc is unset")
+	}
+	return m.PlaceHoldFunc(username, admin, reason)
+}
+
+func (m *UserStore) ReleaseHold(username string, admin string, reason string) error {
+	m.record("ReleaseHold", username, admin, reason)
+	if m.ReleaseHoldFunc == nil {
+		panic("UserStore.ReleaseHold called but ReleaseHoldFunc is unset")
+	}
+	return m.ReleaseHoldFunc(username, admin, reason)
+}
+
+func (m *UserStore) Hold(username string) (*auth.LegalHold, error) {
+	m.record("Hold", username)
+	if m.HoldFunc == nil {
+		panic("UserStore.Hold called but HoldFunc is unset")
+	}
+	return m.HoldFunc(username)
+}
+
+func (m *UserStore) Holds() ([]auth.LegalHold, error) {
+	m.record("Holds")
+	if m.HoldsFunc == nil {
+		panic("UserStore.Holds called but HoldsFunc is unset")
+	}
+	return m.HoldsFunc()
+}
+
+func (m *UserStore) RecordHoldExport(username string, admin string, reason string) error {
+	m.record("RecordHoldExport", username, admin, reason)
+	if m.RecordHoldExportFunc == nil {
+		panic("UserStore.RecordHoldExport called but RecordHoldExportFunc is unset")
+	}
+	return m.RecordHoldExportFunc(username, admin, reason)
+}
+
+func (m *UserStore) HoldAudit(beforeID int64, limit int) ([]auth.HoldAuditEntry, error) {
+	m.record("HoldAudit", beforeID, limit)
+	if m.HoldAuditFunc == nil {
+		panic("UserStore.HoldAudit called but HoldAuditFunc is unset")
+	}
+	return m.HoldAuditFunc(beforeID, limit)
+}
+
+func (m *UserStore) Status(username string) (string, error) {
+	m.record("Status", username)
+	if m.StatusFunc == nil {
+		panic("UserStore.Status called but StatusFunc is unset")
+	}
+	return m.StatusFunc(username)
+}
+
+func (m *UserStore) SetStatus(username string, status string) error {
+	m.record("SetStatus", username, status)
+	if m.SetStatusFunc == nil {
+		panic("UserStore.SetStatus called but SetStatusFunc is unset")
+	}
+	return m.SetStatusFunc(username, status)
+}
+
+func (m *UserStore) DB() *sql.DB {
+	m.record("DB")
+	if m.DBFunc == nil {
+		panic("UserStore.DB called but DBFunc is unset")
+	}
+	return m.DBFunc()
+}
+
+// MessageRouter mocks server.MessageRouter. Methods call the field of the same name with Func appended;
+// when it is unset those returning values panic and the others do nothing
+type MessageRouter struct {
+	RegisterFunc             func(*server.Client)
+	UnregisterFunc           func(*server.Client)
+	ForwardFunc              func(*protocol.Message)
+	BroadcastFunc            func(*protocol.Message)
+	RejectFunc               func(*protocol.Message, string)
+	DisconnectFunc           func(string, int, protocol.CloseReason)
+	SetDrainingFunc          func(bool)
+	PresenceFunc             func(context.Context, []string) ([]server.Presence, error)
+	StatsFunc                func(context.Context) (*server.HubStats, error)
+	SnapshotFunc             func() *server.HubSnapshot
+	ActiveFunc               func(string)
+	SetStatusFunc            func(string, string)
+	SetDoNotDisturbFunc      func(string, notifications.DoNotDisturb)
+	ClaimRoomPostFunc        func(*rooms.Snapshot, string) time.Duration
+	NotifyRoomFunc           func(string, string, interface{})
+	NotifyRoomUpdatedFunc    func(string, string)
+	NotifyRoomMemberFunc     func(string, string, string, string, map[string]interface{})
+	NotifyRoomModeratorsFunc func(string, string, interface{})
+
+	recorder
+}
+
+var _ server.MessageRouter = (*MessageRouter)(nil)
+
+func (m *MessageRouter) Register(client *server.Client) {
+	m.record("Register", client)
+	if m.RegisterFunc != nil {
+		m.RegisterFunc(client)
+	}
+}
+
+func (m *MessageRouter) Unregister(client *server.Client) {
+	m.record("Unregister", client)
+	if m.UnregisterFunc != nil {
+		m.UnregisterFunc(client)
+	}
+}
+
+func (m *MessageRouter) Forward(message *protocol.Message) {
+	m.record("Forward", message)
+	if m.ForwardFunc != nil {
+		m.ForwardFunc(message)
+	}
+}
+
+func (m *MessageRouter) Broadcast(message *protocol.Message) {
+	m.record("Broadcast", message)
+	if m.BroadcastFunc != nil {
+		m.BroadcastFunc(message)
+	}
+}
+
+func (m *MessageRouter) Reject(message *protocol.Message, reason string) {
+	m.record("Reject", message, reason)
+	if m.RejectFunc != nil {
+		m.RejectFunc(message, reason)
+	}
+}
+
+func (m *MessageRouter) Disconnect(username string, code int, reason protocol.CloseReason) {
+	m.record("Disconnect", username, code, reason)
+	if m.DisconnectFunc != nil {
+		m.DisconnectFunc(username, code, reason)
+	}
+}
+
+func (m *MessageRouter) SetDraining(draining bool) {
+	m.record("SetDraining", draining)
+	if m.SetDrainingFunc != nil {
+		m.SetDrainingFunc(draining)
+	}
+}
+
+func (m *MessageRouter) Presence(ctx context.Context, usernames []string) ([]server.Presence, error) {
+	m.record("Presence", ctx, usernames)
+	if m.PresenceFunc == nil {
+		panic("MessageRouter.Presence called but PresenceFunc is unset")
+	}
+	return m.PresenceFunc(ctx, usernames)
+}
+
+func (m *MessageRouter) Stats(ctx context.Context) (*server.HubStats, error) {
+	m.record("Stats", ctx)
+	if m.StatsFunc == nil {
+		panic("MessageRouter.Stats called but StatsFunc is unset")
+	}
+	return m.StatsFunc(ctx)
+}
+
+func (m *MessageRouter) Snapshot() *server.HubSnapshot {
+	m.record("Snapshot")
+	if m.SnapshotFunc == nil {
+		panic("MessageRouter.Snapshot called but SnapshotFunc is unset")
+	}
+	return m.SnapshotFunc()
+}
+
+func (m *MessageRouter) Active(username string) {
+	m.record("Active", username)
+	if m.ActiveFunc != nil {
+		m.ActiveFunc(username)
+	}
+}
+
+func (m *MessageRouter) SetStatus(username string, status string) {
+	m.record("SetStatus", username, status)
+	if m.SetStatusFunc != nil {
+		m.SetStatusFunc(username, status)
+	}
+}
+
+func (m *MessageRouter) SetDoNotDisturb(username string, dnd notifications.DoNotDisturb) {
+	m.record("SetDoNotDisturb", username, dnd)
+	if m.SetDoNotDisturbFunc != nil {
+		m.SetDoNotDisturbFunc(username, dnd)
+	}
+}
+
+func (m *MessageRouter) ClaimRoomPost(snap *rooms.Snapshot, username string) time.Duration {
+	m.record("ClaimRoomPost", snap, username)
+	if m.ClaimRoomPostFunc == nil {
+		panic("MessageRouter.ClaimRoomPost called but ClaimRoomPostFunc is unset")
+	}
+	return m.ClaimRoomPostFunc(snap, username)
+}
+
+func (m *MessageRouter) NotifyRoom(roomID string, event string, data interface{}) {
+	m.record("NotifyRoom", roomID, event, data)
+	if m.NotifyRoomFunc != nil {
+		m.NotifyRoomFunc(roomID, event, data)
+	}
+}
+
+func (m *MessageRouter) NotifyRoomUpdated(roomID string, by string) {
+	m.record("NotifyRoomUpdated", roomID, by)
+	if m.NotifyRoomUpdatedFunc != nil {
+		m.NotifyRoomUpdatedFunc(roomID, by)
+	}
+}
+
+func (m *MessageRouter) NotifyRoomMember(roomID string, username string, action string, by string, extra map[string]interface{}) {
+	m.record("NotifyRoomMember", roomID, username, action, by, extra)
+	if m.NotifyRoomMemberFunc != nil {
+		m.NotifyRoomMemberFunc(roomID, username, action, by, extra)
+	}
+}
+
+func (m *MessageRouter) NotifyRoomModerators(roomID string, event string, data interface{}) {
+	m.record("NotifyRoomModerators", roomID, event, data)
+	if m.NotifyRoomModeratorsFunc != nil {
+		m.NotifyRoomModeratorsFunc(roomID, event, data)
+	}
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/auth"
+	"github.com/Chase-Garrett/meadowlark/internal/notifications"
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+)
+
+// digestSendTimeout bounds delivery of a single digest email
+const digestSendTimeout = 30 * time.Second
+
+// EmailRequest defines JSON for POST /api/account/email
+type EmailRequest struct {
+	Email string `json:"email"`
+}
+
+// EmailVerifyRequest defines JSON for POST /api/account/email/verify
+type EmailVerifyRequest struct {
+	Code string `json:"code"`
+}
+
+// HandleEmail shows, starts verification of, or removes the account email address
+func (s *Server) HandleEmail(w http.ResponseWriter, r *http.Request, username string) {
+	switch r.Method {
+	case http.MethodGet:
+		email, verified, err := s.userStorage.Email(username)
+		if err != nil {
+			respondInternalError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"email": email, "verified": verified})
+	case http.MethodPost:
+		var req EmailRequest
+		if err := s.readJSON(w, r, &req); err != nil {
+			respondError(w, err)
+			return
+		}
+		code, err := s.userStorage.StartEmailVerification(username, req.Email)
+		if err != nil {
+			respondIdentifierError(w, err)
+			return
+		}
+		email, _ := auth.NormalizeEmail(req.Email)
+		body := fmt.Sprintf("Your Meadowlark verification code is %s\n\nIt expires in 10 minutes. If you didn't ask for it, ignore this email.\n", code)
+		if err := s.mail.Send(r.Context(), email, "Meadowlark verification code", body); err != nil {
+			log.Printf("Error sending verification email to %s: %v", username, err)
+			respondError(w, apierror.New(http.StatusBadGateway, apierror.EmailFailed))
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodDelete:
+		if err := s.userStorage.RemoveEmail(username); err != nil {
+			respondInternalError(w, err)
+			return
+		}
+		// digests have nowhere to go anymore
+		if err := s.notify.Set(username, notifications.Preferences{}); err != nil {
+			respondInternalError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		respondMethodNotAllowed(w)
+	}
+}
+
+// HandleEmailVerify confirms the code sent by HandleEmail
+func (s *Server) HandleEmailVerify(w http.ResponseWriter, r *http.Request, username string) {
+	var req EmailVerifyRequest
+	if err := s.readJSON(w, r, &req); err != nil {
+		respondError(w, err)
+		return
+	}
+	email, err := s.userStorage.ConfirmEmail(username, req.Code)
+	if err != nil {
+		respondIdentifierError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"email": email, "verified": true})
+}
+
+// HandleNotificationPreferences reads or replaces the caller's notification preferences
+func (s *Server) HandleNotificationPreferences(w http.ResponseWriter, r *http.Request, username string) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req notifications.Preferences
+		if err := s.readJSON(w, r, &req); err != nil {
+			respondError(w, err)
+			return
+		}
+		switch err := s.notify.Set(username, req); err {
+		case nil:
+		case notifications.ErrInvalidDigestHours:
+			respondError(w, apierror.Invalid(err))
+			return
+		case notifications.ErrEmailNotVerified:
+			respondError(w, apierror.New(http.StatusConflict, apierror.EmailNotVerified))
+			return
+		default:
+			respondInternalError(w, err)
+			return
+		}
+	default:
+		respondMethodNotAllowed(w)
+		return
+	}
+
+	prefs, err := s.notify.Get(username)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prefs)
+}
+
+// doNotDisturbState is a do-not-disturb schedule with whether it is on right now
+type doNotDisturbState struct {
+	notifications.DoNotDisturb
+	Active bool `json:"active"`
+}
+
+// HandleDoNotDisturb reads or replaces the caller's do-not-disturb schedule. A change is
+// applied to how contacts see the caller and sent to their connection, so their other
+// devices follow it
+func (s *Server) HandleDoNotDisturb(w http.ResponseWriter, r *http.Request, username string) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req notifications.DoNotDisturb
+		if err := s.readJSON(w, r, &req); err != nil {
+			respondError(w, err)
+			return
+		}
+		if err := s.notify.SetDoNotDisturb(username, req); err != nil {
+			if errors.Is(err, notifications.ErrInvalidDoNotDisturb) {
+				respondError(w, apierror.Invalid(err))
+				return
+			}
+			respondInternalError(w, err)
+			return
+		}
+	default:
+		respondMethodNotAllowed(w)
+		return
+	}
+
+	dnd, err := s.notify.DoNotDisturb(username)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	state := doNotDisturbState{DoNotDisturb: dnd, Active: dnd.Active(time.Now())}
+	if r.Method == http.MethodPut {
+		s.hub.SetDoNotDisturb(username, dnd)
+		s.hub.Forward(protocol.NewControlMessage(username, protocol.EventDoNotDisturb, state))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+// digestSenders names senders as "alice", "alice and bob" or "alice, bob, carol and others"
+func digestSenders(senders []string, more bool) string {
+	if more {
+		return strings.Join(senders, ", ") + " and others"
+	}
+	if len(senders) == 1 {
+		return senders[0]
+	}
+	return strings.Join(senders[:len(senders)-1], ", ") + " and " + senders[len(senders)-1]
+}
+
+// sendDigests emails everyone due a digest. Digests hold a count of conversations and, for
+// users who opted in, who direct messages are from, never content, since email is neither
+// end-to-end encrypted nor private. A failed send isn't marked, so it is retried on the next run
+func (s *Server) sendDigests(now time.Time) error {
+	due, err := s.notify.DueDigests(now, s.config.DigestMinGap)
+	if err != nil {
+		return fmt.Errorf("finding digests to send: %w", err)
+	}
+	sent := 0
+	for _, digest := range due {
+		// held back, not marked, so it goes out once the user's do-not-disturb ends
+		dnd, err := s.notify.DoNotDisturb(digest.Username)
+		if err != nil {
+			log.Printf("Error loading the do-not-disturb schedule of %s: %v", digest.Username, err)
+			continue
+		}
+		if dnd.Active(now) {
+			continue
+		}
+		// the address is sealed at rest, so it's read through the user store
+		email, _, err := s.userStorage.Email(digest.Username)
+		if err != nil {
+			log.Printf("Error loading the email address of %s: %v", digest.Username, err)
+			continue
+		}
+		noun := "conversations"
+		if digest.Conversations == 1 {
+			noun = "conversation"
+		}
+		summary := fmt.Sprintf("You have new messages in %d %s", digest.Conversations, noun)
+		subject := summary
+		if len(digest.Senders) > 0 {
+			subject = "You have messages waiting from " + digestSenders(digest.Senders, digest.MoreSenders)
+			summary = fmt.Sprintf("%s, in %d %s in all,", subject, digest.Conversations, noun)
+		}
+		body := fmt.Sprintf("%s on Meadowlark since %s.\n\n"+
+			"Open Meadowlark to read them. To stop these emails, turn off digests in your notification settings.\n",
+			summary, digest.OfflineSince.UTC().Format("Jan 2, 15:04 MST"))
+
+		ctx, cancel := context.WithTimeout(context.Background(), digestSendTimeout)
+		err = s.mail.Send(ctx, email, subject, body)
+		cancel()
+		if err != nil {
+			log.Printf("Error sending digest to %s: %v", digest.Username, err)
+			continue
+		}
+		if err := s.notify.MarkDigestSent(digest.Username, now); err != nil {
+			log.Printf("Error recording digest for %s: %v", digest.Username, err)
+		}
+		sent++
+	}
+	if sent > 0 {
+		log.Printf("Sent missed message digests to %d users", sent)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/onboarding"
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+	"github.com/Chase-Garrett/meadowlark/internal/rooms"
+)
+
+// OnboardingRequest defines JSON for PUT /api/admin/onboarding
+type OnboardingRequest struct {
+	Enabled bool     `json:"enabled"`
+	Message string   `json:"message"`
+	Rooms   []string `json:"rooms"`
+}
+
+// onboard greets username on their first login: adds them to the welcome rooms and renders
+// the welcome message. Returns nil on later logins, or when there is nothing to greet with.
+// Failures are logged, they never fail the login
+func (s *Server) onboard(username string) *onboarding.Welcome {
+	// servers built without storage (handler tests) greet nobody
+	if s.onboarding == nil {
+		return nil
+	}
+	first, err := s.onboarding.Claim(username)
+	if err != nil {
+		log.Printf("Error marking %s as onboarded: %v", username, err)
+		return nil
+	}
+	if !first {
+		return nil
+	}
+	settings, err := s.onboarding.Settings()
+	if err != nil {
+		log.Printf("Error reading the onboarding settings: %v", err)
+		return nil
+	}
+	if !settings.Enabled {
+		return nil
+	}
+
+	welcome := &onboarding.Welcome{Rooms: []string{}, CreatedAt: time.Now()}
+	var names []string
+	for _, roomID := range settings.Rooms {
+		room, err := s.rooms.Get(roomID)
+		if err == nil {
+			err = s.rooms.AddMember(roomID, username, rooms.RoleMember)
+		}
+		switch {
+		case errors.Is(err, rooms.ErrMemberExists):
+		case errors.Is(err, rooms.ErrNotFound):
+			log.Printf("Welcome room %s doesn't exist anymore", roomID)
+			continue
+		case err != nil:
+			log.Printf("Error adding %s to welcome room %s: %v", username, roomID, err)
+			continue
+		default:
+			s.hub.NotifyRoomMember(roomID, username, protocol.MemberAdded, username, map[string]interface{}{"role": rooms.RoleMember})
+		}
+		welcome.Rooms = append(welcome.Rooms, roomID)
+		names = append(names, room.Name)
+	}
+	// a template that renders fine for the check can still fail on real data, e.g. an index
+	// past the rooms that still exist
+	welcome.Body, err = onboarding.Render(settings.Message, onboarding.Data{
+		Username:  username,
+		Workspace: s.config.Tenant,
+		Rooms:     names,
+	})
+	if err != nil {
+		log.Printf("Error rendering the welcome message for %s: %v", username, err)
+	}
+	if welcome.Body == "" && len(welcome.Rooms) == 0 {
+		return nil
+	}
+	if err := s.onboarding.Save(username, welcome); err != nil {
+		log.Printf("Error saving the welcome message of %s: %v", username, err)
+	}
+	log.Printf("Welcomed %s, added to %d rooms", username, len(welcome.Rooms))
+	return welcome
+}
+
+// HandleWelcome returns the welcome message the caller got on their first login, for devices
+// that didn't see the login response: {"welcome": null} when they got none
+func (s *Server) HandleWelcome(w http.ResponseWriter, r *http.Request, username string) {
+	if r.Method != http.MethodGet {
+		respondMethodNotAllowed(w)
+		return
+	}
+	welcome, err := s.onboarding.Welcome(username)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"welcome": welcome})
+}
+
+// HandleAdminOnboarding shows (GET), replaces (PUT) or resets to the configured defaults
+// (DELETE) what new users get on their first login (admin only)
+func (s *Server) HandleAdminOnboarding(w http.ResponseWriter, r *http.Request, admin string) {
+	var settings onboarding.Settings
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		settings, err = s.onboarding.Settings()
+	case http.MethodPut:
+		var req OnboardingRequest
+		if apiErr := s.readJSON(w, r, &req); apiErr != nil {
+			respondError(w, apiErr)
+			return
+		}
+		for _, roomID := range req.Rooms {
+			if _, err := s.rooms.Get(roomID); err != nil {
+				if err == rooms.ErrNotFound {
+					respondError(w, apierror.New(http.StatusBadRequest, apierror.InvalidRequest).With("detail", "room "+roomID+" doesn't exist"))
+					return
+				}
+				respondInternalError(w, err)
+				return
+			}
+		}
+		settings, err = s.onboarding.SetSettings(onboarding.Settings{Enabled: req.Enabled, Message: req.Message, Rooms: req.Rooms}, admin)
+		if err == nil {
+			log.Printf("%s changed the onboarding settings", admin)
+		}
+	case http.MethodDelete:
+		settings, err = s.onboarding.ResetSettings()
+		if err == nil {
+			log.Printf("%s reset the onboarding settings", admin)
+		}
+	default:
+		respondMethodNotAllowed(w)
+		return
+	}
+	switch {
+	case errors.Is(err, onboarding.ErrInvalidTemplate), errors.Is(err, onboarding.ErrMessageTooLong), errors.Is(err, onboarding.ErrTooManyRooms):
+		respondError(w, apierror.Invalid(err))
+		return
+	case err != nil:
+		respondInternalError(w, err)
+		return
+	}
+
+	// the message as the admin would get it, to check the template
+	preview, _ := onboarding.Render(settings.Message, onboarding.Data{Username: admin, Workspace: s.config.Tenant, Rooms: s.roomNames(settings.Rooms)})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		onboarding.Settings
+		Preview string `json:"preview"`
+	}{settings, preview})
+}
+
+// roomNames returns the names of the rooms in ids that exist
+func (s *Server) roomNames(ids []string) []string {
+	names := []string{}
+	for _, id := range ids {
+		if room, err := s.rooms.Get(id); err == nil {
+			names = append(names, room.Name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/config"
+	"github.com/Chase-Garrett/meadowlark/internal/tor"
+)
+
+// onionClientIP stands in for the address of clients connecting through tor, which all
+// arrive from the loopback interface. They are exempt from per-IP connection limits
+const onionClientIP = "onion"
+
+// how long to wait before publishing again after losing the control connection
+const onionRetryInterval = 30 * time.Second
+
+type onionContextKey struct{}
+
+// isOnion reports whether r arrived on the tor listener
+func isOnion(r *http.Request) bool {
+	onion, _ := r.Context().Value(onionContextKey{}).(bool)
+	return onion
+}
+
+// serveOnion starts the listener tor forwards onion connections to and, when a control port
+// is configured, publishes the onion service through it
+func serveOnion(cfg *config.Config, handler http.Handler) {
+	addr := cfg.TorListenAddr
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		log.Fatalf("Invalid tor listen address %q: %v", addr, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		log.Fatalf("The tor listener only accepts loopback addresses, got %q", addr)
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("Tor listener: %v", err)
+	}
+
+	srv := newHTTPServer(cfg, handler)
+	srv.BaseContext = func(net.Listener) context.Context {
+		return context.WithValue(context.Background(), onionContextKey{}, true)
+	}
+	go func() {
+		if err := srv.Serve(listener); err != http.ErrServerClosed {
+			log.Fatal("Tor listener: ", err)
+		}
+	}()
+	log.Printf("Accepting onion connections from tor on %s", listener.Addr())
+
+	if cfg.TorControl != "" {
+		go publishOnion(cfg, listener.Addr().String())
+	}
+}
+
+// publishOnion adds the onion service through the control port and adds it again
+// whenever tor drops the connection, which removes the service
+func publishOnion(cfg *config.Config, target string) {
+	for {
+		ctrl, err := addOnion(cfg, target)
+		if err != nil {
+			log.Printf("Failed to publish onion service: %v", err)
+		} else {
+			err = ctrl.Wait()
+			ctrl.Close()
+			log.Printf("Lost the tor control connection, onion service is offline: %v", err)
+		}
+		time.Sleep(onionRetryInterval)
+	}
+}
+
+func addOnion(cfg *config.Config, target string) (*tor.Controller, error) {
+	key, err := os.ReadFile(cfg.TorKeyFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	ctrl, err := tor.Dial(cfg.TorControl, cfg.TorControlPassword)
+	if err != nil {
+		return nil, err
+	}
+	serviceID, newKey, err := ctrl.AddOnion(strings.TrimSpace(string(key)), 80, target)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	if newKey != "" {
+		if err := os.WriteFile(cfg.TorKeyFile, []byte(newKey+"\n"), 0600); err != nil {
+			log.Printf("Warning: could not save the onion service key, the address will change on restart: %v", err)
+		}
+	}
+	log.Printf("Onion service available at http://%s.onion/", serviceID)
+	return ctrl, nil
+}
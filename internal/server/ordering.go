@@ -0,0 +1,167 @@
+package server
+
+import (
+	"sort"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+)
+
+const (
+	// a conversation holding this many messages behind a gap is flushed without waiting
+	maxReorderPending = 256
+	// conversations idle this long forget their position
+	reorderIdle = 10 * time.Minute
+)
+
+// conversationOrder tracks the next sequence number to release for one conversation
+type conversationOrder struct {
+	next     int64
+	pending  map[int64]*protocol.Message
+	waiting  time.Time // when the current gap was first seen
+	lastSeen time.Time
+}
+
+// reorderBuffer releases chat messages in sequence order. Sequence numbers are drawn when a
+// message is stored, so two senders in one conversation can reach the hub out of order;
+// a message after a gap is held until the gap fills or window passes, after which the
+// recipient is expected to fetch what is missing.
+// Delivery order relies on every message of a conversation passing through the one hub
+// goroutine. Splitting the hub must keep that per conversation, routing by orderingKey
+// rather than by sender, or two halves of a conversation would be released independently
+type reorderBuffer struct {
+	window        time.Duration // 0 disables reordering
+	conversations map[string]*conversationOrder
+	// start gives the first sequence number to release in a conversation the buffer hasn't
+	// seen yet, nil starts every conversation at 1
+	start func(message *protocol.Message) int64
+	// messages stored before then were delivered or lost by an earlier process
+	started time.Time
+}
+
+func newReorderBuffer(window time.Duration) *reorderBuffer {
+	return &reorderBuffer{
+		window:        window,
+		conversations: make(map[string]*conversationOrder),
+		started:       time.Now(),
+	}
+}
+
+// conversationKey identifies a direct conversation regardless of direction,
+// rooms are keyed by their id behind a prefix no username pair produces
+func conversationKey(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return a + "\x00" + b
+}
+
+// orderingKey is the conversationKey of a message, or its room's
+func orderingKey(message *protocol.Message) string {
+	if message.Room != "" {
+		return "\x01" + message.Room
+	}
+	return conversationKey(message.Sender, message.Recipient)
+}
+
+// admit returns the messages that can be delivered now that message has arrived
+func (b *reorderBuffer) admit(message *protocol.Message, now time.Time) []*protocol.Message {
+	if b.window <= 0 || message.Seq == 0 {
+		return []*protocol.Message{message}
+	}
+
+	key := orderingKey(message)
+	conv, ok := b.conversations[key]
+	if !ok {
+		// the first message to arrive needn't be the first stored, an earlier one may be on its way
+		next := int64(1)
+		if b.start != nil {
+			next = b.start(message)
+		}
+		conv = &conversationOrder{next: min(next, message.Seq), pending: make(map[int64]*protocol.Message)}
+		b.conversations[key] = conv
+	}
+	conv.lastSeen = now
+
+	if message.Seq < conv.next {
+		// the gap it belonged to was already given up on
+		return []*protocol.Message{message}
+	}
+	if len(conv.pending) == 0 {
+		conv.waiting = now
+	}
+	conv.pending[message.Seq] = message
+
+	ready := conv.release()
+	if len(conv.pending) >= maxReorderPending {
+		ready = append(ready, conv.flush()...)
+	}
+	if len(ready) > 0 {
+		conv.waiting = now
+	}
+	return ready
+}
+
+// expire flushes conversations whose gap has been open longer than the window
+// and forgets idle ones
+func (b *reorderBuffer) expire(now time.Time) []*protocol.Message {
+	var ready []*protocol.Message
+	for key, conv := range b.conversations {
+		if len(conv.pending) == 0 {
+			if now.Sub(conv.lastSeen) > reorderIdle {
+				delete(b.conversations, key)
+			}
+			continue
+		}
+		if now.Sub(conv.waiting) >= b.window {
+			ready = append(ready, conv.flush()...)
+		}
+	}
+	return ready
+}
+
+// flushAll gives up on every gap and returns all held messages, used on shutdown
+func (b *reorderBuffer) flushAll() []*protocol.Message {
+	var ready []*protocol.Message
+	for _, conv := range b.conversations {
+		ready = append(ready, conv.flush()...)
+	}
+	return ready
+}
+
+// held counts the messages waiting for a gap to fill
+func (b *reorderBuffer) held() int {
+	n := 0
+	for _, conv := range b.conversations {
+		n += len(conv.pending)
+	}
+	return n
+}
+
+// release removes consecutive messages starting at next
+func (c *conversationOrder) release() []*protocol.Message {
+	var ready []*protocol.Message
+	for {
+		message, ok := c.pending[c.next]
+		if !ok {
+			return ready
+		}
+		ready = append(ready, message)
+		delete(c.pending, c.next)
+		c.next++
+	}
+}
+
+// flush skips the current gaps and removes every pending message in order
+func (c *conversationOrder) flush() []*protocol.Message {
+	ready := make([]*protocol.Message, 0, len(c.pending))
+	for _, message := range c.pending {
+		ready = append(ready, message)
+	}
+	sort.Slice(ready, func(i, j int) bool { return ready[i].Seq < ready[j].Seq })
+	if len(ready) > 0 {
+		c.next = ready[len(ready)-1].Seq + 1
+	}
+	c.pending = make(map[int64]*protocol.Message)
+	return ready
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+)
+
+func directMessage(sender, recipient string, seq int64) *protocol.Message {
+	return &protocol.Message{Sender: sender, Recipient: recipient, Seq: seq}
+}
+
+func seqs(messages []*protocol.Message) []int64 {
+	out := make([]int64, len(messages))
+	for i, message := range messages {
+		out[i] = message.Seq
+	}
+	return out
+}
+
+func TestReorderReleasesInOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		arrival []int64
+		want    []int64
+	}{
+		{"second first", []int64{2, 1, 3}, []int64{1, 2, 3}},
+		{"in order", []int64{1, 2, 3, 4}, []int64{1, 2, 3, 4}},
+		{"reversed", []int64{4, 3, 2, 1}, []int64{1, 2, 3, 4}},
+		{"swapped pairs", []int64{1, 3, 2, 5, 4}, []int64{1, 2, 3, 4, 5}},
+		{"late first gap", []int64{1, 5, 4, 3, 6, 2}, []int64{1, 2, 3, 4, 5, 6}},
+		{"duplicate held", []int64{1, 3, 3, 2}, []int64{1, 2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newReorderBuffer(time.Minute)
+			now := time.Now()
+			var released []*protocol.Message
+			for _, seq := range tt.arrival {
+				// replies travel the other way round the same conversation
+				sender, recipient := "alice", "bob"
+				if seq%2 == 0 {
+					sender, recipient = recipient, sender
+				}
+				released = append(released, b.admit(directMessage(sender, recipient, seq), now)...)
+			}
+			if got := seqs(released); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Fatalf("released %v, want %v", got, tt.want)
+			}
+			if n := b.held(); n != 0 {
+				t.Fatalf("%d messages still held", n)
+			}
+		})
+	}
+}
+
+// TestReorderInterleavedConversations shuffles the messages of many conversations into one
+// stream, as concurrent senders would deliver them, and checks each conversation comes out FIFO
+func TestReorderInterleavedConversations(t *testing.T) {
+	const conversations, perConversation = 64, 40
+	rng := rand.New(rand.NewSource(1))
+	b := newReorderBuffer(time.Minute)
+	now := time.Now()
+
+	type stream struct {
+		first   *protocol.Message
+		pending []*protocol.Message
+	}
+	streams := make([]*stream, conversations)
+	for c := range streams {
+		newMessage := func(seq int64) *protocol.Message {
+			if c%4 == 0 {
+				return &protocol.Message{Sender: "alice", Room: fmt.Sprintf("room%d", c), Seq: seq}
+			}
+			a, z := fmt.Sprintf("a%d", c), fmt.Sprintf("z%d", c)
+			if rng.Intn(2) == 0 {
+				a, z = z, a
+			}
+			return directMessage(a, z, seq)
+		}
+		s := &stream{first: newMessage(1)}
+		for seq := int64(2); seq <= perConversation; seq++ {
+			s.pending = append(s.pending, newMessage(seq))
+		}
+		// out of order within a conversation, at most a few places from where it belongs
+		for i := range s.pending {
+			j := min(len(s.pending)-1, i+rng.Intn(4))
+			s.pending[i], s.pending[j] = s.pending[j], s.pending[i]
+		}
+		streams[c] = s
+	}
+
+	released := make(map[string][]int64)
+	collect := func(messages []*protocol.Message) {
+		for _, message := range messages {
+			key := orderingKey(message)
+			released[key] = append(released[key], message.Seq)
+		}
+	}
+	for _, s := range streams {
+		collect(b.admit(s.first, now))
+	}
+	for remaining := conversations * (perConversation - 1); remaining > 0; remaining-- {
+		var s *stream
+		for s == nil || len(s.pending) == 0 {
+			s = streams[rng.Intn(conversations)]
+		}
+		message := s.pending[0]
+		s.pending = s.pending[1:]
+		collect(b.admit(message, now))
+	}
+
+	if len(released) != conversations {
+		t.Fatalf("released %d conversations, want %d", len(released), conversations)
+	}
+	for key, got := range released {
+		if len(got) != perConversation {
+			t.Fatalf("conversation %q: released %d messages, want %d", key, len(got), perConversation)
+		}
+		for i, seq := range got {
+			if seq != int64(i+1) {
+				t.Fatalf("conversation %q released out of order: %v", key, got)
+			}
+		}
+	}
+	if n := b.held(); n != 0 {
+		t.Fatalf("%d messages still held", n)
+	}
+}
+
+func TestReorderStartsFromStoredSeq(t *testing.T) {
+	b := newReorderBuffer(time.Minute)
+	// seq 40 is the earliest stored within the window, earlier ones were released long ago
+	b.start = func(*protocol.Message) int64 { return 40 }
+	now := time.Now()
+	if got := b.admit(directMessage("bob", "alice", 41), now); len(got) != 0 {
+		t.Fatalf("released %v ahead of 40", seqs(got))
+	}
+	if got := b.admit(directMessage("alice", "bob", 40), now); fmt.Sprint(seqs(got)) != "[40 41]" {
+		t.Fatalf("released %v, want [40 41]", seqs(got))
+	}
+
+	// nothing stored before it, the first message to arrive starts the conversation
+	b.start = func(message *protocol.Message) int64 { return message.Seq }
+	if got := b.admit(directMessage("carol", "dave", 7), now); fmt.Sprint(seqs(got)) != "[7]" {
+		t.Fatalf("released %v, want [7]", seqs(got))
+	}
+}
+
+func TestReorderGapExpires(t *testing.T) {
+	const window = time.Second
+	b := newReorderBuffer(window)
+	start := time.Now()
+
+	b.admit(directMessage("alice", "bob", 1), start)
+	if got := b.admit(directMessage("bob", "alice", 3), start); len(got) != 0 {
+		t.Fatalf("released %v across a gap", seqs(got))
+	}
+	if got := b.expire(start.Add(window / 2)); len(got) != 0 {
+		t.Fatalf("released %v before the window passed", seqs(got))
+	}
+	got := b.expire(start.Add(window))
+	if fmt.Sprint(seqs(got)) != "[3]" {
+		t.Fatalf("expire released %v, want [3]", seqs(got))
+	}
+	// the missing message turns up after the gap was given up on, it isn't held back
+	if got := b.admit(directMessage("alice", "bob", 2), start.Add(2*window)); fmt.Sprint(seqs(got)) != "[2]" {
+		t.Fatalf("late message released as %v, want [2]", seqs(got))
+	}
+	if got := b.admit(directMessage("alice", "bob", 4), start.Add(2*window)); fmt.Sprint(seqs(got)) != "[4]" {
+		t.Fatalf("next message released as %v, want [4]", seqs(got))
+	}
+}
+
+func TestReorderDisabled(t *testing.T) {
+	b := newReorderBuffer(0)
+	now := time.Now()
+	b.admit(directMessage("alice", "bob", 1), now)
+	if got := b.admit(directMessage("alice", "bob", 3), now); fmt.Sprint(seqs(got)) != "[3]" {
+		t.Fatalf("released %v with reordering off, want [3]", seqs(got))
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+)
+
+// originPattern is one allowed origin, host may start with "*." to match any subdomain
+type originPattern struct {
+	scheme string
+	host   string // lower case, includes the port when one is given
+}
+
+// originPolicy decides which browser origins may open websocket connections
+type originPolicy struct {
+	allowAll bool // dev mode
+	patterns []originPattern
+	rejected atomic.Int64
+}
+
+// newOriginPolicy parses allowed origins such as "https://chat.example.com" or "https://*.example.com"
+func newOriginPolicy(allowed []string, devMode bool) (*originPolicy, error) {
+	p := &originPolicy{allowAll: devMode}
+	for _, origin := range allowed {
+		scheme, host, ok := strings.Cut(strings.ToLower(strings.TrimSuffix(origin, "/")), "://")
+		if !ok || (scheme != "http" && scheme != "https") || host == "" || strings.ContainsAny(host, "/?#@") {
+			return nil, fmt.Errorf("invalid allowed origin %q", origin)
+		}
+		if strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+			return nil, fmt.Errorf("invalid allowed origin %q: only a leading *. wildcard is supported", origin)
+		}
+		p.patterns = append(p.patterns, originPattern{scheme: scheme, host: host})
+	}
+	return p, nil
+}
+
+// check reports whether r may be upgraded. Requests without an Origin header come from
+// non-browser clients and are allowed, same-origin requests are always allowed
+func (p *originPolicy) check(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || p.allowAll {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	host := strings.ToLower(u.Host)
+	if host == strings.ToLower(r.Host) {
+		return true
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	for _, pattern := range p.patterns {
+		if pattern.scheme != scheme {
+			continue
+		}
+		if suffix, ok := strings.CutPrefix(pattern.host, "*"); ok {
+			// "*.example.com" matches "a.example.com" but not "example.com"
+			if strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+				return true
+			}
+		} else if pattern.host == host {
+			return true
+		}
+	}
+	return false
+}
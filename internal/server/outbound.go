@@ -0,0 +1,45 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// parseOutboundProxy validates the outbound proxy setting, returning nil when it is unset
+func parseOutboundProxy(raw string) (*url.URL, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return nil, fmt.Errorf("%q is not a socks5:// or socks5h:// URL", raw)
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("%q has no port", raw)
+	}
+	return u, nil
+}
+
+// outboundClient returns a client for requests to third party services, sent through
+// proxy when set. Host names are resolved by the proxy so lookups don't leak either.
+// Loopback destinations, such as an object store on the same machine, are reached directly
+func outboundClient(proxy *url.URL, timeout time.Duration) *http.Client {
+	if proxy == nil {
+		return &http.Client{Timeout: timeout}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = func(r *http.Request) (*url.URL, error) {
+		host := r.URL.Hostname()
+		if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+			return nil, nil
+		}
+		return proxy, nil
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}
+}
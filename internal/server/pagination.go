@@ -0,0 +1,93 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+)
+
+// List endpoints share one set of query parameters: limit caps the page size, cursor carries
+// on from the previous page's nextCursor, order=desc reverses the sort where it is supported
+// and q filters where it is supported. Cursors are opaque to clients.
+
+const defaultPageSize = 50
+
+// page is a parsed paging request
+type page struct {
+	Limit  int
+	Desc   bool
+	Query  string
+	cursor string
+}
+
+// pageCursor is what an encoded cursor holds, the sort order is kept so a cursor can't be
+// reused with the other order and silently skip entries
+type pageCursor struct {
+	Desc bool            `json:"d,omitempty"`
+	Pos  json.RawMessage `json:"p"`
+}
+
+// pageLimit reads ?limit=, falling back to def and capped at max
+func pageLimit(r *http.Request, def, max int) int {
+	limit := def
+	if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 {
+		limit = v
+	}
+	if limit > max {
+		limit = max
+	}
+	return limit
+}
+
+// readPage parses the paging parameters, sortable says whether the endpoint takes order=desc
+func readPage(r *http.Request, max int, sortable bool) (page, *apierror.Error) {
+	query := r.URL.Query()
+	p := page{
+		Limit:  pageLimit(r, min(defaultPageSize, max), max),
+		Query:  strings.TrimSpace(query.Get("q")),
+		cursor: query.Get("cursor"),
+	}
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		if !sortable {
+			return p, apierror.New(http.StatusBadRequest, apierror.InvalidRequest).With("detail", "this list can't be reordered")
+		}
+		p.Desc = true
+	default:
+		return p, apierror.New(http.StatusBadRequest, apierror.InvalidRequest).With("detail", "order must be asc or desc")
+	}
+	return p, nil
+}
+
+// after decodes the cursor into pos, returning false for the first page
+func (p page) after(pos interface{}) (bool, *apierror.Error) {
+	if p.cursor == "" {
+		return false, nil
+	}
+	var c pageCursor
+	data, err := base64.RawURLEncoding.DecodeString(p.cursor)
+	if err != nil || json.Unmarshal(data, &c) != nil || c.Desc != p.Desc || json.Unmarshal(c.Pos, pos) != nil {
+		return false, apierror.New(http.StatusBadRequest, apierror.InvalidCursor)
+	}
+	return true, nil
+}
+
+// respond writes resp, adding a nextCursor built from last when the page of count items is full
+func (p page) respond(w http.ResponseWriter, r *http.Request, resp map[string]interface{}, count int, last func() interface{}) {
+	if count == p.Limit {
+		resp["nextCursor"] = p.next(last())
+	}
+	respondWithETag(w, r, resp)
+}
+
+// next encodes pos as the cursor of the following page
+func (p page) next(pos interface{}) string {
+	raw, _ := json.Marshal(pos)
+	data, _ := json.Marshal(pageCursor{Desc: p.Desc, Pos: raw})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
@@ -0,0 +1,400 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/auth"
+	"github.com/Chase-Garrett/meadowlark/internal/passkey"
+)
+
+// PasskeyChallengeRequest defines JSON for starting a ceremony: the password for
+// POST /api/passkeys/challenge, an optional username for POST /api/login/passkey/challenge
+type PasskeyChallengeRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// PasskeyChallenge is a started ceremony, PublicKey is passed to navigator.credentials.create()
+// or navigator.credentials.get() with its binary fields decoded from base64url
+type PasskeyChallenge struct {
+	ChallengeID string      `json:"challengeId"`
+	PublicKey   interface{} `json:"publicKey"`
+}
+
+// PasskeyRegistrationRequest defines JSON for POST /api/passkeys
+type PasskeyRegistrationRequest struct {
+	ChallengeID string `json:"challengeId"`
+	Name        string `json:"name"` // label shown in the passkey list, e.g. "Laptop"
+	Credential  struct {
+		ID       passkey.Base64URL           `json:"id"`
+		Response passkey.AttestationResponse `json:"response"`
+	} `json:"credential"`
+}
+
+// PasskeyLoginRequest defines JSON for POST /api/login/passkey
+type PasskeyLoginRequest struct {
+	ChallengeID string `json:"challengeId"`
+	Credential  struct {
+		ID       passkey.Base64URL         `json:"id"`
+		Response passkey.AssertionResponse `json:"response"`
+	} `json:"credential"`
+	Scopes []string `json:"scopes,omitempty"` // like /api/login
+}
+
+// PasskeySettingsRequest defines JSON for PUT /api/passkeys/settings
+type PasskeySettingsRequest struct {
+	Required bool   `json:"required"` // password logins must be confirmed with a passkey
+	Password string `json:"password"` // needed either way, turning it on replaces the recovery codes
+}
+
+type credentialDescriptor struct {
+	Type string            `json:"type"`
+	ID   passkey.Base64URL `json:"id"`
+}
+
+func descriptors(creds []*passkey.Credential) []credentialDescriptor {
+	list := make([]credentialDescriptor, len(creds))
+	for i, c := range creds {
+		list[i] = credentialDescriptor{Type: "public-key", ID: c.ID}
+	}
+	return list
+}
+
+// relyingParty returns the passkey domain for r, the configured one or the request's host
+func (s *Server) relyingParty(r *http.Request) passkey.RelyingParty {
+	id := s.config.WebAuthnRPID
+	if id == "" {
+		id = r.Host
+		if host, _, err := net.SplitHostPort(r.Host); err == nil {
+			id = host
+		}
+	}
+	return passkey.RelyingParty{ID: strings.ToLower(id), Name: s.config.WebAuthnRPName, Origins: s.config.WebAuthnOrigins}
+}
+
+// passkeyError maps passkey storage errors to API errors, nil for unexpected ones
+func passkeyError(err error) *apierror.Error {
+	switch {
+	case errors.Is(err, passkey.ErrInvalidResponse):
+		return apierror.New(http.StatusBadRequest, apierror.InvalidPasskey).With("detail", err.Error())
+	case err == passkey.ErrNotFound:
+		return apierror.New(http.StatusNotFound, apierror.PasskeyNotFound)
+	case err == passkey.ErrChallengeExpired:
+		return apierror.New(http.StatusBadRequest, apierror.PasskeyChallengeExpired)
+	case err == passkey.ErrTooManyPasskeys:
+		return apierror.New(http.StatusConflict, apierror.TooManyPasskeys).With("max", passkey.MaxPasskeys)
+	case err == passkey.ErrAlreadyRegistered:
+		return apierror.New(http.StatusConflict, apierror.PasskeyAlreadyRegistered)
+	case err == passkey.ErrNoPasskeys:
+		return apierror.New(http.StatusConflict, apierror.NoPasskeys)
+	case err == passkey.ErrRequired:
+		return apierror.New(http.StatusConflict, apierror.LastPasskey)
+	}
+	return nil
+}
+
+func respondPasskeyError(w http.ResponseWriter, err error) {
+	if apiErr := passkeyError(err); apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+	respondInternalError(w, err)
+}
+
+// verifyPassword answers 401 and returns false unless password is username's
+func (s *Server) verifyPassword(w http.ResponseWriter, username, password string) bool {
+	err := s.userStorage.VerifyUser(username, password)
+	if err == auth.ErrInvalidCredentials {
+		respondError(w, apierror.New(http.StatusUnauthorized, apierror.InvalidCredentials))
+		return false
+	}
+	if err != nil {
+		respondInternalError(w, err)
+		return false
+	}
+	return true
+}
+
+// HandlePasskeys manages the caller's passkeys: GET /api/passkeys lists them, POST
+// /api/passkeys/challenge starts a registration (the password is asked again so a stolen token
+// can't add one), POST /api/passkeys finishes it, DELETE /api/passkeys/{id} removes one and
+// PUT /api/passkeys/settings turns the second factor requirement on or off, asking for the
+// password either way since turning it on hands out new recovery codes
+func (s *Server) HandlePasskeys(w http.ResponseWriter, r *http.Request, username string) {
+	rest := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/passkeys"), "/")
+	switch {
+	case rest == "" && r.Method == http.MethodGet:
+		creds, err := s.passkeys.List(username)
+		if err != nil {
+			respondInternalError(w, err)
+			return
+		}
+		required, err := s.passkeys.Required(username)
+		if err != nil {
+			respondInternalError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"passkeys": creds, "required": required})
+	case rest == "challenge" && r.Method == http.MethodPost:
+		s.beginPasskeyRegistration(w, r, username)
+	case rest == "" && r.Method == http.MethodPost:
+		s.finishPasskeyRegistration(w, r, username)
+	case rest == "settings" && r.Method == http.MethodPut:
+		var req PasskeySettingsRequest
+		if err := s.readJSON(w, r, &req); err != nil {
+			respondError(w, err)
+			return
+		}
+		if !s.verifyPassword(w, username, req.Password) {
+			return
+		}
+		if err := s.passkeys.SetRequired(username, req.Required); err != nil {
+			respondPasskeyError(w, err)
+			return
+		}
+		log.Printf("Passkey requirement for %s set to %v", username, req.Required)
+		if !req.Required {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		// a fresh set of recovery codes, so losing the passkeys doesn't lock the account
+		codes, err := s.userStorage.GenerateRecoveryCodes(username)
+		if err != nil {
+			respondInternalError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"required": true, "recoveryCodes": codes})
+	case rest != "" && r.Method == http.MethodDelete:
+		id, err := base64.RawURLEncoding.DecodeString(rest)
+		if err != nil {
+			respondError(w, apierror.New(http.StatusNotFound, apierror.PasskeyNotFound))
+			return
+		}
+		if err := s.passkeys.Delete(username, id); err != nil {
+			respondPasskeyError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		respondMethodNotAllowed(w)
+	}
+}
+
+func (s *Server) beginPasskeyRegistration(w http.ResponseWriter, r *http.Request, username string) {
+	var req PasskeyChallengeRequest
+	if err := s.readJSON(w, r, &req); err != nil {
+		respondError(w, err)
+		return
+	}
+	if !s.verifyPassword(w, username, req.Password) {
+		return
+	}
+	handle, err := s.passkeys.UserHandle(username)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	existing, err := s.passkeys.List(username)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+
+	rp := s.relyingParty(r)
+	id, c := s.passkeys.Begin(passkey.Register, username, rp.ID)
+	params := make([]map[string]interface{}, len(passkey.Algorithms))
+	for i, alg := range passkey.Algorithms {
+		params[i] = map[string]interface{}{"type": "public-key", "alg": alg}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PasskeyChallenge{ChallengeID: id, PublicKey: map[string]interface{}{
+		"challenge":          passkey.Base64URL(c.Challenge),
+		"rp":                 map[string]string{"id": rp.ID, "name": rp.Name},
+		"user":               map[string]interface{}{"id": passkey.Base64URL(handle), "name": username, "displayName": username},
+		"pubKeyCredParams":   params,
+		"timeout":            passkey.ChallengeTimeout.Milliseconds(),
+		"attestation":        "none",
+		"excludeCredentials": descriptors(existing),
+		"authenticatorSelection": map[string]string{
+			"residentKey":      "preferred",
+			"userVerification": "preferred",
+		},
+	}})
+}
+
+func (s *Server) finishPasskeyRegistration(w http.ResponseWriter, r *http.Request, username string) {
+	var req PasskeyRegistrationRequest
+	if err := s.readJSON(w, r, &req); err != nil {
+		respondError(w, err)
+		return
+	}
+	c, err := s.passkeys.Take(req.ChallengeID)
+	if err == nil && (c.Kind != passkey.Register || c.Username != username) {
+		err = passkey.ErrChallengeExpired
+	}
+	if err != nil {
+		respondPasskeyError(w, err)
+		return
+	}
+	rp := s.relyingParty(r)
+	rp.ID = c.RPID
+	id, publicKey, err := rp.VerifyRegistration(c.Challenge, req.Credential.Response)
+	if err != nil {
+		respondPasskeyError(w, err)
+		return
+	}
+	cred := &passkey.Credential{ID: id, Username: username, Name: req.Name, PublicKey: publicKey}
+	if err := s.passkeys.Add(cred); err != nil {
+		respondPasskeyError(w, err)
+		return
+	}
+	log.Printf("Passkey registered for %s", username)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(cred)
+}
+
+// assertionOptions starts a login ceremony, limited to username's passkeys when it is set
+func (s *Server) assertionOptions(r *http.Request, kind, username string) (*PasskeyChallenge, error) {
+	var allowed []credentialDescriptor
+	userVerification := "required"
+	if kind == passkey.SecondFactor {
+		// the password already stands for the user, the passkey only has to be present
+		userVerification = "discouraged"
+	}
+	if username != "" {
+		creds, err := s.passkeys.List(username)
+		if err != nil {
+			return nil, err
+		}
+		allowed = descriptors(creds)
+	}
+	rp := s.relyingParty(r)
+	id, c := s.passkeys.Begin(kind, username, rp.ID)
+	options := map[string]interface{}{
+		"challenge":        passkey.Base64URL(c.Challenge),
+		"rpId":             rp.ID,
+		"timeout":          passkey.ChallengeTimeout.Milliseconds(),
+		"userVerification": userVerification,
+	}
+	if len(allowed) > 0 {
+		options["allowCredentials"] = allowed
+	}
+	return &PasskeyChallenge{ChallengeID: id, PublicKey: options}, nil
+}
+
+// HandlePasskeyLoginChallenge starts a passwordless login at /api/login/passkey/challenge. With
+// a username only that account's passkeys are offered, otherwise the authenticator picks one
+func (s *Server) HandlePasskeyLoginChallenge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respondMethodNotAllowed(w)
+		return
+	}
+	if s.rejectDuringMaintenance(w) {
+		return
+	}
+	var req PasskeyChallengeRequest
+	if err := s.readJSON(w, r, &req); err != nil {
+		respondError(w, err)
+		return
+	}
+	username := ""
+	if req.Username != "" {
+		found, err := s.userStorage.LookupLogin(req.Username)
+		if err != nil && err != auth.ErrInvalidCredentials {
+			respondInternalError(w, err)
+			return
+		}
+		username = found
+	}
+	challenge, err := s.assertionOptions(r, passkey.Login, username)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(challenge)
+}
+
+// HandlePasskeyLogin finishes a passkey login at /api/login/passkey, either a passwordless one
+// or the second step of a password login, and issues a token
+func (s *Server) HandlePasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respondMethodNotAllowed(w)
+		return
+	}
+	if s.rejectDuringMaintenance(w) {
+		return
+	}
+	var req PasskeyLoginRequest
+	if err := s.readJSON(w, r, &req); err != nil {
+		respondError(w, err)
+		return
+	}
+	jkt, apiErr := s.loginBinding(r)
+	if apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+
+	c, err := s.passkeys.Take(req.ChallengeID)
+	if err == nil && c.Kind != passkey.Login && c.Kind != passkey.SecondFactor {
+		err = passkey.ErrChallengeExpired
+	}
+	if err != nil {
+		respondPasskeyError(w, err)
+		return
+	}
+
+	// which passkey answered isn't told apart from a bad signature, so logins can't probe for them
+	invalid := apierror.New(http.StatusUnauthorized, apierror.InvalidPasskey)
+	cred, err := s.passkeys.Get(req.Credential.ID)
+	if err == passkey.ErrNotFound || (err == nil && c.Username != "" && cred.Username != c.Username) {
+		respondError(w, invalid)
+		return
+	}
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	rp := s.relyingParty(r)
+	rp.ID = c.RPID
+	signCount, err := rp.VerifyAssertion(c.Challenge, cred, req.Credential.Response, c.Kind == passkey.Login)
+	if errors.Is(err, passkey.ErrInvalidResponse) {
+		log.Printf("Passkey login for %s refused: %v", cred.Username, err)
+		respondError(w, invalid)
+		return
+	}
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	if err := s.passkeys.Used(cred.ID, signCount); err != nil {
+		respondInternalError(w, err)
+		return
+	}
+
+	scopes, apiErr := s.tokenScopes(cred.Username, req.Scopes, nil)
+	if apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+	token, err := s.issueToken(cred.Username, auth.TokenOptions{JKT: jkt, Scopes: scopes})
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LoginResponse{Token: token, Username: cred.Username, Scopes: scopes, Welcome: s.onboard(cred.Username)})
+	log.Printf("User logged in with a passkey: %s from %s", cred.Username, s.clientIP(r))
+	s.noticeOrigin(cred.Username, s.clientIP(r), r.UserAgent(), "passkey")
+}
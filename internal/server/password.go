@@ -0,0 +1,120 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/auth"
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+	"github.com/Chase-Garrett/meadowlark/internal/sessions"
+)
+
+// PasswordChangeRequest defines JSON for POST /api/password/change
+type PasswordChangeRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+// issueToken issues a token for username carrying the user's current token version, so it
+// stops working when the password changes, and the workspace, so no other workspace takes it
+func (s *Server) issueToken(username string, opts auth.TokenOptions) (string, error) {
+	version, err := s.userStorage.TokenVersion(username)
+	if err != nil {
+		return "", err
+	}
+	opts.Version, opts.Tenant = version, s.config.Tenant
+	return auth.IssueToken(username, opts)
+}
+
+// tokenCurrent reports whether a token for username was issued by workspace tenant since the
+// password last changed
+func tokenCurrent(users UserStore, tenant, username string, claims *auth.UserClaims) bool {
+	if claims.Tenant() != tenant {
+		return false
+	}
+	version, err := users.TokenVersion(username)
+	if err != nil {
+		log.Printf("Error reading token version of %s: %v", username, err)
+		return false
+	}
+	return claims.Version == version
+}
+
+// HandleChangePassword changes the caller's password at POST /api/password/change. Every token
+// issued before stops working and open connections are closed; the response carries a new
+// token bound and scoped like the one the request came with
+func (s *Server) HandleChangePassword(w http.ResponseWriter, r *http.Request, username string) {
+	if r.Method != http.MethodPost {
+		respondMethodNotAllowed(w)
+		return
+	}
+	var req PasswordChangeRequest
+	if err := s.readJSON(w, r, &req); err != nil {
+		respondError(w, err)
+		return
+	}
+	if req.CurrentPassword == "" || req.NewPassword == "" {
+		respondError(w, apierror.New(http.StatusBadRequest, apierror.MissingCredentials))
+		return
+	}
+
+	switch err := s.userStorage.ChangePassword(username, req.CurrentPassword, req.NewPassword); err {
+	case nil:
+	case auth.ErrInvalidCredentials:
+		respondError(w, apierror.New(http.StatusUnauthorized, apierror.InvalidCredentials))
+		return
+	case auth.ErrPasswordTooShort:
+		respondError(w, apierror.New(http.StatusBadRequest, apierror.PasswordTooShort).With("min", auth.MinPasswordLength))
+		return
+	default:
+		respondInternalError(w, err)
+		return
+	}
+	log.Printf("User %s changed their password from %s", username, s.clientIP(r))
+	s.sessions.Record(sessions.Event{
+		Username:  username,
+		Kind:      sessions.EventPasswordChanged,
+		IP:        s.clientIP(r),
+		UserAgent: r.UserAgent(),
+	})
+	// open connections were authenticated with tokens that no longer work
+	s.hub.Disconnect(username, protocol.CloseAuthExpired, protocol.CloseReason{Code: apierror.PasswordChanged})
+
+	var opts auth.TokenOptions
+	if claims := requestClaims(r); claims != nil {
+		opts = auth.TokenOptions{JKT: claims.BoundTo(), Scopes: strings.Fields(claims.Scope)}
+	}
+	token, err := s.issueToken(username, opts)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LoginResponse{Token: token, Username: username, Scopes: opts.Scopes})
+}
+
+// resetPassword replaces the password of an account with a sign-in reported as not the user's,
+// at login once everything else was checked. Writes the error response and returns false when
+// the new password is refused
+func (s *Server) resetPassword(w http.ResponseWriter, r *http.Request, username, current, password string) bool {
+	switch err := s.userStorage.ChangePassword(username, current, password); err {
+	case nil:
+	case auth.ErrPasswordTooShort:
+		respondError(w, apierror.New(http.StatusBadRequest, apierror.PasswordTooShort).With("min", auth.MinPasswordLength))
+		return false
+	default:
+		respondInternalError(w, err)
+		return false
+	}
+	log.Printf("User %s chose a new password from %s after reporting a sign-in", username, s.clientIP(r))
+	s.sessions.Record(sessions.Event{
+		Username:  username,
+		Kind:      sessions.EventPasswordChanged,
+		IP:        s.clientIP(r),
+		UserAgent: r.UserAgent(),
+	})
+	return true
+}
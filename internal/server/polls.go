@@ -0,0 +1,227 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+	"github.com/Chase-Garrett/meadowlark/internal/rooms"
+)
+
+const maxPollsPage = 100
+
+// how often polls past their deadline are looked for and closed
+const pollCloseInterval = 30 * time.Second
+
+// PollRequest defines JSON for POST /api/rooms/{id}/polls
+type PollRequest struct {
+	Content   []byte     `json:"content"` // the question and choices, encrypted for members
+	Options   int        `json:"options"` // how many choices Content holds
+	Anonymous bool       `json:"anonymous"`
+	ClosesAt  *time.Time `json:"closesAt"`
+}
+
+// VoteRequest defines JSON for PUT /api/rooms/{id}/polls/{poll}/vote
+type VoteRequest struct {
+	Option *int `json:"option"` // index of the choice
+}
+
+// handleRoomPolls lists and creates a room's polls (/polls), and with idPart shows or deletes one
+// (/polls/{poll}), votes in it (/polls/{poll}/vote) or closes it early (/polls/{poll}/close)
+func (s *Server) handleRoomPolls(w http.ResponseWriter, r *http.Request, roomID, username, idPart string) {
+	role, ok := s.roomRole(w, roomID, username, rooms.RoleMember)
+	if !ok {
+		return
+	}
+	if idPart == "" {
+		switch r.Method {
+		case http.MethodGet:
+			s.listRoomPolls(w, r, roomID, username)
+		case http.MethodPost:
+			s.createRoomPoll(w, r, roomID, username)
+		default:
+			respondMethodNotAllowed(w)
+		}
+		return
+	}
+
+	idPart, action, _ := strings.Cut(idPart, "/")
+	id, err := strconv.ParseInt(idPart, 10, 64)
+	if err != nil {
+		respondError(w, apierror.New(http.StatusNotFound, apierror.PollNotFound))
+		return
+	}
+	if action == "vote" {
+		s.handleVote(w, r, roomID, username, id)
+		return
+	}
+	if action != "" && action != "close" {
+		respondError(w, apierror.New(http.StatusNotFound, apierror.NotFound))
+		return
+	}
+
+	poll, err := s.rooms.Poll(roomID, id, username)
+	if err != nil {
+		respondRoomError(w, err)
+		return
+	}
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(poll)
+		return
+	case action == "" && r.Method == http.MethodDelete, action == "close" && r.Method == http.MethodPost:
+	default:
+		respondMethodNotAllowed(w)
+		return
+	}
+	// the creator manages their own polls, moderators anyone's
+	if poll.Creator != username && !rooms.AtLeast(role, rooms.RoleModerator) {
+		respondError(w, apierror.New(http.StatusForbidden, apierror.RoomForbidden).With("role", rooms.RoleModerator))
+		return
+	}
+
+	if action == "" {
+		if err := s.rooms.DeletePoll(roomID, id); err != nil {
+			respondRoomError(w, err)
+			return
+		}
+		s.hub.NotifyRoom(roomID, protocol.EventRoomPoll, map[string]interface{}{
+			"room": roomID, "action": protocol.PollDeleted, "id": id, "by": username,
+		})
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err := s.rooms.ClosePoll(roomID, id); err != nil {
+		respondRoomError(w, err)
+		return
+	}
+	closed, err := s.rooms.Poll(roomID, id, "")
+	if err != nil {
+		respondRoomError(w, err)
+		return
+	}
+	s.hub.NotifyRoom(roomID, protocol.EventRoomPoll, map[string]interface{}{
+		"room": roomID, "action": protocol.PollClosed, "poll": closed, "by": username,
+	})
+	closed.MyVote = poll.MyVote
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(closed)
+}
+
+// listRoomPolls pages through a room's polls, newest first
+func (s *Server) listRoomPolls(w http.ResponseWriter, r *http.Request, roomID, username string) {
+	p, apiErr := readPage(r, maxPollsPage, false)
+	if apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+	var before int64
+	if _, apiErr := p.after(&before); apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+	polls, err := s.rooms.Polls(roomID, before, p.Limit, username)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	p.respond(w, r, map[string]interface{}{"polls": polls}, len(polls), func() interface{} {
+		return polls[len(polls)-1].ID
+	})
+}
+
+// createRoomPoll adds a poll, which takes the same right as posting a message to the room
+func (s *Server) createRoomPoll(w http.ResponseWriter, r *http.Request, roomID, username string) {
+	snap, err := s.rooms.Snapshot(roomID)
+	if err != nil {
+		respondRoomError(w, err)
+		return
+	}
+	if apiErr := roomPostError(snap, username); apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+	var req PollRequest
+	if err := s.readJSON(w, r, &req); err != nil {
+		respondError(w, err)
+		return
+	}
+	poll := &rooms.Poll{
+		Room:      roomID,
+		Creator:   username,
+		Content:   req.Content,
+		Options:   req.Options,
+		Anonymous: req.Anonymous,
+		ClosesAt:  req.ClosesAt,
+	}
+	if err := s.rooms.AddPoll(poll); err != nil {
+		respondRoomError(w, err)
+		return
+	}
+	s.hub.NotifyRoom(roomID, protocol.EventRoomPoll, map[string]interface{}{
+		"room": roomID, "action": protocol.PollCreated, "poll": poll, "by": username,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(poll)
+}
+
+// handleVote casts or changes (PUT) or withdraws (DELETE) the caller's vote and streams the
+// new tally to the room
+func (s *Server) handleVote(w http.ResponseWriter, r *http.Request, roomID, username string, id int64) {
+	option := -1
+	switch r.Method {
+	case http.MethodPut:
+		var req VoteRequest
+		if err := s.readJSON(w, r, &req); err != nil {
+			respondError(w, err)
+			return
+		}
+		if req.Option == nil || *req.Option < 0 {
+			respondError(w, apierror.New(http.StatusBadRequest, apierror.InvalidVote))
+			return
+		}
+		option = *req.Option
+	case http.MethodDelete:
+	default:
+		respondMethodNotAllowed(w)
+		return
+	}
+	poll, err := s.rooms.Vote(roomID, id, username, option)
+	if err != nil {
+		respondRoomError(w, err)
+		return
+	}
+	s.notifyPollTally(poll)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(poll)
+}
+
+// notifyPollTally sends a poll's current tally, and its votes unless it is anonymous, to the room
+func (s *Server) notifyPollTally(poll *rooms.Poll) {
+	data := map[string]interface{}{"room": poll.Room, "poll": poll.ID, "tally": poll.Tally}
+	if !poll.Anonymous {
+		data["votes"] = poll.Votes
+	}
+	s.hub.NotifyRoom(poll.Room, protocol.EventRoomPollTally, data)
+}
+
+// closeDuePolls closes polls as their deadlines pass
+func (s *Server) closeDuePolls(now time.Time) error {
+	closed, err := s.rooms.CloseDuePolls(now)
+	if err != nil {
+		return fmt.Errorf("closing polls past their deadline: %w", err)
+	}
+	for _, poll := range closed {
+		s.hub.NotifyRoom(poll.Room, protocol.EventRoomPoll, map[string]interface{}{
+			"room": poll.Room, "action": protocol.PollClosed, "poll": poll,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/auth"
+	"github.com/Chase-Garrett/meadowlark/internal/notifications"
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+)
+
+// presence statuses shown to contacts besides available and busy, which users can also choose
+const (
+	presenceAway         = "away" // connected but idle
+	presenceDoNotDisturb = "dnd"  // in one of their do-not-disturb windows
+	presenceOffline      = "offline"
+)
+
+// Presence is whether a user is connected and when they last were
+type Presence struct {
+	Username string     `json:"username"`
+	Online   bool       `json:"online"`
+	Status   string     `json:"status"`             // available, away, busy, dnd or offline
+	LastSeen *time.Time `json:"lastSeen,omitempty"` // unset if they haven't connected since last-seen tracking began
+}
+
+// statusChange applies a status a user chose to their connection
+type statusChange struct {
+	username string
+	status   string
+}
+
+// dndChange applies a user's new do-not-disturb schedule to their connection
+type dndChange struct {
+	username string
+	dnd      notifications.DoNotDisturb
+}
+
+// presenceQuery asks the hub about several users at once
+type presenceQuery struct {
+	usernames []string
+	reply     chan []Presence
+}
+
+// presenceOf reports on usernames, called from the hub goroutine
+func (h *Hub) presenceOf(usernames []string) []Presence {
+	now := time.Now()
+	result := make([]Presence, 0, len(usernames))
+	for _, username := range usernames {
+		result = append(result, h.presenceNow(username, now))
+	}
+	return result
+}
+
+// presenceNow works out how username appears to contacts: invisible users look offline,
+// do-not-disturb comes next, then a status they chose, otherwise they are away once idle.
+// Called from the hub goroutine
+func (h *Hub) presenceNow(username string, now time.Time) Presence {
+	p := Presence{Username: username, Status: presenceOffline}
+	if seen, ok := h.lastSeen[username]; ok {
+		p.LastSeen = &seen
+	}
+	client, ok := h.clients[username]
+	if !ok || client.status == auth.StatusInvisible {
+		return p
+	}
+	p.Online = true
+	switch {
+	case client.dnd.Active(now):
+		p.Status = presenceDoNotDisturb
+	case client.status != "":
+		p.Status = client.status
+	case h.idleTimeout > 0 && now.Sub(client.activeAt()) >= h.idleTimeout:
+		p.Status = presenceAway
+	default:
+		p.Status = auth.StatusAvailable
+	}
+	return p
+}
+
+// announce tells username's contacts when how they appear has changed since they were last
+// told, called from the hub goroutine
+func (h *Hub) announce(username string, now time.Time) {
+	p := h.presenceNow(username, now)
+	shown, ok := h.shown[username]
+	if !ok {
+		shown = presenceOffline
+	}
+	if p.Status == shown {
+		return
+	}
+	if p.Status == presenceOffline {
+		delete(h.shown, username)
+	} else {
+		h.shown[username] = p.Status
+	}
+	// looking up the contacts touches the database, so it happens off the hub goroutine
+	go func() {
+		contacts, err := h.messages.Correspondents(username)
+		if err != nil {
+			log.Printf("Error loading the contacts of %s: %v", username, err)
+			return
+		}
+		for _, contact := range contacts {
+			h.forward <- protocol.NewControlMessage(contact, protocol.EventPresence, p)
+		}
+	}()
+}
+
+// remove drops a client that has disconnected, called from the hub goroutine
+func (h *Hub) remove(client *Client) {
+	delete(h.clients, client.username)
+	// invisible users were last seen when they went invisible
+	if client.status != auth.StatusInvisible {
+		h.lastSeen[client.username] = time.Now()
+	}
+	h.announce(client.username, time.Now())
+}
+
+// changeStatus applies a status the user chose to their connection, if they have one.
+// Going invisible counts as leaving and coming back as arriving, for the last seen time
+func (h *Hub) changeStatus(change statusChange) {
+	now := time.Now()
+	if client, ok := h.clients[change.username]; ok {
+		if (client.status == auth.StatusInvisible) != (change.status == auth.StatusInvisible) {
+			h.lastSeen[change.username] = now
+		}
+		client.status = change.status
+	}
+	h.announce(change.username, now)
+}
+
+// HandlePresence lists whether the people the caller has exchanged messages with are online
+// and when they were last seen. Other users' presence isn't shown to avoid leaking activity
+func (s *Server) HandlePresence(w http.ResponseWriter, r *http.Request, username string) {
+	contacts, err := s.messages.Correspondents(username)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	presence, err := s.hub.Presence(r.Context(), contacts)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"presence": presence})
+}
+
+// StatusRequest defines JSON for PUT /api/status
+type StatusRequest struct {
+	Status string `json:"status"` // "available", "busy", "invisible" or empty for automatic
+}
+
+// HandleStatus shows (GET) or chooses (PUT) the caller's presence status, with how they
+// appear to their contacts
+func (s *Server) HandleStatus(w http.ResponseWriter, r *http.Request, username string) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req StatusRequest
+		if apiErr := s.readJSON(w, r, &req); apiErr != nil {
+			respondError(w, apiErr)
+			return
+		}
+		if err := s.userStorage.SetStatus(username, req.Status); err != nil {
+			if errors.Is(err, auth.ErrInvalidStatus) {
+				respondError(w, apierror.Invalid(err))
+				return
+			}
+			respondInternalError(w, err)
+			return
+		}
+		s.hub.SetStatus(username, req.Status)
+	default:
+		respondMethodNotAllowed(w)
+		return
+	}
+
+	status, err := s.userStorage.Status(username)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	presence, err := s.hub.Presence(r.Context(), []string{username})
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": status, "presence": presence[0]})
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/preview"
+)
+
+// PreviewRequest defines JSON for POST /api/preview
+type PreviewRequest struct {
+	URL string `json:"url"`
+}
+
+// HandlePreview fetches Open Graph metadata for a link so clients never contact the site directly
+func (s *Server) HandlePreview(w http.ResponseWriter, r *http.Request, username string) {
+	if !s.config.PreviewEnabled {
+		respondError(w, apierror.New(http.StatusNotFound, apierror.PreviewsDisabled))
+		return
+	}
+
+	var req PreviewRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		respondError(w, apierror.New(http.StatusBadRequest, apierror.InvalidJSON))
+		return
+	}
+
+	p, err := s.previews.Fetch(r.Context(), req.URL)
+	if errors.Is(err, preview.ErrBlockedAddress) {
+		log.Printf("Blocked preview request from %s for %s", username, req.URL)
+		respondError(w, apierror.New(http.StatusUnprocessableEntity, apierror.PreviewBlocked))
+		return
+	}
+	if err != nil {
+		respondError(w, apierror.New(http.StatusUnprocessableEntity, apierror.PreviewFailed).With("detail", err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// proxyPolicy finds the real client address of requests relayed by trusted reverse proxies
+type proxyPolicy struct {
+	trusted []*net.IPNet
+}
+
+// newProxyPolicy parses trusted proxies given as CIDRs ("10.0.0.0/8") or single addresses
+func newProxyPolicy(trusted []string) (*proxyPolicy, error) {
+	p := &proxyPolicy{}
+	for _, entry := range trusted {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			p.trusted = append(p.trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", entry, err)
+		}
+		p.trusted = append(p.trusted, network)
+	}
+	return p, nil
+}
+
+func (p *proxyPolicy) isTrusted(ip net.IP) bool {
+	for _, network := range p.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address a request came from. Forwarding headers are only read when
+// the connection comes from a trusted proxy or a unix socket, and X-Forwarded-For is walked from the right,
+// past any further trusted proxies, since entries to the left can be made up by the client
+func (p *proxyPolicy) clientIP(r *http.Request) string {
+	remote := parseForwardedIP(r.RemoteAddr)
+	local := isLocalSocket(r)
+	if remote == nil && !local {
+		return r.RemoteAddr
+	}
+	if !local && !p.isTrusted(remote) {
+		return remote.String()
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseForwardedIP(hops[i])
+		if ip == nil {
+			// a malformed entry ends the chain we can vouch for
+			break
+		}
+		if !p.isTrusted(ip) || i == 0 {
+			return ip.String()
+		}
+	}
+	if ip := parseForwardedIP(r.Header.Get("X-Real-IP")); ip != nil {
+		return ip.String()
+	}
+	if remote == nil {
+		return r.RemoteAddr
+	}
+	return remote.String()
+}
+
+// scheme returns "https" or "http" for the URL the client used, trusting X-Forwarded-Proto
+// only from the same proxies clientIP trusts
+func (p *proxyPolicy) scheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	remote := parseForwardedIP(r.RemoteAddr)
+	if isLocalSocket(r) || (remote != nil && p.isTrusted(remote)) {
+		if proto := strings.ToLower(strings.TrimSpace(r.Header.Get("X-Forwarded-Proto"))); proto == "https" || proto == "http" {
+			return proto
+		}
+	}
+	return "http"
+}
+
+// parseForwardedIP accepts "1.2.3.4", "1.2.3.4:80", "2001:db8::1" and "[2001:db8::1]:80"
+func parseForwardedIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	return net.ParseIP(strings.Trim(s, "[]"))
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+	"github.com/Chase-Garrett/meadowlark/internal/rooms"
+)
+
+const maxPublicPostsPage = 100
+
+// public pages may be cached by browsers and proxies for this long, in seconds
+const publicCacheMaxAge = 60
+
+// PublicPostRequest defines JSON for POST /api/rooms/{id}/public
+type PublicPostRequest struct {
+	Text string `json:"text"`
+}
+
+// PublicRoom is the part of a broadcasting room shown on its public page, without members or gates
+type PublicRoom struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Topic       string `json:"topic"`
+	Description string `json:"description"`
+	AvatarURL   string `json:"avatarUrl,omitempty"`
+}
+
+// broadcastError refuses to turn broadcasting on when public room pages are disabled
+func (s *Server) broadcastError(req *RoomRequest) *apierror.Error {
+	if req.Broadcast != nil && *req.Broadcast && !s.config.PublicRooms {
+		return apierror.New(http.StatusForbidden, apierror.PublicRoomsDisabled)
+	}
+	return nil
+}
+
+// handlePublicPosts publishes (POST) or removes (DELETE /public/{id}) a room's unencrypted
+// public posts (owners and moderators)
+func (s *Server) handlePublicPosts(w http.ResponseWriter, r *http.Request, roomID, username, idPart string) {
+	if !s.config.PublicRooms {
+		respondError(w, apierror.New(http.StatusForbidden, apierror.PublicRoomsDisabled))
+		return
+	}
+	if _, ok := s.roomRole(w, roomID, username, rooms.RoleModerator); !ok {
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && idPart == "":
+		var req PublicPostRequest
+		if err := s.readJSON(w, r, &req); err != nil {
+			respondError(w, err)
+			return
+		}
+		post, err := s.rooms.AddPublicPost(roomID, username, req.Text)
+		if err != nil {
+			respondRoomError(w, err)
+			return
+		}
+		s.hub.NotifyRoom(roomID, protocol.EventRoomPublicPost, map[string]interface{}{
+			"room": roomID, "action": protocol.PublicPostAdded, "post": post, "by": username,
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(post)
+	case r.Method == http.MethodDelete && idPart != "":
+		id, err := strconv.ParseInt(idPart, 10, 64)
+		if err != nil {
+			respondError(w, apierror.New(http.StatusNotFound, apierror.PublicPostNotFound))
+			return
+		}
+		if err := s.rooms.DeletePublicPost(roomID, id); err != nil {
+			respondRoomError(w, err)
+			return
+		}
+		s.hub.NotifyRoom(roomID, protocol.EventRoomPublicPost, map[string]interface{}{
+			"room": roomID, "action": protocol.PublicPostDeleted, "id": id, "by": username,
+		})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		respondMethodNotAllowed(w)
+	}
+}
+
+// publicPage is what the public room template renders
+type publicPage struct {
+	Room     PublicRoom
+	Posts    []rooms.PublicPost
+	BasePath string
+	Next     string // cursor of older posts, empty on the last page
+}
+
+var publicRoomTemplate = template.Must(template.New("room").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Room.Name}}</title>
+{{if .Room.Topic}}<meta name="description" content="{{.Room.Topic}}">
+{{end}}<link rel="alternate" type="application/json" href="{{.BasePath}}/public/rooms/{{.Room.ID}}.json">
+<link rel="alternate" type="application/atom+xml" title="{{.Room.Name}}" href="{{.BasePath}}/feeds/rooms/{{.Room.ID}}.xml">
+<style>
+body { font-family: system-ui, sans-serif; max-width: 40rem; margin: 2rem auto; padding: 0 1rem; color: #222; }
+header img { width: 4rem; height: 4rem; border-radius: 50%; float: left; margin-right: 1rem; }
+header { overflow: hidden; margin-bottom: 2rem; }
+.topic { color: #555; }
+.description, .text { white-space: pre-wrap; }
+article { border-top: 1px solid #ddd; padding: 1rem 0; }
+.meta { color: #777; font-size: 0.875rem; }
+</style>
+</head>
+<body>
+<header>
+{{if .Room.AvatarURL}}<img src="{{.Room.AvatarURL}}" alt="">
+{{end}}<h1>{{.Room.Name}}</h1>
+{{if .Room.Topic}}<p class="topic">{{.Room.Topic}}</p>
+{{end}}{{if .Room.Description}}<p class="description">{{.Room.Description}}</p>
+{{end}}</header>
+<main>
+{{range .Posts}}<article>
+<p class="meta">{{.Author}} &middot; <time datetime="{{.CreatedAt.UTC.Format "2006-01-02T15:04:05Z07:00"}}">{{.CreatedAt.UTC.Format "2 Jan 2006 15:04 MST"}}</time></p>
+<p class="text">{{.Text}}</p>
+</article>
+{{else}}<p>Nothing has been posted yet.</p>
+{{end}}{{if .Next}}<p><a href="?cursor={{.Next}}">Older posts</a></p>
+{{end}}</main>
+</body>
+</html>
+`))
+
+// HandlePublicRoom serves /public/rooms/{id} as a read-only HTML page of a broadcasting room's
+// public posts, newest first, and /public/rooms/{id}.json as the same page in JSON. No
+// authentication: only posts explicitly published unencrypted are shown, never room messages
+func (s *Server) HandlePublicRoom(w http.ResponseWriter, r *http.Request) {
+	roomID := strings.TrimPrefix(r.URL.Path, "/public/rooms/")
+	roomID, asJSON := strings.CutSuffix(roomID, ".json")
+	if !s.config.PublicRooms || roomID == "" || strings.Contains(roomID, "/") {
+		respondError(w, apierror.New(http.StatusNotFound, apierror.NotFound))
+		return
+	}
+	room, err := s.rooms.Broadcasting(roomID)
+	if err != nil {
+		respondRoomError(w, err)
+		return
+	}
+
+	p, apiErr := readPage(r, maxPublicPostsPage, false)
+	if apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+	var before int64
+	if _, apiErr := p.after(&before); apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+	posts, err := s.rooms.PublicPosts(roomID, before, p.Limit)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	updated, err := s.rooms.PublicUpdated(roomID)
+	if err != nil {
+		respondRoomError(w, err)
+		return
+	}
+
+	page := publicPage{
+		Room: PublicRoom{
+			ID:          room.ID,
+			Name:        room.Name,
+			Topic:       room.Topic,
+			Description: room.Description,
+			AvatarURL:   room.AvatarURL,
+		},
+		Posts:    posts,
+		BasePath: s.config.BasePath,
+	}
+	if len(posts) == p.Limit {
+		page.Next = p.next(posts[len(posts)-1].ID)
+	}
+
+	if asJSON {
+		resp := map[string]interface{}{"room": page.Room, "posts": posts}
+		if page.Next != "" {
+			resp["nextCursor"] = page.Next
+		}
+		data, err := json.Marshal(resp)
+		if err != nil {
+			respondInternalError(w, err)
+			return
+		}
+		respondPublic(w, r, "application/json", updated, append(data, '\n'))
+		return
+	}
+	var buf bytes.Buffer
+	if err := publicRoomTemplate.Execute(&buf, page); err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	// the page runs no scripts and only loads the room avatar from this server
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; img-src 'self'; style-src 'unsafe-inline'")
+	respondPublic(w, r, "text/html; charset=utf-8", updated, buf.Bytes())
+}
+
+// respondPublic writes a response anyone may cache briefly. The ETag and modified, when it
+// isn't zero, let caches revalidate with If-None-Match and If-Modified-Since
+func respondPublic(w http.ResponseWriter, r *http.Request, contentType string, modified time.Time, data []byte) {
+	sum := sha256.Sum256(data)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(publicCacheMaxAge))
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", modified, bytes.NewReader(data))
+}
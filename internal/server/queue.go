@@ -0,0 +1,199 @@
+package server
+
+import "github.com/Chase-Garrett/meadowlark/internal/protocol"
+
+// lane is a per client send queue, lower values are written first
+type lane int
+
+const (
+	laneControl lane = iota // typing, presence and other small control frames
+	laneContent             // live chat messages
+	laneBulk                // history replays and other large transfers, alongside streams
+	laneCount
+)
+
+// buffer size of each lane
+var laneBuffers = [laneCount]int{
+	laneControl: 64,
+	laneContent: 256,
+	laneBulk:    256,
+}
+
+// maxPriorityBurst is how many times waiting lower priority messages may be
+// passed over before one of them is written regardless of priority
+const maxPriorityBurst = 16
+
+// laneFor picks the lane a message is queued on
+func laneFor(message *protocol.Message) lane {
+	if message.Type == protocol.TypeControl {
+		return laneControl
+	}
+	return laneContent
+}
+
+// sendQueues holds a client's prioritized outgoing messages
+type sendQueues struct {
+	lanes  [laneCount]chan *protocol.Message
+	closed chan struct{}
+	// transfers with their own flow control, written at bulk priority
+	streams streamSet
+
+	// only touched by the hub goroutine, read by writePump once closed
+	isClosed    bool
+	closeCode   int    // sent in the close frame, 0 for a plain close
+	closeReason string // JSON encoded protocol.CloseReason
+	// only touched by writePump
+	skipped int
+}
+
+func newSendQueues() *sendQueues {
+	q := &sendQueues{closed: make(chan struct{})}
+	q.streams.ready = make(chan struct{}, 1)
+	for i := range q.lanes {
+		q.lanes[i] = make(chan *protocol.Message, laneBuffers[i])
+	}
+	return q
+}
+
+// push queues message on its lane without blocking, returns false if the lane is full
+func (q *sendQueues) push(message *protocol.Message) bool {
+	select {
+	case q.lanes[laneFor(message)] <- message:
+		return true
+	default:
+		return false
+	}
+}
+
+// pushWait queues message on lane, waiting while the lane is full. Returns false once the
+// queues are closed, so a long replay stops with the connection
+func (q *sendQueues) pushWait(l lane, message *protocol.Message) bool {
+	select {
+	case q.lanes[l] <- message:
+		return true
+	case <-q.closed:
+		return false
+	}
+}
+
+// done reports whether the queues were closed, the hub closes them once the client is
+// unregistered. Safe to call from any goroutine
+func (q *sendQueues) done() bool {
+	select {
+	case <-q.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// close tells writePump to finish once queued messages are written
+// must only be called from the hub goroutine
+func (q *sendQueues) close() {
+	if !q.isClosed {
+		q.isClosed = true
+		close(q.closed)
+	}
+}
+
+// closeWith closes the queues and has writePump send code and reason in its close frame
+// must only be called from the hub goroutine
+func (q *sendQueues) closeWith(code int, reason protocol.CloseReason) {
+	if !q.isClosed {
+		q.closeCode = code
+		q.closeReason = reason.String()
+	}
+	q.close()
+}
+
+// next returns the next message to write, blocking until one is available
+// returns false once the queues are closed and drained
+func (q *sendQueues) next() (*protocol.Message, bool) {
+	for {
+		if message, ok := q.take(); ok {
+			return message, true
+		}
+
+		// nothing queued, wait for anything
+		select {
+		case message := <-q.lanes[laneControl]:
+			return message, true
+		case message := <-q.lanes[laneContent]:
+			return message, true
+		case message := <-q.lanes[laneBulk]:
+			return message, true
+		case <-q.streams.ready:
+			// a stream got a message or credit, which take may now find
+		case <-q.closed:
+			return nil, false
+		}
+	}
+}
+
+// take returns the next message to write without blocking. Streams take turns ahead of the
+// bulk lane, and only while they have credit
+func (q *sendQueues) take() (*protocol.Message, bool) {
+	// starvation protection: serve the lowest waiting lane after too many skips
+	if q.skipped >= maxPriorityBurst {
+		if message, ok := q.takeStream(); ok {
+			q.skipped = 0
+			return message, true
+		}
+		for l := laneCount - 1; l >= 0; l-- {
+			select {
+			case message := <-q.lanes[l]:
+				q.skipped = 0
+				return message, true
+			default:
+			}
+		}
+		q.skipped = 0
+	}
+
+	for l := lane(0); l < laneCount; l++ {
+		if l == laneBulk {
+			if message, ok := q.takeStream(); ok {
+				q.skipped = 0
+				return message, true
+			}
+		}
+		select {
+		case message := <-q.lanes[l]:
+			if q.lowerPending(l) {
+				q.skipped++
+			} else {
+				q.skipped = 0
+			}
+			return message, true
+		default:
+		}
+	}
+	return nil, false
+}
+
+// lowerPending reports whether any lane below l has messages waiting, counting streams
+// that may write as part of the bulk lane
+func (q *sendQueues) lowerPending(l lane) bool {
+	for lower := l + 1; lower < laneCount; lower++ {
+		if len(q.lanes[lower]) > 0 {
+			return true
+		}
+	}
+	return l < laneBulk && q.streamsPending()
+}
+
+// takeAll removes every queued message without blocking, highest priority lane first.
+// Streams are left alone, they replay messages that are stored anyway
+func (q *sendQueues) takeAll() []*protocol.Message {
+	var messages []*protocol.Message
+	for _, l := range q.lanes {
+		for len(l) > 0 {
+			select {
+			case message := <-l:
+				messages = append(messages, message)
+			default:
+			}
+		}
+	}
+	return messages
+}
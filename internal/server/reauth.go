@@ -0,0 +1,106 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/auth"
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// how long a client whose token lapsed has to acknowledge the close frame
+const expiredCloseGrace = time.Second
+
+// tokenLifetime warns a connection before its token expires and closes it once it has
+type tokenLifetime struct {
+	mu        sync.Mutex
+	expiresAt time.Time
+	warn      *time.Timer
+	expire    *time.Timer
+}
+
+// scheduleExpiry replaces the timers for a token expiring at expiresAt, a zero time never expires
+func (c *Client) scheduleExpiry(expiresAt time.Time) {
+	t := &c.token
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopLocked()
+	t.expiresAt = expiresAt
+	if expiresAt.IsZero() {
+		return
+	}
+
+	// timers fire right away for a token already inside the warning window
+	t.warn = time.AfterFunc(time.Until(expiresAt.Add(-c.reauthWarning)), func() { c.warnExpiry(expiresAt) })
+	t.expire = time.AfterFunc(time.Until(expiresAt), c.closeExpired)
+}
+
+// warnExpiry asks the client for a new token. It runs on the timer goroutine, which must not
+// wait on the hub, so the warning goes straight onto the client's control lane and is left out
+// if that is full or the client was unregistered meanwhile; the connection is closed at expiry
+// either way
+func (c *Client) warnExpiry(expiresAt time.Time) {
+	if c.send.done() {
+		return
+	}
+	c.send.push(protocol.NewControlMessage(c.username, protocol.EventReauthenticate, map[string]interface{}{
+		"expiresAt": expiresAt,
+	}))
+}
+
+// stopExpiry cancels the timers once the connection is gone
+func (c *Client) stopExpiry() {
+	c.token.mu.Lock()
+	defer c.token.mu.Unlock()
+	c.token.stopLocked()
+}
+
+func (t *tokenLifetime) stopLocked() {
+	if t.warn != nil {
+		t.warn.Stop()
+	}
+	if t.expire != nil {
+		t.expire.Stop()
+	}
+}
+
+// closeExpired runs on the timer goroutine, so it only sends a close frame, which may be
+// written concurrently, and bounds the wait for the acknowledgement that ends readPump.
+// A client already unregistered is closing anyway
+func (c *Client) closeExpired() {
+	if c.send.done() {
+		return
+	}
+	reason := protocol.CloseReason{Code: apierror.TokenExpired}
+	deadline := time.Now().Add(expiredCloseGrace)
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(protocol.CloseAuthExpired, reason.String()), deadline)
+	c.conn.SetReadDeadline(deadline)
+}
+
+// reauthenticate accepts a fresh token for the same account sent over the socket. A connection
+// opened with a bound token only takes tokens bound to the same key, its proof was checked on
+// the upgrade
+func (c *Client) reauthenticate(token string) {
+	claims, err := auth.ParseClaims(token)
+	var username string
+	if err == nil {
+		username, err = c.users.ResolveUsername(claims.Username)
+	}
+	if err != nil || username != c.username || claims.BoundTo() != c.keyBinding || !tokenCurrent(c.users, c.tenant, username, claims) {
+		c.sendError(apierror.New(http.StatusUnauthorized, apierror.InvalidToken))
+		return
+	}
+	var expiresAt time.Time
+	if claims.ExpiresAt != nil {
+		expiresAt = claims.ExpiresAt.Time
+	}
+	c.scheduleExpiry(expiresAt)
+	c.canSend = claims.HasScope(auth.ScopeChatSend)
+	c.hub.Forward(protocol.NewControlMessage(c.username, protocol.EventReauthenticated, map[string]interface{}{
+		"expiresAt": expiresAt,
+	}))
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/auth"
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+)
+
+// RecoveryCodesRequest defines JSON for POST /api/account/recovery-codes
+type RecoveryCodesRequest struct {
+	Password string `json:"password"`
+}
+
+// HandleRecoveryCodes manages the caller's recovery codes: GET /api/account/recovery-codes
+// counts the unused ones, POST replaces them with a new set, which asks for the password again
+func (s *Server) HandleRecoveryCodes(w http.ResponseWriter, r *http.Request, username string) {
+	switch r.Method {
+	case http.MethodGet:
+		left, err := s.userStorage.RecoveryCodesLeft(username)
+		if err != nil {
+			respondInternalError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"remaining": left})
+	case http.MethodPost:
+		var req RecoveryCodesRequest
+		if err := s.readJSON(w, r, &req); err != nil {
+			respondError(w, err)
+			return
+		}
+		if !s.verifyPassword(w, username, req.Password) {
+			return
+		}
+		codes, err := s.userStorage.GenerateRecoveryCodes(username)
+		if err != nil {
+			respondInternalError(w, err)
+			return
+		}
+		log.Printf("New recovery codes for %s", username)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"recoveryCodes": codes})
+	default:
+		respondMethodNotAllowed(w)
+	}
+}
+
+// useRecoveryCode lets a recovery code stand in for username's passkey at login, consuming it
+// and telling the user's open connections, since a code used by someone else means the password
+// is known too. Writes the error response and returns false when the code is refused
+func (s *Server) useRecoveryCode(w http.ResponseWriter, r *http.Request, username, code string) bool {
+	left, err := s.userStorage.UseRecoveryCode(username, code)
+	if err == auth.ErrInvalidRecoveryCode {
+		respondError(w, apierror.New(http.StatusUnauthorized, apierror.InvalidRecoveryCode))
+		return false
+	}
+	if err != nil {
+		respondInternalError(w, err)
+		return false
+	}
+	log.Printf("User %s used a recovery code from %s, %d left", username, s.clientIP(r), left)
+	s.hub.Forward(protocol.NewControlMessage(username, protocol.EventRecoveryCodeUsed, map[string]interface{}{
+		"remaining": left,
+		"ip":        s.clientIP(r),
+		"userAgent": r.UserAgent(),
+	}))
+	return true
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/attachments"
+	"github.com/Chase-Garrett/meadowlark/internal/auth"
+	"github.com/Chase-Garrett/meadowlark/internal/config"
+	"github.com/Chase-Garrett/meadowlark/internal/s3"
+)
+
+// RegionRequest defines JSON for PUT /api/admin/users/{username}/region
+type RegionRequest struct {
+	Region string `json:"region"` // empty moves the account back to the main storage
+}
+
+// RegionStatus is an account's data residency region and how much of its data is still elsewhere
+type RegionStatus struct {
+	Username             string `json:"username"`
+	Region               string `json:"region"`
+	AttachmentsElsewhere int    `json:"attachmentsElsewhere"`
+}
+
+// regionMoves runs one migration between regions at a time
+var regionMoves sync.Mutex
+
+// newRegionBlobStores builds the attachment backend of every configured region
+func newRegionBlobStores(cfg *config.Config, proxy *url.URL) (map[string]attachments.BlobStore, error) {
+	stores := make(map[string]attachments.BlobStore, len(cfg.Regions))
+	for _, region := range cfg.Regions {
+		var store attachments.BlobStore
+		var err error
+		switch region.AttachmentStorage {
+		case "file":
+			store, err = attachments.NewFileStore(region.AttachmentDir)
+		case "s3":
+			client := &s3.Client{
+				Endpoint:  region.S3Endpoint,
+				Region:    region.S3Region,
+				AccessKey: region.S3AccessKey,
+				SecretKey: region.S3SecretKey,
+				Bucket:    region.S3Bucket,
+			}
+			if proxy != nil {
+				client.HTTP = outboundClient(proxy, 0)
+			}
+			store, err = attachments.NewS3Store(client, region.S3Prefix, cfg.AttachmentMultipartThreshold)
+		default:
+			err = fmt.Errorf("unknown attachment storage %q, expected file or s3", region.AttachmentStorage)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("region %s: %v", region.Name, err)
+		}
+		stores[region.Name] = store
+	}
+	if _, ok := stores[cfg.DefaultRegion]; cfg.DefaultRegion != "" && !ok {
+		return nil, fmt.Errorf("default region %q is not in MEADOWLARK_REGIONS", cfg.DefaultRegion)
+	}
+	return stores, nil
+}
+
+// regionConfig returns the settings of a named region, nil for the main storage
+func (s *Server) regionConfig(name string) *config.Region {
+	for i := range s.config.Regions {
+		if s.config.Regions[i].Name == name {
+			return &s.config.Regions[i]
+		}
+	}
+	return nil
+}
+
+// HandleAccountRegion serves /api/admin/users/{username}/region: GET shows an account's region,
+// PUT moves it to another one (admin only). New uploads go to the new region straight away,
+// existing attachments are copied over in the background
+func (s *Server) HandleAccountRegion(w http.ResponseWriter, r *http.Request, admin string) {
+	username, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/api/admin/users/"), "/region")
+	if !ok || username == "" || strings.Contains(username, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req RegionRequest
+		if err := s.readJSON(w, r, &req); err != nil {
+			respondError(w, err)
+			return
+		}
+		if !s.attachments.HasRegion(req.Region) {
+			respondError(w, apierror.New(http.StatusBadRequest, apierror.UnknownRegion).With("region", req.Region))
+			return
+		}
+		if err := s.userStorage.SetRegion(username, req.Region); err != nil {
+			respondRegionError(w, err)
+			return
+		}
+		log.Printf("Admin %s moved %s to region %q", admin, username, req.Region)
+		go s.moveAccountData(username)
+	default:
+		respondMethodNotAllowed(w)
+		return
+	}
+
+	status, err := s.regionStatus(username)
+	if err != nil {
+		respondRegionError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodPut {
+		w.WriteHeader(http.StatusAccepted)
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+func (s *Server) regionStatus(username string) (*RegionStatus, error) {
+	region, err := s.userStorage.Region(username)
+	if err != nil {
+		return nil, err
+	}
+	elsewhere, err := s.attachments.Outside(username, region)
+	if err != nil {
+		return nil, err
+	}
+	return &RegionStatus{Username: username, Region: region, AttachmentsElsewhere: elsewhere}, nil
+}
+
+// moveAccountData copies an account's attachments to the region it is tagged with now,
+// so a second move made while the first runs ends up in the latest region
+func (s *Server) moveAccountData(username string) {
+	regionMoves.Lock()
+	defer regionMoves.Unlock()
+
+	region, err := s.userStorage.Region(username)
+	if err != nil {
+		log.Printf("Error moving data of %s: %v", username, err)
+		return
+	}
+	moved, err := s.attachments.MoveOwner(context.Background(), username, region)
+	if err != nil {
+		log.Printf("Moved %d attachments of %s to region %q before failing, PUT the region again to resume: %v", moved, username, region, err)
+		return
+	}
+	log.Printf("Moved %d attachments of %s to region %q", moved, username, region)
+}
+
+// respondRegionError maps region lookups to API errors
+func respondRegionError(w http.ResponseWriter, err error) {
+	if err == auth.ErrUserNotFound {
+		respondError(w, apierror.New(http.StatusNotFound, apierror.UserNotFound))
+		return
+	}
+	respondInternalError(w, err)
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/attachments"
+)
+
+// headers of the resumable upload protocol, named after tus
+const (
+	uploadOffsetHeader = "Upload-Offset"
+	uploadLengthHeader = "Upload-Length"
+)
+
+// uploadStatus answers HEAD /api/attachments/{id} with how many bytes of a resumable
+// upload the server has
+func (s *Server) uploadStatus(w http.ResponseWriter, username string, att *attachments.Attachment) {
+	if att.Owner != username {
+		respondError(w, apierror.New(http.StatusForbidden, apierror.AttachmentNotOwned))
+		return
+	}
+	offset := att.Size
+	if !att.Complete {
+		var err error
+		if offset, err = s.uploads.Offset(att.ID); err != nil {
+			respondInternalError(w, err)
+			return
+		}
+	}
+	w.Header().Set(uploadOffsetHeader, strconv.FormatInt(offset, 10))
+	w.Header().Set(uploadLengthHeader, strconv.FormatInt(att.Size, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// resumeUpload appends the chunk in a PATCH /api/attachments/{id} at its Upload-Offset.
+// The chunk that brings the upload to its full size also stores the blob, a PATCH with
+// an empty body at the full size retries that when storing failed
+func (s *Server) resumeUpload(w http.ResponseWriter, r *http.Request, username string, att *attachments.Attachment) {
+	if att.Owner != username {
+		respondError(w, apierror.New(http.StatusForbidden, apierror.AttachmentNotOwned))
+		return
+	}
+	if att.Complete {
+		respondError(w, apierror.New(http.StatusConflict, apierror.AttachmentAlreadyUploaded))
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get(uploadOffsetHeader), 10, 64)
+	if err != nil || offset < 0 || offset > att.Size {
+		respondError(w, apierror.New(http.StatusBadRequest, apierror.InvalidUploadOffset))
+		return
+	}
+	release, err := s.uploads.Claim(att.ID)
+	if err != nil {
+		respondError(w, apierror.New(http.StatusConflict, apierror.UploadInProgress))
+		return
+	}
+	defer release()
+
+	liftDeadlines(w)
+	offset, err = s.uploads.Append(att.ID, offset, att.Size, r.Body)
+	w.Header().Set(uploadOffsetHeader, strconv.FormatInt(offset, 10))
+	switch {
+	case errors.Is(err, attachments.ErrOffsetMismatch):
+		respondError(w, apierror.New(http.StatusConflict, apierror.UploadOffsetMismatch).With("offset", offset))
+		return
+	case errors.Is(err, attachments.ErrSizeMismatch):
+		respondError(w, apierror.New(http.StatusBadRequest, apierror.AttachmentSizeMismatch))
+		return
+	case err != nil:
+		// a dropped connection lands here too, the client resumes from the offset sent back
+		respondError(w, apierror.New(http.StatusBadRequest, apierror.UploadFailed).With("detail", err.Error()))
+		return
+	}
+	if offset < att.Size {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	staged, err := s.uploads.Open(att.ID)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	shared, err := s.attachments.Store(r.Context(), att, staged)
+	staged.Close()
+	// content that failed validation has to be sent again from the start, while a
+	// backend failure keeps the staged bytes for a retry
+	if err == nil || errors.Is(err, attachments.ErrHashMismatch) || errors.Is(err, attachments.ErrSizeMismatch) {
+		if removeErr := s.uploads.Remove(att.ID); removeErr != nil {
+			log.Printf("Error removing staged upload %s: %v", att.ID, removeErr)
+		}
+		if err != nil {
+			w.Header().Set(uploadOffsetHeader, "0")
+		}
+	}
+	s.uploaded(w, att, shared, err)
+}
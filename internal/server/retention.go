@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/attachments"
+	"github.com/Chase-Garrett/meadowlark/internal/history"
+)
+
+// retentionReleaseTimeout bounds releasing the attachments one retention run found expired
+const retentionReleaseTimeout = 10 * time.Minute
+
+// RetentionPolicyJSON is the API form of a retention policy
+type RetentionPolicyJSON struct {
+	Scope         string `json:"scope"`             // "global", "user" or "room"
+	Subject       string `json:"subject,omitempty"` // username for user policies, room id for room policies
+	MaxAgeSeconds int64  `json:"maxAgeSeconds"`     // 0 removes the policy
+}
+
+// HandleRetention lists or sets retention policies (admin only)
+func (s *Server) HandleRetention(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		policies, err := s.messages.RetentionPolicies()
+		if err != nil {
+			respondInternalError(w, err)
+			return
+		}
+		resp := []RetentionPolicyJSON{}
+		for _, policy := range policies {
+			resp = append(resp, RetentionPolicyJSON{
+				Scope:         policy.Scope,
+				Subject:       policy.Subject,
+				MaxAgeSeconds: int64(policy.MaxAge.Seconds()),
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"defaultMaxAgeSeconds": int64(s.config.Retention.Seconds()),
+			"policies":             resp,
+		})
+	case http.MethodPost:
+		var req RetentionPolicyJSON
+		if err := s.readJSON(w, r, &req); err != nil {
+			respondError(w, err)
+			return
+		}
+		err := s.messages.SetRetentionPolicy(history.RetentionPolicy{
+			Scope:   req.Scope,
+			Subject: req.Subject,
+			MaxAge:  time.Duration(req.MaxAgeSeconds) * time.Second,
+		})
+		if err != nil {
+			respondError(w, apierror.Invalid(err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(req)
+	default:
+		respondMethodNotAllowed(w)
+	}
+}
+
+// releaseAttachments deletes attachments past retention with their thumbnails, and their blobs
+// once nothing else shares them, returning how many went. Stops at the first failure, the
+// next run picks up the rest
+func (s *Server) releaseAttachments(ids []string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), retentionReleaseTimeout)
+	defer cancel()
+	for i, id := range ids {
+		if err := s.attachments.Delete(ctx, id); err != nil && err != attachments.ErrNotFound {
+			return i, fmt.Errorf("releasing attachment %s: %w", id, err)
+		}
+	}
+	return len(ids), nil
+}
+
+// HandleRetentionReport reports what the next pruning run would delete (admin only)
+func (s *Server) HandleRetentionReport(w http.ResponseWriter, r *http.Request) {
+	report, err := s.messages.Prune(s.config.Retention, s.plan.Retention, true)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
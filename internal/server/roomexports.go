@@ -0,0 +1,246 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+	"github.com/Chase-Garrett/meadowlark/internal/rooms"
+)
+
+// scheduled room export limits
+const (
+	roomExportTimeout     = 2 * time.Minute // per delivery, webhook or S3
+	roomExportMaxMessages = 10000           // per file, a longer backlog continues at the next run
+)
+
+// RoomExportRequest defines JSON for PUT /api/rooms/{id}/export
+type RoomExportRequest struct {
+	Destination string `json:"destination"` // "webhook" or "s3"
+	URL         string `json:"url"`         // webhooks only
+	Every       string `json:"every"`       // "daily", "weekly" or "monthly"
+	// a new schedule exports the room's earlier messages at once, instead of starting with the next one
+	Backfill bool `json:"backfill"`
+}
+
+// runRoomExports starts the scheduled room exports that are due
+func (s *Server) runRoomExports(now time.Time, routes *archiveRoutes) error {
+	due, err := s.rooms.DueExports(now)
+	if err != nil {
+		return fmt.Errorf("finding room exports to run: %w", err)
+	}
+	for _, export := range due {
+		if !routes.claim(export.Room) {
+			continue
+		}
+		go func(export rooms.Export) {
+			defer routes.release(export.Room)
+			s.runRoomExport(export)
+		}(export)
+	}
+	return nil
+}
+
+// runRoomExport writes the messages posted since a room's last export and schedules the next.
+// Moderators are told when a run fails, and when one succeeds again afterwards
+func (s *Server) runRoomExport(export rooms.Export) {
+	location, last, n, err := s.writeRoomExport(export)
+	if errors.Is(err, rooms.ErrNotFound) {
+		// deleted since, and the schedule with it
+		return
+	}
+	if err != nil {
+		export.Failures++
+		next := time.Now().Add(archiveRetryDelay(export.Failures))
+		if err := s.rooms.ExportFailed(export.Room, err.Error(), next); err != nil {
+			log.Printf("Error recording failed export of room %s: %v", export.Room, err)
+		}
+		log.Printf("Export of room %s failed: %v", export.Room, err)
+		if export.Failures == 1 {
+			s.hub.NotifyRoomModerators(export.Room, protocol.EventRoomExport, map[string]interface{}{
+				"room":    export.Room,
+				"status":  rooms.ExportFailed,
+				"error":   err.Error(),
+				"nextRun": next,
+			})
+		}
+		return
+	}
+
+	next, _ := rooms.NextExport(export.Every, time.Now())
+	if n == roomExportMaxMessages {
+		// more are waiting, carry on at the next run of the job
+		next = time.Now()
+	}
+	if err := s.rooms.ExportDone(export.Room, last, location, n, next); err != nil {
+		log.Printf("Error recording export of room %s: %v", export.Room, err)
+		return
+	}
+	if n > 0 {
+		log.Printf("Exported %d messages of room %s to %s", n, export.Room, location)
+	}
+	if export.Failures > 0 {
+		s.hub.NotifyRoomModerators(export.Room, protocol.EventRoomExport, map[string]interface{}{
+			"room":     export.Room,
+			"status":   rooms.ExportOK,
+			"location": location,
+			"messages": n,
+		})
+	}
+}
+
+// writeRoomExport sends the room's messages after the last exported one to the destination,
+// in the conversation export format. Returns where they went, the last seq and how many
+// there were; nothing is sent when no messages were posted since the last run
+func (s *Server) writeRoomExport(export rooms.Export) (string, int64, int, error) {
+	room, err := s.rooms.Get(export.Room)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	envelopes, err := s.messages.RoomMessages(export.Room, export.Exported+1, 1<<62, roomExportMaxMessages)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("loading messages: %w", err)
+	}
+	if len(envelopes) == 0 {
+		return "", export.Exported, 0, nil
+	}
+	members, err := s.rooms.Members(export.Room)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("loading members: %w", err)
+	}
+
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	now := time.Now()
+	enc.Encode(ExportHeader{
+		Type:         "header",
+		Format:       "meadowlark-export",
+		Version:      exportVersion,
+		ExportedBy:   export.CreatedBy,
+		ExportedAt:   now,
+		Conversation: ExportConversation{Kind: "room", Room: room, Members: members},
+	})
+	for _, env := range envelopes {
+		enc.Encode(exportRoomMessage{Type: "message", RoomEnvelope: env})
+	}
+	enc.Encode(ExportEnd{Type: "end", Messages: len(envelopes)})
+
+	first, last := envelopes[0].Seq, envelopes[len(envelopes)-1].Seq
+	ctx, cancel := context.WithTimeout(context.Background(), roomExportTimeout)
+	defer cancel()
+	var location string
+	switch export.Destination {
+	case rooms.ExportWebhook:
+		location = export.URL
+		err = s.postRoomExport(ctx, export, first, last, body.Bytes())
+	case rooms.ExportS3:
+		key := s.config.RoomExportS3Prefix + export.Room + "/" + now.UTC().Format("20060102T150405Z") +
+			"-" + strconv.FormatInt(first, 10) + "-" + strconv.FormatInt(last, 10) + ".jsonl"
+		location = "s3://" + s.objectStore.Bucket + "/" + key
+		if err = s.objectStore.PutObject(ctx, key, &body, int64(body.Len()), "application/jsonl"); err != nil {
+			err = fmt.Errorf("upload failed: %v", err)
+		}
+	default:
+		err = fmt.Errorf("unknown destination %q", export.Destination)
+	}
+	if err != nil {
+		return "", 0, 0, err
+	}
+	return location, last, len(envelopes), nil
+}
+
+// postRoomExport sends one export file to a webhook, signed like archive deliveries
+func (s *Server) postRoomExport(ctx context.Context, export rooms.Export, first, last int64, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, export.URL, bytes.NewReader(body))
+	if err != nil {
+		return errors.New("invalid webhook URL")
+	}
+	req.Header.Set("Content-Type", "application/jsonl")
+	req.Header.Set("User-Agent", "MeadowlarkExport/1.0")
+	req.Header.Set("Meadowlark-Delivery", fmt.Sprintf("%s:%d-%d", export.Room, first, last))
+	req.Header.Set("Meadowlark-Signature", signArchiveDelivery(export.Secret, time.Now(), body))
+
+	resp, err := s.exports.Do(req)
+	if err != nil {
+		return webhookError(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// handleRoomExport shows (GET), sets (PUT) or removes (DELETE) a room's export schedule
+// (moderators)
+func (s *Server) handleRoomExport(w http.ResponseWriter, r *http.Request, roomID, username string) {
+	if !s.config.RoomExports {
+		respondError(w, apierror.New(http.StatusForbidden, apierror.RoomExportsDisabled))
+		return
+	}
+	if _, ok := s.roomRole(w, roomID, username, rooms.RoleModerator); !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		export, err := s.rooms.Export(roomID)
+		if err != nil {
+			respondRoomError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(export)
+	case http.MethodPut:
+		var req RoomExportRequest
+		if err := s.readJSON(w, r, &req); err != nil {
+			respondError(w, err)
+			return
+		}
+		if _, ok := rooms.NextExport(req.Every, time.Now()); !ok {
+			respondError(w, apierror.New(http.StatusBadRequest, apierror.InvalidRoomExport).With("detail", "every must be daily, weekly or monthly"))
+			return
+		}
+		switch req.Destination {
+		case rooms.ExportWebhook:
+			if detail := checkArchiveURL(req.URL, s.config.RoomArchivePrivate); detail != "" {
+				respondError(w, apierror.New(http.StatusBadRequest, apierror.InvalidRoomExport).With("detail", detail))
+				return
+			}
+		case rooms.ExportS3:
+			if !s.objectStore.Configured() {
+				respondError(w, apierror.New(http.StatusBadRequest, apierror.StorageNotConfigured))
+				return
+			}
+			req.URL = ""
+		default:
+			respondError(w, apierror.New(http.StatusBadRequest, apierror.InvalidRoomExport).With("detail", "destination must be webhook or s3"))
+			return
+		}
+		export, err := s.rooms.SetExport(roomID, req.Destination, req.URL, req.Every, username, req.Backfill)
+		if err != nil {
+			respondRoomError(w, err)
+			return
+		}
+		log.Printf("%s scheduled %s exports of room %s to %s", username, req.Every, roomID, req.Destination)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(export)
+	case http.MethodDelete:
+		if err := s.rooms.RemoveExport(roomID); err != nil {
+			respondRoomError(w, err)
+			return
+		}
+		log.Printf("%s stopped the exports of room %s", username, roomID)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		respondMethodNotAllowed(w)
+	}
+}
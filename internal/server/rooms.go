@@ -0,0 +1,845 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/auth"
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+	"github.com/Chase-Garrett/meadowlark/internal/rooms"
+)
+
+const maxDirectoryLimit = 200
+
+// RoomRequest defines JSON for POST /api/rooms and PATCH /api/rooms/{id}
+type RoomRequest struct {
+	Name         *string `json:"name"`
+	Topic        *string `json:"topic"`
+	Description  *string `json:"description"`
+	Announcement *bool   `json:"announcement"` // only owners and moderators may post
+	Public       *bool   `json:"public"`       // listed in the directory, anyone may join
+	Broadcast    *bool   `json:"broadcast"`    // public posts shown on a public page, public announcement rooms only
+	SlowMode     *int    `json:"slowMode"`     // seconds between a member's messages, 0 turns it off
+	Rules        *string `json:"rules"`        // accepted when joining, empty for none
+	JoinQuestion *string `json:"joinQuestion"` // answered when joining and reviewed by a moderator, empty for none
+	// who may send attachments: everyone, moderators or none
+	Attachments *string `json:"attachments"`
+	// attachment categories allowed: image, video, audio, document, other; empty for all
+	AttachmentTypes *[]string `json:"attachmentTypes"`
+}
+
+// apply copies the fields present in the request onto room
+func (req *RoomRequest) apply(room *rooms.Room) {
+	if req.Name != nil {
+		room.Name = *req.Name
+	}
+	if req.Topic != nil {
+		room.Topic = *req.Topic
+	}
+	if req.Description != nil {
+		room.Description = *req.Description
+	}
+	if req.Announcement != nil {
+		room.Announcement = *req.Announcement
+	}
+	if req.Public != nil {
+		room.Public = *req.Public
+	}
+	if req.Broadcast != nil {
+		room.Broadcast = *req.Broadcast
+	}
+	if req.SlowMode != nil {
+		room.SlowMode = *req.SlowMode
+	}
+	if req.Rules != nil {
+		room.Rules = *req.Rules
+	}
+	if req.JoinQuestion != nil {
+		room.JoinQuestion = *req.JoinQuestion
+	}
+	if req.Attachments != nil {
+		room.Attachments = *req.Attachments
+	}
+	if req.AttachmentTypes != nil {
+		room.AttachmentTypes = *req.AttachmentTypes
+	}
+}
+
+// JoinRoomRequest defines JSON for POST /api/rooms/{id}/join, the body may be left out
+// for rooms without a join gate
+type JoinRoomRequest struct {
+	AcceptRules bool   `json:"acceptRules"`
+	Answer      string `json:"answer"` // to the join question
+}
+
+// RoomMemberRequest defines JSON for adding a member or changing their role
+type RoomMemberRequest struct {
+	Username string `json:"username"`
+	Role     string `json:"role"` // defaults to member when adding
+}
+
+// roomError maps room storage errors to API errors, nil for unexpected errors
+func roomError(err error) *apierror.Error {
+	if apiErr := textPolicyError(err); apiErr != nil {
+		return apiErr
+	}
+	switch err {
+	case rooms.ErrNotFound:
+		return apierror.New(http.StatusNotFound, apierror.RoomNotFound)
+	case rooms.ErrNotMember:
+		return apierror.New(http.StatusNotFound, apierror.NotRoomMember)
+	case rooms.ErrInvalidAvatar:
+		return apierror.New(http.StatusBadRequest, apierror.InvalidRoomAvatar)
+	case rooms.ErrNoAvatar:
+		return apierror.New(http.StatusNotFound, apierror.RoomAvatarNotFound)
+	case rooms.ErrTooManyPins:
+		return apierror.New(http.StatusConflict, apierror.TooManyPins).With("max", rooms.MaxPins)
+	case rooms.ErrNotPinned:
+		return apierror.New(http.StatusNotFound, apierror.NotPinned)
+	case rooms.ErrInvalidRole:
+		return apierror.New(http.StatusBadRequest, apierror.InvalidRoomRole)
+	case rooms.ErrLastOwner:
+		return apierror.New(http.StatusConflict, apierror.LastRoomOwner)
+	case rooms.ErrMemberExists:
+		return apierror.New(http.StatusConflict, apierror.RoomMemberExists)
+	case rooms.ErrNotMuted:
+		return apierror.New(http.StatusNotFound, apierror.NotMuted)
+	case rooms.ErrInvalidSlowMode:
+		return apierror.New(http.StatusBadRequest, apierror.InvalidSlowMode).With("max", rooms.MaxSlowMode)
+	case rooms.ErrRulesNotAccepted:
+		return apierror.New(http.StatusBadRequest, apierror.RulesNotAccepted)
+	case rooms.ErrJoinAnswerRequired:
+		return apierror.New(http.StatusBadRequest, apierror.JoinAnswerRequired).With("max", rooms.MaxJoinAnswerLength)
+	case rooms.ErrJoinRequestNotFound:
+		return apierror.New(http.StatusNotFound, apierror.JoinRequestNotFound)
+	case rooms.ErrBroadcastNotAllowed:
+		return apierror.New(http.StatusBadRequest, apierror.BroadcastNotAllowed)
+	case rooms.ErrNotBroadcast:
+		return apierror.New(http.StatusConflict, apierror.RoomNotBroadcast)
+	case rooms.ErrPublicPostNotFound:
+		return apierror.New(http.StatusNotFound, apierror.PublicPostNotFound)
+	case rooms.ErrEventEmpty, rooms.ErrInvalidEventTime:
+		return apierror.New(http.StatusBadRequest, apierror.InvalidEvent).With("detail", err.Error())
+	case rooms.ErrEventTooLarge:
+		return apierror.New(http.StatusRequestEntityTooLarge, apierror.PayloadTooLarge).With("max", rooms.MaxEventContentSize)
+	case rooms.ErrEventNotFound:
+		return apierror.New(http.StatusNotFound, apierror.EventNotFound)
+	case rooms.ErrInvalidRSVP:
+		return apierror.New(http.StatusBadRequest, apierror.InvalidRSVP)
+	case rooms.ErrInvalidPoll:
+		return apierror.New(http.StatusBadRequest, apierror.InvalidPoll).With("min", rooms.MinPollOptions).
+			With("max", rooms.MaxPollOptions).With("days", int(rooms.MaxPollDuration/(24*time.Hour)))
+	case rooms.ErrPollNotFound:
+		return apierror.New(http.StatusNotFound, apierror.PollNotFound)
+	case rooms.ErrInvalidVote:
+		return apierror.New(http.StatusBadRequest, apierror.InvalidVote)
+	case rooms.ErrPollClosed:
+		return apierror.New(http.StatusConflict, apierror.PollClosed)
+	case rooms.ErrNoArchive:
+		return apierror.New(http.StatusNotFound, apierror.RoomArchiveNotFound)
+	case rooms.ErrNoExport:
+		return apierror.New(http.StatusNotFound, apierror.RoomExportNotFound)
+	case rooms.ErrInvalidAttachmentPolicy:
+		return apierror.New(http.StatusBadRequest, apierror.InvalidAttachmentPolicy)
+	case rooms.ErrAttachmentsNotAllowed:
+		return apierror.New(http.StatusForbidden, apierror.RoomAttachmentsNotAllowed)
+	}
+	return nil
+}
+
+// respondRoomError responds with the API error for a room storage error
+func respondRoomError(w http.ResponseWriter, err error) {
+	if apiErr := roomError(err); apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+	respondInternalError(w, err)
+}
+
+// roomPostError explains why username may not post to a room, nil if they may
+func roomPostError(snap *rooms.Snapshot, username string) *apierror.Error {
+	if _, ok := snap.Members[username]; !ok {
+		return apierror.New(http.StatusNotFound, apierror.RoomNotFound).With("room", snap.Room.ID)
+	}
+	if until, muted := snap.Muted(username, time.Now()); muted {
+		apiErr := apierror.New(http.StatusForbidden, apierror.RoomMuted).With("room", snap.Room.ID)
+		if !until.IsZero() {
+			apiErr = apiErr.With("until", until.Unix())
+		}
+		return apiErr
+	}
+	if !snap.CanPost(username) {
+		return apierror.New(http.StatusForbidden, apierror.RoomReadOnly).With("room", snap.Room.ID)
+	}
+	return nil
+}
+
+// canRemoveMember reports whether a member with role may remove or mute someone with target's role
+func canRemoveMember(role, target string) bool {
+	return role == rooms.RoleOwner || (role == rooms.RoleModerator && target == rooms.RoleMember)
+}
+
+// NotifyRoom pushes a control message to every member of a room.
+// It sends on the hub's channels, so it must not be called from the hub goroutine
+func (h *Hub) NotifyRoom(roomID, event string, data interface{}) {
+	snap, err := h.rooms.Snapshot(roomID)
+	if err != nil {
+		log.Printf("Error loading room %s: %v", roomID, err)
+		return
+	}
+	for member := range snap.Members {
+		h.forward <- protocol.NewControlMessage(member, event, data)
+	}
+}
+
+// NotifyRoomModerators pushes a control message to a room's moderators and owners.
+// It sends on the hub's channels, so it must not be called from the hub goroutine
+func (h *Hub) NotifyRoomModerators(roomID, event string, data interface{}) {
+	snap, err := h.rooms.Snapshot(roomID)
+	if err != nil {
+		log.Printf("Error loading room %s: %v", roomID, err)
+		return
+	}
+	for member, role := range snap.Members {
+		if rooms.AtLeast(role, rooms.RoleModerator) {
+			h.forward <- protocol.NewControlMessage(member, event, data)
+		}
+	}
+}
+
+// NotifyRoomUpdated tells members a room's settings or avatar changed
+func (h *Hub) NotifyRoomUpdated(roomID, by string) {
+	room, err := h.rooms.Get(roomID)
+	if err != nil {
+		log.Printf("Error loading room %s: %v", roomID, err)
+		return
+	}
+	h.NotifyRoom(roomID, protocol.EventRoomUpdated, map[string]interface{}{"room": room, "by": by})
+}
+
+// NotifyRoomMember tells members someone joined, left, was removed, muted or unmuted.
+// A removed member is told directly since they are no longer in the room
+func (h *Hub) NotifyRoomMember(roomID, username, action, by string, extra map[string]interface{}) {
+	data := map[string]interface{}{"room": roomID, "username": username, "action": action, "by": by}
+	for k, v := range extra {
+		data[k] = v
+	}
+	h.NotifyRoom(roomID, protocol.EventRoomMember, data)
+	if action == protocol.MemberRemoved && username != by {
+		h.forward <- protocol.NewControlMessage(username, protocol.EventRoomMember, data)
+	}
+}
+
+// roomRole returns the caller's role, responding with an error when they may not act on the room.
+// Non-members get the same not found error as missing rooms so room ids can't be probed
+func (s *Server) roomRole(w http.ResponseWriter, roomID, username, min string) (string, bool) {
+	role, err := s.rooms.Role(roomID, username)
+	if err == rooms.ErrNotMember || err == rooms.ErrNotFound {
+		respondError(w, apierror.New(http.StatusNotFound, apierror.RoomNotFound))
+		return "", false
+	}
+	if err != nil {
+		respondInternalError(w, err)
+		return "", false
+	}
+	if !rooms.AtLeast(role, min) {
+		respondError(w, apierror.New(http.StatusForbidden, apierror.RoomForbidden).With("role", min))
+		return "", false
+	}
+	return role, true
+}
+
+// HandleRooms lists the caller's rooms or creates a new one
+func (s *Server) HandleRooms(w http.ResponseWriter, r *http.Request, username string) {
+	switch r.Method {
+	case http.MethodGet:
+		if since := r.URL.Query().Get("since"); since != "" {
+			s.roomChanges(w, username, since)
+			return
+		}
+		p, apiErr := readPage(r, maxDirectoryLimit, true)
+		if apiErr != nil {
+			respondError(w, apiErr)
+			return
+		}
+		var after *rooms.DirectoryCursor
+		var pos rooms.DirectoryCursor
+		ok, apiErr := p.after(&pos)
+		if apiErr != nil {
+			respondError(w, apiErr)
+			return
+		}
+		if ok {
+			after = &pos
+		}
+		// the cursor is read first, a change landing in between is sent again by the next delta
+		cursor, err := s.rooms.Cursor(username)
+		if err != nil {
+			respondInternalError(w, err)
+			return
+		}
+		list, err := s.rooms.ForUserPage(username, p.Query, after, p.Desc, p.Limit)
+		if err != nil {
+			respondInternalError(w, err)
+			return
+		}
+		p.respond(w, r, map[string]interface{}{"rooms": list, "cursor": cursor}, len(list), func() interface{} {
+			last := list[len(list)-1]
+			return rooms.DirectoryCursor{Name: last.Name, ID: last.ID}
+		})
+	case http.MethodPost:
+		var req RoomRequest
+		if err := s.readJSON(w, r, &req); err != nil {
+			respondError(w, err)
+			return
+		}
+		if req.Name == nil {
+			respondError(w, apierror.New(http.StatusBadRequest, apierror.InvalidJSON))
+			return
+		}
+		if apiErr := s.broadcastError(&req); apiErr != nil {
+			respondError(w, apiErr)
+			return
+		}
+		var settings rooms.Room
+		req.apply(&settings)
+		room, err := s.rooms.Create(username, settings)
+		if err != nil {
+			respondRoomError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(room)
+	default:
+		respondMethodNotAllowed(w)
+	}
+}
+
+// roomChanges answers GET /api/rooms?since={cursor} with the rooms added to or changed in
+// the caller's list and the ids of rooms that left it
+func (s *Server) roomChanges(w http.ResponseWriter, username, since string) {
+	cursor, err := strconv.ParseInt(since, 10, 64)
+	if err != nil || cursor < 0 {
+		respondError(w, apierror.New(http.StatusBadRequest, apierror.InvalidRequest).With("detail", "since must be a cursor from an earlier response"))
+		return
+	}
+	changes, err := s.rooms.ChangesSince(username, cursor)
+	if err == rooms.ErrCursorExpired {
+		respondError(w, apierror.New(http.StatusGone, apierror.CursorExpired))
+		return
+	}
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(changes)
+}
+
+// HandleRoomDirectory lists public rooms, optionally filtered by a search term
+func (s *Server) HandleRoomDirectory(w http.ResponseWriter, r *http.Request, username string) {
+	p, apiErr := readPage(r, maxDirectoryLimit, false)
+	if apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+	var after *rooms.DirectoryCursor
+	var pos rooms.DirectoryCursor
+	ok, apiErr := p.after(&pos)
+	if apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+	if ok {
+		after = &pos
+	}
+
+	entries, err := s.rooms.Directory(username, p.Query, after, p.Limit)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+
+	p.respond(w, r, map[string]interface{}{"rooms": entries}, len(entries), func() interface{} {
+		last := entries[len(entries)-1]
+		return rooms.DirectoryCursor{Name: last.Name, ID: last.ID}
+	})
+}
+
+// HandleRoomAvatarImage serves /api/rooms/{id}/avatar
+// avatars are public so they can be used directly in img tags, room ids are unguessable
+func (s *Server) HandleRoomAvatarImage(w http.ResponseWriter, r *http.Request) {
+	roomID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/rooms/"), "/avatar")
+	avatar, err := s.rooms.Avatar(roomID)
+	if err != nil {
+		respondRoomError(w, err)
+		return
+	}
+
+	w.Header().Set("ETag", avatar.ETag)
+	// the URL changes with the image, but revalidate in case an old URL is reused
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	if r.Header.Get("If-None-Match") == avatar.ETag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", avatar.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(avatar.Data)))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(avatar.Data)
+}
+
+// HandleRoom serves /api/rooms/{id}, /api/rooms/{id}/join, /api/rooms/{id}/requests[/{username}],
+// /api/rooms/{id}/members[/{username}], /api/rooms/{id}/messages, /api/rooms/{id}/avatar,
+// /api/rooms/{id}/pins[/{seq}], /api/rooms/{id}/public[/{post}], /api/rooms/{id}/events[/{event}[/rsvp]]
+// /api/rooms/{id}/events.ics, /api/rooms/{id}/polls[/{poll}[/vote|/close]], /api/rooms/{id}/archive
+// and /api/rooms/{id}/export
+func (s *Server) HandleRoom(w http.ResponseWriter, r *http.Request, username string) {
+	roomID, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/rooms/"), "/")
+	section, member, _ := strings.Cut(rest, "/")
+
+	switch {
+	case section == "":
+		s.handleRoomSettings(w, r, roomID, username)
+	case section == "join" && member == "":
+		s.handleJoinRoom(w, r, roomID, username)
+	case section == "requests":
+		s.handleJoinRequests(w, r, roomID, username, member)
+	case section == "members" && member == "":
+		if r.Method != http.MethodPost {
+			respondMethodNotAllowed(w)
+			return
+		}
+		s.handleAddRoomMember(w, r, roomID, username)
+	case section == "members":
+		s.handleRoomMember(w, r, roomID, username, member)
+	case section == "avatar" && member == "":
+		s.handleRoomAvatar(w, r, roomID, username)
+	case section == "pins":
+		s.handleRoomPins(w, r, roomID, username, member)
+	case section == "public":
+		s.handlePublicPosts(w, r, roomID, username, member)
+	case section == "events":
+		s.handleRoomEvents(w, r, roomID, username, member)
+	case section == "polls":
+		s.handleRoomPolls(w, r, roomID, username, member)
+	case section == "events.ics" && member == "":
+		s.handleRoomCalendar(w, r, roomID, username)
+	case section == "archive" && member == "":
+		s.handleRoomArchive(w, r, roomID, username)
+	case section == "export" && member == "":
+		s.handleRoomExport(w, r, roomID, username)
+	case section == "messages" && member == "":
+		if r.Method != http.MethodGet {
+			respondMethodNotAllowed(w)
+			return
+		}
+		s.handleRoomMessages(w, r, roomID, username)
+	default:
+		respondError(w, apierror.New(http.StatusNotFound, apierror.NotFound))
+	}
+}
+
+func (s *Server) handleRoomSettings(w http.ResponseWriter, r *http.Request, roomID, username string) {
+	switch r.Method {
+	case http.MethodGet:
+		role, ok := s.roomRole(w, roomID, username, rooms.RoleMember)
+		if !ok {
+			return
+		}
+		room, err := s.rooms.Get(roomID)
+		if err != nil {
+			respondRoomError(w, err)
+			return
+		}
+		members, err := s.rooms.Members(roomID)
+		if err != nil {
+			respondInternalError(w, err)
+			return
+		}
+		pins, err := s.rooms.Pins(roomID)
+		if err != nil {
+			respondInternalError(w, err)
+			return
+		}
+		snap, err := s.rooms.Snapshot(roomID)
+		if err != nil {
+			respondRoomError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"room":         room,
+			"role":         role,
+			"members":      members,
+			"pins":         pins,
+			"capabilities": snap.Capabilities(username),
+		})
+	case http.MethodPatch:
+		if _, ok := s.roomRole(w, roomID, username, rooms.RoleModerator); !ok {
+			return
+		}
+		var req RoomRequest
+		if err := s.readJSON(w, r, &req); err != nil {
+			respondError(w, err)
+			return
+		}
+		if apiErr := s.broadcastError(&req); apiErr != nil {
+			respondError(w, apiErr)
+			return
+		}
+		room, err := s.rooms.Get(roomID)
+		if err != nil {
+			respondRoomError(w, err)
+			return
+		}
+		req.apply(room)
+		if err := s.rooms.Update(room); err != nil {
+			respondRoomError(w, err)
+			return
+		}
+		s.hub.NotifyRoomUpdated(roomID, username)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(room)
+	case http.MethodDelete:
+		if _, ok := s.roomRole(w, roomID, username, rooms.RoleOwner); !ok {
+			return
+		}
+		if err := s.rooms.Delete(roomID); err != nil {
+			respondRoomError(w, err)
+			return
+		}
+		if err := s.messages.DeleteRoom(roomID); err != nil {
+			respondInternalError(w, err)
+			return
+		}
+		if err := s.inbound.DeleteRoom(roomID); err != nil {
+			respondInternalError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		respondMethodNotAllowed(w)
+	}
+}
+
+// handleRoomAvatar replaces or removes a room's avatar (owners and moderators)
+func (s *Server) handleRoomAvatar(w http.ResponseWriter, r *http.Request, roomID, username string) {
+	if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		respondMethodNotAllowed(w)
+		return
+	}
+	if _, ok := s.roomRole(w, roomID, username, rooms.RoleModerator); !ok {
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		if err := s.rooms.DeleteAvatar(roomID); err != nil {
+			respondRoomError(w, err)
+			return
+		}
+		s.hub.NotifyRoomUpdated(roomID, username)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	maxSize := s.config.RoomAvatarMaxSize
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSize))
+	if err != nil {
+		respondError(w, apierror.New(http.StatusRequestEntityTooLarge, apierror.PayloadTooLarge).With("max", maxSize))
+		return
+	}
+	url, err := s.rooms.SetAvatar(roomID, data)
+	if err != nil {
+		respondRoomError(w, err)
+		return
+	}
+	s.hub.NotifyRoomUpdated(roomID, username)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"avatarUrl": url})
+}
+
+// handleRoomPins pins (POST) or unpins (DELETE /pins/{seq}) room messages (owners and moderators)
+func (s *Server) handleRoomPins(w http.ResponseWriter, r *http.Request, roomID, username, seqPart string) {
+	if _, ok := s.roomRole(w, roomID, username, rooms.RoleModerator); !ok {
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && seqPart == "":
+		var req struct {
+			Seq int64 `json:"seq"`
+		}
+		if err := s.readJSON(w, r, &req); err != nil {
+			respondError(w, err)
+			return
+		}
+		exists, err := s.messages.RoomMessageExists(roomID, req.Seq)
+		if err != nil {
+			respondInternalError(w, err)
+			return
+		}
+		if !exists {
+			respondError(w, apierror.New(http.StatusNotFound, apierror.RoomMessageNotFound))
+			return
+		}
+		if err := s.rooms.Pin(roomID, req.Seq, username); err != nil {
+			respondRoomError(w, err)
+			return
+		}
+	case r.Method == http.MethodDelete && seqPart != "":
+		seq, err := strconv.ParseInt(seqPart, 10, 64)
+		if err != nil {
+			respondError(w, apierror.New(http.StatusNotFound, apierror.NotPinned))
+			return
+		}
+		if err := s.rooms.Unpin(roomID, seq); err != nil {
+			respondRoomError(w, err)
+			return
+		}
+	default:
+		respondMethodNotAllowed(w)
+		return
+	}
+
+	pins, err := s.rooms.Pins(roomID)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	s.hub.NotifyRoom(roomID, protocol.EventRoomPins, map[string]interface{}{"room": roomID, "pins": pins, "by": username})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"pins": pins})
+}
+
+// handleJoinRoom shows a public room's join gate, or adds the caller to it. Rooms with a join
+// question queue the caller's answer for moderators instead, answering 202
+func (s *Server) handleJoinRoom(w http.ResponseWriter, r *http.Request, roomID, username string) {
+	switch r.Method {
+	case http.MethodGet:
+		gate, err := s.rooms.Gate(roomID)
+		if err != nil {
+			respondRoomError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(gate)
+		return
+	case http.MethodPost:
+	default:
+		respondMethodNotAllowed(w)
+		return
+	}
+
+	var req JoinRoomRequest
+	if r.ContentLength != 0 {
+		if err := s.readJSON(w, r, &req); err != nil {
+			respondError(w, err)
+			return
+		}
+	}
+	pending, err := s.rooms.Join(roomID, username, req.AcceptRules, req.Answer)
+	if err != nil {
+		respondRoomError(w, err)
+		return
+	}
+	if pending {
+		s.hub.NotifyRoomModerators(roomID, protocol.EventRoomJoinRequest, map[string]interface{}{
+			"room": roomID, "username": username, "action": protocol.JoinRequested, "by": username,
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "pending"})
+		return
+	}
+	s.hub.NotifyRoomMember(roomID, username, protocol.MemberAdded, username, map[string]interface{}{"role": rooms.RoleMember})
+	room, err := s.rooms.Get(roomID)
+	if err != nil {
+		respondRoomError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"room": room,
+		"role": rooms.RoleMember,
+	})
+}
+
+// handleJoinRequests lists pending join requests and approves or rejects them (moderators).
+// The requester may withdraw their own request
+func (s *Server) handleJoinRequests(w http.ResponseWriter, r *http.Request, roomID, username, requester string) {
+	if requester == "" {
+		if r.Method != http.MethodGet {
+			respondMethodNotAllowed(w)
+			return
+		}
+		if _, ok := s.roomRole(w, roomID, username, rooms.RoleModerator); !ok {
+			return
+		}
+		requests, err := s.rooms.JoinRequests(roomID)
+		if err != nil {
+			respondInternalError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"requests": requests})
+		return
+	}
+
+	var action string
+	switch r.Method {
+	case http.MethodPost:
+		if _, ok := s.roomRole(w, roomID, username, rooms.RoleModerator); !ok {
+			return
+		}
+		if err := s.rooms.ApproveJoin(roomID, requester); err != nil {
+			respondRoomError(w, err)
+			return
+		}
+		action = protocol.JoinApproved
+	case http.MethodDelete:
+		action = protocol.JoinWithdrawn
+		if requester != username {
+			if _, ok := s.roomRole(w, roomID, username, rooms.RoleModerator); !ok {
+				return
+			}
+			action = protocol.JoinRejected
+		}
+		if err := s.rooms.DeleteJoinRequest(roomID, requester); err != nil {
+			respondRoomError(w, err)
+			return
+		}
+	default:
+		respondMethodNotAllowed(w)
+		return
+	}
+
+	data := map[string]interface{}{"room": roomID, "username": requester, "action": action, "by": username}
+	s.hub.NotifyRoomModerators(roomID, protocol.EventRoomJoinRequest, data)
+	if action == protocol.JoinApproved {
+		s.hub.NotifyRoomMember(roomID, requester, protocol.MemberAdded, username, map[string]interface{}{"role": rooms.RoleMember})
+	} else if action == protocol.JoinRejected {
+		s.hub.Forward(protocol.NewControlMessage(requester, protocol.EventRoomJoinRequest, data))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAddRoomMember lets moderators add members, only owners may grant higher roles
+func (s *Server) handleAddRoomMember(w http.ResponseWriter, r *http.Request, roomID, username string) {
+	role, ok := s.roomRole(w, roomID, username, rooms.RoleModerator)
+	if !ok {
+		return
+	}
+	var req RoomMemberRequest
+	if err := s.readJSON(w, r, &req); err != nil {
+		respondError(w, err)
+		return
+	}
+	if req.Role == "" {
+		req.Role = rooms.RoleMember
+	}
+	if req.Role != rooms.RoleMember && role != rooms.RoleOwner {
+		respondError(w, apierror.New(http.StatusForbidden, apierror.RoomForbidden).With("role", rooms.RoleOwner))
+		return
+	}
+
+	member, err := s.userStorage.ResolveUsername(req.Username)
+	if err == auth.ErrUserNotFound {
+		respondError(w, apierror.New(http.StatusNotFound, apierror.UserNotFound))
+		return
+	}
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	if err := s.rooms.AddMember(roomID, member, req.Role); err != nil {
+		respondRoomError(w, err)
+		return
+	}
+	s.hub.NotifyRoomMember(roomID, member, protocol.MemberAdded, username, map[string]interface{}{"role": req.Role})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(RoomMemberRequest{Username: member, Role: req.Role})
+}
+
+// handleRoomMember changes a member's role (owners only) or removes them.
+// Anyone may leave, moderators may remove plain members and owners anyone
+func (s *Server) handleRoomMember(w http.ResponseWriter, r *http.Request, roomID, username, member string) {
+	switch r.Method {
+	case http.MethodPut:
+		if _, ok := s.roomRole(w, roomID, username, rooms.RoleOwner); !ok {
+			return
+		}
+		var req RoomMemberRequest
+		if err := s.readJSON(w, r, &req); err != nil {
+			respondError(w, err)
+			return
+		}
+		if err := s.rooms.SetRole(roomID, member, req.Role); err != nil {
+			respondRoomError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(RoomMemberRequest{Username: member, Role: req.Role})
+	case http.MethodDelete:
+		if member != username {
+			role, ok := s.roomRole(w, roomID, username, rooms.RoleModerator)
+			if !ok {
+				return
+			}
+			target, err := s.rooms.Role(roomID, member)
+			if err != nil {
+				respondRoomError(w, err)
+				return
+			}
+			if !canRemoveMember(role, target) {
+				respondError(w, apierror.New(http.StatusForbidden, apierror.RoomForbidden).With("role", rooms.RoleOwner))
+				return
+			}
+		}
+		if err := s.rooms.RemoveMember(roomID, member); err != nil {
+			respondRoomError(w, err)
+			return
+		}
+		s.hub.NotifyRoomMember(roomID, member, protocol.MemberRemoved, username, nil)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		respondMethodNotAllowed(w)
+	}
+}
+
+// handleRoomMessages returns stored room messages within a sequence range, for filling gaps
+func (s *Server) handleRoomMessages(w http.ResponseWriter, r *http.Request, roomID, username string) {
+	if _, ok := s.roomRole(w, roomID, username, rooms.RoleMember); !ok {
+		return
+	}
+	query := r.URL.Query()
+	from, fromErr := strconv.ParseInt(query.Get("from"), 10, 64)
+	to, toErr := strconv.ParseInt(query.Get("to"), 10, 64)
+	if fromErr != nil || toErr != nil || from < 1 || to < from {
+		respondError(w, apierror.New(http.StatusBadRequest, apierror.InvalidSequenceRange))
+		return
+	}
+
+	limit := pageLimit(r, maxMissingMessages, maxMissingMessages)
+	envelopes, err := s.messages.RoomMessages(roomID, from, to, limit)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+
+	resp := map[string]interface{}{"messages": envelopes}
+	if len(envelopes) == limit {
+		resp["nextFrom"] = envelopes[len(envelopes)-1].Seq + 1
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/history"
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+)
+
+// maxSavedPage caps a page of GET /api/saved
+const maxSavedPage = 200
+
+// HandleSaved serves the caller's saved messages: the list at /api/saved, newest saved first,
+// and /api/saved/{user|room}/{messageId}, where PUT saves a message and DELETE unsaves it.
+// Changes are sent to the caller's connection so their other devices follow
+func (s *Server) HandleSaved(w http.ResponseWriter, r *http.Request, username string) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/saved")
+	if rest == "" || rest == "/" {
+		if r.Method != http.MethodGet {
+			respondMethodNotAllowed(w)
+			return
+		}
+		s.listSaved(w, r, username)
+		return
+	}
+
+	scope, rawID, _ := strings.Cut(strings.TrimPrefix(rest, "/"), "/")
+	messageID, err := strconv.ParseInt(rawID, 10, 64)
+	if (scope != history.ConversationUser && scope != history.ConversationRoom) || err != nil || messageID < 1 {
+		respondError(w, apierror.New(http.StatusNotFound, apierror.NotFound))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		saved, err := s.messages.SaveMessage(username, scope, messageID)
+		switch {
+		case errors.Is(err, history.ErrMessageNotFound):
+			respondError(w, apierror.New(http.StatusNotFound, apierror.MessageNotFound))
+			return
+		case errors.Is(err, history.ErrTooManySaved):
+			respondError(w, apierror.New(http.StatusConflict, apierror.TooManySavedMessages).With("max", history.MaxSavedMessages))
+			return
+		case err != nil:
+			respondInternalError(w, err)
+			return
+		}
+		s.hub.Forward(protocol.NewControlMessage(username, protocol.EventSavedMessage, map[string]interface{}{
+			"action": protocol.SavedAdded,
+			"saved":  saved,
+		}))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(saved)
+	case http.MethodDelete:
+		err := s.messages.UnsaveMessage(username, scope, messageID)
+		if errors.Is(err, history.ErrMessageNotFound) {
+			respondError(w, apierror.New(http.StatusNotFound, apierror.MessageNotFound))
+			return
+		}
+		if err != nil {
+			respondInternalError(w, err)
+			return
+		}
+		s.hub.Forward(protocol.NewControlMessage(username, protocol.EventSavedMessage, map[string]interface{}{
+			"action":    protocol.SavedRemoved,
+			"scope":     scope,
+			"messageId": messageID,
+		}))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		respondMethodNotAllowed(w)
+	}
+}
+
+// listSaved pages through the caller's saved messages
+func (s *Server) listSaved(w http.ResponseWriter, r *http.Request, username string) {
+	p, apiErr := readPage(r, maxSavedPage, false)
+	if apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+	var before int64
+	if _, apiErr := p.after(&before); apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+	saved, err := s.messages.SavedMessages(username, before, p.Limit)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	p.respond(w, r, map[string]interface{}{"saved": saved}, len(saved), func() interface{} {
+		return saved[len(saved)-1].ID
+	})
+}
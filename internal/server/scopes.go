@@ -0,0 +1,139 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/auth"
+)
+
+// TokenRequest defines JSON for POST /api/tokens
+type TokenRequest struct {
+	Scopes []string `json:"scopes"`
+	JKT    string   `json:"jkt,omitempty"` // thumbprint of the integration's DPoP key
+}
+
+// TokenResponse is a token issued by POST /api/tokens
+type TokenResponse struct {
+	Token     string    `json:"token"`
+	Scopes    []string  `json:"scopes"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// requiredScope is the scope a token needs for r, looked up in routeScopes by the pattern
+// the request was routed by. A route missing from the table needs admin, so forgetting one
+// locks it down rather than opening it up
+func requiredScope(r *http.Request) string {
+	route, ok := routeScopes[r.Pattern]
+	if !ok {
+		return auth.ScopeAdmin
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+		return route.read
+	}
+	return route.write
+}
+
+// checkScope makes sure the token may be used for r
+func checkScope(r *http.Request, claims *auth.UserClaims) *apierror.Error {
+	scope := requiredScope(r)
+	switch {
+	case claims.HasScope(scope):
+		return nil
+	case scope == auth.ScopeAdmin:
+		// tokens of users who aren't admins never have the scope, they get the error they always did
+		return apierror.New(http.StatusForbidden, apierror.AdminRequired)
+	}
+	return apierror.New(http.StatusForbidden, apierror.InsufficientScope).With("scope", scope)
+}
+
+// requestClaims returns the claims of the token r was authenticated with, nil when it has none
+func requestClaims(r *http.Request) *auth.UserClaims {
+	claims, err := auth.ParseClaims(requestToken(r))
+	if err != nil {
+		return nil
+	}
+	return claims
+}
+
+// tokenScopes checks the scopes requested for a token for username. None requested means every
+// scope the account can hold; admin is only for configured admins, and a token issued from
+// another one (limit) can't have scopes it lacks
+func (s *Server) tokenScopes(username string, requested []string, limit *auth.UserClaims) ([]string, *apierror.Error) {
+	if requested == nil {
+		requested = auth.Scopes
+		if !s.config.IsAdmin(username) {
+			requested = requested[:len(requested)-1] // admin comes last
+		}
+		if limit != nil {
+			var allowed []string
+			for _, scope := range requested {
+				if limit.HasScope(scope) {
+					allowed = append(allowed, scope)
+				}
+			}
+			requested = allowed
+		}
+	}
+	scopes, err := auth.NormalizeScopes(requested)
+	if err != nil {
+		return nil, apierror.New(http.StatusBadRequest, apierror.InvalidScope).With("scopes", strings.Join(auth.Scopes, ", "))
+	}
+	for _, scope := range scopes {
+		if scope == auth.ScopeAdmin && !s.config.IsAdmin(username) {
+			return nil, apierror.New(http.StatusForbidden, apierror.AdminRequired)
+		}
+		if limit != nil && !limit.HasScope(scope) {
+			return nil, apierror.New(http.StatusForbidden, apierror.InsufficientScope).With("scope", scope)
+		}
+	}
+	return scopes, nil
+}
+
+// HandleIssueToken issues a token with fewer scopes than the caller's for an integration, such
+// as a bot that only reads or only sends (/api/tokens, needs the bots scope)
+func (s *Server) HandleIssueToken(w http.ResponseWriter, r *http.Request, username string) {
+	if r.Method != http.MethodPost {
+		respondMethodNotAllowed(w)
+		return
+	}
+	var req TokenRequest
+	if err := s.readJSON(w, r, &req); err != nil {
+		respondError(w, err)
+		return
+	}
+	if req.Scopes == nil {
+		req.Scopes = []string{}
+	}
+	scopes, apiErr := s.tokenScopes(username, req.Scopes, requestClaims(r))
+	if apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+	if req.JKT != "" {
+		if thumbprint, err := base64.RawURLEncoding.DecodeString(req.JKT); err != nil || len(thumbprint) != 32 {
+			respondError(w, apierror.New(http.StatusBadRequest, apierror.InvalidKeyThumbprint))
+			return
+		}
+	}
+
+	token, err := s.issueToken(username, auth.TokenOptions{JKT: req.JKT, Scopes: scopes})
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	claims, err := auth.ParseClaims(token)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(TokenResponse{Token: token, Scopes: scopes, ExpiresAt: claims.ExpiresAt.Time})
+	log.Printf("User %s issued a token with scopes %s", username, strings.Join(scopes, " "))
+}
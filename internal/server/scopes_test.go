@@ -0,0 +1,135 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Chase-Garrett/meadowlark/internal/auth"
+	"github.com/Chase-Garrett/meadowlark/internal/config"
+)
+
+// recordingMux collects the patterns routes are registered with
+type recordingMux struct {
+	patterns []string
+}
+
+func (m *recordingMux) HandleFunc(pattern string, _ func(http.ResponseWriter, *http.Request)) {
+	m.patterns = append(m.patterns, pattern)
+}
+
+// publicRoutes don't authenticate with a user's token, so they have no scope
+var publicRoutes = map[string]bool{
+	"/":                                true,
+	"/api/register":                    true,
+	"/api/login":                       true,
+	"/api/login/passkey":               true,
+	"/api/login/passkey/challenge":     true,
+	"/public/rooms/":                   true,
+	"/feeds/rooms/":                    true,
+	"/api/i18n":                        true,
+	"/api/i18n/":                       true,
+	"/api/emoji/":                      true,
+	"/register":                        true,
+	"/keys/":                           true,
+	"/.well-known/meadowlark/identity": true,
+	"/api/capabilities":                true,
+	"/api/keylog":                      true,
+	"/api/keylog/head":                 true,
+	"/api/keylog/proof/":               true,
+	"/ws":                              true, // scopes are checked per frame
+	"/api/hooks/email":                 true,
+	"/metrics":                         true,
+}
+
+func TestRouteScopesCoverEveryRoute(t *testing.T) {
+	s := &Server{}
+	mux := &recordingMux{}
+	registerRoutes(mux, s, &config.Config{})
+	s.registerDebugRoutes(mux)
+
+	registered := make(map[string]bool)
+	for _, pattern := range mux.patterns {
+		registered[pattern] = true
+		_, scoped := routeScopes[pattern]
+		if scoped == publicRoutes[pattern] {
+			t.Errorf("route %s: in routeScopes %v, public %v, want exactly one", pattern, scoped, publicRoutes[pattern])
+		}
+	}
+	for pattern := range routeScopes {
+		if !registered[pattern] {
+			t.Errorf("routeScopes has %s, which isn't registered", pattern)
+		}
+	}
+}
+
+func TestRequiredScope(t *testing.T) {
+	tests := []struct {
+		method  string
+		pattern string
+		want    string
+	}{
+		{http.MethodGet, "/api/users", auth.ScopeReadOnly},
+		{http.MethodPost, "/api/sync", auth.ScopeReadOnly},
+		{http.MethodPost, "/api/preview", auth.ScopeReadOnly},
+		{http.MethodPost, "/api/contacts/discover", auth.ScopeReadOnly},
+		{http.MethodPost, "/api/rooms", auth.ScopeChatSend},
+		{http.MethodGet, "/api/rooms/", auth.ScopeReadOnly},
+		{http.MethodPut, "/api/drafts/", auth.ScopeChatSend},
+		{http.MethodPut, "/api/account/notifications", auth.ScopeChatSend},
+		{http.MethodDelete, "/api/account", auth.ScopeAccount},
+		{http.MethodPost, "/api/password/change", auth.ScopeAccount},
+		{http.MethodGet, "/api/passkeys", auth.ScopeReadOnly},
+		{http.MethodPost, "/api/passkeys", auth.ScopeAccount},
+		{http.MethodPut, "/api/passkeys/", auth.ScopeAccount},
+		{http.MethodPost, "/api/account/recovery-codes", auth.ScopeAccount},
+		{http.MethodPut, "/api/account/key", auth.ScopeAccount},
+		{http.MethodPut, "/api/account/phone", auth.ScopeAccount},
+		{http.MethodPost, "/api/account/email/verify", auth.ScopeAccount},
+		{http.MethodPut, "/api/account/username", auth.ScopeAccount},
+		{http.MethodPost, "/api/sessions/report", auth.ScopeAccount},
+		{http.MethodPost, "/api/tokens", auth.ScopeBots},
+		{http.MethodGet, "/api/admin/stats", auth.ScopeAdmin},
+		{http.MethodGet, "/debug/runtime", auth.ScopeAdmin},
+		{http.MethodGet, "/api/not-in-the-table", auth.ScopeAdmin},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.pattern, nil)
+		r.Pattern = tt.pattern
+		if got := requiredScope(r); got != tt.want {
+			t.Errorf("%s %s needs %q, want %q", tt.method, tt.pattern, got, tt.want)
+		}
+	}
+}
+
+// TestRequiredScopeRouted checks the pattern is there by the time a handler authenticates
+func TestRequiredScopeRouted(t *testing.T) {
+	var got string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/passkeys/", func(w http.ResponseWriter, r *http.Request) {
+		got = requiredScope(r)
+	})
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/api/passkeys/settings", strings.NewReader("{}")))
+	if got != auth.ScopeAccount {
+		t.Fatalf("PUT /api/passkeys/settings needs %q, want %q", got, auth.ScopeAccount)
+	}
+}
+
+func TestIntegrationTokensLackAccount(t *testing.T) {
+	s := &Server{config: &config.Config{}}
+	for _, requested := range [][]string{{}, {auth.ScopeChatSend}, {auth.ScopeChatSend, auth.ScopeBots}} {
+		scopes, apiErr := s.tokenScopes("bob", requested, &auth.UserClaims{})
+		if apiErr != nil {
+			t.Fatalf("%v: %v", requested, apiErr)
+		}
+		claims := &auth.UserClaims{Scope: strings.Join(scopes, " ")}
+		if claims.HasScope(auth.ScopeAccount) {
+			t.Errorf("requesting %v gave %v", requested, scopes)
+		}
+	}
+	scopes, _ := s.tokenScopes("bob", nil, nil)
+	if claims := (&auth.UserClaims{Scope: strings.Join(scopes, " ")}); !claims.HasScope(auth.ScopeAccount) {
+		t.Errorf("a login gets %v, without account", scopes)
+	}
+}
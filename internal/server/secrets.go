@@ -0,0 +1,166 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/auth"
+	"github.com/Chase-Garrett/meadowlark/internal/config"
+	"github.com/Chase-Garrett/meadowlark/internal/keyring"
+	"github.com/Chase-Garrett/meadowlark/internal/mail"
+	"github.com/Chase-Garrett/meadowlark/internal/secrets"
+)
+
+// secretFetchTimeout bounds one request to a remote secrets provider
+const secretFetchTimeout = 10 * time.Second
+
+// NewSecrets builds the provider selected in cfg, wrapped in a cache
+func NewSecrets(cfg *config.Config) (*secrets.Cache, error) {
+	proxy, err := parseOutboundProxy(cfg.OutboundProxy)
+	if err != nil {
+		return nil, err
+	}
+	// the variables stay the source for "env", and the ciphertexts for "aws-kms"
+	env := secrets.Static{
+		secrets.JWTKeys:        cfg.JWTKeys,
+		secrets.EncryptionKeys: cfg.EncryptionKeys,
+		secrets.SMTPUsername:   cfg.SMTPUsername,
+		secrets.SMTPPassword:   cfg.SMTPPassword,
+	}
+	aws := &secrets.AWS{
+		Region:       cfg.AWSRegion,
+		AccessKey:    cfg.AWSAccessKey,
+		SecretKey:    cfg.AWSSecretKey,
+		SessionToken: cfg.AWSSessionToken,
+		Endpoint:     cfg.AWSEndpoint,
+		HTTP:         outboundClient(proxy, secretFetchTimeout),
+	}
+
+	var provider secrets.Provider
+	switch cfg.SecretsProvider {
+	case "env":
+		provider = env
+	case "file":
+		provider = secrets.Dir(cfg.SecretsDir)
+	case "vault":
+		if cfg.VaultAddr == "" || cfg.VaultToken == "" {
+			return nil, fmt.Errorf("vault requires VAULT_ADDR and VAULT_TOKEN")
+		}
+		provider = &secrets.Vault{
+			Addr:  cfg.VaultAddr,
+			Token: cfg.VaultToken,
+			Mount: cfg.VaultMount,
+			Path:  cfg.VaultPath,
+			HTTP:  outboundClient(proxy, secretFetchTimeout),
+		}
+	case "aws-secrets-manager", "aws-kms":
+		if cfg.AWSRegion == "" || cfg.AWSAccessKey == "" || cfg.AWSSecretKey == "" {
+			return nil, fmt.Errorf("%s requires AWS_REGION, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY", cfg.SecretsProvider)
+		}
+		if cfg.SecretsProvider == "aws-kms" {
+			provider = &secrets.KMS{AWS: aws, Source: env}
+		} else {
+			provider = &secrets.SecretsManager{AWS: aws, Prefix: cfg.AWSSecretPrefix}
+		}
+	default:
+		return nil, fmt.Errorf("unknown secrets provider %q, expected env, file, vault, aws-secrets-manager or aws-kms", cfg.SecretsProvider)
+	}
+	return secrets.NewCache(provider), nil
+}
+
+// getSecret fetches one secret with a bounded wait
+func getSecret(store *secrets.Cache, name string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), secretFetchTimeout)
+	defer cancel()
+	value, err := store.Get(ctx, name)
+	if err != nil {
+		return "", fmt.Errorf("fetching %s: %v", name, err)
+	}
+	return value, nil
+}
+
+// loadKeyring fetches an "id:base64key" list, nil when the secret isn't set
+func loadKeyring(store *secrets.Cache, name, currentID string) (*keyring.Keyring, error) {
+	list, err := getSecret(store, name)
+	if err != nil {
+		return nil, err
+	}
+	return parseSecretKeyring(currentID, list)
+}
+
+// parseSecretKeyring parses a key list from the secrets provider. Without a configured id the
+// first entry is current, so a rotation can be done by prepending a key to the secret alone
+func parseSecretKeyring(currentID, list string) (*keyring.Keyring, error) {
+	if currentID == "" {
+		first, _, _ := strings.Cut(list, ",")
+		currentID, _, _ = strings.Cut(strings.TrimSpace(first), ":")
+	}
+	return keyring.Parse(currentID, list)
+}
+
+// loadSigningKeys installs the JWT keys, warning when tokens fall back to the development key
+func loadSigningKeys(cfg *config.Config, store *secrets.Cache) error {
+	keys, err := loadKeyring(store, secrets.JWTKeys, cfg.JWTKeyID)
+	if err != nil {
+		return err
+	}
+	if keys == nil {
+		log.Printf("Warning: no JWT keys configured, session tokens are signed with the built-in development key")
+	}
+	auth.SetSigningKeys(keys)
+	return nil
+}
+
+// watchSecrets registers rotation hooks applying new secret values to the running server
+// and starts refreshing them. A value that doesn't parse is logged and the old one kept
+func watchSecrets(cfg *config.Config, store *secrets.Cache, userStorage *auth.UserStorage, sender mail.Sender) {
+	store.OnRotate(secrets.JWTKeys, func(list string) {
+		keys, err := parseSecretKeyring(cfg.JWTKeyID, list)
+		if err == nil && keys == nil {
+			err = errors.New("the secret is empty")
+		}
+		if err != nil {
+			log.Printf("Ignoring rotated JWT keys: %v", err)
+			return
+		}
+		auth.SetSigningKeys(keys)
+	})
+	store.OnRotate(secrets.EncryptionKeys, func(list string) {
+		keys, err := parseSecretKeyring(cfg.EncryptionKeyID, list)
+		if err == nil && keys != nil {
+			err = keys.CheckAES()
+		}
+		if err == nil {
+			err = userStorage.SetAtRestKeys(keys)
+		}
+		if err != nil {
+			log.Printf("Ignoring rotated encryption keys: %v", err)
+		}
+	})
+	if smtp, ok := sender.(*mail.SMTPSender); ok {
+		rotateLogin := func(string) {
+			username, err := getSecret(store, secrets.SMTPUsername)
+			if err != nil {
+				log.Printf("Ignoring rotated SMTP credentials: %v", err)
+				return
+			}
+			password, err := getSecret(store, secrets.SMTPPassword)
+			if err != nil {
+				log.Printf("Ignoring rotated SMTP credentials: %v", err)
+				return
+			}
+			smtp.SetCredentials(username, password)
+		}
+		store.OnRotate(secrets.SMTPUsername, rotateLogin)
+		store.OnRotate(secrets.SMTPPassword, rotateLogin)
+	}
+
+	// environment variables can't change under a running process
+	if cfg.SecretsProvider != "env" && cfg.SecretsRefresh > 0 {
+		go store.Run(context.Background(), cfg.SecretsRefresh)
+	}
+}
@@ -1,160 +1,763 @@
 package server
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
-	"path/filepath"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/attachments"
 	"github.com/Chase-Garrett/meadowlark/internal/auth"
+	"github.com/Chase-Garrett/meadowlark/internal/billing"
+	"github.com/Chase-Garrett/meadowlark/internal/chaos"
+	"github.com/Chase-Garrett/meadowlark/internal/config"
+	"github.com/Chase-Garrett/meadowlark/internal/emoji"
+	"github.com/Chase-Garrett/meadowlark/internal/flags"
+	"github.com/Chase-Garrett/meadowlark/internal/history"
+	"github.com/Chase-Garrett/meadowlark/internal/identity"
+	"github.com/Chase-Garrett/meadowlark/internal/inbound"
+	"github.com/Chase-Garrett/meadowlark/internal/jobs"
+	"github.com/Chase-Garrett/meadowlark/internal/keyring"
+	"github.com/Chase-Garrett/meadowlark/internal/mail"
+	"github.com/Chase-Garrett/meadowlark/internal/notifications"
+	"github.com/Chase-Garrett/meadowlark/internal/onboarding"
+	"github.com/Chase-Garrett/meadowlark/internal/passkey"
+	"github.com/Chase-Garrett/meadowlark/internal/preview"
 	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+	"github.com/Chase-Garrett/meadowlark/internal/rooms"
+	"github.com/Chase-Garrett/meadowlark/internal/s3"
+	"github.com/Chase-Garrett/meadowlark/internal/secrets"
+	"github.com/Chase-Garrett/meadowlark/internal/sessions"
+	"github.com/Chase-Garrett/meadowlark/internal/sms"
+	"github.com/Chase-Garrett/meadowlark/internal/spam"
+	"github.com/Chase-Garrett/meadowlark/internal/stats"
+	"github.com/Chase-Garrett/meadowlark/internal/support"
+	"github.com/Chase-Garrett/meadowlark/internal/telemetry"
+	"github.com/Chase-Garrett/meadowlark/internal/textpolicy"
 	"github.com/gorilla/websocket"
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin:     func(r *http.Request) bool { return true },
-}
+const maxUsersPage = 500
 
 // server holds all dependencies for meadowlark application
 type Server struct {
-	userStorage *auth.UserStorage
-	hub         *Hub
+	config      *config.Config
+	userStorage UserStore
+	messages    *history.MessageStorage
+	hub         MessageRouter
+	maintenance *maintenanceState
+	upgrader    websocket.Upgrader
+	compression compressionPolicy
+	connLimits  *connectionLimiter
+	spam        *spam.Filter
+	objectStore *s3.Client
+	attachments *attachments.Storage
+	uploads     *attachments.Uploads // resumable uploads in progress
+	previews    *preview.Fetcher
+	archives    *http.Client // calls room archive webhooks
+	exports     *http.Client // calls room export webhooks
+	emoji       *emoji.Storage
+	sms         sms.Sender
+	mail        mail.Sender
+	notify      *notifications.Storage
+	support     *support.Storage
+	inbound     *inbound.Storage
+	passkeys    *passkey.Storage
+	text        *textpolicy.Policy
+	stats       *stats.Collector
+	sessions    *sessions.Log
+	origins     *originPolicy
+	proxies     *proxyPolicy
+	dedupe      *dedupeCache
+	proofs      *proofReplay // DPoP proofs recently accepted
+	rooms       *rooms.Storage
+	static      *staticFiles
+	identity    *identity.Identity
+	telemetry   telemetry.Reporter
+	conns       *connRegistry // metrics of open websocket connections
+	locations   *locationShares
+	faults      *chaos.Faults // failure injection in chaos mode, nil otherwise
+	jobs        *jobs.Scheduler
+	flags       *flags.Set // gradual rollouts, consulted by handlers and the hub
+	onboarding  *onboarding.Storage
+	plan        config.Plan
+	billing     *billing.Outbox  // usage events, nil without a billing webhook
+	billingHook *billing.Webhook // where they are posted
+
+	inboundRoutes inbound.Routes // inbound email addresses and where their mail goes
 }
 
 // create a new server instance
-func NewServer() *Server {
-	userStorage := auth.NewUserStorage("./chat.db")
-	hub := NewHub()
+func NewServer(cfg *config.Config) *Server {
+	store, err := NewSecrets(cfg)
+	if err != nil {
+		log.Fatalf("Failed to set up secrets: %v", err)
+	}
+	if err := loadSigningKeys(cfg, store); err != nil {
+		log.Fatalf("Invalid JWT key configuration: %v", err)
+	}
+	userStorage, err := OpenUserStorage(cfg, store)
+	if err != nil {
+		log.Fatalf("Failed to set up user storage: %v", err)
+	}
+	// loaded by OpenUserStorage already, for the database driver
+	faults, _ := loadFaults(cfg)
+	messages := history.NewMessageStorage(userStorage.DB())
+	if cfg.SessionPolicy != SessionPolicyTakeover && cfg.SessionPolicy != SessionPolicyReject {
+		log.Fatalf("Unknown session policy %q", cfg.SessionPolicy)
+	}
+	if !auth.ValidRecyclingPolicy(cfg.UsernameRecycling) {
+		log.Fatalf("Unknown username recycling policy %q", cfg.UsernameRecycling)
+	}
+	origins, err := newOriginPolicy(cfg.AllowedOrigins, cfg.DevMode)
+	if err != nil {
+		log.Fatalf("Failed to parse allowed origins: %v", err)
+	}
+	if cfg.DevMode {
+		log.Println("Dev mode: accepting websocket connections from any origin")
+	}
+	proxies, err := newProxyPolicy(cfg.TrustedProxies)
+	if err != nil {
+		log.Fatalf("Failed to parse trusted proxies: %v", err)
+	}
+	static, err := newStaticFiles(staticFS(cfg.Desktop), cfg.StaticCacheControl, cfg.StaticGzip)
+	if err != nil {
+		log.Fatalf("Failed to parse static cache policies: %v", err)
+	}
+	serverIdentity, err := identity.LoadOrCreate(cfg.IdentityKeyFile)
+	if err != nil {
+		log.Fatalf("Failed to load server identity key: %v", err)
+	}
+	log.Printf("Server identity fingerprint: %s", serverIdentity.Fingerprint())
+	text, err := newTextPolicy(cfg)
+	if err != nil {
+		log.Fatalf("Failed to set up metadata checks: %v", err)
+	}
+	roomStorage := rooms.NewStorage(userStorage.DB(), text, cfg.BasePath)
+	featureFlags := loadFeatureFlags(cfg.FeatureFlags, userStorage.DB())
+	hub := NewHub(messages, roomStorage, cfg.SessionPolicy, cfg.ReorderWindow)
+	hub.flags = featureFlags
+	hub.recipientPrivacy = cfg.RecipientPrivacy
+	hub.idleTimeout = cfg.AwayTimeout
+	if snap := loadHubSnapshot(cfg.HubSnapshotFile); snap != nil {
+		hub.restore(snap, cfg.HubSnapshotMaxAge)
+	}
 	go hub.Run()
+
+	spamFilter := spam.NewFilter(spam.Config{
+		Enabled:       cfg.SpamEnabled,
+		RatePerMinute: cfg.SpamRatePerMinute,
+		FanoutPerHour: cfg.SpamFanoutPerHour,
+		NewAccountAge: cfg.SpamNewAccountAge,
+		FlagScore:     cfg.SpamFlagScore,
+		ThrottleScore: cfg.SpamThrottleScore,
+		ShadowScore:   cfg.SpamShadowScore,
+	}, spam.NewStorage(userStorage.DB()))
+	go spamFilter.Run()
+	proxy, err := parseOutboundProxy(cfg.OutboundProxy)
+	if err != nil {
+		log.Fatalf("Invalid outbound proxy: %v", err)
+	}
+	objectStore := &s3.Client{
+		Endpoint:  cfg.S3Endpoint,
+		Region:    cfg.S3Region,
+		AccessKey: cfg.S3AccessKey,
+		SecretKey: cfg.S3SecretKey,
+		Bucket:    cfg.S3Bucket,
+	}
+	if proxy != nil {
+		objectStore.HTTP = outboundClient(proxy, 0)
+	}
+	blobs, err := newBlobStore(cfg, objectStore)
+	if err != nil {
+		log.Fatalf("Failed to set up attachment storage: %v", err)
+	}
+	regionBlobs, err := newRegionBlobStores(cfg, proxy)
+	if err != nil {
+		log.Fatalf("Failed to set up data regions: %v", err)
+	}
+	smsSender, err := newSMSSender(cfg, proxy)
+	if err != nil {
+		log.Fatalf("Failed to set up SMS delivery: %v", err)
+	}
+	mailSender, err := newMailSender(cfg, proxy, store)
+	if err != nil {
+		log.Fatalf("Failed to set up email delivery: %v", err)
+	}
+	watchSecrets(cfg, store, userStorage, mailSender)
+	reporter, err := newTelemetryReporter(cfg, proxy)
+	if err != nil {
+		log.Fatalf("Invalid telemetry endpoint: %v", err)
+	}
+	plan, err := findPlan(cfg)
+	if err != nil {
+		log.Fatalf("Invalid plan: %v", err)
+	}
+	billingEvents, billingHook, err := newBilling(cfg, plan, userStorage, proxy)
+	if err != nil {
+		log.Fatalf("Invalid billing webhook: %v", err)
+	}
+	inboundRoutes, err := inbound.ParseRoutes(cfg.InboundEmailRoutes)
+	if err != nil {
+		log.Fatalf("Invalid inbound email routes: %v", err)
+	}
+	attachmentStorage := attachments.NewStorage(userStorage.DB(), blobs, regionBlobs)
+	uploads, err := attachments.NewUploads(cfg.AttachmentUploadDir)
+	if err != nil {
+		log.Fatalf("Failed to create upload staging directory: %v", err)
+	}
+	// seeded from the users, messages and attachments tables, so created after them
+	statsCollector := stats.NewCollector(userStorage.DB())
+	sessionLog := sessions.NewLog(userStorage.DB())
+
 	return &Server{
+		config:      cfg,
 		userStorage: userStorage,
+		messages:    messages,
 		hub:         hub,
+		maintenance: &maintenanceState{},
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:    1024,
+			WriteBufferSize:   1024,
+			CheckOrigin:       origins.check,
+			EnableCompression: cfg.WSCompression,
+		},
+		compression: compressionPolicy{
+			enabled:         cfg.WSCompression,
+			threshold:       cfg.WSCompressionThreshold,
+			encryptedCutoff: cfg.WSCompressionEncryptedMin,
+		},
+		connLimits:  newConnectionLimiter(cfg.MaxConnectionsPerAccount, cfg.MaxConnectionsPerIP),
+		spam:        spamFilter,
+		objectStore: objectStore,
+		attachments: attachmentStorage,
+		uploads:     uploads,
+		previews:    preview.NewFetcher(cfg.PreviewTimeout, cfg.PreviewMaxBytes, cfg.PreviewCacheTTL, proxy),
+		archives:    archiveClient(proxy, cfg.RoomArchivePrivate, archiveTimeout),
+		exports:     archiveClient(proxy, cfg.RoomArchivePrivate, roomExportTimeout),
+		emoji:       emoji.NewStorage(userStorage.DB(), cfg.BasePath),
+		sms:         smsSender,
+		mail:        mailSender,
+		notify:      notifications.NewStorage(userStorage.DB()),
+		support:     support.NewStorage(userStorage.DB()),
+		onboarding: onboarding.NewStorage(userStorage.DB(), onboarding.Settings{
+			Enabled: cfg.WelcomeMessage != "" || len(cfg.WelcomeRooms) > 0,
+			Message: cfg.WelcomeMessage,
+			Rooms:   cfg.WelcomeRooms,
+		}),
+		inbound:     inbound.NewStorage(userStorage.DB()),
+		passkeys:    passkey.NewStorage(userStorage.DB()),
+		stats:       statsCollector,
+		sessions:    sessionLog,
+		origins:     origins,
+		proxies:     proxies,
+		dedupe:      newDedupeCache(cfg.DedupeTTL),
+		proofs:      newProofReplay(cfg.DPoPProofWindow),
+		rooms:       roomStorage,
+		static:      static,
+		identity:    serverIdentity,
+		text:        text,
+		telemetry:   reporter,
+		conns:       newConnRegistry(),
+		locations:   newLocationShares(hub, cfg.LocationMaxDuration, cfg.LocationMinInterval, cfg.LocationSharesPerHour),
+		faults:      faults,
+		jobs:        jobs.NewScheduler(userStorage.DB(), cfg.JobJitter),
+		flags:       featureFlags,
+		plan:        plan,
+		billing:     billingEvents,
+		billingHook: billingHook,
+
+		inboundRoutes: inboundRoutes,
+	}
+}
+
+// newBlobStore picks the attachment backend selected in cfg
+func newBlobStore(cfg *config.Config, objectStore *s3.Client) (attachments.BlobStore, error) {
+	switch cfg.AttachmentStorage {
+	case "file":
+		return attachments.NewFileStore(cfg.AttachmentDir)
+	case "s3":
+		return attachments.NewS3Store(objectStore, cfg.AttachmentS3Prefix, cfg.AttachmentMultipartThreshold)
+	default:
+		return nil, fmt.Errorf("unknown attachment storage %q, expected file or s3", cfg.AttachmentStorage)
+	}
+}
+
+// newSMSSender picks the SMS provider selected in cfg
+func newSMSSender(cfg *config.Config, proxy *url.URL) (sms.Sender, error) {
+	switch cfg.SMSProvider {
+	case "log":
+		return sms.LogSender{}, nil
+	case "twilio":
+		if cfg.TwilioAccountSID == "" || cfg.TwilioAuthToken == "" || cfg.TwilioFrom == "" {
+			return nil, fmt.Errorf("twilio requires MEADOWLARK_TWILIO_ACCOUNT_SID, MEADOWLARK_TWILIO_AUTH_TOKEN and MEADOWLARK_TWILIO_FROM")
+		}
+		return &sms.TwilioSender{
+			AccountSID: cfg.TwilioAccountSID,
+			AuthToken:  cfg.TwilioAuthToken,
+			From:       cfg.TwilioFrom,
+			HTTP:       outboundClient(proxy, 10*time.Second),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown SMS provider %q, expected log or twilio", cfg.SMSProvider)
+	}
+}
+
+// newMailSender picks the email provider selected in cfg
+func newMailSender(cfg *config.Config, proxy *url.URL, store *secrets.Cache) (mail.Sender, error) {
+	switch cfg.MailProvider {
+	case "log":
+		return mail.LogSender{}, nil
+	case "smtp":
+		if cfg.SMTPAddr == "" || cfg.MailFrom == "" {
+			return nil, fmt.Errorf("smtp requires MEADOWLARK_SMTP_ADDR and MEADOWLARK_MAIL_FROM")
+		}
+		if _, err := auth.NormalizeEmail(cfg.MailFrom); err != nil {
+			return nil, fmt.Errorf("MEADOWLARK_MAIL_FROM must be a bare email address")
+		}
+		// SMTP can't go through the SOCKS proxy, so only a relay on this machine keeps it from leaking
+		host, _, err := net.SplitHostPort(cfg.SMTPAddr)
+		if err != nil {
+			return nil, fmt.Errorf("MEADOWLARK_SMTP_ADDR: %v", err)
+		}
+		if ip := net.ParseIP(host); proxy != nil && host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return nil, fmt.Errorf("with MEADOWLARK_OUTBOUND_PROXY set, MEADOWLARK_SMTP_ADDR must be a relay on localhost")
+		}
+		username, err := getSecret(store, secrets.SMTPUsername)
+		if err != nil {
+			return nil, err
+		}
+		password, err := getSecret(store, secrets.SMTPPassword)
+		if err != nil {
+			return nil, err
+		}
+		return &mail.SMTPSender{
+			Addr:     cfg.SMTPAddr,
+			Username: username,
+			Password: password,
+			From:     cfg.MailFrom,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown mail provider %q, expected log or smtp", cfg.MailProvider)
+	}
+}
+
+// NewServerWith builds a Server around users and router alone, without a database, websockets
+// or background work, so handlers that only need accounts and message delivery can be exercised
+// with the mocks package. Handlers relying on other storage must not be called on it
+func NewServerWith(cfg *config.Config, users UserStore, router MessageRouter) (*Server, error) {
+	proxies, err := newProxyPolicy(cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		config:      cfg,
+		userStorage: users,
+		hub:         router,
+		maintenance: &maintenanceState{},
+		proxies:     proxies,
+		proofs:      newProofReplay(cfg.DPoPProofWindow),
+	}, nil
+}
+
+// OpenUserStorage builds the user storage with the hashing settings from cfg and the
+// encryption keys from store
+func OpenUserStorage(cfg *config.Config, store *secrets.Cache) (*auth.UserStorage, error) {
+	hasher, err := auth.NewPasswordHasher(auth.HashingConfig{
+		Algorithm:     cfg.PasswordHash,
+		BcryptCost:    cfg.BcryptCost,
+		Argon2Memory:  uint32(cfg.Argon2Memory),
+		Argon2Time:    uint32(cfg.Argon2Time),
+		Argon2Threads: uint8(cfg.Argon2Threads),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid password hashing configuration: %v", err)
+	}
+
+	peppers, err := keyring.Parse(cfg.PepperID, cfg.Peppers)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pepper configuration: %v", err)
+	}
+
+	atRest, err := loadKeyring(store, secrets.EncryptionKeys, cfg.EncryptionKeyID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key configuration: %v", err)
+	}
+	if atRest != nil {
+		if err := atRest.CheckAES(); err != nil {
+			return nil, fmt.Errorf("invalid encryption key configuration: %v", err)
+		}
+	}
+
+	text, err := newTextPolicy(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata checks: %v", err)
+	}
+	faults, err := loadFaults(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid failure injection: %v", err)
+	}
+	var driver string
+	if faults != nil && faults.DBErrorRate > 0 {
+		driver = chaosDriver
 	}
+
+	return auth.NewUserStorage(cfg.DBPath, auth.StorageOptions{
+		Hasher:  hasher,
+		Peppers: peppers,
+		AtRest:  atRest,
+		Text:    text,
+
+		Recycling: auth.UsernameRecycling{Policy: cfg.UsernameRecycling, Cooldown: cfg.UsernameRecycleCooldown},
+		Driver:    driver,
+	}), nil
 }
 
 // RegistrationRequest defines JSON for the /register endpoint
 type RegistrationRequest struct {
 	Username  string `json:"username"`
 	Password  string `json:"password"`
-	Email     string `json:"email"`     // Frontend sends this, we'll accept it but not store it yet
+	Email     string `json:"email"`     // Optional, can be used to log in
 	PublicKey string `json:"publicKey"` // Optional
 }
 
 // LoginRequest defines JSON for the /api/login endpoint
 type LoginRequest struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username string   `json:"username"` // username or email address
+	Password string   `json:"password"`
+	Scopes   []string `json:"scopes,omitempty"` // every scope the account can hold when omitted
+
+	// stands in for the passkey of accounts that require one
+	RecoveryCode string `json:"recoveryCode,omitempty"`
+
+	// replaces the password of an account with a sign-in reported as not the user's,
+	// see HandleSessionReport
+	NewPassword string `json:"newPassword,omitempty"`
 }
 
-// LoginResponse defines JSON response for login
+// LoginResponse defines JSON response for login. For accounts that require a passkey, a
+// correct password gets no token but a Passkey challenge to finish at /api/login/passkey
 type LoginResponse struct {
-	Token    string `json:"token"`
-	Username string `json:"username"`
+	Token    string            `json:"token,omitempty"`
+	Username string            `json:"username"`
+	Passkey  *PasskeyChallenge `json:"passkey,omitempty"`
+	Scopes   []string          `json:"scopes,omitempty"`
+	// the greeting of an account's first login, see /api/welcome
+	Welcome *onboarding.Welcome `json:"welcome,omitempty"`
 }
 
 // HandleRegister handles the registration of a user
 func (s *Server) HandleRegister(w http.ResponseWriter, r *http.Request) {
+	if s.rejectDuringMaintenance(w) {
+		return
+	}
+
 	var req RegistrationRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondJSONError(w, err.Error(), http.StatusBadRequest)
+	if err := s.readJSON(w, r, &req); err != nil {
+		respondError(w, err)
 		return
 	}
 
-	// Email is accepted but not stored yet (for future use)
-	// PublicKey is optional
-	err := s.userStorage.RegisterNewUser(req.Username, req.Password, req.PublicKey)
-	if err != nil {
-		respondJSONError(w, err.Error(), http.StatusBadRequest)
+	if apiErr := s.checkUserLimit(req.Username); apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+
+	// Email and PublicKey are optional
+	err := s.userStorage.RegisterNewUser(req.Username, req.Password, req.PublicKey, req.Email)
+	if apiErr := textPolicyError(err); apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+	switch err {
+	case nil:
+	case auth.ErrInvalidEmail, auth.ErrEmailTaken:
+		respondIdentifierError(w, err)
+		return
+	case auth.ErrMissingCredentials:
+		respondError(w, apierror.New(http.StatusBadRequest, apierror.MissingCredentials))
+		return
+	case auth.ErrPasswordTooShort:
+		respondError(w, apierror.New(http.StatusBadRequest, apierror.PasswordTooShort).With("min", auth.MinPasswordLength))
+		return
+	case auth.ErrInvalidPublicKey:
+		respondError(w, apierror.New(http.StatusBadRequest, apierror.InvalidPublicKey))
 		return
+	case auth.ErrUsernameTaken:
+		respondError(w, apierror.New(http.StatusConflict, apierror.UsernameTaken))
+		return
+	default:
+		respondInternalError(w, err)
+		return
+	}
+
+	if s.config.DefaultRegion != "" {
+		if err := s.userStorage.SetRegion(req.Username, s.config.DefaultRegion); err != nil {
+			log.Printf("Error tagging %s with region %q: %v", req.Username, s.config.DefaultRegion, err)
+		}
+	}
+	s.stats.UserRegistered()
+	s.billing.Record(billing.Event{Type: billing.EventUserRegistered, Username: req.Username})
+
+	// handed out now so they are at hand when passkeys are required later
+	codes, err := s.userStorage.GenerateRecoveryCodes(req.Username)
+	if err != nil {
+		log.Printf("Error generating recovery codes for %s: %v", req.Username, err)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{
-		"message": "Registration successful",
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":       "Registration successful",
+		"recoveryCodes": codes,
 	})
-	log.Printf("User registered: %s", req.Username)
+	log.Printf("User registered: %s from %s", req.Username, s.clientIP(r))
 }
 
 // HandleLogin handles user login and returns JWT token
 func (s *Server) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	if s.rejectDuringMaintenance(w) {
+		return
+	}
+
 	var req LoginRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondJSONError(w, err.Error(), http.StatusBadRequest)
+	if err := s.readJSON(w, r, &req); err != nil {
+		respondError(w, err)
+		return
+	}
+	jkt, apiErr := s.loginBinding(r)
+	if apiErr != nil {
+		respondError(w, apiErr)
 		return
 	}
 
-	err := s.userStorage.VerifyUser(req.Username, req.Password)
+	username, err := s.userStorage.LookupLogin(req.Username)
+	if err == nil {
+		err = s.userStorage.VerifyUser(username, req.Password)
+	}
+	if err == auth.ErrInvalidCredentials {
+		respondError(w, apierror.New(http.StatusUnauthorized, apierror.InvalidCredentials))
+		return
+	}
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	scopes, apiErr := s.tokenScopes(username, req.Scopes, nil)
+	if apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+	reset, err := s.userStorage.PasswordResetRequired(username)
 	if err != nil {
-		respondJSONError(w, err.Error(), http.StatusUnauthorized)
+		respondInternalError(w, err)
+		return
+	}
+	if reset && req.NewPassword == "" {
+		respondError(w, apierror.New(http.StatusForbidden, apierror.PasswordResetRequired))
+		return
+	}
+
+	// servers built without storage (handler tests) have no passkeys
+	if s.passkeys != nil {
+		required, err := s.passkeys.Required(username)
+		if err != nil {
+			respondInternalError(w, err)
+			return
+		}
+		if required && req.RecoveryCode != "" {
+			if !s.useRecoveryCode(w, r, username, req.RecoveryCode) {
+				return
+			}
+		} else if required && reset {
+			// the new password can't wait for the passkey step, a recovery code goes with it instead,
+			// or the user signs in with the passkey alone and changes the password
+			respondError(w, apierror.New(http.StatusForbidden, apierror.PasswordResetRequired).With("passkey", true))
+			return
+		} else if required {
+			challenge, err := s.assertionOptions(r, passkey.SecondFactor, username)
+			if err != nil {
+				respondInternalError(w, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(LoginResponse{Username: username, Passkey: challenge})
+			return
+		}
+	}
+
+	if reset && !s.resetPassword(w, r, username, req.Password, req.NewPassword) {
 		return
 	}
 
-	token, err := auth.GenerateToken(req.Username)
+	token, err := s.issueToken(username, auth.TokenOptions{JKT: jkt, Scopes: scopes})
 	if err != nil {
-		respondJSONError(w, "Failed to generate token", http.StatusInternalServerError)
+		respondInternalError(w, err)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(LoginResponse{
 		Token:    token,
-		Username: req.Username,
+		Username: username,
+		Scopes:   scopes,
+		Welcome:  s.onboard(username),
 	})
-	log.Printf("User logged in: %s", req.Username)
+	log.Printf("User logged in: %s from %s", username, s.clientIP(r))
+	s.noticeOrigin(username, s.clientIP(r), r.UserAgent(), "login")
 }
 
-// HandleGetUsers returns a list of all users (for direct messaging)
+// HandleGetUsers pages through registered users by name, optionally those starting with ?q=
+// (for direct messaging)
 func (s *Server) HandleGetUsers(w http.ResponseWriter, r *http.Request) {
-	users, err := s.userStorage.GetAllUsers()
+	p, apiErr := readPage(r, maxUsersPage, true)
+	if apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+	var after string
+	if _, apiErr := p.after(&after); apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+
+	users, err := s.userStorage.ListUsers(p.Query, after, p.Desc, p.Limit)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+
+	p.respond(w, r, map[string]interface{}{"users": users}, len(users), func() interface{} {
+		return users[len(users)-1]
+	})
+}
+
+// HandleDeadLetterStats returns statistics about undeliverable messages (admin only)
+func (s *Server) HandleDeadLetterStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := s.messages.DeadLetterStats(50)
 	if err != nil {
-		respondJSONError(w, err.Error(), http.StatusInternalServerError)
+		respondInternalError(w, err)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(users)
+	json.NewEncoder(w).Encode(stats)
+}
+
+// Helper function to respond with a structured JSON error
+func respondError(w http.ResponseWriter, err *apierror.Error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(err.Status)
+	json.NewEncoder(w).Encode(err)
 }
 
-// Helper function to respond with JSON error
-func respondJSONError(w http.ResponseWriter, message string, statusCode int) {
+// respondWithETag sends v as JSON tagged with a hash of the body, answering 304 Not Modified
+// when the client already has it so unchanged lists aren't downloaded again
+func respondWithETag(w http.ResponseWriter, r *http.Request, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(map[string]string{"error": message})
+	w.Write(append(data, '\n'))
+}
+
+// respondInternalError logs the cause and hides it from the client
+func respondInternalError(w http.ResponseWriter, err error) {
+	log.Printf("Internal error: %v", err)
+	respondError(w, apierror.New(http.StatusInternalServerError, apierror.InternalError))
+}
+
+func respondMethodNotAllowed(w http.ResponseWriter) {
+	respondError(w, apierror.New(http.StatusMethodNotAllowed, apierror.MethodNotAllowed))
 }
 
 // Middleware to authenticate JWT tokens
-func (s *Server) authenticateRequest(r *http.Request) (string, error) {
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		return "", fmt.Errorf("authorization header required")
+func (s *Server) authenticateRequest(r *http.Request) (string, *apierror.Error) {
+	if r.Header.Get("Authorization") == "" {
+		return "", apierror.New(http.StatusUnauthorized, apierror.AuthRequired)
 	}
 
-	parts := strings.Split(authHeader, " ")
-	if len(parts) != 2 || parts[0] != "Bearer" {
-		return "", fmt.Errorf("invalid authorization header format")
+	token := requestToken(r)
+	if token == "" {
+		return "", apierror.New(http.StatusUnauthorized, apierror.AuthRequired)
 	}
 
-	username, err := auth.ValidateToken(parts[1])
+	claims, err := auth.ParseClaims(token)
 	if err != nil {
-		return "", fmt.Errorf("invalid token: %v", err)
+		return "", apierror.New(http.StatusUnauthorized, apierror.InvalidToken)
+	}
+	if apiErr := s.checkBinding(r, claims, token, r.Header.Get("DPoP")); apiErr != nil {
+		return "", apiErr
+	}
+	if apiErr := checkScope(r, claims); apiErr != nil {
+		return "", apiErr
+	}
+
+	// tokens issued before a rename keep working while the old name is an alias
+	username, err := s.userStorage.ResolveUsername(claims.Username)
+	if err != nil || !tokenCurrent(s.userStorage, s.config.Tenant, username, claims) {
+		return "", apierror.New(http.StatusUnauthorized, apierror.InvalidToken)
 	}
 
 	return username, nil
 }
 
+// requireAdmin authenticates the request and checks the user is a configured admin
+// writes the error response and returns false if the request should not proceed
+func (s *Server) requireAdmin(w http.ResponseWriter, r *http.Request) (string, bool) {
+	username, err := s.authenticateRequest(r)
+	if err != nil {
+		respondError(w, err)
+		return "", false
+	}
+	if !s.config.IsAdmin(username) {
+		respondError(w, apierror.New(http.StatusForbidden, apierror.AdminRequired))
+		return "", false
+	}
+	return username, true
+}
+
 // HandleGetPublicKey serves a user's publickey
 func (s *Server) HandleGetPublicKey(w http.ResponseWriter, r *http.Request) {
-	username := strings.TrimPrefix(r.URL.Path, "/keys/")
-	publicKey, err := s.userStorage.GetUserPublicKey(username)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+	username, err := s.userStorage.ResolveUsername(strings.TrimPrefix(r.URL.Path, "/keys/"))
+	var publicKey []byte
+	if err == nil {
+		publicKey, err = s.userStorage.GetUserPublicKey(username)
+	}
+	switch err {
+	case nil:
+	case auth.ErrUserNotFound:
+		respondError(w, apierror.New(http.StatusNotFound, apierror.UserNotFound))
+		return
+	case auth.ErrNoPublicKey:
+		respondError(w, apierror.New(http.StatusNotFound, apierror.PublicKeyMissing))
+		return
+	default:
+		respondInternalError(w, err)
 		return
 	}
 
@@ -166,141 +769,1072 @@ func (s *Server) HandleGetPublicKey(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// closeWithError sends an error control frame and closes the connection, the close reason
+// carries the error code and how long to wait before reconnecting, 0 meaning don't
+func closeWithError(conn *websocket.Conn, username string, closeCode int, apiErr *apierror.Error, retryAfter int) {
+	deadline := time.Now().Add(time.Second)
+	conn.SetWriteDeadline(deadline)
+	conn.WriteJSON(protocol.NewControlMessage(username, protocol.EventError, apiErr))
+	reason := protocol.CloseReason{Code: apiErr.Code, Retry: retryAfter > 0, RetryAfter: retryAfter}
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeCode, reason.String()), deadline)
+	conn.Close()
+}
+
 // HandleConnections handles incoming websocket connections
 func (s *Server) HandleConnections(w http.ResponseWriter, r *http.Request) {
-	// Get token from query parameter or Authorization header
+	if s.rejectDuringMaintenance(w) {
+		return
+	}
+
+	// Get token from query parameter or Authorization header, and likewise the DPoP proof:
+	// browsers can't set headers on websocket requests
 	token := r.URL.Query().Get("token")
 	if token == "" {
-		authHeader := r.Header.Get("Authorization")
-		if authHeader != "" {
-			parts := strings.Split(authHeader, " ")
-			if len(parts) == 2 && parts[0] == "Bearer" {
-				token = parts[1]
-			}
-		}
+		token = requestToken(r)
+	}
+	proof := r.URL.Query().Get("dpop")
+	if proof == "" {
+		proof = r.Header.Get("DPoP")
 	}
 
 	if token == "" {
-		http.Error(w, "Authentication token required", http.StatusUnauthorized)
+		respondError(w, apierror.New(http.StatusUnauthorized, apierror.AuthRequired))
+		return
+	}
+
+	// checked before the upgrade so the rejection is counted and gets a structured error
+	if !s.origins.check(r) {
+		s.origins.rejected.Add(1)
+		log.Printf("Warning: rejected websocket origin %q from %s", r.Header.Get("Origin"), s.clientIP(r))
+		respondError(w, apierror.New(http.StatusForbidden, apierror.OriginNotAllowed))
 		return
 	}
 
-	username, err := auth.ValidateToken(token)
+	claims, err := auth.ParseClaims(token)
 	if err != nil {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		respondError(w, apierror.New(http.StatusUnauthorized, apierror.InvalidToken))
 		return
 	}
+	if apiErr := s.checkBinding(r, claims, token, proof); apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+	username, err := s.userStorage.ResolveUsername(claims.Username)
+	if err != nil || !tokenCurrent(s.userStorage, s.config.Tenant, username, claims) {
+		respondError(w, apierror.New(http.StatusUnauthorized, apierror.InvalidToken))
+		return
+	}
+	var expiresAt time.Time
+	if claims.ExpiresAt != nil {
+		expiresAt = claims.ExpiresAt.Time
+	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	// the connection outlives the request, readPump and writePump bound it from here on
+	liftDeadlines(w)
+	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
 		return
 	}
+	// a larger frame closes the connection with 1009 before it is buffered
+	conn.SetReadLimit(protocol.MaxFrameSize)
+
+	createdAt, err := s.userStorage.CreatedAt(username)
+	if err != nil {
+		closeWithError(conn, username, protocol.CloseAuthExpired, apierror.New(http.StatusUnauthorized, apierror.UserNotFound), 0)
+		return
+	}
+	status, err := s.userStorage.Status(username)
+	if err != nil {
+		// shown with the automatic status rather than turned away
+		log.Printf("Error loading the status of %s: %v", username, err)
+	}
+	dnd, err := s.notify.DoNotDisturb(username)
+	if err != nil {
+		log.Printf("Error loading the do-not-disturb schedule of %s: %v", username, err)
+	}
+
+	release, reason := s.connLimits.acquire(username, s.clientIP(r))
+	if release == nil {
+		log.Printf("Rejected connection for %s from %s: %s", username, s.clientIP(r), reason)
+		s.sessions.Record(sessions.Event{
+			Username:    username,
+			Kind:        sessions.EventRejected,
+			IP:          s.clientIP(r),
+			UserAgent:   r.UserAgent(),
+			CloseCode:   protocol.CloseTooManyConnections,
+			CloseReason: reason,
+		})
+		closeWithError(conn, username, protocol.CloseTooManyConnections,
+			apierror.New(http.StatusTooManyRequests, apierror.TooManyConnections).With("detail", reason), connectionRetryAfter)
+		return
+	}
+
+	hello, version, apiErr := readHello(conn, s.config.WSHelloTimeout)
+	if apiErr != nil {
+		release()
+		log.Printf("Rejected connection for %s from %s: %s", username, s.clientIP(r), apiErr.Code)
+		s.sessions.Record(sessions.Event{
+			Username:    username,
+			Kind:        sessions.EventRejected,
+			IP:          s.clientIP(r),
+			UserAgent:   r.UserAgent(),
+			CloseCode:   protocol.CloseProtocolViolation,
+			CloseReason: apiErr.Code,
+		})
+		closeWithError(conn, username, protocol.CloseProtocolViolation, apiErr, 0)
+		return
+	}
+	version = s.flaggedVersion(version, username)
+
+	if s.compression.enabled {
+		if err := conn.SetCompressionLevel(s.config.WSCompressionLevel); err != nil {
+			log.Printf("Invalid compression level %d: %v", s.config.WSCompressionLevel, err)
+		}
+	}
+
+	client := &Client{
+		hub:         s.hub,
+		conn:        conn,
+		send:        newSendQueues(),
+		username:    username,
+		messages:    s.messages,
+		users:       s.userStorage,
+		compression: s.compression,
+		release:     release,
+		spam:        s.spam,
+		createdAt:   createdAt,
+		contacts:    make(map[string]bool),
+		stats:       s.stats,
+		sessions:    s.sessions,
+		ip:          s.clientIP(r),
+		userAgent:   r.UserAgent(),
+		dedupe:      s.dedupe,
+		rooms:       s.rooms,
+		locations:   s.locations,
+		verbose:     s.config.Verbose,
+		sessionID:   newSessionID(),
+		deviceID:    hello.DeviceID,
+		version:     version,
+		conns:       s.conns,
+		faults:      s.faults,
+		flags:       s.flags,
+
+		reauthWarning: s.config.TokenRefreshWarning,
+		keyBinding:    claims.BoundTo(),
+		tenant:        s.config.Tenant,
+		canSend:       claims.HasScope(auth.ScopeChatSend),
+		pingInterval:  s.config.WSPingInterval,
 
-	client := &Client{hub: s.hub, conn: conn, send: make(chan *protocol.Message, 256), username: username}
-	client.hub.register <- client
+		recipientPrivacy: s.config.RecipientPrivacy,
 
-	log.Printf("Client connected: %s", username)
+		status:      status,
+		dnd:         dnd,
+		idleTimeout: s.config.AwayTimeout,
+	}
+	client.lastActive.Store(time.Now().UnixNano())
+	client.metrics = s.conns.add(client)
+	// forwarded before the client registers, so only the user's other connection is told
+	s.noticeOrigin(username, client.ip, client.userAgent, "websocket")
+	// the hello goes first, then the hub may queue live messages, then missed ones are replayed
+	backfill := s.greet(client, version, hello.Cursor)
+	client.hub.Register(client)
+	client.scheduleExpiry(expiresAt)
+	s.stats.UserActive(username)
+	s.sessions.Record(sessions.Event{Username: username, Kind: sessions.EventConnect, IP: client.ip, UserAgent: client.userAgent})
+
+	log.Printf("Client connected: %s (device %s, protocol %d)", username, client.deviceID, version)
 
 	go client.writePump()
 	go client.readPump()
+	if backfill {
+		go client.backfill(hello.Cursor, s.config.WSBackfillLimit)
+	}
 }
 
-// ServeStaticFiles serves static files from the static directory
-func (s *Server) ServeStaticFiles(w http.ResponseWriter, r *http.Request) {
-	// Skip API routes
-	if strings.HasPrefix(r.URL.Path, "/api") ||
-		strings.HasPrefix(r.URL.Path, "/ws") ||
-		strings.HasPrefix(r.URL.Path, "/keys") ||
-		strings.HasPrefix(r.URL.Path, "/register") {
-		http.NotFound(w, r)
-		return
+func Start() {
+	cfg := config.Load()
+	if cfg.Desktop {
+		prepareDesktop(cfg)
 	}
-
-	// Get the requested path
-	path := r.URL.Path
-	if path == "/" || path == "" {
-		path = "/index.html"
+	if cfg.Dev {
+		prepareDev(cfg)
+	}
+	selfCheck(cfg)
+	server := NewServer(cfg)
+	if err := stampSchemaVersion(server.userStorage.DB()); err != nil {
+		log.Printf("Error recording the schema version: %v", err)
+	}
+	if cfg.Dev {
+		server.seedDevFixtures()
 	}
+	server.scheduleJobs()
+	server.jobs.Start()
+	go server.runTelemetry(cfg.TelemetryInterval)
 
-	// Remove leading slash and build full path
-	localPath := strings.TrimPrefix(path, "/")
-	fullPath := filepath.Join("cmd", "static", localPath)
+	registerRoutes(http.DefaultServeMux, server, cfg)
+	tenants := startTenants(cfg)
+	handler := tenants.route(withBasePath(cfg.BasePath, http.DefaultServeMux))
 
-	// Check if file exists
-	info, err := os.Stat(fullPath)
+	if cfg.DebugAddr != "" {
+		server.serveDebug(cfg.DebugAddr)
+	}
+	if server.faults != nil {
+		log.Printf("Chaos mode: injecting up to %v latency, %v dropped frames, %v disconnects and %v database errors",
+			cfg.ChaosLatency, cfg.ChaosDropRate, cfg.ChaosDisconnectRate, cfg.ChaosDBErrorRate)
+		server.faults.Arm()
+	}
+	if cfg.Desktop {
+		server.runDesktop()
+		return
+	}
+	if cfg.MDNS {
+		advertise(cfg)
+	}
+	if cfg.TorListenAddr != "" || cfg.TorControl != "" {
+		serveOnion(cfg, handler)
+	}
+
+	listeners, err := listen(cfg)
 	if err != nil {
-		if os.IsNotExist(err) {
-			// If file doesn't exist and it's not a root request, try index.html (for SPA routing)
-			if path != "/index.html" {
-				fullPath = filepath.Join("cmd", "static", "index.html")
-				info, err = os.Stat(fullPath)
-			}
-			if err != nil {
-				http.NotFound(w, r)
-				return
+		log.Fatal("Listen: ", err)
+	}
+	srv := newHTTPServer(cfg, handler)
+	srv.ConnContext = tagLocalSocket
+	addrs := make([]string, 0, len(listeners))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			if err := srv.Serve(listener); err != http.ErrServerClosed {
+				log.Fatal("Serve: ", err)
 			}
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+		}(listener)
+		addrs = append(addrs, listener.Addr().Network()+":"+listener.Addr().String())
 	}
+	log.Printf("HTTP server started on %s under %s/", strings.Join(addrs, ", "), cfg.BasePath)
+	sdNotify("READY=1\nSTATUS=Serving on " + strings.Join(addrs, ", "))
+	go server.runWatchdog()
 
-	// Prevent directory listing
-	if info.IsDir() {
-		http.NotFound(w, r)
-		return
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	log.Printf("Received %v, shutting down", <-stop)
+	sdNotify("STOPPING=1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down HTTP server: %v", err)
 	}
+	server.close()
+	tenants.close()
+}
 
-	// Set appropriate content type based on extension
-	ext := filepath.Ext(fullPath)
-	switch ext {
-	case ".html":
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	case ".js":
-		w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
-	case ".css":
-		w.Header().Set("Content-Type", "text/css; charset=utf-8")
-	default:
-		w.Header().Set("Content-Type", "application/octet-stream")
+// close saves the hub's state and releases storage once the HTTP server has stopped
+func (s *Server) close() {
+	s.saveHubSnapshot()
+	if err := s.stats.Flush(); err != nil {
+		log.Printf("Error flushing stats: %v", err)
+	}
+	if err := s.userStorage.DB().Close(); err != nil {
+		log.Printf("Error closing database: %v", err)
 	}
+}
 
-	http.ServeFile(w, r, fullPath)
+// routeScope is the scope a route needs to read, with GET, HEAD or OPTIONS, and to write,
+// with any other method
+type routeScope struct {
+	read, write string
 }
 
-func Start() {
-	server := NewServer()
+var (
+	scopeRead    = routeScope{auth.ScopeReadOnly, auth.ScopeReadOnly}
+	scopeSend    = routeScope{auth.ScopeReadOnly, auth.ScopeChatSend}
+	scopeAccount = routeScope{auth.ScopeReadOnly, auth.ScopeAccount}
+	scopeBots    = routeScope{auth.ScopeBots, auth.ScopeBots}
+	scopeAdmin   = routeScope{auth.ScopeAdmin, auth.ScopeAdmin}
+)
 
-	// Static file serving
-	http.HandleFunc("/", server.ServeStaticFiles)
+// routeScopes has the scope of every route that authenticates, by the pattern it is
+// registered with here or on the debug listener. POSTs that only look things up need no
+// more than readonly, and anything that secures or removes the account needs account, so a
+// token that sends messages can't take the account over
+var routeScopes = map[string]routeScope{
+	"/api/passkeys":                  scopeAccount,
+	"/api/passkeys/":                 scopeAccount,
+	"/api/tokens":                    scopeBots,
+	"/api/users":                     scopeRead,
+	"/api/attachments":               scopeSend,
+	"/api/attachments/":              scopeSend,
+	"/api/presence":                  scopeRead,
+	"/api/status":                    scopeSend,
+	"/api/sync":                      scopeRead,
+	"/api/preview":                   scopeRead,
+	"/api/account":                   scopeAccount,
+	"/api/account/username":          scopeAccount,
+	"/api/password/change":           scopeAccount,
+	"/api/account/recovery-codes":    scopeAccount,
+	"/api/account/key":               scopeAccount,
+	"/api/account/phone":             scopeAccount,
+	"/api/account/phone/verify":      scopeAccount,
+	"/api/account/email":             scopeAccount,
+	"/api/account/email/verify":      scopeAccount,
+	"/api/account/notifications":     scopeSend,
+	"/api/account/notifications/dnd": scopeSend,
+	"/api/location/shares":           scopeSend,
+	"/api/location/shares/":          scopeSend,
+	"/api/saved":                     scopeSend,
+	"/api/saved/":                    scopeSend,
+	"/api/drafts":                    scopeSend,
+	"/api/drafts/":                   scopeSend,
+	"/api/conversations/":            scopeSend,
+	"/api/export":                    scopeRead,
+	"/api/support":                   scopeSend,
+	"/api/flags":                     scopeRead,
+	"/api/welcome":                   scopeRead,
+	"/api/contacts/discover":         scopeRead,
+	"/api/rooms":                     scopeSend,
+	"/api/rooms/directory":           scopeRead,
+	"/api/rooms/":                    scopeSend,
+	"/api/messages/missing":          scopeRead,
+	"/api/sessions/report":           scopeAccount,
+	"/api/sessions/history":          scopeRead,
+	"/api/emoji":                     scopeRead,
+	"/api/emails":                    scopeRead,
 
-	// API endpoints
-	http.HandleFunc("/api/register", server.HandleRegister)
-	http.HandleFunc("/api/login", server.HandleLogin)
-	http.HandleFunc("/api/users", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	"/api/admin/maintenance":      scopeAdmin,
+	"/api/admin/kick":             scopeAdmin,
+	"/api/admin/users/":           scopeAdmin,
+	"/api/admin/support":          scopeAdmin,
+	"/api/admin/support/":         scopeAdmin,
+	"/api/admin/deadletters":      scopeAdmin,
+	"/api/admin/spam":             scopeAdmin,
+	"/api/admin/spam/flags":       scopeAdmin,
+	"/api/admin/spam/held":        scopeAdmin,
+	"/api/admin/backup":           scopeAdmin,
+	"/api/admin/holds":            scopeAdmin,
+	"/api/admin/holds/":           scopeAdmin,
+	"/api/admin/retention":        scopeAdmin,
+	"/api/admin/retention/report": scopeAdmin,
+	"/api/admin/emoji":            scopeAdmin,
+	"/api/admin/emoji/":           scopeAdmin,
+	"/api/admin/flags":            scopeAdmin,
+	"/api/admin/flags/":           scopeAdmin,
+	"/api/admin/stats":            scopeAdmin,
+	"/api/admin/connections":      scopeAdmin,
+	"/api/admin/hub":              scopeAdmin,
+	"/api/admin/onboarding":       scopeAdmin,
+	"/api/admin/plan":             scopeAdmin,
+	"/api/admin/telemetry":        scopeAdmin,
+
+	"/debug/pprof/":  scopeAdmin,
+	"/debug/runtime": scopeAdmin,
+	"/debug/hub":     scopeAdmin,
+}
+
+// routeMux is where routes are registered, an *http.ServeMux outside tests
+type routeMux interface {
+	HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request))
+}
+
+// registerRoutes serves server's static files and API on mux, the routes that authenticate
+// need an entry in routeScopes
+func registerRoutes(mux routeMux, server *Server, cfg *config.Config) {
+	// Static file serving
+	mux.HandleFunc("/", server.ServeStaticFiles)
+
+	// API endpoints
+	mux.HandleFunc("/api/register", server.HandleRegister)
+	mux.HandleFunc("/api/login", server.HandleLogin)
+	mux.HandleFunc("/api/login/passkey", server.HandlePasskeyLogin)
+	mux.HandleFunc("/api/login/passkey/challenge", server.HandlePasskeyLoginChallenge)
+	passkeys := func(w http.ResponseWriter, r *http.Request) {
+		username, err := server.authenticateRequest(r)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		server.HandlePasskeys(w, r, username)
+	}
+	mux.HandleFunc("/api/passkeys", passkeys)
+	mux.HandleFunc("/api/passkeys/", passkeys)
+	mux.HandleFunc("/api/tokens", func(w http.ResponseWriter, r *http.Request) {
+		username, err := server.authenticateRequest(r)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		server.HandleIssueToken(w, r, username)
+	})
+	mux.HandleFunc("/api/users", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondMethodNotAllowed(w)
 			return
 		}
 		// Authenticate the request
 		_, err := server.authenticateRequest(r)
 		if err != nil {
-			respondJSONError(w, err.Error(), http.StatusUnauthorized)
+			respondError(w, err)
 			return
 		}
 		server.HandleGetUsers(w, r)
 	})
+	mux.HandleFunc("/api/attachments", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			respondMethodNotAllowed(w)
+			return
+		}
+		username, err := server.authenticateRequest(r)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		server.HandleCreateAttachment(w, r, username)
+	})
+	mux.HandleFunc("/api/attachments/", func(w http.ResponseWriter, r *http.Request) {
+		username, err := server.authenticateRequest(r)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		server.HandleAttachment(w, r, username)
+	})
+	mux.HandleFunc("/api/presence", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondMethodNotAllowed(w)
+			return
+		}
+		username, err := server.authenticateRequest(r)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		server.HandlePresence(w, r, username)
+	})
+	mux.HandleFunc("/api/status", func(w http.ResponseWriter, r *http.Request) {
+		username, err := server.authenticateRequest(r)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		server.HandleStatus(w, r, username)
+	})
+	mux.HandleFunc("/api/sync", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			respondMethodNotAllowed(w)
+			return
+		}
+		username, err := server.authenticateRequest(r)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		server.HandleSync(w, r, username)
+	})
+	mux.HandleFunc("/api/preview", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			respondMethodNotAllowed(w)
+			return
+		}
+		username, err := server.authenticateRequest(r)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		server.HandlePreview(w, r, username)
+	})
+	mux.HandleFunc("/api/account", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			respondMethodNotAllowed(w)
+			return
+		}
+		username, err := server.authenticateRequest(r)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		server.HandleDeleteAccount(w, r, username)
+	})
+	mux.HandleFunc("/api/account/username", func(w http.ResponseWriter, r *http.Request) {
+		username, err := server.authenticateRequest(r)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		server.HandleUsername(w, r, username)
+	})
+	mux.HandleFunc("/api/password/change", func(w http.ResponseWriter, r *http.Request) {
+		username, err := server.authenticateRequest(r)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		server.HandleChangePassword(w, r, username)
+	})
+	mux.HandleFunc("/api/account/recovery-codes", func(w http.ResponseWriter, r *http.Request) {
+		username, err := server.authenticateRequest(r)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		server.HandleRecoveryCodes(w, r, username)
+	})
+	mux.HandleFunc("/api/account/key", func(w http.ResponseWriter, r *http.Request) {
+		username, err := server.authenticateRequest(r)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		server.HandleAccountKey(w, r, username)
+	})
+	mux.HandleFunc("/api/account/phone", func(w http.ResponseWriter, r *http.Request) {
+		username, err := server.authenticateRequest(r)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		server.HandlePhone(w, r, username)
+	})
+	mux.HandleFunc("/api/account/phone/verify", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			respondMethodNotAllowed(w)
+			return
+		}
+		username, err := server.authenticateRequest(r)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		server.HandlePhoneVerify(w, r, username)
+	})
+	mux.HandleFunc("/api/account/email", func(w http.ResponseWriter, r *http.Request) {
+		username, err := server.authenticateRequest(r)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		server.HandleEmail(w, r, username)
+	})
+	mux.HandleFunc("/api/account/email/verify", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			respondMethodNotAllowed(w)
+			return
+		}
+		username, err := server.authenticateRequest(r)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		server.HandleEmailVerify(w, r, username)
+	})
+	mux.HandleFunc("/api/account/notifications", func(w http.ResponseWriter, r *http.Request) {
+		username, err := server.authenticateRequest(r)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		server.HandleNotificationPreferences(w, r, username)
+	})
+	mux.HandleFunc("/api/account/notifications/dnd", func(w http.ResponseWriter, r *http.Request) {
+		username, err := server.authenticateRequest(r)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		server.HandleDoNotDisturb(w, r, username)
+	})
+	locationShares := func(w http.ResponseWriter, r *http.Request) {
+		username, err := server.authenticateRequest(r)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		server.HandleLocationShares(w, r, username)
+	}
+	mux.HandleFunc("/api/location/shares", locationShares)
+	mux.HandleFunc("/api/location/shares/", locationShares)
+	saved := func(w http.ResponseWriter, r *http.Request) {
+		username, err := server.authenticateRequest(r)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		server.HandleSaved(w, r, username)
+	}
+	mux.HandleFunc("/api/saved", saved)
+	mux.HandleFunc("/api/saved/", saved)
+	drafts := func(w http.ResponseWriter, r *http.Request) {
+		username, err := server.authenticateRequest(r)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		server.HandleDrafts(w, r, username)
+	}
+	mux.HandleFunc("/api/drafts", drafts)
+	mux.HandleFunc("/api/drafts/", drafts)
+	mux.HandleFunc("/api/conversations/", func(w http.ResponseWriter, r *http.Request) {
+		username, err := server.authenticateRequest(r)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		server.HandleConversationSettings(w, r, username)
+	})
+	mux.HandleFunc("/api/export", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondMethodNotAllowed(w)
+			return
+		}
+		username, err := server.authenticateRequest(r)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		server.HandleExport(w, r, username)
+	})
+	mux.HandleFunc("/api/support", func(w http.ResponseWriter, r *http.Request) {
+		username, err := server.authenticateRequest(r)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		server.HandleSupport(w, r, username)
+	})
+	mux.HandleFunc("/api/flags", func(w http.ResponseWriter, r *http.Request) {
+		username, err := server.authenticateRequest(r)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		server.HandleFlags(w, r, username)
+	})
+	mux.HandleFunc("/api/welcome", func(w http.ResponseWriter, r *http.Request) {
+		username, err := server.authenticateRequest(r)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		server.HandleWelcome(w, r, username)
+	})
+	mux.HandleFunc("/api/contacts/discover", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			respondMethodNotAllowed(w)
+			return
+		}
+		username, err := server.authenticateRequest(r)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		server.HandleDiscover(w, r, username)
+	})
+	mux.HandleFunc("/api/rooms", func(w http.ResponseWriter, r *http.Request) {
+		username, err := server.authenticateRequest(r)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		server.HandleRooms(w, r, username)
+	})
+	mux.HandleFunc("/api/rooms/directory", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondMethodNotAllowed(w)
+			return
+		}
+		username, err := server.authenticateRequest(r)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		server.HandleRoomDirectory(w, r, username)
+	})
+	mux.HandleFunc("/api/rooms/", func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/avatar") && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+			server.HandleRoomAvatarImage(w, r)
+			return
+		}
+		username, err := server.authenticateRequest(r)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		server.HandleRoom(w, r, username)
+	})
+	mux.HandleFunc("/public/rooms/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			respondMethodNotAllowed(w)
+			return
+		}
+		server.HandlePublicRoom(w, r)
+	})
+	mux.HandleFunc("/feeds/rooms/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			respondMethodNotAllowed(w)
+			return
+		}
+		server.HandleRoomFeed(w, r)
+	})
+	mux.HandleFunc("/api/messages/missing", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondMethodNotAllowed(w)
+			return
+		}
+		username, err := server.authenticateRequest(r)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		server.HandleMissingMessages(w, r, username)
+	})
+	mux.HandleFunc("/api/sessions/report", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			respondMethodNotAllowed(w)
+			return
+		}
+		username, err := server.authenticateRequest(r)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		server.HandleSessionReport(w, r, username)
+	})
+	mux.HandleFunc("/api/sessions/history", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondMethodNotAllowed(w)
+			return
+		}
+		username, err := server.authenticateRequest(r)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		server.HandleSessionHistory(w, r, username)
+	})
+	mux.HandleFunc("/api/i18n", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondMethodNotAllowed(w)
+			return
+		}
+		server.HandleLocales(w, r)
+	})
+	mux.HandleFunc("/api/i18n/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondMethodNotAllowed(w)
+			return
+		}
+		server.HandleTranslations(w, r)
+	})
+	mux.HandleFunc("/api/emoji", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondMethodNotAllowed(w)
+			return
+		}
+		if _, err := server.authenticateRequest(r); err != nil {
+			respondError(w, err)
+			return
+		}
+		server.HandleEmojiManifest(w, r)
+	})
+	mux.HandleFunc("/api/emoji/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			respondMethodNotAllowed(w)
+			return
+		}
+		server.HandleEmojiImage(w, r)
+	})
 
 	// Legacy endpoints (kept for compatibility)
-	http.HandleFunc("/register", server.HandleRegister)
-	http.HandleFunc("/keys/", server.HandleGetPublicKey)
+	mux.HandleFunc("/register", server.HandleRegister)
+	mux.HandleFunc("/keys/", server.signed(server.HandleGetPublicKey))
+	mux.HandleFunc("/.well-known/meadowlark/identity", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondMethodNotAllowed(w)
+			return
+		}
+		server.signed(server.HandleIdentity)(w, r)
+	})
+	mux.HandleFunc("/api/capabilities", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondMethodNotAllowed(w)
+			return
+		}
+		server.signed(server.HandleCapabilities)(w, r)
+	})
+	mux.HandleFunc("/api/keylog", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondMethodNotAllowed(w)
+			return
+		}
+		server.HandleKeyLog(w, r)
+	})
+	mux.HandleFunc("/api/keylog/head", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondMethodNotAllowed(w)
+			return
+		}
+		server.signed(server.HandleKeyLogHead)(w, r)
+	})
+	mux.HandleFunc("/api/keylog/proof/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondMethodNotAllowed(w)
+			return
+		}
+		server.signed(server.HandleKeyProof)(w, r)
+	})
 
 	// WebSocket endpoint
-	http.HandleFunc("/ws", server.HandleConnections)
+	mux.HandleFunc("/ws", server.HandleConnections)
+	mux.HandleFunc("/api/hooks/email", func(w http.ResponseWriter, r *http.Request) {
+		if cfg.InboundEmailToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			respondMethodNotAllowed(w)
+			return
+		}
+		if !server.inboundAuthorized(r) {
+			respondError(w, apierror.New(http.StatusUnauthorized, apierror.AuthRequired))
+			return
+		}
+		server.HandleInboundEmail(w, r)
+	})
+	mux.HandleFunc("/api/emails", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondMethodNotAllowed(w)
+			return
+		}
+		username, err := server.authenticateRequest(r)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		server.HandleEmails(w, r, username)
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if cfg.MetricsToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodGet {
+			respondMethodNotAllowed(w)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+cfg.MetricsToken)) != 1 {
+			respondError(w, apierror.New(http.StatusUnauthorized, apierror.AuthRequired))
+			return
+		}
+		server.HandleMetrics(w, r)
+	})
 
-	log.Println("HTTP server started on :8080")
-	err := http.ListenAndServe(":8080", nil)
-	if err != nil {
-		log.Fatal("ListenAndServe: ", err)
-	}
+	// Admin endpoints
+	mux.HandleFunc("/api/admin/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := server.requireAdmin(w, r); !ok {
+			return
+		}
+		server.HandleMaintenance(w, r)
+	})
+	mux.HandleFunc("/api/admin/kick", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			respondMethodNotAllowed(w)
+			return
+		}
+		admin, ok := server.requireAdmin(w, r)
+		if !ok {
+			return
+		}
+		server.HandleKick(w, r, admin)
+	})
+	mux.HandleFunc("/api/admin/users/", func(w http.ResponseWriter, r *http.Request) {
+		admin, ok := server.requireAdmin(w, r)
+		if !ok {
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/region") {
+			server.HandleAccountRegion(w, r, admin)
+			return
+		}
+		server.HandleAdminDeleteUser(w, r, admin)
+	})
+	mux.HandleFunc("/api/admin/support", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondMethodNotAllowed(w)
+			return
+		}
+		if _, ok := server.requireAdmin(w, r); !ok {
+			return
+		}
+		server.HandleSupportQueue(w, r)
+	})
+	mux.HandleFunc("/api/admin/support/", func(w http.ResponseWriter, r *http.Request) {
+		admin, ok := server.requireAdmin(w, r)
+		if !ok {
+			return
+		}
+		server.HandleSupportTicket(w, r, admin)
+	})
+	mux.HandleFunc("/api/admin/deadletters", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondMethodNotAllowed(w)
+			return
+		}
+		if _, ok := server.requireAdmin(w, r); !ok {
+			return
+		}
+		server.HandleDeadLetterStats(w, r)
+	})
+	mux.HandleFunc("/api/admin/spam", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondMethodNotAllowed(w)
+			return
+		}
+		if _, ok := server.requireAdmin(w, r); !ok {
+			return
+		}
+		server.HandleSpamReport(w, r)
+	})
+	mux.HandleFunc("/api/admin/spam/flags", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondMethodNotAllowed(w)
+			return
+		}
+		if _, ok := server.requireAdmin(w, r); !ok {
+			return
+		}
+		server.HandleSpamFlags(w, r)
+	})
+	mux.HandleFunc("/api/admin/spam/held", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := server.requireAdmin(w, r); !ok {
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			server.HandleSpamHeld(w, r)
+		case http.MethodPost:
+			server.HandleSpamReview(w, r)
+		default:
+			respondMethodNotAllowed(w)
+		}
+	})
+	mux.HandleFunc("/api/admin/backup", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			respondMethodNotAllowed(w)
+			return
+		}
+		if _, ok := server.requireAdmin(w, r); !ok {
+			return
+		}
+		server.HandleBackup(w, r)
+	})
+	mux.HandleFunc("/api/admin/holds", func(w http.ResponseWriter, r *http.Request) {
+		admin, ok := server.requireAdmin(w, r)
+		if !ok {
+			return
+		}
+		server.HandleHolds(w, r, admin)
+	})
+	mux.HandleFunc("/api/admin/holds/", func(w http.ResponseWriter, r *http.Request) {
+		admin, ok := server.requireAdmin(w, r)
+		if !ok {
+			return
+		}
+		server.HandleHold(w, r, admin)
+	})
+	mux.HandleFunc("/api/admin/retention", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := server.requireAdmin(w, r); !ok {
+			return
+		}
+		server.HandleRetention(w, r)
+	})
+	mux.HandleFunc("/api/admin/emoji", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := server.requireAdmin(w, r); !ok {
+			return
+		}
+		server.HandleEmojiPacks(w, r)
+	})
+	mux.HandleFunc("/api/admin/emoji/", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := server.requireAdmin(w, r); !ok {
+			return
+		}
+		server.HandleEmojiPack(w, r)
+	})
+	mux.HandleFunc("/api/admin/flags", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := server.requireAdmin(w, r); !ok {
+			return
+		}
+		server.HandleAdminFlags(w, r)
+	})
+	mux.HandleFunc("/api/admin/flags/", func(w http.ResponseWriter, r *http.Request) {
+		admin, ok := server.requireAdmin(w, r)
+		if !ok {
+			return
+		}
+		server.HandleAdminFlag(w, r, admin)
+	})
+	mux.HandleFunc("/api/admin/stats", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondMethodNotAllowed(w)
+			return
+		}
+		if _, ok := server.requireAdmin(w, r); !ok {
+			return
+		}
+		server.HandleStats(w, r)
+	})
+	mux.HandleFunc("/api/admin/connections", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondMethodNotAllowed(w)
+			return
+		}
+		if _, ok := server.requireAdmin(w, r); !ok {
+			return
+		}
+		server.HandleAdminConnections(w, r)
+	})
+	mux.HandleFunc("/api/admin/hub", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondMethodNotAllowed(w)
+			return
+		}
+		if _, ok := server.requireAdmin(w, r); !ok {
+			return
+		}
+		server.HandleAdminHub(w, r)
+	})
+	mux.HandleFunc("/api/admin/onboarding", func(w http.ResponseWriter, r *http.Request) {
+		admin, ok := server.requireAdmin(w, r)
+		if !ok {
+			return
+		}
+		server.HandleAdminOnboarding(w, r, admin)
+	})
+	mux.HandleFunc("/api/admin/plan", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondMethodNotAllowed(w)
+			return
+		}
+		if _, ok := server.requireAdmin(w, r); !ok {
+			return
+		}
+		server.HandleAdminPlan(w, r)
+	})
+	mux.HandleFunc("/api/admin/telemetry", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondMethodNotAllowed(w)
+			return
+		}
+		if _, ok := server.requireAdmin(w, r); !ok {
+			return
+		}
+		server.HandleTelemetry(w, r)
+	})
+	mux.HandleFunc("/api/admin/retention/report", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondMethodNotAllowed(w)
+			return
+		}
+		if _, ok := server.requireAdmin(w, r); !ok {
+			return
+		}
+		server.HandleRetentionReport(w, r)
+	})
 }
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+	"github.com/Chase-Garrett/meadowlark/internal/sessions"
+)
+
+const maxSessionHistory = 200
+
+// newDeviceSendTimeout bounds delivery of a new device email
+const newDeviceSendTimeout = 30 * time.Second
+
+// HandleSessionHistory lists the caller's recent connections so they can spot access they don't recognise
+func (s *Server) HandleSessionHistory(w http.ResponseWriter, r *http.Request, username string) {
+	limit := pageLimit(r, 50, maxSessionHistory)
+	before, _ := strconv.ParseInt(r.URL.Query().Get("before"), 10, 64)
+
+	events, err := s.sessions.History(username, before, limit)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+
+	resp := map[string]interface{}{"events": events}
+	if len(events) == limit {
+		resp["nextBefore"] = events[len(events)-1].ID
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// SessionReportRequest defines JSON for POST /api/sessions/report
+type SessionReportRequest struct {
+	ID int64 `json:"id"` // a new_device event
+}
+
+// noticeOrigin tells username when they signed in from an IP address and user agent they
+// haven't used before. Their open connection gets a new_device control message with the event
+// id to report, and a verified email address an email unless that is turned off. via says how
+// they signed in: login, passkey or websocket
+func (s *Server) noticeOrigin(username, ip, userAgent, via string) {
+	// servers built without storage (handler tests) keep no sign-in history
+	if s.sessions == nil {
+		return
+	}
+	event, err := s.sessions.SeenFrom(username, ip, userAgent)
+	if err != nil {
+		log.Printf("Error recording where %s signed in from: %v", username, err)
+		return
+	}
+	if event == nil {
+		return
+	}
+	log.Printf("User %s signed in from a new device at %s", username, ip)
+	s.hub.Forward(protocol.NewControlMessage(username, protocol.EventNewDevice, map[string]interface{}{
+		"id":        event.ID,
+		"ip":        event.IP,
+		"userAgent": event.UserAgent,
+		"via":       via,
+		"createdAt": event.CreatedAt,
+	}))
+	if s.config.NewDeviceEmail {
+		go s.emailNewDevice(event)
+	}
+}
+
+// emailNewDevice emails the account's verified address about a new_device event
+func (s *Server) emailNewDevice(event *sessions.Event) {
+	email, verified, err := s.userStorage.Email(event.Username)
+	if err != nil {
+		log.Printf("Error loading the email address of %s: %v", event.Username, err)
+		return
+	}
+	if email == "" || !verified {
+		return
+	}
+	userAgent := event.UserAgent
+	if userAgent == "" {
+		userAgent = "unknown"
+	}
+	body := fmt.Sprintf("Your Meadowlark account %s was signed in to from a device or network it hasn't been used from before.\n\n"+
+		"IP address: %s\nBrowser or app: %s\nTime: %s\n\n"+
+		"If this was you, there is nothing to do. If it wasn't, open Meadowlark on a device you trust and report the sign-in "+
+		"from your session history: every session is signed out and a new password has to be chosen at the next login.\n",
+		event.Username, event.IP, userAgent, event.CreatedAt.UTC().Format("Jan 2, 15:04 MST"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), newDeviceSendTimeout)
+	defer cancel()
+	if err := s.mail.Send(ctx, email, "New sign-in to your Meadowlark account", body); err != nil {
+		log.Printf("Error sending new device email to %s: %v", event.Username, err)
+	}
+}
+
+// HandleSessionReport is "this wasn't me" for a new_device event: every token of the account
+// stops working, its connection is closed and the next password login must choose a new password
+func (s *Server) HandleSessionReport(w http.ResponseWriter, r *http.Request, username string) {
+	var req SessionReportRequest
+	if err := s.readJSON(w, r, &req); err != nil {
+		respondError(w, err)
+		return
+	}
+	event, err := s.sessions.Get(username, req.ID)
+	if err == sessions.ErrNotFound || (err == nil && event.Kind != sessions.EventNewDevice) {
+		respondError(w, apierror.New(http.StatusNotFound, apierror.SessionEventNotFound))
+		return
+	}
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+
+	if err := s.userStorage.RequirePasswordReset(username); err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	// signing in from there again is news again
+	if err := s.sessions.ForgetOrigin(username, event.IP, event.UserAgent); err != nil {
+		log.Printf("Error forgetting where %s signed in from: %v", username, err)
+	}
+	s.sessions.Record(sessions.Event{
+		Username:  username,
+		Kind:      sessions.EventReported,
+		IP:        s.clientIP(r),
+		UserAgent: r.UserAgent(),
+	})
+	log.Printf("User %s reported the sign-in from %s as not theirs, password reset required", username, event.IP)
+	s.hub.Disconnect(username, protocol.CloseAuthExpired, protocol.CloseReason{Code: apierror.PasswordResetRequired})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// KickRequest defines JSON for POST /api/admin/kick
+type KickRequest struct {
+	Username string `json:"username"`
+}
+
+// HandleKick closes a user's websocket connection, the client is told not to reconnect on its own
+func (s *Server) HandleKick(w http.ResponseWriter, r *http.Request, admin string) {
+	var req KickRequest
+	if err := s.readJSON(w, r, &req); err != nil {
+		respondError(w, err)
+		return
+	}
+	exists, err := s.userStorage.UserExists(req.Username)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	if !exists {
+		respondError(w, apierror.New(http.StatusNotFound, apierror.UserNotFound))
+		return
+	}
+
+	s.hub.Disconnect(req.Username, protocol.CloseKicked, protocol.CloseReason{Code: apierror.Kicked})
+	log.Printf("Admin %s disconnected %s", admin, req.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+	"github.com/Chase-Garrett/meadowlark/internal/textpolicy"
+)
+
+// response headers carrying the server identity signature
+const (
+	signatureHeader = "Meadowlark-Signature" // "t=<unix seconds>, sig=<base64 Ed25519 signature>"
+	identityHeader  = "Meadowlark-Identity"  // fingerprint of the signing key
+)
+
+// bufferedResponse holds a handler's status and body so they can be signed before sending
+type bufferedResponse struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	b.status = status
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
+
+// signed signs the body of every response from h with the server identity,
+// including error responses, so clients can tell a proxy didn't substitute them
+func (s *Server) signed(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		buf := &bufferedResponse{ResponseWriter: w, status: http.StatusOK}
+		h(buf, r)
+
+		now := time.Now()
+		signature := s.identity.SignResponse(buf.body.Bytes(), now)
+		w.Header().Set(signatureHeader, fmt.Sprintf("t=%d, sig=%s", now.Unix(), base64.StdEncoding.EncodeToString(signature)))
+		w.Header().Set(identityHeader, s.identity.Fingerprint())
+		w.WriteHeader(buf.status)
+		w.Write(buf.body.Bytes())
+	}
+}
+
+// ServerIdentity is the public half of the server's signing key
+type ServerIdentity struct {
+	Algorithm   string    `json:"algorithm"`
+	PublicKey   []byte    `json:"publicKey"`
+	Fingerprint string    `json:"fingerprint"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+func (s *Server) serverIdentity() ServerIdentity {
+	return ServerIdentity{
+		Algorithm:   "ed25519",
+		PublicKey:   s.identity.PublicKey(),
+		Fingerprint: s.identity.Fingerprint(),
+		CreatedAt:   s.identity.CreatedAt(),
+	}
+}
+
+// HandleIdentity serves the server's public identity key for clients to pin on first contact
+func (s *Server) HandleIdentity(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.serverIdentity())
+}
+
+// Capabilities describes what this server supports, so clients can adapt without probing
+type Capabilities struct {
+	Server   string                 `json:"server"`
+	Identity ServerIdentity         `json:"identity"`
+	Features map[string]bool        `json:"features"`
+	Limits   map[string]interface{} `json:"limits"`
+}
+
+// features reports which optional features are enabled, for capabilities and telemetry
+func (s *Server) features() map[string]bool {
+	return map[string]bool{
+		"attachments":      true,
+		"emailDigests":     s.config.DigestInterval > 0,
+		"forwarding":       true,
+		"keyTransparency":  true,
+		"legalHold":        s.config.LegalHold,
+		"linkPreviews":     s.config.PreviewEnabled,
+		"publicRooms":      s.config.PublicRooms,
+		"resumableUploads": true,
+		"roomArchives":     s.config.RoomArchives,
+		"roomAttachments":  true,
+		"roomExports":      s.config.RoomExports,
+		"rooms":            true,
+		"sync":             true,
+		"wsCompression":    s.config.WSCompression,
+	}
+}
+
+// HandleCapabilities lists the features enabled on this server and their limits
+func (s *Server) HandleCapabilities(w http.ResponseWriter, r *http.Request) {
+	caps := Capabilities{
+		Server:   "meadowlark",
+		Identity: s.serverIdentity(),
+		Features: s.features(),
+		Limits: map[string]interface{}{
+			"attachmentMaxSize":          s.config.AttachmentMaxSize,
+			"attachmentThumbnailMaxSize": s.config.AttachmentThumbnailMaxSize,
+			"audioMaxDurationMs":         s.config.AudioMaxDuration.Milliseconds(),
+			"audioWaveformMaxSamples":    maxWaveformSamples,
+			"discoveryMaxHashes":         s.config.DiscoveryMaxHashes,
+			"emojiMaxSize":               s.config.EmojiMaxSize,
+			"frameMaxSize":               protocol.MaxFrameSize,
+			"provenanceMaxSize":          protocol.MaxProvenanceSize,
+			"roomAvatarMaxSize":          s.config.RoomAvatarMaxSize,
+			"stickerMaxSize":             s.config.StickerMaxSize,
+			"syncPageSize":               s.config.SyncPageSize,
+			"usernameMaxLength":          s.text.MaxLength(textpolicy.Username),
+			"roomNameMaxLength":          s.text.MaxLength(textpolicy.RoomName),
+			"roomTopicMaxLength":         s.text.MaxLength(textpolicy.RoomTopic),
+			"roomDescriptionMaxLength":   s.text.MaxLength(textpolicy.RoomDescription),
+		},
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(caps)
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/rooms"
+)
+
+// roomCooldowns remembers when members last posted to rooms in slow mode. It is locked
+// rather than owned by the hub goroutine since clients claim a post before storing it
+type roomCooldowns struct {
+	mu        sync.Mutex
+	last      map[string]time.Time // room and username -> last accepted post
+	lastSweep time.Time
+}
+
+func newRoomCooldowns() *roomCooldowns {
+	return &roomCooldowns{last: make(map[string]time.Time)}
+}
+
+// claim records a post by username at now unless they posted less than interval ago,
+// in which case it returns how much longer they have to wait
+func (c *roomCooldowns) claim(roomID, username string, interval time.Duration, now time.Time) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// nothing older than the longest interval can hold anyone back
+	if now.Sub(c.lastSweep) > rooms.MaxSlowMode*time.Second {
+		for key, at := range c.last {
+			if now.Sub(at) > rooms.MaxSlowMode*time.Second {
+				delete(c.last, key)
+			}
+		}
+		c.lastSweep = now
+	}
+
+	key := roomID + "\x00" + username
+	if wait := c.last[key].Add(interval).Sub(now); wait > 0 {
+		return wait
+	}
+	c.last[key] = now
+	return 0
+}
+
+// ClaimRoomPost enforces a room's slow mode: it records a post by username and returns 0,
+// or returns how long they must wait when they posted too recently. Moderators are exempt
+func (h *Hub) ClaimRoomPost(snap *rooms.Snapshot, username string) time.Duration {
+	interval := snap.SlowMode(username)
+	if interval <= 0 {
+		return 0
+	}
+	return h.cooldowns.claim(snap.Room.ID, username, interval, time.Now())
+}
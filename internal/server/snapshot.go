@@ -0,0 +1,142 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+)
+
+// hubSnapshotVersion is bumped when the snapshot layout changes, other versions are ignored
+const hubSnapshotVersion = 1
+
+// HubSnapshot is the in-memory hub state carried across a restart
+type HubSnapshot struct {
+	Version  int                            `json:"version"`
+	TakenAt  time.Time                      `json:"takenAt"`
+	Pending  map[string][]*protocol.Message `json:"pending,omitempty"` // queued for a recipient but not yet written
+	LastSeen map[string]time.Time           `json:"lastSeen,omitempty"`
+}
+
+// connectionEvents only make sense on the connection they were queued for and aren't carried over
+var connectionEvents = map[string]bool{
+	protocol.EventShutdownWarning:   true,
+	protocol.EventRateLimited:       true,
+	protocol.EventSignedInElsewhere: true,
+	protocol.EventReauthenticate:    true,
+	protocol.EventReauthenticated:   true,
+}
+
+// takeSnapshot stops the hub accepting clients, releases held messages, takes every message
+// still waiting in a client's queues and closes the connections. Called from the hub goroutine
+func (h *Hub) takeSnapshot() *HubSnapshot {
+	now := time.Now()
+	h.draining = true
+	for _, message := range h.ordering.flushAll() {
+		h.route(message)
+	}
+
+	snap := &HubSnapshot{
+		Version:  hubSnapshotVersion,
+		TakenAt:  now,
+		Pending:  make(map[string][]*protocol.Message),
+		LastSeen: h.lastSeen,
+	}
+	for username, messages := range h.held {
+		snap.Pending[username] = messages
+	}
+	for username, client := range h.clients {
+		// writePump may take a message at the same time, each one ends up either written or here
+		for _, message := range client.send.takeAll() {
+			if message.Control != nil && connectionEvents[message.Control.Event] {
+				continue
+			}
+			snap.Pending[username] = append(snap.Pending[username], message)
+		}
+		client.send.closeWith(protocol.CloseServerShutdown, protocol.CloseReason{Code: apierror.Maintenance, Retry: true})
+		h.lastSeen[username] = now
+		delete(h.clients, username)
+	}
+	return snap
+}
+
+// restore loads a snapshot before the hub runs. Messages older than maxAge are dropped,
+// clients fetch anything they missed from history on reconnect
+func (h *Hub) restore(snap *HubSnapshot, maxAge time.Duration) {
+	for username, seen := range snap.LastSeen {
+		h.lastSeen[username] = seen
+	}
+	if maxAge > 0 && time.Since(snap.TakenAt) > maxAge {
+		return
+	}
+	for username, messages := range snap.Pending {
+		h.held[username] = messages
+	}
+}
+
+// saveHubSnapshot asks the hub for its state and writes it to the snapshot file
+func (s *Server) saveHubSnapshot() {
+	if s.config.HubSnapshotFile == "" {
+		return
+	}
+	snap := s.hub.Snapshot()
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		log.Printf("Error encoding hub snapshot: %v", err)
+		return
+	}
+	// written next to the target and renamed so a crash mid-write leaves no partial snapshot
+	tmp := s.config.HubSnapshotFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		log.Printf("Error writing hub snapshot: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, s.config.HubSnapshotFile); err != nil {
+		log.Printf("Error writing hub snapshot: %v", err)
+		return
+	}
+	queued := 0
+	for _, messages := range snap.Pending {
+		queued += len(messages)
+	}
+	log.Printf("Saved hub snapshot with %d queued messages and %d last seen times to %s", queued, len(snap.LastSeen), filepath.Base(s.config.HubSnapshotFile))
+}
+
+// loadHubSnapshot reads the snapshot left by the last shutdown and removes it,
+// so a later crash doesn't replay the same messages
+func loadHubSnapshot(path string) *HubSnapshot {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		log.Printf("Error reading hub snapshot: %v", err)
+		return nil
+	}
+	if err := os.Remove(path); err != nil {
+		log.Printf("Error removing hub snapshot: %v", err)
+	}
+
+	var snap HubSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		log.Printf("Ignoring unreadable hub snapshot: %v", err)
+		return nil
+	}
+	if snap.Version != hubSnapshotVersion {
+		log.Printf("Ignoring hub snapshot with version %d", snap.Version)
+		return nil
+	}
+	if snap.LastSeen == nil {
+		snap.LastSeen = make(map[string]time.Time)
+	}
+	return &snap
+}
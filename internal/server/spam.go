@@ -0,0 +1,128 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+	"github.com/Chase-Garrett/meadowlark/internal/spam"
+)
+
+const maxSpamPage = 500
+
+// SpamReviewRequest defines JSON for POST /api/admin/spam/held
+type SpamReviewRequest struct {
+	ID     int64  `json:"id"`
+	Action string `json:"action"` // "release" or "discard"
+}
+
+// HandleSpamReport lists flagged senders and held messages (admin only)
+func (s *Server) HandleSpamReport(w http.ResponseWriter, r *http.Request) {
+	flags, err := s.spam.Store().ListFlags(0, 100)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	held, err := s.spam.Store().ListHeld(0, false, 100)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"flags": flags,
+		"held":  held,
+	})
+}
+
+// HandleSpamFlags pages through flagged senders, newest first (admin only)
+func (s *Server) HandleSpamFlags(w http.ResponseWriter, r *http.Request) {
+	p, apiErr := readPage(r, maxSpamPage, false)
+	if apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+	var before int64
+	if _, apiErr := p.after(&before); apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+
+	flags, err := s.spam.Store().ListFlags(before, p.Limit)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	p.respond(w, r, map[string]interface{}{"flags": flags}, len(flags), func() interface{} {
+		return flags[len(flags)-1].ID
+	})
+}
+
+// HandleSpamHeld pages through messages held for review, oldest first (admin only)
+func (s *Server) HandleSpamHeld(w http.ResponseWriter, r *http.Request) {
+	p, apiErr := readPage(r, maxSpamPage, true)
+	if apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+	var after int64
+	if _, apiErr := p.after(&after); apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+
+	held, err := s.spam.Store().ListHeld(after, p.Desc, p.Limit)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	p.respond(w, r, map[string]interface{}{"held": held}, len(held), func() interface{} {
+		return held[len(held)-1].ID
+	})
+}
+
+// HandleSpamReview releases or discards a held message (admin only)
+func (s *Server) HandleSpamReview(w http.ResponseWriter, r *http.Request) {
+	var req SpamReviewRequest
+	if err := s.readJSON(w, r, &req); err != nil {
+		respondError(w, err)
+		return
+	}
+	if req.Action != "release" && req.Action != "discard" {
+		respondError(w, apierror.New(http.StatusBadRequest, apierror.InvalidSpamAction))
+		return
+	}
+
+	held, err := s.spam.Store().TakeHeld(req.ID)
+	if err == spam.ErrNotFound {
+		respondError(w, apierror.New(http.StatusNotFound, apierror.HeldMessageNotFound))
+		return
+	}
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+
+	if req.Action == "release" {
+		msg := &protocol.Message{
+			Type:      protocol.TypeChat,
+			Recipient: held.Recipient,
+			Sender:    held.Sender,
+			Content:   held.Content,
+		}
+		if err := s.messages.Save(msg); err != nil {
+			respondInternalError(w, err)
+			return
+		}
+		s.hub.Forward(msg)
+	}
+
+	log.Printf("Held message %d from %s: %s", held.ID, held.Sender, req.Action)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Held message " + req.Action + "d",
+	})
+}
@@ -0,0 +1,301 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/cmd/static"
+)
+
+// files smaller than this are sent as is, the gzip framing would eat most of the gain
+const gzipMinSize = 1024
+
+// extensions worth compressing, images and fonts are already compressed
+var compressibleExts = map[string]bool{
+	".html": true,
+	".js":   true,
+	".css":  true,
+	".json": true,
+	".map":  true,
+	".svg":  true,
+	".txt":  true,
+}
+
+// pre-compressed siblings looked for next to a file, in order of preference
+var precompressed = []struct{ encoding, suffix string }{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// staticAsset is what is remembered about a file between requests
+type staticAsset struct {
+	modTime time.Time
+	size    int64
+	etag    string
+	gzipped []byte // nil when the file isn't worth compressing
+}
+
+// staticFiles serves the web client with validators, per type cache policies and compression
+type staticFiles struct {
+	fsys         fs.FS             // the cmd/static directory on disk, or the copy embedded in the binary
+	cacheControl map[string]string // extension -> Cache-Control value, "*" for everything else
+	gzip         bool
+
+	mu     sync.Mutex
+	assets map[string]*staticAsset // by name within fsys
+}
+
+func newStaticFiles(fsys fs.FS, cacheControl string, gzip bool) (*staticFiles, error) {
+	policies, err := parseCacheControl(cacheControl)
+	if err != nil {
+		return nil, err
+	}
+	return &staticFiles{fsys: fsys, cacheControl: policies, gzip: gzip, assets: make(map[string]*staticAsset)}, nil
+}
+
+// parseCacheControl reads ".html=no-cache;.js=public, max-age=3600;*=public, max-age=86400"
+func parseCacheControl(spec string) (map[string]string, error) {
+	policies := make(map[string]string)
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		ext, policy, ok := strings.Cut(entry, "=")
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if !ok || (ext != "*" && !strings.HasPrefix(ext, ".")) {
+			return nil, fmt.Errorf("invalid cache policy %q, expected .ext=value or *=value", entry)
+		}
+		policies[ext] = strings.TrimSpace(policy)
+	}
+	return policies, nil
+}
+
+// cachePolicy returns the Cache-Control value for a file extension
+func (sf *staticFiles) cachePolicy(ext string) string {
+	if policy, ok := sf.cacheControl[strings.ToLower(ext)]; ok {
+		return policy
+	}
+	return sf.cacheControl["*"]
+}
+
+// asset returns the validators and gzipped copy of a file, recomputing them when it changed on disk
+func (sf *staticFiles) asset(name string, info fs.FileInfo) (*staticAsset, error) {
+	sf.mu.Lock()
+	cached, ok := sf.assets[name]
+	sf.mu.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached, nil
+	}
+
+	data, err := fs.ReadFile(sf.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	asset := &staticAsset{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		etag:    `"` + hex.EncodeToString(sum[:16]) + `"`,
+	}
+	if sf.gzip && compressibleExts[strings.ToLower(path.Ext(name))] && len(data) >= gzipMinSize {
+		var buf bytes.Buffer
+		zw, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+		zw.Write(data)
+		zw.Close()
+		if buf.Len() < len(data) {
+			asset.gzipped = buf.Bytes()
+		}
+	}
+
+	sf.mu.Lock()
+	sf.assets[name] = asset
+	sf.mu.Unlock()
+	return asset, nil
+}
+
+// serve writes a file, answering conditional and range requests and picking the best encoding
+// the client accepts: a pre-compressed .br or .gz file, the cached gzip copy or the file itself
+func (sf *staticFiles) serve(w http.ResponseWriter, r *http.Request, name string, info fs.FileInfo) {
+	asset, err := sf.asset(name, info)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ext := strings.ToLower(path.Ext(name))
+	if policy := sf.cachePolicy(ext); policy != "" {
+		w.Header().Set("Cache-Control", policy)
+	}
+	if compressibleExts[ext] {
+		w.Header().Set("Vary", "Accept-Encoding")
+	}
+
+	accept := r.Header.Get("Accept-Encoding")
+	for _, pre := range precompressed {
+		if !acceptsEncoding(accept, pre.encoding) {
+			continue
+		}
+		// a stale pre-compressed file left behind by an old build must not shadow the new one
+		preInfo, err := fs.Stat(sf.fsys, name+pre.suffix)
+		if err != nil || preInfo.IsDir() || preInfo.ModTime().Before(info.ModTime()) {
+			continue
+		}
+		content, closer, err := sf.open(name + pre.suffix)
+		if err != nil {
+			continue
+		}
+		defer closer.Close()
+		w.Header().Set("Content-Encoding", pre.encoding)
+		w.Header().Set("ETag", encodedETag(asset.etag, pre.encoding))
+		http.ServeContent(w, r, "", info.ModTime(), content)
+		return
+	}
+
+	if asset.gzipped != nil && acceptsEncoding(accept, "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("ETag", encodedETag(asset.etag, "gzip"))
+		http.ServeContent(w, r, "", info.ModTime(), bytes.NewReader(asset.gzipped))
+		return
+	}
+
+	content, closer, err := sf.open(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer closer.Close()
+	w.Header().Set("ETag", asset.etag)
+	http.ServeContent(w, r, "", info.ModTime(), content)
+}
+
+// open returns a file's content for http.ServeContent, which needs to seek
+func (sf *staticFiles) open(name string) (io.ReadSeeker, io.Closer, error) {
+	f, err := sf.fsys.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	// both os and embed files can seek, anything else is read into memory
+	if seeker, ok := f.(io.ReadSeeker); ok {
+		return seeker, f, nil
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return bytes.NewReader(data), f, nil
+}
+
+// staticFS picks the web interface to serve: cmd/static on disk when running from a checkout,
+// so edits show up without a rebuild, otherwise the copy embedded in the binary
+func staticFS(embeddedOnly bool) fs.FS {
+	dir := filepath.Join("cmd", "static")
+	if info, err := os.Stat(dir); err == nil && info.IsDir() && !embeddedOnly {
+		return os.DirFS(dir)
+	}
+	return static.Files
+}
+
+// encodedETag gives each encoding of a file its own validator, as the bytes differ
+func encodedETag(etag, encoding string) string {
+	return strings.TrimSuffix(etag, `"`) + "-" + encoding + `"`
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header allows encoding
+func acceptsEncoding(header, encoding string) bool {
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != encoding && name != "*" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// staticContentType is the Content-Type for a static file extension
+func staticContentType(ext string) string {
+	switch ext {
+	case ".html":
+		return "text/html; charset=utf-8"
+	case ".js":
+		return "application/javascript; charset=utf-8"
+	case ".css":
+		return "text/css; charset=utf-8"
+	}
+	if contentType := mime.TypeByExtension(ext); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// ServeStaticFiles serves static files from the static directory
+func (s *Server) ServeStaticFiles(w http.ResponseWriter, r *http.Request) {
+	// Skip API routes
+	if strings.HasPrefix(r.URL.Path, "/api") ||
+		strings.HasPrefix(r.URL.Path, "/ws") ||
+		strings.HasPrefix(r.URL.Path, "/keys") ||
+		strings.HasPrefix(r.URL.Path, "/register") {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Get the requested path
+	urlPath := r.URL.Path
+	if urlPath == "/" || urlPath == "" {
+		urlPath = "/index.html"
+	}
+
+	// Clean the path and make it relative to the static files
+	name := strings.TrimPrefix(path.Clean(urlPath), "/")
+
+	// Check if file exists
+	info, err := fs.Stat(s.static.fsys, name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			// If file doesn't exist and it's not a root request, try index.html (for SPA routing)
+			if urlPath != "/index.html" {
+				name = "index.html"
+				info, err = fs.Stat(s.static.fsys, name)
+			}
+			if err != nil {
+				http.NotFound(w, r)
+				return
+			}
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Prevent directory listing
+	if info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", staticContentType(strings.ToLower(path.Ext(name))))
+	s.static.serve(w, r, name, info)
+}
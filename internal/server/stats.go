@@ -0,0 +1,59 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+const maxStatsDays = 366
+
+// HandleStats returns aggregated usage statistics and live connection counts (admin only)
+func (s *Server) HandleStats(w http.ResponseWriter, r *http.Request) {
+	days := 30
+	if v, err := strconv.Atoi(r.URL.Query().Get("days")); err == nil && v > 0 {
+		days = v
+	}
+	if days > maxStatsDays {
+		days = maxStatsDays
+	}
+
+	summary, err := s.stats.Summary(days)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	usage, err := s.attachments.Usage()
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	connections, accounts, addresses := s.connLimits.counts()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"users":              summary.Users,
+		"dailyActiveUsers":   summary.DailyActiveUsers,
+		"monthlyActiveUsers": summary.MonthlyActiveUsers,
+		"storage": map[string]int64{
+			"databaseBytes":   summary.DatabaseBytes,
+			"attachmentBytes": summary.AttachmentBytes,
+			// bytes actually held by the blob backends, less than the above once
+			// attachments share blobs or some were deleted
+			"attachmentStoredBytes": usage.StoredBytes,
+		},
+		"deduplication": map[string]int64{
+			"uploads":     summary.DeduplicatedUploads, // attachments that reused a stored blob
+			"blobs":       usage.Blobs,
+			"sharedBlobs": usage.SharedBlobs,
+			"savedBytes":  usage.SavedBytes, // of the attachments stored now
+		},
+		"connections": map[string]int64{
+			"open":            int64(connections),
+			"accounts":        int64(accounts),
+			"addresses":       int64(addresses),
+			"rejectedOrigins": s.origins.rejected.Load(), // since startup
+		},
+		"days": summary.Days,
+	})
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+)
+
+// streamWindow is how many messages a stream may write before the client grants more
+// with a window frame, so one long transfer can't hold up the others
+const streamWindow = 64
+
+// maxStreamCredit caps the credit a client can hold on one stream
+const maxStreamCredit = 1 << 16
+
+// sendStream is one transfer multiplexed over a connection, such as the replay of one
+// conversation. Control messages in a stream, its start and end, don't use credit
+type sendStream struct {
+	id      int
+	pending []*protocol.Message
+	credit  int
+	ended   bool // nothing more will be queued, forgotten once drained
+}
+
+// sendable reports whether the stream's next message may be written now
+func (s *sendStream) sendable() bool {
+	return len(s.pending) > 0 && (s.credit > 0 || s.pending[0].Type == protocol.TypeControl)
+}
+
+// streamSet holds a connection's open streams. Producers and readPump, which grants credit,
+// run beside writePump, so the set is locked
+type streamSet struct {
+	mu      sync.Mutex
+	lastID  int
+	streams []*sendStream // round robin order, the next to be served first
+	ready   chan struct{} // wakes writePump when a stream has something to write
+}
+
+// openStream starts a stream and returns its id, ids are never reused on a connection
+func (q *sendQueues) openStream() int {
+	q.streams.mu.Lock()
+	defer q.streams.mu.Unlock()
+	q.streams.lastID++
+	q.streams.streams = append(q.streams.streams, &sendStream{id: q.streams.lastID, credit: streamWindow})
+	return q.streams.lastID
+}
+
+// find returns the open stream with id, must be called with mu held
+func (set *streamSet) find(id int) *sendStream {
+	for _, s := range set.streams {
+		if s.id == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// wake tells writePump there may be something to write
+func (set *streamSet) wake() {
+	select {
+	case set.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pushStream queues message on stream id, returns false if the stream isn't open
+func (q *sendQueues) pushStream(id int, message *protocol.Message) bool {
+	q.streams.mu.Lock()
+	defer q.streams.mu.Unlock()
+	s := q.streams.find(id)
+	if s == nil || s.ended {
+		return false
+	}
+	message.Stream = id
+	s.pending = append(s.pending, message)
+	if s.sendable() {
+		q.streams.wake()
+	}
+	return true
+}
+
+// endStream queues message as the last of stream id
+func (q *sendQueues) endStream(id int, message *protocol.Message) bool {
+	if !q.pushStream(id, message) {
+		return false
+	}
+	q.streams.mu.Lock()
+	defer q.streams.mu.Unlock()
+	if s := q.streams.find(id); s != nil {
+		s.ended = true
+	}
+	return true
+}
+
+// grant lets stream id write credit more messages, returns false for streams that are
+// unknown or already finished
+func (q *sendQueues) grant(id, credit int) bool {
+	q.streams.mu.Lock()
+	defer q.streams.mu.Unlock()
+	s := q.streams.find(id)
+	if s == nil {
+		return false
+	}
+	s.credit = min(s.credit+credit, maxStreamCredit)
+	if s.sendable() {
+		q.streams.wake()
+	}
+	return true
+}
+
+// takeStream removes the next message of the first stream that may write, which then goes
+// to the back of the line. Streams without credit are passed over
+func (q *sendQueues) takeStream() (*protocol.Message, bool) {
+	q.streams.mu.Lock()
+	defer q.streams.mu.Unlock()
+	set := &q.streams
+	for i, s := range set.streams {
+		if !s.sendable() {
+			continue
+		}
+		message := s.pending[0]
+		s.pending[0] = nil
+		s.pending = s.pending[1:]
+		if message.Type != protocol.TypeControl {
+			s.credit--
+		}
+		set.streams = append(set.streams[:i], set.streams[i+1:]...)
+		if !s.ended || len(s.pending) > 0 {
+			set.streams = append(set.streams, s)
+		}
+		return message, true
+	}
+	return nil, false
+}
+
+// streamsPending reports whether any stream has a message it may write
+func (q *sendQueues) streamsPending() bool {
+	q.streams.mu.Lock()
+	defer q.streams.mu.Unlock()
+	for _, s := range q.streams.streams {
+		if s.sendable() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/protocol"
+	"github.com/Chase-Garrett/meadowlark/internal/support"
+)
+
+// supportAuthor is who staff replies appear to come from for the user
+const supportAuthor = "support"
+
+const maxSupportPage = 200
+
+// SupportMessageRequest defines JSON for POST /api/support and POST /api/admin/support/{id}
+type SupportMessageRequest struct {
+	Body string `json:"body"`
+}
+
+// HandleSupport lists the caller's support tickets or sends a message to support,
+// opening a ticket when none is open. Support messages are readable by the server's
+// admins, they are not end-to-end encrypted
+func (s *Server) HandleSupport(w http.ResponseWriter, r *http.Request, username string) {
+	switch r.Method {
+	case http.MethodGet:
+		tickets, err := s.support.Tickets(username, 20)
+		if err != nil {
+			respondInternalError(w, err)
+			return
+		}
+		for i := range tickets {
+			for j := range tickets[i].Messages {
+				maskStaff(&tickets[i].Messages[j])
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"tickets": tickets})
+	case http.MethodPost:
+		var req SupportMessageRequest
+		if err := s.readJSON(w, r, &req); err != nil {
+			respondError(w, err)
+			return
+		}
+		ticketID, msg, err := s.support.Ask(username, req.Body)
+		if err != nil {
+			respondSupportError(w, err)
+			return
+		}
+
+		// let admins who are online know, the queue is the source of truth for the rest
+		for _, admin := range s.config.Admins {
+			s.hub.Forward(protocol.NewControlMessage(admin, protocol.EventSupportMessage, map[string]interface{}{
+				"ticketId": ticketID,
+				"username": username,
+				"message":  msg,
+			}))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"ticketId": ticketID, "message": msg})
+	default:
+		respondMethodNotAllowed(w)
+	}
+}
+
+// HandleSupportQueue lists support tickets for operators, those waiting longest for a reply first (admin only)
+func (s *Server) HandleSupportQueue(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = support.StatusOpen
+	}
+	if status != support.StatusOpen && status != support.StatusClosed {
+		respondError(w, apierror.New(http.StatusBadRequest, apierror.InvalidRequest).With("detail", "status must be open or closed"))
+		return
+	}
+	p, apiErr := readPage(r, maxSupportPage, false)
+	if apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+	var after *support.QueueCursor
+	var pos support.QueueCursor
+	ok, apiErr := p.after(&pos)
+	if apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+	if ok {
+		after = &pos
+	}
+
+	tickets, err := s.support.Queue(status, after, p.Limit)
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	p.respond(w, r, map[string]interface{}{"tickets": tickets}, len(tickets), func() interface{} {
+		last := tickets[len(tickets)-1]
+		return support.QueueCursor{Waiting: last.Waiting, UpdatedAt: last.UpdatedAt.UnixMilli(), ID: last.ID}
+	})
+}
+
+// HandleSupportTicket serves /api/admin/support/{id}: GET reads a ticket, POST replies to it
+// and POST /api/admin/support/{id}/close resolves it (admin only)
+func (s *Server) HandleSupportTicket(w http.ResponseWriter, r *http.Request, admin string) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/admin/support/")
+	idPart, action, _ := strings.Cut(rest, "/")
+	ticketID, err := strconv.ParseInt(idPart, 10, 64)
+	if err != nil || (action != "" && action != "close") {
+		respondError(w, apierror.New(http.StatusNotFound, apierror.TicketNotFound))
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		ticket, err := s.support.Ticket(ticketID)
+		if err != nil {
+			respondSupportError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ticket)
+	case action == "" && r.Method == http.MethodPost:
+		var req SupportMessageRequest
+		if err := s.readJSON(w, r, &req); err != nil {
+			respondError(w, err)
+			return
+		}
+		username, msg, err := s.support.Reply(ticketID, admin, req.Body)
+		if err != nil {
+			respondSupportError(w, err)
+			return
+		}
+		log.Printf("Admin %s replied to support ticket %d of %s", admin, ticketID, username)
+
+		shown := msg
+		maskStaff(&shown)
+		s.hub.Forward(protocol.NewControlMessage(username, protocol.EventSupportMessage, map[string]interface{}{
+			"ticketId": ticketID,
+			"message":  shown,
+		}))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(msg)
+	case action == "close" && r.Method == http.MethodPost:
+		username, err := s.support.Close(ticketID)
+		if err != nil {
+			respondSupportError(w, err)
+			return
+		}
+		log.Printf("Admin %s closed support ticket %d of %s", admin, ticketID, username)
+		s.hub.Forward(protocol.NewControlMessage(username, protocol.EventSupportClosed, map[string]interface{}{
+			"ticketId": ticketID,
+		}))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		respondMethodNotAllowed(w)
+	}
+}
+
+// maskStaff hides which operator wrote a reply
+func maskStaff(msg *support.Message) {
+	if msg.Staff {
+		msg.Author = supportAuthor
+	}
+}
+
+// respondSupportError maps support storage errors to API errors
+func respondSupportError(w http.ResponseWriter, err error) {
+	switch err {
+	case support.ErrNotFound:
+		respondError(w, apierror.New(http.StatusNotFound, apierror.TicketNotFound))
+	case support.ErrTicketClosed:
+		respondError(w, apierror.New(http.StatusConflict, apierror.TicketClosed))
+	case support.ErrInvalidMessage:
+		respondError(w, apierror.Invalid(err))
+	default:
+		respondInternalError(w, err)
+	}
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+)
+
+// sync sections, streamed in this order
+const (
+	syncContacts = iota
+	syncKeys
+	syncMessages
+	syncDone
+)
+
+const maxSyncLimit = 500
+
+// SyncRequest defines JSON for POST /api/sync
+type SyncRequest struct {
+	Cursor string     `json:"cursor"` // opaque, empty for the first page
+	Limit  int        `json:"limit"`  // items per page, optional
+	Since  *time.Time `json:"since"`  // optional start of the message window
+}
+
+// SyncItem is one entry of the sync stream
+type SyncItem struct {
+	Kind string      `json:"kind"` // "contact", "key" or "message"
+	Data interface{} `json:"data"`
+}
+
+// SyncResponse defines the JSON response for POST /api/sync
+type SyncResponse struct {
+	Items      []SyncItem `json:"items"`
+	NextCursor string     `json:"nextCursor,omitempty"`
+	Done       bool       `json:"done"`
+}
+
+// syncCursor records where the previous page stopped
+type syncCursor struct {
+	Section int    `json:"s"`
+	After   string `json:"a,omitempty"` // last username for contacts and keys
+	AfterID int64  `json:"i,omitempty"` // last message id
+	Since   int64  `json:"t"`           // message window start, unix millis
+}
+
+func encodeSyncCursor(c syncCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeSyncCursor(s string) (syncCursor, error) {
+	var c syncCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, errors.New("invalid cursor")
+	}
+	if err := json.Unmarshal(data, &c); err != nil || c.Section < syncContacts || c.Section > syncDone {
+		return c, errors.New("invalid cursor")
+	}
+	return c, nil
+}
+
+// HandleSync streams everything a new device needs to bootstrap in pages
+func (s *Server) HandleSync(w http.ResponseWriter, r *http.Request, username string) {
+	var req SyncRequest
+	if err := s.readJSON(w, r, &req); err != nil {
+		respondError(w, err)
+		return
+	}
+
+	limit := req.Limit
+	if limit <= 0 {
+		limit = s.config.SyncPageSize
+	}
+	if limit > maxSyncLimit {
+		limit = maxSyncLimit
+	}
+
+	var cursor syncCursor
+	if req.Cursor != "" {
+		var err error
+		if cursor, err = decodeSyncCursor(req.Cursor); err != nil {
+			respondError(w, apierror.New(http.StatusBadRequest, apierror.InvalidCursor))
+			return
+		}
+	} else {
+		since := time.Now().Add(-s.config.SyncMessageWindow)
+		if req.Since != nil {
+			since = *req.Since
+		}
+		cursor.Since = since.UnixMilli()
+	}
+
+	resp := SyncResponse{Items: []SyncItem{}}
+	for cursor.Section < syncDone && len(resp.Items) < limit {
+		remaining := limit - len(resp.Items)
+		fetched, err := s.syncSection(&cursor, username, remaining, &resp)
+		if err != nil {
+			respondInternalError(w, err)
+			return
+		}
+		if fetched < remaining {
+			// section exhausted, move on to the next one
+			cursor = syncCursor{Section: cursor.Section + 1, Since: cursor.Since}
+		}
+	}
+
+	resp.Done = cursor.Section == syncDone
+	if !resp.Done {
+		resp.NextCursor = encodeSyncCursor(cursor)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// syncSection appends up to limit items of the cursor's section and advances the cursor
+func (s *Server) syncSection(cursor *syncCursor, username string, limit int, resp *SyncResponse) (int, error) {
+	switch cursor.Section {
+	case syncContacts:
+		users, err := s.userStorage.ListUsersAfter(cursor.After, limit)
+		if err != nil {
+			return 0, err
+		}
+		for _, user := range users {
+			resp.Items = append(resp.Items, SyncItem{Kind: "contact", Data: map[string]string{"username": user}})
+			cursor.After = user
+		}
+		return len(users), nil
+	case syncKeys:
+		keys, err := s.userStorage.ListPublicKeysAfter(cursor.After, limit)
+		if err != nil {
+			return 0, err
+		}
+		for _, key := range keys {
+			resp.Items = append(resp.Items, SyncItem{Kind: "key", Data: map[string]string{
+				"username":  key.Username,
+				"publicKey": base64.StdEncoding.EncodeToString(key.PublicKey),
+			}})
+			cursor.After = key.Username
+		}
+		return len(keys), nil
+	case syncMessages:
+		envelopes, err := s.messages.ListForUser(username, time.UnixMilli(cursor.Since), cursor.AfterID, limit)
+		if err != nil {
+			return 0, err
+		}
+		for _, env := range envelopes {
+			resp.Items = append(resp.Items, SyncItem{Kind: "message", Data: env})
+			cursor.AfterID = env.ID
+		}
+		return len(envelopes), nil
+	}
+	return 0, nil
+}
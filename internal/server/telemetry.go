@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/Chase-Garrett/meadowlark/internal/config"
+	"github.com/Chase-Garrett/meadowlark/internal/telemetry"
+)
+
+// telemetryTimeout bounds gathering and sending one report
+const telemetryTimeout = 30 * time.Second
+
+// newTelemetryReporter returns the reporter selected in cfg, a no-op unless the operator
+// set an endpoint
+func newTelemetryReporter(cfg *config.Config, proxy *url.URL) (telemetry.Reporter, error) {
+	if cfg.TelemetryEndpoint == "" {
+		return telemetry.Noop{}, nil
+	}
+	endpoint, err := url.Parse(cfg.TelemetryEndpoint)
+	if err != nil || (endpoint.Scheme != "https" && endpoint.Scheme != "http") || endpoint.Host == "" {
+		return nil, fmt.Errorf("%q is not an http:// or https:// URL", cfg.TelemetryEndpoint)
+	}
+	return &telemetry.HTTPReporter{Endpoint: cfg.TelemetryEndpoint, HTTP: outboundClient(proxy, 10*time.Second)}, nil
+}
+
+// telemetryReport gathers the report that would be sent now
+func (s *Server) telemetryReport() (telemetry.Report, error) {
+	summary, err := s.stats.Summary(1)
+	if err != nil {
+		return telemetry.Report{}, err
+	}
+	var features []string
+	for name, enabled := range s.features() {
+		if enabled {
+			features = append(features, name)
+		}
+	}
+	sort.Strings(features)
+	return telemetry.NewReport(summary.Users, features), nil
+}
+
+// runTelemetry sends a report shortly after startup and then every interval
+func (s *Server) runTelemetry(interval time.Duration) {
+	if _, ok := s.telemetry.(telemetry.Noop); ok || interval <= 0 {
+		return
+	}
+	log.Printf("Anonymous telemetry is on, reporting to %s every %v", s.config.TelemetryEndpoint, interval)
+	// a server restarting in a loop shouldn't send a report each time
+	timer := time.NewTimer(time.Minute)
+	defer timer.Stop()
+	for range timer.C {
+		report, err := s.telemetryReport()
+		if err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), telemetryTimeout)
+			err = s.telemetry.Report(ctx, report)
+			cancel()
+		}
+		if err != nil {
+			log.Printf("Error sending telemetry report: %v", err)
+		}
+		timer.Reset(interval)
+	}
+}
+
+// HandleTelemetry shows admins whether telemetry is on and exactly what a report contains
+func (s *Server) HandleTelemetry(w http.ResponseWriter, r *http.Request) {
+	report, err := s.telemetryReport()
+	if err != nil {
+		respondInternalError(w, err)
+		return
+	}
+	_, off := s.telemetry.(telemetry.Noop)
+	resp := map[string]interface{}{"enabled": !off, "report": report}
+	if !off {
+		resp["endpoint"] = s.config.TelemetryEndpoint
+		resp["intervalSeconds"] = int64(s.config.TelemetryInterval.Seconds())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/Chase-Garrett/meadowlark/internal/config"
+)
+
+// tenantName keeps workspace names usable in paths, keys and variable names
+var tenantName = regexp.MustCompile(`^[a-z0-9][a-z0-9_]*$`)
+
+// workspace is a tenant served by the process: a Server of its own on its own database
+type workspace struct {
+	name     string
+	basePath string // the main base path and the workspace's prefix
+	server   *Server
+	handler  http.Handler
+}
+
+// workspaces picks the workspace a request is for by host name, then by URL prefix
+type workspaces struct {
+	all      []*workspace
+	hosts    map[string]*workspace
+	prefixed []*workspace
+}
+
+// startTenants starts a server for each configured workspace, exiting on configuration errors
+func startTenants(cfg *config.Config) *workspaces {
+	ws := &workspaces{hosts: make(map[string]*workspace)}
+	names := make(map[string]bool)
+	for _, t := range cfg.Tenants {
+		if !tenantName.MatchString(t.Name) {
+			log.Fatalf("Invalid workspace name %q: use lowercase letters, digits and underscores", t.Name)
+		}
+		if names[t.Name] {
+			log.Fatalf("Workspace %s is listed twice in MEADOWLARK_TENANTS", t.Name)
+		}
+		names[t.Name] = true
+		if len(t.Hosts) == 0 && t.Prefix == "" {
+			log.Fatalf("Workspace %s needs MEADOWLARK_TENANT_%s_HOSTS or _PREFIX", t.Name, strings.ToUpper(t.Name))
+		}
+
+		tcfg := cfg.ForTenant(t)
+		if !cfg.Dev {
+			if err := os.MkdirAll(t.DataDir, 0700); err != nil {
+				log.Fatalf("Failed to create the data directory of workspace %s: %v", t.Name, err)
+			}
+		}
+		server := NewServer(tcfg)
+		if err := stampSchemaVersion(server.userStorage.DB()); err != nil {
+			log.Printf("Error recording the schema version of workspace %s: %v", t.Name, err)
+		}
+		if cfg.Dev {
+			server.seedDevFixtures()
+		}
+		server.scheduleJobs()
+		server.jobs.Start()
+
+		mux := http.NewServeMux()
+		registerRoutes(mux, server, tcfg)
+		w := &workspace{name: t.Name, basePath: tcfg.BasePath, server: server, handler: withBasePath(tcfg.BasePath, mux)}
+		ws.all = append(ws.all, w)
+		for _, host := range t.Hosts {
+			host = strings.ToLower(host)
+			if other, ok := ws.hosts[host]; ok {
+				log.Fatalf("Workspaces %s and %s both serve %s", other.name, t.Name, host)
+			}
+			ws.hosts[host] = w
+		}
+		if t.Prefix != "" {
+			ws.prefixed = append(ws.prefixed, w)
+		}
+		hosts := strings.Join(t.Hosts, ", ")
+		if hosts == "" {
+			hosts = "any host"
+		}
+		log.Printf("Workspace %s served on %s under %s/", t.Name, hosts, tcfg.BasePath)
+	}
+	return ws
+}
+
+// route sends requests for a workspace to it and every other one to main
+func (ws *workspaces) route(main http.Handler) http.Handler {
+	if len(ws.all) == 0 {
+		return main
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if tenant, ok := ws.hosts[strings.ToLower(host)]; ok {
+			tenant.handler.ServeHTTP(w, r)
+			return
+		}
+		for _, tenant := range ws.prefixed {
+			if r.URL.Path == tenant.basePath || strings.HasPrefix(r.URL.Path, tenant.basePath+"/") {
+				tenant.handler.ServeHTTP(w, r)
+				return
+			}
+		}
+		main.ServeHTTP(w, r)
+	})
+}
+
+// close saves and releases every workspace once the HTTP server has stopped
+func (ws *workspaces) close() {
+	for _, tenant := range ws.all {
+		tenant.server.close()
+	}
+}
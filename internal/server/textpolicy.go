@@ -0,0 +1,91 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/Chase-Garrett/meadowlark/internal/apierror"
+	"github.com/Chase-Garrett/meadowlark/internal/config"
+	"github.com/Chase-Garrett/meadowlark/internal/textpolicy"
+)
+
+// newTextPolicy builds the checks on plaintext metadata from cfg
+func newTextPolicy(cfg *config.Config) (*textpolicy.Policy, error) {
+	words := cfg.BlockedWords
+	if cfg.BlockedWordsFile != "" {
+		f, err := os.Open(cfg.BlockedWordsFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			// blank lines and # comments are skipped
+			if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+				words = append(words, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return textpolicy.New(textpolicy.Config{
+		Rules: map[string]textpolicy.Rule{
+			textpolicy.Username:        {MaxLength: cfg.UsernameMaxLength, Required: true, Identifier: true},
+			textpolicy.RoomName:        {MaxLength: cfg.RoomNameMaxLength, Required: true, Links: cfg.MetadataLinks},
+			textpolicy.RoomTopic:       {MaxLength: cfg.RoomTopicMaxLength, Links: cfg.MetadataLinks},
+			textpolicy.RoomDescription: {MaxLength: cfg.RoomDescriptionMaxLength, Multiline: true, Links: cfg.MetadataLinks},
+			// rules often link to a longer code of conduct
+			textpolicy.RoomRules:        {MaxLength: cfg.RoomDescriptionMaxLength, Multiline: true, Links: cfg.MetadataLinks},
+			textpolicy.RoomJoinQuestion: {MaxLength: cfg.RoomTopicMaxLength, Links: cfg.MetadataLinks},
+			textpolicy.PublicPost:       {MaxLength: cfg.RoomDescriptionMaxLength, Required: true, Multiline: true, Links: cfg.MetadataLinks},
+			// events may be titled and placed only in their encrypted content
+			textpolicy.EventTitle:    {MaxLength: cfg.RoomNameMaxLength, Links: cfg.MetadataLinks},
+			textpolicy.EventLocation: {MaxLength: cfg.RoomTopicMaxLength, Links: cfg.MetadataLinks},
+		},
+		BlockedWords:  words,
+		BlockedAction: cfg.BlockedWordsAction,
+	})
+}
+
+// textPolicyError maps a rejected metadata field to an API error, nil if err isn't a *textpolicy.Error.
+// Length problems keep the error code each field had before the policy existed
+func textPolicyError(err error) *apierror.Error {
+	var rejected *textpolicy.Error
+	if !errors.As(err, &rejected) {
+		return nil
+	}
+	switch rejected.Reason {
+	case textpolicy.ReasonLink:
+		return apierror.New(http.StatusBadRequest, apierror.LinksNotAllowed).With("field", rejected.Field)
+	case textpolicy.ReasonBlockedWord:
+		return apierror.New(http.StatusBadRequest, apierror.BlockedWord).With("field", rejected.Field)
+	case textpolicy.ReasonInvalidCharacters:
+		return apierror.New(http.StatusBadRequest, apierror.InvalidCharacters).With("field", rejected.Field)
+	}
+
+	code := apierror.InvalidRequest
+	switch rejected.Field {
+	case textpolicy.Username:
+		code = apierror.InvalidUsername
+	case textpolicy.RoomName:
+		code = apierror.InvalidRoomName
+	case textpolicy.RoomTopic:
+		code = apierror.InvalidRoomTopic
+	case textpolicy.RoomDescription:
+		code = apierror.InvalidRoomDescription
+	case textpolicy.RoomRules:
+		code = apierror.InvalidRoomRules
+	case textpolicy.RoomJoinQuestion:
+		code = apierror.InvalidJoinQuestion
+	case textpolicy.PublicPost:
+		code = apierror.InvalidPublicPost
+	case textpolicy.EventTitle, textpolicy.EventLocation:
+		code = apierror.InvalidEventText
+	}
+	return apierror.New(http.StatusBadRequest, code).With("max", rejected.Max)
+}
@@ -0,0 +1,154 @@
+package sessions
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+// connection event kinds
+const (
+	EventConnect         = "connect"
+	EventDisconnect      = "disconnect"
+	EventRejected        = "rejected"         // authenticated but turned away, e.g. too many connections
+	EventPasswordChanged = "password_changed" // every earlier token was revoked
+	EventNewDevice       = "new_device"       // signed in from an IP address and user agent not seen before
+	EventReported        = "reported"         // the user said a new_device event wasn't them
+)
+
+// ErrNotFound is returned for events that don't exist or belong to someone else
+var ErrNotFound = errors.New("event not found")
+
+// maxUserAgent bounds how much of the User-Agent header is stored
+const maxUserAgent = 256
+
+// Event is one entry of a user's connection history
+type Event struct {
+	ID          int64     `json:"id"`
+	Username    string    `json:"-"`
+	Kind        string    `json:"event"`
+	IP          string    `json:"ip"`
+	UserAgent   string    `json:"userAgent,omitempty"`
+	CloseCode   int       `json:"closeCode,omitempty"`
+	CloseReason string    `json:"closeReason,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// Log stores connection events in SQLite
+type Log struct {
+	db *sql.DB
+}
+
+// NewLog initializes the connection_events table on an open database
+func NewLog(db *sql.DB) *Log {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS connection_events (
+		"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+		"username" TEXT NOT NULL,
+		"event" TEXT NOT NULL,
+		"ip" TEXT NOT NULL,
+		"user_agent" TEXT,
+		"close_code" INTEGER,
+		"close_reason" TEXT,
+		"created_at" INTEGER NOT NULL);
+	CREATE INDEX IF NOT EXISTS connection_events_username ON connection_events (username, id);
+	CREATE INDEX IF NOT EXISTS connection_events_created_at ON connection_events (created_at);`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Fatalf("Failed to create connection_events table: %v", err)
+	}
+	createOriginTable(db)
+
+	return &Log{db: db}
+}
+
+// Record stores an event, failures are logged since auditing must not break connections.
+// A nil Log, as servers built without storage have, records nothing
+func (l *Log) Record(e Event) {
+	if l == nil {
+		return
+	}
+	if _, err := l.insert(&e); err != nil {
+		log.Printf("Error recording %s event for %s: %v", e.Kind, e.Username, err)
+	}
+}
+
+// insert stores an event, filling in its id and time
+func (l *Log) insert(e *Event) (int64, error) {
+	e.UserAgent = truncateUserAgent(e.UserAgent)
+	var closeCode interface{}
+	if e.CloseCode != 0 {
+		closeCode = e.CloseCode
+	}
+	e.CreatedAt = time.Now()
+	insertSQL := `INSERT INTO connection_events (username, event, ip, user_agent, close_code, close_reason, created_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?)`
+	res, err := l.db.Exec(insertSQL, e.Username, e.Kind, e.IP, e.UserAgent, closeCode, e.CloseReason, e.CreatedAt.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	e.ID, err = res.LastInsertId()
+	return e.ID, err
+}
+
+// truncateUserAgent bounds how much of a User-Agent header is stored
+func truncateUserAgent(userAgent string) string {
+	if len(userAgent) > maxUserAgent {
+		return userAgent[:maxUserAgent]
+	}
+	return userAgent
+}
+
+// Get returns username's event id, ErrNotFound if there is none
+func (l *Log) Get(username string, id int64) (Event, error) {
+	querySQL := `SELECT event, ip, COALESCE(user_agent, ''), COALESCE(close_code, 0), COALESCE(close_reason, ''), created_at
+	FROM connection_events WHERE username = ? AND id = ?`
+	e := Event{ID: id, Username: username}
+	var createdAt int64
+	err := l.db.QueryRow(querySQL, username, id).Scan(&e.Kind, &e.IP, &e.UserAgent, &e.CloseCode, &e.CloseReason, &createdAt)
+	if err == sql.ErrNoRows {
+		return Event{}, ErrNotFound
+	}
+	if err != nil {
+		return Event{}, err
+	}
+	e.CreatedAt = time.UnixMilli(createdAt)
+	return e, nil
+}
+
+// History returns up to limit events for username older than beforeID (0 for the newest), newest first
+func (l *Log) History(username string, beforeID int64, limit int) ([]Event, error) {
+	querySQL := `SELECT id, event, ip, COALESCE(user_agent, ''), COALESCE(close_code, 0), COALESCE(close_reason, ''), created_at
+	FROM connection_events WHERE username = ? AND (? = 0 OR id < ?) ORDER BY id DESC LIMIT ?`
+	rows, err := l.db.Query(querySQL, username, beforeID, beforeID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []Event{}
+	for rows.Next() {
+		e := Event{Username: username}
+		var createdAt int64
+		if err := rows.Scan(&e.ID, &e.Kind, &e.IP, &e.UserAgent, &e.CloseCode, &e.CloseReason, &createdAt); err != nil {
+			return nil, err
+		}
+		e.CreatedAt = time.UnixMilli(createdAt)
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// Prune deletes events older than maxAge, and forgets origins not seen for as long
+func (l *Log) Prune(maxAge time.Duration) (int64, error) {
+	cutoff := time.Now().Add(-maxAge).UnixMilli()
+	if _, err := l.db.Exec(`DELETE FROM login_origins WHERE last_seen < ?`, cutoff); err != nil {
+		return 0, err
+	}
+	res, err := l.db.Exec(`DELETE FROM connection_events WHERE created_at < ?`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,74 @@
+package sessions
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// createOriginTable records where each user has signed in from, an IP address and user agent
+// pair, so a sign-in from somewhere new can be pointed out to them
+func createOriginTable(db *sql.DB) {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS login_origins (
+		"username" TEXT NOT NULL,
+		"ip" TEXT NOT NULL,
+		"user_agent" TEXT NOT NULL,
+		"first_seen" INTEGER NOT NULL,
+		"last_seen" INTEGER NOT NULL,
+		PRIMARY KEY (username, ip, user_agent));`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Fatalf("Failed to create login_origins table: %v", err)
+	}
+}
+
+// SeenFrom notes that username signed in from ip with userAgent. The first time the pair is
+// seen it records a new_device event and returns it, unless it is the first origin the user
+// has at all: their first device isn't news to anyone
+func (l *Log) SeenFrom(username, ip, userAgent string) (*Event, error) {
+	userAgent = truncateUserAgent(userAgent)
+	now := time.Now().UnixMilli()
+
+	tx, err := l.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE login_origins SET last_seen = ? WHERE username = ? AND ip = ? AND user_agent = ?`,
+		now, username, ip, userAgent)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return nil, tx.Commit()
+	}
+	var known bool
+	if err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM login_origins WHERE username = ?)`, username).Scan(&known); err != nil {
+		return nil, err
+	}
+	insertSQL := `INSERT INTO login_origins (username, ip, user_agent, first_seen, last_seen) VALUES (?, ?, ?, ?, ?)`
+	if _, err := tx.Exec(insertSQL, username, ip, userAgent, now, now); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	if !known {
+		return nil, nil
+	}
+
+	e := &Event{Username: username, Kind: EventNewDevice, IP: ip, UserAgent: userAgent}
+	if _, err := l.insert(e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// ForgetOrigin drops a pair recorded by SeenFrom, so signing in from it is news again
+func (l *Log) ForgetOrigin(username, ip, userAgent string) error {
+	_, err := l.db.Exec(`DELETE FROM login_origins WHERE username = ? AND ip = ? AND user_agent = ?`,
+		username, ip, truncateUserAgent(userAgent))
+	return err
+}
@@ -0,0 +1,67 @@
+package sms
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Sender delivers text messages
+type Sender interface {
+	Send(ctx context.Context, to, body string) error
+}
+
+// LogSender writes messages to the server log instead of sending them, for development
+type LogSender struct{}
+
+// Send logs the message
+func (LogSender) Send(ctx context.Context, to, body string) error {
+	log.Printf("SMS to %s: %s", to, body)
+	return nil
+}
+
+// TwilioSender sends messages through the Twilio REST API
+type TwilioSender struct {
+	AccountSID string
+	AuthToken  string
+	From       string
+	HTTP       *http.Client // optional, defaults to a client with a 10s timeout
+	BaseURL    string       // optional, for testing against a mock
+}
+
+// Send posts the message to Twilio
+func (t *TwilioSender) Send(ctx context.Context, to, body string) error {
+	base := t.BaseURL
+	if base == "" {
+		base = "https://api.twilio.com"
+	}
+	client := t.HTTP
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	form := url.Values{"To": {to}, "From": {t.From}, "Body": {body}}
+	endpoint := fmt.Sprintf("%s/2010-04-01/Accounts/%s/Messages.json", base, url.PathEscape(t.AccountSID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(t.AccountSID, t.AuthToken)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("twilio: %s: %s", resp.Status, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
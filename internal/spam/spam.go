@@ -0,0 +1,177 @@
+package spam
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// actions the filter can take on a message, in increasing severity
+const (
+	ActionAllow    = "allow"
+	ActionFlag     = "flag"     // deliver, but record the sender for admin review
+	ActionThrottle = "throttle" // reject and tell the sender to slow down
+	ActionShadow   = "shadow"   // accept silently but hold the message for review
+)
+
+// Config holds the thresholds used to score senders
+type Config struct {
+	Enabled       bool
+	RatePerMinute int           // messages per minute considered normal
+	FanoutPerHour int           // distinct non-contact recipients per hour considered normal
+	NewAccountAge time.Duration // accounts younger than this score double
+
+	// a score of 1 means a sender is exactly at one of the normal limits
+	FlagScore     float64
+	ThrottleScore float64
+	ShadowScore   float64
+}
+
+// Verdict is the result of scoring one message
+type Verdict struct {
+	Score   float64
+	Action  string
+	Reasons []string
+}
+
+// senderActivity is the recent metadata seen for one sender
+type senderActivity struct {
+	sent       []time.Time          // send times within the last minute
+	nonContact map[string]time.Time // non-contact recipients and when they were last messaged
+	lastFlag   time.Time
+}
+
+// Filter scores senders using only metadata the server can see
+type Filter struct {
+	cfg     Config
+	mu      sync.Mutex
+	senders map[string]*senderActivity
+	store   *Storage
+}
+
+// NewFilter creates a filter recording flags and held messages in store
+func NewFilter(cfg Config, store *Storage) *Filter {
+	return &Filter{
+		cfg:     cfg,
+		senders: make(map[string]*senderActivity),
+		store:   store,
+	}
+}
+
+// Check scores a message from sender to recipient
+// accountCreated is the sender's registration time, zero if unknown
+func (f *Filter) Check(sender, recipient string, isContact bool, accountCreated time.Time) Verdict {
+	if !f.cfg.Enabled {
+		return Verdict{Action: ActionAllow}
+	}
+
+	now := time.Now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	activity, ok := f.senders[sender]
+	if !ok {
+		activity = &senderActivity{nonContact: make(map[string]time.Time)}
+		f.senders[sender] = activity
+	}
+	activity.prune(now)
+	activity.sent = append(activity.sent, now)
+	if !isContact {
+		activity.nonContact[recipient] = now
+	}
+
+	var verdict Verdict
+	if f.cfg.RatePerMinute > 0 {
+		rate := float64(len(activity.sent)) / float64(f.cfg.RatePerMinute)
+		if rate > 1 {
+			verdict.Reasons = append(verdict.Reasons, fmt.Sprintf("rate %d/min", len(activity.sent)))
+		}
+		verdict.Score += rate
+	}
+	if f.cfg.FanoutPerHour > 0 {
+		fanout := float64(len(activity.nonContact)) / float64(f.cfg.FanoutPerHour)
+		if fanout > 1 {
+			verdict.Reasons = append(verdict.Reasons, fmt.Sprintf("fan-out to %d non-contacts/hour", len(activity.nonContact)))
+		}
+		verdict.Score += fanout
+	}
+	if !accountCreated.IsZero() && now.Sub(accountCreated) < f.cfg.NewAccountAge {
+		verdict.Score *= 2
+		verdict.Reasons = append(verdict.Reasons, "new account")
+	}
+
+	switch {
+	case f.cfg.ShadowScore > 0 && verdict.Score >= f.cfg.ShadowScore:
+		verdict.Action = ActionShadow
+	case f.cfg.ThrottleScore > 0 && verdict.Score >= f.cfg.ThrottleScore:
+		verdict.Action = ActionThrottle
+	case f.cfg.FlagScore > 0 && verdict.Score >= f.cfg.FlagScore:
+		verdict.Action = ActionFlag
+	default:
+		verdict.Action = ActionAllow
+	}
+
+	// throttled messages are never sent, so they shouldn't count against the rate
+	if verdict.Action == ActionThrottle {
+		activity.sent = activity.sent[:len(activity.sent)-1]
+	}
+
+	return verdict
+}
+
+// ShouldRecordFlag reports whether sender hasn't been flagged within the last hour
+// so a single burst produces one review entry rather than hundreds
+func (f *Filter) ShouldRecordFlag(sender string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	activity, ok := f.senders[sender]
+	if !ok || time.Since(activity.lastFlag) < time.Hour {
+		return false
+	}
+	activity.lastFlag = time.Now()
+	return true
+}
+
+// Store returns the storage used for flags and held messages
+func (f *Filter) Store() *Storage {
+	return f.store
+}
+
+// Run periodically forgets idle senders so memory use stays bounded
+func (f *Filter) Run() {
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		f.forget()
+	}
+}
+
+// forget drops the in-memory activity of senders idle for over an hour
+func (f *Filter) forget() {
+	now := time.Now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for sender, activity := range f.senders {
+		activity.prune(now)
+		if len(activity.sent) == 0 && len(activity.nonContact) == 0 && now.Sub(activity.lastFlag) > time.Hour {
+			delete(f.senders, sender)
+		}
+	}
+}
+
+func (a *senderActivity) prune(now time.Time) {
+	cutoff := now.Add(-time.Minute)
+	i := 0
+	for i < len(a.sent) && a.sent[i].Before(cutoff) {
+		i++
+	}
+	a.sent = a.sent[i:]
+
+	hourAgo := now.Add(-time.Hour)
+	for recipient, last := range a.nonContact {
+		if last.Before(hourAgo) {
+			delete(a.nonContact, recipient)
+		}
+	}
+}
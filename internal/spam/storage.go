@@ -0,0 +1,158 @@
+package spam
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"math"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when a held message doesn't exist
+var ErrNotFound = errors.New("held message not found")
+
+// Flag is a sender recorded for admin review
+type Flag struct {
+	ID        int64     `json:"id"`
+	Username  string    `json:"username"`
+	Score     float64   `json:"score"`
+	Action    string    `json:"action"`
+	Reasons   string    `json:"reasons"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// HeldMessage is a shadow-queued message waiting for review
+type HeldMessage struct {
+	ID        int64     `json:"id"`
+	Sender    string    `json:"sender"`
+	Recipient string    `json:"recipient"`
+	Content   []byte    `json:"-"`
+	Score     float64   `json:"score"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Storage keeps spam flags and held messages in SQLite
+type Storage struct {
+	db *sql.DB
+}
+
+// NewStorage initializes the spam tables on an open database
+func NewStorage(db *sql.DB) *Storage {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS spam_flags (
+		"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+		"username" TEXT NOT NULL,
+		"score" REAL NOT NULL,
+		"action" TEXT NOT NULL,
+		"reasons" TEXT,
+		"created_at" INTEGER NOT NULL);
+	CREATE TABLE IF NOT EXISTS spam_held (
+		"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+		"sender" TEXT NOT NULL,
+		"recipient" TEXT NOT NULL,
+		"content" BLOB,
+		"score" REAL NOT NULL,
+		"created_at" INTEGER NOT NULL);`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Fatalf("Failed to create spam tables: %v", err)
+	}
+
+	return &Storage{db: db}
+}
+
+// RecordFlag stores a review entry for sender
+func (s *Storage) RecordFlag(username string, verdict Verdict) error {
+	insertSQL := `INSERT INTO spam_flags (username, score, action, reasons, created_at) VALUES (?, ?, ?, ?, ?)`
+	_, err := s.db.Exec(insertSQL, username, verdict.Score, verdict.Action, strings.Join(verdict.Reasons, ", "), time.Now().Unix())
+	return err
+}
+
+// Hold stores a shadow-queued message
+func (s *Storage) Hold(sender, recipient string, content []byte, score float64) error {
+	insertSQL := `INSERT INTO spam_held (sender, recipient, content, score, created_at) VALUES (?, ?, ?, ?, ?)`
+	_, err := s.db.Exec(insertSQL, sender, recipient, content, score, time.Now().Unix())
+	return err
+}
+
+// ListFlags returns the most recent flags with an id below before, 0 for the newest
+func (s *Storage) ListFlags(before int64, limit int) ([]Flag, error) {
+	if before <= 0 {
+		before = math.MaxInt64
+	}
+	rows, err := s.db.Query(`SELECT id, username, score, action, COALESCE(reasons, ''), created_at
+	FROM spam_flags WHERE id < ? ORDER BY id DESC LIMIT ?`, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	flags := []Flag{}
+	for rows.Next() {
+		var flag Flag
+		var createdAt int64
+		if err := rows.Scan(&flag.ID, &flag.Username, &flag.Score, &flag.Action, &flag.Reasons, &createdAt); err != nil {
+			return nil, err
+		}
+		flag.CreatedAt = time.Unix(createdAt, 0)
+		flags = append(flags, flag)
+	}
+	return flags, rows.Err()
+}
+
+// ListHeld returns held messages after the given id, the oldest first or the newest
+// when desc is set. after 0 starts at the beginning
+func (s *Storage) ListHeld(after int64, desc bool, limit int) ([]HeldMessage, error) {
+	where, order := `id > ?`, `id`
+	if desc {
+		where, order = `id < ?`, `id DESC`
+		if after <= 0 {
+			after = math.MaxInt64
+		}
+	}
+	rows, err := s.db.Query(`SELECT id, sender, recipient, score, created_at
+	FROM spam_held WHERE `+where+` ORDER BY `+order+` LIMIT ?`, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	held := []HeldMessage{}
+	for rows.Next() {
+		var msg HeldMessage
+		var createdAt int64
+		if err := rows.Scan(&msg.ID, &msg.Sender, &msg.Recipient, &msg.Score, &createdAt); err != nil {
+			return nil, err
+		}
+		msg.CreatedAt = time.Unix(createdAt, 0)
+		held = append(held, msg)
+	}
+	return held, rows.Err()
+}
+
+// TakeHeld removes a held message and returns it
+func (s *Storage) TakeHeld(id int64) (*HeldMessage, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	msg := &HeldMessage{ID: id}
+	var createdAt int64
+	err = tx.QueryRow(`SELECT sender, recipient, content, score, created_at FROM spam_held WHERE id = ?`, id).
+		Scan(&msg.Sender, &msg.Recipient, &msg.Content, &msg.Score, &createdAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	msg.CreatedAt = time.Unix(createdAt, 0)
+
+	if _, err := tx.Exec(`DELETE FROM spam_held WHERE id = ?`, id); err != nil {
+		return nil, err
+	}
+	return msg, tx.Commit()
+}
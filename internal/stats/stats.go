@@ -0,0 +1,295 @@
+package stats
+
+import (
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+)
+
+// totals tracked across days
+const (
+	TotalUsers               = "users"
+	TotalAttachmentBytes     = "attachment_bytes"
+	TotalDeduplicatedUploads = "deduplicated_uploads" // attachments that reused a stored blob
+)
+
+// activityWindow is how long per-user activity is kept, long enough for monthly actives
+const activityWindow = 31
+
+const dayFormat = "2006-01-02"
+
+// Day is the aggregate for one UTC day
+type Day struct {
+	Date          string `json:"date"`
+	Messages      int64  `json:"messages"`
+	Registrations int64  `json:"registrations"`
+	ActiveUsers   int64  `json:"activeUsers"`
+}
+
+// Summary is the aggregated view served to admins
+type Summary struct {
+	Users               int64 `json:"users"`
+	DailyActiveUsers    int64 `json:"dailyActiveUsers"`
+	MonthlyActiveUsers  int64 `json:"monthlyActiveUsers"`
+	AttachmentBytes     int64 `json:"attachmentBytes"`
+	DeduplicatedUploads int64 `json:"deduplicatedUploads"`
+	DatabaseBytes       int64 `json:"databaseBytes"`
+	Days                []Day `json:"days"` // most recent first
+}
+
+// Collector counts events in memory and periodically folds them into aggregate tables,
+// so reading stats never scans the users or messages tables
+type Collector struct {
+	db *sql.DB
+
+	mu     sync.Mutex
+	days   map[string]*Day            // pending counts per day
+	active map[string]map[string]bool // day -> usernames seen since the last flush
+	totals map[string]int64           // pending deltas
+}
+
+// NewCollector creates the stats tables and seeds totals on first use
+func NewCollector(db *sql.DB) *Collector {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS stats_daily (
+		"day" TEXT NOT NULL PRIMARY KEY,
+		"messages" INTEGER NOT NULL DEFAULT 0,
+		"registrations" INTEGER NOT NULL DEFAULT 0,
+		"active_users" INTEGER NOT NULL DEFAULT 0);
+	CREATE TABLE IF NOT EXISTS stats_totals (
+		"name" TEXT NOT NULL PRIMARY KEY,
+		"value" INTEGER NOT NULL);
+	CREATE TABLE IF NOT EXISTS stats_activity (
+		"day" TEXT NOT NULL,
+		"username" TEXT NOT NULL,
+		PRIMARY KEY ("day", "username"));`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Fatalf("Failed to create stats tables: %v", err)
+	}
+
+	c := &Collector{
+		db:     db,
+		days:   make(map[string]*Day),
+		active: make(map[string]map[string]bool),
+		totals: make(map[string]int64),
+	}
+	if err := c.seed(); err != nil {
+		log.Fatalf("Failed to seed stats: %v", err)
+	}
+	return c
+}
+
+// seed computes totals once for databases that predate stats collection
+func (c *Collector) seed() error {
+	var seeded bool
+	if err := c.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM stats_totals WHERE name = ?)`, TotalUsers).Scan(&seeded); err != nil {
+		return err
+	}
+	if seeded {
+		return nil
+	}
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	seedSQL := `
+	INSERT INTO stats_totals (name, value) SELECT 'users', COUNT(*) FROM users;
+	INSERT OR REPLACE INTO stats_totals (name, value)
+		SELECT 'attachment_bytes', COALESCE(SUM(size), 0) FROM attachments WHERE complete = 1;
+	INSERT OR REPLACE INTO stats_daily (day, messages)
+		SELECT strftime('%Y-%m-%d', created_at / 1000, 'unixepoch'), COUNT(*) FROM messages GROUP BY 1;
+	INSERT INTO stats_daily (day, registrations)
+		SELECT strftime('%Y-%m-%d', created_at, 'unixepoch'), COUNT(*) FROM users WHERE created_at IS NOT NULL GROUP BY 1
+		ON CONFLICT(day) DO UPDATE SET registrations = excluded.registrations;`
+	if _, err := tx.Exec(seedSQL); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (c *Collector) day(now time.Time) *Day {
+	key := now.UTC().Format(dayFormat)
+	d, ok := c.days[key]
+	if !ok {
+		d = &Day{Date: key}
+		c.days[key] = d
+	}
+	return d
+}
+
+// MessageSent counts a delivered or stored chat message
+func (c *Collector) MessageSent() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.day(time.Now()).Messages++
+}
+
+// UserRegistered counts a new account
+func (c *Collector) UserRegistered() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.day(time.Now()).Registrations++
+	c.totals[TotalUsers]++
+}
+
+// UserActive marks username as active today
+func (c *Collector) UserActive(username string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := time.Now().UTC().Format(dayFormat)
+	if c.active[key] == nil {
+		c.active[key] = make(map[string]bool)
+	}
+	c.active[key][username] = true
+}
+
+// AddTotal adjusts a running total such as TotalAttachmentBytes
+func (c *Collector) AddTotal(name string, delta int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.totals[name] += delta
+}
+
+// Flush writes pending counts to the aggregate tables
+func (c *Collector) Flush() error {
+	c.mu.Lock()
+	days, active, totals := c.days, c.active, c.totals
+	c.days = make(map[string]*Day)
+	c.active = make(map[string]map[string]bool)
+	c.totals = make(map[string]int64)
+	c.mu.Unlock()
+
+	err := c.write(days, active, totals)
+	if err != nil {
+		// put the counts back so the next flush retries them
+		c.mu.Lock()
+		for key, d := range days {
+			pending := c.day(mustParseDay(key))
+			pending.Messages += d.Messages
+			pending.Registrations += d.Registrations
+		}
+		for key, users := range active {
+			if c.active[key] == nil {
+				c.active[key] = make(map[string]bool)
+			}
+			for u := range users {
+				c.active[key][u] = true
+			}
+		}
+		for name, delta := range totals {
+			c.totals[name] += delta
+		}
+		c.mu.Unlock()
+	}
+	return err
+}
+
+func (c *Collector) write(days map[string]*Day, active map[string]map[string]bool, totals map[string]int64) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for key, d := range days {
+		upsertSQL := `INSERT INTO stats_daily (day, messages, registrations) VALUES (?, ?, ?)
+		ON CONFLICT(day) DO UPDATE SET messages = messages + excluded.messages, registrations = registrations + excluded.registrations`
+		if _, err := tx.Exec(upsertSQL, key, d.Messages, d.Registrations); err != nil {
+			return err
+		}
+	}
+	for key, users := range active {
+		for username := range users {
+			if _, err := tx.Exec(`INSERT OR IGNORE INTO stats_activity (day, username) VALUES (?, ?)`, key, username); err != nil {
+				return err
+			}
+		}
+		// active users only grow during a day, so the count for touched days is refreshed here
+		refreshSQL := `INSERT INTO stats_daily (day, active_users) VALUES (?, (SELECT COUNT(*) FROM stats_activity WHERE day = ?))
+		ON CONFLICT(day) DO UPDATE SET active_users = excluded.active_users`
+		if _, err := tx.Exec(refreshSQL, key, key); err != nil {
+			return err
+		}
+	}
+	for name, delta := range totals {
+		upsertSQL := `INSERT INTO stats_totals (name, value) VALUES (?, ?)
+		ON CONFLICT(name) DO UPDATE SET value = value + excluded.value`
+		if _, err := tx.Exec(upsertSQL, name, delta); err != nil {
+			return err
+		}
+	}
+
+	cutoff := time.Now().UTC().AddDate(0, 0, -activityWindow).Format(dayFormat)
+	if _, err := tx.Exec(`DELETE FROM stats_activity WHERE day < ?`, cutoff); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Summary flushes pending counts and returns totals plus the last n days
+func (c *Collector) Summary(n int) (*Summary, error) {
+	if err := c.Flush(); err != nil {
+		return nil, err
+	}
+
+	summary := &Summary{Days: []Day{}}
+	rows, err := c.db.Query(`SELECT name, value FROM stats_totals`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var name string
+		var value int64
+		if err := rows.Scan(&name, &value); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		switch name {
+		case TotalUsers:
+			summary.Users = value
+		case TotalAttachmentBytes:
+			summary.AttachmentBytes = value
+		case TotalDeduplicatedUploads:
+			summary.DeduplicatedUploads = value
+		}
+	}
+	rows.Close()
+
+	now := time.Now().UTC()
+	today := now.Format(dayFormat)
+	monthStart := now.AddDate(0, 0, -29).Format(dayFormat)
+	if err := c.db.QueryRow(`SELECT COUNT(*) FROM stats_activity WHERE day = ?`, today).Scan(&summary.DailyActiveUsers); err != nil {
+		return nil, err
+	}
+	if err := c.db.QueryRow(`SELECT COUNT(DISTINCT username) FROM stats_activity WHERE day >= ?`, monthStart).Scan(&summary.MonthlyActiveUsers); err != nil {
+		return nil, err
+	}
+	// page counts are kept in the database header, this is not a scan
+	if err := c.db.QueryRow(`SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()`).Scan(&summary.DatabaseBytes); err != nil {
+		return nil, err
+	}
+
+	dayRows, err := c.db.Query(`SELECT day, messages, registrations, active_users FROM stats_daily ORDER BY day DESC LIMIT ?`, n)
+	if err != nil {
+		return nil, err
+	}
+	defer dayRows.Close()
+	for dayRows.Next() {
+		var d Day
+		if err := dayRows.Scan(&d.Date, &d.Messages, &d.Registrations, &d.ActiveUsers); err != nil {
+			return nil, err
+		}
+		summary.Days = append(summary.Days, d)
+	}
+	return summary, dayRows.Err()
+}
+
+func mustParseDay(key string) time.Time {
+	t, _ := time.Parse(dayFormat, key)
+	return t
+}
@@ -0,0 +1,301 @@
+package support
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// MaxMessageLength is the longest support message accepted, in characters
+const MaxMessageLength = 4000
+
+// ticket statuses
+const (
+	StatusOpen   = "open"
+	StatusClosed = "closed"
+)
+
+// errors returned by Storage
+var (
+	ErrNotFound       = errors.New("support ticket not found")
+	ErrTicketClosed   = errors.New("support ticket is closed")
+	ErrInvalidMessage = fmt.Errorf("support messages must be 1 to %d characters", MaxMessageLength)
+)
+
+// Ticket is a conversation between a user and the server's operators
+type Ticket struct {
+	ID        int64     `json:"id"`
+	Username  string    `json:"username"`
+	Status    string    `json:"status"`
+	Waiting   bool      `json:"waiting"` // the latest message is from the user, so an operator owes a reply
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	Messages  []Message `json:"messages,omitempty"`
+}
+
+// Message is one entry of a ticket. Staff replies keep the operator's username
+// for the audit trail, users only ever see them as coming from support
+type Message struct {
+	ID        int64     `json:"id"`
+	Author    string    `json:"author"`
+	Staff     bool      `json:"staff"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Storage keeps support tickets in SQLite
+type Storage struct {
+	db *sql.DB
+}
+
+// NewStorage initializes the support tables on an open database
+func NewStorage(db *sql.DB) *Storage {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS support_tickets (
+		"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+		"username" TEXT NOT NULL,
+		"status" TEXT NOT NULL,
+		"waiting" INTEGER NOT NULL DEFAULT 1,
+		"created_at" INTEGER NOT NULL,
+		"updated_at" INTEGER NOT NULL);
+	CREATE UNIQUE INDEX IF NOT EXISTS support_tickets_open ON support_tickets (username) WHERE status = 'open';
+	CREATE INDEX IF NOT EXISTS support_tickets_status ON support_tickets (status, updated_at);
+	CREATE TABLE IF NOT EXISTS support_messages (
+		"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+		"ticket_id" INTEGER NOT NULL,
+		"author" TEXT NOT NULL,
+		"staff" INTEGER NOT NULL,
+		"body" TEXT NOT NULL,
+		"created_at" INTEGER NOT NULL);
+	CREATE INDEX IF NOT EXISTS support_messages_ticket ON support_messages (ticket_id, id);`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		log.Fatalf("Failed to create support tables: %v", err)
+	}
+
+	return &Storage{db: db}
+}
+
+// validBody trims a message and checks its length
+func validBody(body string) (string, error) {
+	body = strings.TrimSpace(body)
+	if body == "" || utf8.RuneCountInString(body) > MaxMessageLength || !utf8.ValidString(body) {
+		return "", ErrInvalidMessage
+	}
+	return body, nil
+}
+
+// Ask adds a user's message to their open ticket, opening one if they have none, and returns the ticket id
+func (s *Storage) Ask(username, body string) (int64, Message, error) {
+	body, err := validBody(body)
+	if err != nil {
+		return 0, Message{}, err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, Message{}, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	var ticketID int64
+	err = tx.QueryRow(`SELECT id FROM support_tickets WHERE username = ? AND status = 'open'`, username).Scan(&ticketID)
+	if err == sql.ErrNoRows {
+		insertSQL := `INSERT INTO support_tickets (username, status, waiting, created_at, updated_at) VALUES (?, 'open', 1, ?, ?)`
+		res, err := tx.Exec(insertSQL, username, now.UnixMilli(), now.UnixMilli())
+		if err != nil {
+			return 0, Message{}, err
+		}
+		if ticketID, err = res.LastInsertId(); err != nil {
+			return 0, Message{}, err
+		}
+	} else if err != nil {
+		return 0, Message{}, err
+	}
+
+	msg, err := addMessage(tx, ticketID, username, false, body, now)
+	if err != nil {
+		return 0, Message{}, err
+	}
+	return ticketID, msg, tx.Commit()
+}
+
+// Reply adds an operator's answer to an open ticket and returns the ticket's owner
+func (s *Storage) Reply(ticketID int64, staff, body string) (string, Message, error) {
+	body, err := validBody(body)
+	if err != nil {
+		return "", Message{}, err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", Message{}, err
+	}
+	defer tx.Rollback()
+
+	var username, status string
+	err = tx.QueryRow(`SELECT username, status FROM support_tickets WHERE id = ?`, ticketID).Scan(&username, &status)
+	if err == sql.ErrNoRows {
+		return "", Message{}, ErrNotFound
+	}
+	if err != nil {
+		return "", Message{}, err
+	}
+	if status != StatusOpen {
+		return "", Message{}, ErrTicketClosed
+	}
+
+	msg, err := addMessage(tx, ticketID, staff, true, body, time.Now())
+	if err != nil {
+		return "", Message{}, err
+	}
+	return username, msg, tx.Commit()
+}
+
+func addMessage(tx *sql.Tx, ticketID int64, author string, staff bool, body string, now time.Time) (Message, error) {
+	msg := Message{Author: author, Staff: staff, Body: body, CreatedAt: time.UnixMilli(now.UnixMilli())}
+	insertSQL := `INSERT INTO support_messages (ticket_id, author, staff, body, created_at) VALUES (?, ?, ?, ?, ?)`
+	res, err := tx.Exec(insertSQL, ticketID, author, staff, body, now.UnixMilli())
+	if err != nil {
+		return Message{}, err
+	}
+	if msg.ID, err = res.LastInsertId(); err != nil {
+		return Message{}, err
+	}
+	_, err = tx.Exec(`UPDATE support_tickets SET waiting = ?, updated_at = ? WHERE id = ?`, !staff, now.UnixMilli(), ticketID)
+	return msg, err
+}
+
+// Close marks a ticket as resolved and returns its owner, the user's next message opens a new one
+func (s *Storage) Close(ticketID int64) (string, error) {
+	var username string
+	updateSQL := `UPDATE support_tickets SET status = 'closed', waiting = 0, updated_at = ? WHERE id = ? AND status = 'open' RETURNING username`
+	err := s.db.QueryRow(updateSQL, time.Now().UnixMilli(), ticketID).Scan(&username)
+	if err == sql.ErrNoRows {
+		var exists bool
+		if err := s.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM support_tickets WHERE id = ?)`, ticketID).Scan(&exists); err != nil {
+			return "", err
+		}
+		if !exists {
+			return "", ErrNotFound
+		}
+		return "", ErrTicketClosed
+	}
+	return username, err
+}
+
+const ticketColumns = `id, username, status, waiting, created_at, updated_at`
+
+func scanTicket(scan func(dest ...interface{}) error) (Ticket, error) {
+	var t Ticket
+	var createdAt, updatedAt int64
+	err := scan(&t.ID, &t.Username, &t.Status, &t.Waiting, &createdAt, &updatedAt)
+	t.CreatedAt = time.UnixMilli(createdAt)
+	t.UpdatedAt = time.UnixMilli(updatedAt)
+	return t, err
+}
+
+// QueueCursor is where the previous queue page stopped
+type QueueCursor struct {
+	Waiting   bool  `json:"w"`
+	UpdatedAt int64 `json:"u"` // unix millis
+	ID        int64 `json:"i"`
+}
+
+// Queue lists tickets with the given status, those waiting longest for a reply first,
+// starting after cursor (nil for the first page)
+func (s *Storage) Queue(status string, after *QueueCursor, limit int) ([]Ticket, error) {
+	where := `status = ?`
+	args := []interface{}{status}
+	if after != nil {
+		where += ` AND (waiting < ? OR (waiting = ? AND (updated_at > ? OR (updated_at = ? AND id > ?))))`
+		args = append(args, after.Waiting, after.Waiting, after.UpdatedAt, after.UpdatedAt, after.ID)
+	}
+	args = append(args, limit)
+
+	querySQL := `SELECT ` + ticketColumns + ` FROM support_tickets WHERE ` + where + ` ORDER BY waiting DESC, updated_at, id LIMIT ?`
+	rows, err := s.db.Query(querySQL, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tickets := []Ticket{}
+	for rows.Next() {
+		t, err := scanTicket(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		tickets = append(tickets, t)
+	}
+	return tickets, rows.Err()
+}
+
+// Ticket returns a ticket with all its messages
+func (s *Storage) Ticket(ticketID int64) (*Ticket, error) {
+	t, err := scanTicket(s.db.QueryRow(`SELECT `+ticketColumns+` FROM support_tickets WHERE id = ?`, ticketID).Scan)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if t.Messages, err = s.messages(t.ID); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// Tickets returns a user's tickets with their messages, newest first
+func (s *Storage) Tickets(username string, limit int) ([]Ticket, error) {
+	querySQL := `SELECT ` + ticketColumns + ` FROM support_tickets WHERE username = ? ORDER BY id DESC LIMIT ?`
+	rows, err := s.db.Query(querySQL, username, limit)
+	if err != nil {
+		return nil, err
+	}
+	tickets := []Ticket{}
+	for rows.Next() {
+		t, err := scanTicket(rows.Scan)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tickets = append(tickets, t)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range tickets {
+		if tickets[i].Messages, err = s.messages(tickets[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return tickets, nil
+}
+
+func (s *Storage) messages(ticketID int64) ([]Message, error) {
+	querySQL := `SELECT id, author, staff, body, created_at FROM support_messages WHERE ticket_id = ? ORDER BY id`
+	rows, err := s.db.Query(querySQL, ticketID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		var m Message
+		var createdAt int64
+		if err := rows.Scan(&m.ID, &m.Author, &m.Staff, &m.Body, &createdAt); err != nil {
+			return nil, err
+		}
+		m.CreatedAt = time.UnixMilli(createdAt)
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
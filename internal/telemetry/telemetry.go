@@ -0,0 +1,115 @@
+// Package telemetry reports anonymous, aggregate facts about a deployment to an endpoint
+// the operator chose, so maintainers can see which versions and features are in use.
+// Nothing is sent unless a reporter other than Noop is configured
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// Report is everything one report contains. It never carries usernames, addresses,
+// hostnames or exact counts
+type Report struct {
+	Version   string    `json:"version"`
+	GoVersion string    `json:"goVersion"`
+	OS        string    `json:"os"`
+	Arch      string    `json:"arch"`
+	Users     string    `json:"users"`    // a bucket from UserBucket
+	Features  []string  `json:"features"` // enabled optional features, sorted
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// NewReport fills in the build and platform fields around the counters the caller gathered
+func NewReport(users int64, features []string) Report {
+	return Report{
+		Version:   Version(),
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		Users:     UserBucket(users),
+		Features:  features,
+		Timestamp: time.Now().UTC().Truncate(time.Hour), // no finer than needed to tell reports apart
+	}
+}
+
+// Reporter delivers reports
+type Reporter interface {
+	Report(ctx context.Context, report Report) error
+}
+
+// Noop discards reports, the default until an operator opts in
+type Noop struct{}
+
+// Report does nothing
+func (Noop) Report(ctx context.Context, report Report) error {
+	return nil
+}
+
+// HTTPReporter posts reports as JSON to an endpoint
+type HTTPReporter struct {
+	Endpoint string
+	HTTP     *http.Client // optional, defaults to a client with a 10s timeout
+}
+
+// Report posts report to the endpoint
+func (h *HTTPReporter) Report(ctx context.Context, report Report) error {
+	client := h.HTTP
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "meadowlark-telemetry")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("telemetry: %s: %s", resp.Status, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
+
+// UserBucket places an account count between powers of ten, so reports show the size
+// of a deployment without its exact number of users
+func UserBucket(users int64) string {
+	if users <= 0 {
+		return "0"
+	}
+	low, high := int64(1), int64(10)
+	for users > high {
+		if high == 1_000_000 {
+			return "1000001+"
+		}
+		low, high = high+1, high*10
+	}
+	return fmt.Sprintf("%d-%d", low, high)
+}
+
+// Version is the module version the server was built from, "devel" for local builds
+func Version() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok || info.Main.Version == "" || info.Main.Version == "(devel)" {
+		return "devel"
+	}
+	return info.Main.Version
+}
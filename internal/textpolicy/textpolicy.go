@@ -0,0 +1,201 @@
+// Package textpolicy validates the plaintext metadata the server stores and shows to other
+// users, such as usernames and room settings, so every place accepting it applies the same rules
+package textpolicy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// fields checked by a Policy, also reported in errors
+const (
+	Username         = "username"
+	RoomName         = "roomName"
+	RoomTopic        = "roomTopic"
+	RoomDescription  = "roomDescription"
+	RoomRules        = "roomRules"
+	RoomJoinQuestion = "roomJoinQuestion"
+	PublicPost       = "publicPost"
+	EventTitle       = "eventTitle"
+	EventLocation    = "eventLocation"
+)
+
+// what happens to links in a field
+const (
+	LinksAllow  = "allow"
+	LinksStrip  = "strip"
+	LinksReject = "reject"
+)
+
+// what happens to blocked words in fields that aren't identifiers
+const (
+	BlockedReject = "reject"
+	BlockedMask   = "mask"
+)
+
+// reasons reported in errors
+const (
+	ReasonRequired          = "required"
+	ReasonTooLong           = "too_long"
+	ReasonInvalidCharacters = "invalid_characters"
+	ReasonLink              = "link"
+	ReasonBlockedWord       = "blocked_word"
+)
+
+var (
+	linkPattern  = regexp.MustCompile(`(?i)\b(?:[a-z][a-z0-9+.-]*://|www\.)[^\s<>"]+`)
+	spacePattern = regexp.MustCompile(`[ \t]{2,}`)
+)
+
+// Rule is how one field is checked
+type Rule struct {
+	MaxLength  int  // in characters, 0 for no limit
+	Required   bool // empty values are rejected
+	Identifier bool // no whitespace, and blocked words are always rejected since masking would change the name
+	Multiline  bool // newlines and tabs are allowed
+	Links      string
+}
+
+// Config is the settings a Policy is built from
+type Config struct {
+	Rules         map[string]Rule
+	BlockedWords  []string // matched case insensitively, as whole words except in identifiers
+	BlockedAction string   // BlockedReject or BlockedMask
+}
+
+// Policy checks and cleans metadata fields
+type Policy struct {
+	rules      map[string]Rule
+	words      *regexp.Regexp // whole words
+	substrings *regexp.Regexp // anywhere, for identifiers
+	action     string
+}
+
+// Error explains why a value was rejected
+type Error struct {
+	Field  string
+	Reason string
+	Max    int // the length limit, for ReasonTooLong and ReasonRequired
+}
+
+func (e *Error) Error() string {
+	switch e.Reason {
+	case ReasonRequired, ReasonTooLong:
+		return fmt.Sprintf("%s must be 1 to %d characters", e.Field, e.Max)
+	case ReasonInvalidCharacters:
+		return fmt.Sprintf("%s contains characters that aren't allowed", e.Field)
+	case ReasonLink:
+		return fmt.Sprintf("%s can't contain links", e.Field)
+	default:
+		return fmt.Sprintf("%s contains a blocked word", e.Field)
+	}
+}
+
+// New builds a policy, fields without a rule are only trimmed and checked for control characters
+func New(cfg Config) (*Policy, error) {
+	p := &Policy{rules: cfg.Rules, action: cfg.BlockedAction}
+	if p.action == "" {
+		p.action = BlockedReject
+	}
+	if p.action != BlockedReject && p.action != BlockedMask {
+		return nil, fmt.Errorf("unknown blocked word action %q, expected reject or mask", cfg.BlockedAction)
+	}
+	for field, rule := range cfg.Rules {
+		switch rule.Links {
+		case "", LinksAllow, LinksStrip, LinksReject:
+		default:
+			return nil, fmt.Errorf("%s: unknown link handling %q, expected allow, strip or reject", field, rule.Links)
+		}
+	}
+
+	var quoted []string
+	for _, word := range cfg.BlockedWords {
+		if word = strings.TrimSpace(word); word != "" {
+			quoted = append(quoted, regexp.QuoteMeta(word))
+		}
+	}
+	if len(quoted) > 0 {
+		alternatives := strings.Join(quoted, "|")
+		p.words = regexp.MustCompile(`(?i)\b(?:` + alternatives + `)\b`)
+		p.substrings = regexp.MustCompile(`(?i)(?:` + alternatives + `)`)
+	}
+	return p, nil
+}
+
+// MaxLength returns the length limit of a field, 0 if it has none
+func (p *Policy) MaxLength(field string) int {
+	return p.rules[field].MaxLength
+}
+
+// Clean trims value and applies the rule for field, returning the value to store
+// or an *Error. Links may be stripped and blocked words masked, depending on the rule.
+// Identifiers are never changed, surrounding whitespace is rejected like any other
+func (p *Policy) Clean(field, value string) (string, error) {
+	rule := p.rules[field]
+	if !rule.Identifier {
+		value = strings.TrimSpace(value)
+	}
+	if !utf8.ValidString(value) {
+		return "", &Error{Field: field, Reason: ReasonInvalidCharacters}
+	}
+	for _, r := range value {
+		if !allowedRune(r, rule) {
+			return "", &Error{Field: field, Reason: ReasonInvalidCharacters}
+		}
+	}
+
+	links := rule.Links
+	if rule.Identifier {
+		links = LinksReject
+	}
+	switch links {
+	case LinksReject:
+		if linkPattern.MatchString(value) {
+			return "", &Error{Field: field, Reason: ReasonLink}
+		}
+	case LinksStrip:
+		if linkPattern.MatchString(value) {
+			value = linkPattern.ReplaceAllString(value, "")
+			value = strings.TrimSpace(spacePattern.ReplaceAllString(value, " "))
+		}
+	}
+
+	if rule.Identifier && p.substrings != nil && p.substrings.MatchString(value) {
+		return "", &Error{Field: field, Reason: ReasonBlockedWord}
+	}
+	if !rule.Identifier && p.words != nil && p.words.MatchString(value) {
+		if p.action == BlockedReject {
+			return "", &Error{Field: field, Reason: ReasonBlockedWord}
+		}
+		value = p.words.ReplaceAllStringFunc(value, func(word string) string {
+			return strings.Repeat("*", utf8.RuneCountInString(word))
+		})
+	}
+
+	if value == "" && rule.Required {
+		return "", &Error{Field: field, Reason: ReasonRequired, Max: rule.MaxLength}
+	}
+	if rule.MaxLength > 0 && utf8.RuneCountInString(value) > rule.MaxLength {
+		return "", &Error{Field: field, Reason: ReasonTooLong, Max: rule.MaxLength}
+	}
+	return value, nil
+}
+
+// allowedRune rejects control characters and the bidirectional overrides used to
+// make text display differently from what it contains
+func allowedRune(r rune, rule Rule) bool {
+	switch {
+	case r == '\n' || r == '\t':
+		return rule.Multiline
+	case rule.Identifier && unicode.IsSpace(r):
+		return false
+	case unicode.IsControl(r):
+		return false
+	case r >= '\u202a' && r <= '\u202e', r >= '\u2066' && r <= '\u2069':
+		return false
+	}
+	return true
+}
@@ -0,0 +1,249 @@
+// Package tor talks to a running tor daemon over its control port to publish onion services.
+// Only the commands needed for that are implemented: PROTOCOLINFO, AUTHENTICATE and ADD_ONION
+package tor
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// HMAC keys from the SAFECOOKIE authentication spec
+const (
+	serverHashKey     = "Tor safe cookie authentication server-to-controller hash"
+	controllerHashKey = "Tor safe cookie authentication controller-to-server hash"
+)
+
+// Controller is an authenticated control port connection.
+// Onion services added through it are removed by tor when it is closed
+type Controller struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// reply is a complete control port response
+type reply struct {
+	code  string
+	lines []string // text of each line without the status code
+}
+
+// Dial connects to the control port at addr, "host:port" or "unix:/path/to/socket",
+// and authenticates with password when given, otherwise with the cookie file tor advertises
+func Dial(addr, password string) (*Controller, error) {
+	network := "tcp"
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		network, addr = "unix", path
+	}
+	conn, err := net.DialTimeout(network, addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c := &Controller{conn: conn, reader: bufio.NewReader(conn)}
+	if err := c.authenticate(password); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close closes the connection, taking down the onion services it added
+func (c *Controller) Close() error {
+	return c.conn.Close()
+}
+
+// Wait blocks until tor closes the connection, for example when it restarts
+func (c *Controller) Wait() error {
+	for {
+		if _, err := c.read(); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *Controller) authenticate(password string) error {
+	info, err := c.command("PROTOCOLINFO 1")
+	if err != nil {
+		return err
+	}
+	var methods []string
+	var cookieFile string
+	for _, line := range info.lines {
+		rest, ok := strings.CutPrefix(line, "AUTH METHODS=")
+		if !ok {
+			continue
+		}
+		list, file, _ := strings.Cut(rest, " COOKIEFILE=")
+		methods = strings.Split(list, ",")
+		cookieFile = unquote(file)
+	}
+
+	switch {
+	case password != "":
+		_, err = c.command("AUTHENTICATE " + quote(password))
+	case contains(methods, "NULL"):
+		_, err = c.command("AUTHENTICATE")
+	case contains(methods, "SAFECOOKIE"):
+		err = c.safeCookie(cookieFile)
+	case contains(methods, "COOKIE"):
+		var cookie []byte
+		if cookie, err = os.ReadFile(cookieFile); err == nil {
+			_, err = c.command("AUTHENTICATE " + hex.EncodeToString(cookie))
+		}
+	default:
+		return fmt.Errorf("tor: no supported authentication method in %v, set a control password", methods)
+	}
+	if err != nil {
+		return fmt.Errorf("tor: authentication failed: %w", err)
+	}
+	return nil
+}
+
+// safeCookie proves knowledge of the cookie without sending it, and checks tor knows it too
+func (c *Controller) safeCookie(cookieFile string) error {
+	cookie, err := os.ReadFile(cookieFile)
+	if err != nil {
+		return err
+	}
+	clientNonce := make([]byte, 32)
+	if _, err := rand.Read(clientNonce); err != nil {
+		return err
+	}
+	challenge, err := c.command("AUTHCHALLENGE SAFECOOKIE " + hex.EncodeToString(clientNonce))
+	if err != nil {
+		return err
+	}
+	fields := keywords(challenge.lines[0])
+	serverHash, err1 := hex.DecodeString(fields["SERVERHASH"])
+	serverNonce, err2 := hex.DecodeString(fields["SERVERNONCE"])
+	if err1 != nil || err2 != nil || len(serverNonce) == 0 {
+		return errors.New("malformed AUTHCHALLENGE reply")
+	}
+
+	message := append(append(append([]byte{}, cookie...), clientNonce...), serverNonce...)
+	if !hmac.Equal(serverHash, safeCookieHash(serverHashKey, message)) {
+		return errors.New("tor does not know the cookie, is this the right control port?")
+	}
+	_, err = c.command("AUTHENTICATE " + hex.EncodeToString(safeCookieHash(controllerHashKey, message)))
+	return err
+}
+
+func safeCookieHash(key string, message []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(message)
+	return mac.Sum(nil)
+}
+
+// AddOnion publishes an onion service forwarding virtualPort to target ("127.0.0.1:8081").
+// key is a private key previously returned, or empty to have tor generate one.
+// It returns the address without ".onion" and, for new services only, the private key
+func (c *Controller) AddOnion(key string, virtualPort int, target string) (serviceID, privateKey string, err error) {
+	keyArg, flags := key, " Flags=DiscardPK"
+	if key == "" {
+		keyArg, flags = "NEW:ED25519-V3", ""
+	}
+	resp, err := c.command(fmt.Sprintf("ADD_ONION %s%s Port=%d,%s", keyArg, flags, virtualPort, target))
+	if err != nil {
+		return "", "", err
+	}
+	for _, line := range resp.lines {
+		if id, ok := strings.CutPrefix(line, "ServiceID="); ok {
+			serviceID = id
+		}
+		if pk, ok := strings.CutPrefix(line, "PrivateKey="); ok {
+			privateKey = pk
+		}
+	}
+	if serviceID == "" {
+		return "", "", errors.New("tor: ADD_ONION reply has no ServiceID")
+	}
+	return serviceID, privateKey, nil
+}
+
+// command sends one line and returns the reply, non-250 codes become errors
+func (c *Controller) command(line string) (*reply, error) {
+	c.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	defer c.conn.SetDeadline(time.Time{})
+	if _, err := c.conn.Write([]byte(line + "\r\n")); err != nil {
+		return nil, err
+	}
+	resp, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+	if resp.code != "250" {
+		return nil, fmt.Errorf("tor: %s %s", resp.code, strings.Join(resp.lines, "; "))
+	}
+	return resp, nil
+}
+
+// read reads one reply: "250-" lines continue it, "250+" starts a data block ending
+// with a lone ".", and "250 " ends it
+func (c *Controller) read() (*reply, error) {
+	resp := &reply{}
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if len(line) < 4 {
+			return nil, fmt.Errorf("tor: malformed reply line %q", line)
+		}
+		resp.code = line[:3]
+		resp.lines = append(resp.lines, line[4:])
+		switch line[3] {
+		case ' ':
+			return resp, nil
+		case '+':
+			for {
+				data, err := c.reader.ReadString('\n')
+				if err != nil {
+					return nil, err
+				}
+				if strings.TrimRight(data, "\r\n") == "." {
+					break
+				}
+			}
+		}
+	}
+}
+
+// keywords parses "KEY=value KEY2=value2" reply text
+func keywords(line string) map[string]string {
+	fields := make(map[string]string)
+	for _, field := range strings.Fields(line) {
+		if k, v, ok := strings.Cut(field, "="); ok {
+			fields[k] = unquote(v)
+		}
+	}
+	return fields
+}
+
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func unquote(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		return strings.NewReplacer(`\\`, `\`, `\"`, `"`).Replace(s[1 : len(s)-1])
+	}
+	return s
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}